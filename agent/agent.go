@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -8,6 +12,7 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/quantizer"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 	log "github.com/cihub/seelog"
 )
@@ -19,6 +24,11 @@ type processedTrace struct {
 	Root      *model.Span
 	Env       string
 	Sublayers []model.SublayerValue
+	Waits     map[uint64]model.SpanWaits // by span ID, see model.ComputeWaits
+
+	// ErrorSample is set if the trace holds the sample of an error type in
+	// the stats, for the sampler to keep it, see Concentrator.SampleErrors
+	ErrorSample bool
 }
 
 func (pt *processedTrace) weight() float64 {
@@ -32,14 +42,21 @@ func (pt *processedTrace) weight() float64 {
 type Agent struct {
 	Receiver     *HTTPReceiver
 	Concentrator *Concentrator
-	Sampler      *Sampler
+	Sampler      *Sampler // nil in stats-only mode
 	Writer       *Writer
 
+	filter        *traceFilter        // drops traces by tag before stats and sampling
+	distributions *distributionClient // sends the distributions of the stats to dogstatsd, nil if disabled
+	timers        *TimerListener      // adds statsd timing metrics to the stats, nil if disabled
+
 	// config
 	conf *config.AgentConfig
+	info model.AgentInfo
 
 	// Used to synchronize on a clean exit
-	exit chan struct{}
+	exit     chan struct{}
+	done     chan struct{} // closed once Run returned, see Start
+	stopOnce sync.Once
 
 	die func(format string, args ...interface{})
 }
@@ -50,23 +67,96 @@ func NewAgent(conf *config.AgentConfig) *Agent {
 
 	r := NewHTTPReceiver(conf)
 	c := NewConcentrator(
-		conf.ExtraAggregators,
+		concentratorAggregators(conf),
 		conf.BucketInterval.Nanoseconds(),
+		conf.MaxDistributions,
 	)
-	s := NewSampler(conf)
+	c.SetPrecisionTiers(conf.PrecisionTiers)
+	c.SetTopResources(conf.TopResources)
+	c.SetQuantileBounds(conf.QuantileBounds)
+	if conf.LatencyAlerts {
+		c.SetLatencyAlerts(conf.LatencyAlertFactor, conf.LatencyAlertMinHits)
+	}
+	quantizer.SetResourceCacheSize(conf.ResourceCacheSize)
+	if conf.SkipFirstPartialBucket {
+		c.FlagPartialBuckets()
+	}
+	if conf.StateDir != "" {
+		path := filepath.Join(conf.StateDir, concentratorStateFile)
+		if err := c.LoadState(path, 2*conf.BucketInterval); err == nil {
+			log.Infof("resumed stats buckets from %s", path)
+		} else if !os.IsNotExist(err) {
+			log.Warnf("ignoring saved stats buckets in %s: %v", path, err)
+		}
+	}
+	// in stats-only mode, nothing is sampled and the clients get the default
+	// rates of the receiver
+	var s *Sampler
+	if !conf.StatsOnly {
+		s = NewSampler(conf)
+		r.rates = s.rates
+	}
 
 	w := NewWriter(conf)
 	w.inServices = r.services
 
+	var d *distributionClient
+	if conf.MetricsStatsdAddr != "" {
+		var err error
+		if d, err = newDistributionClient(conf.MetricsStatsdAddr); err != nil {
+			log.Errorf("cannot send distributions to %s: %v", conf.MetricsStatsdAddr, err)
+		}
+	}
+
+	var timers *TimerListener
+	if conf.TimersPort != 0 {
+		timers = NewTimerListener(conf, c)
+	}
+
 	return &Agent{
-		Receiver:     r,
-		Concentrator: c,
-		Sampler:      s,
-		Writer:       w,
-		conf:         conf,
-		exit:         exit,
-		die:          die,
+		Receiver:      r,
+		Concentrator:  c,
+		Sampler:       s,
+		Writer:        w,
+		filter:        newTraceFilter(conf),
+		distributions: d,
+		timers:        timers,
+		conf:          conf,
+		info:          newAgentInfo(conf),
+		exit:          exit,
+		done:          make(chan struct{}),
+		die:           die,
+	}
+}
+
+// concentratorAggregators returns the extra aggregators of the concentrator.
+// With routing, stats are also aggregated by the routing tag so that the
+// writer can split them by route, and with container tagging by the
+// container tags.
+func concentratorAggregators(conf *config.AgentConfig) []string {
+	var tags []string
+	if conf.RoutingTag != "" {
+		tags = append(tags, conf.RoutingTag)
+	}
+	if conf.ContainerTagging {
+		tags = append(tags, containerTagKeys...)
+	}
+
+	aggregators := conf.ExtraAggregators
+	for _, tag := range tags {
+		found := false
+		for _, agg := range aggregators {
+			if agg == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// copied not to append to the config
+			aggregators = append(append([]string{}, aggregators...), tag)
+		}
 	}
+	return aggregators
 }
 
 // Run starts routers routines and individual pieces then stop them when the exit order is received
@@ -80,45 +170,135 @@ func (a *Agent) Run() {
 	watchdogTicker := time.NewTicker(a.conf.WatchdogInterval)
 	defer watchdogTicker.Stop()
 
+	statsTicker := time.NewTicker(processStatsInterval)
+	defer statsTicker.Stop()
+
 	a.Receiver.Run()
 	a.Writer.Run()
-	a.Sampler.Run()
+	if a.timers != nil {
+		addr := fmt.Sprintf("%s:%d", a.conf.ReceiverHost, a.conf.TimersPort)
+		if err := a.timers.Listen(addr); err != nil {
+			log.Error(err)
+			a.timers = nil
+		} else {
+			a.timers.Run()
+		}
+	}
+	if a.Sampler != nil {
+		a.Sampler.Run()
+	}
 
 	for {
 		select {
 		case t := <-a.Receiver.traces:
 			a.Process(t)
+		case t := <-a.Writer.selfTraces:
+			// the trace of a flush goes out with the next one
+			a.process(t, t.GetRoot())
 		case <-flushTicker.C:
-			p := model.AgentPayload{
-				HostName: a.conf.HostName,
-				Env:      a.conf.DefaultEnv,
-			}
-			var wg sync.WaitGroup
-			wg.Add(2)
-			go func() {
-				p.Stats = a.Concentrator.Flush()
-				wg.Done()
-			}()
-			go func() {
-				p.Traces = a.Sampler.Flush()
-				wg.Done()
-			}()
-
-			wg.Wait()
-
-			a.Writer.inPayloads <- p
+			a.flush()
+		case req := <-a.Receiver.flushRequests:
+			req.done(a.flushAll())
 		case <-watchdogTicker.C:
 			a.watchdog()
+		case <-statsTicker.C:
+			a.logProcessStats()
 		case <-a.exit:
 			log.Info("exiting")
 			close(a.Receiver.exit)
+			if a.timers != nil {
+				a.timers.Stop()
+			}
 			a.Writer.Stop()
-			a.Sampler.Stop()
+			if a.Sampler != nil {
+				a.Sampler.Stop()
+			}
+			a.saveState()
 			return
 		}
 	}
 }
 
+// Start runs the agent in the background, until Stop is called
+func (a *Agent) Start() {
+	go func() {
+		a.Run()
+		close(a.done)
+	}()
+}
+
+// Stop tells the agent started with Start to exit and waits until it did:
+// the receiver stops accepting traces, the writer flushes its payloads, then
+// the stats buckets are saved. It returns ctx.Err() if ctx is done first, the
+// agent still exiting in the background.
+func (a *Agent) Stop(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.exit) })
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends the stats of the complete buckets and the sampled traces to
+// the writer
+func (a *Agent) flush() {
+	a.flushPayload(a.Concentrator.Flush)
+}
+
+// flushAll is flush, including the open stats buckets, and returns the
+// payload once the writer got it
+func (a *Agent) flushAll() model.AgentPayload {
+	return a.flushPayload(a.Concentrator.FlushAll)
+}
+
+// flushPayload sends the stats returned by flushStats and the sampled traces
+// to the writer. With self tracing, the flush is traced from here to the
+// writing of its payload.
+func (a *Agent) flushPayload(flushStats func() []model.StatsBucket) model.AgentPayload {
+	var ft *flushTrace
+	if a.conf.SelfTracing {
+		ft = newFlushTrace(time.Now())
+	}
+
+	p := model.AgentPayload{
+		HostName:      a.conf.HostName,
+		Env:           a.conf.DefaultEnv,
+		AgentInfo:     &a.info,
+		SchemaVersion: model.PayloadSchemaVersion,
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		start := time.Now()
+		p.Stats = flushStats()
+		ft.stage("concentrate", start, map[string]float64{"stats_buckets": float64(len(p.Stats))})
+		wg.Done()
+	}()
+	if a.Sampler != nil {
+		wg.Add(1)
+		go func() {
+			start := time.Now()
+			p.Traces = a.Sampler.Flush()
+			ft.stage("sample", start, map[string]float64{"traces": float64(len(p.Traces))})
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	a.distributions.Send(p.Stats)
+	a.Receiver.streams.publish(p.Traces)
+
+	if ft != nil {
+		a.Writer.inFlushTraces <- ft
+	}
+	a.Writer.inPayloads <- p
+	a.Writer.payloadsQueue.observe()
+	return p
+}
+
 // Process is the default work unit that receives a trace, transforms it and
 // passes it downstream
 func (a *Agent) Process(t model.Trace) {
@@ -137,12 +317,27 @@ func (a *Agent) Process(t model.Trace) {
 		return
 	}
 
+	if !a.filter.Keep(t, root) {
+		log.Debugf("skipping trace %d filtered by tags", root.TraceID)
+		return
+	}
+
+	a.process(t, root)
+}
+
+// process computes the stats of a trace and samples it. Unlike Process, it
+// never drops the trace, which is how the agent's own traces go through. In
+// stats-only mode, only what the stats need is done.
+func (a *Agent) process(t model.Trace, root *model.Span) {
 	sublayers := model.ComputeSublayers(&t)
-	model.SetSublayersOnSpan(root, sublayers)
+	if a.Sampler != nil {
+		model.SetSublayersOnSpan(root, sublayers)
+	}
 
 	for i := range t {
 		t[i] = quantizer.Quantize(t[i])
 	}
+	t.ComputeTopLevel()
 
 	pt := processedTrace{
 		Trace:     t,
@@ -153,12 +348,72 @@ func (a *Agent) Process(t model.Trace) {
 	if tenv := t.GetEnv(); tenv != "" {
 		pt.Env = tenv
 	}
+	if a.conf.DerivedWaitMetrics {
+		pt.Waits = model.ComputeWaits(t)
+	}
+
+	// the route of a trace is the one of its root, give it to all the spans
+	// so that their stats are routed along
+	if tag := a.conf.RoutingTag; tag != "" {
+		if route := root.Meta[tag]; route != "" {
+			for i := range t {
+				if _, ok := t[i].Meta[tag]; ok {
+					continue
+				}
+				if t[i].Meta == nil {
+					t[i].Meta = make(map[string]string)
+				}
+				t[i].Meta[tag] = route
+			}
+		}
+	}
 
 	weight := pt.weight() // need to do this now because sampler edits .Metrics map
+	if a.Sampler != nil && !clientDropped(root) {
+		// before the errors are counted, which takes the first ones as
+		// samples otherwise
+		pt.ErrorSample = a.Concentrator.SampleErrors(pt)
+	}
 	go a.Concentrator.Add(pt, weight)
+	if a.Sampler == nil {
+		return
+	}
+
+	// stats are computed from all the spans, giant traces are only truncated
+	// before being sampled
+	if max := a.conf.MaxSpansPerTrace; max > 0 && len(t) > max {
+		log.Debugf("truncating trace %d from %d to %d spans", t[0].TraceID, len(t), max)
+		statsd.Client.Count("datadog.trace_agent.trace_truncated", 1, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.truncated_spans", int64(len(t)-max), nil, 1)
+
+		truncated := pt
+		truncated.Trace, truncated.Root = t.Truncate(root, max)
+		pt = truncated
+	}
 	go a.Sampler.Add(pt)
 }
 
+// saveState saves the open stats buckets, if state persistence is enabled,
+// so that they are not lost across restarts
+func (a *Agent) saveState() {
+	if a.conf.StateDir == "" {
+		return
+	}
+	path := filepath.Join(a.conf.StateDir, concentratorStateFile)
+	if err := a.Concentrator.SaveState(path); err != nil {
+		log.Errorf("cannot save stats buckets to %s: %v", path, err)
+		return
+	}
+	log.Infof("saved stats buckets to %s", path)
+}
+
+// logProcessStats reports the stats of the processing of the traces
+func (a *Agent) logProcessStats() {
+	hits, misses := quantizer.SwapResourceCacheStats()
+	statsd.Client.Count("datadog.trace_agent.quantizer.cache_hits", hits, nil, 1)
+	statsd.Client.Count("datadog.trace_agent.quantizer.cache_misses", misses, nil, 1)
+}
+
 func (a *Agent) watchdog() {
 	var wi watchdog.Info
 	wi.CPU = watchdog.CPU()
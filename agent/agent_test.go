@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestWatchdog(t *testing.T) {
@@ -71,12 +79,61 @@ func TestWatchdog(t *testing.T) {
 	buf[len(buf)-1] = 2
 }
 
+func TestAgentStartStop(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-state")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	conf.ReceiverPort = 0
+	conf.StateDir = dir
+
+	defaultMux := http.DefaultServeMux
+	http.DefaultServeMux = http.NewServeMux()
+	defer func() { http.DefaultServeMux = defaultMux }()
+
+	agent := NewAgent(conf)
+	agent.Process(model.Trace{fixtures.TestSpan()})
+	agent.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(agent.Stop(ctx))
+	// the stats buckets were saved before Stop returned
+	_, err = os.Stat(filepath.Join(dir, concentratorStateFile))
+	assert.Nil(err)
+	// stopping twice is fine
+	assert.Nil(agent.Stop(ctx))
+
+	// an agent which cannot exit in time, here never started
+	agent = NewAgent(config.NewDefaultAgentConfig())
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, agent.Stop(ctx))
+}
+
 func BenchmarkAgentTraceProcessing(b *testing.B) {
-	// Disable debug logs in these tests
-	config.NewLoggerLevelCustom("INFO", "/var/log/datadog/trace-agent.log")
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	benchmarkAgentTraceProcessing(b, conf)
+}
 
+// BenchmarkAgentTraceProcessingStatsOnly is BenchmarkAgentTraceProcessing
+// without sampling, to compare their CPU time for the same traces
+func BenchmarkAgentTraceProcessingStatsOnly(b *testing.B) {
 	conf := config.NewDefaultAgentConfig()
 	conf.APIKeys = append(conf.APIKeys, "")
+	conf.StatsOnly = true
+	benchmarkAgentTraceProcessing(b, conf)
+}
+
+func benchmarkAgentTraceProcessing(b *testing.B, conf *config.AgentConfig) {
+	// Disable debug logs in these tests
+	config.NewLoggerLevelCustom("INFO", "/var/log/datadog/trace-agent.log")
+
 	agent := NewAgent(conf)
 	b.ResetTimer()
 	b.ReportAllocs()
@@ -96,3 +153,194 @@ func BenchmarkWatchdog(b *testing.B) {
 		agent.watchdog()
 	}
 }
+
+// alwaysSampleEngine is a SamplerEngine keeping all the traces
+type alwaysSampleEngine struct{}
+
+func (e alwaysSampleEngine) Run()  {}
+func (e alwaysSampleEngine) Stop() {}
+func (e alwaysSampleEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	return true
+}
+
+func TestProcessTruncatesGiantTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+	agent.Sampler.samplerEngine = alwaysSampleEngine{}
+
+	now := model.Now()
+	trace := make(model.Trace, 10000)
+	for i := range trace {
+		trace[i] = model.Span{TraceID: 42, SpanID: uint64(i + 1), ParentID: 1, Service: "loop", Name: "iteration",
+			Resource: "it", Start: now - 1e9, Duration: int64(i + 1)}
+	}
+	trace[0].ParentID = 0
+	agent.Process(trace)
+
+	// both run asynchronously
+	var sampled []model.Trace
+	var hits float64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		agent.Sampler.mu.Lock()
+		sampled = agent.Sampler.sampledTraces
+		agent.Sampler.mu.Unlock()
+
+		hits = 0
+		agent.Concentrator.mu.Lock()
+		for _, b := range agent.Concentrator.buckets {
+			for _, c := range b.Export().Counts {
+				if c.Measure == model.HITS {
+					hits += c.Value
+				}
+			}
+		}
+		agent.Concentrator.mu.Unlock()
+
+		if len(sampled) == 1 && hits == 10000 {
+			break
+		}
+	}
+
+	assert.Equal(float64(10000), hits)
+	if assert.Len(sampled, 1) {
+		assert.Len(sampled[0], conf.MaxSpansPerTrace)
+		root := sampled[0].GetRoot()
+		assert.Equal(uint64(1), root.SpanID)
+		assert.Equal("true", root.Meta[model.TraceTruncatedKey])
+		assert.Equal(float64(10000-conf.MaxSpansPerTrace), root.Metrics[model.TraceDroppedSpansKey])
+	}
+}
+
+func TestProcessStatsOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	conf.StatsOnly = true
+	agent := NewAgent(conf)
+	assert.Nil(agent.Sampler)
+
+	now := model.Now()
+	trace := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "request", Resource: "GET /",
+			Start: now - 1e9, Duration: 100, Metrics: map[string]float64{model.SamplingPriorityKey: 2}},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "query", Type: "sql",
+			Resource: "SELECT * FROM users WHERE id = 42", Start: now - 1e9, Duration: 50},
+	}
+	agent.Process(trace)
+
+	// stats are computed asynchronously
+	var hits float64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		agent.Concentrator.mu.Lock()
+		hits = 0
+		for _, b := range agent.Concentrator.buckets {
+			for _, c := range b.Export().Counts {
+				if c.Measure == model.HITS {
+					hits += c.Value
+				}
+			}
+		}
+		agent.Concentrator.mu.Unlock()
+		if hits == 2 {
+			break
+		}
+	}
+	assert.Equal(float64(2), hits)
+
+	// even kept by priority, the trace never reaches the writer
+	p := agent.flushAll()
+	received := <-agent.Writer.inPayloads
+	assert.Nil(p.Traces)
+	assert.Nil(received.Traces)
+	if assert.Len(received.Stats, 1) {
+		// resources are still obfuscated
+		var resources []string
+		for _, c := range received.Stats[0].Counts {
+			if c.Measure == model.HITS && c.Name == "query" {
+				resources = append(resources, c.Key)
+			}
+		}
+		if assert.Len(resources, 1) {
+			assert.Contains(resources[0], "resource:SELECT * FROM users WHERE id = ?")
+		}
+	}
+
+	// the traces field is omitted from the intake payload
+	var buf bytes.Buffer
+	_, err := received.WriteTo(&buf)
+	assert.Nil(err)
+	assert.NotContains(buf.String(), `"traces"`)
+}
+
+func TestProcessRoutingTag(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	conf.ExtraAggregators = []string{"version"}
+	conf.RoutingTag = "team"
+	conf.Routes = []config.Route{{Value: "payments", Endpoint: "http://localhost:8080", APIKey: "key_payments"}}
+	agent := NewAgent(conf)
+	assert.Equal([]string{"version"}, conf.ExtraAggregators)
+	assert.Equal([]string{"team", "version"}, agent.Concentrator.aggregators)
+
+	now := model.Now()
+	trace := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /",
+			Start: now - 1e9, Duration: 100, Meta: map[string]string{"team": "payments"}},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "mcnulty", Name: "sql", Resource: "SELECT",
+			Start: now - 1e9, Duration: 50},
+		model.Span{TraceID: 1, SpanID: 3, ParentID: 1, Service: "search", Name: "query", Resource: "GET /",
+			Start: now - 1e9, Duration: 50, Meta: map[string]string{"team": "search"}},
+	}
+	agent.Process(trace)
+
+	// children without the tag take the route of the root
+	assert.Equal("payments", trace[1].Meta["team"])
+	assert.Equal("search", trace[2].Meta["team"])
+}
+
+func TestProcessTopLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	trace := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /",
+			Start: now - 1e9, Duration: 100},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "web", Name: "template.render", Resource: "index",
+			Start: now - 1e9, Duration: 50},
+		model.Span{TraceID: 1, SpanID: 3, ParentID: 1, Service: "db", Name: "postgres.query", Resource: "SELECT",
+			Start: now - 1e9, Duration: 30},
+	}
+	agent.Process(trace)
+
+	// stats are computed asynchronously
+	distributions := make(map[string][]string)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		distributions = make(map[string][]string)
+		agent.Concentrator.mu.Lock()
+		for _, b := range agent.Concentrator.buckets {
+			for _, d := range b.Export().Distributions {
+				distributions[d.Measure] = append(distributions[d.Measure], d.Name)
+			}
+		}
+		agent.Concentrator.mu.Unlock()
+
+		if len(distributions[model.DURATION]) == 3 {
+			break
+		}
+	}
+
+	sort.Strings(distributions[model.DURATION])
+	sort.Strings(distributions[model.SERVICEDURATION])
+	assert.Equal([]string{"http.request", "postgres.query", "template.render"}, distributions[model.DURATION])
+	assert.Equal([]string{"http.request", "postgres.query"}, distributions[model.SERVICEDURATION])
+}
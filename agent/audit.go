@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// auditQueueSize is the number of payloads waiting to be written to the audit
+// directory, above which they are dropped from the audit
+const auditQueueSize = 16
+
+// auditRecord is the content of an audit file: a payload written by the
+// writer and the result of its write
+type auditRecord struct {
+	Time    int64              `json:"time"`            // when the write ended, in nanoseconds since epoch
+	Route   string             `json:"route,omitempty"` // empty for the main endpoint
+	Status  string             `json:"status"`          // "ok" or "error"
+	Error   string             `json:"error,omitempty"` // the errors of the endpoints, with their response status
+	Size    int                `json:"size"`            // size of the payload as sent
+	Payload model.AgentPayload `json:"payload"`
+}
+
+// auditLog writes a sample of the payloads sent by the writer to gzipped
+// JSON files, see config.AgentConfig.APIAuditDir. Files are written by their
+// own goroutine from a bounded queue, so that auditing never slows down the
+// flushes.
+type auditLog struct {
+	rate    float64
+	files   *LocalEndpoint // writes and rotates the files
+	records chan auditRecord
+	done    chan struct{}
+	random  func() float64 // overridden by tests
+}
+
+// newAuditLog returns an auditLog writing to conf.APIAuditDir, or nil if
+// auditing is disabled. A nil auditLog audits nothing.
+func newAuditLog(conf *config.AgentConfig) (*auditLog, error) {
+	if conf.APIAuditDir == "" || conf.APIAuditSampleRate <= 0 {
+		return nil, nil
+	}
+	files, err := NewLocalEndpoint(conf.APIAuditDir, conf.APIAuditMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		rate:    conf.APIAuditSampleRate,
+		files:   files,
+		records: make(chan auditRecord, auditQueueSize),
+		done:    make(chan struct{}),
+		random:  rand.Float64,
+	}, nil
+}
+
+// Run writes the audited payloads until Stop is called
+func (a *auditLog) Run() {
+	if a == nil {
+		return
+	}
+	go func() {
+		defer close(a.done)
+		for r := range a.records {
+			a.write(r)
+		}
+	}()
+}
+
+// Stop writes the payloads still queued and returns. Record must not be
+// called afterwards.
+func (a *auditLog) Stop() {
+	if a == nil {
+		return
+	}
+	close(a.records)
+	<-a.done
+}
+
+// sampled tells if the next payload is audited
+func (a *auditLog) sampled() bool {
+	return a.random() < a.rate
+}
+
+// Record queues p, whose write returned err, to be audited if it is
+// sampled. It never blocks: the payload is dropped from the audit when the
+// queue is full.
+func (a *auditLog) Record(p *writerPayload, err error) {
+	if a == nil || !a.sampled() {
+		return
+	}
+
+	r := auditRecord{
+		Time:    time.Now().UnixNano(),
+		Route:   p.route,
+		Status:  "ok",
+		Size:    p.size,
+		Payload: p.payload,
+	}
+	if err != nil {
+		r.Status, r.Error = "error", err.Error()
+	}
+	select {
+	case a.records <- r:
+	default:
+		statsd.Client.Count("datadog.trace_agent.writer.dropped_audit", 1, nil, 1)
+	}
+}
+
+func (a *auditLog) write(r auditRecord) {
+	_, err := a.files.writeFile("audit.json.gz", func(f io.Writer) (int64, error) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(gz).Encode(r); err != nil {
+			return 0, err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
+		n, err := f.Write(buf.Bytes())
+		return int64(n), err
+	})
+	if err != nil {
+		log.Errorf("cannot write audited payload to %s: %v", a.files.dir, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditRecords(t *testing.T, dir string) []auditRecord {
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+
+	var records []auditRecord
+	for _, fi := range infos {
+		assert.True(t, strings.HasSuffix(fi.Name(), "-audit.json.gz"), fi.Name())
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		assert.Nil(t, err)
+		gz, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		var r auditRecord
+		assert.Nil(t, json.NewDecoder(gz).Decode(&r))
+		f.Close()
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	a, err := newAuditLog(conf)
+	assert.Nil(err)
+	assert.Nil(a)
+	a.Record(&writerPayload{}, nil) // a nil auditLog audits nothing
+
+	conf.APIAuditDir = dir
+	conf.APIAuditSampleRate = 1
+	a, err = newAuditLog(conf)
+	assert.Nil(err)
+	a.Run()
+
+	p := &writerPayload{payload: newTestPayload("test"), size: 1234}
+	a.Record(p, nil)
+	routed := &writerPayload{payload: newTestPayload("prod"), size: 567, route: "payments"}
+	a.Record(routed, errors.New("500 Internal Server Error"))
+	a.Stop()
+
+	records := readAuditRecords(t, dir)
+	if !assert.Len(records, 2) {
+		t.FailNow()
+	}
+	assert.Equal("ok", records[0].Status)
+	assert.Equal("", records[0].Error)
+	assert.Equal("", records[0].Route)
+	assert.Equal(1234, records[0].Size)
+	assert.Equal("test", records[0].Payload.Env)
+	assert.Len(records[0].Payload.Traces, 1)
+	assert.True(records[0].Time > 0)
+
+	assert.Equal("error", records[1].Status)
+	assert.Equal("500 Internal Server Error", records[1].Error)
+	assert.Equal("payments", records[1].Route)
+	assert.Equal(567, records[1].Size)
+	assert.Equal("prod", records[1].Payload.Env)
+}
+
+func TestAuditLogSampling(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIAuditDir = dir
+	conf.APIAuditSampleRate = 0.1
+	a, err := newAuditLog(conf)
+	assert.Nil(err)
+	a.random = rand.New(rand.NewSource(42)).Float64
+
+	n := 10000
+	sampled := 0
+	for i := 0; i < n; i++ {
+		if a.sampled() {
+			sampled++
+		}
+	}
+	assert.InEpsilon(0.1, float64(sampled)/float64(n), 0.1)
+
+	// nothing is audited with a null rate
+	conf.APIAuditSampleRate = 0
+	a, err = newAuditLog(conf)
+	assert.Nil(err)
+	assert.Nil(a)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIAuditDir = dir
+	conf.APIAuditSampleRate = 1
+	conf.APIAuditMaxSize = 1
+	a, err := newAuditLog(conf)
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		a.Record(&writerPayload{payload: newTestPayload("test")}, nil)
+	}
+	a.Run()
+	a.Stop()
+
+	// only the last file is kept
+	assert.Len(readAuditRecords(t, dir), 1)
+}
+
+func TestAuditLogQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIAuditDir = dir
+	conf.APIAuditSampleRate = 1
+	a, err := newAuditLog(conf)
+	assert.Nil(err)
+
+	// without Run, records are queued, and dropped once the queue is full
+	for i := 0; i < 2*auditQueueSize; i++ {
+		a.Record(&writerPayload{payload: newTestPayload("test")}, nil)
+	}
+	assert.Len(a.records, auditQueueSize)
+	a.Run()
+	a.Stop()
+	assert.Len(readAuditRecords(t, dir), auditQueueSize)
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"sort"
 	"sync"
+	"time"
 
 	log "github.com/cihub/seelog"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/statsd"
+	"github.com/DataDog/datadog-trace-agent/watch"
 )
 
 // Concentrator produces time bucketed statistics from a stream of raw traces.
@@ -15,71 +18,279 @@ import (
 // Gets an imperial shitton of traces, and outputs pre-computed data structures
 // allowing to find the gold (stats) amongst the traces.
 type Concentrator struct {
-	aggregators []string
-	bsize       int64
+	aggregators      []string
+	bsize            int64
+	maxDistributions int // maximum number of distributions per bucket, 0 for no limit
+
+	lastOverflowWarning time.Time // to throttle the overflow warnings
+
+	clock watch.Clock // tells when buckets are complete, overridden by tests
+
+	// buckets starting before partialBefore, in nanoseconds, are flagged as
+	// partial when flushed unless they were resumed, see FlagPartialBuckets
+	partialBefore int64
+	resumed       map[int64]bool // buckets resumed by LoadState, by start
+
+	// the precision of the distributions of each service depends on its
+	// number of spans per bucket, see SetPrecisionTiers
+	precisionTiers []config.PrecisionTier
+	spans          map[int64]map[string]int64 // spans of the open buckets by service, by start
+	volumes        []map[string]int64         // spans by service of the last flushed buckets
+	epsilons       map[string]float64         // given to the buckets, by service
+
+	topResources   int  // listed in the flushed buckets, see SetTopResources
+	quantileBounds bool // of the p95 of the top resources, see SetQuantileBounds
+
+	latency *latencyAlerts // nil if disabled, see SetLatencyAlerts
 
 	buckets map[int64]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
 	mu      sync.Mutex
 }
 
 // NewConcentrator initializes a new concentrator ready to be started
-func NewConcentrator(aggregators []string, bsize int64) *Concentrator {
+func NewConcentrator(aggregators []string, bsize int64, maxDistributions int) *Concentrator {
 	c := Concentrator{
-		aggregators: aggregators,
-		bsize:       bsize,
-		buckets:     make(map[int64]*model.StatsRawBucket),
+		aggregators:      aggregators,
+		bsize:            bsize,
+		maxDistributions: maxDistributions,
+		buckets:          make(map[int64]*model.StatsRawBucket),
+		resumed:          make(map[int64]bool),
+		spans:            make(map[int64]map[string]int64),
+		clock:            watch.Real,
 	}
 	sort.Strings(c.aggregators)
 	return &c
 }
 
-// Add appends to the proper stats bucket this trace's statistics
+// precisionWindow is the number of flushed buckets the precision of the
+// distributions of a service is chosen from
+const precisionWindow = 3
+
+// SetPrecisionTiers chooses the precision of the distributions of each
+// service from its peak number of spans per bucket over the last flushed
+// buckets, see config.AgentConfig.PrecisionTiers. Until a service was
+// flushed, its distributions have the default precision.
+func (c *Concentrator) SetPrecisionTiers(tiers []config.PrecisionTier) {
+	c.mu.Lock()
+	c.precisionTiers = tiers
+	c.mu.Unlock()
+}
+
+// SetTopResources lists the n resources with the most hits and the highest
+// p95 in the flushed buckets, see model.StatsBucket.SetTopResources. 0 for
+// none.
+func (c *Concentrator) SetTopResources(n int) {
+	c.mu.Lock()
+	c.topResources = n
+	c.mu.Unlock()
+}
+
+// SetQuantileBounds adds the bounds of their p95 to the top resources of the
+// flushed buckets, see model.StatsBucket.SetTopResourcesWithBounds
+func (c *Concentrator) SetQuantileBounds(bounds bool) {
+	c.mu.Lock()
+	c.quantileBounds = bounds
+	c.mu.Unlock()
+}
+
+// SetLatencyAlerts logs a warning for each duration distribution whose p95
+// shifted by more than factor since the previous flush, both ways, if it had
+// at least minHits values in both, see latencyAlerts. Up to maxDistributions
+// distributions are remembered between flushes.
+func (c *Concentrator) SetLatencyAlerts(factor float64, minHits int) {
+	c.mu.Lock()
+	c.latency = newLatencyAlerts(factor, minHits, c.maxDistributions)
+	c.mu.Unlock()
+}
+
+// Add appends to the proper stats bucket this trace's statistics. Spans are
+// aggregated by their own env if they are tagged with one, by the env of
+// the trace otherwise, so that hosts serving several envs keep them apart.
+// The spans made by the agent are not aggregated, see model.ShouldAggregate.
 func (c *Concentrator) Add(t processedTrace, weight float64) {
 	c.mu.Lock()
 
 	for _, s := range t.Trace {
-		btime := s.End() - s.End()%c.bsize
-		b, ok := c.buckets[btime]
-		if !ok {
-			b = model.NewStatsRawBucket(btime, c.bsize)
-			c.buckets[btime] = b
+		if !model.ShouldAggregate(&s) {
+			continue
+		}
+		env := t.Env
+		if e := s.GetEnv(); e != "" {
+			env = e
+		}
+		btime, b := c.bucket(s.End())
+		if len(c.precisionTiers) > 0 {
+			spans, ok := c.spans[btime]
+			if !ok {
+				spans = make(map[string]int64)
+				c.spans[btime] = spans
+			}
+			spans[s.Service]++
 		}
 
 		if t.Root != nil && s.SpanID == t.Root.SpanID && t.Sublayers != nil {
 			// handle sublayers
-			b.HandleSpan(s, t.Env, c.aggregators, weight, &t.Sublayers)
+			b.HandleSpan(s, env, c.aggregators, weight, &t.Sublayers)
 		} else {
-			b.HandleSpan(s, t.Env, c.aggregators, weight, nil)
+			b.HandleSpan(s, env, c.aggregators, weight, nil)
+		}
+		if w, ok := t.Waits[s.SpanID]; ok {
+			b.HandleWaits(s, env, c.aggregators, w)
+		}
+	}
+
+	c.mu.Unlock()
+}
+
+// SampleErrors makes the errors of t the samples of their error types in
+// their buckets, when these have none yet, and tells if any of them was,
+// for the sampler to keep t, see model.StatsRawBucket.SampleError. It must
+// be called before Add, which counts the errors.
+func (c *Concentrator) SampleErrors(t processedTrace) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sampled bool
+	for i := range t.Trace {
+		s := &t.Trace[i]
+		if s.Error == 0 || !model.ShouldAggregate(s) {
+			continue
+		}
+		if _, b := c.bucket(s.End()); b.SampleError(s) {
+			sampled = true
 		}
 	}
+	return sampled
+}
 
+// bucket returns the start and the bucket of the spans ending at end, which
+// is opened if needed. c.mu must be held.
+func (c *Concentrator) bucket(end int64) (int64, *model.StatsRawBucket) {
+	btime := end - end%c.bsize
+	b, ok := c.buckets[btime]
+	if !ok {
+		b = model.NewStatsRawBucket(btime, c.bsize)
+		b.SetMaxDistributions(c.maxDistributions)
+		b.SetEpsilons(c.epsilons)
+		c.buckets[btime] = b
+	}
+	return btime, b
+}
+
+// FlagPartialBuckets flags the buckets starting before now as partial, e.g.
+// when the agent starts: the spans which ended before now were never seen.
+// Buckets resumed from a saved state are not flagged.
+func (c *Concentrator) FlagPartialBuckets() {
+	c.mu.Lock()
+	c.partialBefore = c.clock.Now().UnixNano()
 	c.mu.Unlock()
 }
 
 // Flush deletes and returns complete statistic buckets
 func (c *Concentrator) Flush() []model.StatsBucket {
+	return c.flush(false)
+}
+
+// FlushAll deletes and returns all the statistic buckets, including the open
+// ones. Spans arriving later for these buckets go to new buckets.
+func (c *Concentrator) FlushAll() []model.StatsBucket {
+	return c.flush(true)
+}
+
+func (c *Concentrator) flush(all bool) []model.StatsBucket {
 	var sb []model.StatsBucket
-	now := model.Now()
+	now := c.clock.Now().UnixNano()
 
 	c.mu.Lock()
 	for ts, srb := range c.buckets {
-		bucket := srb.Export()
-
 		// always keep one bucket opened
 		// this is a trade-off: we accept slightly late traces (clock skew and stuff)
 		// but we delay flushing by at most 2 buckets
-		if ts > now-2*c.bsize {
+		if !all && ts > now-2*c.bsize {
 			continue
 		}
+		bucket := srb.Export()
+		bucket.Partial = ts < c.partialBefore && !c.resumed[ts]
+		bucket.SetTopResourcesWithBounds(c.topResources, c.quantileBounds)
 
 		log.Debugf("flushing bucket %d", ts)
 		for _, d := range bucket.Distributions {
 			statsd.Client.Histogram("datadog.trace_agent.distribution.len", float64(d.Summary.N), nil, 1)
 		}
+		statsd.Client.Histogram("datadog.trace_agent.concentrator.distributions", float64(len(bucket.Distributions)), nil, 1)
+		c.logOverflow(srb.Overflow())
 		sb = append(sb, bucket)
 		delete(c.buckets, ts)
+		delete(c.resumed, ts)
+		if spans, ok := c.spans[ts]; ok {
+			c.volumes = append(c.volumes, spans)
+			delete(c.spans, ts)
+		}
+	}
+	c.latency.check(sb)
+	if len(c.volumes) > precisionWindow {
+		c.volumes = c.volumes[len(c.volumes)-precisionWindow:]
+	}
+	if len(sb) > 0 && len(c.precisionTiers) > 0 {
+		c.epsilons = c.computeEpsilons()
+		for _, b := range c.buckets {
+			b.SetEpsilons(c.epsilons)
+		}
 	}
 	c.mu.Unlock()
 
 	return sb
 }
+
+// computeEpsilons returns the precision of the distributions of the services
+// of the last flushed buckets, from their peak number of spans per bucket
+func (c *Concentrator) computeEpsilons() map[string]float64 {
+	peaks := make(map[string]int64)
+	for _, spans := range c.volumes {
+		for service, n := range spans {
+			if n > peaks[service] {
+				peaks[service] = n
+			}
+		}
+	}
+
+	epsilons := make(map[string]float64, len(peaks))
+	for service, n := range peaks {
+		for _, tier := range c.precisionTiers {
+			if tier.Below == 0 || n < tier.Below {
+				epsilons[service] = tier.Epsilon
+				break
+			}
+		}
+	}
+	return epsilons
+}
+
+// overflowWarningInterval is the minimum interval between two warnings about
+// buckets reaching their distribution limit
+const overflowWarningInterval = time.Minute
+
+// logOverflow reports the keys that were folded in overflow distributions
+func (c *Concentrator) logOverflow(overflow map[string]int) {
+	if len(overflow) == 0 {
+		return
+	}
+
+	var total, top int
+	var topService string
+	for service, n := range overflow {
+		total += n
+		if n > top || (n == top && service < topService) {
+			top, topService = n, service
+		}
+	}
+
+	statsd.Client.Count("datadog.trace_agent.concentrator.overflow_keys", int64(total), nil, 1)
+	statsd.Client.Gauge("datadog.trace_agent.concentrator.max_distributions", float64(c.maxDistributions), nil, 1)
+
+	if now := c.clock.Now(); now.Sub(c.lastOverflowWarning) > overflowWarningInterval {
+		c.lastOverflowWarning = now
+		log.Warnf("stats bucket reached its limit of %d distributions, %d keys aggregated as resource %q, mostly from service %q (%d keys)",
+			c.maxDistributions, total, model.OverflowResource, topService, top)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// concentratorStateFile is the file, in config.AgentConfig.StateDir, the
+// open buckets are saved to on exit
+const concentratorStateFile = "concentrator.state"
+
+// concentratorState is what the concentrator saves on exit
+type concentratorState struct {
+	SavedAt     time.Time
+	BucketSize  int64
+	Aggregators []string
+	Buckets     []*model.StatsRawBucket
+}
+
+// SaveState writes the open buckets to path, so that they can be resumed by
+// LoadState after a restart. The file is written atomically.
+func (c *Concentrator) SaveState(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := concentratorState{
+		SavedAt:     c.clock.Now(),
+		BucketSize:  c.bsize,
+		Aggregators: c.aggregators,
+		Buckets:     make([]*model.StatsRawBucket, 0, len(c.buckets)),
+	}
+	for _, b := range c.buckets {
+		state.Buckets = append(state.Buckets, b)
+	}
+
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(&state); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState resumes the buckets saved by SaveState in path, if it is younger
+// than maxAge and was saved with the same bucket size and aggregators. Buckets
+// already open are merged with their saved state. Resumed buckets are never
+// flagged as partial. The file is removed in any case so that bad state is
+// never loaded twice.
+func (c *Concentrator) LoadState(path string, maxAge time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	var state concentratorState
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		return fmt.Errorf("corrupt state: %v", err)
+	}
+	if age := c.clock.Now().Sub(state.SavedAt); age > maxAge || age < 0 {
+		return fmt.Errorf("stale state, saved %s ago", age)
+	}
+	if state.BucketSize != c.bsize {
+		return fmt.Errorf("state has buckets of %d ns, expected %d", state.BucketSize, c.bsize)
+	}
+	if strings.Join(state.Aggregators, ",") != strings.Join(c.aggregators, ",") {
+		return fmt.Errorf("state has aggregators %v, expected %v", state.Aggregators, c.aggregators)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range state.Buckets {
+		if b == nil {
+			continue
+		}
+		ts := b.Start()
+		b.SetMaxDistributions(c.maxDistributions)
+		b.SetEpsilons(c.epsilons)
+		if open, ok := c.buckets[ts]; ok {
+			// spans came for this bucket before the state was loaded
+			if err := open.Merge(b); err != nil {
+				log.Warnf("not resuming the saved state of stats bucket %d: %v", ts, err)
+				continue
+			}
+		} else {
+			c.buckets[ts] = b
+		}
+		c.resumed[ts] = true
+	}
+	return nil
+}
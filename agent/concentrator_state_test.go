@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/watch"
+	"github.com/stretchr/testify/assert"
+)
+
+func stateTestTraces(c *Concentrator) (processedTrace, processedTrace) {
+	before := processedTrace{Env: "none", Trace: model.Trace{
+		testSpan(c, 1, 24, 3, "A1", "resource1", 0),
+		testSpan(c, 2, 120, 3, "A1", "resource1", 1),
+		testSpan(c, 3, 40, 3, "A2", "resource2", 0),
+	}}
+	after := processedTrace{Env: "none", Trace: model.Trace{
+		testSpan(c, 4, 36, 3, "A1", "resource1", 0),
+		testSpan(c, 5, 1000, 3, "A2", "resource2", 1),
+		testSpan(c, 6, 12, 3, "A2", "resource3", 0),
+	}}
+	return before, after
+}
+
+func TestConcentratorStateRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "concentrator-state")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, concentratorStateFile)
+
+	baseline := NewConcentrator([]string{"version"}, testBucketInterval, 0)
+	before, after := stateTestTraces(baseline)
+	baseline.Add(before, 1)
+	baseline.Add(after, 1)
+
+	// the same traces, with a restart in between
+	c := NewConcentrator([]string{"version"}, testBucketInterval, 0)
+	c.Add(before, 1)
+	assert.Nil(c.SaveState(path))
+
+	restarted := NewConcentrator([]string{"version"}, testBucketInterval, 0)
+	restarted.FlagPartialBuckets()
+	assert.Nil(restarted.LoadState(path, 2*time.Duration(testBucketInterval)))
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err), "state file should be removed once loaded")
+	restarted.Add(after, 1)
+
+	expected := baseline.Flush()
+	got := restarted.Flush()
+	if !assert.Len(got, len(expected)) || !assert.Len(got, 1) {
+		t.FailNow()
+	}
+	assert.Equal(expected[0].Start, got[0].Start)
+	// the bucket started before the restart, but its start was seen
+	assert.False(got[0].Partial)
+	assert.Equal(expected[0].Counts, got[0].Counts)
+	assert.Equal(len(expected[0].Distributions), len(got[0].Distributions))
+	for k, d := range expected[0].Distributions {
+		for _, q := range []float64{0, 0.5, 0.9, 1} {
+			assert.Equal(d.Summary.Quantile(q), got[0].Distributions[k].Summary.Quantile(q), "%s q%v", k, q)
+		}
+	}
+}
+
+func TestConcentratorStateMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "concentrator-state")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, concentratorStateFile)
+
+	baseline := NewConcentrator([]string{"version"}, testBucketInterval, 0)
+	before, after := stateTestTraces(baseline)
+	baseline.Add(before, 1)
+	baseline.Add(after, 1)
+
+	c := NewConcentrator([]string{"version"}, testBucketInterval, 0)
+	c.Add(before, 1)
+	assert.Nil(c.SaveState(path))
+
+	// spans for the saved bucket come before the state is loaded
+	restarted := NewConcentrator([]string{"version"}, testBucketInterval, 0)
+	restarted.Add(after, 1)
+	assert.Nil(restarted.LoadState(path, 2*time.Duration(testBucketInterval)))
+
+	expected := baseline.Flush()
+	got := restarted.Flush()
+	if !assert.Len(got, 1) || !assert.Len(expected, 1) {
+		t.FailNow()
+	}
+	assert.Equal(expected[0].Counts, got[0].Counts)
+	assert.Equal(len(expected[0].Distributions), len(got[0].Distributions))
+	for k, d := range expected[0].Distributions {
+		assert.Equal(d.Summary.N, got[0].Distributions[k].Summary.N, k)
+	}
+}
+
+func TestConcentratorStateIgnored(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "concentrator-state")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, concentratorStateFile)
+	maxAge := 2 * time.Duration(testBucketInterval)
+
+	saved := func(c *Concentrator) {
+		before, _ := stateTestTraces(c)
+		c.Add(before, 1)
+		assert.Nil(c.SaveState(path))
+	}
+	ignored := func(c *Concentrator, maxAge time.Duration) {
+		assert.NotNil(c.LoadState(path, maxAge))
+		assert.Len(c.buckets, 0)
+		_, err := os.Stat(path)
+		assert.True(os.IsNotExist(err), "ignored state file should be removed")
+	}
+
+	// no state
+	err = NewTestConcentrator().LoadState(path, maxAge)
+	assert.True(os.IsNotExist(err))
+
+	// corrupt
+	assert.Nil(ioutil.WriteFile(path, []byte("not a gob"), 0600))
+	ignored(NewConcentrator([]string{}, testBucketInterval, 0), maxAge)
+
+	// stale
+	clock := watch.NewFakeClock(time.Now())
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = clock
+	saved(c)
+	clock.Advance(maxAge + time.Nanosecond)
+	c = NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = clock
+	ignored(c, maxAge)
+
+	// other bucket size or aggregators
+	saved(NewConcentrator([]string{}, testBucketInterval, 0))
+	ignored(NewConcentrator([]string{}, 2*testBucketInterval, 0), maxAge)
+	saved(NewConcentrator([]string{}, testBucketInterval, 0))
+	ignored(NewConcentrator([]string{"version"}, testBucketInterval, 0), maxAge)
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/DataDog/datadog-trace-agent/watch"
 	"github.com/stretchr/testify/assert"
 )
 
 var testBucketInterval = time.Duration(2 * time.Second).Nanoseconds()
 
 func NewTestConcentrator() *Concentrator {
-	return NewConcentrator([]string{}, time.Second.Nanoseconds())
+	return NewConcentrator([]string{}, time.Second.Nanoseconds(), 0)
 }
 
 // getTsInBucket gives a timestamp in ns which is `offset` buckets late
@@ -23,7 +27,7 @@ func getTsInBucket(alignedNow int64, bsize int64, offset int64) int64 {
 // testSpan avoids typo and inconsistency in test spans (typical pitfall: duration, start time,
 // and end time are aligned, and end time is the one that needs to be aligned
 func testSpan(c *Concentrator, spanID uint64, duration, offset int64, service, resource string, err int32) model.Span {
-	now := model.Now()
+	now := c.clock.Now().UnixNano()
 	alignedNow := now - now%c.bsize
 
 	return model.Span{
@@ -39,9 +43,11 @@ func testSpan(c *Concentrator, spanID uint64, duration, offset int64, service, r
 
 func TestConcentratorStatsCounts(t *testing.T) {
 	assert := assert.New(t)
-	c := NewConcentrator([]string{}, testBucketInterval)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	// a fixed time, so that the spans cannot slip to the next buckets
+	c.clock = watch.NewFakeClock(time.Now())
 
-	now := model.Now()
+	now := c.clock.Now().UnixNano()
 	alignedNow := now - now%c.bsize
 
 	testTrace := processedTrace{
@@ -138,3 +144,349 @@ func TestConcentratorStatsCounts(t *testing.T) {
 		assert.Equal(val, int64(count.Value), "Wrong value for count %s", key)
 	}
 }
+
+func TestConcentratorMaxDistributions(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 10)
+
+	var trace model.Trace
+	for i := 0; i < 100; i++ {
+		trace = append(trace, testSpan(c, uint64(i), 24, 3, "A1", fmt.Sprintf("resource%d", i), 0))
+	}
+	testTrace := processedTrace{Env: "none", Trace: trace}
+	c.Add(testTrace, testTrace.weight())
+
+	stats := c.Flush()
+	if !assert.Equal(1, len(stats)) {
+		t.FailNow()
+	}
+	assert.Len(stats[0].Distributions, 11)
+	assert.Contains(stats[0].Distributions, "query|duration|env:none,resource:__other__,service:A1")
+	assert.False(c.lastOverflowWarning.IsZero())
+}
+
+func TestConcentratorEnvs(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+
+	// one host serving prod and staging, a prod service calling a staging one
+	prod := testSpan(c, 1, 24, 3, "web", "GET /", 0)
+	prod.Meta = map[string]string{"env": "prod"}
+	staging := testSpan(c, 2, 12, 3, "db", "SELECT", 0)
+	staging.ParentID = 1
+	staging.Meta = map[string]string{"env": "staging"}
+	untagged := testSpan(c, 3, 10, 3, "cache", "GET", 0)
+	untagged.ParentID = 1
+	c.Add(processedTrace{Env: "prod", Trace: model.Trace{prod, staging, untagged}}, 1)
+	// a trace without env
+	c.Add(processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 4, 24, 3, "web", "GET /", 0)}}, 1)
+
+	stats := c.Flush()
+	if !assert.Len(stats, 1) {
+		t.FailNow()
+	}
+	var keys []string
+	for key := range stats[0].Distributions {
+		keys = append(keys, key)
+	}
+	assert.Len(keys, 4)
+	for _, key := range []string{
+		"query|duration|env:prod,resource:GET /,service:web",
+		"query|duration|env:staging,resource:SELECT,service:db",
+		"query|duration|env:prod,resource:GET,service:cache",
+		"query|duration|env:none,resource:GET /,service:web",
+	} {
+		if assert.Contains(stats[0].Distributions, key) {
+			assert.Equal(1, stats[0].Distributions[key].Summary.N, key)
+		}
+	}
+}
+
+func TestConcentratorWaits(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+
+	now := c.clock.Now().UnixNano()
+	start := now - now%c.bsize - 3*c.bsize
+	trace := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: start, Duration: 1000},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "query", Resource: "SELECT", Start: start + 100, Duration: 500},
+	}
+	c.Add(processedTrace{Env: "none", Trace: trace}, 1)
+	c.Add(processedTrace{Env: "none", Trace: trace, Waits: model.ComputeWaits(trace)}, 1)
+
+	stats := c.Flush()
+	if !assert.Len(stats, 1) {
+		t.FailNow()
+	}
+	// only the parent of the second trace has waits
+	before := stats[0].Distributions["http.request|derived.wait_before|env:none,service:web"]
+	if assert.NotNil(before.Summary) && assert.Equal(1, before.Summary.N) {
+		assert.Equal(float64(100), before.Summary.Quantile(1))
+	}
+	after := stats[0].Distributions["http.request|derived.wait_after|env:none,service:web"]
+	if assert.NotNil(after.Summary) && assert.Equal(1, after.Summary.N) {
+		assert.Equal(float64(400), after.Summary.Quantile(1))
+	}
+	assert.NotContains(stats[0].Distributions, "query|derived.wait_before|env:none,service:db")
+}
+
+func TestConcentratorSynthetic(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+
+	marker := model.NewTraceFlushMarker()
+	c.Add(processedTrace{Env: "none", Trace: marker, Root: &marker[0]}, 1)
+	start := c.clock.Now().Add(-3 * time.Duration(testBucketInterval))
+	self := newFlushTrace(start)
+	self.addStage("concentrate", start, time.Millisecond, nil)
+	trace := self.finish()
+	c.Add(processedTrace{Env: "none", Trace: trace, Root: &trace[0], Waits: model.ComputeWaits(trace)}, 1)
+
+	c.FlushAll()
+	assert.Len(c.buckets, 0)
+	assert.Len(c.FlushAll(), 0)
+
+	// along with a received span, only the latter counts
+	trace = append(trace, testSpan(c, 42, 100, 3, "web", "GET /", 0))
+	c.Add(processedTrace{Env: "none", Trace: trace, Root: &trace[0]}, 1)
+	stats := c.Flush()
+	if assert.Len(stats, 1) {
+		assert.Equal(float64(1), stats[0].Counts["query|hits|env:none,resource:GET /,service:web"].Value)
+		for key := range stats[0].Counts {
+			assert.NotContains(key, selfTraceService)
+		}
+	}
+}
+
+func TestConcentratorTopResources(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+
+	trace := model.Trace{
+		testSpan(c, 1, 100, 3, "web", "GET /", 0),
+		testSpan(c, 2, 300, 3, "web", "GET /", 0),
+		testSpan(c, 3, 5000, 3, "web", "POST /upload", 0),
+	}
+	c.Add(processedTrace{Env: "none", Trace: trace}, 1)
+	stats := c.Flush()
+	if assert.Len(stats, 1) {
+		assert.Nil(stats[0].TopResources)
+	}
+
+	c.SetTopResources(1)
+	c.Add(processedTrace{Env: "none", Trace: trace}, 1)
+	stats = c.Flush()
+	if assert.Len(stats, 1) && assert.NotNil(stats[0].TopResources) {
+		top := stats[0].TopResources
+		assert.Equal([]model.ResourceStats{{Name: "query", Service: "web", Resource: "GET /", Hits: 2, P95: 300}}, top.Hits)
+		assert.Equal([]model.ResourceStats{{Name: "query", Service: "web", Resource: "POST /upload", Hits: 1, P95: 5000}}, top.P95)
+	}
+
+	c.SetQuantileBounds(true)
+	c.Add(processedTrace{Env: "none", Trace: trace}, 1)
+	stats = c.Flush()
+	if assert.Len(stats, 1) && assert.NotNil(stats[0].TopResources) {
+		assert.Equal([]model.ResourceStats{{Name: "query", Service: "web", Resource: "POST /upload", Hits: 1,
+			P95: 5000, P95Lower: 5000, P95Upper: 5000}}, stats[0].TopResources.P95)
+	}
+}
+
+func TestConcentratorPrecisionTiers(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+	c.SetPrecisionTiers([]config.PrecisionTier{{Below: 1000, Epsilon: 0.02}, {Below: 10000, Epsilon: 0.01}, {Epsilon: 0.005}})
+
+	volumes := map[string]int{"small": 500, "medium": 5000, "large": 20000}
+	add := func(offset int64) {
+		var id uint64
+		for service, n := range volumes {
+			for i := 0; i < n; i++ {
+				id++
+				s := testSpan(c, id, int64((i*7919)%1000+1), offset, service, "GET /", 0)
+				c.Add(processedTrace{Env: "none", Trace: model.Trace{s}}, 1)
+			}
+		}
+	}
+
+	// the services have the default precision until their volume is known
+	add(5)
+	stats := c.Flush()
+	if !assert.Len(stats, 1) {
+		t.FailNow()
+	}
+	for service := range volumes {
+		assert.Equal(quantile.EPSILON, stats[0].Distributions["query|duration|env:none,resource:GET /,service:"+service].Summary.Precision())
+	}
+
+	add(3)
+	stats = c.Flush()
+	if !assert.Len(stats, 1) {
+		t.FailNow()
+	}
+	for service, eps := range map[string]float64{"small": 0.02, "medium": 0.01, "large": 0.005} {
+		d := stats[0].Distributions["query|duration|env:none,resource:GET /,service:"+service]
+		if !assert.NotNil(d.Summary, service) {
+			continue
+		}
+		assert.Equal(eps, d.Summary.Precision(), service)
+		assert.Equal(volumes[service], d.Summary.N, service)
+
+		// the number of entries follows the precision
+		ref := quantile.NewSliceSummary()
+		for i := 0; i < volumes[service]; i++ {
+			ref.Insert(float64((i*7919)%1000+1), uint64(i))
+		}
+		ref.Compress()
+		switch service {
+		case "small":
+			assert.True(len(d.Summary.Entries) < len(ref.Entries), "%d entries, %d by default", len(d.Summary.Entries), len(ref.Entries))
+		case "medium":
+			assert.Equal(len(ref.Entries), len(d.Summary.Entries))
+		case "large":
+			assert.True(len(d.Summary.Entries) > len(ref.Entries), "%d entries, %d by default", len(d.Summary.Entries), len(ref.Entries))
+		}
+	}
+}
+
+func TestConcentratorPartialBuckets(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+
+	// the agent starts in the middle of a bucket
+	now := time.Now().UnixNano()
+	aligned := now - now%testBucketInterval
+	clock := watch.NewFakeClock(time.Unix(0, aligned+testBucketInterval/2))
+	c.clock = clock
+	c.FlagPartialBuckets()
+
+	// late spans of the previous bucket, and spans of the current one
+	c.Add(processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 1, 24, 1, "A1", "resource1", 0)}}, 1)
+	c.Add(processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 2, 24, 0, "A1", "resource1", 0)}}, 1)
+	// the next bucket is complete
+	clock.Advance(time.Duration(testBucketInterval))
+	c.Add(processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 3, 24, 0, "A1", "resource1", 0)}}, 1)
+
+	clock.Advance(3 * time.Duration(testBucketInterval))
+	partial := make(map[int64]bool)
+	for _, sb := range c.Flush() {
+		partial[sb.Start] = sb.Partial
+	}
+	assert.Equal(map[int64]bool{
+		aligned - testBucketInterval: true,
+		aligned:                      true,
+		aligned + testBucketInterval: false,
+	}, partial)
+
+	// without flagging, no bucket is partial
+	c = NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = clock
+	c.Add(processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 1, 24, 3, "A1", "resource1", 0)}}, 1)
+	stats := c.Flush()
+	if assert.Len(stats, 1) {
+		assert.False(stats[0].Partial)
+	}
+}
+
+func TestConcentratorSampleErrors(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+
+	errorTrace := func(traceID uint64, offset int64, errorType string) processedTrace {
+		s := testSpan(c, 1, 24, offset, "A1", "resource1", 1)
+		s.TraceID = traceID
+		s.Meta = map[string]string{model.ErrorTypeKey: errorType}
+		return processedTrace{Env: "none", Trace: model.Trace{s, testSpan(c, 2, 24, offset, "A1", "resource1", 0)}}
+	}
+
+	// the first error of a type in a bucket is its sample
+	for _, tc := range []struct {
+		trace   processedTrace
+		sampled bool
+	}{
+		{errorTrace(1, 1, "Timeout"), true},
+		{errorTrace(2, 1, "Timeout"), false},
+		{errorTrace(3, 1, "IOError"), true},
+		{errorTrace(4, 0, "Timeout"), true},
+		{processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 1, 24, 1, "A1", "resource1", 0)}}, false},
+	} {
+		assert.Equal(tc.sampled, c.SampleErrors(tc.trace), tc.trace.Trace[0].TraceID)
+		c.Add(tc.trace, 1)
+	}
+
+	stats := c.FlushAll()
+	if assert.Len(stats, 2) {
+		for _, sb := range stats {
+			for _, e := range sb.ErrorSummaries["A1"] {
+				assert.Contains([]uint64{1, 3, 4}, e.TraceID)
+			}
+		}
+	}
+}
+
+// benchConcentratorTraces returns traces of 10 spans as sent by a web app:
+// http requests with an env and a status code, errors and database queries
+func benchConcentratorTraces(c *Concentrator, n int) []processedTrace {
+	traces := make([]processedTrace, n)
+	for i := range traces {
+		trace := make(model.Trace, 10)
+		for j := range trace {
+			s := testSpan(c, uint64(i*10+j+1), rand.Int63n(1e9), 0, "web", fmt.Sprintf("GET /users/%d", j), 0)
+			s.TraceID = uint64(i + 1)
+			s.Meta = map[string]string{
+				"env":              "prod",
+				"http.method":      "GET",
+				"http.status_code": "200",
+				"http.url":         "/users/42",
+			}
+			if j%3 == 0 {
+				s.Service = "db"
+				s.Meta["sql.query"] = "SELECT * FROM users WHERE id = ?"
+			}
+			if j%5 == 0 {
+				s.Error = 1
+				s.Meta["http.status_code"] = "500"
+				s.Meta["error.msg"] = "internal error"
+			}
+			trace[j] = s
+		}
+		trace.ComputeTopLevel()
+		traces[i] = processedTrace{Trace: trace, Root: &trace[0], Env: "none"}
+	}
+	return traces
+}
+
+// BenchmarkConcentratorAdd measures the concentration of normalized spans,
+// with their typed meta reset as before Normalize set them, or set
+func BenchmarkConcentratorAdd(b *testing.B) {
+	for _, typed := range []bool{false, true} {
+		name := "meta"
+		if typed {
+			name = "typed"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := NewConcentrator([]string{"http.status_code"}, testBucketInterval, 0)
+			c.clock = watch.NewFakeClock(time.Now())
+			traces := benchConcentratorTraces(c, 100)
+			for _, t := range traces {
+				for i := range t.Trace {
+					t.Trace[i].Normalize()
+					if !typed {
+						t.Trace[i].Env, t.Trace[i].StatusCode = "", 0
+					}
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Add(traces[i%len(traces)], 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// headerContainerID is the header in which clients running in a container
+// send its ID
+const headerContainerID = "Datadog-Container-ID"
+
+// meta keys set on the spans of the payloads sent from a container
+const (
+	containerIDKey   = "container_id"
+	podNameKey       = "pod_name"
+	kubeNamespaceKey = "kube_namespace"
+)
+
+// containerTagKeys are the meta keys set by a containerTagger, stats are
+// aggregated by them too
+var containerTagKeys = []string{containerIDKey, kubeNamespaceKey, podNameKey}
+
+// ContainerMetadata describes a container, fields are empty when unknown
+type ContainerMetadata struct {
+	PodName   string
+	Namespace string
+}
+
+// ContainerResolver returns the metadata of the container with the given ID
+type ContainerResolver interface {
+	Resolve(containerID string) ContainerMetadata
+}
+
+// envContainerResolver resolves all the containers to the pod the agent runs
+// in, as told by the DD_POD_NAME and DD_POD_NAMESPACE environment variables,
+// which is right when the agent runs as a sidecar. It is to be replaced by a
+// resolver asking the kubelet.
+type envContainerResolver struct {
+	metadata ContainerMetadata
+}
+
+func newEnvContainerResolver() *envContainerResolver {
+	return &envContainerResolver{ContainerMetadata{
+		PodName:   os.Getenv("DD_POD_NAME"),
+		Namespace: os.Getenv("DD_POD_NAMESPACE"),
+	}}
+}
+
+// Resolve implements ContainerResolver
+func (r *envContainerResolver) Resolve(containerID string) ContainerMetadata {
+	return r.metadata
+}
+
+// containerTagger tags the spans of payloads with the container which sent
+// them, see config.AgentConfig.ContainerTagging
+type containerTagger struct {
+	resolver ContainerResolver
+}
+
+// newContainerTagger returns a containerTagger using resolver, or nil if
+// container tagging is disabled. A nil containerTagger tags nothing.
+func newContainerTagger(conf *config.AgentConfig, resolver ContainerResolver) *containerTagger {
+	if !conf.ContainerTagging {
+		return nil
+	}
+	return &containerTagger{resolver: resolver}
+}
+
+// Tag sets the container of req and its metadata on all the spans of traces,
+// keeping the values set by clients. Requests without a container ID are left
+// as is.
+func (c *containerTagger) Tag(req *http.Request, traces model.Traces) {
+	if c == nil {
+		return
+	}
+	id := req.Header.Get(headerContainerID)
+	if id == "" {
+		return
+	}
+
+	md := c.resolver.Resolve(id)
+	tags := [...]model.Tag{
+		{Name: containerIDKey, Value: id},
+		{Name: podNameKey, Value: md.PodName},
+		{Name: kubeNamespaceKey, Value: md.Namespace},
+	}
+	for _, t := range traces {
+		for i := range t {
+			for _, tag := range tags {
+				if tag.Value == "" {
+					continue
+				}
+				if _, ok := t[i].Meta[tag.Name]; ok {
+					continue
+				}
+				if t[i].Meta == nil {
+					t[i].Meta = make(map[string]string, len(tags))
+				}
+				t[i].Meta[tag.Name] = tag.Value
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// staticContainerResolver resolves containers from a map
+type staticContainerResolver map[string]ContainerMetadata
+
+func (r staticContainerResolver) Resolve(containerID string) ContainerMetadata {
+	return r[containerID]
+}
+
+func TestReceiverContainerTagging(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ContainerTagging = true
+	receiver := NewHTTPReceiver(conf)
+	receiver.containers = newContainerTagger(conf, staticContainerResolver{
+		"abc": {PodName: "web-1", Namespace: "prod"},
+	})
+	c := NewConcentrator(concentratorAggregators(conf), testBucketInterval, 0)
+
+	post := func(traceID uint64, containerID string) model.Trace {
+		trace := model.Trace{
+			testSpan(c, 1, 24, 3, "a1", "resource1", 0),
+			testSpan(c, 2, 12, 3, "a1", "resource1", 0),
+		}
+		for i := range trace {
+			trace[i].TraceID = traceID
+		}
+		trace[1].ParentID = 1
+		// clients can set their own values
+		trace[1].Meta = map[string]string{podNameKey: "custom"}
+
+		var buf bytes.Buffer
+		assert.Nil(msgp.Encode(&buf, model.Traces{trace}))
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v0.4/traces", &buf)
+		if containerID != "" {
+			req.Header.Set(headerContainerID, containerID)
+		}
+		receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		received := <-receiver.traces
+		c.Add(processedTrace{Env: "none", Trace: received, Root: received.GetRoot()}, 1)
+		return received
+	}
+
+	tagged := post(1, "abc")
+	assert.Equal("abc", tagged[0].Meta[containerIDKey])
+	assert.Equal("web-1", tagged[0].Meta[podNameKey])
+	assert.Equal("prod", tagged[0].Meta[kubeNamespaceKey])
+	assert.Equal("abc", tagged[1].Meta[containerIDKey])
+	assert.Equal("custom", tagged[1].Meta[podNameKey])
+
+	// unknown containers only get their ID
+	unknown := post(2, "def")
+	assert.Equal(map[string]string{containerIDKey: "def"}, unknown[0].Meta)
+
+	untagged := post(3, "")
+	assert.Len(untagged[0].Meta, 0)
+	assert.Equal(map[string]string{podNameKey: "custom"}, untagged[1].Meta)
+
+	hits := make(map[string]int64)
+	for _, sb := range c.Flush() {
+		for key, count := range sb.Counts {
+			hits[key] += int64(count.Value)
+		}
+	}
+	assert.Equal(int64(1), hits["query|hits|env:none,resource:resource1,service:a1,container_id:abc,kube_namespace:prod,pod_name:web-1"])
+	assert.Equal(int64(1), hits["query|hits|env:none,resource:resource1,service:a1,container_id:abc,kube_namespace:prod,pod_name:custom"])
+	assert.Equal(int64(1), hits["query|hits|env:none,resource:resource1,service:a1,container_id:def"])
+	assert.Equal(int64(1), hits["query|hits|env:none,resource:resource1,service:a1"])
+}
+
+func TestReceiverContainerTaggingDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+	assert.Nil(receiver.containers)
+	assert.Equal(conf.ExtraAggregators, concentratorAggregators(conf))
+
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, model.Traces{{{TraceID: 1, SpanID: 1, Service: "a1", Name: "query", Resource: "r", Start: model.Now(), Duration: 1}}}))
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v0.4/traces", &buf)
+	req.Header.Set(headerContainerID, "abc")
+	receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Len((<-receiver.traces)[0].Meta, 0)
+}
+
+func TestEnvContainerResolver(t *testing.T) {
+	defer os.Unsetenv("DD_POD_NAME")
+	defer os.Unsetenv("DD_POD_NAMESPACE")
+	os.Setenv("DD_POD_NAME", "web-1")
+	os.Setenv("DD_POD_NAMESPACE", "prod")
+
+	r := newEnvContainerResolver()
+	assert.Equal(t, ContainerMetadata{PodName: "web-1", Namespace: "prod"}, r.Resolve("abc"))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPathPrefix is the prefix of the routes answered with CORS headers, the
+// trace intake routes never are
+const corsPathPrefix = "/debug/"
+
+// corsHandler lets the browser pages of the allowed origins query the debug
+// routes of h, e.g. a local UI polling /debug/vars. Requests from other
+// origins are served without CORS headers, so browsers block them, and their
+// preflights are forbidden.
+type corsHandler struct {
+	h         http.Handler
+	origins   map[string]struct{}
+	anyOrigin bool
+}
+
+// newCORSHandler returns h, answering the requests of the debug routes from
+// origins with CORS headers. "*" allows any origin.
+func newCORSHandler(origins []string, h http.Handler) *corsHandler {
+	c := &corsHandler{h: h, origins: make(map[string]struct{}, len(origins))}
+	for _, o := range origins {
+		if o == "*" {
+			c.anyOrigin = true
+		}
+		c.origins[o] = struct{}{}
+	}
+	return c
+}
+
+func (c *corsHandler) allowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	_, ok := c.origins[origin]
+	return ok
+}
+
+// ServeHTTP implements http.Handler
+func (c *corsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin == "" || !strings.HasPrefix(req.URL.Path, corsPathPrefix) {
+		c.h.ServeHTTP(w, req)
+		return
+	}
+
+	preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+	w.Header().Add("Vary", "Origin")
+	if !c.allowed(origin) {
+		if preflight {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		c.h.ServeHTTP(w, req)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		c.h.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DebugAllowedOrigins = []string{"http://localhost:3000"}
+	receiver := NewHTTPReceiver(conf)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/v0.3/traces", receiver.httpHandleWithVersion(v03, receiver.handleTraces))
+	handler := receiver.newServer(mux, true).Handler
+
+	serve := func(method, path, origin string, header map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader("[]"))
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "content-type",
+	}
+
+	// allowed origin
+	rr := serve("OPTIONS", "/debug/vars", "http://localhost:3000", preflight)
+	assert.Equal(http.StatusNoContent, rr.Code)
+	assert.Equal("http://localhost:3000", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(rr.Header().Get("Access-Control-Allow-Methods"), "GET")
+	assert.Equal("content-type", rr.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal("Origin", rr.Header().Get("Vary"))
+
+	rr = serve("GET", "/debug/vars", "http://localhost:3000", nil)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("{}", rr.Body.String())
+	assert.Equal("http://localhost:3000", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// denied origin
+	rr = serve("OPTIONS", "/debug/vars", "http://evil.example", preflight)
+	assert.Equal(http.StatusForbidden, rr.Code)
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	rr = serve("GET", "/debug/vars", "http://evil.example", nil)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// no origin, not a browser
+	rr = serve("GET", "/debug/vars", "", nil)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal("", rr.Header().Get("Vary"))
+
+	// the trace endpoints are unaffected, even for allowed origins
+	rr = serve("OPTIONS", "/v0.3/traces", "http://localhost:3000", preflight)
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Methods"))
+	rr = serve("POST", "/v0.3/traces", "http://localhost:3000", map[string]string{"Content-Type": "application/json"})
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal("", rr.Header().Get("Vary"))
+}
+
+func TestCORSHandlerDefaultDeny(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	handler := receiver.newServer(http.NotFoundHandler(), true).Handler
+
+	req, _ := http.NewRequest("OPTIONS", "/debug/pipeline", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(http.StatusForbidden, rr.Code)
+	assert.Equal("", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// any origin
+	handler = newCORSHandler([]string{"*"}, http.NotFoundHandler())
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(http.StatusNoContent, rr.Code)
+	assert.Equal("http://localhost:3000", rr.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// dedupeShardBits is the log2 of the number of shards of a spanDedupe
+const dedupeShardBits = 6
+
+// spanKey identifies a span across payloads
+type spanKey struct {
+	traceID, spanID uint64
+}
+
+type dedupeEntry struct {
+	key  spanKey
+	seen time.Time
+}
+
+// dedupeShard is an LRU of the spans whose key hashes to it
+type dedupeShard struct {
+	mu      sync.Mutex
+	entries map[spanKey]*list.Element
+	lru     *list.List // *dedupeEntry, most recently seen first
+}
+
+// spanDedupe remembers the spans received in the last ttl to drop the ones
+// sent again, e.g. by tracers retrying a request which timed out. Keys are
+// spread over shards not to contend on a single lock, each shard holding at
+// most its share of size spans, the least recently seen being forgotten
+// first.
+type spanDedupe struct {
+	ttl      time.Duration
+	shardCap int
+	shards   [1 << dedupeShardBits]dedupeShard
+	now      func() time.Time // overridden by tests
+
+	duplicates int64 // number of spans dropped as duplicates
+}
+
+// newSpanDedupe returns a spanDedupe remembering up to size spans for ttl,
+// or nil if size is not positive. A nil spanDedupe keeps all spans.
+func newSpanDedupe(size int, ttl time.Duration) *spanDedupe {
+	if size <= 0 {
+		return nil
+	}
+	d := &spanDedupe{
+		ttl:      ttl,
+		shardCap: size >> dedupeShardBits,
+		now:      time.Now,
+	}
+	if d.shardCap < 1 {
+		d.shardCap = 1
+	}
+	for i := range d.shards {
+		d.shards[i].entries = make(map[spanKey]*list.Element)
+		d.shards[i].lru = list.New()
+	}
+	return d
+}
+
+// shard returns the shard of k, the IDs being mixed since tracers may not
+// generate them uniformly
+func (d *spanDedupe) shard(k spanKey) *dedupeShard {
+	h := (k.traceID*31 + k.spanID) * 0x9E3779B97F4A7C15
+	return &d.shards[h>>(64-dedupeShardBits)]
+}
+
+// seen records k and tells if it was already seen in the last ttl
+func (d *spanDedupe) seen(k spanKey, now time.Time) bool {
+	s := d.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[k]; ok {
+		e := elem.Value.(*dedupeEntry)
+		dup := now.Sub(e.seen) < d.ttl
+		e.seen = now
+		s.lru.MoveToFront(elem)
+		return dup
+	}
+
+	// entries are ordered by when they were seen, evict from the oldest
+	for back := s.lru.Back(); back != nil; back = s.lru.Back() {
+		e := back.Value.(*dedupeEntry)
+		if s.lru.Len() < d.shardCap && now.Sub(e.seen) < d.ttl {
+			break
+		}
+		s.lru.Remove(back)
+		delete(s.entries, e.key)
+	}
+	s.entries[k] = s.lru.PushFront(&dedupeEntry{key: k, seen: now})
+	return false
+}
+
+// Filter returns the spans of t which were not seen in the last ttl. t is
+// returned as is when it holds no duplicate.
+func (d *spanDedupe) Filter(t model.Trace) model.Trace {
+	if d == nil {
+		return t
+	}
+
+	now := d.now()
+	var kept model.Trace
+	for i := range t {
+		// spans without ID are dropped by the normalizer anyway
+		dup := t[i].SpanID != 0 && d.seen(spanKey{t[i].TraceID, t[i].SpanID}, now)
+		switch {
+		case dup && kept == nil:
+			kept = make(model.Trace, i, len(t))
+			copy(kept, t[:i])
+		case !dup && kept != nil:
+			kept = append(kept, t[i])
+		}
+	}
+	if kept == nil {
+		return t
+	}
+	atomic.AddInt64(&d.duplicates, int64(len(t)-len(kept)))
+	return kept
+}
+
+// swapDuplicates returns the number of duplicates dropped and resets it
+func (d *spanDedupe) swapDuplicates() int64 {
+	if d == nil {
+		return 0
+	}
+	return atomic.SwapInt64(&d.duplicates, 0)
+}
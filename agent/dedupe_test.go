@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func dedupeTrace(traceID uint64, spanIDs ...uint64) model.Trace {
+	t := make(model.Trace, len(spanIDs))
+	for i, id := range spanIDs {
+		t[i] = model.Span{TraceID: traceID, SpanID: id}
+	}
+	return t
+}
+
+func TestSpanDedupe(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newSpanDedupe(1000, 20*time.Second)
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	d.now = clock.now
+
+	assert.Equal([]uint64{1, 2, 3}, spanIDs(d.Filter(dedupeTrace(42, 1, 2, 3))))
+	assert.Len(d.Filter(dedupeTrace(42, 1, 2, 3)), 0)
+	assert.Equal([]uint64{4}, spanIDs(d.Filter(dedupeTrace(42, 2, 4, 3))))
+	// the same span ID in another trace is another span
+	assert.Equal([]uint64{1}, spanIDs(d.Filter(dedupeTrace(43, 1))))
+	// spans without ID are left to the normalizer
+	assert.Equal([]uint64{0, 0}, spanIDs(d.Filter(dedupeTrace(42, 0, 0))))
+	assert.Equal(int64(5), d.swapDuplicates())
+	assert.Equal(int64(0), d.swapDuplicates())
+
+	// spans are forgotten once not seen for ttl
+	clock.advance(15 * time.Second)
+	assert.Len(d.Filter(dedupeTrace(42, 1)), 0)
+	clock.advance(15 * time.Second)
+	assert.Len(d.Filter(dedupeTrace(42, 1)), 0)
+	assert.Equal([]uint64{2}, spanIDs(d.Filter(dedupeTrace(42, 2))))
+
+	// a nil dedupe keeps everything
+	d = newSpanDedupe(0, time.Minute)
+	assert.Nil(d)
+	assert.Len(d.Filter(dedupeTrace(42, 1, 1)), 2)
+	assert.Equal(int64(0), d.swapDuplicates())
+}
+
+func TestSpanDedupeSize(t *testing.T) {
+	assert := assert.New(t)
+
+	size := (1 << dedupeShardBits) * 10
+	d := newSpanDedupe(size, time.Minute)
+	for id := uint64(1); id <= uint64(10*size); id++ {
+		d.Filter(dedupeTrace(42, id))
+	}
+
+	var n int
+	for i := range d.shards {
+		s := &d.shards[i]
+		assert.True(s.lru.Len() <= d.shardCap)
+		assert.Equal(s.lru.Len(), len(s.entries))
+		n += s.lru.Len()
+	}
+	assert.True(n > size/2, "only %d spans remembered", n)
+
+	// the most recent spans are remembered, the oldest forgotten
+	assert.Len(d.Filter(dedupeTrace(42, uint64(10*size))), 0)
+	assert.Len(d.Filter(dedupeTrace(42, 1)), 1)
+}
+
+func BenchmarkSpanDedupe(b *testing.B) {
+	d := newSpanDedupe(500000, 20*time.Second)
+	var traceID uint64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		t := dedupeTrace(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+		for pb.Next() {
+			id := atomic.AddUint64(&traceID, 1)
+			for i := range t {
+				t[i].TraceID = id
+			}
+			d.Filter(t)
+			// half of the payloads are retried
+			if id%2 == 0 {
+				d.Filter(t)
+			}
+		}
+	})
+}
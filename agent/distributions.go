@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// distributionMaxCentroids is the maximum number of points a distribution is
+// sent as, see quantile.SliceSummary.ToCentroids
+const distributionMaxCentroids = 32
+
+// maxDistributionPacketSize is the size above which the lines sent to
+// dogstatsd are split into several packets, to stay under the usual MTU
+const maxDistributionPacketSize = 1432
+
+// distributionTagReplacer replaces the characters with a meaning in the
+// dogstatsd protocol from tags
+var distributionTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// distributionClient sends the distributions of the stats buckets to
+// dogstatsd as distribution metrics named `trace.<service>.<measure>`, see
+// config.AgentConfig.MetricsStatsdAddr
+type distributionClient struct {
+	conn net.Conn
+	buf  bytes.Buffer
+}
+
+// newDistributionClient returns a client sending distributions to the
+// dogstatsd listening on the UDP addr
+func newDistributionClient(addr string) (*distributionClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &distributionClient{conn: conn}, nil
+}
+
+// Send sends the distributions of the buckets, each of them as at most
+// distributionMaxCentroids points. It does nothing on a nil client, i.e. when
+// sending distributions is disabled.
+func (c *distributionClient) Send(buckets []model.StatsBucket) {
+	if c == nil {
+		return
+	}
+
+	var lines, errors int
+	line := make([]byte, 0, 256)
+	for _, b := range buckets {
+		for _, d := range b.Distributions {
+			for _, centroid := range d.Summary.ToCentroids(distributionMaxCentroids) {
+				line = appendDistributionLine(line[:0], d, centroid.Value, centroid.Count)
+				if err := c.write(line); err != nil {
+					errors++
+				}
+				lines++
+			}
+		}
+	}
+	if err := c.flush(); err != nil {
+		errors++
+	}
+
+	if errors > 0 {
+		log.Errorf("could not send %d distribution packets to dogstatsd", errors)
+		return
+	}
+	log.Debugf("sent %d distribution points to dogstatsd", lines)
+}
+
+// write buffers a line, flushing the buffer first if the line does not fit
+// in the current packet
+func (c *distributionClient) write(line []byte) error {
+	var err error
+	if c.buf.Len() > 0 && c.buf.Len()+1+len(line) > maxDistributionPacketSize {
+		err = c.flush()
+	}
+	if c.buf.Len() > 0 {
+		c.buf.WriteByte('\n')
+	}
+	c.buf.Write(line)
+	return err
+}
+
+// flush sends the buffered lines as one packet
+func (c *distributionClient) flush() error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// appendDistributionLine appends the dogstatsd line of a point of d weighing
+// count to b. The weight is given as a sample rate of 1/count. Durations are
+// sent in seconds.
+func appendDistributionLine(b []byte, d model.Distribution, v float64, count int64) []byte {
+	if d.Measure == model.DURATION {
+		v /= 1e9
+	}
+
+	b = append(b, "trace."...)
+	b = append(b, d.Service()...)
+	b = append(b, '.')
+	b = append(b, d.Measure...)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	b = append(b, "|d"...)
+	if count > 1 {
+		b = append(b, "|@"...)
+		b = strconv.AppendFloat(b, 1/float64(count), 'g', -1, 64)
+	}
+
+	b = append(b, "|#name:"...)
+	b = append(b, distributionTagReplacer.Replace(d.Name)...)
+	for _, t := range d.TagSet {
+		b = append(b, ',')
+		b = append(b, distributionTagReplacer.Replace(t.Name)...)
+		b = append(b, ':')
+		b = append(b, distributionTagReplacer.Replace(t.Value)...)
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// distributionLineRegexp matches the dogstatsd distribution lines
+var distributionLineRegexp = regexp.MustCompile(`^([a-z0-9_.]+):([^|]+)\|d(?:\|@([^|]+))?\|#([^|]+)$`)
+
+// receiveDistributionLines returns the lines of the packets received by conn
+// until no packet comes for a while
+func receiveDistributionLines(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		if n > maxDistributionPacketSize {
+			t.Errorf("packet of %d bytes, above %d", n, maxDistributionPacketSize)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestDistributionClient(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer conn.Close()
+	client, err := newDistributionClient(conn.LocalAddr().String())
+	assert.Nil(err)
+
+	srb := model.NewStatsRawBucket(0, 1e10)
+	// enough to fill several packets, not to overflow the socket buffer
+	resources := 10
+	for i := 0; i < resources; i++ {
+		span := fixtures.TestSpan()
+		span.Resource = fmt.Sprintf("GET /raclette/%d|,#", i)
+		for j := 0; j < 1000; j++ {
+			span.Duration = int64(j+1) * 1e6
+			srb.HandleSpan(span, "prod", nil, 1, nil)
+		}
+	}
+	client.Send([]model.StatsBucket{srb.Export()})
+
+	lines := receiveDistributionLines(t, conn)
+	assert.True(len(lines) > resources && len(lines) <= resources*distributionMaxCentroids)
+
+	counts := make(map[string]float64)
+	for _, line := range lines {
+		m := distributionLineRegexp.FindStringSubmatch(line)
+		if !assert.NotNil(m, "invalid line %q", line) {
+			continue
+		}
+		assert.Equal("trace.django.duration", m[1])
+
+		v, err := strconv.ParseFloat(m[2], 64)
+		assert.Nil(err)
+		// durations are sent in seconds
+		assert.True(v > 0 && v <= 1, "value %v out of range", v)
+
+		count := 1.0
+		if m[3] != "" {
+			rate, err := strconv.ParseFloat(m[3], 64)
+			assert.Nil(err)
+			count = 1 / rate
+		}
+
+		tags := strings.Split(m[4], ",")
+		assert.Contains(tags, "name:django.controller")
+		assert.Contains(tags, "service:django")
+		assert.Contains(tags, "env:prod")
+		var resource string
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, "resource:") {
+				resource = tag
+			}
+		}
+		assert.NotEqual("", resource)
+		counts[resource] += count
+	}
+
+	assert.Len(counts, resources)
+	for resource, count := range counts {
+		assert.Equal(float64(1000), math.Floor(count+0.5), resource)
+		assert.False(strings.ContainsAny(resource, "|#"))
+	}
+}
+
+func TestDistributionClientDisabled(t *testing.T) {
+	// a nil client sends nothing
+	var client *distributionClient
+	client.Send([]model.StatsBucket{fixtures.TestStatsBucket()})
+}
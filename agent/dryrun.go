@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// dryRunStats is what the payloads encoded in dry run would have sent,
+// since the agent started
+type dryRunStats struct {
+	Payloads      int64
+	Bytes         int64 // encoded and compressed, as they would be sent
+	Traces        int64
+	StatsBuckets  int64
+	Distributions int64
+	EncodeErrors  int64
+	EncodeTime    float64 // in seconds, of all the payloads
+	Services      int64   // services payloads
+	ServicesBytes int64
+	Written       int64 // payloads written to config.AgentConfig.APIDryRunDir
+}
+
+// DryRunEndpoint implements AgentEndpoint by encoding the payloads as an
+// APIEndpoint would, compression included, but never sending them. It
+// records what they hold and writes the first ones to a LocalEndpoint, see
+// config.AgentConfig.APIDryRun. Payloads are always reported as sent.
+type DryRunEndpoint struct {
+	compressor model.Compressor
+	local      *LocalEndpoint // nil if the payloads are not written
+	maxWritten int64
+
+	mu      sync.Mutex
+	stats   dryRunStats // published with updateDryRunStats
+	written int64       // payloads given to local, including failures
+}
+
+// NewDryRunEndpoint returns a DryRunEndpoint compressing the payloads as
+// configured for the API, and writing the first conf.APIDryRunMaxPayloads of
+// them to conf.APIDryRunDir, if set
+func NewDryRunEndpoint(conf *config.AgentConfig) *DryRunEndpoint {
+	e := &DryRunEndpoint{
+		compressor: newCompressionChain(conf.APICompression, conf.APICompressionLevel).get(""),
+		maxWritten: int64(conf.APIDryRunMaxPayloads),
+	}
+	if conf.APIDryRunDir != "" && conf.APIDryRunMaxPayloads > 0 {
+		// bounded by the number of payloads, the files are never rotated
+		local, err := NewLocalEndpoint(conf.APIDryRunDir, math.MaxInt32)
+		if err != nil {
+			log.Errorf("cannot write the dry run payloads to %s: %v", conf.APIDryRunDir, err)
+		} else {
+			e.local = local
+		}
+	}
+	updateDryRunStats(e.stats)
+	return e
+}
+
+// Write encodes the payload, then drops it
+func (e *DryRunEndpoint) Write(p model.AgentPayload) (int, error) {
+	r, err := e.WriteResult(p)
+	return r.size, err
+}
+
+// WriteResult encodes the payload, then drops it
+func (e *DryRunEndpoint) WriteResult(p model.AgentPayload) (writeResult, error) {
+	start := time.Now()
+	size, err := model.StreamAgentPayloadWith(ioutil.Discard, &p, e.compressor)
+	encodeTime := time.Since(start)
+
+	var distributions int
+	for _, sb := range p.Stats {
+		distributions += len(sb.Distributions)
+	}
+
+	e.mu.Lock()
+	e.stats.EncodeTime += encodeTime.Seconds()
+	if err != nil {
+		e.stats.EncodeErrors++
+	} else {
+		e.stats.Payloads++
+		e.stats.Bytes += size
+		e.stats.Traces += int64(len(p.Traces))
+		e.stats.StatsBuckets += int64(len(p.Stats))
+		e.stats.Distributions += int64(distributions)
+	}
+	write := err == nil && e.local != nil && e.written < e.maxWritten
+	if write {
+		e.written++
+	}
+	updateDryRunStats(e.stats)
+	e.mu.Unlock()
+
+	if err != nil {
+		// as with the API, such a payload is never retried
+		log.Errorf("dry run: encoding issue: %v", err)
+		return writeResult{size: int(size), encodeTime: encodeTime}, err
+	}
+	log.Infof("dry run: encoded payload, time:%s, size:%d, traces:%d, stats buckets:%d, distributions:%d",
+		encodeTime, size, len(p.Traces), len(p.Stats), distributions)
+	statsd.Client.Count("datadog.trace_agent.writer.dry_run.payloads", 1, nil, 1)
+	statsd.Client.Count("datadog.trace_agent.writer.dry_run.payload_bytes", size, nil, 1)
+	statsd.Client.Gauge("datadog.trace_agent.writer.dry_run.encode_duration", encodeTime.Seconds(), nil, 1)
+
+	if write {
+		if _, err := e.local.Write(p); err == nil {
+			e.mu.Lock()
+			e.stats.Written++
+			updateDryRunStats(e.stats)
+			e.mu.Unlock()
+		}
+	}
+	return writeResult{size: int(size), encodeTime: encodeTime}, nil
+}
+
+// WriteServices encodes the services, then drops them
+func (e *DryRunEndpoint) WriteServices(s model.ServicesMetadata) {
+	data, err := model.EncodeServicesPayload(s)
+	if err != nil {
+		log.Errorf("dry run: encoding issue: %v", err)
+		return
+	}
+
+	e.mu.Lock()
+	e.stats.Services++
+	e.stats.ServicesBytes += int64(len(data))
+	updateDryRunStats(e.stats)
+	e.mu.Unlock()
+
+	log.Infof("dry run: encoded %d services, size:%d", len(s), len(data))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// guardTransport fails the test on any request made through it
+type guardTransport struct {
+	t *testing.T
+}
+
+func (g guardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.t.Errorf("unexpected request to %s in dry run", req.URL)
+	return nil, http.ErrNotSupported
+}
+
+func TestWriterDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = guardTransport{t}
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	data := make(chan dataFromAPI, 10)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "trace-agent-dry-run")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APISplitPayloads = true
+	conf.APIDryRun = true
+	conf.APIDryRunDir = dir
+	conf.APIDryRunMaxPayloads = 1
+
+	w := NewWriter(conf)
+	w.inServices = make(chan model.ServicesMetadata)
+	go w.Run()
+
+	// split in its traces and its stats, both reported as sent
+	w.inPayloads <- newTestPayload("test")
+	var stats dryRunStats
+	for deadline := time.Now().Add(time.Second); stats.Payloads < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		stats = publishDryRunStats().(dryRunStats)
+	}
+	w.inServices <- model.ServicesMetadata{"mcnulty": {"app_type": "web"}}
+	w.Stop()
+	assert.Len(w.payloadBuffer, 0)
+
+	stats = publishDryRunStats().(dryRunStats)
+	assert.Equal(int64(2), stats.Payloads)
+	assert.True(stats.Bytes > 0)
+	assert.Equal(int64(1), stats.Traces)
+	assert.Equal(int64(1), stats.StatsBuckets)
+	assert.Equal(int64(len(newTestPayload("test").Stats[0].Distributions)), stats.Distributions)
+	assert.True(stats.EncodeTime > 0)
+	assert.Equal(int64(1), stats.Services)
+	assert.True(stats.ServicesBytes > 0)
+
+	// only the first payload is written
+	assert.Equal(int64(1), stats.Written)
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(infos, 1)
+
+	select {
+	case d := <-data:
+		t.Fatalf("unexpected request to %s", d.urlPath)
+	default:
+	}
+
+	// and published on /info
+	receiver := NewHTTPReceiver(conf)
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/info", nil)
+	http.HandlerFunc(receiver.handleInfo).ServeHTTP(rr, req)
+	var info receiverInfo
+	assert.Nil(json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.True(info.Config.DryRun)
+	if assert.NotNil(info.DryRun) {
+		assert.Equal(stats, *info.DryRun)
+	}
+}
+
+func TestDryRunEndpointNoDir(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIDryRun = true
+	e := NewDryRunEndpoint(conf)
+	assert.Nil(e.local)
+
+	for i := 0; i < 3; i++ {
+		n, err := e.Write(newTestPayload("test"))
+		assert.Nil(err)
+		assert.True(n > 0)
+	}
+	stats := publishDryRunStats().(dryRunStats)
+	assert.Equal(int64(3), stats.Payloads)
+	assert.Equal(int64(0), stats.Written)
+}
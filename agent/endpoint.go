@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,8 +25,10 @@ type apiError struct {
 	endpoint *APIEndpoint
 }
 
-func newAPIError() *apiError {
-	return &apiError{endpoint: &APIEndpoint{}}
+// newAPIError returns an empty apiError, whose endpoint sends data the same
+// way as a
+func newAPIError(a *APIEndpoint) *apiError {
+	return &apiError{endpoint: &APIEndpoint{client: a.client, transport: a.transport, compression: a.compression, auth: a.auth, paths: a.paths}}
 }
 
 func (err *apiError) IsEmpty() bool {
@@ -35,6 +41,22 @@ func (err *apiError) Append(url, apiKey string, e error) {
 	err.endpoint.apiKeys = append(err.endpoint.apiKeys, apiKey)
 }
 
+// splitForbidden returns the errors of the URLs which rejected their API key
+// and the other errors, each nil if there are none
+func (err *apiError) splitForbidden() (forbidden, others *apiError) {
+	for i, e := range err.errs {
+		dest := &others
+		if e == errForbidden {
+			dest = &forbidden
+		}
+		if *dest == nil {
+			*dest = newAPIError(err.endpoint)
+		}
+		(*dest).Append(err.endpoint.urls[i], err.endpoint.apiKeys[i], e)
+	}
+	return forbidden, others
+}
+
 func (err *apiError) Error() string {
 	var buf bytes.Buffer
 
@@ -59,15 +81,34 @@ type AgentEndpoint interface {
 	WriteServices(s model.ServicesMetadata)
 }
 
+// writeResult is what an endpoint tells of the write of one payload
+type writeResult struct {
+	size         int           // the size of the serialized payload
+	encodeTime   time.Duration // the time spent encoding the payload
+	rateLimitLow bool          // true if the intake announced it is about to rate limit
+}
+
+// resultEndpoint is implemented by the endpoints which tell how long the
+// encoding of a payload took and whether the intake is about to rate limit.
+// Payloads are written concurrently, so this is returned by each write
+// rather than kept by the endpoint.
+type resultEndpoint interface {
+	WriteResult(p model.AgentPayload) (writeResult, error)
+}
+
 // APIEndpoint implements AgentEndpoint to send data to a
 // list of different endpoints and API keys.
 // One URL is associated to one API key, hence the two config
 // options need to be of the same length.
 type APIEndpoint struct {
-	apiKeys []string
-	urls    []string
-	stats   endpointStats
-	client  *http.Client
+	apiKeys     []string
+	urls        []string
+	stats       endpointStats
+	client      *http.Client
+	transport   *http.Transport // the transport of client
+	compression *compressionChain
+	auth        *authState
+	paths       apiPaths
 }
 
 // NewAPIEndpoint returns a new APIEndpoint from a given config
@@ -82,15 +123,53 @@ func NewAPIEndpoint(urls, apiKeys []string) *APIEndpoint {
 		panic(fmt.Errorf("APIEndpoint should be initialized with same number of url/api keys"))
 	}
 
+	transport := newAPITransport()
 	a := APIEndpoint{
-		apiKeys: apiKeys,
-		urls:    urls,
-		client:  http.DefaultClient,
+		apiKeys:     apiKeys,
+		urls:        urls,
+		client:      &http.Client{Transport: transport},
+		transport:   transport,
+		compression: newCompressionChain(model.CompressionGzip, 0),
+		auth:        newAuthState(),
+		paths:       apiPaths{payloads: model.AgentPayloadAPIPath(), services: model.ServicesPayloadAPIPath()},
 	}
 	go a.logStats()
 	return &a
 }
 
+// apiPaths are the paths of the intake routes, after the URLs of an
+// APIEndpoint
+type apiPaths struct {
+	payloads string // of the payloads with both traces and stats
+	traces   string // of the payloads with only traces, payloads if empty
+	stats    string // of the payloads with only stats, payloads if empty
+	services string
+}
+
+// payload returns the path p is posted to, and its content, contentTraces
+// or contentStats, when it has a route of its own
+func (ps apiPaths) payload(p *model.AgentPayload) (path, content string) {
+	switch {
+	case len(p.Stats) == 0 && ps.traces != "":
+		return ps.traces, contentTraces
+	case len(p.Traces) == 0 && ps.stats != "":
+		return ps.stats, contentStats
+	}
+	return ps.payloads, ""
+}
+
+// SetPaths sets the paths of the intake routes the payloads and services are
+// posted to. It must be called before any write.
+func (a *APIEndpoint) SetPaths(conf *config.AgentConfig) {
+	if conf.APISplitPayloads {
+		a.paths.traces = conf.APITracesPath
+		a.paths.stats = conf.APIStatsPath
+	}
+	if conf.APIServicesPath != "" {
+		a.paths.services = conf.APIServicesPath
+	}
+}
+
 // SetProxy updates the http client used by APIEndpoint to report via the given proxy
 func (a *APIEndpoint) SetProxy(settings *config.ProxySettings) {
 	proxyPath, err := settings.URL()
@@ -98,53 +177,247 @@ func (a *APIEndpoint) SetProxy(settings *config.ProxySettings) {
 		log.Errorf("failed to configure proxy: %v", err)
 		return
 	}
-	a.client = &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyPath),
-		},
+	a.transport.Proxy = http.ProxyURL(proxyPath)
+}
+
+// SetCompression sets the codec compressing the payloads, with a level
+// specific to it, see compressionFallbacks.
+func (a *APIEndpoint) SetCompression(name string, level int) {
+	a.compression = newCompressionChain(name, level)
+}
+
+// compressionFallbacks is the order in which codecs are tried when an intake
+// responds 415 Unsupported Media Type, starting after the configured one.
+var compressionFallbacks = []string{
+	model.CompressionZstd,
+	model.CompressionSnappy,
+	model.CompressionGzip,
+	model.CompressionNone,
+}
+
+// compressionChain holds the compressors an endpoint can use, in fallback
+// order, and the one negotiated with each URL. Negotiations are kept until
+// the agent is restarted.
+type compressionChain struct {
+	compressors []model.Compressor
+
+	mu      sync.Mutex
+	current map[string]int // index in compressors, by URL
+}
+
+// newCompressionChain returns the chain of the compressors available in
+// this build, starting with name. The level only applies to name, fallbacks
+// using their default level.
+func newCompressionChain(name string, level int) *compressionChain {
+	c := &compressionChain{current: make(map[string]int)}
+
+	start := 0
+	for i, n := range compressionFallbacks {
+		if n == name {
+			start = i
+		}
+	}
+	for i, n := range compressionFallbacks[start:] {
+		l := 0
+		if i == 0 {
+			l = level
+		}
+		compressor, err := model.NewCompressor(n, l)
+		if err != nil {
+			log.Warnf("cannot compress payloads with %s: %v", n, err)
+			continue
+		}
+		c.compressors = append(c.compressors, compressor)
 	}
+	return c
 }
 
-// Write writes the bucket to the API collector endpoint.
-func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
-	data, err := model.EncodeAgentPayload(p)
+// get returns the compressor to use for url
+func (c *compressionChain) get(url string) model.Compressor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.compressors[c.current[url]]
+}
+
+// fallback makes url use the compressor after failed, returning it and
+// false if there is none.
+func (c *compressionChain) fallback(url string, failed model.Compressor) (model.Compressor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.current[url]
+	if c.compressors[i] != failed {
+		// already negotiated by a concurrent write
+		return c.compressors[i], true
+	}
+	if i+1 >= len(c.compressors) {
+		return nil, false
+	}
+	c.current[url] = i + 1
+	return c.compressors[i+1], true
+}
+
+// authProbeInterval is how often a URL which rejected its API key is sent a
+// payload, to tell when the key is accepted again
+const authProbeInterval = time.Minute
+
+// errForbidden is the error of the URLs which rejected their API key, see
+// config.APIAuthFailure for what is done with their payloads
+var errForbidden = errors.New("403 Forbidden, the API key is missing or invalid")
+
+// authState tracks the URLs which rejected their API key, so that they are
+// only sent a payload every authProbeInterval instead of every flush
+type authState struct {
+	mu       sync.Mutex
+	rejected map[string]time.Time // when the URL was last sent a payload, by URL
+	now      func() time.Time     // overridden by tests
+}
+
+func newAuthState() *authState {
+	return &authState{rejected: make(map[string]time.Time), now: time.Now}
+}
+
+// skip tells if url rejected its API key and was sent a payload less than
+// authProbeInterval ago
+func (s *authState) skip(url string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.rejected[url]
+	return ok && s.now().Sub(last) < authProbeInterval
+}
+
+// reject records that url rejected its API key
+func (s *authState) reject(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rejected[url]; !ok {
+		log.Errorf("%s rejected its API key, sending it a payload every %s until it accepts it", url, authProbeInterval)
+	}
+	s.rejected[url] = s.now()
+}
+
+// accept records that url accepted its API key
+func (s *authState) accept(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rejected[url]; ok {
+		log.Infof("%s accepts its API key again", url)
+		delete(s.rejected, url)
+	}
+}
+
+// headerPayloadSeq is the header holding the sequence number of a payload,
+// see payloadSeq
+const headerPayloadSeq = "X-Datadog-Payload-Sequence"
+
+// newPayloadRequest returns the request posting a payload compressed with
+// compressor to url
+func newPayloadRequest(url, apiKey string, body io.Reader, compressor model.Compressor) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
-		log.Errorf("encoding issue: %v", err)
-		return 0, err
+		return nil, err
 	}
-	payloadSize := len(data)
-	statsd.Client.Count("datadog.trace_agent.writer.payload_bytes", int64(payloadSize), nil, 1)
-	atomic.AddInt64(&a.stats.TracesBytes, int64(payloadSize))
-	atomic.AddInt64(&a.stats.TracesCount, int64(len(p.Traces)))
-	atomic.AddInt64(&a.stats.TracesStats, int64(len(p.Stats)))
 
-	endpointErr := newAPIError()
+	queryParams := req.URL.Query()
+	queryParams.Add("api_key", apiKey)
+	req.URL.RawQuery = queryParams.Encode()
+	model.SetAgentPayloadHeaders(req.Header)
+	if name := compressor.Name(); name == model.CompressionNone {
+		req.Header.Del("Content-Encoding")
+	} else {
+		req.Header.Set("Content-Encoding", name)
+	}
+	return req, nil
+}
 
+// Write writes the bucket to the API collector endpoint, see WriteResult
+func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
+	r, err := a.WriteResult(p)
+	return r.size, err
+}
+
+// WriteResult writes the bucket to the API collector endpoint. The payload
+// is encoded while being sent, once for each URL, so that it is never
+// entirely held in memory.
+func (a *APIEndpoint) WriteResult(p model.AgentPayload) (writeResult, error) {
+	var payloadSize int64
+	endpointErr := newAPIError(a)
+	var rateLimitLow bool
+	var encodeTime time.Duration
+	path, content := a.paths.payload(&p)
+	var tags []string
+	if content != "" {
+		tags = []string{"payload:" + content}
+	}
+
+urls:
 	for i := range a.urls {
+		if a.auth.skip(a.urls[i]) {
+			endpointErr.Append(a.urls[i], a.apiKeys[i], errForbidden)
+			continue
+		}
 		atomic.AddInt64(&a.stats.TracesPayload, 1)
 
 		startFlush := time.Now()
 
-		url := a.urls[i] + model.AgentPayloadAPIPath()
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-		if err != nil {
-			// If the request cannot be created, there is no point
-			// in trying again later, it will always yield the
-			// same result.
-			log.Errorf("could not create request for endpoint %s: %v", url, err)
-			atomic.AddInt64(&a.stats.TracesPayloadError, 1)
-			continue
-		}
+		url := a.urls[i] + path
+		var resp *http.Response
+		var err error
+		for {
+			compressor := a.compression.get(a.urls[i])
+			body, bodyWriter := io.Pipe()
+			req, rerr := newPayloadRequest(url, a.apiKeys[i], body, compressor)
+			if rerr != nil {
+				// If the request cannot be created, there is no point
+				// in trying again later, it will always yield the
+				// same result.
+				log.Errorf("could not create request for endpoint %s: %v", url, rerr)
+				atomic.AddInt64(&a.stats.TracesPayloadError, 1)
+				updateLastAPIError(rerr)
+				continue urls
+			}
+			if p.Seq != 0 {
+				req.Header.Set(headerPayloadSeq, strconv.FormatUint(p.Seq, 10))
+			}
 
-		queryParams := req.URL.Query()
-		queryParams.Add("api_key", a.apiKeys[i])
-		req.URL.RawQuery = queryParams.Encode()
-		model.SetAgentPayloadHeaders(req.Header)
+			encoded := make(chan error, 1)
+			go func() {
+				encodeStart := time.Now()
+				size, err := model.StreamAgentPayloadWith(&drainWriter{w: bodyWriter}, &p, compressor)
+				encodeTime += time.Since(encodeStart)
+				payloadSize = size
+				bodyWriter.CloseWithError(err)
+				encoded <- err
+			}()
+
+			resp, err = a.client.Do(req)
+			// unblock the encoding if the request ended before reading it all
+			body.Close()
+			if encodeErr := <-encoded; encodeErr != nil {
+				// the payload will never be encoded, don't retry it
+				log.Errorf("encoding issue: %v", encodeErr)
+				atomic.AddInt64(&a.stats.TracesPayloadError, 1)
+				updateLastAPIError(encodeErr)
+				if resp != nil {
+					resp.Body.Close()
+				}
+				return writeResult{size: int(payloadSize), encodeTime: encodeTime}, encodeErr
+			}
 
-		resp, err := a.client.Do(req)
+			if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+				break
+			}
+			next, ok := a.compression.fallback(a.urls[i], compressor)
+			if !ok {
+				break
+			}
+			resp.Body.Close()
+			log.Warnf("endpoint %s does not accept %s payloads, sending %s payloads instead",
+				url, compressor.Name(), next.Name())
+		}
 		if err != nil {
 			log.Errorf("error when requesting to endpoint %s: %v", url, err)
 			atomic.AddInt64(&a.stats.TracesPayloadError, 1)
+			updateLastAPIError(err)
 			endpointErr.Append(a.urls[i], a.apiKeys[i], err)
 			continue
 		}
@@ -154,6 +427,7 @@ func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
 			err := fmt.Errorf("request to %s responded with %s", url, resp.Status)
 			log.Error(err)
 			atomic.AddInt64(&a.stats.TracesPayloadError, 1)
+			updateLastAPIError(err)
 
 			// Only retry for 5xx (server) errors; for 4xx errors,
 			// something is wrong with the request and there is
@@ -161,22 +435,61 @@ func (a *APIEndpoint) Write(p model.AgentPayload) (int, error) {
 			if resp.StatusCode/100 == 5 {
 				endpointErr.Append(a.urls[i], a.apiKeys[i], err)
 			}
+			// except when the API key is rejected, for the writer to
+			// handle the payload, see config.APIAuthFailure
+			if resp.StatusCode == http.StatusForbidden {
+				a.auth.reject(a.urls[i])
+				endpointErr.Append(a.urls[i], a.apiKeys[i], errForbidden)
+			}
 
 			continue
 		}
+		a.auth.accept(a.urls[i])
+
+		// the intake can tell what it did with the payload, without a
+		// response any 2xx means the payload was accepted
+		if ir := readIntakeResponse(resp); ir != nil {
+			ir.report(url, &a.stats)
+			if ir.rateLimitLow() {
+				log.Warnf("%s is about to rate limit payloads, %d remaining", url, *ir.RateLimitRemaining)
+				rateLimitLow = true
+			}
+		}
 
 		flushTime := time.Since(startFlush)
-		log.Infof("flushed payload to the API, time:%s, size:%d", flushTime, len(data))
+		log.Infof("flushed payload to the API, time:%s, size:%d", flushTime, payloadSize)
 		statsd.Client.Gauge("datadog.trace_agent.writer.flush_duration",
-			flushTime.Seconds(), nil, 1)
+			flushTime.Seconds(), tags, 1)
 	}
 
+	// the payload has the same size for all the URLs
+	statsd.Client.Count("datadog.trace_agent.writer.payload_bytes", payloadSize, tags, 1)
+	atomic.AddInt64(&a.stats.TracesBytes, payloadSize)
+	atomic.AddInt64(&a.stats.TracesCount, int64(len(p.Traces)))
+	atomic.AddInt64(&a.stats.TracesStats, int64(len(p.Stats)))
+	r := writeResult{size: int(payloadSize), encodeTime: encodeTime, rateLimitLow: rateLimitLow}
+
 	if endpointErr.IsEmpty() {
 		// The payload was sent to all endpoints without any error
-		return payloadSize, nil
+		return r, nil
 	}
 
-	return payloadSize, endpointErr
+	return r, endpointErr
+}
+
+// drainWriter writes to w until it fails, then discards the data. This way
+// the payload is always entirely encoded and its size known, even when the
+// request is interrupted.
+type drainWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *drainWriter) Write(b []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(b)
+	}
+	return len(b), nil
 }
 
 // WriteServices writes services to the services endpoint
@@ -194,11 +507,12 @@ func (a *APIEndpoint) WriteServices(s model.ServicesMetadata) {
 	for i := range a.urls {
 		atomic.AddInt64(&a.stats.ServicesPayload, 1)
 
-		url := a.urls[i] + model.ServicesPayloadAPIPath()
+		url := a.urls[i] + a.paths.services
 		req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
 		if err != nil {
 			log.Errorf("could not create request for endpoint %s: %v", url, err)
 			atomic.AddInt64(&a.stats.ServicesPayloadError, 1)
+			updateLastAPIError(err)
 			continue
 		}
 
@@ -211,13 +525,16 @@ func (a *APIEndpoint) WriteServices(s model.ServicesMetadata) {
 		if err != nil {
 			log.Errorf("error when requesting to endpoint %s: %v", url, err)
 			atomic.AddInt64(&a.stats.ServicesPayloadError, 1)
+			updateLastAPIError(err)
 			continue
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode/100 != 2 {
-			log.Errorf("request to %s responded with %s", url, resp.Status)
+			err := fmt.Errorf("request to %s responded with %s", url, resp.Status)
+			log.Error(err)
 			atomic.AddInt64(&a.stats.ServicesPayloadError, 1)
+			updateLastAPIError(err)
 			continue
 		}
 
@@ -251,6 +568,8 @@ func (a *APIEndpoint) logStats() {
 		accStats.TracesBytes = atomic.SwapInt64(&a.stats.TracesBytes, 0)
 		accStats.TracesCount = atomic.SwapInt64(&a.stats.TracesCount, 0)
 		accStats.TracesStats = atomic.SwapInt64(&a.stats.TracesStats, 0)
+		accStats.TracesAccepted = atomic.SwapInt64(&a.stats.TracesAccepted, 0)
+		accStats.TracesRejected = atomic.SwapInt64(&a.stats.TracesRejected, 0)
 		accStats.ServicesPayload = atomic.SwapInt64(&a.stats.ServicesPayload, 0)
 		accStats.ServicesPayloadError = atomic.SwapInt64(&a.stats.ServicesPayloadError, 0)
 		accStats.ServicesBytes = atomic.SwapInt64(&a.stats.ServicesBytes, 0)
@@ -276,6 +595,11 @@ type endpointStats struct {
 	// TracesStats is the number of stats in the traces payload data sent, including errors.
 	// If several URLs are given, it does not change the size (shared for all).
 	TracesStats int64
+	// TracesAccepted is the number of traces the intake responded it accepted.
+	// Intakes which respond without a JSON body are not counted.
+	TracesAccepted int64
+	// TracesRejected is the number of traces the intake responded it rejected.
+	TracesRejected int64
 	// TracesPayload is the number of services payload sent, including errors.
 	// If several URLs are given, each URL counts for one.
 	ServicesPayload int64
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/DataDog/datadog-trace-agent/fixtures"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
 )
 
 func newBenchPayload(traces, spans, stats int) model.AgentPayload {
@@ -41,3 +50,270 @@ func BenchmarkEncodeAgentPayload(b *testing.B) {
 		}
 	}
 }
+
+// newDistributionsPayload returns a payload holding a stats bucket with n
+// distributions
+func newDistributionsPayload(n int) model.AgentPayload {
+	srb := model.NewStatsRawBucket(0, 1e9)
+	for i := 0; i < n; i++ {
+		span := fixtures.TestSpan()
+		span.Resource = fmt.Sprintf("resource-%d", i)
+		for j := 0; j < 100; j++ {
+			span.Duration = int64(j * 1000)
+			srb.HandleSpan(span, "default", nil, 1, nil)
+		}
+	}
+	payload := newBenchPayload(10, 100, 0)
+	payload.Stats = []model.StatsBucket{srb.Export()}
+	return payload
+}
+
+// newErrorTypesPayload returns a payload whose stats count errors by type
+func newErrorTypesPayload() model.AgentPayload {
+	srb := model.NewStatsRawBucket(0, 1e10)
+	for _, errorType := range []string{"Timeout", "IOError"} {
+		s := model.Span{Service: "web", Name: "request", Resource: "GET /", Duration: 100, Error: 1,
+			Meta: map[string]string{model.ErrorTypeKey: errorType}}
+		srb.HandleSpan(s, "default", nil, 1, nil)
+	}
+	return model.AgentPayload{HostName: "errors", Stats: []model.StatsBucket{srb.Export()}}
+}
+
+func TestAgentPayloadWriteTo(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, payload := range []model.AgentPayload{
+		newTestPayload("test"),
+		newDistributionsPayload(50),
+		newErrorTypesPayload(),
+		model.AgentPayload{HostName: "empty", AgentInfo: &model.AgentInfo{Version: "dev"}},
+	} {
+		expected, err := json.Marshal(payload)
+		assert.Nil(err)
+
+		var buf bytes.Buffer
+		n, err := payload.WriteTo(&buf)
+		assert.Nil(err)
+		assert.Equal(int64(buf.Len()), n)
+
+		var streamed bytes.Buffer
+		assert.Nil(json.Compact(&streamed, buf.Bytes()))
+		assert.Equal(string(expected), streamed.String())
+	}
+}
+
+func TestStreamAgentPayload(t *testing.T) {
+	assert := assert.New(t)
+	payload := newTestPayload("test")
+
+	var buf bytes.Buffer
+	n, err := model.StreamAgentPayload(&buf, &payload)
+	assert.Nil(err)
+	assert.Equal(int64(buf.Len()), n)
+
+	gz, err := gzip.NewReader(&buf)
+	assert.Nil(err)
+	var decoded model.AgentPayload
+	assert.Nil(json.NewDecoder(gz).Decode(&decoded))
+	assert.Equal(payload.HostName, decoded.HostName)
+	assert.Len(decoded.Traces, 1)
+	assert.Len(decoded.Stats, 1)
+}
+
+// BenchmarkMarshalAgentPayload is the reference for BenchmarkStreamAgentPayload,
+// it marshals the whole payload before compressing it.
+func BenchmarkMarshalAgentPayload(b *testing.B) {
+	payload := newDistributionsPayload(500)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			b.Fatalf("error encoding payload: %v", err)
+		}
+		gz, _ := gzip.NewWriterLevel(ioutil.Discard, gzip.BestSpeed)
+		gz.Write(data)
+		gz.Close()
+	}
+}
+
+func BenchmarkStreamAgentPayload(b *testing.B) {
+	payload := newDistributionsPayload(500)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := model.StreamAgentPayload(ioutil.Discard, &payload); err != nil {
+			b.Fatalf("error encoding payload: %v", err)
+		}
+	}
+}
+
+// fakeCompressor is a Compressor sending uncompressed payloads under a
+// codec name
+type fakeCompressor string
+
+func (c fakeCompressor) Name() string { return string(c) }
+
+func (c fakeCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newGzipOnlyTestServer returns a server responding 415 to payloads which
+// are not gzipped, sending the Content-Encoding of all payloads to encodings
+func newGzipOnlyTestServer(encodings chan string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		encoding := r.Header.Get("Content-Encoding")
+		encodings <- encoding
+		if encoding != "gzip" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestAPIEndpointCompressionFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	encodings := make(chan string, 10)
+	server := newGzipOnlyTestServer(encodings)
+	defer server.Close()
+
+	gz, err := model.NewCompressor(model.CompressionGzip, 0)
+	assert.Nil(err)
+	a := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	a.compression = &compressionChain{
+		compressors: []model.Compressor{fakeCompressor("zstd"), gz},
+		current:     make(map[string]int),
+	}
+
+	received := func() []string {
+		var e []string
+		for len(encodings) > 0 {
+			e = append(e, <-encodings)
+		}
+		return e
+	}
+
+	_, err = a.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal([]string{"zstd", "gzip"}, received())
+
+	// the negotiated encoding is kept for the next payloads
+	_, err = a.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal([]string{"gzip"}, received())
+
+	// without any codec left, the payload is not retried
+	a.compression = &compressionChain{
+		compressors: []model.Compressor{fakeCompressor("zstd")},
+		current:     make(map[string]int),
+	}
+	_, err = a.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal([]string{"zstd"}, received())
+}
+
+func TestNewCompressionChain(t *testing.T) {
+	assert := assert.New(t)
+
+	names := func(c *compressionChain) []string {
+		var n []string
+		for _, compressor := range c.compressors {
+			n = append(n, compressor.Name())
+		}
+		return n
+	}
+
+	if _, err := model.NewCompressor(model.CompressionZstd, 0); err == nil {
+		assert.Equal([]string{"zstd", "snappy", "gzip", "none"}, names(newCompressionChain(model.CompressionZstd, 3)))
+	} else {
+		// zstd needs a build with cgo
+		assert.Equal([]string{"snappy", "gzip", "none"}, names(newCompressionChain(model.CompressionZstd, 3)))
+	}
+	assert.Equal([]string{"snappy", "gzip", "none"}, names(newCompressionChain(model.CompressionSnappy, 0)))
+	assert.Equal([]string{"gzip", "none"}, names(newCompressionChain(model.CompressionGzip, 0)))
+	assert.Equal([]string{"none"}, names(newCompressionChain(model.CompressionNone, 0)))
+	// an invalid level disables its codec only
+	assert.Equal([]string{"none"}, names(newCompressionChain(model.CompressionGzip, 42)))
+}
+
+// BenchmarkCompression compares the CPU time and the compressed size of the
+// codecs on a payload of about 2MB of JSON
+func BenchmarkCompression(b *testing.B) {
+	payload := newBenchPayload(20, 7000, 30)
+	var raw bytes.Buffer
+	payload.WriteTo(&raw)
+
+	for _, name := range compressionFallbacks {
+		compressor, err := model.NewCompressor(name, 0)
+		if err != nil {
+			b.Logf("skipping %s: %v", name, err)
+			continue
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(raw.Len()))
+			b.ReportAllocs()
+			var size int64
+			for i := 0; i < b.N; i++ {
+				if size, err = model.StreamAgentPayloadWith(ioutil.Discard, &payload, compressor); err != nil {
+					b.Fatalf("error encoding payload: %v", err)
+				}
+			}
+			b.Logf("%s: %d bytes compressed to %d", name, raw.Len(), size)
+		})
+	}
+}
+
+func TestAPIEndpointIntakeResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	var contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	a := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	write := func(ct, b string) writeResult {
+		contentType, body = ct, b
+		r, err := a.WriteResult(newTestPayload("test"))
+		assert.Nil(err)
+		return r
+	}
+
+	r := write("application/json; charset=utf-8", `{
+		"accepted_traces": 8,
+		"accepted_bytes": 1024,
+		"rejected": [{"reason": "too_old", "traces": 3}, {"traces": 1}],
+		"ratelimit_remaining": 5
+	}`)
+	assert.True(r.rateLimitLow)
+	assert.EqualValues(8, a.stats.TracesAccepted)
+	assert.EqualValues(4, a.stats.TracesRejected)
+
+	assert.False(write("application/json", `{"accepted_traces": 1, "ratelimit_remaining": 100}`).rateLimitLow)
+	assert.EqualValues(9, a.stats.TracesAccepted)
+
+	// unknown or absent bodies are a plain success
+	assert.True(write("application/json", `{"accepted_traces": 1, "ratelimit_remaining": 0}`).rateLimitLow)
+	assert.False(write("text/plain", "OK").rateLimitLow)
+	assert.False(write("application/json", `not json {"ratelimit_remaining": 0}`).rateLimitLow)
+	assert.False(write("", "").rateLimitLow)
+	assert.EqualValues(10, a.stats.TracesAccepted)
+	assert.EqualValues(4, a.stats.TracesRejected)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// filterRule is a config.TagRule counting the traces it matched
+type filterRule struct {
+	config.TagRule
+	pattern []rune
+	tags    []string // statsd tags of the hits
+	hits    int64
+}
+
+func newFilterRules(rules []config.TagRule, kind string) []*filterRule {
+	filterRules := make([]*filterRule, 0, len(rules))
+	for _, r := range rules {
+		filterRules = append(filterRules, &filterRule{
+			TagRule: r,
+			pattern: []rune(r.Pattern),
+			tags:    []string{"type:" + kind, "rule:" + r.String()},
+		})
+	}
+	return filterRules
+}
+
+// matchSpan returns true if the meta of s match the rule
+func (r *filterRule) matchSpan(s *model.Span) bool {
+	v, ok := s.GetMeta(r.Key)
+	return ok && globMatch(r.pattern, []rune(v))
+}
+
+// traceFilter drops traces by the meta of their spans, see config.TagRule
+type traceFilter struct {
+	reject  []*filterRule
+	require []*filterRule
+	anySpan bool // match all the spans of a trace, not only its root
+}
+
+func newTraceFilter(conf *config.AgentConfig) *traceFilter {
+	return &traceFilter{
+		reject:  newFilterRules(conf.FilterReject, "reject"),
+		require: newFilterRules(conf.FilterRequire, "require"),
+		anySpan: conf.FilterScope == config.FilterScopeAny,
+	}
+}
+
+// match returns the first of rules matched by t, or nil
+func (f *traceFilter) match(rules []*filterRule, t model.Trace, root *model.Span) *filterRule {
+	for _, r := range rules {
+		if !f.anySpan {
+			if r.matchSpan(root) {
+				return r
+			}
+			continue
+		}
+		for i := range t {
+			if r.matchSpan(&t[i]) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// Keep returns false if t matches a reject rule or, when there are require
+// rules, none of them. The hits of the rule deciding are counted.
+func (f *traceFilter) Keep(t model.Trace, root *model.Span) bool {
+	if r := f.match(f.reject, t, root); r != nil {
+		r.hit()
+		return false
+	}
+	if len(f.require) == 0 {
+		return true
+	}
+	if r := f.match(f.require, t, root); r != nil {
+		r.hit()
+		return true
+	}
+	statsd.Client.Count("datadog.trace_agent.filter.unmatched_trace", 1, nil, 1)
+	return false
+}
+
+func (r *filterRule) hit() {
+	atomic.AddInt64(&r.hits, 1)
+	statsd.Client.Count("datadog.trace_agent.filter.hit", 1, r.tags, 1)
+}
+
+// globMatch tells if s matches pattern, where `*` matches any sequence of
+// characters and `?` any single one. Other characters match themselves.
+func globMatch(pattern, s []rune) bool {
+	var p, i int
+	star, next := -1, 0 // position of the last `*` and of s when it was reached
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			// let the last `*` match one more character
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything/at?all", true},
+		{"staging", "staging", true},
+		{"staging", "staging2", false},
+		{"staging", "Staging", false},
+		{"?", "", false},
+		{"?", "é", true},
+		{"??", "é", false},
+		{"stag?ng", "staging", true},
+		{"*healthcheck*", "http://host/healthcheck", true},
+		{"*healthcheck*", "http://host/healthcheck?full=1", true},
+		{"*healthcheck*", "http://host/health", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYcZ", false},
+		{"a**", "a", true},
+		{"*a", "aaab", false},
+		{"*ab", "aaab", true},
+	} {
+		assert.Equal(tc.match, globMatch([]rune(tc.pattern), []rune(tc.s)), "%q on %q", tc.pattern, tc.s)
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := func(rootMeta, childMeta map[string]string) model.Trace {
+		return model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Meta: rootMeta},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Meta: childMeta},
+		}
+	}
+	staging := map[string]string{"env": "staging"}
+	payments := map[string]string{"team": "payments"}
+	stagingPayments := map[string]string{"env": "staging", "team": "payments"}
+	healthcheck := map[string]string{"http.url": "http://localhost/healthcheck"}
+
+	for _, tc := range []struct {
+		name    string
+		reject  string
+		require string
+		scope   string
+		trace   model.Trace
+		keep    bool
+	}{
+		{"no rules", "", "", config.FilterScopeRoot, trace(staging, nil), true},
+		{"rejected", "env:staging", "", config.FilterScopeRoot, trace(staging, nil), false},
+		{"rejected by glob", "http.url:*healthcheck*", "", config.FilterScopeRoot, trace(healthcheck, nil), false},
+		{"not rejected", "env:staging", "", config.FilterScopeRoot, trace(payments, nil), true},
+		{"missing key", "env:*", "", config.FilterScopeRoot, trace(payments, nil), true},
+		{"required", "", "team:payments", config.FilterScopeRoot, trace(payments, nil), true},
+		{"not required", "", "team:payments", config.FilterScopeRoot, trace(staging, nil), false},
+		{"reject first", "env:staging", "team:payments", config.FilterScopeRoot, trace(stagingPayments, nil), false},
+		{"child ignored", "env:staging", "", config.FilterScopeRoot, trace(payments, staging), true},
+		{"child rejected", "env:staging", "", config.FilterScopeAny, trace(payments, staging), false},
+		{"child required", "", "team:payments", config.FilterScopeAny, trace(staging, payments), true},
+	} {
+		conf := config.NewDefaultAgentConfig()
+		conf.FilterScope = tc.scope
+		if tc.reject != "" {
+			conf.FilterReject = parseTestRules(tc.reject)
+		}
+		if tc.require != "" {
+			conf.FilterRequire = parseTestRules(tc.require)
+		}
+		f := newTraceFilter(conf)
+		assert.Equal(tc.keep, f.Keep(tc.trace, tc.trace.GetRoot()), tc.name)
+	}
+}
+
+// parseTestRules parses a single `<key>:<pattern>` rule
+func parseTestRules(rule string) []config.TagRule {
+	for i := range rule {
+		if rule[i] == ':' {
+			return []config.TagRule{{Key: rule[:i], Pattern: rule[i+1:]}}
+		}
+	}
+	return nil
+}
+
+func TestTraceFilterHits(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.FilterReject = []config.TagRule{{Key: "env", Pattern: "staging"}, {Key: "env", Pattern: "*"}}
+	conf.FilterRequire = []config.TagRule{{Key: "team", Pattern: "payments"}}
+	f := newTraceFilter(conf)
+
+	keep := func(meta map[string]string) bool {
+		trace := model.Trace{model.Span{TraceID: 1, SpanID: 1, Meta: meta}}
+		return f.Keep(trace, &trace[0])
+	}
+	assert.False(keep(map[string]string{"env": "staging"}))
+	assert.False(keep(map[string]string{"env": "prod"}))
+	assert.True(keep(map[string]string{"team": "payments"}))
+	assert.False(keep(map[string]string{"team": "search"}))
+
+	// only the first matching rule is counted
+	assert.EqualValues(1, f.reject[0].hits)
+	assert.EqualValues(1, f.reject[1].hits)
+	assert.EqualValues(1, f.require[0].hits)
+}
+
+func TestProcessFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	conf.FilterReject = []config.TagRule{{Key: "env", Pattern: "staging"}}
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	newTrace := func(env string) model.Trace {
+		return model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /",
+				Start: now - 1e9, Duration: 100, Meta: map[string]string{"env": env}},
+		}
+	}
+
+	// filtered traces are dropped before sublayers are computed
+	filtered := newTrace("staging")
+	agent.Process(filtered)
+	assert.Nil(filtered[0].Metrics)
+
+	kept := newTrace("prod")
+	agent.Process(kept)
+	assert.NotNil(kept[0].Metrics)
+}
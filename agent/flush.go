@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// flushRequest asks the agent for a flush out of band of its ticker, done
+// being called with the payload once the writer got it
+type flushRequest struct {
+	done func(p model.AgentPayload)
+}
+
+// flushSummary describes the payload of a flush served on /debug/flush
+type flushSummary struct {
+	BucketStart   int64 `json:"bucket_start"` // start of the oldest stats bucket, 0 without stats
+	Buckets       int   `json:"buckets"`
+	Distributions int   `json:"distributions"`
+	Traces        int   `json:"traces"`
+	Bytes         int64 `json:"bytes"` // size of the payload as sent to the API
+}
+
+func newFlushSummary(p model.AgentPayload) flushSummary {
+	s := flushSummary{Buckets: len(p.Stats), Traces: len(p.Traces)}
+	for _, b := range p.Stats {
+		if s.BucketStart == 0 || b.Start < s.BucketStart {
+			s.BucketStart = b.Start
+		}
+		s.Distributions += len(b.Distributions)
+	}
+	if !p.IsEmpty() {
+		s.Bytes, _ = model.StreamAgentPayload(ioutil.Discard, &p)
+	}
+	return s
+}
+
+// handleFlush flushes the stats, including the open bucket, and the sampled
+// traces right away, and responds with the summary of the payload once the
+// writer got it. The flushes of the ticker go on as usual.
+func (r *HTTPReceiver) handleFlush(w http.ResponseWriter, req *http.Request) {
+	if !r.conf.DebugEnabled {
+		http.Error(w, "debug endpoints are disabled", http.StatusNotFound)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payloads := make(chan model.AgentPayload, 1)
+	select {
+	case r.flushRequests <- flushRequest{done: func(p model.AgentPayload) { payloads <- p }}:
+	case <-r.exit:
+		http.Error(w, "the agent is exiting", http.StatusServiceUnavailable)
+		return
+	}
+
+	var p model.AgentPayload
+	select {
+	case p = <-payloads:
+	case <-r.exit:
+		http.Error(w, "the agent is exiting", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newFlushSummary(p))
+}
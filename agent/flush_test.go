@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiverFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 10)
+	intake := newTestServer(t, data)
+	defer intake.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{intake.URL}
+	conf.APIKeys = []string{"key"}
+	conf.DebugEnabled = true
+	// the bucket of the span started before the agent
+	conf.SkipFirstPartialBucket = false
+	agent := NewAgent(conf)
+	agent.Sampler.samplerEngine = alwaysSampleEngine{}
+	agent.Writer.Run()
+	defer agent.Writer.Stop()
+
+	// serve the flush requests like Agent.Run, without its ticker
+	go func() {
+		for {
+			select {
+			case req := <-agent.Receiver.flushRequests:
+				req.done(agent.flushAll())
+			case <-agent.Receiver.exit:
+				return
+			}
+		}
+	}()
+	defer close(agent.Receiver.exit)
+
+	// the span ends in the open bucket, which a ticker flush would keep
+	trace := model.Trace{{TraceID: 1, SpanID: 1, Service: "web", Name: "request", Resource: "GET /", Start: model.Now(), Duration: 1e6}}
+	pt := processedTrace{Trace: trace, Root: &trace[0], Env: "test"}
+	agent.Concentrator.Add(pt, 1)
+	agent.Sampler.Add(pt)
+
+	server := httptest.NewServer(http.HandlerFunc(agent.Receiver.handleFlush))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/flush")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/debug/flush", "", nil)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var summary flushSummary
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&summary))
+	bsize := conf.BucketInterval.Nanoseconds()
+	assert.Equal(trace[0].End()-trace[0].End()%bsize, summary.BucketStart)
+	assert.Equal(1, summary.Buckets)
+	assert.True(summary.Distributions > 0)
+	assert.Equal(1, summary.Traces)
+	assert.True(summary.Bytes > 0)
+
+	select {
+	case received := <-data:
+		gz, err := gzip.NewReader(strings.NewReader(received.body))
+		assert.Nil(err)
+		var payload model.AgentPayload
+		assert.Nil(json.NewDecoder(gz).Decode(&payload))
+		assert.Len(payload.Stats, 1)
+		if assert.Len(payload.Traces, 1) {
+			assert.Equal(uint64(1), payload.Traces[0][0].TraceID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the payload of the flush was not sent")
+	}
+
+	// the buckets were all flushed
+	assert.Len(agent.Concentrator.Flush(), 0)
+}
+
+func TestReceiverFlushDisabled(t *testing.T) {
+	receiver := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	server := httptest.NewServer(http.HandlerFunc(receiver.handleFlush))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/debug/flush", "", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
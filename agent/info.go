@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
@@ -23,6 +24,12 @@ var (
 	infoEndpointStats  endpointStats // only for the last minute
 	infoWatchdogInfo   watchdog.Info
 	infoSamplerInfo    samplerInfo
+	infoRequestStats   map[string]requestsSnapshot // by endpoint, only for the last report
+	infoTracerStats    map[string]tracerCounts     // by tracer, only for the last minute
+	infoClockSkew      map[string]float64          // median by tracer in seconds, only for the last 10s
+	infoServiceStats   []infoService               // top services by spans, only for the last minute
+	infoDryRunStats    *dryRunStats                // since the start, nil unless in dry run
+	infoLastAPIError   infoAPIError
 	infoStart          = time.Now()
 	infoOnce           sync.Once
 	infoTmpl           *template.Template
@@ -30,6 +37,13 @@ var (
 	infoErrorTmpl      *template.Template
 )
 
+const (
+	// maxInfoServices is the number of services published on /debug/vars,
+	// and infoTopServices the number of them displayed by -info
+	maxInfoServices = 10
+	infoTopServices = 3
+)
+
 const (
 	infoTmplSrc = `{{.Banner}}
 {{.Program}}
@@ -46,14 +60,22 @@ const (
   Bytes received (1 min): {{add .Status.Receiver.TracesBytes .Status.Receiver.ServicesBytes}}
   Traces received (1 min): {{.Status.Receiver.TracesReceived}}
   Spans received (1 min): {{.Status.Receiver.SpansReceived}}
-{{if gt .Status.Receiver.TracesDropped 0}}  WARNING: Traces dropped (1 min): {{.Status.Receiver.TracesDropped}}
+  Spans per second (1 min): {{perSecond .Status.Receiver.SpansReceived}}
+{{if .TopServices}}  Top services (1 min):{{range $i, $s := .TopServices}}{{if $i}},{{end}} {{$s.Service}} ({{$s.Spans}} spans){{end}}
+{{end}}{{if gt .Status.Receiver.TracesDropped 0}}  WARNING: Traces dropped (1 min): {{.Status.Receiver.TracesDropped}}
 {{end}}{{if gt .Status.Receiver.SpansDropped 0}}  WARNING: Spans dropped (1 min): {{.Status.Receiver.SpansDropped}}
 {{end}}
   Bytes sent (1 min): {{add .Status.Endpoint.TracesBytes .Status.Endpoint.ServicesBytes}}
   Traces sent (1 min): {{.Status.Endpoint.TracesCount}}
   Stats sent (1 min): {{.Status.Endpoint.TracesStats}}
-{{if gt .Status.Endpoint.TracesPayloadError 0}}  WARNING: Traces API errors (1 min): {{.Status.Endpoint.TracesPayloadError}}/{{.Status.Endpoint.TracesPayload}}
+  Payloads sent (1 min): {{add .Status.Endpoint.TracesPayload .Status.Endpoint.ServicesPayload}} ({{add .Status.Endpoint.TracesPayloadError .Status.Endpoint.ServicesPayloadError}} errors)
+{{if .Status.Sampler}}  Traces sampled (last flush): {{.Status.Sampler.Stats.KeptTraces}}/{{.Status.Sampler.Stats.TotalTraces}}
+{{end}}{{if .Status.Pipeline}}  Queue depth:{{range $i, $q := .Status.Pipeline}}{{if $i}},{{end}} {{$q.Name}} {{$q.Length}}{{if $q.Capacity}}/{{$q.Capacity}}{{end}}{{end}}
+{{end}}{{if gt .Status.Endpoint.TracesPayloadError 0}}  WARNING: Traces API errors (1 min): {{.Status.Endpoint.TracesPayloadError}}/{{.Status.Endpoint.TracesPayload}}
+{{end}}{{if gt .Status.Endpoint.TracesRejected 0}}  WARNING: Traces rejected by the API (1 min): {{.Status.Endpoint.TracesRejected}}
 {{end}}{{if gt .Status.Endpoint.ServicesPayloadError 0}}  WARNING: Services API errors (1 min): {{.Status.Endpoint.ServicesPayloadError}}/{{.Status.Endpoint.ServicesPayload}}
+{{end}}{{if .Status.DryRun}}  WARNING: Dry run, nothing sent: {{.Status.DryRun.Payloads}} payloads, {{.Status.DryRun.Bytes}} bytes encoded since start
+{{end}}{{if .Status.LastAPIError.Error}}  WARNING: Last API error ({{.Status.LastAPIError.Time.Format "2006-01-02 15:04:05 MST"}}): {{.Status.LastAPIError.Error}}
 {{end}}
 `
 	infoNotRunningTmplSrc = `{{.Banner}}
@@ -90,6 +112,111 @@ func publishReceiverStats() interface{} {
 	return rs
 }
 
+func updateRequestStats(rs map[string]requestsSnapshot) {
+	infoMu.Lock()
+	infoRequestStats = rs
+	infoMu.Unlock()
+}
+
+func publishRequestStats() interface{} {
+	infoMu.RLock()
+	rs := infoRequestStats
+	infoMu.RUnlock()
+	return rs
+}
+
+func updateTracerStats(ts map[string]tracerCounts) {
+	infoMu.Lock()
+	infoTracerStats = ts
+	infoMu.Unlock()
+}
+
+func publishTracerStats() interface{} {
+	infoMu.RLock()
+	ts := infoTracerStats
+	infoMu.RUnlock()
+	return ts
+}
+
+func updateClockSkewStats(skews map[string]float64) {
+	infoMu.Lock()
+	infoClockSkew = skews
+	infoMu.Unlock()
+}
+
+func publishClockSkewStats() interface{} {
+	infoMu.RLock()
+	skews := infoClockSkew
+	infoMu.RUnlock()
+	return skews
+}
+
+// infoService is the number of spans received for a service
+type infoService struct {
+	Service string
+	Spans   int64
+}
+
+func updateServiceStats(spans map[string]int64) {
+	top := topServices(spans, maxInfoServices)
+	services := make([]infoService, len(top))
+	for i, t := range top {
+		services[i] = infoService{Service: t.service, Spans: t.count}
+	}
+	infoMu.Lock()
+	infoServiceStats = services
+	infoMu.Unlock()
+}
+
+func publishServiceStats() interface{} {
+	infoMu.RLock()
+	ss := infoServiceStats
+	infoMu.RUnlock()
+	return ss
+}
+
+// infoAPIError is the last error sending a payload to the API
+type infoAPIError struct {
+	Time  time.Time
+	Error string
+}
+
+func updateLastAPIError(err error) {
+	infoMu.Lock()
+	infoLastAPIError = infoAPIError{Time: time.Now(), Error: err.Error()}
+	infoMu.Unlock()
+}
+
+func publishLastAPIError() interface{} {
+	infoMu.RLock()
+	e := infoLastAPIError
+	infoMu.RUnlock()
+	if e.Error == "" {
+		return nil
+	}
+	return e
+}
+
+func updateDryRunStats(ds dryRunStats) {
+	infoMu.Lock()
+	infoDryRunStats = &ds
+	infoMu.Unlock()
+}
+
+func publishDryRunStats() interface{} {
+	infoMu.RLock()
+	ds := infoDryRunStats
+	infoMu.RUnlock()
+	if ds == nil {
+		return nil
+	}
+	return *ds
+}
+
+func publishPipeline() interface{} {
+	return pipeline.snapshot()
+}
+
 func updateEndpointStats(es endpointStats) {
 	infoMu.Lock()
 	infoEndpointStats = es
@@ -147,6 +274,16 @@ func publishVersion() interface{} {
 	}
 }
 
+// newAgentInfo returns the agent info attached to payloads
+func newAgentInfo(conf *config.AgentConfig) model.AgentInfo {
+	return model.AgentInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		StartTime: infoStart.UnixNano(),
+		Hostname:  conf.HostName,
+	}
+}
+
 type infoString string
 
 func (s infoString) String() string { return string(s) }
@@ -159,6 +296,9 @@ func initInfo(conf *config.AgentConfig) error {
 		"add": func(a, b int64) int64 {
 			return a + b
 		},
+		"perSecond": func(perMinute int64) string {
+			return fmt.Sprintf("%.2f", float64(perMinute)/60)
+		},
 	}
 
 	infoOnce.Do(func() {
@@ -166,7 +306,14 @@ func initInfo(conf *config.AgentConfig) error {
 		expvar.Publish("uptime", expvar.Func(publishUptime))
 		expvar.Publish("version", expvar.Func(publishVersion))
 		expvar.Publish("receiver", expvar.Func(publishReceiverStats))
+		expvar.Publish("requests", expvar.Func(publishRequestStats))
+		expvar.Publish("tracers", expvar.Func(publishTracerStats))
+		expvar.Publish("clock_skew", expvar.Func(publishClockSkewStats))
+		expvar.Publish("services", expvar.Func(publishServiceStats))
 		expvar.Publish("endpoint", expvar.Func(publishEndpointStats))
+		expvar.Publish("last_api_error", expvar.Func(publishLastAPIError))
+		expvar.Publish("dry_run", expvar.Func(publishDryRunStats))
+		expvar.Publish("pipeline", expvar.Func(publishPipeline))
 		expvar.Publish("sampler", expvar.Func(publishSamplerInfo))
 		expvar.Publish("watchdog", expvar.Func(publishWatchdogInfo))
 
@@ -214,11 +361,18 @@ type StatusInfo struct {
 	MemStats struct {
 		Alloc uint64
 	} `json:"memstats"`
-	Version  infoVersion        `json:"version"`
-	Receiver receiverStats      `json:"receiver"`
-	Endpoint endpointStats      `json:"endpoint"`
-	Watchdog watchdog.Info      `json:"watchdog"`
-	Config   config.AgentConfig `json:"config"`
+	Version  infoVersion   `json:"version"`
+	Receiver receiverStats `json:"receiver"`
+	Services []infoService `json:"services"`
+	Endpoint endpointStats `json:"endpoint"`
+	Sampler  *struct {
+		Stats samplerStats
+	} `json:"sampler"`
+	Pipeline     []queueSnapshot    `json:"pipeline"`
+	LastAPIError infoAPIError       `json:"last_api_error"`
+	DryRun       *dryRunStats       `json:"dry_run"`
+	Watchdog     watchdog.Info      `json:"watchdog"`
+	Config       config.AgentConfig `json:"config"`
 }
 
 func getProgramBanner(version string) (string, string) {
@@ -253,18 +407,27 @@ func getProgramBanner(version string) (string, string) {
 //   Bytes received (1 min): 10000
 //   Traces received (1 min): 240
 //   Spans received (1 min): 360
+//   Spans per second (1 min): 6.00
+//   Top services (1 min): web (200 spans), db (100 spans), cache (60 spans)
 //   WARNING: Traces dropped (1 min): 5
 //   WARNING: Spans dropped (1 min): 10
 //
 //   Bytes sent (1 min): 3245
 //   Traces sent (1 min): 6
 //   Stats sent (1 min): 60
+//   Payloads sent (1 min): 4 (2 errors)
+//   Traces sampled (last flush): 12/80
+//   Queue depth: receiver.traces 3/5000, writer.payloads 0/128
 //   WARNING: Traces API errors (1 min): 1/3
 //   WARNING: Services API errors (1 min): 1/1
+//   WARNING: Last API error (2017-02-01 13:28:10 UTC): request to https://trace.agent.datadoghq.com/api/v0.2/traces responded with 503 Service Unavailable
+//   WARNING: Dry run, nothing sent: 8 payloads, 25960 bytes encoded since start
 //
 // -----8<-------------------------------------------------------
 //
-// The "WARNING:" lines are hidden if there's nothing dropped or no errors.
+// The "WARNING:" lines are hidden if there's nothing dropped or no errors,
+// the top services, sampling and queue lines if the agent does not report
+// them.
 //
 // Typical output of 'trace-agent -info' when agent is not running:
 //
@@ -296,7 +459,8 @@ func Info(w io.Writer, conf *config.AgentConfig) error {
 	if host == "0.0.0.0" {
 		host = "127.0.0.1" // [FIXME:christian] not fool-proof
 	}
-	url := "http://localhost:" + strconv.Itoa(conf.ReceiverPort) + "/debug/vars"
+	base := "http://localhost:" + strconv.Itoa(conf.ReceiverPort)
+	url := base + "/debug/vars"
 	client := http.Client{Timeout: 3 * time.Second}
 	resp, err := client.Get(url)
 	if err != nil {
@@ -336,16 +500,48 @@ func Info(w io.Writer, conf *config.AgentConfig) error {
 		return err
 	}
 
+	// the version and uptime of /info are preferred, agents which do not
+	// serve it are described from /debug/vars only
+	if ri, err := getReceiverInfo(&client, base+"/info"); err == nil {
+		info.Version.Version = ri.Agent.Version
+		info.Uptime = ri.Uptime
+	}
+
+	top := info.Services
+	if len(top) > infoTopServices {
+		top = top[:infoTopServices]
+	}
+
 	// display the remote program version, now that we know it
 	program, banner := getProgramBanner(info.Version.Version)
 	err = infoTmpl.Execute(w, struct {
-		Banner  string
-		Program string
-		Status  *StatusInfo
+		Banner      string
+		Program     string
+		Status      *StatusInfo
+		TopServices []infoService
 	}{
-		Banner:  banner,
-		Program: program,
-		Status:  &info,
+		Banner:      banner,
+		Program:     program,
+		Status:      &info,
+		TopServices: top,
 	})
 	return nil
 }
+
+// getReceiverInfo returns the document served by the agent on /info
+func getReceiverInfo(client *http.Client, url string) (*receiverInfo, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+
+	var ri receiverInfo
+	if err := json.NewDecoder(resp.Body).Decode(&ri); err != nil {
+		return nil, err
+	}
+	return &ri, nil
+}
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/stretchr/testify/assert"
@@ -85,6 +86,49 @@ func testServerWarning(t *testing.T) *httptest.Server {
 	return server
 }
 
+// testServerDetailsHandler serves /info and the stats of a recent agent
+type testServerDetailsHandler struct {
+	t *testing.T
+}
+
+func (h *testServerDetailsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var err error
+	switch r.URL.Path {
+	case "/info":
+		h.t.Logf("serving fake (static) info data for %s", r.URL.Path)
+		_, err = w.Write([]byte(`{"agent": {"version": "1.2.3", "git_commit": "abcdef0", "start_time": 1485955690000000000, "hostname": "localhost.localdomain"}, "uptime": 3720, "endpoints": ["/v0.4/traces"]}`))
+	case "/debug/vars":
+		h.t.Logf("serving fake (static) info data for %s", r.URL.Path)
+		_, err = w.Write([]byte(`{
+"cmdline": ["./trace-agent"],
+"config": {"HostName":"localhost.localdomain","APIEndpoints":["https://trace.agent.datadoghq.com"],"ReceiverHost":"localhost","ReceiverPort":8126},
+"endpoint": {"TracesPayload":6,"TracesPayloadError":1,"TracesBytes":3245,"TracesCount":6,"TracesStats":60,"ServicesPayload":2,"ServicesPayloadError":0,"ServicesBytes":346},
+"memstats": {"Alloc":773552},
+"pid": 38149,
+"receiver": {"TracesBytes":10000,"ServicesBytes":1000,"SpansReceived":390,"TracesReceived":240,"SpansDropped":0,"TracesDropped":0},
+"services": [{"Service":"web","Spans":200},{"Service":"db","Spans":100},{"Service":"cache","Spans":60},{"Service":"worker","Spans":30}],
+"sampler": {"Stats": {"KeptTPS":1.2,"TotalTPS":8,"KeptTraces":12,"TotalTraces":80}},
+"pipeline": [{"name":"receiver.traces","length":3,"capacity":5000,"high_water":12},{"name":"writer.payload_buffer","length":1,"capacity":0,"high_water":2}],
+"last_api_error": {"Time":"2017-02-01T13:28:10Z","Error":"request to https://trace.agent.datadoghq.com/api/v0.2/traces responded with 503 Service Unavailable"},
+"uptime": 3719,
+"version": {"Version": "1.2.2"}
+}`))
+	default:
+		h.t.Logf("answering 404 for %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if err != nil {
+		h.t.Errorf("error serving %s: %v", r.URL.Path, err)
+	}
+}
+
+func testServerDetails(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(&testServerDetailsHandler{t: t})
+	t.Logf("test server (serving the stats of a recent agent) listening on %s", server.URL)
+	return server
+}
+
 type testServerErrorHandler struct {
 	t *testing.T
 }
@@ -152,7 +196,7 @@ func TestInfo(t *testing.T) {
 	t.Logf("Info:\n%s\n", info)
 
 	lines := strings.Split(info, "\n")
-	assert.Equal(21, len(lines))
+	assert.Equal(23, len(lines))
 	assert.Regexp(regexp.MustCompile(`^={10,100}$`), lines[0])
 	assert.Regexp(regexp.MustCompile(`^Trace Agent \(v.*\)$`), lines[1])
 	assert.Regexp(regexp.MustCompile(`^={10,100}$`), lines[2])
@@ -170,12 +214,14 @@ func TestInfo(t *testing.T) {
 	assert.Equal("  Bytes received (1 min): 11000", lines[12])
 	assert.Equal("  Traces received (1 min): 240", lines[13])
 	assert.Equal("  Spans received (1 min): 360", lines[14])
-	assert.Equal("", lines[15])
-	assert.Equal("  Bytes sent (1 min): 3591", lines[16])
-	assert.Equal("  Traces sent (1 min): 6", lines[17])
-	assert.Equal("  Stats sent (1 min): 60", lines[18])
-	assert.Equal("", lines[19])
-	assert.Equal("", lines[20])
+	assert.Equal("  Spans per second (1 min): 6.00", lines[15])
+	assert.Equal("", lines[16])
+	assert.Equal("  Bytes sent (1 min): 3591", lines[17])
+	assert.Equal("  Traces sent (1 min): 6", lines[18])
+	assert.Equal("  Stats sent (1 min): 60", lines[19])
+	assert.Equal("  Payloads sent (1 min): 6 (0 errors)", lines[20])
+	assert.Equal("", lines[21])
+	assert.Equal("", lines[22])
 }
 
 func TestWarning(t *testing.T) {
@@ -205,7 +251,7 @@ func TestWarning(t *testing.T) {
 	t.Logf("Info:\n%s\n", info)
 
 	lines := strings.Split(info, "\n")
-	assert.Equal(25, len(lines))
+	assert.Equal(27, len(lines))
 	assert.Regexp(regexp.MustCompile(`^={10,100}$`), lines[0])
 	assert.Regexp(regexp.MustCompile(`^Trace Agent \(v.*\)$`), lines[1])
 	assert.Regexp(regexp.MustCompile(`^={10,100}$`), lines[2])
@@ -223,16 +269,89 @@ func TestWarning(t *testing.T) {
 	assert.Equal("  Bytes received (1 min): 11000", lines[12])
 	assert.Equal("  Traces received (1 min): 240", lines[13])
 	assert.Equal("  Spans received (1 min): 360", lines[14])
-	assert.Equal("  WARNING: Traces dropped (1 min): 5", lines[15])
-	assert.Equal("  WARNING: Spans dropped (1 min): 10", lines[16])
+	assert.Equal("  Spans per second (1 min): 6.00", lines[15])
+	assert.Equal("  WARNING: Traces dropped (1 min): 5", lines[16])
+	assert.Equal("  WARNING: Spans dropped (1 min): 10", lines[17])
+	assert.Equal("", lines[18])
+	assert.Equal("  Bytes sent (1 min): 3591", lines[19])
+	assert.Equal("  Traces sent (1 min): 6", lines[20])
+	assert.Equal("  Stats sent (1 min): 60", lines[21])
+	assert.Equal("  Payloads sent (1 min): 6 (4 errors)", lines[22])
+	assert.Equal("  WARNING: Traces API errors (1 min): 3/4", lines[23])
+	assert.Equal("  WARNING: Services API errors (1 min): 1/2", lines[24])
+	assert.Equal("", lines[25])
+	assert.Equal("", lines[26])
+}
+
+func TestInfoDetails(t *testing.T) {
+	assert := assert.New(t)
+	conf := testInit(t)
+
+	server := testServerDetails(t)
+	defer server.Close()
+
+	url, err := url.Parse(server.URL)
+	assert.Nil(err)
+	port, err := strconv.Atoi(strings.Split(url.Host, ":")[1])
+	assert.Nil(err)
+	conf.ReceiverPort = port
+
+	var buf bytes.Buffer
+	err = Info(&buf, conf)
+	assert.Nil(err)
+	info := buf.String()
+
+	t.Logf("Info:\n%s\n", info)
+
+	lines := strings.Split(info, "\n")
+	assert.Equal(28, len(lines))
+	// the version and uptime come from /info
+	assert.Equal("Trace Agent (v 1.2.3)", lines[1])
+	assert.Equal("  Uptime: 3720 seconds", lines[5])
+	assert.Equal("  Spans received (1 min): 390", lines[14])
+	assert.Equal("  Spans per second (1 min): 6.50", lines[15])
+	assert.Equal("  Top services (1 min): web (200 spans), db (100 spans), cache (60 spans)", lines[16])
 	assert.Equal("", lines[17])
-	assert.Equal("  Bytes sent (1 min): 3591", lines[18])
-	assert.Equal("  Traces sent (1 min): 6", lines[19])
-	assert.Equal("  Stats sent (1 min): 60", lines[20])
-	assert.Equal("  WARNING: Traces API errors (1 min): 3/4", lines[21])
-	assert.Equal("  WARNING: Services API errors (1 min): 1/2", lines[22])
-	assert.Equal("", lines[23])
-	assert.Equal("", lines[24])
+	assert.Equal("  Payloads sent (1 min): 8 (1 errors)", lines[21])
+	assert.Equal("  Traces sampled (last flush): 12/80", lines[22])
+	assert.Equal("  Queue depth: receiver.traces 3/5000, writer.payload_buffer 1", lines[23])
+	assert.Equal("  WARNING: Traces API errors (1 min): 1/6", lines[24])
+	assert.Equal("  WARNING: Last API error (2017-02-01 13:28:10 UTC): "+
+		"request to https://trace.agent.datadoghq.com/api/v0.2/traces responded with 503 Service Unavailable", lines[25])
+	assert.Equal("", lines[26])
+	assert.Equal("", lines[27])
+}
+
+func TestInfoLastAPIError(t *testing.T) {
+	assert := assert.New(t)
+	testInit(t)
+
+	infoMu.Lock()
+	infoLastAPIError = infoAPIError{}
+	infoMu.Unlock()
+	assert.Equal("null", expvar.Get("last_api_error").String())
+
+	updateLastAPIError(fmt.Errorf("request to %s responded with %s", "https://example.com", "502 Bad Gateway"))
+	var e infoAPIError
+	assert.Nil(json.Unmarshal([]byte(expvar.Get("last_api_error").String()), &e))
+	assert.Equal("request to https://example.com responded with 502 Bad Gateway", e.Error)
+	assert.True(time.Since(e.Time) < time.Minute)
+}
+
+func TestInfoServiceStats(t *testing.T) {
+	assert := assert.New(t)
+	testInit(t)
+
+	spans := make(map[string]int64)
+	for i := 0; i < maxInfoServices+5; i++ {
+		spans[fmt.Sprintf("service-%02d", i)] = int64(i)
+	}
+	updateServiceStats(spans)
+
+	services := publishServiceStats().([]infoService)
+	assert.Len(services, maxInfoServices)
+	assert.Equal(infoService{Service: "service-14", Spans: 14}, services[0])
+	assert.Equal(infoService{Service: "service-05", Spans: 5}, services[maxInfoServices-1])
 }
 
 func TestNotRunning(t *testing.T) {
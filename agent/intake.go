@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// maxIntakeResponseSize is the size above which intake responses are not read
+const maxIntakeResponseSize = 64 * 1024
+
+// rateLimitLowWatermark is the number of remaining payloads announced by the
+// intake at or below which the writer slows down, see Writer.flushLimit
+const rateLimitLowWatermark = 10
+
+// intakeResponse is the JSON body the intake can respond to payloads with
+type intakeResponse struct {
+	AcceptedTraces int64             `json:"accepted_traces"`
+	AcceptedBytes  int64             `json:"accepted_bytes"`
+	Rejected       []intakeRejection `json:"rejected"`
+	// RateLimitRemaining is the number of payloads the intake still accepts
+	// before rate limiting this API key, nil if not given
+	RateLimitRemaining *int64 `json:"ratelimit_remaining"`
+}
+
+// intakeRejection counts the traces of a payload rejected for a reason
+type intakeRejection struct {
+	Reason string `json:"reason"`
+	Traces int64  `json:"traces"`
+}
+
+// readIntakeResponse decodes the body of resp, returning nil if it is not a
+// JSON intake response
+func readIntakeResponse(resp *http.Response) *intakeResponse {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return nil
+	}
+	var ir intakeResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntakeResponseSize)).Decode(&ir); err != nil {
+		log.Debugf("cannot decode intake response: %v", err)
+		return nil
+	}
+	return &ir
+}
+
+// rateLimitLow returns true if the intake announced it is about to rate limit
+func (ir *intakeResponse) rateLimitLow() bool {
+	return ir.RateLimitRemaining != nil && *ir.RateLimitRemaining <= rateLimitLowWatermark
+}
+
+// report logs the rejections of the response and submits its counts
+func (ir *intakeResponse) report(url string, stats *endpointStats) {
+	atomic.AddInt64(&stats.TracesAccepted, ir.AcceptedTraces)
+	statsd.Client.Count("datadog.trace_agent.writer.accepted_traces", ir.AcceptedTraces, nil, 1)
+	statsd.Client.Count("datadog.trace_agent.writer.accepted_bytes", ir.AcceptedBytes, nil, 1)
+
+	for _, r := range ir.Rejected {
+		reason := r.Reason
+		if reason == "" {
+			reason = "unknown"
+		}
+		log.Warnf("%s rejected %d traces: %s", url, r.Traces, reason)
+		atomic.AddInt64(&stats.TracesRejected, r.Traces)
+		statsd.Client.Count("datadog.trace_agent.writer.rejected_traces", r.Traces, []string{"reason:" + reason}, 1)
+	}
+
+	if ir.RateLimitRemaining != nil {
+		statsd.Client.Gauge("datadog.trace_agent.writer.ratelimit_remaining", float64(*ir.RateLimitRemaining), nil, 1)
+	}
+}
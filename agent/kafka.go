@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// KafkaProducer is what the KafkaEndpoint needs from a Kafka client
+type KafkaProducer interface {
+	// Produce sends a message to a topic, waiting for the required acks
+	Produce(topic string, key, value []byte) error
+	// Close flushes and releases the connections to the brokers
+	Close() error
+}
+
+// newKafkaProducer returns a producer connected to the given brokers
+var newKafkaProducer = func(brokers []string, requiredAcks int) (KafkaProducer, error) {
+	conf := sarama.NewConfig()
+	conf.ClientID = "trace-agent"
+	conf.Producer.RequiredAcks = sarama.RequiredAcks(requiredAcks)
+	// needed by the sync producer to wait for the acks
+	conf.Producer.Return.Successes = true
+	p, err := sarama.NewSyncProducer(brokers, conf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the Kafka brokers %s: %v", strings.Join(brokers, ","), err)
+	}
+	return saramaProducer{p}, nil
+}
+
+// saramaProducer implements KafkaProducer with a sarama.SyncProducer
+type saramaProducer struct {
+	producer sarama.SyncProducer
+}
+
+// Produce implements KafkaProducer
+func (p saramaProducer) Produce(topic string, key, value []byte) error {
+	_, _, err := p.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.ByteEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
+
+// Close implements KafkaProducer
+func (p saramaProducer) Close() error {
+	return p.producer.Close()
+}
+
+// kafkaMessage is a payload waiting to be produced
+type kafkaMessage struct {
+	key   []byte
+	value []byte
+}
+
+// KafkaEndpoint implements AgentEndpoint to send gob-encoded payloads to
+// a Kafka topic, keyed by hostname. Payloads are produced asynchronously
+// from a bounded queue so that a slow cluster never blocks the writer,
+// payloads which don't fit in the queue are dropped.
+type KafkaEndpoint struct {
+	producer KafkaProducer
+	topic    string
+	queue    chan kafkaMessage
+
+	dropped int64 // number of payloads dropped because the queue was full
+	errors  int64 // number of payloads the producer failed to send
+
+	exit   chan struct{}
+	exitWG sync.WaitGroup
+}
+
+// NewKafkaEndpoint returns a KafkaEndpoint producing to topic, with a queue
+// of queueSize payloads
+func NewKafkaEndpoint(producer KafkaProducer, topic string, queueSize int) *KafkaEndpoint {
+	return &KafkaEndpoint{
+		producer: producer,
+		topic:    topic,
+		queue:    make(chan kafkaMessage, queueSize),
+		exit:     make(chan struct{}),
+	}
+}
+
+// Run starts producing the queued payloads
+func (k *KafkaEndpoint) Run() {
+	k.exitWG.Add(2)
+	go k.run()
+	go k.logStats()
+}
+
+func (k *KafkaEndpoint) run() {
+	defer k.exitWG.Done()
+
+	for {
+		select {
+		case m := <-k.queue:
+			k.produce(m)
+		case <-k.exit:
+			// produce what is left in the queue before leaving
+			for {
+				select {
+				case m := <-k.queue:
+					k.produce(m)
+				default:
+					if err := k.producer.Close(); err != nil {
+						log.Errorf("error closing Kafka producer: %v", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (k *KafkaEndpoint) produce(m kafkaMessage) {
+	if err := k.producer.Produce(k.topic, m.key, m.value); err != nil {
+		log.Errorf("error producing payload to Kafka topic %s: %v", k.topic, err)
+		atomic.AddInt64(&k.errors, 1)
+	}
+}
+
+// Stop produces the remaining payloads and closes the producer
+func (k *KafkaEndpoint) Stop() {
+	close(k.exit)
+	k.exitWG.Wait()
+}
+
+// Write queues the payload to be produced. It never returns an error since
+// payloads are not retried, see KafkaEndpoint.
+func (k *KafkaEndpoint) Write(p model.AgentPayload) (int, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		log.Errorf("encoding issue: %v", err)
+		return 0, nil
+	}
+
+	select {
+	case k.queue <- kafkaMessage{key: []byte(p.HostName), value: buf.Bytes()}:
+	default:
+		atomic.AddInt64(&k.dropped, 1)
+	}
+	return buf.Len(), nil
+}
+
+// WriteServices drops services, they are only sent to the API
+func (k *KafkaEndpoint) WriteServices(s model.ServicesMetadata) {}
+
+// logStats periodically submits stats about the endpoint to statsd
+func (k *KafkaEndpoint) logStats() {
+	defer k.exitWG.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.exit:
+			return
+		}
+		if dropped := atomic.SwapInt64(&k.dropped, 0); dropped > 0 {
+			log.Infof("dropped %d payloads (Kafka queue full)", dropped)
+			statsd.Client.Count("datadog.trace_agent.kafka.dropped_payload", dropped, []string{"reason:queue_full"}, 1)
+		}
+		statsd.Client.Count("datadog.trace_agent.kafka.error", atomic.SwapInt64(&k.errors, 0), nil, 1)
+		statsd.Client.Gauge("datadog.trace_agent.kafka.queue_size", float64(len(k.queue)), nil, 1)
+	}
+}
+
+// teeEndpoint implements AgentEndpoint to write payloads to a main endpoint
+// and a secondary one. Only the main endpoint errors are reported, so that
+// the secondary one never affects retries.
+type teeEndpoint struct {
+	main      AgentEndpoint
+	secondary AgentEndpoint
+}
+
+// Write writes the payload to both endpoints
+func (t teeEndpoint) Write(p model.AgentPayload) (int, error) {
+	t.secondary.Write(p)
+	return t.main.Write(p)
+}
+
+// WriteResult writes the payload to both endpoints, returning the result of
+// the main one
+func (t teeEndpoint) WriteResult(p model.AgentPayload) (writeResult, error) {
+	t.secondary.Write(p)
+	if re, ok := t.main.(resultEndpoint); ok {
+		return re.WriteResult(p)
+	}
+	n, err := t.main.Write(p)
+	return writeResult{size: n}, err
+}
+
+// WriteServices writes services to both endpoints
+func (t teeEndpoint) WriteServices(s model.ServicesMetadata) {
+	t.secondary.WriteServices(s)
+	t.main.WriteServices(s)
+}
+
+// newKafkaEndpoint creates and starts the KafkaEndpoint described by conf
+func newKafkaEndpoint(conf *config.AgentConfig) (*KafkaEndpoint, error) {
+	producer, err := newKafkaProducer(conf.KafkaBrokers, conf.KafkaRequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+	k := NewKafkaEndpoint(producer, conf.KafkaTopic, conf.KafkaQueueSize)
+	k.Run()
+	return k, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+type producedMessage struct {
+	topic string
+	key   []byte
+	value []byte
+}
+
+// mockProducer captures produced messages, blocking until release is closed
+type mockProducer struct {
+	mu       sync.Mutex
+	messages []producedMessage
+	release  chan struct{}
+	closed   bool
+}
+
+func newMockProducer() *mockProducer {
+	release := make(chan struct{})
+	close(release)
+	return &mockProducer{release: release}
+}
+
+func (p *mockProducer) Produce(topic string, key, value []byte) error {
+	<-p.release
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, producedMessage{topic, key, value})
+	return nil
+}
+
+func (p *mockProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+type failingEndpoint struct{ err error }
+
+func (e failingEndpoint) Write(p model.AgentPayload) (int, error) { return 0, e.err }
+func (e failingEndpoint) WriteServices(s model.ServicesMetadata)  {}
+
+func TestKafkaEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	producer := newMockProducer()
+	k := NewKafkaEndpoint(producer, "test-topic", 10)
+	k.Run()
+
+	payload := newTestPayload("test")
+	_, err := k.Write(payload)
+	assert.Nil(err)
+	k.Stop()
+
+	assert.True(producer.closed)
+	assert.Len(producer.messages, 1)
+	m := producer.messages[0]
+	assert.Equal("test-topic", m.topic)
+	assert.Equal("test.host", string(m.key))
+
+	var decoded model.AgentPayload
+	assert.Nil(gob.NewDecoder(bytes.NewReader(m.value)).Decode(&decoded))
+	assert.Equal(payload.HostName, decoded.HostName)
+	assert.Equal(payload.Env, decoded.Env)
+	assert.Len(decoded.Traces, 1)
+	assert.Equal(payload.Traces[0][0].TraceID, decoded.Traces[0][0].TraceID)
+	assert.Len(decoded.Stats, 1)
+}
+
+func TestKafkaEndpointQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	producer := newMockProducer()
+	producer.release = make(chan struct{})
+	k := NewKafkaEndpoint(producer, "test-topic", 2)
+
+	// not running: nothing is consumed from the queue
+	for i := 0; i < 5; i++ {
+		_, err := k.Write(newTestPayload("test"))
+		assert.Nil(err)
+	}
+	assert.Equal(int64(3), k.dropped)
+
+	close(producer.release)
+	k.Run()
+	k.Stop()
+	assert.Len(producer.messages, 2)
+}
+
+func TestSaramaProducer(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := mocks.NewSyncProducer(t, nil)
+	mock.ExpectSendMessageWithCheckerFunctionAndSucceed(func(v []byte) error {
+		if string(v) != "payload" {
+			return errors.New("unexpected value " + string(v))
+		}
+		return nil
+	})
+	mock.ExpectSendMessageAndFail(sarama.ErrNotLeaderForPartition)
+
+	p := saramaProducer{mock}
+	assert.Nil(p.Produce("test-topic", []byte("test.host"), []byte("payload")))
+	assert.Equal(sarama.ErrNotLeaderForPartition, p.Produce("test-topic", []byte("test.host"), []byte("payload")))
+	assert.Nil(p.Close())
+}
+
+func TestTeeEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	mainErr := errors.New("main failed")
+	tee := teeEndpoint{main: failingEndpoint{mainErr}, secondary: failingEndpoint{errors.New("secondary failed")}}
+	_, err := tee.Write(newTestPayload("test"))
+	assert.Equal(mainErr, err)
+
+	producer := newMockProducer()
+	k := NewKafkaEndpoint(producer, "test-topic", 10)
+	k.Run()
+	tee = teeEndpoint{main: NullEndpoint{}, secondary: k}
+	_, err = tee.Write(newTestPayload("test"))
+	assert.Nil(err)
+	k.Stop()
+	assert.Len(producer.messages, 1)
+}
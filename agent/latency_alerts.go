@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// maxLatencyAlerts is the number of latency alerts logged per flush, the
+// largest shifts first
+const maxLatencyAlerts = 20
+
+// latencyAlert is a duration distribution whose p95 shifted since the
+// previous flush
+type latencyAlert struct {
+	dist     model.Distribution
+	previous float64 // p95 of the previous flush, in nanoseconds
+	p95      float64
+	ratio    float64 // of the largest p95 to the smallest, to rank the alerts
+}
+
+// latencyAlerts compares the p95 of the duration distributions of each flush
+// to the ones of the previous flush, by distribution key, so that the agent
+// itself tells large latency shifts, see Concentrator.SetLatencyAlerts.
+type latencyAlerts struct {
+	factor  float64 // the p95 ratio above which a shift is alerted
+	minHits uint64  // in both flushes, below which a distribution is too noisy
+	maxKeys int     // the keys remembered, 0 for no limit
+
+	last map[string]latencyP95 // of the last flush, by distribution key
+}
+
+// latencyP95 is the p95 of a distribution and the number of its values
+type latencyP95 struct {
+	p95  float64
+	hits uint64
+}
+
+// newLatencyAlerts returns a latencyAlerts remembering up to maxKeys
+// distributions, if not 0
+func newLatencyAlerts(factor float64, minHits, maxKeys int) *latencyAlerts {
+	return &latencyAlerts{
+		factor:  factor,
+		minHits: uint64(minHits),
+		maxKeys: maxKeys,
+		last:    make(map[string]latencyP95),
+	}
+}
+
+// check logs the alerts of the buckets of a flush, up to maxLatencyAlerts,
+// and returns all of them. The keys of the flush replace the ones of the
+// previous one, so that the keys which disappear start over. A nil
+// latencyAlerts checks nothing.
+func (a *latencyAlerts) check(buckets []model.StatsBucket) []latencyAlert {
+	if a == nil || len(buckets) == 0 {
+		return nil
+	}
+
+	// the latest bucket of the flush wins, usually there is only one
+	sorted := make([]model.StatsBucket, len(buckets))
+	copy(sorted, buckets)
+	sort.Sort(bucketsByStart(sorted))
+
+	current := make(map[string]latencyP95)
+	dists := make(map[string]model.Distribution)
+	for _, sb := range sorted {
+		for key, d := range sb.Distributions {
+			if d.Measure != model.DURATION || d.Summary == nil || d.Summary.N == 0 || d.Resource() == model.OverflowResource {
+				continue
+			}
+			current[key] = latencyP95{p95: d.Summary.Quantile(0.95), hits: uint64(d.Summary.N)}
+			dists[key] = d
+		}
+	}
+
+	var alerts []latencyAlert
+	for key, cur := range current {
+		prev, ok := a.last[key]
+		if !ok || prev.hits < a.minHits || cur.hits < a.minHits || prev.p95 <= 0 || cur.p95 <= 0 {
+			continue
+		}
+		ratio := cur.p95 / prev.p95
+		if ratio < 1 {
+			ratio = 1 / ratio
+		}
+		if ratio >= a.factor {
+			alerts = append(alerts, latencyAlert{dist: dists[key], previous: prev.p95, p95: cur.p95, ratio: ratio})
+		}
+	}
+	sort.Sort(alertsByRatio(alerts))
+
+	if a.maxKeys > 0 && len(current) > a.maxKeys {
+		current = busiestKeys(current, a.maxKeys)
+	}
+	a.last = current
+
+	logLatencyAlerts(alerts)
+	return alerts
+}
+
+// logLatencyAlerts logs the first maxLatencyAlerts alerts, and counts all
+func logLatencyAlerts(alerts []latencyAlert) {
+	if len(alerts) == 0 {
+		return
+	}
+	statsd.Client.Count("datadog.trace_agent.concentrator.latency_alerts", int64(len(alerts)), nil, 1)
+	for i, al := range alerts {
+		if i == maxLatencyAlerts {
+			config.WithFields(config.Fields{"suppressed": len(alerts) - i}).
+				Warnf("%d more p95 shifts since the previous flush not logged", len(alerts)-i)
+			break
+		}
+		config.WithFields(config.Fields{
+			"env":          al.dist.TagSet.Get("env").Value,
+			"service":      al.dist.Service(),
+			"resource":     al.dist.Resource(),
+			"name":         al.dist.Name,
+			"previous_p95": al.previous,
+			"p95":          al.p95,
+		}).Warnf("p95 duration of service %q resource %q shifted from %.0fns to %.0fns since the previous flush",
+			al.dist.Service(), al.dist.Resource(), al.previous, al.p95)
+	}
+}
+
+// busiestKeys returns the n distributions of m with the most hits, ties
+// broken by key
+func busiestKeys(m map[string]latencyP95, n int) map[string]latencyP95 {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Sort(keysByHits{keys, m})
+	kept := make(map[string]latencyP95, n)
+	for _, k := range keys[:n] {
+		kept[k] = m[k]
+	}
+	return kept
+}
+
+type bucketsByStart []model.StatsBucket
+
+func (b bucketsByStart) Len() int           { return len(b) }
+func (b bucketsByStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bucketsByStart) Less(i, j int) bool { return b[i].Start < b[j].Start }
+
+type alertsByRatio []latencyAlert
+
+func (a alertsByRatio) Len() int      { return len(a) }
+func (a alertsByRatio) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a alertsByRatio) Less(i, j int) bool {
+	if a[i].ratio != a[j].ratio {
+		return a[i].ratio > a[j].ratio
+	}
+	return a[i].dist.Key < a[j].dist.Key
+}
+
+type keysByHits struct {
+	keys []string
+	m    map[string]latencyP95
+}
+
+func (k keysByHits) Len() int      { return len(k.keys) }
+func (k keysByHits) Swap(i, j int) { k.keys[i], k.keys[j] = k.keys[j], k.keys[i] }
+func (k keysByHits) Less(i, j int) bool {
+	if hi, hj := k.m[k.keys[i]].hits, k.m[k.keys[j]].hits; hi != hj {
+		return hi > hj
+	}
+	return k.keys[i] < k.keys[j]
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/watch"
+	"github.com/stretchr/testify/assert"
+)
+
+// latencyTrace returns n spans of resource lasting duration
+func latencyTrace(c *Concentrator, n int, duration int64, resource string) model.Trace {
+	var trace model.Trace
+	for i := 0; i < n; i++ {
+		trace = append(trace, testSpan(c, uint64(i+1), duration, 3, "web", resource, 0))
+	}
+	return trace
+}
+
+func TestLatencyAlerts(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+	a := newLatencyAlerts(2, 10, 0)
+
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 100, "GET /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 1000, "POST /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 1000, "PUT /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 5, 1000, "DELETE /")}, 1)
+	assert.Len(a.check(c.Flush()), 0)
+
+	// slower GET, slightly faster POST, and too few DELETE and PUT
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 300, "GET /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 600, "POST /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 5, 5000, "PUT /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 5, 5000, "DELETE /")}, 1)
+	alerts := a.check(c.Flush())
+	if assert.Len(alerts, 1) {
+		assert.Equal("web", alerts[0].dist.Service())
+		assert.Equal("GET /", alerts[0].dist.Resource())
+		assert.Equal(float64(100), alerts[0].previous)
+		assert.Equal(float64(300), alerts[0].p95)
+	}
+
+	// no flush, nothing changes
+	assert.Len(a.check(c.Flush()), 0)
+	assert.Len(a.last, 4)
+
+	// faster too, but PUT disappeared in between and starts over
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 100, "GET /")}, 1)
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 20, 100, "PUT /")}, 1)
+	assert.Len(a.check(c.Flush()), 1)
+	assert.Len(a.last, 2)
+}
+
+func TestLatencyAlertsBounds(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+	a := newLatencyAlerts(2, 0, 2*maxLatencyAlerts)
+
+	for _, duration := range []int64{100, 1000} {
+		for i := 0; i < 3*maxLatencyAlerts; i++ {
+			n := 1
+			if i >= 2*maxLatencyAlerts {
+				n = 2 // the busiest distributions are remembered
+			}
+			c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, n, duration, fmt.Sprintf("GET /%d", i))}, 1)
+		}
+		alerts := a.check(c.Flush())
+		assert.Len(a.last, 2*maxLatencyAlerts)
+		if duration == 1000 {
+			// all returned, only the first logged
+			assert.Len(alerts, 2*maxLatencyAlerts)
+			for _, al := range alerts {
+				assert.Equal(float64(10), al.ratio)
+			}
+		}
+	}
+}
+
+func TestConcentratorLatencyAlerts(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, 1000)
+	assert.Nil(c.latency)
+	// a nil latencyAlerts checks nothing
+	assert.Nil(c.latency.check([]model.StatsBucket{model.NewStatsBucket(0, testBucketInterval)}))
+
+	c.SetLatencyAlerts(3, 50)
+	if assert.NotNil(c.latency) {
+		assert.Equal(float64(3), c.latency.factor)
+		assert.Equal(uint64(50), c.latency.minHits)
+		assert.Equal(1000, c.latency.maxKeys)
+	}
+
+	// and checks the flushes
+	c.clock = watch.NewFakeClock(time.Now())
+	c.Add(processedTrace{Env: "none", Trace: latencyTrace(c, 1, 100, "GET /")}, 1)
+	c.Flush()
+	assert.Len(c.latency.last, 1)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// localFilePrefix starts the names of the files written by a LocalEndpoint,
+// only these are rotated
+const localFilePrefix = "trace-agent-"
+
+// localFile is a file written by a LocalEndpoint
+type localFile struct {
+	name string
+	size int64
+}
+
+// LocalEndpoint implements AgentEndpoint by writing payloads as JSON files
+// to a directory, for users to inspect what would have been sent. Once the
+// files are bigger than maxSize, the oldest ones are removed.
+type LocalEndpoint struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	files []localFile // oldest first
+	size  int64
+	seq   int
+	now   func() time.Time // overridden by tests
+}
+
+// NewLocalEndpoint returns a LocalEndpoint writing to dir, which is created
+// if needed. The files already in dir count in maxSize.
+func NewLocalEndpoint(dir string, maxSize int) (*LocalEndpoint, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &LocalEndpoint{dir: dir, maxSize: int64(maxSize), now: time.Now}
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), localFilePrefix) {
+			continue
+		}
+		e.files = append(e.files, localFile{fi.Name(), fi.Size()})
+		e.size += fi.Size()
+	}
+	// names start with their creation time
+	sort.Sort(localFilesByName(e.files))
+	return e, nil
+}
+
+type localFilesByName []localFile
+
+func (f localFilesByName) Len() int           { return len(f) }
+func (f localFilesByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f localFilesByName) Less(i, j int) bool { return f[i].name < f[j].name }
+
+// Write writes the payload to a new file
+func (e *LocalEndpoint) Write(p model.AgentPayload) (int, error) {
+	size, err := e.writeFile("payload.json", p.WriteTo)
+	if err != nil {
+		log.Errorf("cannot write payload to %s: %v", e.dir, err)
+	}
+	return size, err
+}
+
+// WriteServices writes the services to a new file
+func (e *LocalEndpoint) WriteServices(s model.ServicesMetadata) {
+	_, err := e.writeFile("services.json", func(f io.Writer) (int64, error) {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return 0, err
+		}
+		n, err := f.Write(data)
+		return int64(n), err
+	})
+	if err != nil {
+		log.Errorf("cannot write services to %s: %v", e.dir, err)
+	}
+}
+
+// writeFile creates a file whose name ends with suffix, written by write,
+// then removes the oldest files to stay under maxSize
+func (e *LocalEndpoint) writeFile(suffix string, write func(io.Writer) (int64, error)) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// the sequence number keeps names unique and ordered within a nanosecond
+	e.seq++
+	name := fmt.Sprintf("%s%d-%06d-%s", localFilePrefix, e.now().UnixNano(), e.seq%1000000, suffix)
+	f, err := os.Create(filepath.Join(e.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	n, err := write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(e.dir, name))
+		return int(n), err
+	}
+
+	e.files = append(e.files, localFile{name, n})
+	e.size += n
+	for e.size > e.maxSize && len(e.files) > 1 {
+		oldest := e.files[0]
+		if err := os.Remove(filepath.Join(e.dir, oldest.name)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cannot rotate local payloads: %v", err)
+			break
+		}
+		e.files = e.files[1:]
+		e.size -= oldest.size
+	}
+	return int(n), nil
+}
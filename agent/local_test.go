@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-local")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// files left by a previous run are rotated, other files are not
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "trace-agent-1-000001-payload.json"), make([]byte, 10), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), make([]byte, 1000), 0644))
+
+	payload := newTestPayload("test")
+	var buf bytes.Buffer
+	payload.WriteTo(&buf)
+	size := buf.Len()
+
+	e, err := NewLocalEndpoint(dir, 2*size+10)
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		n, err := e.Write(payload)
+		assert.Nil(err)
+		assert.Equal(size, n)
+	}
+	e.WriteServices(model.ServicesMetadata{"mcnulty": {"app_type": "web"}})
+
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if !assert.Len(names, 3) {
+		t.FailNow()
+	}
+	assert.Equal("notes.txt", names[0])
+	assert.True(strings.HasSuffix(names[1], "-payload.json"), names[1])
+	assert.True(strings.HasSuffix(names[2], "-services.json"), names[2])
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, names[1]))
+	assert.Nil(err)
+	var decoded model.AgentPayload
+	assert.Nil(json.Unmarshal(data, &decoded))
+	assert.Equal("test", decoded.Env)
+	assert.Len(decoded.Traces, 1)
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, names[2]))
+	assert.Nil(err)
+	assert.Equal(`{"mcnulty":{"app_type":"web"}}`, string(data))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -19,6 +20,10 @@ import (
 	_ "net/http/pprof"
 )
 
+// shutdownTimeout is how long the agent is given to flush and save its state
+// once told to exit
+const shutdownTimeout = 30 * time.Second
+
 // handleSignal closes a channel to exit cleanly from routines
 func handleSignal(exit chan struct{}) {
 	sigChan := make(chan os.Signal, 10)
@@ -55,13 +60,14 @@ var opts struct {
 	logLevel     string
 	version      bool
 	info         bool
+	strict       bool
 	cpuprofile   string
 	memprofile   string
 }
 
-// version info sourced from build flags
+// version info sourced from build flags, see go_build in gorake.rb
 var (
-	Version   string
+	Version   = "dev"
 	GitCommit string
 	GitBranch string
 	BuildDate string
@@ -104,6 +110,7 @@ func init() {
 	flag.StringVar(&opts.configFile, "config", "/etc/datadog/trace-agent.ini", "Trace agent ini config file.")
 	flag.BoolVar(&opts.version, "version", false, "Show version information and exit")
 	flag.BoolVar(&opts.info, "info", false, "Show info about running trace agent process and exit")
+	flag.BoolVar(&opts.strict, "strict", false, "Fail on unknown keys of the config files, as DD_STRICT_CONFIG=true")
 
 	// profiling arguments
 	flag.StringVar(&opts.cpuprofile, "cpuprofile", "", "Write cpu profile to file")
@@ -163,6 +170,10 @@ func main() {
 		log.Infof("using configuration from %s", opts.ddConfigFile)
 	}
 
+	if opts.strict {
+		// environment variables override the config files, see config.mergeEnv
+		os.Setenv("DD_STRICT_CONFIG", "true")
+	}
 	agentConf, err = config.NewAgentConfig(conf, legacyConf)
 	if err != nil {
 		die("%v", err)
@@ -193,7 +204,7 @@ func main() {
 	}
 
 	// Initialize logging (replacing the default logger)
-	err = config.NewLoggerLevelCustom(agentConf.LogLevel, agentConf.LogFilePath)
+	err = config.NewLogger(agentConf.LogLevel, agentConf.LogFilePath, agentConf.LogFormat, agentConf.LogFileMaxSize)
 	if err != nil {
 		die("cannot create logger: %v", err)
 	}
@@ -210,10 +221,18 @@ func main() {
 	agent := NewAgent(agentConf)
 
 	// Handle stops properly
-	go handleSignal(agent.exit)
+	stop := make(chan struct{})
+	go handleSignal(stop)
 
 	log.Infof("trace-agent running on host %s", agentConf.HostName)
-	agent.Run()
+	agent.Start()
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := agent.Stop(ctx); err != nil {
+		log.Errorf("could not exit cleanly within %s: %v", shutdownTimeout, err)
+	}
+	cancel()
 
 	// collect memory profile
 	if opts.memprofile != "" {
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// The OTLP/HTTP JSON encoding of the traces sent by OpenTelemetry exporters,
+// an ExportTraceServiceRequest, limited to what the agent translates.
+// See https://github.com/open-telemetry/opentelemetry-proto
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              otlpEnum       `json:"kind"`
+	StartTimeUnixNano otlpInt        `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpInt        `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Events            []otlpEvent    `json:"events"`
+	Links             []otlpLink     `json:"links"`
+	Status            struct {
+		Code    otlpEnum `json:"code"`
+		Message string   `json:"message"`
+	} `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano otlpInt        `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	TraceState string         `json:"traceState"`
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue holds one of its fields, the others being nil
+type otlpAnyValue struct {
+	StringValue *string          `json:"stringValue"`
+	BoolValue   *bool            `json:"boolValue"`
+	IntValue    *otlpInt         `json:"intValue"`
+	DoubleValue *float64         `json:"doubleValue"`
+	ArrayValue  *json.RawMessage `json:"arrayValue"`
+	KvlistValue *json.RawMessage `json:"kvlistValue"`
+	BytesValue  *string          `json:"bytesValue"`
+}
+
+// number returns the value as a metric, if it is a number
+func (v otlpAnyValue) number() (float64, bool) {
+	switch {
+	case v.IntValue != nil:
+		return float64(*v.IntValue), true
+	case v.DoubleValue != nil:
+		return *v.DoubleValue, true
+	}
+	return 0, false
+}
+
+// String returns the value as a tag. Arrays and key-value lists are kept in
+// their JSON encoding.
+func (v otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.ArrayValue != nil:
+		return string(*v.ArrayValue)
+	case v.KvlistValue != nil:
+		return string(*v.KvlistValue)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	}
+	return ""
+}
+
+// otlpInt is a 64-bit integer, which the JSON encoding of protobuf writes as
+// a string, but some exporters as a number
+type otlpInt int64
+
+// UnmarshalJSON implements json.Unmarshaler
+func (i *otlpInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// some exporters write unsigned nanosecond timestamps
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil || u > math.MaxInt64 {
+			return fmt.Errorf("invalid integer %s", b)
+		}
+		n = int64(u)
+	}
+	*i = otlpInt(n)
+	return nil
+}
+
+// otlpEnum is an enum, written as its number or as its name,
+// e.g. 2 or "SPAN_KIND_SERVER"
+type otlpEnum int
+
+// UnmarshalJSON implements json.Unmarshaler, names are resolved with
+// otlpEnumNames
+func (e *otlpEnum) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if strings.HasPrefix(s, `"`) {
+		n, ok := otlpEnumNames[strings.Trim(s, `"`)]
+		if !ok {
+			return fmt.Errorf("unknown enum value %s", b)
+		}
+		*e = otlpEnum(n)
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid enum value %s", b)
+	}
+	*e = otlpEnum(n)
+	return nil
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+	otlpKindProducer = 4
+	otlpKindConsumer = 5
+
+	otlpStatusError = 2
+)
+
+var otlpEnumNames = map[string]int{
+	"SPAN_KIND_UNSPECIFIED": 0,
+	"SPAN_KIND_INTERNAL":    otlpKindInternal,
+	"SPAN_KIND_SERVER":      otlpKindServer,
+	"SPAN_KIND_CLIENT":      otlpKindClient,
+	"SPAN_KIND_PRODUCER":    otlpKindProducer,
+	"SPAN_KIND_CONSUMER":    otlpKindConsumer,
+	"STATUS_CODE_UNSET":     0,
+	"STATUS_CODE_OK":        1,
+	"STATUS_CODE_ERROR":     otlpStatusError,
+}
+
+// otlpKindNames are the values of the span.kind meta, by span kind
+var otlpKindNames = map[otlpEnum]string{
+	otlpKindInternal: "internal",
+	otlpKindServer:   "server",
+	otlpKindClient:   "client",
+	otlpKindProducer: "producer",
+	otlpKindConsumer: "consumer",
+}
+
+// otlpMetaKeys maps the OpenTelemetry semantic conventions to the meta keys
+// of our clients. Other attributes are kept under their own key, in the
+// metrics if they are numbers.
+var otlpMetaKeys = map[string]string{
+	"deployment.environment":    "env",
+	"service.version":           "version",
+	"http.request.method":       "http.method",
+	"http.response.status_code": "http.status_code",
+	"url.full":                  "http.url",
+	"http.status_code":          "http.status_code", // a tag, though an integer
+}
+
+// otlpUnknownService is the service of the spans whose resource has no
+// service.name, as named by the OpenTelemetry SDKs
+const otlpUnknownService = "unknown_service"
+
+// otlpStats counts what the translation of OTLP payloads loses, reported by
+// the receiver
+var otlpStats struct {
+	EventsDropped   int64 // events beyond model.MaxEventsPerSpan
+	LinksDropped    int64 // links to invalid span IDs
+	LinkAttrsLost   int64 // attributes and trace states of links, which our model lacks
+	ResourcesNoName int64 // resources without a service.name
+}
+
+// decodeTracesOTLP decodes an OTLP/HTTP JSON payload and groups its spans
+// into traces. The protobuf encoding is not supported.
+func decodeTracesOTLP(req *http.Request, v APIVersion) (model.Traces, error) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType != "application/json" && contentType != "" {
+		return nil, errUnsupportedMediaType
+	}
+	spans, err := decodeOTLPSpans(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	return model.TracesFromSpans(spans), nil
+}
+
+// decodeOTLPSpans decodes an OTLP/HTTP JSON payload into spans
+func decodeOTLPSpans(r io.Reader) ([]model.Span, error) {
+	var payload otlpTracesRequest
+	if err := json.NewDecoder(r).Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	var spans []model.Span
+	for _, rs := range payload.ResourceSpans {
+		service := otlpUnknownService
+		resourceMeta := make(map[string]string, len(rs.Resource.Attributes))
+		for _, kv := range rs.Resource.Attributes {
+			if kv.Key == "service.name" {
+				service = kv.Value.String()
+				continue
+			}
+			resourceMeta[otlpMetaKey(kv.Key)] = kv.Value.String()
+		}
+		if service == otlpUnknownService {
+			atomic.AddInt64(&otlpStats.ResourcesNoName, 1)
+		}
+
+		for _, ss := range rs.ScopeSpans {
+			for _, o := range ss.Spans {
+				s, err := convertOTLPSpan(o, service, resourceMeta)
+				if err != nil {
+					return nil, err
+				}
+				if ss.Scope.Name != "" {
+					s.Meta["otel.scope.name"] = ss.Scope.Name
+				}
+				if ss.Scope.Version != "" {
+					s.Meta["otel.scope.version"] = ss.Scope.Version
+				}
+				spans = append(spans, s)
+			}
+		}
+	}
+	return spans, nil
+}
+
+// otlpMetaKey returns the meta key of an attribute, see otlpMetaKeys
+func otlpMetaKey(key string) string {
+	if k, ok := otlpMetaKeys[key]; ok {
+		return k
+	}
+	return key
+}
+
+func otlpMapped(key string) bool {
+	_, ok := otlpMetaKeys[key]
+	return ok
+}
+
+// convertOTLPSpan translates a span of service, tagged with the attributes of
+// its resource
+func convertOTLPSpan(o otlpSpan, service string, resourceMeta map[string]string) (model.Span, error) {
+	traceID, err := parseOTLPID(o.TraceID, 16)
+	if err != nil {
+		return model.Span{}, fmt.Errorf("invalid traceId: %v", err)
+	}
+	spanID, err := parseOTLPID(o.SpanID, 8)
+	if err != nil {
+		return model.Span{}, fmt.Errorf("invalid spanId: %v", err)
+	}
+	parentID, err := parseOTLPID(o.ParentSpanID, 8)
+	if err != nil {
+		return model.Span{}, fmt.Errorf("invalid parentSpanId: %v", err)
+	}
+
+	s := model.Span{
+		TraceID:  traceID,
+		SpanID:   spanID,
+		ParentID: parentID,
+		Service:  service,
+		Name:     o.Name,
+		Resource: o.Name,
+		Start:    int64(o.StartTimeUnixNano),
+		Meta:     make(map[string]string, len(resourceMeta)+len(o.Attributes)+1),
+		Metrics:  make(map[string]float64),
+	}
+	if end := int64(o.EndTimeUnixNano); end > s.Start {
+		s.Duration = end - s.Start
+	}
+	for k, v := range resourceMeta {
+		s.Meta[k] = v
+	}
+	for _, kv := range o.Attributes {
+		if n, ok := kv.Value.number(); ok && !otlpMapped(kv.Key) {
+			s.Metrics[kv.Key] = n
+			continue
+		}
+		s.Meta[otlpMetaKey(kv.Key)] = kv.Value.String()
+	}
+	if kind, ok := otlpKindNames[o.Kind]; ok {
+		s.Meta["span.kind"] = kind
+	}
+	s.Type = otlpSpanType(o.Kind, s.Meta)
+	if method, route := s.Meta["http.method"], s.Meta["http.route"]; o.Kind == otlpKindServer && method != "" && route != "" {
+		s.Resource = method + " " + route
+	}
+	if s.Meta["db.system"] != "" {
+		// quantized for the sql, cassandra and redis types
+		if q := s.Meta["db.statement"]; q != "" {
+			s.Resource = q
+		} else if q := s.Meta["db.query.text"]; q != "" {
+			s.Resource = q
+		}
+	}
+
+	if o.Status.Code == otlpStatusError {
+		s.Error = 1
+		if o.Status.Message != "" {
+			s.Meta[model.ErrorMsgKey] = o.Status.Message
+		}
+	}
+
+	events := o.Events
+	if len(events) > model.MaxEventsPerSpan {
+		atomic.AddInt64(&otlpStats.EventsDropped, int64(len(events)-model.MaxEventsPerSpan))
+		events = events[:model.MaxEventsPerSpan]
+	}
+	for _, e := range events {
+		attrs := make(map[string]string, len(e.Attributes))
+		for _, kv := range e.Attributes {
+			attrs[kv.Key] = kv.Value.String()
+		}
+		if e.Name == "exception" {
+			// the exception.* keys are error aliases, see model.Span.Normalize
+			for k, v := range attrs {
+				if strings.HasPrefix(k, "exception.") {
+					s.Meta[k] = v
+				}
+			}
+		}
+		s.Events = append(s.Events, model.SpanEvent{Ts: int64(e.TimeUnixNano), Name: e.Name, Attrs: attrs})
+	}
+
+	for _, l := range o.Links {
+		if l.TraceState != "" || len(l.Attributes) > 0 {
+			atomic.AddInt64(&otlpStats.LinkAttrsLost, 1)
+		}
+		lt, terr := parseOTLPID(l.TraceID, 16)
+		ls, serr := parseOTLPID(l.SpanID, 8)
+		if terr != nil || serr != nil || lt == 0 || ls == 0 {
+			atomic.AddInt64(&otlpStats.LinksDropped, 1)
+			continue
+		}
+		s.Links = append(s.Links, model.SpanLink{TraceID: lt, SpanID: ls})
+	}
+	return s, nil
+}
+
+// otlpSpanType returns the type of a span of kind with meta, for the
+// protocols which have one
+func otlpSpanType(kind otlpEnum, meta map[string]string) string {
+	switch system := meta["db.system"]; {
+	case system == "redis" || system == "cassandra" || system == "mongodb" || system == "memcached":
+		return system
+	case system != "":
+		return "sql"
+	case kind == otlpKindServer:
+		return "web"
+	case kind == otlpKindClient && meta["http.method"] != "":
+		return "http"
+	}
+	return ""
+}
+
+// parseOTLPID parses an ID of size bytes written in hex, keeping its lower 64
+// bits: trace IDs have 128 bits, ours 64. Empty IDs are 0.
+func parseOTLPID(s string, size int) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if len(s) != 2*size {
+		return 0, fmt.Errorf("%q is not %d hex bytes", s, size)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return 0, err
+	}
+	var id uint64
+	for _, c := range b[len(b)-8:] {
+		id = id<<8 | uint64(c)
+	}
+	return id, nil
+}
+
+// respondOTLP answers with an empty ExportTraceServiceResponse
+func respondOTLP(r *HTTPReceiver, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "{}")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeOTLPSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	payload, err := ioutil.ReadFile("testdata/otlp_traces.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&otlpStats.LinkAttrsLost, 0)
+	atomic.StoreInt64(&otlpStats.LinksDropped, 0)
+	atomic.StoreInt64(&otlpStats.ResourcesNoName, 0)
+
+	spans, err := decodeOTLPSpans(bytes.NewReader(payload))
+	assert.Nil(err)
+	if !assert.Len(spans, 3) {
+		t.FailNow()
+	}
+
+	web := spans[0]
+	assert.Equal(uint64(0xd269b633813fc60c), web.TraceID)
+	assert.Equal(uint64(0xeee19b7ec3c1b174), web.SpanID)
+	assert.Equal(uint64(0), web.ParentID)
+	assert.Equal("checkout", web.Service)
+	assert.Equal("GET", web.Name)
+	assert.Equal("GET /cart/{id}", web.Resource)
+	assert.Equal("web", web.Type)
+	assert.Equal(int64(1544712660000000000), web.Start)
+	assert.Equal(int64(time.Second), web.Duration)
+	assert.Equal(int32(1), web.Error)
+	assert.Equal(map[string]string{
+		"env":                "prod",
+		"host.name":          "web-1",
+		"http.method":        "GET",
+		"http.route":         "/cart/{id}",
+		"http.status_code":   "500",
+		"cached":             "false",
+		"tags":               `{"values": [{"stringValue": "a"}]}`,
+		"span.kind":          "server",
+		"otel.scope.name":    "io.opentelemetry.http",
+		"otel.scope.version": "1.2.0",
+		"error.msg":          "internal error",
+		"exception.type":     "TimeoutError",
+		"exception.message":  "query timed out",
+	}, web.Meta)
+	assert.Equal(map[string]float64{"retries": 2}, web.Metrics)
+	if assert.Len(web.Events, 1) {
+		assert.Equal("exception", web.Events[0].Name)
+		assert.Equal(int64(1544712660500000000), web.Events[0].Ts)
+		assert.Equal("TimeoutError", web.Events[0].Attrs["exception.type"])
+	}
+	assert.Equal([]model.SpanLink{{TraceID: 42, SpanID: 52}}, web.Links)
+
+	db := spans[1]
+	assert.Equal(web.TraceID, db.TraceID)
+	assert.Equal(uint64(1234), db.SpanID)
+	assert.Equal(web.SpanID, db.ParentID)
+	assert.Equal("sql", db.Type)
+	assert.Equal("SELECT * FROM carts WHERE id = 42", db.Resource)
+	assert.Equal("client", db.Meta["span.kind"])
+	assert.Equal(int64(200*time.Millisecond), db.Duration)
+	assert.Equal(1.5, db.Metrics["db.rows"])
+	assert.Equal(int32(0), db.Error)
+
+	job := spans[2]
+	assert.Equal(otlpUnknownService, job.Service)
+	assert.Equal("job", job.Resource)
+	assert.Equal("", job.Type)
+	assert.Equal("internal", job.Meta["span.kind"])
+
+	// what the translation loses is counted
+	assert.Equal(int64(1), atomic.LoadInt64(&otlpStats.LinkAttrsLost))
+	assert.Equal(int64(1), atomic.LoadInt64(&otlpStats.LinksDropped))
+	assert.Equal(int64(1), atomic.LoadInt64(&otlpStats.ResourcesNoName))
+}
+
+func TestDecodeOTLPSpansEventsOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	events := make([]string, model.MaxEventsPerSpan+3)
+	for i := range events {
+		events[i] = `{"name": "retry", "timeUnixNano": "1"}`
+	}
+	payload := `{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "0000000000000000000000000000002a",
+		"spanId": "0000000000000001", "name": "n", "events": [` + strings.Join(events, ",") + `]}]}]}]}`
+
+	dropped := atomic.LoadInt64(&otlpStats.EventsDropped)
+	spans, err := decodeOTLPSpans(strings.NewReader(payload))
+	assert.Nil(err)
+	if assert.Len(spans, 1) {
+		assert.Len(spans[0].Events, model.MaxEventsPerSpan)
+	}
+	assert.Equal(int64(3), atomic.LoadInt64(&otlpStats.EventsDropped)-dropped)
+}
+
+func TestDecodeOTLPSpansInvalid(t *testing.T) {
+	for name, payload := range map[string]string{
+		"not json":       `resourceSpans`,
+		"short trace ID": `{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "2a", "spanId": "0000000000000001"}]}]}]}`,
+		"bad span ID":    `{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "0000000000000000000000000000002a", "spanId": "zzzzzzzzzzzzzzzz"}]}]}]}`,
+		"bad timestamp":  `{"resourceSpans": [{"scopeSpans": [{"spans": [{"startTimeUnixNano": "yesterday"}]}]}]}`,
+		"bad kind":       `{"resourceSpans": [{"scopeSpans": [{"spans": [{"kind": "SPAN_KIND_SIDEWAYS"}]}]}]}`,
+	} {
+		_, err := decodeOTLPSpans(strings.NewReader(payload))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestReceiverOTLP(t *testing.T) {
+	assert := assert.New(t)
+
+	payload, err := ioutil.ReadFile("testdata/otlp_traces.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	receiver := NewHTTPReceiver(conf)
+	server := httptest.NewServer(receiver.httpHandleWithVersion(vOTLP, receiver.handleTraces))
+	defer server.Close()
+
+	// the protobuf encoding is not supported yet
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader(payload))
+	assert.Nil(err)
+	assert.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Post(server.URL, "application/json", bytes.NewReader(payload))
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("{}", string(body))
+
+	// spans wait for the rest of their trace
+	receiver.reassembler.Flush(true)
+	var trace model.Trace
+	for len(receiver.traces) > 0 {
+		if tr := <-receiver.traces; tr[0].Service == "checkout" {
+			trace = tr
+		}
+	}
+	if !assert.Len(trace, 2) {
+		t.FailNow()
+	}
+
+	// the spans get the stats of their service, computed asynchronously
+	agent := NewAgent(conf)
+	now := model.Now()
+	for i := range trace {
+		trace[i].Start += now - 1e9 - 1544712660000000000
+	}
+	agent.Process(trace)
+
+	var hits map[string]float64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		agent.Concentrator.mu.Lock()
+		hits = make(map[string]float64)
+		for _, b := range agent.Concentrator.buckets {
+			for _, c := range b.Export().Counts {
+				if c.Measure == model.HITS {
+					hits[c.TagSet.Get("service").Value+" "+c.TagSet.Get("resource").Value] += c.Value
+				}
+			}
+		}
+		agent.Concentrator.mu.Unlock()
+		if len(hits) == 2 {
+			break
+		}
+	}
+	assert.Equal(map[string]float64{
+		"checkout GET /cart/{id}":                   1,
+		"checkout SELECT * FROM carts WHERE id = ?": 1,
+	}, hits)
+}
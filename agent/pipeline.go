@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// queueStats tracks the depth of a queue between two components of the
+// agent, typically a channel. Senders call observe after sending, which only
+// costs a len and an atomic compare.
+type queueStats struct {
+	name      string
+	length    func() int // current number of elements in the queue
+	capacity  int        // 0 for unbounded
+	highWater int64      // highest length observed since the last report
+}
+
+// observe records the current length of the queue in its high-water mark
+func (q *queueStats) observe() {
+	n := int64(q.length())
+	for {
+		hw := atomic.LoadInt64(&q.highWater)
+		if n <= hw || atomic.CompareAndSwapInt64(&q.highWater, hw, n) {
+			return
+		}
+	}
+}
+
+// queueSnapshot is the state of a queue served on /debug/pipeline
+type queueSnapshot struct {
+	Name      string `json:"name"`
+	Length    int    `json:"length"`
+	Capacity  int    `json:"capacity"`
+	HighWater int64  `json:"high_water"`
+}
+
+func (q *queueStats) snapshot() queueSnapshot {
+	return queueSnapshot{
+		Name:      q.name,
+		Length:    q.length(),
+		Capacity:  q.capacity,
+		HighWater: atomic.LoadInt64(&q.highWater),
+	}
+}
+
+// pipelineStats holds the queues of the agent pipeline
+type pipelineStats struct {
+	mu     sync.RWMutex
+	queues map[string]*queueStats
+}
+
+// pipeline holds the queues of the running agent
+var pipeline = &pipelineStats{queues: make(map[string]*queueStats)}
+
+// register starts tracking a queue, replacing any queue with the same name
+func (p *pipelineStats) register(name string, length func() int, capacity int) *queueStats {
+	q := &queueStats{name: name, length: length, capacity: capacity}
+	p.mu.Lock()
+	p.queues[name] = q
+	p.mu.Unlock()
+	return q
+}
+
+// snapshot returns the state of all the queues, sorted by name
+func (p *pipelineStats) snapshot() []queueSnapshot {
+	p.mu.RLock()
+	snapshots := make([]queueSnapshot, 0, len(p.queues))
+	for _, q := range p.queues {
+		snapshots = append(snapshots, q.snapshot())
+	}
+	p.mu.RUnlock()
+
+	sort.Sort(byQueueName(snapshots))
+	return snapshots
+}
+
+type byQueueName []queueSnapshot
+
+func (b byQueueName) Len() int           { return len(b) }
+func (b byQueueName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byQueueName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// handlePipeline serves the state of the queues as JSON
+func (p *pipelineStats) handlePipeline(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.snapshot()); err != nil {
+		log.Errorf("cannot encode /debug/pipeline response: %v", err)
+	}
+}
+
+// logStats periodically submits the depth of the queues to statsd, the
+// high-water marks being reset after each report
+func (p *pipelineStats) logStats() {
+	for range time.Tick(10 * time.Second) {
+		p.mu.RLock()
+		for _, q := range p.queues {
+			tags := []string{"queue:" + q.name}
+			statsd.Client.Gauge("datadog.trace_agent.pipeline.queue_length", float64(q.length()), tags, 1)
+			statsd.Client.Gauge("datadog.trace_agent.pipeline.queue_high_water",
+				float64(atomic.SwapInt64(&q.highWater, 0)), tags, 1)
+			if q.capacity > 0 {
+				statsd.Client.Gauge("datadog.trace_agent.pipeline.queue_capacity", float64(q.capacity), tags, 1)
+			}
+		}
+		p.mu.RUnlock()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/stretchr/testify/assert"
+)
+
+// getPipeline returns the queues served by the /debug/pipeline handler
+func getPipeline(t *testing.T) map[string]queueSnapshot {
+	server := httptest.NewServer(http.HandlerFunc(pipeline.handlePipeline))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var snapshots []queueSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+		t.Fatal(err)
+	}
+	queues := make(map[string]queueSnapshot, len(snapshots))
+	for _, q := range snapshots {
+		queues[q.Name] = q
+	}
+	return queues
+}
+
+func TestPipelineReceiverTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	// nothing reads from the receiver, the traces pile up in its channel
+	r := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	for _, trace := range fixtures.GetTestTrace(10, 1) {
+		r.processTrace(trace, unknownTracer)
+	}
+
+	q := getPipeline(t)["receiver.traces"]
+	assert.Equal(10, q.Length)
+	assert.Equal(cap(r.traces), q.Capacity)
+	assert.EqualValues(10, q.HighWater)
+
+	// draining lowers the depth, not the high-water mark
+	for i := 0; i < 7; i++ {
+		<-r.traces
+	}
+	q = getPipeline(t)["receiver.traces"]
+	assert.Equal(3, q.Length)
+	assert.EqualValues(10, q.HighWater)
+}
+
+func TestPipelineWriterQueues(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	w := NewWriter(conf)
+	w.inPayloads <- newTestPayload("test")
+	w.payloadsQueue.observe()
+	w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload("test"), NullEndpoint{}))
+	w.setBufferedPayloads()
+
+	queues := getPipeline(t)
+	assert.Equal(1, queues["writer.payloads"].Length)
+	assert.Equal(1, queues["writer.payloads"].Capacity)
+	assert.Equal(1, queues["writer.payload_buffer"].Length)
+	assert.Equal(0, queues["writer.payload_buffer"].Capacity)
+	assert.EqualValues(1, queues["writer.payload_buffer"].HighWater)
+}
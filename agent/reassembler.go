@@ -0,0 +1,210 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// reassemblyQuietPeriod is how long a trace whose root was received waits
+// for more spans before being considered complete
+const reassemblyQuietPeriod = 500 * time.Millisecond
+
+// pendingTrace is a trace being reassembled
+type pendingTrace struct {
+	spans     []model.Span
+	hasRoot   bool
+	firstSeen time.Time
+	lastSeen  time.Time
+	elem      *list.Element // in spanReassembler.order
+	chunk     int           // sequence number of the chunk, for long-running traces, -1 otherwise
+}
+
+// traceChunks tracks a long-running trace sent in chunks
+type traceChunks struct {
+	next    int       // sequence number of the next chunk
+	emitted time.Time // when the last chunk was emitted
+}
+
+// spanReassembler groups into traces the spans sent by clients of the flat
+// v0.1 format, which can spread the spans of a trace over several payloads.
+// A trace is emitted once its root was received and no new span came for
+// reassemblyQuietPeriod. Spans of traces whose root did not come while no new
+// span came for timeout are emitted as single-span traces, marked with
+// model.TraceOrphanKey. To bound memory, the oldest traces are emitted early
+// once more than maxSpans spans are buffered.
+//
+// Traces still receiving spans maxAssembly after their first span are
+// emitted as is, as the first chunk of a long-running trace. The spans of the
+// trace received afterwards make the next chunks, see model.TraceChunkSeqKey.
+type spanReassembler struct {
+	timeout     time.Duration
+	maxAssembly time.Duration // 0 for no limit
+	maxSpans    int
+	emit        func(model.Trace)
+	now         func() time.Time // overridden by tests
+
+	mu     sync.Mutex
+	traces map[uint64]*pendingTrace
+	order  *list.List // trace IDs, oldest first
+	spans  int        // number of buffered spans
+	chunks map[uint64]*traceChunks
+
+	orphans int64 // number of spans emitted as orphans
+	evicted int64 // number of traces emitted early to bound memory
+	chunked int64 // number of chunks of long-running traces emitted
+}
+
+func newSpanReassembler(timeout, maxAssembly time.Duration, maxSpans int, emit func(model.Trace)) *spanReassembler {
+	return &spanReassembler{
+		timeout:     timeout,
+		maxAssembly: maxAssembly,
+		maxSpans:    maxSpans,
+		emit:        emit,
+		now:         time.Now,
+		traces:      make(map[uint64]*pendingTrace),
+		order:       list.New(),
+		chunks:      make(map[uint64]*traceChunks),
+	}
+}
+
+// Add buffers spans until their traces are complete
+func (r *spanReassembler) Add(spans []model.Span) {
+	var evicted []*pendingTrace
+
+	r.mu.Lock()
+	now := r.now()
+	for _, s := range spans {
+		t, ok := r.traces[s.TraceID]
+		if !ok {
+			t = &pendingTrace{firstSeen: now, chunk: -1}
+			if c, ok := r.chunks[s.TraceID]; ok {
+				t.chunk = c.next
+			}
+			t.elem = r.order.PushBack(s.TraceID)
+			r.traces[s.TraceID] = t
+		}
+		t.spans = append(t.spans, s)
+		t.lastSeen = now
+		if s.ParentID == 0 {
+			t.hasRoot = true
+		}
+		r.spans++
+	}
+	for r.maxSpans > 0 && r.spans > r.maxSpans && r.order.Len() > 0 {
+		id := r.order.Front().Value.(uint64)
+		t := r.remove(id)
+		if t.chunk >= 0 {
+			// the next spans still belong to the long-running trace
+			r.nextChunk(id, t, now)
+		}
+		evicted = append(evicted, t)
+	}
+	r.mu.Unlock()
+
+	atomic.AddInt64(&r.evicted, int64(len(evicted)))
+	r.emitAll(evicted)
+}
+
+// Flush emits the traces which are complete or were buffered for too long,
+// or all of them if all is true.
+func (r *spanReassembler) Flush(all bool) {
+	var done []*pendingTrace
+
+	r.mu.Lock()
+	now := r.now()
+	for e := r.order.Front(); e != nil; {
+		next := e.Next()
+		id := e.Value.(uint64)
+		t := r.traces[id]
+		switch {
+		case all, t.hasRoot && now.Sub(t.lastSeen) >= reassemblyQuietPeriod, !t.hasRoot && now.Sub(t.lastSeen) >= r.timeout:
+			// the trace, or the last chunk of a long-running one, is done
+			delete(r.chunks, id)
+			done = append(done, r.remove(id))
+		case r.maxAssembly > 0 && now.Sub(t.firstSeen) >= r.maxAssembly:
+			r.remove(id)
+			r.nextChunk(id, t, now)
+			done = append(done, t)
+		}
+		e = next
+	}
+	for id, c := range r.chunks {
+		if _, ok := r.traces[id]; !ok && now.Sub(c.emitted) >= r.maxAssembly {
+			delete(r.chunks, id)
+		}
+	}
+	r.mu.Unlock()
+
+	r.emitAll(done)
+}
+
+// Run flushes the reassembled traces until exit is closed, then flushes
+// all the buffered ones.
+func (r *spanReassembler) Run(exit chan struct{}) {
+	ticker := time.NewTicker(reassemblyQuietPeriod / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Flush(false)
+		case <-exit:
+			r.Flush(true)
+			return
+		}
+	}
+}
+
+// remove deletes the trace from the buffer and returns it, r.mu must be held
+func (r *spanReassembler) remove(id uint64) *pendingTrace {
+	t := r.traces[id]
+	delete(r.traces, id)
+	r.order.Remove(t.elem)
+	r.spans -= len(t.spans)
+	return t
+}
+
+// nextChunk makes t a chunk of a long-running trace, the next spans of the
+// trace going to the next chunk, r.mu must be held
+func (r *spanReassembler) nextChunk(id uint64, t *pendingTrace, now time.Time) {
+	if t.chunk < 0 {
+		t.chunk = 0
+	}
+	r.chunks[id] = &traceChunks{next: t.chunk + 1, emitted: now}
+}
+
+func (r *spanReassembler) emitAll(traces []*pendingTrace) {
+	for _, t := range traces {
+		if t.chunk >= 0 {
+			atomic.AddInt64(&r.chunked, 1)
+			seq := strconv.Itoa(t.chunk)
+			for i := range t.spans {
+				s := &t.spans[i]
+				if s.Meta == nil {
+					s.Meta = make(map[string]string, 2)
+				}
+				s.Meta[model.TraceLongRunningKey] = "true"
+				s.Meta[model.TraceChunkSeqKey] = seq
+			}
+			r.emit(t.spans)
+			continue
+		}
+		if t.hasRoot {
+			r.emit(t.spans)
+			continue
+		}
+		atomic.AddInt64(&r.orphans, int64(len(t.spans)))
+		for _, s := range t.spans {
+			if s.Meta == nil {
+				s.Meta = make(map[string]string, 1)
+			}
+			s.Meta[model.TraceOrphanKey] = "true"
+			r.emit(model.Trace{s})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// fakeClock is a clock only moving when told to
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestReassembler(timeout time.Duration, maxSpans int) (*spanReassembler, *fakeClock, *[]model.Trace) {
+	var emitted []model.Trace
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	r := newSpanReassembler(timeout, 0, maxSpans, func(t model.Trace) { emitted = append(emitted, t) })
+	r.now = clock.now
+	return r, clock, &emitted
+}
+
+func reassemblySpan(traceID, spanID, parentID uint64) model.Span {
+	return model.Span{TraceID: traceID, SpanID: spanID, ParentID: parentID, Service: "mcnulty", Name: "query"}
+}
+
+func spanIDs(t model.Trace) []uint64 {
+	ids := make([]uint64, len(t))
+	for i := range t {
+		ids[i] = t[i].SpanID
+	}
+	sort.Sort(uint64s(ids))
+	return ids
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+
+func TestReassemblerInterleavedTraces(t *testing.T) {
+	assert := assert.New(t)
+	r, clock, emitted := newTestReassembler(3*time.Second, 0)
+
+	// spans of two traces, spread over several payloads
+	r.Add([]model.Span{reassemblySpan(1, 11, 10), reassemblySpan(2, 21, 20)})
+	clock.advance(100 * time.Millisecond)
+	r.Add([]model.Span{reassemblySpan(2, 20, 0), reassemblySpan(1, 12, 10)})
+	clock.advance(100 * time.Millisecond)
+	r.Add([]model.Span{reassemblySpan(1, 10, 0)})
+
+	// trace 2 got its root, but trace 1 got a span since
+	clock.advance(400 * time.Millisecond)
+	r.Flush(false)
+	if assert.Len(*emitted, 1) {
+		assert.Equal([]uint64{20, 21}, spanIDs((*emitted)[0]))
+	}
+
+	clock.advance(100 * time.Millisecond)
+	r.Flush(false)
+	if assert.Len(*emitted, 2) {
+		assert.Equal([]uint64{10, 11, 12}, spanIDs((*emitted)[1]))
+	}
+	assert.Equal(0, r.spans)
+	assert.Equal(int64(0), r.orphans)
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	assert := assert.New(t)
+	r, clock, emitted := newTestReassembler(3*time.Second, 0)
+
+	// the root never comes
+	r.Add([]model.Span{reassemblySpan(1, 11, 10), reassemblySpan(1, 12, 10)})
+	for i := 0; i < 29; i++ {
+		clock.advance(100 * time.Millisecond)
+		r.Flush(false)
+	}
+	assert.Len(*emitted, 0)
+
+	clock.advance(100 * time.Millisecond)
+	r.Flush(false)
+	if assert.Len(*emitted, 2) {
+		for _, trace := range *emitted {
+			assert.Len(trace, 1)
+			assert.Equal("true", trace[0].Meta[model.TraceOrphanKey])
+		}
+	}
+	assert.Equal(int64(2), r.orphans)
+	assert.Equal(0, r.spans)
+}
+
+func TestReassemblerEviction(t *testing.T) {
+	assert := assert.New(t)
+	r, clock, emitted := newTestReassembler(3*time.Second, 4)
+
+	r.Add([]model.Span{reassemblySpan(1, 10, 0), reassemblySpan(1, 11, 10)})
+	clock.advance(100 * time.Millisecond)
+	r.Add([]model.Span{reassemblySpan(2, 20, 0), reassemblySpan(2, 21, 20)})
+	assert.Len(*emitted, 0)
+
+	// the oldest trace goes to make room
+	r.Add([]model.Span{reassemblySpan(3, 30, 0)})
+	if assert.Len(*emitted, 1) {
+		assert.Equal([]uint64{10, 11}, spanIDs((*emitted)[0]))
+	}
+	assert.Equal(int64(1), r.evicted)
+	assert.Equal(3, r.spans)
+
+	// everything is sent on exit
+	r.Flush(true)
+	assert.Len(*emitted, 3)
+	assert.Equal(0, r.spans)
+}
+
+func TestReassemblerLongRunningTrace(t *testing.T) {
+	assert := assert.New(t)
+	r, clock, emitted := newTestReassembler(3*time.Second, 0)
+	r.maxAssembly = 10 * time.Minute
+
+	// a batch job sending a span every second, its root comes last
+	spanID := uint64(10)
+	for i := 0; i < 700; i++ {
+		spanID++
+		r.Add([]model.Span{reassemblySpan(1, spanID, 10)})
+		clock.advance(time.Second)
+		r.Flush(false)
+	}
+	r.Add([]model.Span{reassemblySpan(1, 10, 0)})
+	clock.advance(reassemblyQuietPeriod)
+	r.Flush(false)
+
+	if assert.Len(*emitted, 2) {
+		first, second := (*emitted)[0], (*emitted)[1]
+		// the first chunk is sent as is once the window is crossed
+		assert.Len(first, 600)
+		assert.Len(second, 101)
+		for _, s := range first {
+			assert.Equal("true", s.Meta[model.TraceLongRunningKey])
+			assert.Equal("0", s.Meta[model.TraceChunkSeqKey])
+		}
+		for _, s := range second {
+			assert.Equal("true", s.Meta[model.TraceLongRunningKey])
+			assert.Equal("1", s.Meta[model.TraceChunkSeqKey])
+		}
+		seq, ok := second.ChunkSeq()
+		assert.True(ok)
+		assert.Equal(1, seq)
+	}
+	assert.Equal(int64(0), r.orphans)
+	assert.Equal(int64(2), r.chunked)
+	assert.Len(r.chunks, 0)
+
+	// the next trace with the same ID is a whole trace
+	r.Add([]model.Span{reassemblySpan(1, 20, 0)})
+	clock.advance(reassemblyQuietPeriod)
+	r.Flush(false)
+	if assert.Len(*emitted, 3) {
+		_, ok := (*emitted)[2].ChunkSeq()
+		assert.False(ok)
+	}
+}
+
+func TestReassemblerLongRunningChunksExpire(t *testing.T) {
+	assert := assert.New(t)
+	r, clock, emitted := newTestReassembler(3*time.Second, 0)
+	r.maxAssembly = time.Minute
+
+	for i := 0; i < 61; i++ {
+		r.Add([]model.Span{reassemblySpan(1, uint64(11+i), 10)})
+		clock.advance(time.Second)
+		r.Flush(false)
+	}
+	assert.Len(*emitted, 1)
+	assert.Len(r.chunks, 1)
+
+	// no span came for the trace since its last chunk
+	clock.advance(time.Minute)
+	r.Flush(false)
+	assert.Len(r.chunks, 0)
+}
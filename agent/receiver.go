@@ -1,12 +1,18 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +21,7 @@ import (
 
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
 	"github.com/DataDog/datadog-trace-agent/statsd"
 )
 
@@ -44,8 +51,115 @@ const (
 	// Traces: msgpack/JSON (Content-Type) slice of traces
 	// Services: msgpack/JSON, map[string]map[string][string]
 	v03 APIVersion = "v0.3"
+	// v04
+	// Traces: msgpack (default)/JSON (Content-Type) slice of traces, answered
+	// with the rates applied by service
+	v04 APIVersion = "v0.4"
+	// vOTLP
+	// Traces: OTLP/HTTP JSON of OpenTelemetry exporters, see otlp.go
+	vOTLP APIVersion = "otlp"
 )
 
+// headerTraceCount is the header clients use to tell how many traces a
+// payload holds, so that we can account for them if it can't be decoded
+const headerTraceCount = "X-Datadog-Trace-Count"
+
+// receiverRoute binds a path to the handler of an API version
+type receiverRoute struct {
+	pattern  string
+	v        APIVersion
+	services bool // whether this is a services endpoint, traces otherwise
+}
+
+// receiverRoutes are all the collector endpoints served by the receiver
+var receiverRoutes = []receiverRoute{
+	// FIXME[1.x]: remove all those legacy endpoints + code that goes with it
+	{"/spans", v01, false},
+	{"/services", v01, true},
+	{"/v0.1/spans", v01, false},
+	{"/v0.1/services", v01, true},
+	{"/v0.2/traces", v02, false},
+	{"/v0.2/services", v02, true},
+
+	// current collector API
+	{"/v0.3/traces", v03, false},
+	{"/v0.3/services", v03, true},
+	{"/v0.4/traces", v04, false},
+	{"/otlp/v1/traces", vOTLP, false},
+}
+
+// traceHandler describes how an API version decodes traces and answers clients
+type traceHandler struct {
+	decode      func(req *http.Request, v APIVersion) (model.Traces, error)
+	respond     func(r *HTTPReceiver, w http.ResponseWriter)
+	countHeader bool // whether headerTraceCount accounts for undecodable payloads
+	reassemble  bool // whether traces can be spread over several payloads, see spanReassembler
+	rates       bool // whether the reports of rejected traces carry the rates by service
+
+	// stream decodes the traces one at a time, for the payloads over the
+	// size limit to be accepted up to it, see readTraceStream. Nil if the
+	// version decodes its payloads whole.
+	stream func(req *http.Request) (*model.TraceStream, error)
+}
+
+// traceHandlers are the trace handlers by API version
+var traceHandlers = map[APIVersion]traceHandler{
+	v01: {decode: decodeTracesV01, respond: respondOK, reassemble: true},
+	v02: {decode: decodeTraces, respond: respondOK, stream: newTraceStream},
+	v03: {decode: decodeTraces, respond: respondOK, stream: newTraceStream},
+	v04: {decode: decodeTracesV04, respond: respondRateByService, countHeader: true, rates: true, stream: newTraceStreamV04},
+	// exporters send the spans as they end, in batches
+	vOTLP: {decode: decodeTracesOTLP, respond: respondOTLP, reassemble: true},
+}
+
+// errUnsupportedMediaType is returned by decoders when the Content-Type is
+// not supported by the API version
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// decodeTracesV01 decodes JSON spans and assembles them into traces
+func decodeTracesV01(req *http.Request, v APIVersion) (model.Traces, error) {
+	// We cannot use decodeReceiverPayload because []model.Span does not
+	// implement msgp.Decodable. This hack can be removed once we
+	// drop v01 support.
+	contentType := req.Header.Get("Content-Type")
+	if contentType != "application/json" && contentType != "text/json" && contentType != "" {
+		return nil, errUnsupportedMediaType
+	}
+
+	// in v01 we actually get spans that we have to transform in traces
+	var spans []model.Span
+	if err := json.NewDecoder(req.Body).Decode(&spans); err != nil {
+		return nil, err
+	}
+	return model.TracesFromSpans(spans), nil
+}
+
+// decodeTraces decodes traces according to the Content-Type, JSON by default
+func decodeTraces(req *http.Request, v APIVersion) (model.Traces, error) {
+	if req.Header.Get("Content-Type") == "application/msgpack" {
+		return model.DecodeTracesMsgpack(req.Body)
+	}
+	var traces model.Traces
+	err := decodeReceiverPayload(req.Body, &traces, v, req.Header.Get("Content-Type"))
+	return traces, err
+}
+
+// decodeTracesV04 decodes traces according to the Content-Type, msgpack by default
+func decodeTracesV04(req *http.Request, v APIVersion) (model.Traces, error) {
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/msgpack")
+	}
+	return decodeTraces(req, v)
+}
+
+func respondOK(r *HTTPReceiver, w http.ResponseWriter) {
+	HTTPOK(w)
+}
+
+func respondRateByService(r *HTTPReceiver, w http.ResponseWriter) {
+	HTTPRateByService(w, r.rates.GetAll())
+}
+
 // HTTPReceiver is a collector that uses HTTP protocol and just holds
 // a chan where the spans received are sent one by one
 type HTTPReceiver struct {
@@ -55,10 +169,34 @@ type HTTPReceiver struct {
 
 	// due to the high volume the receiver handles
 	// custom logger that rate-limits errors and track statistics
-	logger *errorLogger
-	stats  receiverStats
-
-	exit chan struct{}
+	logger            *errorLogger
+	stats             receiverStats
+	metaTruncated     serviceCounts // bytes of span metadata truncated
+	inherited         serviceCounts // spans which were given a resource, see model.Trace.InheritResources
+	clamped           serviceCounts // spans shortened to the max duration, see model.Span.ClampDuration
+	serviceSpans      serviceCounts // spans received, for the top services of -info
+	authRejected      serviceCounts // requests without the auth token, by remote address
+	readTimeouts      int64         // requests whose payload was not read within the read timeout
+	truncatedPayloads int64         // payloads not read past the size limit, see readTraceStream
+	tracers           *tracerStats  // the counters above by tracer, see newTracerKey
+	skew              *clockSkew    // the delta between the end of the spans and their reception, by tracer
+
+	exit  chan struct{}
+	info  model.AgentInfo
+	rates *sampler.RateByService // returned to v0.4 clients
+
+	reassembler *spanReassembler // groups the spans of v0.1 clients into traces
+	dedupe      *spanDedupe      // drops the spans sent again by clients, nil if disabled
+	payloads    *payloadChecker  // checks the checksums of the payloads and drops the duplicates, nil if disabled
+	containers  *containerTagger // tags the spans with the container which sent them, nil if disabled
+	streams     *traceBroadcast  // sends the sampled traces to /debug/stream
+	requests    *requestStats    // counts and times the requests of the endpoints
+
+	flushRequests chan flushRequest // flushes asked on /debug/flush, served by the agent
+
+	// depth of the output channels, see /debug/pipeline
+	tracesQueue   *queueStats
+	servicesQueue *queueStats
 
 	maxRequestBodyLength int64
 	debug                bool
@@ -67,31 +205,49 @@ type HTTPReceiver struct {
 // NewHTTPReceiver returns a pointer to a new HTTPReceiver
 func NewHTTPReceiver(conf *config.AgentConfig) *HTTPReceiver {
 	// use buffered channels so that handlers are not waiting on downstream processing
-	return &HTTPReceiver{
+	r := &HTTPReceiver{
 		traces:   make(chan model.Trace, 5000), // about 1000 traces/sec for 5 sec
 		services: make(chan model.ServicesMetadata, 50),
 		conf:     conf,
 		logger:   &errorLogger{},
 		exit:     make(chan struct{}),
+		info:     newAgentInfo(conf),
+		rates:    sampler.NewRateByService(),
+		streams:  newTraceBroadcast(conf.DebugMaxStreams),
+		requests: newRequestStats(conf.ReceiverLogRequests),
+		tracers:  newTracerStats(maxTracers),
+		skew:     newClockSkew(maxTracers),
+
+		flushRequests: make(chan flushRequest),
 
 		maxRequestBodyLength: maxRequestBodyLength,
 		debug:                strings.ToLower(conf.LogLevel) == "debug",
 	}
+	r.reassembler = newSpanReassembler(conf.ReassemblyTimeout, conf.MaxTraceAssemblyDuration, conf.ReassemblyMaxSpans, func(t model.Trace) { r.processTrace(t, unknownTracer) })
+	r.dedupe = newSpanDedupe(conf.DedupeCacheSize, 2*conf.BucketInterval)
+	r.payloads = newPayloadChecker(conf)
+	r.containers = newContainerTagger(conf, newEnvContainerResolver())
+	r.tracesQueue = pipeline.register("receiver.traces",
+		func() int { return len(r.traces) }, cap(r.traces))
+	r.servicesQueue = pipeline.register("receiver.services",
+		func() int { return len(r.services) }, cap(r.services))
+	return r
 }
 
 // Run starts doing the HTTP server and is ready to receive traces
 func (r *HTTPReceiver) Run() {
-	// FIXME[1.x]: remove all those legacy endpoints + code that goes with it
-	http.HandleFunc("/spans", r.httpHandleWithVersion(v01, r.handleTraces))
-	http.HandleFunc("/services", r.httpHandleWithVersion(v01, r.handleServices))
-	http.HandleFunc("/v0.1/spans", r.httpHandleWithVersion(v01, r.handleTraces))
-	http.HandleFunc("/v0.1/services", r.httpHandleWithVersion(v01, r.handleServices))
-	http.HandleFunc("/v0.2/traces", r.httpHandleWithVersion(v02, r.handleTraces))
-	http.HandleFunc("/v0.2/services", r.httpHandleWithVersion(v02, r.handleServices))
+	for _, e := range receiverRoutes {
+		h := r.handleTraces
+		if e.services {
+			h = r.handleServices
+		}
+		http.HandleFunc(e.pattern, r.requests.wrap(e.pattern, r.httpHandleWithVersion(e.v, h)))
+	}
 
-	// current collector API
-	http.HandleFunc("/v0.3/traces", r.httpHandleWithVersion(v03, r.handleTraces))
-	http.HandleFunc("/v0.3/services", r.httpHandleWithVersion(v03, r.handleServices))
+	http.HandleFunc("/info", r.requests.wrap("/info", r.handleInfo))
+	http.HandleFunc("/debug/pipeline", pipeline.handlePipeline)
+	http.HandleFunc("/debug/stream", r.handleStream)
+	http.HandleFunc("/debug/flush", r.handleFlush)
 
 	// expvar implicitely publishes "/debug/vars" on the same port
 
@@ -105,7 +261,15 @@ func (r *HTTPReceiver) Run() {
 		log.Error(err)
 	}
 
+	if r.conf.ReceiverSocket != "" {
+		if err := r.ListenUnix(r.conf.ReceiverSocket); err != nil {
+			log.Error(err)
+		}
+	}
+
 	go r.logStats()
+	go r.reassembler.Run(r.exit)
+	go pipeline.logStats()
 }
 
 // Listen creates a new HTTP server listening on the provided address.
@@ -121,15 +285,7 @@ func (r *HTTPReceiver) Listen(addr, logExtra string) error {
 		return fmt.Errorf("cannot create stoppable listener: %v", err)
 	}
 
-	timeout := 5 * time.Second
-	if r.conf.ReceiverTimeout > 0 {
-		timeout = time.Duration(r.conf.ReceiverTimeout) * time.Second
-	}
-
-	server := http.Server{
-		ReadTimeout:  time.Second * time.Duration(timeout),
-		WriteTimeout: time.Second * time.Duration(timeout),
-	}
+	server := r.newServer(nil, true)
 
 	log.Infof("listening for traces at http://%s%s", addr, logExtra)
 
@@ -139,15 +295,95 @@ func (r *HTTPReceiver) Listen(addr, logExtra string) error {
 	return nil
 }
 
+// ListenUnix creates a new HTTP server listening on the unix socket at path,
+// replacing the socket left by a previous run. It is removed on exit.
+func (r *HTTPReceiver) ListenUnix(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %v", path, err)
+	}
+	// connecting needs the write permission
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return fmt.Errorf("cannot set the permissions of %s: %v", path, err)
+	}
+
+	server := r.newServer(nil, !r.conf.ReceiverSocketSkipAuth)
+
+	log.Infof("listening for traces at unix://%s", path)
+
+	go func() {
+		<-r.exit
+		listener.Close()
+	}()
+	go server.Serve(listener)
+
+	return nil
+}
+
+// newServer returns the HTTP server of the receiver, serving h, or the
+// default mux if nil, with the timeouts and header size limit from the config
+// and CORS on the debug routes. With auth, the requests need the auth token of
+// the config, if any, see authHandler.
+func (r *HTTPReceiver) newServer(h http.Handler, auth bool) *http.Server {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	if auth {
+		h = newAuthHandler(r.conf.ReceiverAuthToken, r.conf.ReceiverDebugAuth, &r.authRejected, h)
+	}
+	server := &http.Server{
+		Handler:        newCORSHandler(r.conf.DebugAllowedOrigins, h),
+		ReadTimeout:    r.conf.ReceiverReadTimeout,
+		WriteTimeout:   r.conf.ReceiverWriteTimeout,
+		MaxHeaderBytes: r.conf.ReceiverMaxHeaderBytes,
+	}
+	setIdleTimeout(server, r.conf.ReceiverIdleTimeout)
+	return server
+}
+
 func (r *HTTPReceiver) httpHandle(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		req.Body = model.NewLimitedReader(req.Body, r.maxRequestBodyLength)
+		req = r.payloads.wrap(req)
+		req.Body = model.NewLimitedReader(req.Body, r.bodyLimit())
+		if strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+			// the limit also applies once decompressed, and the bytes
+			// read are then the decompressed ones
+			req.Body = model.NewLimitedReader(&gzipBody{body: req.Body}, r.bodyLimit())
+		}
 		defer req.Body.Close()
 
 		fn(w, req)
 	}
 }
 
+// gzipBody decompresses a gzipped request body. Its header is only read with
+// the body, so that its errors are decoding errors.
+type gzipBody struct {
+	body io.ReadCloser
+	gz   *gzip.Reader
+}
+
+// Read implements io.Reader
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.gz == nil {
+		gz, err := gzip.NewReader(b.body)
+		if err != nil {
+			return 0, err
+		}
+		b.gz = gz
+	}
+	return b.gz.Read(p)
+}
+
+// Close implements io.Closer
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
+
 func (r *HTTPReceiver) httpHandleWithVersion(v APIVersion, f func(APIVersion, http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return r.httpHandle(func(w http.ResponseWriter, req *http.Request) {
 		contentType := req.Header.Get("Content-Type")
@@ -164,82 +400,204 @@ func (r *HTTPReceiver) httpHandleWithVersion(v APIVersion, f func(APIVersion, ht
 
 // handleTraces knows how to handle a bunch of traces
 func (r *HTTPReceiver) handleTraces(v APIVersion, w http.ResponseWriter, req *http.Request) {
-	var traces model.Traces
-	contentType := req.Header.Get("Content-Type")
-
-	switch v {
-	case v01:
-		// We cannot use decodeReceiverPayload because []model.Span does not
-		// implement msgp.Decodable. This hack can be removed once we
-		// drop v01 support.
-		if contentType != "application/json" && contentType != "text/json" && contentType != "" {
-			r.logger.Errorf("rejecting client request, unsupported media type %q", contentType)
-			HTTPFormatError([]string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
-			return
-		}
+	tags := []string{tagTraceHandler, fmt.Sprintf("v:%s", v)}
+	tracer := newTracerKey(req)
 
-		// in v01 we actually get spans that we have to transform in traces
-		var spans []model.Span
-		if err := json.NewDecoder(req.Body).Decode(&spans); err != nil {
-			r.logger.Errorf("cannot decode %s traces payload: %v", v, err)
-			HTTPDecodingError(err, []string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
-			return
-		}
-		traces = model.TracesFromSpans(spans)
+	h, ok := traceHandlers[v]
+	if !ok {
+		HTTPEndpointNotSupported(tags, w)
+		return
+	}
 
-	case v02:
-		fallthrough
-	case v03:
-		if err := decodeReceiverPayload(req.Body, &traces, v, contentType); err != nil {
-			r.logger.Errorf("cannot decode %s traces payload: %v", v, err)
-			HTTPDecodingError(err, []string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
-			return
+	var (
+		traces   model.Traces
+		streamed *streamedPayload
+		err      error
+	)
+	if h.stream != nil && r.conf.ReceiverAcceptOversized {
+		traces, streamed, err = r.readTraceStream(req, h)
+	} else if traces, err = h.decode(req, v); err == nil {
+		err = r.checkBodyLimit(req)
+	}
+	if isTimeout(err) {
+		atomic.AddInt64(&r.readTimeouts, 1)
+		r.logger.Errorf("timed out reading %s traces payload: %v", v, err)
+		HTTPTimeoutError(tags, w)
+		return
+	}
+	if err == errUnsupportedMediaType {
+		r.logger.Errorf("rejecting client request, unsupported media type %q", req.Header.Get("Content-Type"))
+		HTTPFormatError(tags, w)
+		return
+	}
+	if err != nil {
+		r.logger.Errorf("cannot decode %s traces payload: %v", v, err)
+		if h.countHeader {
+			// the payload is lost, account for all the traces it held
+			if n, err := strconv.ParseInt(req.Header.Get(headerTraceCount), 10, 64); err == nil && n > 0 {
+				atomic.AddInt64(&r.stats.TracesReceived, n)
+				atomic.AddInt64(&r.stats.TracesDropped, n)
+				r.tracers.add(tracer, &tracerCounts{TracesReceived: n, TracesDropped: n, TracesUndecodable: n})
+			}
 		}
-
-	default:
-		HTTPEndpointNotSupported([]string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
+		HTTPDecodingError(err, tags, w)
 		return
 	}
 
-	HTTPOK(w)
+	// after reading what the decoder left of the payload, unless it was
+	// not read whole and can't be checked
+	var checkErr error
+	if streamed == nil || !streamed.truncated {
+		checkErr = r.payloads.check(req)
+	}
 
 	bytesRead := req.Body.(*model.LimitedReader).Count
 	if bytesRead > 0 {
 		atomic.AddInt64(&r.stats.TracesBytes, int64(bytesRead))
+		r.tracers.add(tracer, &tracerCounts{TracesBytes: int64(bytesRead)})
 	}
 
-	// normalize data
-	for i := range traces {
-		spans := len(traces[i])
-		normTrace, err := model.NormalizeTrace(traces[i])
-		if err != nil {
-			atomic.AddInt64(&r.stats.TracesDropped, 1)
-			atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
+	switch err := checkErr; {
+	case err == errDuplicatePayload:
+		// its traces were processed already, answered as they were
+		log.Debugf("dropping %s traces payload received twice", v)
+		h.respond(r, w)
+		return
+	case err == errChecksumMismatch:
+		r.logger.Errorf("rejecting %s traces payload: %v", v, err)
+		var spans int64
+		for _, t := range traces {
+			spans += int64(len(t))
+		}
+		n := int64(len(traces))
+		atomic.AddInt64(&r.stats.TracesReceived, n)
+		atomic.AddInt64(&r.stats.TracesDropped, n)
+		atomic.AddInt64(&r.stats.SpansReceived, spans)
+		atomic.AddInt64(&r.stats.SpansDropped, spans)
+		r.tracers.add(tracer, &tracerCounts{
+			TracesReceived: n, TracesDropped: n, TracesChecksumMismatch: n,
+			SpansReceived: spans, SpansDropped: spans,
+		})
+		HTTPChecksumError(err, tags, w)
+		return
+	case isTimeout(err):
+		atomic.AddInt64(&r.readTimeouts, 1)
+		r.logger.Errorf("timed out reading %s traces payload: %v", v, err)
+		HTTPTimeoutError(tags, w)
+		return
+	case err != nil:
+		r.logger.Errorf("cannot read %s traces payload: %v", v, err)
+		HTTPDecodingError(err, tags, w)
+		return
+	}
 
-			errorMsg := fmt.Sprintf("dropping trace reason: %s (debug for more info), %v", err, normTrace)
-			if len(errorMsg) > 150 && r.debug {
-				errorMsg = errorMsg[:150] + "..."
+	// the traces of reassembling versions are processed later, so that
+	// they are never reported
+	var report traceReport
+	r.containers.Tag(req, traces)
+	for i, t := range traces {
+		if len(t) > 0 {
+			if t = r.dedupe.Filter(t); len(t) == 0 {
+				// all its spans were already received
+				report.accept()
+				continue
 			}
-			r.logger.Errorf(errorMsg)
+		}
+		if h.reassemble {
+			r.reassembler.Add(t)
+		} else if err := r.processTrace(t, tracer); err != nil {
+			report.reject(streamed.index(i), err)
 		} else {
-			atomic.AddInt64(&r.stats.SpansDropped, int64(spans-len(normTrace)))
-
-			// if our downstream consumer is slow, we drop the trace on the floor
-			// this is a safety net against us using too much memory
-			// when clients flood us
-			select {
-			case r.traces <- normTrace:
-			default:
-				atomic.AddInt64(&r.stats.TracesDropped, 1)
-				atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
-
-				r.logger.Errorf("dropping trace reason: rate-limited")
-			}
+			report.accept()
+		}
+	}
+	r.rejectStreamed(streamed, tracer, &report)
+
+	if report.Rejected == 0 && !report.Truncated {
+		h.respond(r, w)
+		return
+	}
+	var rates map[string]float64
+	if h.rates {
+		rates = r.rates.GetAll()
+	}
+	HTTPTraceReport(tags, w, &report, rates)
+}
+
+// errTraceQueueFull is returned by processTrace for the traces dropped
+// because the pipeline is not keeping up
+var errTraceQueueFull = errors.New("dropped, the agent is not keeping up")
+
+// processTrace normalizes a trace sent by tracer and sends it down the
+// pipeline. It returns the reason the trace was dropped, if it was.
+func (r *HTTPReceiver) processTrace(trace model.Trace, tracer tracerKey) error {
+	var counts tracerCounts
+	defer r.tracers.add(tracer, &counts)
+
+	spans := len(trace)
+	for service, n := range trace.InheritResources() {
+		r.inherited.add(service, n)
+		counts.ResourcesInherited += int64(n)
+	}
+	normTrace, err := model.NormalizeTrace(trace)
+	atomic.AddInt64(&r.stats.TracesReceived, 1)
+	atomic.AddInt64(&r.stats.SpansReceived, int64(spans))
+	counts.TracesReceived, counts.SpansReceived = 1, int64(spans)
+	if err != nil {
+		atomic.AddInt64(&r.stats.TracesDropped, 1)
+		atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
+		counts.TracesDropped, counts.SpansDropped, counts.TracesInvalid = 1, int64(spans), 1
+
+		errorMsg := fmt.Sprintf("dropping trace reason: %s (debug for more info), %v", err, normTrace)
+		if len(errorMsg) > 150 && r.debug {
+			errorMsg = errorMsg[:150] + "..."
 		}
+		r.logger.Errorf(errorMsg)
+		return err
+	}
+
+	atomic.AddInt64(&r.stats.SpansDropped, int64(spans-len(normTrace)))
+	counts.SpansDropped = int64(spans - len(normTrace))
+
+	for j := range normTrace {
+		normTrace[j].AddMissingMeta(r.conf.GlobalTags)
+		if n := normTrace[j].TruncateMeta(r.conf.MaxMetaSize); n > 0 {
+			r.metaTruncated.add(normTrace[j].Service, n)
+			counts.MetaTruncatedBytes += int64(n)
+		}
+		if normTrace[j].ClampDuration(r.maxDuration(normTrace[j].Service)) {
+			r.clamped.add(normTrace[j].Service, 1)
+			counts.DurationsClamped++
+		}
+	}
 
-		atomic.AddInt64(&r.stats.TracesReceived, 1)
-		atomic.AddInt64(&r.stats.SpansReceived, int64(spans))
+	r.serviceSpans.addSpans(normTrace)
+	r.skew.observe(tracer, normTrace, time.Now().UnixNano())
+
+	// if our downstream consumer is slow, we drop the trace on the floor
+	// this is a safety net against us using too much memory
+	// when clients flood us
+	select {
+	case r.traces <- normTrace:
+		r.tracesQueue.observe()
+		return nil
+	default:
+		atomic.AddInt64(&r.stats.TracesDropped, 1)
+		atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
+		counts.TracesDropped, counts.SpansDropped, counts.TracesQueueFull = 1, int64(spans), 1
+
+		r.logger.Errorf("dropping trace reason: rate-limited")
+		return errTraceQueueFull
+	}
+}
+
+// maxDuration returns the max duration of the spans of service, in
+// nanoseconds, 0 for no limit
+func (r *HTTPReceiver) maxDuration(service string) int64 {
+	if d, ok := r.conf.MaxDurationByService[service]; ok {
+		return d.Nanoseconds()
 	}
+	return r.conf.MaxDuration.Nanoseconds()
 }
 
 // handleServices handle a request with a list of several services
@@ -248,7 +606,16 @@ func (r *HTTPReceiver) handleServices(v APIVersion, w http.ResponseWriter, req *
 	var servicesMeta model.ServicesMetadata
 
 	contentType := req.Header.Get("Content-Type")
-	if err := decodeReceiverPayload(req.Body, &servicesMeta, v, contentType); err != nil {
+	err := decodeReceiverPayload(req.Body, &servicesMeta, v, contentType)
+	if err == nil {
+		err = r.checkBodyLimit(req)
+	}
+	if isTimeout(err) {
+		atomic.AddInt64(&r.readTimeouts, 1)
+		r.logger.Errorf("timed out reading %s services payload: %v", v, err)
+		HTTPTimeoutError([]string{tagServiceHandler, fmt.Sprintf("v:%s", v)}, w)
+		return
+	} else if err != nil {
 		r.logger.Errorf("cannot decode %s services payload: %v", v, err)
 		HTTPDecodingError(err, []string{tagServiceHandler, fmt.Sprintf("v:%s", v)}, w)
 		return
@@ -263,12 +630,89 @@ func (r *HTTPReceiver) handleServices(v APIVersion, w http.ResponseWriter, req *
 	}
 
 	r.services <- servicesMeta
+	r.servicesQueue.observe()
+}
+
+// receiverEndpoints returns the collector endpoints reported by /info
+func receiverEndpoints() []string {
+	endpoints := make([]string, len(receiverRoutes))
+	for i, e := range receiverRoutes {
+		endpoints[i] = e.pattern
+	}
+	return endpoints
+}
+
+// receiverInfo is the JSON document served on /info
+type receiverInfo struct {
+	Agent     model.AgentInfo    `json:"agent"`
+	Uptime    int                `json:"uptime"` // in seconds
+	Endpoints []string           `json:"endpoints"`
+	Config    receiverInfoConfig `json:"config"`
+	DryRun    *dryRunStats       `json:"dry_run,omitempty"` // what would have been sent, in dry run only
+}
+
+// receiverInfoConfig holds the configuration highlights served on /info
+type receiverInfoConfig struct {
+	DefaultEnv       string   `json:"default_env"`
+	APIEndpoints     []string `json:"api_endpoints"`
+	APIKeys          []string `json:"api_keys"` // redacted
+	BucketInterval   float64  `json:"bucket_interval"`
+	ExtraAggregators []string `json:"extra_aggregators"`
+	ExtraSampleRate  float64  `json:"extra_sample_rate"`
+	MaxTPS           float64  `json:"max_traces_per_second"`
+	DryRun           bool     `json:"dry_run"`
+}
+
+// redactAPIKey only keeps the last characters of an API key, enough to tell
+// which one is used
+func redactAPIKey(key string) string {
+	const visible = 5
+	if len(key) <= visible {
+		return strings.Repeat("*", len(key))
+	}
+	return strings.Repeat("*", len(key)-visible) + key[len(key)-visible:]
+}
+
+// handleInfo returns the agent version, endpoints and configuration as JSON
+func (r *HTTPReceiver) handleInfo(w http.ResponseWriter, req *http.Request) {
+	keys := make([]string, len(r.conf.APIKeys))
+	for i, k := range r.conf.APIKeys {
+		keys[i] = redactAPIKey(k)
+	}
+
+	info := receiverInfo{
+		Agent:     r.info,
+		Uptime:    int(time.Since(infoStart) / time.Second),
+		Endpoints: receiverEndpoints(),
+		Config: receiverInfoConfig{
+			DefaultEnv:       r.conf.DefaultEnv,
+			APIEndpoints:     r.conf.APIEndpoints,
+			APIKeys:          keys,
+			BucketInterval:   r.conf.BucketInterval.Seconds(),
+			ExtraAggregators: r.conf.ExtraAggregators,
+			ExtraSampleRate:  r.conf.ExtraSampleRate,
+			MaxTPS:           r.conf.MaxTPS,
+			DryRun:           r.conf.APIDryRun,
+		},
+	}
+	if ds, ok := publishDryRunStats().(dryRunStats); ok && r.conf.APIDryRun {
+		info.DryRun = &ds
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Errorf("cannot encode /info response: %v", err)
+	}
 }
 
 // logStats periodically submits stats about the receiver to statsd
 func (r *HTTPReceiver) logStats() {
 	var accStats receiverStats
-	var lastLog time.Time
+	var lastLog, lastSkewWarning time.Time
+	accTruncated := make(map[string]int64)
+	accRejected := make(map[string]int64)
+	accServices := make(map[string]int64)
+	accTracers := make(map[tracerKey]*tracerCounts)
 
 	for now := range time.Tick(10 * time.Second) {
 		// Load counters and reset them for the next flush
@@ -299,11 +743,99 @@ func (r *HTTPReceiver) logStats() {
 		statsd.Client.Count("datadog.trace_agent.receiver.span_dropped", sdropped, nil, 1)
 		statsd.Client.Count("datadog.trace_agent.receiver.trace_dropped", tdropped, nil, 1)
 
+		statsd.Client.Count("datadog.trace_agent.receiver.read_timeout", atomic.SwapInt64(&r.readTimeouts, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.payload_truncated", atomic.SwapInt64(&r.truncatedPayloads, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.orphan_span", atomic.SwapInt64(&r.reassembler.orphans, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.reassembly_evicted_trace", atomic.SwapInt64(&r.reassembler.evicted, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.long_running_chunk", atomic.SwapInt64(&r.reassembler.chunked, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.span_duplicate", r.dedupe.swapDuplicates(), nil, 1)
+		mismatches, duplicates := r.payloads.swapCounts()
+		statsd.Client.Count("datadog.trace_agent.receiver.payload_checksum_mismatch", mismatches, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.payload_duplicate", duplicates, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.otlp.events_dropped", atomic.SwapInt64(&otlpStats.EventsDropped, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.otlp.links_dropped", atomic.SwapInt64(&otlpStats.LinksDropped, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.otlp.link_attributes_lost", atomic.SwapInt64(&otlpStats.LinkAttrsLost, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.receiver.otlp.resources_without_service", atomic.SwapInt64(&otlpStats.ResourcesNoName, 0), nil, 1)
+
+		requests := r.requests.swap()
+		for endpoint, rs := range requests {
+			tags := []string{"endpoint:" + endpoint}
+			for class, n := range rs.Statuses {
+				statsd.Client.Count("datadog.trace_agent.receiver.requests", n, append(tags, "status:"+class), 1)
+			}
+			statsd.Client.Count("datadog.trace_agent.receiver.request_bytes", rs.Bytes, tags, 1)
+			statsd.Client.Gauge("datadog.trace_agent.receiver.request_latency.p50", rs.LatencyP50, tags, 1)
+			statsd.Client.Gauge("datadog.trace_agent.receiver.request_latency.p99", rs.LatencyP99, tags, 1)
+			statsd.Client.Gauge("datadog.trace_agent.receiver.request_latency.max", rs.LatencyMax, tags, 1)
+		}
+		updateRequestStats(requests)
+
+		for service, n := range r.metaTruncated.swap() {
+			accTruncated[service] += n
+			statsd.Client.Count("datadog.trace_agent.receiver.meta_truncated_bytes", n, []string{"service:" + service}, 1)
+		}
+		for service, n := range r.inherited.swap() {
+			statsd.Client.Count("datadog.trace_agent.receiver.resource_inherited", n, []string{"service:" + service}, 1)
+		}
+		for service, n := range r.clamped.swap() {
+			statsd.Client.Count("datadog.trace_agent.receiver.duration_clamped", n, []string{"service:" + service}, 1)
+		}
+		for addr, n := range r.authRejected.swap() {
+			accRejected[addr] += n
+			statsd.Client.Count("datadog.trace_agent.receiver.auth_rejected", n, []string{"remote_addr:" + addr}, 1)
+		}
+		for service, n := range r.serviceSpans.swap() {
+			accServices[service] += n
+		}
+		for tracer, c := range r.tracers.swap() {
+			if acc, ok := accTracers[tracer]; ok {
+				acc.add(c)
+			} else {
+				accTracers[tracer] = c
+			}
+		}
+		skews := r.skew.swap()
+		for tracer, d := range skews {
+			tags := []string{"lang:" + tracer.lang}
+			if tracer.version != "" {
+				tags = append(tags, "tracer_version:"+tracer.version)
+			}
+			statsd.Client.Gauge("datadog.trace_agent.receiver.clock_skew", d.Seconds(), tags, 1)
+		}
+		updateClockSkewStats(clockSkewSnapshot(skews))
+		if threshold := r.conf.ClockSkewThreshold; threshold > 0 && now.Sub(lastSkewWarning) >= time.Minute {
+			if skewed := skewedTracers(skews, threshold); len(skewed) > 0 {
+				log.Warnf("the spans of these tracers end over %s away from the clock of the agent, their clock may be skewed: %s",
+					threshold, strings.Join(skewed, ", "))
+				lastSkewWarning = now
+			}
+		}
+
 		if now.Sub(lastLog) >= time.Minute {
 			updateReceiverStats(accStats)
-			log.Infof("receiver handled %d spans, dropped %d ; handled %d traces, dropped %d",
+			config.WithFields(config.Fields{
+				"spans_received":  accStats.SpansReceived,
+				"spans_dropped":   accStats.SpansDropped,
+				"traces_received": accStats.TracesReceived,
+				"traces_dropped":  accStats.TracesDropped,
+			}).Infof("receiver handled %d spans, dropped %d ; handled %d traces, dropped %d",
 				accStats.SpansReceived, accStats.SpansDropped,
 				accStats.TracesReceived, accStats.TracesDropped)
+			if len(accTruncated) > 0 {
+				logMetaTruncated(accTruncated)
+				accTruncated = make(map[string]int64)
+			}
+			if len(accRejected) > 0 {
+				logAuthRejected(accRejected)
+				accRejected = make(map[string]int64)
+			}
+			updateServiceStats(accServices)
+			accServices = make(map[string]int64)
+			updateTracerStats(tracersSnapshot(accTracers))
+			if len(accTracers) > 0 {
+				logTracerStats(accTracers)
+				accTracers = make(map[tracerKey]*tracerCounts)
+			}
 			r.logger.Reset()
 
 			accStats = receiverStats{}
@@ -328,6 +860,93 @@ type receiverStats struct {
 	TracesDropped int64
 }
 
+// serviceCounts counts events by service, such as the bytes of span metadata
+// truncated to fit in the MaxMetaSize budget
+type serviceCounts struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (m *serviceCounts) add(service string, n int) {
+	m.mu.Lock()
+	if m.counts == nil {
+		m.counts = make(map[string]int64)
+	}
+	m.counts[service] += int64(n)
+	m.mu.Unlock()
+}
+
+// addSpans counts the spans of t by service
+func (m *serviceCounts) addSpans(t model.Trace) {
+	m.mu.Lock()
+	if m.counts == nil {
+		m.counts = make(map[string]int64)
+	}
+	for i := range t {
+		m.counts[t[i].Service]++
+	}
+	m.mu.Unlock()
+}
+
+// swap returns the counts and resets them
+func (m *serviceCounts) swap() map[string]int64 {
+	m.mu.Lock()
+	counts := m.counts
+	m.counts = nil
+	m.mu.Unlock()
+	return counts
+}
+
+// maxLoggedTruncatedServices is the number of services listed when logging metadata truncation
+const maxLoggedTruncatedServices = 5
+
+type serviceCount struct {
+	service string
+	count   int64
+}
+
+type byCount []serviceCount
+
+func (b byCount) Len() int      { return len(b) }
+func (b byCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool {
+	if b[i].count != b[j].count {
+		return b[i].count > b[j].count
+	}
+	return b[i].service < b[j].service
+}
+
+// topServices returns the n services with the highest counts
+func topServices(counts map[string]int64, n int) []serviceCount {
+	top := make(byCount, 0, len(counts))
+	for service, c := range counts {
+		top = append(top, serviceCount{service, c})
+	}
+	sort.Sort(top)
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func logMetaTruncated(truncated map[string]int64) {
+	var total int64
+	for _, n := range truncated {
+		total += n
+	}
+
+	top := topServices(truncated, maxLoggedTruncatedServices)
+	services := make([]string, len(top))
+	for i, t := range top {
+		services[i] = fmt.Sprintf("%s:%d", t.service, t.count)
+	}
+
+	config.WithFields(config.Fields{
+		"meta_truncated_bytes": total,
+		"top_services":         services,
+	}).Infof("receiver truncated %d bytes of span metadata, top services: %s", total, strings.Join(services, ", "))
+}
+
 func decodeReceiverPayload(r io.Reader, dest msgp.Decodable, v APIVersion, contentType string) error {
 	switch contentType {
 	case "application/msgpack":
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// headerAuth is the header of the token the clients send when
+// config.AgentConfig.ReceiverAuthToken is set
+const headerAuth = "X-Datadog-Auth"
+
+// authHandler answers with a 401 the requests of the trace intake routes of h
+// without the token, and of the /info and debug routes if configured. The
+// rejected requests are counted by remote address.
+type authHandler struct {
+	h        http.Handler
+	token    [sha256.Size]byte // hashed, so that comparisons do not depend on its length
+	debug    bool              // whether the /info and debug routes need the token
+	routes   map[string]struct{}
+	rejected *serviceCounts
+}
+
+// newAuthHandler returns h, requiring token on the trace intake routes, and on
+// the /info and debug routes with debug. It returns h itself if token is
+// empty.
+func newAuthHandler(token string, debug bool, rejected *serviceCounts, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	a := &authHandler{
+		h:        h,
+		token:    sha256.Sum256([]byte(token)),
+		debug:    debug,
+		routes:   make(map[string]struct{}, len(receiverRoutes)),
+		rejected: rejected,
+	}
+	for _, e := range receiverRoutes {
+		a.routes[e.pattern] = struct{}{}
+	}
+	return a
+}
+
+func (a *authHandler) protected(path string) bool {
+	if _, ok := a.routes[path]; ok {
+		return true
+	}
+	return a.debug && (path == "/info" || strings.HasPrefix(path, corsPathPrefix))
+}
+
+func (a *authHandler) authorized(req *http.Request) bool {
+	token := req.Header.Get(headerAuth)
+	if token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(sum[:], a.token[:]) == 1
+}
+
+// ServeHTTP implements http.Handler
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.protected(req.URL.Path) || a.authorized(req) {
+		a.h.ServeHTTP(w, req)
+		return
+	}
+	a.rejected.add(remoteHost(req.RemoteAddr), 1)
+	HTTPAuthError([]string{"endpoint:" + req.URL.Path}, w)
+}
+
+// remoteHost returns the host of the remote address of a request, without
+// its port, which changes with every connection
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if addr == "" || addr == "@" {
+		// unix sockets have no remote address
+		return "unix"
+	}
+	return addr
+}
+
+// logAuthRejected logs the requests rejected without the token, by remote
+// address
+func logAuthRejected(rejected map[string]int64) {
+	var total int64
+	addrs := make([]string, 0, len(rejected))
+	for addr, n := range rejected {
+		total += n
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	config.WithFields(config.Fields{"rejected": total, "remote_addrs": addrs}).
+		Warnf("rejected %d requests without a valid %s header from: %s", total, headerAuth, strings.Join(addrs, ", "))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAuthTestMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("OK")) }
+	mux.HandleFunc("/v0.3/traces", ok)
+	mux.HandleFunc("/info", ok)
+	mux.HandleFunc("/debug/vars", ok)
+	return mux
+}
+
+func TestReceiverAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverAuthToken = "s3cr3t"
+	receiver := NewHTTPReceiver(conf)
+	handler := receiver.newServer(newAuthTestMux(), true).Handler
+
+	serve := func(path, token string) int {
+		req, _ := http.NewRequest("PUT", path, strings.NewReader("[]"))
+		req.RemoteAddr = "10.0.0.1:4242"
+		if token != "" {
+			req.Header.Set(headerAuth, token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// accepted
+	assert.Equal(http.StatusOK, serve("/v0.3/traces", "s3cr3t"))
+	assert.Len(receiver.authRejected.swap(), 0)
+
+	// rejected, by remote address
+	assert.Equal(http.StatusUnauthorized, serve("/v0.3/traces", ""))
+	assert.Equal(http.StatusUnauthorized, serve("/v0.3/traces", "s3cr3"))
+	assert.Equal(http.StatusUnauthorized, serve("/v0.3/traces", "s3cr3t "))
+	assert.Equal(map[string]int64{"10.0.0.1": 3}, receiver.authRejected.swap())
+
+	// the /info and debug routes only need it with debug_auth
+	assert.Equal(http.StatusOK, serve("/info", ""))
+	assert.Equal(http.StatusOK, serve("/debug/vars", ""))
+
+	conf.ReceiverDebugAuth = true
+	handler = receiver.newServer(newAuthTestMux(), true).Handler
+	assert.Equal(http.StatusUnauthorized, serve("/info", ""))
+	assert.Equal(http.StatusUnauthorized, serve("/debug/vars", ""))
+	assert.Equal(http.StatusOK, serve("/debug/vars", "s3cr3t"))
+	assert.Equal(map[string]int64{"10.0.0.1": 2}, receiver.authRejected.swap())
+}
+
+func TestReceiverAuthDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverDebugAuth = true
+	receiver := NewHTTPReceiver(conf)
+	handler := receiver.newServer(newAuthTestMux(), true).Handler
+
+	for _, path := range []string{"/v0.3/traces", "/info", "/debug/vars"} {
+		req, _ := http.NewRequest("PUT", path, strings.NewReader("[]"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code, path)
+	}
+	assert.Len(receiver.authRejected.swap(), 0)
+}
+
+func TestReceiverAuthSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-socket")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	defaultMux := http.DefaultServeMux
+	http.DefaultServeMux = newAuthTestMux()
+	defer func() { http.DefaultServeMux = defaultMux }()
+
+	post := func(path string) int {
+		client := &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) { return net.Dial("unix", path) },
+		}}
+		resp, err := client.Post("http://unix/v0.3/traces", "application/json", strings.NewReader("[]"))
+		if !assert.Nil(err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i, skip := range []bool{false, true} {
+		conf := config.NewDefaultAgentConfig()
+		conf.ReceiverAuthToken = "s3cr3t"
+		conf.ReceiverSocketSkipAuth = skip
+		receiver := NewHTTPReceiver(conf)
+
+		path := filepath.Join(dir, fmt.Sprintf("apm%d.socket", i))
+		if !assert.Nil(receiver.ListenUnix(path)) {
+			t.FailNow()
+		}
+		fi, err := os.Stat(path)
+		assert.Nil(err)
+		assert.Equal(os.FileMode(0660), fi.Mode().Perm())
+
+		if skip {
+			assert.Equal(http.StatusOK, post(path))
+			assert.Len(receiver.authRejected.swap(), 0)
+		} else {
+			assert.Equal(http.StatusUnauthorized, post(path))
+			assert.Equal(map[string]int64{"unix": 1}, receiver.authRejected.swap())
+		}
+		close(receiver.exit)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// headerPayloadChecksum is the hex MD5 of the body of a trace payload, as
+// sent. Content-MD5, its base64 counterpart, is checked as well.
+const headerPayloadChecksum = "X-Datadog-Payload-Checksum"
+
+// payloadDedupeTTL is how long the checksums of the payloads are remembered
+const payloadDedupeTTL = time.Minute
+
+var (
+	errChecksumMismatch = errors.New("payload does not match its checksum")
+	errDuplicatePayload = errors.New("payload already received")
+)
+
+type payloadChecksum [md5.Size]byte
+
+// checksumBody hashes the bytes read from a request body
+type checksumBody struct {
+	body io.ReadCloser
+	hash hash.Hash
+}
+
+// Read implements io.Reader
+func (b *checksumBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+// Close implements io.Closer
+func (b *checksumBody) Close() error {
+	return b.body.Close()
+}
+
+// checksumBodyKey is the context key of the checksumBody of a request
+type checksumBodyKey struct{}
+
+// payloadChecker checks the trace payloads against the checksum sent along
+// and drops the ones received again byte for byte within payloadDedupeTTL.
+// As opposed to spanDedupe, whole payloads are dropped, before being
+// decoded into spans. A nil payloadChecker accepts all payloads.
+type payloadChecker struct {
+	validate bool
+	seen     *payloadCache // nil if the payloads are not deduplicated
+
+	mismatches int64 // payloads rejected for their checksum
+	duplicates int64 // payloads dropped as received already
+}
+
+// newPayloadChecker returns the payloadChecker configured by conf, nil if
+// the payloads are neither validated nor deduplicated
+func newPayloadChecker(conf *config.AgentConfig) *payloadChecker {
+	if !conf.PayloadChecksums && conf.PayloadDedupeSize <= 0 {
+		return nil
+	}
+	c := &payloadChecker{validate: conf.PayloadChecksums}
+	if conf.PayloadDedupeSize > 0 {
+		c.seen = newPayloadCache(conf.PayloadDedupeSize, payloadDedupeTTL)
+	}
+	return c
+}
+
+// wrap returns req, hashing its body as read. It must be called before the
+// body is limited and decompressed, checksums being of the payloads as sent.
+func (c *payloadChecker) wrap(req *http.Request) *http.Request {
+	if c == nil {
+		return req
+	}
+	body := &checksumBody{body: req.Body, hash: md5.New()}
+	req.Body = body
+	return req.WithContext(context.WithValue(req.Context(), checksumBodyKey{}, body))
+}
+
+// check reads the rest of the body of req, wrapped by wrap, and returns
+// errChecksumMismatch if it does not match its checksum headers, or
+// errDuplicatePayload if it was received in the last payloadDedupeTTL.
+func (c *payloadChecker) check(req *http.Request) error {
+	if c == nil {
+		return nil
+	}
+	body, ok := req.Context().Value(checksumBodyKey{}).(*checksumBody)
+	if !ok {
+		return nil
+	}
+	// the decoders may stop before the end of the payload, which is read
+	// through the limits and decompression of req.Body
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		return err
+	}
+	var sum payloadChecksum
+	copy(sum[:], body.hash.Sum(nil))
+
+	if c.validate && !matchesChecksum(req.Header, sum) {
+		atomic.AddInt64(&c.mismatches, 1)
+		return errChecksumMismatch
+	}
+	if c.seen != nil && c.seen.seen(sum, time.Now()) {
+		atomic.AddInt64(&c.duplicates, 1)
+		return errDuplicatePayload
+	}
+	return nil
+}
+
+// matchesChecksum tells if sum matches the checksum headers of h, if any
+func matchesChecksum(h http.Header, sum payloadChecksum) bool {
+	if v := h.Get("Content-MD5"); v != "" {
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v)); err != nil || string(b) != string(sum[:]) {
+			return false
+		}
+	}
+	if v := h.Get(headerPayloadChecksum); v != "" {
+		if b, err := hex.DecodeString(strings.TrimSpace(v)); err != nil || string(b) != string(sum[:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// swapCounts returns the mismatches and duplicates counted and resets them
+func (c *payloadChecker) swapCounts() (mismatches, duplicates int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.SwapInt64(&c.mismatches, 0), atomic.SwapInt64(&c.duplicates, 0)
+}
+
+type payloadCacheEntry struct {
+	sum  payloadChecksum
+	seen time.Time
+}
+
+// payloadCache is an LRU of up to size payload checksums seen in the last
+// ttl. Payloads are few compared to spans, a single lock is enough.
+type payloadCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[payloadChecksum]*list.Element
+	lru     *list.List // *payloadCacheEntry, most recently seen first
+}
+
+func newPayloadCache(size int, ttl time.Duration) *payloadCache {
+	return &payloadCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[payloadChecksum]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// seen records sum and tells if it was already seen in the last ttl. The
+// window is not extended by the duplicates.
+func (c *payloadCache) seen(sum payloadChecksum, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[sum]; ok {
+		e := elem.Value.(*payloadCacheEntry)
+		if now.Sub(e.seen) < c.ttl {
+			return true
+		}
+		e.seen = now
+		c.lru.MoveToFront(elem)
+		return false
+	}
+
+	for back := c.lru.Back(); back != nil; back = c.lru.Back() {
+		e := back.Value.(*payloadCacheEntry)
+		if c.lru.Len() < c.size && now.Sub(e.seen) < c.ttl {
+			break
+		}
+		c.lru.Remove(back)
+		delete(c.entries, e.sum)
+	}
+	c.entries[sum] = c.lru.PushFront(&payloadCacheEntry{sum: sum, seen: now})
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func checksumTestPayload(t *testing.T, traceID uint64) []byte {
+	trace := model.Trace{fixtures.TestSpan()}
+	trace[0].TraceID = traceID
+	trace[0].Start = time.Now().UnixNano()
+	var buf bytes.Buffer
+	assert.Nil(t, msgp.Encode(&buf, model.Traces{trace}))
+	return buf.Bytes()
+}
+
+func TestPayloadChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.PayloadChecksums = true
+	receiver := NewHTTPReceiver(conf)
+	handler := receiver.httpHandleWithVersion(v04, receiver.handleTraces)
+	post := func(body []byte, header map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v0.4/traces", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/msgpack")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	payload := checksumTestPayload(t, 1)
+	sum := md5.Sum(payload)
+	rr := post(payload, map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(sum[:])})
+	assert.Equal(http.StatusOK, rr.Code)
+	rr = post(checksumTestPayload(t, 2), map[string]string{headerPayloadChecksum: hex.EncodeToString(sum[:])})
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	assert.Contains(rr.Body.String(), "checksum-mismatch")
+	rr = post(checksumTestPayload(t, 3), map[string]string{"Content-MD5": "not base64"})
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	// without checksum, nothing to check
+	rr = post(checksumTestPayload(t, 4), nil)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	// the checksum is of the payload as sent
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(checksumTestPayload(t, 5))
+	w.Close()
+	sum = md5.Sum(gz.Bytes())
+	rr = post(gz.Bytes(), map[string]string{"Content-Encoding": "gzip", headerPayloadChecksum: hex.EncodeToString(sum[:])})
+	assert.Equal(http.StatusOK, rr.Code)
+
+	assert.Len(receiver.traces, 3)
+	assert.Equal(int64(2), receiver.stats.TracesDropped)
+	mismatches, duplicates := receiver.payloads.swapCounts()
+	assert.Equal(int64(2), mismatches)
+	assert.Equal(int64(0), duplicates)
+	assert.Equal(int64(2), receiver.tracers.swap()[unknownTracer].TracesChecksumMismatch)
+}
+
+func TestPayloadDedupe(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		size   int
+		traces int
+	}{
+		// the retransmit is dropped
+		{10, 1},
+		// the same payload is legitimately processed twice when disabled
+		{0, 2},
+	} {
+		conf := config.NewDefaultAgentConfig()
+		conf.PayloadDedupeSize = tc.size
+		conf.DedupeCacheSize = 0 // its spans would be dropped otherwise
+		receiver := NewHTTPReceiver(conf)
+		handler := receiver.httpHandleWithVersion(v04, receiver.handleTraces)
+
+		payload := checksumTestPayload(t, 1)
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("POST", "/v0.4/traces", bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/msgpack")
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			assert.Equal(http.StatusOK, rr.Code)
+		}
+		assert.Len(receiver.traces, tc.traces)
+		_, duplicates := receiver.payloads.swapCounts()
+		assert.Equal(int64(2-tc.traces), duplicates)
+		// the duplicates are not counted as spans received again
+		assert.Equal(int64(0), receiver.dedupe.swapDuplicates())
+	}
+}
+
+func TestPayloadCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newPayloadCache(2, time.Minute)
+	now := time.Now()
+	a, b, d := payloadChecksum{1}, payloadChecksum{2}, payloadChecksum{3}
+	assert.False(c.seen(a, now))
+	assert.True(c.seen(a, now.Add(30*time.Second)))
+	// the window starts with the first payload
+	assert.False(c.seen(a, now.Add(time.Minute)))
+
+	// the least recently seen are evicted first
+	now = now.Add(time.Minute)
+	assert.False(c.seen(b, now))
+	assert.False(c.seen(d, now))
+	assert.Len(c.entries, 2)
+	assert.False(c.seen(a, now))
+	assert.True(c.seen(d, now))
+}
@@ -0,0 +1,15 @@
+//go:build go1.8
+// +build go1.8
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// setIdleTimeout sets how long the keep-alive connections of s wait for the
+// next request
+func setIdleTimeout(s *http.Server, d time.Duration) {
+	s.IdleTimeout = d
+}
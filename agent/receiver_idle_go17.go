@@ -0,0 +1,13 @@
+//go:build !go1.8
+// +build !go1.8
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// setIdleTimeout does nothing: before go1.8, the read timeout also bounds
+// how long keep-alive connections wait for the next request
+func setIdleTimeout(s *http.Server, d time.Duration) {}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// newTraceStream starts decoding the traces of a payload one at a time,
+// according to the Content-Type, JSON by default, as decodeTraces
+func newTraceStream(req *http.Request) (*model.TraceStream, error) {
+	switch req.Header.Get("Content-Type") {
+	case "application/msgpack":
+		return model.NewTraceStream(req.Body, true)
+	case "application/json", "text/json", "":
+		return model.NewTraceStream(req.Body, false)
+	default:
+		return nil, errUnsupportedMediaType
+	}
+}
+
+// newTraceStreamV04 starts decoding the traces of a payload one at a time,
+// according to the Content-Type, msgpack by default, as decodeTracesV04
+func newTraceStreamV04(req *http.Request) (*model.TraceStream, error) {
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/msgpack")
+	}
+	return newTraceStream(req)
+}
+
+// streamedPayload is what readTraceStream read of a payload besides its traces
+type streamedPayload struct {
+	indexes  []int // index in the payload of each trace returned
+	tooLarge []int // indexes of the traces larger than ReceiverMaxTraceBytes
+
+	// truncated is whether reading stopped at the payload limit. The traces
+	// from the index first on were then not accepted, and there were
+	// overLimit of them, 0 if their number is unknown.
+	truncated bool
+	first     int
+	overLimit int64
+}
+
+// index returns the index in the payload of the trace i returned with p,
+// which can be nil if the payload was decoded whole
+func (p *streamedPayload) index(i int) int {
+	if p == nil {
+		return i
+	}
+	return p.indexes[i]
+}
+
+// traceTooLargeError and payloadLimitError are the reasons the traces of
+// streamed payloads are rejected for
+type traceTooLargeError struct {
+	max int64
+}
+
+func (e *traceTooLargeError) Error() string {
+	return fmt.Sprintf("dropped, over the limit of %d bytes by trace", e.max)
+}
+
+type payloadLimitError struct {
+	max int64
+}
+
+func (e *payloadLimitError) Error() string {
+	return fmt.Sprintf("dropped with the next traces, past the limit of %d bytes by payload", e.max)
+}
+
+// bodyLimit returns the size above which the request bodies are not read
+// further, which is maxRequestBodyLength unless the traces of the payloads
+// over it are accepted up to it, see readTraceStream. It is then twice it,
+// only as a backstop.
+func (r *HTTPReceiver) bodyLimit() int64 {
+	if r.conf.ReceiverAcceptOversized {
+		return 2 * r.maxRequestBodyLength
+	}
+	return r.maxRequestBodyLength
+}
+
+// checkBodyLimit returns model.ErrLimitedReaderLimitReached if more than
+// maxRequestBodyLength bytes of req were read, for the payloads decoded whole
+// to keep their limit when bodyLimit is above it
+func (r *HTTPReceiver) checkBodyLimit(req *http.Request) error {
+	if req.Body.(*model.LimitedReader).Count > r.maxRequestBodyLength {
+		return model.ErrLimitedReaderLimitReached
+	}
+	return nil
+}
+
+// readTraceStream decodes the traces of a payload one at a time with
+// h.stream, so that payloads over maxRequestBodyLength are not rejected
+// whole. The traces larger than ReceiverMaxTraceBytes are dropped, and
+// reading stops at the trace which takes the traces read over
+// maxRequestBodyLength. The traces left are counted from the length of
+// msgpack payloads, or from headerTraceCount if h.countHeader.
+func (r *HTTPReceiver) readTraceStream(req *http.Request, h traceHandler) (model.Traces, *streamedPayload, error) {
+	s, err := h.stream(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		traces model.Traces
+		p      streamedPayload
+		read   int64
+	)
+	for !p.truncated {
+		t, size, err := s.Next(r.conf.ReceiverMaxTraceBytes)
+		read += size
+		switch {
+		case err == io.EOF:
+			return traces, &p, nil
+		case err == model.ErrLimitedReaderLimitReached:
+			// past the backstop, within a trace
+			p.truncated, p.first = true, s.Read()
+		case err == model.ErrTraceTooLarge:
+			p.tooLarge = append(p.tooLarge, s.Read()-1)
+			p.truncated, p.first = read >= r.maxRequestBodyLength, s.Read()
+		case err != nil:
+			return nil, nil, err
+		case read > r.maxRequestBodyLength:
+			p.truncated, p.first = true, s.Read()-1
+		default:
+			p.indexes = append(p.indexes, s.Read()-1)
+			traces = append(traces, t)
+		}
+	}
+
+	n := int64(s.Len())
+	if n < 0 && h.countHeader {
+		n, _ = strconv.ParseInt(req.Header.Get(headerTraceCount), 10, 64)
+	}
+	if n > int64(p.first) {
+		p.overLimit = n - int64(p.first)
+	}
+	atomic.AddInt64(&r.truncatedPayloads, 1)
+	// the server closes the connection rather than reading the rest
+	req.Body.Close()
+	return traces, &p, nil
+}
+
+// rejectStreamed accounts for the traces of p which were not accepted, and
+// adds them to report
+func (r *HTTPReceiver) rejectStreamed(p *streamedPayload, tracer tracerKey, report *traceReport) {
+	if p == nil {
+		return
+	}
+	for _, i := range p.tooLarge {
+		report.reject(i, &traceTooLargeError{max: r.conf.ReceiverMaxTraceBytes})
+	}
+	if p.truncated {
+		report.Truncated = true
+		report.rejectN(p.first, p.overLimit, &payloadLimitError{max: r.maxRequestBodyLength})
+	}
+
+	n := int64(len(p.tooLarge)) + p.overLimit
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&r.stats.TracesReceived, n)
+	atomic.AddInt64(&r.stats.TracesDropped, n)
+	r.tracers.add(tracer, &tracerCounts{TracesReceived: n, TracesDropped: n, TracesTooLarge: n})
+}
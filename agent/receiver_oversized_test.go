@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// testOversizedTraces returns n valid traces of about size bytes each
+func testOversizedTraces(n, size int) model.Traces {
+	var traces model.Traces
+	for i := uint64(1); i <= uint64(n); i++ {
+		span := fixtures.TestSpan()
+		span.TraceID, span.SpanID, span.ParentID = i, i*10, 0
+		span.Start = time.Now().UnixNano()
+		span.Meta = map[string]string{"padding": strings.Repeat("x", size)}
+		traces = append(traces, model.Trace{span})
+	}
+	return traces
+}
+
+// oversizedReport is the answer to the payloads over the limit
+type oversizedReport struct {
+	Accepted  int
+	Rejected  int
+	Truncated bool
+	Errors    []map[string]interface{}
+}
+
+func postOversized(assert *assert.Assertions, r *HTTPReceiver, v APIVersion, contentType string, header map[string]string, body []byte) (int, oversizedReport) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/traces", v), bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	r.httpHandleWithVersion(v, r.handleTraces).ServeHTTP(rr, req)
+
+	var report oversizedReport
+	if rr.Code == http.StatusOK && rr.Header().Get("Content-Type") == "application/json" {
+		assert.Nil(json.Unmarshal(rr.Body.Bytes(), &report))
+	}
+	return rr.Code, report
+}
+
+func TestReceiverOversizedPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testOversizedTraces(20, 900)
+	var payload bytes.Buffer
+	assert.Nil(msgp.Encode(&payload, traces))
+	// the traces fitting in the limit
+	var fit int
+	for size := int64(0); fit < len(traces); fit++ {
+		var buf bytes.Buffer
+		assert.Nil(msgp.Encode(&buf, traces[fit]))
+		if size += int64(buf.Len()); size > 10000 {
+			break
+		}
+	}
+	assert.True(fit > 0 && fit < len(traces))
+
+	// rejected whole by default
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+	receiver.maxRequestBodyLength = 10000
+	code, _ := postOversized(assert, receiver, v04, "application/msgpack", nil, payload.Bytes())
+	assert.Equal(http.StatusRequestEntityTooLarge, code)
+	assert.Len(receiver.traces, 0)
+
+	conf = config.NewDefaultAgentConfig()
+	conf.ReceiverAcceptOversized = true
+	receiver = NewHTTPReceiver(conf)
+	receiver.maxRequestBodyLength = 10000
+	code, report := postOversized(assert, receiver, v04, "application/msgpack", nil, payload.Bytes())
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(fit, report.Accepted)
+	assert.Equal(len(traces)-fit, report.Rejected)
+	assert.True(report.Truncated)
+	assert.Len(report.Errors, 1)
+	assert.Equal(float64(fit), report.Errors[0]["trace"])
+	assert.Contains(report.Errors[0]["reason"], "limit of 10000 bytes by payload")
+
+	assert.Len(receiver.traces, fit)
+	assert.Equal(int64(len(traces)), receiver.stats.TracesReceived)
+	assert.Equal(int64(len(traces)-fit), receiver.stats.TracesDropped)
+	assert.Equal(int64(1), receiver.truncatedPayloads)
+	assert.Equal(int64(len(traces)-fit), receiver.tracers.swap()[unknownTracer].TracesTooLarge)
+
+	// payloads under the limit are answered as usual
+	payload.Reset()
+	assert.Nil(msgp.Encode(&payload, testOversizedTraces(2, 900)))
+	code, report = postOversized(assert, receiver, v04, "application/msgpack", nil, payload.Bytes())
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(oversizedReport{}, report)
+	assert.Equal(int64(1), receiver.truncatedPayloads)
+}
+
+func TestReceiverOversizedPayloadJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverAcceptOversized = true
+	receiver := NewHTTPReceiver(conf)
+	receiver.maxRequestBodyLength = 10000
+
+	traces := testOversizedTraces(20, 900)
+	payload, err := json.Marshal(traces)
+	assert.Nil(err)
+	var fit int
+	for size := 0; fit < len(traces); fit++ {
+		js, _ := json.Marshal(traces[fit])
+		if size += len(js); size > 10000 {
+			break
+		}
+	}
+
+	// the number of traces not read is known from the header
+	code, report := postOversized(assert, receiver, v04, "application/json",
+		map[string]string{headerTraceCount: "20"}, payload)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(fit, report.Accepted)
+	assert.Equal(len(traces)-fit, report.Rejected)
+	assert.True(report.Truncated)
+
+	// or unknown
+	code, report = postOversized(assert, receiver, v03, "application/json", nil, payload)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(fit, report.Accepted)
+	assert.Equal(0, report.Rejected)
+	assert.True(report.Truncated)
+	assert.Equal(float64(fit), report.Errors[0]["trace"])
+	assert.Equal(int64(2), receiver.truncatedPayloads)
+}
+
+func TestReceiverMaxTraceSize(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverAcceptOversized = true
+	conf.ReceiverMaxTraceBytes = 2000
+	receiver := NewHTTPReceiver(conf)
+
+	// a trace too large, then an invalid one
+	traces := testOversizedTraces(4, 100)
+	traces[1][0].Meta["padding"] = strings.Repeat("x", 5000)
+	traces[2][0].Service = ""
+	for _, tc := range []struct {
+		contentType string
+		marshal     func(model.Traces) []byte
+	}{
+		{"application/msgpack", func(traces model.Traces) []byte {
+			var buf bytes.Buffer
+			msgp.Encode(&buf, traces)
+			return buf.Bytes()
+		}},
+		{"application/json", func(traces model.Traces) []byte {
+			js, _ := json.Marshal(traces)
+			return js
+		}},
+	} {
+		for i := range traces {
+			traces[i][0].SpanID++ // not dropped as duplicates
+		}
+		code, report := postOversized(assert, receiver, v04, tc.contentType, nil, tc.marshal(traces))
+		assert.Equal(http.StatusOK, code, tc.contentType)
+		assert.Equal(2, report.Accepted, tc.contentType)
+		assert.Equal(2, report.Rejected, tc.contentType)
+		assert.False(report.Truncated, tc.contentType)
+		if assert.Len(report.Errors, 2, tc.contentType) {
+			assert.Equal(2.0, report.Errors[0]["trace"], tc.contentType)
+			assert.Equal("Service", report.Errors[0]["field"], tc.contentType)
+			assert.Equal(1.0, report.Errors[1]["trace"], tc.contentType)
+			assert.Contains(report.Errors[1]["reason"], "limit of 2000 bytes by trace", tc.contentType)
+		}
+	}
+	assert.Equal(int64(0), receiver.truncatedPayloads)
+	assert.Equal(int64(2), receiver.tracers.swap()[unknownTracer].TracesTooLarge)
+}
+
+func TestReceiverOversizedServices(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverAcceptOversized = true
+	receiver := NewHTTPReceiver(conf)
+	receiver.maxRequestBodyLength = 100
+
+	// the payloads decoded whole keep their limit
+	body := fmt.Sprintf(`{"svc": {"app": "%s"}}`, strings.Repeat("x", 150))
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v0.3/services", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	receiver.httpHandleWithVersion(v03, receiver.handleServices).ServeHTTP(rr, req)
+	assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 
 	"github.com/DataDog/datadog-trace-agent/model"
@@ -31,7 +33,46 @@ func HTTPDecodingError(err error, tags []string, w http.ResponseWriter) {
 	tags = append(tags, fmt.Sprintf("error:%s", errtag))
 	statsd.Client.Count("datadog.trace_agent.receiver.error", 1, tags, 1)
 
-	http.Error(w, msg, status)
+	// tell client libraries what is wrong with their payload
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "reason": err.Error()})
+}
+
+// HTTPChecksumError is used for payloads not matching their checksum header,
+// which are likely corrupted
+func HTTPChecksumError(err error, tags []string, w http.ResponseWriter) {
+	tags = append(tags, "error:checksum-mismatch")
+	statsd.Client.Count("datadog.trace_agent.receiver.error", 1, tags, 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": "checksum-mismatch", "reason": err.Error()})
+}
+
+// HTTPTimeoutError is used for payloads not read within the read timeout,
+// which are not decoding errors
+func HTTPTimeoutError(tags []string, w http.ResponseWriter) {
+	tags = append(tags, "error:read-timeout")
+	statsd.Client.Count("datadog.trace_agent.receiver.error", 1, tags, 1)
+	http.Error(w, "read-timeout", http.StatusRequestTimeout)
+}
+
+// isTimeout tells if err is a network timeout, as returned when reading a
+// request body past the read timeout of the server
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// HTTPAuthError is used for requests without the token of the receiver, see
+// authHandler
+func HTTPAuthError(tags []string, w http.ResponseWriter) {
+	tags = append(tags, "error:unauthorized")
+	statsd.Client.Count("datadog.trace_agent.receiver.error", 1, tags, 1)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
 }
 
 // HTTPEndpointNotSupported is for payloads getting sent to a wrong endpoint
@@ -41,8 +82,93 @@ func HTTPEndpointNotSupported(tags []string, w http.ResponseWriter) {
 	http.Error(w, "unsupported-endpoint", http.StatusInternalServerError)
 }
 
+// HTTPRateByService answers with the rates applied by service, for clients
+// to adjust their own sampling
+func HTTPRateByService(w http.ResponseWriter, rates map[string]float64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]map[string]float64{"rate_by_service": rates})
+}
+
 // HTTPOK is a dumb response for when things are a OK
 func HTTPOK(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, "OK\n")
 }
+
+// maxReportedTraceErrors is the number of rejected traces detailed in a
+// traceReport
+const maxReportedTraceErrors = 10
+
+// traceReport tells clients which traces of their payload were rejected and
+// why, the other traces being accepted
+type traceReport struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Errors   []traceError `json:"errors"` // of the first rejected traces
+
+	// Truncated is whether the payload was not read whole, being over the
+	// size limit, the traces not read being rejected
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// traceError is why a trace of a payload was rejected
+type traceError struct {
+	Trace  int    `json:"trace"`          // index of the trace in the payload
+	Span   *int   `json:"span,omitempty"` // index of the invalid span in the trace
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"` // all the above in a sentence
+}
+
+func (r *traceReport) accept() {
+	r.Accepted++
+}
+
+// reject accounts for the trace at index i of the payload, rejected with err
+func (r *traceReport) reject(i int, err error) {
+	r.Rejected++
+	if len(r.Errors) >= maxReportedTraceErrors {
+		return
+	}
+
+	te := traceError{Trace: i, Reason: err.Error()}
+	te.Error = fmt.Sprintf("trace %d: %s", i, te.Reason)
+	if se, ok := err.(*model.SpanError); ok {
+		span := se.Index
+		te.Span = &span
+		te.Field = se.Err.Field
+		te.Reason = se.Err.Reason
+		te.Error = fmt.Sprintf("span %d in trace %d: %s", span, i, te.Reason)
+	}
+	r.Errors = append(r.Errors, te)
+}
+
+// rejectN accounts for the n traces of the payload from index i on, rejected
+// with err. n is 0 if their number is unknown, err being reported anyway.
+func (r *traceReport) rejectN(i int, n int64, err error) {
+	r.Rejected += int(n)
+	if len(r.Errors) >= maxReportedTraceErrors {
+		return
+	}
+	r.Errors = append(r.Errors, traceError{Trace: i, Reason: err.Error(), Error: fmt.Sprintf("trace %d: %s", i, err)})
+}
+
+// HTTPTraceReport answers the payloads of which some traces were rejected,
+// the others being accepted. The rates by service are added to the report
+// unless nil, see HTTPRateByService.
+func HTTPTraceReport(tags []string, w http.ResponseWriter, report *traceReport, rates map[string]float64) {
+	tags = append(tags, "error:rejected-traces")
+	statsd.Client.Count("datadog.trace_agent.receiver.error", 1, tags, 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if rates == nil {
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		*traceReport
+		RateByService map[string]float64 `json:"rate_by_service"`
+	}{report, rates})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+)
+
+// clockSkew summarizes, by tracer, the delta between the end of the spans
+// received and the clock of the agent, so that support can tell which
+// library sends spans from a skewed clock, which land in the wrong stats
+// buckets. At most max tracers are kept apart, the others are summarized as
+// otherTracer. The summaries are reset at each report, see swap.
+type clockSkew struct {
+	mu        sync.Mutex
+	max       int
+	summaries map[tracerKey]*quantile.Summary
+}
+
+func newClockSkew(max int) *clockSkew {
+	return &clockSkew{max: max, summaries: make(map[tracerKey]*quantile.Summary)}
+}
+
+// observe adds the deltas of the spans of t, sent by tracer and received
+// at now, in nanoseconds since the epoch. The spans made by the agent
+// itself are not accounted for.
+func (c *clockSkew) observe(tracer tracerKey, t model.Trace, now int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.summaries[tracer]
+	if !ok {
+		if len(c.summaries) >= c.max {
+			tracer = otherTracer
+			s, ok = c.summaries[tracer]
+		}
+		if !ok {
+			s = quantile.NewSummary()
+			c.summaries[tracer] = s
+		}
+	}
+	for i := range t {
+		if t[i].IsSynthetic() {
+			continue
+		}
+		s.Insert(float64(now-t[i].End()), t[i].SpanID)
+	}
+}
+
+// swap returns the median deltas by tracer since the last call, and resets
+// them. They are positive when the spans end before they are received, as
+// they do with a clock in sync, and negative when they end in the future.
+func (c *clockSkew) swap() map[tracerKey]time.Duration {
+	c.mu.Lock()
+	summaries := c.summaries
+	c.summaries = make(map[tracerKey]*quantile.Summary)
+	c.mu.Unlock()
+
+	medians := make(map[tracerKey]time.Duration, len(summaries))
+	for tracer, s := range summaries {
+		if s.N > 0 {
+			medians[tracer] = time.Duration(s.Quantile(0.5))
+		}
+	}
+	return medians
+}
+
+// clockSkewSnapshot returns the median deltas by tracer key in seconds, as
+// published on /debug/vars
+func clockSkewSnapshot(medians map[tracerKey]time.Duration) map[string]float64 {
+	snapshot := make(map[string]float64, len(medians))
+	for tracer, d := range medians {
+		snapshot[tracer.String()] = d.Seconds()
+	}
+	return snapshot
+}
+
+// skewedTracers describes the tracers whose median delta is over threshold,
+// either way, sorted
+func skewedTracers(medians map[tracerKey]time.Duration, threshold time.Duration) []string {
+	var skewed []string
+	for tracer, d := range medians {
+		if d > threshold || d < -threshold {
+			skewed = append(skewed, fmt.Sprintf("%s (%+.1fs)", tracer, d.Seconds()))
+		}
+	}
+	sort.Strings(skewed)
+	return skewed
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestReceiverClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	post := func(lang, version string, skew time.Duration, id uint64) {
+		// a client ahead of the agent clock by skew, sending spans which
+		// ended a second ago on its own clock
+		var traces model.Traces
+		for i := uint64(0); i < 20; i++ {
+			span := fixtures.TestSpan()
+			span.TraceID, span.SpanID, span.ParentID = id+i, id+i, 0
+			span.Duration = int64(100 * time.Millisecond)
+			span.Start = time.Now().Add(skew-time.Second).UnixNano() - span.Duration
+			traces = append(traces, model.Trace{span})
+		}
+		var buf bytes.Buffer
+		assert.Nil(msgp.Encode(&buf, traces))
+		req, _ := http.NewRequest("POST", "/v0.4/traces", &buf)
+		req.Header.Set(headerLang, lang)
+		req.Header.Set(headerTracerVersion, version)
+		rr := httptest.NewRecorder()
+		receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+	}
+	post("python", "0.10.0", 30*time.Second, 100)
+	post("go", "0.5.0", 0, 200)
+
+	skews := receiver.skew.swap()
+	assert.Len(skews, 2)
+	python, gotracer := tracerKey{"python", "0.10.0"}, tracerKey{"go", "0.5.0"}
+	assert.InDelta(float64(-29*time.Second), float64(skews[python]), float64(100*time.Millisecond))
+	assert.InDelta(float64(time.Second), float64(skews[gotracer]), float64(100*time.Millisecond))
+
+	assert.Equal([]string{"python:0.10.0 (-29.0s)"}, skewedTracers(skews, 10*time.Second))
+	snapshot := clockSkewSnapshot(skews)
+	assert.InDelta(-29, snapshot["python:0.10.0"], 0.1)
+	assert.InDelta(1, snapshot["go:0.5.0"], 0.1)
+
+	// reset at each report
+	assert.Len(receiver.skew.swap(), 0)
+}
+
+func TestClockSkewMaxTracers(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newClockSkew(1)
+	now := time.Now().UnixNano()
+	trace := model.Trace{fixtures.TestSpan()}
+	trace[0].Start, trace[0].Duration = now-int64(3*time.Second), int64(time.Second)
+	c.observe(tracerKey{"python", "0.10.0"}, trace, now)
+	c.observe(tracerKey{"ruby", "0.1.0"}, trace, now)
+	c.observe(tracerKey{"go", "0.5.0"}, trace, now)
+
+	// and the spans of the agent are ignored
+	synthetic := model.Trace{fixtures.TestSpan()}
+	synthetic[0].Start = now + int64(time.Hour)
+	synthetic[0].SetSynthetic()
+	c.observe(tracerKey{"python", "0.10.0"}, synthetic, now)
+
+	assert.Equal(map[tracerKey]time.Duration{
+		{"python", "0.10.0"}: 2 * time.Second,
+		otherTracer:          2 * time.Second,
+	}, c.swap())
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-trace-agent/client"
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/watch"
 	"github.com/stretchr/testify/assert"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -107,6 +114,9 @@ func TestLegacyReceiver(t *testing.T) {
 			assert.Nil(err)
 			assert.Equal(200, resp.StatusCode)
 
+			// v0.1 spans wait for the rest of their trace
+			tc.r.reassembler.Flush(true)
+
 			// now we should be able to read the trace data
 			select {
 			case rt := <-tc.r.traces:
@@ -400,6 +410,510 @@ func TestReceiverServiceMsgpackDecoder(t *testing.T) {
 	}
 }
 
+func TestReceiverTraceVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+	receiver.rates.Set("django", "prod", 0.5)
+
+	var buf bytes.Buffer
+	msgp.Encode(&buf, fixtures.GetTestTrace(1, 1))
+
+	post := func(v APIVersion, contentType string, body []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/traces", v), bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		receiver.httpHandleWithVersion(v, receiver.handleTraces).ServeHTTP(rr, req)
+		// consume the traces channel
+		select {
+		case <-receiver.traces:
+		default:
+		}
+		return rr
+	}
+
+	// v0.3 answers with a plain OK
+	rr := post(v03, "application/msgpack", buf.Bytes())
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("OK\n", rr.Body.String())
+
+	// v0.4 defaults to msgpack and answers with the rates
+	rr = post(v04, "", buf.Bytes())
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("application/json", rr.Header().Get("Content-Type"))
+	var resp map[string]map[string]float64
+	assert.Nil(json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(map[string]float64{"service:django,env:prod": 0.5}, resp["rate_by_service"])
+
+	// JSON is still supported by v0.4
+	js, _ := json.Marshal(fixtures.GetTestTrace(1, 1))
+	rr = post(v04, "application/json", js)
+	assert.Equal(http.StatusOK, rr.Code)
+}
+
+func TestReceiverSpanEventsAndLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DedupeCacheSize = 0 // the same trace is posted with both encodings
+	receiver := NewHTTPReceiver(conf)
+	sampler := NewSampler(conf)
+	sampler.samplerEngine = neverSampleEngine{}
+
+	traces := fixtures.GetTestTrace(1, 1)
+	span := &traces[0][0]
+	span.Metrics[model.SamplingPriorityKey] = model.PriorityUserKeep
+	span.Events = []model.SpanEvent{
+		{Ts: span.Start + 10, Name: "cache miss", Attrs: map[string]string{"key": "raclette"}},
+		{Ts: span.Start + 20, Name: "retry"},
+	}
+	span.Links = []model.SpanLink{{TraceID: 1234, SpanID: 5678}, {TraceID: 0, SpanID: 1}}
+
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+	js, err := json.Marshal(traces)
+	assert.Nil(err)
+
+	for contentType, body := range map[string][]byte{
+		"application/msgpack": buf.Bytes(),
+		"application/json":    js,
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v0.4/traces", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		var trace model.Trace
+		select {
+		case trace = <-receiver.traces:
+		default:
+			t.Fatalf("no data received with %s", contentType)
+		}
+		assert.Equal(span.Events, trace[0].Events)
+		// the invalid link was dropped by the normalizer
+		assert.Equal(span.Links[:1], trace[0].Links)
+
+		// events and links are sent along with sampled traces
+		sampler.Add(processedTrace{Trace: trace, Root: &trace[0]})
+		sampled := sampler.Flush()
+		assert.Len(sampled, 1)
+		assert.Equal(span.Events, sampled[0][0].Events)
+		assert.Equal(span.Links[:1], sampled[0][0].Links)
+	}
+}
+
+func TestReceiverTraceCountHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+
+	var buf bytes.Buffer
+	msgp.Encode(&buf, fixtures.GetTestTrace(5, 3))
+	truncated := buf.Bytes()[:buf.Len()/2]
+
+	post := func(v APIVersion) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/traces", v), bytes.NewReader(truncated))
+		req.Header.Set("Content-Type", "application/msgpack")
+		req.Header.Set("X-Datadog-Trace-Count", "5")
+		receiver.httpHandleWithVersion(v, receiver.handleTraces).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// v0.3 ignores the header
+	rr := post(v03)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	assert.Equal(int64(0), receiver.stats.TracesDropped)
+
+	// v0.4 accounts for the lost traces
+	rr = post(v04)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	assert.Equal(int64(5), receiver.stats.TracesDropped)
+	assert.Equal(int64(5), receiver.stats.TracesReceived)
+}
+
+func TestReceiverReadTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverReadTimeout = 200 * time.Millisecond
+	receiver := NewHTTPReceiver(conf)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v0.3/traces", receiver.httpHandleWithVersion(v03, receiver.handleTraces))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer listener.Close()
+	go receiver.newServer(mux, true).Serve(listener)
+
+	// slowClient sends the start of a request, then stalls until the
+	// server closes the connection, and returns how long it took
+	slowClient := func(start string, check func(*bufio.Reader)) time.Duration {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if !assert.Nil(err) {
+			t.FailNow()
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		begin := time.Now()
+		fmt.Fprint(conn, start)
+		resp := bufio.NewReader(conn)
+		check(resp)
+		_, err = ioutil.ReadAll(resp)
+		assert.Nil(err, "the connection was not closed by the server")
+		return time.Since(begin)
+	}
+
+	// headers never completed, the server closes the connection
+	elapsed := slowClient("POST /v0.3/traces HTTP/1.1\r\nHost: localhost\r\n", func(*bufio.Reader) {})
+	assert.InDelta(200*time.Millisecond, elapsed, float64(150*time.Millisecond))
+	assert.Equal(int64(0), receiver.readTimeouts)
+
+	// body never completed, the handler answers before closing it
+	elapsed = slowClient("POST /v0.3/traces HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n[[",
+		func(r *bufio.Reader) {
+			resp, err := http.ReadResponse(r, nil)
+			if assert.Nil(err) {
+				assert.Equal(http.StatusRequestTimeout, resp.StatusCode)
+			}
+		})
+	assert.InDelta(200*time.Millisecond, elapsed, float64(150*time.Millisecond))
+	assert.Equal(int64(1), receiver.readTimeouts)
+	assert.Equal(int64(0), receiver.stats.TracesReceived)
+}
+
+func TestReceiverGlobalTags(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.GlobalTags = map[string]string{"datacenter": "us-east-1a", "team": "platform"}
+	receiver := NewHTTPReceiver(conf)
+
+	now := model.Now()
+	receiver.processTrace(model.Trace{
+		{TraceID: 1, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /", Start: now, Duration: 100},
+		{TraceID: 1, SpanID: 2, ParentID: 1, Service: "mcnulty", Name: "query", Resource: "GET /", Start: now, Duration: 50,
+			Meta: map[string]string{"datacenter": "eu-west-1b"}},
+	}, unknownTracer)
+	var trace model.Trace
+	select {
+	case trace = <-receiver.traces:
+	case <-time.After(time.Second):
+		t.Fatal("the trace was not processed")
+	}
+	assert.Equal(map[string]string{"datacenter": "us-east-1a", "team": "platform"}, trace[0].Meta)
+	assert.Equal(map[string]string{"datacenter": "eu-west-1b", "team": "platform"}, trace[1].Meta)
+
+	// the tags are aggregators like the ones of the spans
+	srb := model.NewStatsRawBucket(0, 1e10)
+	for _, s := range trace {
+		srb.HandleSpan(s, "none", []string{"datacenter"}, 1, nil)
+	}
+	sb := srb.Export()
+	assert.Contains(sb.Counts, "query|hits|env:none,resource:GET /,service:mcnulty,datacenter:us-east-1a")
+	assert.Contains(sb.Counts, "query|hits|env:none,resource:GET /,service:mcnulty,datacenter:eu-west-1b")
+}
+
+func TestReceiverClient(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []client.Option
+	}{
+		{"json", nil},
+		{"json gzip", []client.Option{client.WithGzip()}},
+		{"msgpack", []client.Option{client.WithEncoding(client.EncodingMsgpack)}},
+		{"msgpack gzip", []client.Option{client.WithEncoding(client.EncodingMsgpack), client.WithGzip()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			receiver := NewHTTPReceiver(config.NewDefaultAgentConfig())
+			mux := http.NewServeMux()
+			mux.HandleFunc("/v0.4/traces", receiver.httpHandleWithVersion(v04, receiver.handleTraces))
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			c, err := client.New(server.URL, tc.opts...)
+			if !assert.Nil(err) {
+				t.FailNow()
+			}
+			now := model.Now()
+			for id := uint64(1); id <= 3; id++ {
+				assert.Nil(c.SubmitTrace([]model.Span{
+					{TraceID: id, SpanID: 1, Service: "backup", Name: "run", Resource: "nightly", Start: now, Duration: 100},
+					{TraceID: id, SpanID: 2, ParentID: 1, Service: "backup", Name: "upload", Resource: "s3", Start: now, Duration: 50},
+				}))
+			}
+			assert.Nil(c.Close())
+
+			for id := uint64(1); id <= 3; id++ {
+				select {
+				case trace := <-receiver.traces:
+					assert.Len(trace, 2)
+					assert.Equal(id, trace[0].TraceID)
+					assert.Equal("nightly", trace[0].Resource)
+				case <-time.After(time.Second):
+					t.Fatalf("trace %d did not reach the pipeline", id)
+				}
+			}
+			assert.Equal(int64(3), receiver.stats.TracesReceived)
+		})
+	}
+}
+
+func TestReceiverGzipError(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	h := receiver.httpHandleWithVersion(v04, receiver.handleTraces)
+
+	// a body which is not gzipped is a decoding error
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v0.4/traces", bytes.NewReader([]byte("[]")))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+
+	// and the limit applies to the decompressed body
+	receiver.maxRequestBodyLength = 1000
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("[[" + strings.Repeat(" ", 10000) + "]]"))
+	gz.Close()
+	assert.True(buf.Len() < 1000)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v0.4/traces", &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(rr, req)
+	assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestReceiverDedupe(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+	c := NewConcentrator(nil, testBucketInterval, 0)
+
+	trace := model.Trace{
+		testSpan(c, 1, 24, 3, "a1", "resource1", 0),
+		testSpan(c, 2, 12, 3, "a1", "resource1", 0),
+		testSpan(c, 3, 40, 3, "a1", "resource2", 0),
+	}
+	for i := range trace {
+		trace[i].TraceID = 42
+		trace[i].ParentID = 1
+	}
+	trace[0].ParentID = 0
+
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, model.Traces{trace}))
+
+	post := func(body []byte) {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v0.4/traces", bytes.NewReader(body))
+		receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+	}
+
+	// the client retries the whole payload, then sends a new span of the trace
+	post(buf.Bytes())
+	post(buf.Bytes())
+	span := testSpan(c, 4, 30, 3, "a1", "resource2", 0)
+	span.TraceID, span.ParentID = 42, 1
+	buf.Reset()
+	assert.Nil(msgp.Encode(&buf, model.Traces{{trace[2], span}}))
+	post(buf.Bytes())
+
+	var spans int
+	for len(receiver.traces) > 0 {
+		t := <-receiver.traces
+		spans += len(t)
+		c.Add(processedTrace{Env: "none", Trace: t}, 1)
+	}
+	assert.Equal(4, spans)
+	assert.Equal(int64(4), receiver.dedupe.swapDuplicates())
+
+	hits := make(map[string]int64)
+	for _, sb := range c.Flush() {
+		for key, count := range sb.Counts {
+			hits[key] += int64(count.Value)
+		}
+	}
+	assert.Equal(int64(2), hits["query|hits|env:none,resource:resource1,service:a1"])
+	assert.Equal(int64(2), hits["query|hits|env:none,resource:resource2,service:a1"])
+}
+
+func TestReceiverRejectedTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+
+	// 2 valid traces then 12 rejected ones, the first with an invalid span
+	// in second position
+	var traces model.Traces
+	for i := uint64(1); i <= 3; i++ {
+		trace := model.Trace{fixtures.TestSpan(), fixtures.TestSpan()}
+		for j := range trace {
+			trace[j].TraceID, trace[j].SpanID = i, i*10+uint64(j)
+			trace[j].Start = time.Now().UnixNano()
+		}
+		traces = append(traces, trace)
+	}
+	traces[2][1].Service = ""
+	for i := 0; i < 11; i++ {
+		traces = append(traces, model.Trace{})
+	}
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v0.4/traces", &buf)
+	receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("application/json", rr.Header().Get("Content-Type"))
+	var report struct {
+		Accepted      int
+		Rejected      int
+		Errors        []map[string]interface{}
+		RateByService map[string]float64 `json:"rate_by_service"`
+	}
+	assert.Nil(json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(2, report.Accepted)
+	assert.Equal(12, report.Rejected)
+	assert.NotNil(report.RateByService)
+	assert.Len(report.Errors, maxReportedTraceErrors)
+	assert.Equal(map[string]interface{}{
+		"trace":  2.0,
+		"span":   1.0,
+		"field":  "Service",
+		"reason": "empty `Service`",
+		"error":  "span 1 in trace 2: empty `Service`",
+	}, report.Errors[0])
+	assert.Equal(map[string]interface{}{
+		"trace":  3.0,
+		"reason": "empty trace",
+		"error":  "trace 3: empty trace",
+	}, report.Errors[1])
+
+	// the valid traces went through
+	assert.Len(receiver.traces, 2)
+	assert.Equal(int64(12), receiver.stats.TracesDropped)
+
+	// payloads which cannot be decoded are detailed as well
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v0.3/traces", strings.NewReader("[[{\"duration\": \"long\"}]]"))
+	req.Header.Set("Content-Type", "application/json")
+	receiver.httpHandleWithVersion(v03, receiver.handleTraces).ServeHTTP(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	var decodingErr map[string]string
+	assert.Nil(json.Unmarshal(rr.Body.Bytes(), &decodingErr))
+	assert.Equal("decoding-error", decodingErr["error"])
+	assert.Contains(decodingErr["reason"], "duration")
+}
+
+func TestReceiverClampDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.MaxDurationByService = map[string]time.Duration{"batch": 0}
+	receiver := NewHTTPReceiver(conf)
+	c := NewConcentrator(nil, testBucketInterval, 0)
+	c.clock = watch.NewFakeClock(time.Now())
+
+	// 1000 spans of 0.1 to 100ms, and one of 40 days, e.g. from a clock bug
+	var traces model.Traces
+	for i := 1; i <= 1000; i++ {
+		traces = append(traces, model.Trace{testSpan(c, uint64(i), int64(i)*1e5, 0, "web", "GET /", 0)})
+	}
+	absurd := testSpan(c, 1001, int64(40*24*time.Hour), 0, "web", "GET /", 0)
+	traces = append(traces, model.Trace{absurd})
+	// the limit is disabled for this service
+	long := testSpan(c, 1002, int64(40*24*time.Hour), 0, "batch", "job", 0)
+	traces = append(traces, model.Trace{long})
+	for i := range traces {
+		traces[i][0].TraceID = traces[i][0].SpanID
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v0.4/traces", &buf)
+	receiver.httpHandleWithVersion(v04, receiver.handleTraces).ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	assert.Len(receiver.traces, 1002)
+	for len(receiver.traces) > 0 {
+		t := <-receiver.traces
+		switch t[0].SpanID {
+		case absurd.SpanID:
+			assert.Equal(int64(30*time.Minute), t[0].Duration)
+			assert.Equal(absurd.End(), t[0].End())
+			assert.Equal(float64(absurd.Duration), t[0].Metrics[model.SpanUnclampedDurationKey])
+		case long.SpanID:
+			assert.Equal(long.Duration, t[0].Duration)
+		}
+		c.Add(processedTrace{Env: "none", Trace: t}, 1)
+	}
+	assert.Equal(map[string]int64{"web": 1}, receiver.clamped.swap())
+
+	var found bool
+	for _, sb := range c.FlushAll() {
+		for _, d := range sb.Distributions {
+			if d.Service() != "web" {
+				continue
+			}
+			found = true
+			// within the 1% rank error of the summaries, the P99 can be
+			// the max, which is now the clamp instead of 40 days
+			assert.InEpsilon(float64(98*time.Millisecond), d.Summary.Quantile(0.98), 0.02)
+			assert.True(d.Summary.Quantile(0.99) <= float64(30*time.Minute))
+			assert.InEpsilon(float64(30*time.Minute), d.Summary.Quantile(1), 0.01)
+		}
+	}
+	assert.True(found)
+}
+
+func TestReceiverInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.HostName = "testhost"
+	conf.APIKeys = []string{"0123456789abcdef"}
+	receiver := NewHTTPReceiver(conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/info", nil)
+	http.HandlerFunc(receiver.handleInfo).ServeHTTP(rr, req)
+
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("application/json", rr.Header().Get("Content-Type"))
+
+	body := rr.Body.String()
+	assert.NotContains(body, "0123456789abcdef")
+
+	var info receiverInfo
+	assert.Nil(json.Unmarshal([]byte(body), &info))
+	assert.Equal(Version, info.Agent.Version)
+	assert.Equal("testhost", info.Agent.Hostname)
+	assert.Equal(infoStart.UnixNano(), info.Agent.StartTime)
+	assert.Contains(info.Endpoints, "/v0.3/traces")
+	assert.Equal([]string{"https://trace.agent.datadoghq.com"}, info.Config.APIEndpoints)
+	assert.Equal([]string{"***********bcdef"}, info.Config.APIKeys)
+}
+
 func BenchmarkHandleTraces(b *testing.B) {
 	// prepare the payload
 	// msgpack payload
@@ -477,3 +991,33 @@ func BenchmarkDecoderMsgpack(b *testing.B) {
 		_ = msgp.Decode(reader, &traces)
 	}
 }
+
+func TestTopTruncatedServices(t *testing.T) {
+	assert := assert.New(t)
+
+	var stats serviceCounts
+	for i, service := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		stats.add(service, (i+1)*100)
+	}
+	stats.add("a", 1000)
+
+	truncated := stats.swap()
+	assert.Len(truncated, 7)
+	assert.Nil(stats.swap())
+
+	top := topServices(truncated, 5)
+	assert.Equal([]serviceCount{{"a", 1100}, {"g", 700}, {"f", 600}, {"e", 500}, {"d", 400}}, top)
+}
+
+func TestServiceCountsAddSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	var spans serviceCounts
+	trace := model.Trace{fixtures.TestSpan(), fixtures.TestSpan(), fixtures.TestSpan()}
+	trace[0].Service, trace[1].Service, trace[2].Service = "web", "db", "web"
+	spans.addSpans(trace)
+	spans.addSpans(trace[1:2])
+
+	assert.Equal(map[string]int64{"web": 2, "db": 2}, spans.swap())
+	assert.Nil(spans.swap())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+)
+
+// Headers the tracing libraries identify themselves with
+const (
+	headerLang          = "Datadog-Meta-Lang"
+	headerTracerVersion = "Datadog-Meta-Tracer-Version"
+)
+
+const (
+	// maxTracers is the number of tracers whose stats are kept apart, the
+	// ones seen past it are counted as otherTracer
+	maxTracers = 100
+	// maxTracerHeaderLength truncates the values of the tracer headers
+	maxTracerHeaderLength = 32
+)
+
+var (
+	// unknownTracer is the tracer of the requests without tracer headers,
+	// and of the traces reassembled from several payloads
+	unknownTracer = tracerKey{lang: "unknown"}
+	// otherTracer gathers the tracers seen once maxTracers were
+	otherTracer = tracerKey{lang: "other"}
+)
+
+// tracerKey identifies the tracing library which sent a payload
+type tracerKey struct {
+	lang, version string
+}
+
+// newTracerKey returns the tracer which sent req, from its headers
+func newTracerKey(req *http.Request) tracerKey {
+	lang := strings.ToLower(strings.TrimSpace(req.Header.Get(headerLang)))
+	if lang == "" {
+		return unknownTracer
+	}
+	return tracerKey{
+		lang:    truncateTracerHeader(lang),
+		version: truncateTracerHeader(strings.TrimSpace(req.Header.Get(headerTracerVersion))),
+	}
+}
+
+func truncateTracerHeader(v string) string {
+	if len(v) > maxTracerHeaderLength {
+		return v[:maxTracerHeaderLength]
+	}
+	return v
+}
+
+// String returns the key of the tracer in /debug/vars, lang:version
+func (k tracerKey) String() string {
+	if k.version == "" {
+		return k.lang
+	}
+	return k.lang + ":" + k.version
+}
+
+// tracerCounts are the counters of the receiver attributed to a tracer
+type tracerCounts struct {
+	TracesReceived int64 `json:"traces_received"`
+	SpansReceived  int64 `json:"spans_received"`
+	TracesBytes    int64 `json:"traces_bytes"`
+	TracesDropped  int64 `json:"traces_dropped"`
+	SpansDropped   int64 `json:"spans_dropped"`
+
+	// the reasons traces were dropped for
+	TracesUndecodable int64 `json:"traces_undecodable"` // lost with their payload, as told by headerTraceCount
+	TracesInvalid     int64 `json:"traces_invalid"`     // rejected by model.NormalizeTrace
+	TracesQueueFull   int64 `json:"traces_queue_full"`
+	// rejected with their payload, see payloadChecker
+	TracesChecksumMismatch int64 `json:"traces_checksum_mismatch"`
+	// over the size limits, see HTTPReceiver.readTraceStream
+	TracesTooLarge int64 `json:"traces_too_large"`
+
+	// the fixes of the spans kept
+	ResourcesInherited int64 `json:"resources_inherited"`
+	MetaTruncatedBytes int64 `json:"meta_truncated_bytes"`
+	DurationsClamped   int64 `json:"durations_clamped"`
+}
+
+func (c *tracerCounts) add(o *tracerCounts) {
+	c.TracesReceived += o.TracesReceived
+	c.SpansReceived += o.SpansReceived
+	c.TracesBytes += o.TracesBytes
+	c.TracesDropped += o.TracesDropped
+	c.SpansDropped += o.SpansDropped
+	c.TracesUndecodable += o.TracesUndecodable
+	c.TracesInvalid += o.TracesInvalid
+	c.TracesQueueFull += o.TracesQueueFull
+	c.TracesChecksumMismatch += o.TracesChecksumMismatch
+	c.TracesTooLarge += o.TracesTooLarge
+	c.ResourcesInherited += o.ResourcesInherited
+	c.MetaTruncatedBytes += o.MetaTruncatedBytes
+	c.DurationsClamped += o.DurationsClamped
+}
+
+// tracerStats counts what the receiver did by tracer. At most max tracers
+// are kept apart, the others are counted as otherTracer. The counts are
+// reset at each report, see swap.
+type tracerStats struct {
+	mu      sync.Mutex
+	max     int
+	tracers map[tracerKey]*tracerCounts
+}
+
+func newTracerStats(max int) *tracerStats {
+	return &tracerStats{max: max, tracers: make(map[tracerKey]*tracerCounts)}
+}
+
+// add adds counts to the ones of tracer
+func (s *tracerStats) add(tracer tracerKey, counts *tracerCounts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.tracers[tracer]
+	if !ok {
+		if len(s.tracers) >= s.max {
+			tracer = otherTracer
+			c, ok = s.tracers[tracer]
+		}
+		if !ok {
+			c = &tracerCounts{}
+			s.tracers[tracer] = c
+		}
+	}
+	c.add(counts)
+}
+
+// swap returns the counts by tracer since the last call, and resets them
+func (s *tracerStats) swap() map[tracerKey]*tracerCounts {
+	s.mu.Lock()
+	tracers := s.tracers
+	s.tracers = make(map[tracerKey]*tracerCounts)
+	s.mu.Unlock()
+	return tracers
+}
+
+// tracersSnapshot returns the counts of tracers by tracer key, as published
+// on /debug/vars
+func tracersSnapshot(tracers map[tracerKey]*tracerCounts) map[string]tracerCounts {
+	snapshot := make(map[string]tracerCounts, len(tracers))
+	for k, c := range tracers {
+		snapshot[k.String()] = *c
+	}
+	return snapshot
+}
+
+// logTracerStats logs the traces received and dropped by language
+func logTracerStats(tracers map[tracerKey]*tracerCounts) {
+	byLang := make(map[string]*tracerCounts)
+	for k, c := range tracers {
+		lc, ok := byLang[k.lang]
+		if !ok {
+			lc = &tracerCounts{}
+			byLang[k.lang] = lc
+		}
+		lc.add(c)
+	}
+
+	langs := make([]string, 0, len(byLang))
+	for lang := range byLang {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	summary := make([]string, len(langs))
+	for i, lang := range langs {
+		c := byLang[lang]
+		summary[i] = fmt.Sprintf("%s: %d received, %d dropped", lang, c.TracesReceived, c.TracesDropped)
+	}
+	config.WithFields(config.Fields{
+		"languages": byLang,
+	}).Infof("receiver traces by language: %s", strings.Join(summary, "; "))
+}
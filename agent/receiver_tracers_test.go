@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestNewTracerKey(t *testing.T) {
+	assert := assert.New(t)
+
+	req, _ := http.NewRequest("POST", "/v0.4/traces", nil)
+	assert.Equal(unknownTracer, newTracerKey(req))
+
+	req.Header.Set(headerLang, " Python ")
+	assert.Equal(tracerKey{lang: "python"}, newTracerKey(req))
+	assert.Equal("python", newTracerKey(req).String())
+
+	req.Header.Set(headerTracerVersion, "0.10.0")
+	assert.Equal("python:0.10.0", newTracerKey(req).String())
+
+	req.Header.Set(headerTracerVersion, strings.Repeat("1", 100))
+	assert.Len(newTracerKey(req).version, maxTracerHeaderLength)
+}
+
+func TestTracerStatsMax(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTracerStats(2)
+	goTracer := tracerKey{lang: "go", version: "1.0.0"}
+	s.add(goTracer, &tracerCounts{TracesReceived: 1})
+	s.add(tracerKey{lang: "python", version: "0.10.0"}, &tracerCounts{TracesReceived: 2})
+	// past the limit, new tracers are counted together
+	s.add(tracerKey{lang: "ruby", version: "0.9.0"}, &tracerCounts{TracesReceived: 3})
+	s.add(tracerKey{lang: "java", version: "0.2.0"}, &tracerCounts{TracesReceived: 4})
+	s.add(goTracer, &tracerCounts{TracesReceived: 5})
+
+	assert.Equal(map[string]tracerCounts{
+		"go:1.0.0":      {TracesReceived: 6},
+		"python:0.10.0": {TracesReceived: 2},
+		"other":         {TracesReceived: 7},
+	}, tracersSnapshot(s.swap()))
+	assert.Len(s.swap(), 0)
+}
+
+func TestReceiverTracerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+	handler := receiver.httpHandleWithVersion(v04, receiver.handleTraces)
+
+	// go sends a valid trace, one with an invalid span and an empty one
+	var traces model.Traces
+	for i := uint64(1); i <= 2; i++ {
+		trace := model.Trace{fixtures.TestSpan(), fixtures.TestSpan()}
+		for j := range trace {
+			trace[j].TraceID, trace[j].SpanID = i, i*10+uint64(j)
+			trace[j].Start = time.Now().UnixNano()
+		}
+		traces = append(traces, trace)
+	}
+	traces[1][1].Service = ""
+	traces = append(traces, model.Trace{})
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+	req, _ := http.NewRequest("POST", "/v0.4/traces", &buf)
+	req.Header.Set(headerLang, "go")
+	req.Header.Set(headerTracerVersion, "1.0.0")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// python sends a payload which cannot be decoded
+	req, _ = http.NewRequest("POST", "/v0.4/traces", strings.NewReader("not msgpack"))
+	req.Header.Set(headerLang, "python")
+	req.Header.Set(headerTracerVersion, "0.10.0")
+	req.Header.Set(headerTraceCount, "3")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	tracers := receiver.tracers.swap()
+	if !assert.Len(tracers, 2) {
+		t.FailNow()
+	}
+	golang := tracers[tracerKey{lang: "go", version: "1.0.0"}]
+	assert.Equal(int64(3), golang.TracesReceived)
+	assert.Equal(int64(4), golang.SpansReceived)
+	assert.Equal(int64(2), golang.TracesDropped)
+	assert.Equal(int64(2), golang.SpansDropped)
+	assert.Equal(int64(2), golang.TracesInvalid)
+	assert.Equal(int64(0), golang.TracesUndecodable)
+	assert.True(golang.TracesBytes > 0)
+
+	python := tracers[tracerKey{lang: "python", version: "0.10.0"}]
+	assert.Equal(int64(3), python.TracesReceived)
+	assert.Equal(int64(3), python.TracesDropped)
+	assert.Equal(int64(3), python.TracesUndecodable)
+	assert.Equal(int64(0), python.TracesInvalid)
+
+	// all the drops are attributed
+	assert.Equal(receiver.stats.TracesDropped, golang.TracesDropped+python.TracesDropped)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/DataDog/datadog-trace-agent/watch"
+)
+
+// requestStats tracks the requests served by the receiver endpoints: their
+// number by status class, the size of their payloads and the latency of their
+// handlers. Handlers record concurrently, and the stats are reset at each
+// report, see swap.
+type requestStats struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointRequests
+
+	logRequests bool        // logs every request at debug level
+	clock       watch.Clock // times the handlers, overridden by tests
+}
+
+// endpointRequests are the requests of an endpoint since the last report
+type endpointRequests struct {
+	requests int64
+	statuses map[string]int64 // by status class, e.g. "2xx"
+	bytes    int64            // read from the request bodies
+	latency  *quantile.Summary
+}
+
+// requestsSnapshot is the report of the requests of an endpoint, latencies
+// are in seconds
+type requestsSnapshot struct {
+	Requests   int64            `json:"requests"`
+	Statuses   map[string]int64 `json:"statuses"`
+	Bytes      int64            `json:"bytes"`
+	LatencyP50 float64          `json:"latency_p50"`
+	LatencyP99 float64          `json:"latency_p99"`
+	LatencyMax float64          `json:"latency_max"`
+}
+
+func newRequestStats(logRequests bool) *requestStats {
+	return &requestStats{
+		endpoints:   make(map[string]*endpointRequests),
+		logRequests: logRequests,
+		clock:       watch.Real,
+	}
+}
+
+// wrap returns h, recording its requests as the ones of endpoint
+func (s *requestStats) wrap(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := s.clock.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		body := &countingBody{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+
+		h(sw, req)
+
+		latency := s.clock.Now().Sub(start)
+		s.record(endpoint, sw.status, body.n, latency)
+		if s.logRequests {
+			log.Debugf("%s %s from %s: %d, %d bytes in %s", req.Method, endpoint, req.RemoteAddr, sw.status, body.n, latency)
+		}
+	}
+}
+
+func (s *requestStats) record(endpoint string, status int, bytes int64, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.endpoints[endpoint]
+	if !ok {
+		e = &endpointRequests{statuses: make(map[string]int64), latency: quantile.NewSummary()}
+		s.endpoints[endpoint] = e
+	}
+	e.requests++
+	e.statuses[fmt.Sprintf("%dxx", status/100)]++
+	e.bytes += bytes
+	e.latency.Insert(latency.Seconds(), uint64(e.requests))
+}
+
+// swap returns the report of the requests by endpoint since the last call,
+// and resets them
+func (s *requestStats) swap() map[string]requestsSnapshot {
+	s.mu.Lock()
+	endpoints := s.endpoints
+	s.endpoints = make(map[string]*endpointRequests)
+	s.mu.Unlock()
+
+	snapshots := make(map[string]requestsSnapshot, len(endpoints))
+	for name, e := range endpoints {
+		snapshots[name] = requestsSnapshot{
+			Requests:   e.requests,
+			Statuses:   e.statuses,
+			Bytes:      e.bytes,
+			LatencyP50: e.latency.Quantile(0.5),
+			LatencyP99: e.latency.Quantile(0.99),
+			LatencyMax: e.latency.Quantile(1),
+		}
+	}
+	return snapshots
+}
+
+// statusWriter remembers the status code written to the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read implements io.Reader
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/watch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestStatsLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := watch.NewFakeClock(time.Now())
+	s := newRequestStats(false)
+	s.clock = clock
+
+	// the i-th request takes i milliseconds
+	var i int
+	h := s.wrap("/v0.3/traces", func(w http.ResponseWriter, req *http.Request) {
+		i++
+		ioutil.ReadAll(req.Body)
+		clock.Advance(time.Duration(i) * time.Millisecond)
+		if i%10 == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	for n := 0; n < 500; n++ {
+		h(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v0.3/traces", strings.NewReader("[]")))
+	}
+
+	report := s.swap()
+	rs, ok := report["/v0.3/traces"]
+	if !assert.True(ok) {
+		t.FailNow()
+	}
+	assert.Equal(int64(500), rs.Requests)
+	assert.Equal(map[string]int64{"2xx": 450, "4xx": 50}, rs.Statuses)
+	assert.Equal(int64(1000), rs.Bytes)
+	assert.InDelta(0.250, rs.LatencyP50, 0.010)
+	assert.InDelta(0.495, rs.LatencyP99, 0.010)
+	assert.Equal(0.5, rs.LatencyMax)
+
+	// stats are reset at each report
+	assert.Len(s.swap(), 0)
+}
+
+func TestRequestStatsConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newRequestStats(true)
+	server := httptest.NewServer(s.wrap("/v0.4/services", func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		time.Sleep(time.Millisecond)
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 10; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 30; n++ {
+				resp, err := http.Post(server.URL, "application/json", strings.NewReader("{}"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	rs := s.swap()["/v0.4/services"]
+	assert.Equal(int64(300), rs.Requests)
+	assert.Equal(map[string]int64{"2xx": 300}, rs.Statuses)
+	assert.Equal(int64(600), rs.Bytes)
+	assert.True(rs.LatencyP99 >= 0.001, "P99 of %fs is below the latency of the handler", rs.LatencyP99)
+	assert.True(rs.LatencyP99 < 1, "P99 of %fs is implausible", rs.LatencyP99)
+	assert.True(rs.LatencyP50 <= rs.LatencyP99)
+	assert.True(rs.LatencyP99 <= rs.LatencyMax)
+}
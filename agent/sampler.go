@@ -1,6 +1,8 @@
 package main
 
 import (
+	"container/heap"
+	"fmt"
 	"sync"
 	"time"
 
@@ -9,16 +11,58 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+	"github.com/DataDog/datadog-trace-agent/watch"
 )
 
 // Sampler chooses wich spans to write to the API
 type Sampler struct {
-	mu            sync.Mutex
-	sampledTraces []model.Trace
-	traceCount    int
-	lastFlush     time.Time
+	mu             sync.Mutex
+	sampledTraces  []model.Trace
+	traceCount     int
+	priorityCounts map[int]int64 // traces received per sampling priority, since the last flush
+	lastFlush      time.Time
+
+	indexedKeys    []string
+	indexedMaxKeys int
+
+	uniformRate float64 // fraction of the traces kept by trace ID, see config.AgentConfig.UniformSampleRate
+
+	// memory of the sampled traces, see config.AgentConfig.MaxSamplerMemory.
+	// Evicted traces are set to nil in sampledTraces until the next flush.
+	maxBytes      int64
+	bytes         int64        // estimated with model.Trace.WeightedSize
+	sizes         sampledSizes // only maintained with maxBytes
+	evictedBytes  int64        // since the last flush
+	evictedTraces int64
+
+	// shapes of the traces kept during the last flushes, nil unless
+	// config.AgentConfig.DedupeWindowFlushes is set
+	shapes     *sampledShapes
+	duplicates int64 // traces skipped as repeated shapes, since the last flush
+
+	errorSamples int64 // traces kept for holding error samples, since the last flush
+
+	// decisions taken since the last flush, only recorded for the decision
+	// log, which is nil if disabled
+	decisionLog *decisionLog
+	decisions   []samplingDecision
+
+	rates *sampler.RateByService
+
+	// chunks holds the decisions taken for the long-running traces sent in
+	// chunks, so that all their chunks are kept or dropped together
+	chunks   map[uint64]chunkDecision
+	chunkTTL time.Duration // how long a decision waits for the next chunk
 
 	samplerEngine SamplerEngine
+	clock         watch.Clock // times the flushes and the chunk decisions, overridden by tests
+}
+
+// chunkDecision is the sampling decision of a long-running trace
+type chunkDecision struct {
+	keep bool
+	seen time.Time // when the last chunk was sampled
 }
 
 // samplerStats contains sampler statistics
@@ -27,6 +71,23 @@ type samplerStats struct {
 	KeptTPS float64
 	// TotalTPS is the total number of traces (average per second for last flush)
 	TotalTPS float64
+	// KeptTraces and TotalTraces are the number of traces kept and seen (for last flush)
+	KeptTraces  int64
+	TotalTraces int64
+	// PriorityTraces is the number of traces for each sampling priority (for last flush)
+	PriorityTraces map[string]int64
+	// MemoryBytes is the estimated memory of the sampled traces (at last flush)
+	MemoryBytes int64
+	// EvictedBytes and EvictedTraces count the traces evicted to stay under
+	// the memory limit (for last flush)
+	EvictedBytes  int64
+	EvictedTraces int64
+	// DuplicatesSkipped is the number of traces skipped for having the
+	// shape of an already kept one (for last flush)
+	DuplicatesSkipped int64
+	// ErrorSamplesKept is the number of traces kept for holding the sample
+	// of an error type of the stats (for last flush)
+	ErrorSamplesKept int64
 }
 
 type samplerInfo struct {
@@ -45,56 +106,314 @@ type SamplerEngine interface {
 
 // NewSampler creates a new empty sampler ready to be started
 func NewSampler(conf *config.AgentConfig) *Sampler {
+	engine := sampler.NewSampler(conf.ExtraSampleRate, conf.MaxTPS)
+	decisions, err := newDecisionLog(conf)
+	if err != nil {
+		log.Errorf("cannot write the sampling decisions to %s: %v", conf.DecisionLogDir, err)
+	}
 	return &Sampler{
-		sampledTraces: []model.Trace{},
-		traceCount:    0,
-		samplerEngine: sampler.NewSampler(conf.ExtraSampleRate, conf.MaxTPS),
+		sampledTraces:  []model.Trace{},
+		traceCount:     0,
+		priorityCounts: make(map[int]int64),
+		indexedKeys:    conf.IndexedKeys,
+		indexedMaxKeys: conf.IndexedMaxKeys,
+		uniformRate:    conf.UniformSampleRate,
+		maxBytes:       conf.MaxSamplerMemory,
+		shapes:         newSampledShapes(conf.DedupeWindowFlushes),
+		rates:          engine.RateByService,
+		chunks:         make(map[uint64]chunkDecision),
+		chunkTTL:       2 * conf.MaxTraceAssemblyDuration,
+		decisionLog:    decisions,
+		samplerEngine:  engine,
+		clock:          watch.Real,
 	}
 }
 
 // Run starts sampling traces
 func (s *Sampler) Run() {
+	s.decisionLog.Run()
 	go s.samplerEngine.Run()
 }
 
-// Add samples a trace then keep it until the next flush
+// Add samples a trace then keep it until the next flush. Traces with a
+// sampling priority given by the client are dropped or kept as asked, only
+// the ones with PriorityAutoKeep or no priority go through the sampler engine,
+// and are also kept when part of the uniform sample or when holding the
+// sample of an error type of the stats, see processedTrace.ErrorSample. The
+// chunks of a long-running trace get the decision taken for its first
+// chunk. With a dedupe window, the engine's traces without errors are skipped
+// when one of the same shape was kept during the window, see sampledShapes.
+// The agent's own traces are kept without counting in the sampler stats, and
+// flush markers are ignored, see model.ShouldAggregate.
 func (s *Sampler) Add(t processedTrace) {
+	if t.Root != nil && !model.ShouldAggregate(t.Root) {
+		if !t.Root.IsFlushMarker() {
+			s.mu.Lock()
+			s.keep(t.Trace)
+			s.mu.Unlock()
+		}
+		return
+	}
+
+	priority, hasPriority := 0, false
+	if t.Root != nil {
+		priority, hasPriority = t.Root.SamplingPriority()
+	}
+	seq, chunked := t.Trace.ChunkSeq()
+
 	s.mu.Lock()
 	s.traceCount++
-	if s.samplerEngine.Sample(t.Trace, t.Root, t.Env) {
-		s.sampledTraces = append(s.sampledTraces, t.Trace)
+	if hasPriority {
+		s.priorityCounts[priority]++
+	}
+
+	var keep bool
+	var mechanism string
+	var decision chunkDecision
+	var decided bool
+	if chunked {
+		decision, decided = s.chunks[t.Trace[0].TraceID]
+	}
+	switch {
+	case chunked && seq > 0 && decided:
+		keep, mechanism = decision.keep, decisionChunk
+	case hasPriority && priority <= model.PriorityAutoDrop:
+		// only used for stats
+		mechanism = decisionClientDrop
+	case hasPriority && priority >= model.PriorityUserKeep:
+		keep, mechanism = true, decisionUserKeep
+	case t.ErrorSample:
+		// its errors are the samples of the stats
+		keep, mechanism = true, decisionError
+		s.errorSamples++
+	default:
+		keep, mechanism = s.samplerEngine.Sample(t.Trace, t.Root, t.Env), decisionEngine
+		if keep && s.shapes != nil && t.Root != nil && !hasError(t.Trace) && s.shapes.repeated(t) {
+			keep, mechanism = false, decisionDuplicate
+			s.duplicates++
+		}
+		if !keep && s.uniformKeep(t.Trace) {
+			keep, mechanism = true, decisionUniform
+		}
+	}
+	if chunked {
+		s.chunks[t.Trace[0].TraceID] = chunkDecision{keep: keep, seen: s.clock.Now()}
+	}
+	if keep {
+		s.keep(t.Trace)
+	}
+	if s.decisionLog != nil {
+		s.decide(t, keep, mechanism)
 	}
 	s.mu.Unlock()
 }
 
+// decide records the decision taken for t for the decision log, right
+// after t was kept if keep is true. s.mu must be held.
+func (s *Sampler) decide(t processedTrace, keep bool, mechanism string) {
+	d := samplingDecision{
+		Env:       t.Env,
+		Error:     hasError(t.Trace),
+		Kept:      keep,
+		Mechanism: mechanism,
+		index:     len(s.sampledTraces) - 1,
+	}
+	if len(t.Trace) > 0 {
+		d.TraceID = t.Trace[0].TraceID
+	}
+	if t.Root != nil {
+		d.Service, d.Resource = t.Root.Service, t.Root.Resource
+		d.DurationBucket = durationBucket(t.Root.Duration)
+	}
+	s.decisions = append(s.decisions, d)
+}
+
+// clientDropped tells if the client decided to drop the trace of root, which
+// the sampler then never keeps
+func clientDropped(root *model.Span) bool {
+	priority, ok := root.SamplingPriority()
+	return ok && priority <= model.PriorityAutoDrop
+}
+
+// keep adds t to the sampled traces, then evicts the biggest ones, t
+// included, until they fit in the memory limit. s.mu must be held.
+func (s *Sampler) keep(t model.Trace) {
+	size := t.WeightedSize()
+	s.bytes += int64(size)
+	s.sampledTraces = append(s.sampledTraces, t)
+	if s.maxBytes <= 0 {
+		return
+	}
+
+	heap.Push(&s.sizes, sampledSize{index: len(s.sampledTraces) - 1, size: size})
+	for s.bytes > s.maxBytes && s.sizes.Len() > 0 {
+		evicted := heap.Pop(&s.sizes).(sampledSize)
+		s.sampledTraces[evicted.index] = nil
+		s.bytes -= int64(evicted.size)
+		s.evictedBytes += int64(evicted.size)
+		s.evictedTraces++
+	}
+}
+
+// sampledSize is the size of a sampled trace, by its index in sampledTraces
+type sampledSize struct {
+	index int
+	size  int
+}
+
+// sampledSizes is a heap of the sampled traces, biggest first
+type sampledSizes []sampledSize
+
+func (h sampledSizes) Len() int            { return len(h) }
+func (h sampledSizes) Less(i, j int) bool  { return h[i].size > h[j].size }
+func (h sampledSizes) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sampledSizes) Push(x interface{}) { *h = append(*h, x.(sampledSize)) }
+func (h *sampledSizes) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// uniformKeep tells if t is part of the uniform sample. The decision only
+// depends on the trace ID, so that all the agents, and the client tracers
+// sampling at the same rate, keep the same traces.
+func (s *Sampler) uniformKeep(t model.Trace) bool {
+	return s.uniformRate > 0 && len(t) > 0 && sampler.SampleByRate(t[0].TraceID, s.uniformRate)
+}
+
 // Stop stops the sampler
 func (s *Sampler) Stop() {
 	s.samplerEngine.Stop()
+	s.decisionLog.Stop()
 }
 
-// Flush returns representative spans based on GetSamples and reset its internal memory
+// Flush returns representative spans based on GetSamples and reset its internal memory.
+// The decisions taken since the last flush are queued to the decision log.
 func (s *Sampler) Flush() []model.Trace {
 	s.mu.Lock()
 
 	traces := s.sampledTraces
 	s.sampledTraces = []model.Trace{}
+	decisions := s.decisions
+	s.decisions = nil
+	var keptDecisions int
+	for i := range decisions {
+		d := &decisions[i]
+		if d.Kept && traces[d.index] == nil {
+			d.Kept, d.Evicted = false, true
+		}
+		if d.Kept {
+			keptDecisions++
+		}
+	}
+	if s.evictedTraces > 0 {
+		kept := traces[:0]
+		for _, t := range traces {
+			if t != nil {
+				kept = append(kept, t)
+			}
+		}
+		traces = kept
+	}
+	bytes, evictedBytes, evictedTraces := s.bytes, s.evictedBytes, s.evictedTraces
+	s.bytes, s.evictedBytes, s.evictedTraces = 0, 0, 0
+	s.sizes = s.sizes[:0]
 	traceCount := s.traceCount
 	s.traceCount = 0
+	priorityCounts := s.priorityCounts
+	s.priorityCounts = make(map[int]int64)
+	duplicates := s.duplicates
+	s.duplicates = 0
+	errorSamples := s.errorSamples
+	s.errorSamples = 0
+	if s.shapes != nil {
+		s.shapes.flushed()
+	}
 
-	now := time.Now()
+	now := s.clock.Now()
 	duration := now.Sub(s.lastFlush)
 	s.lastFlush = now
 
+	for id, d := range s.chunks {
+		if now.Sub(d.seen) > s.chunkTTL {
+			delete(s.chunks, id)
+		}
+	}
+
 	s.mu.Unlock()
 
-	state := s.samplerEngine.(*sampler.Sampler).GetState()
+	if s.decisionLog != nil {
+		s.decisionLog.Record(decisionFlush{
+			Flush:    now.UnixNano(),
+			Duration: duration.Seconds(),
+			Traces:   len(decisions),
+			Kept:     keptDecisions,
+		}, decisions)
+	}
+
+	// the traces of the uniform sample are tagged as such, whichever way
+	// they were kept
+	if s.uniformRate > 0 {
+		for _, t := range traces {
+			if !s.uniformKeep(t) {
+				continue
+			}
+			root := t.GetRoot()
+			if root.Meta == nil {
+				root.Meta = make(map[string]string)
+			}
+			root.Meta[model.TraceUniformKeepKey] = "true"
+		}
+	}
+
+	// only sampled spans carry index hints, stats are computed apart
+	if len(s.indexedKeys) > 0 {
+		for _, t := range traces {
+			for i := range t {
+				t[i].PromoteIndexed(s.indexedKeys, s.indexedMaxKeys)
+			}
+		}
+	}
+
+	var state sampler.InternalState
+	if engine, ok := s.samplerEngine.(*sampler.Sampler); ok {
+		state = engine.GetState()
+	}
 	var stats samplerStats
 	if duration > 0 {
 		stats.KeptTPS = float64(len(traces)) / duration.Seconds()
 		stats.TotalTPS = float64(traceCount) / duration.Seconds()
 	}
+	stats.KeptTraces = int64(len(traces))
+	stats.TotalTraces = int64(traceCount)
+	stats.MemoryBytes = bytes
+	stats.EvictedBytes = evictedBytes
+	stats.EvictedTraces = evictedTraces
+	stats.DuplicatesSkipped = duplicates
+	stats.ErrorSamplesKept = errorSamples
+	statsd.Client.Count("datadog.trace_agent.sampler.error_samples_kept", errorSamples, nil, 1)
+	if s.shapes != nil {
+		statsd.Client.Count("datadog.trace_agent.sampler.duplicates_skipped", duplicates, nil, 1)
+	}
+	statsd.Client.Gauge("datadog.trace_agent.sampler.memory", float64(bytes), nil, 1)
+	if evictedTraces > 0 {
+		statsd.Client.Count("datadog.trace_agent.sampler.evicted_bytes", evictedBytes, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.sampler.evicted_traces", evictedTraces, nil, 1)
+		log.Warnf("evicted %d sampled traces, %d bytes, to stay under the sampler memory limit of %d bytes",
+			evictedTraces, evictedBytes, s.maxBytes)
+	}
+	stats.PriorityTraces = make(map[string]int64, len(priorityCounts))
+	for priority, n := range priorityCounts {
+		tag := fmt.Sprintf("priority:%d", priority)
+		stats.PriorityTraces[tag] = n
+		statsd.Client.Count("datadog.trace_agent.sampler.priority_traces", n, []string{tag}, 1)
+	}
 
-	log.Debugf("flushed %d sampled traces out of %d", len(traces), traceCount)
+	config.WithFields(config.Fields{
+		"sampled": len(traces),
+		"total":   traceCount,
+	}).Debugf("flushed %d sampled traces out of %d", len(traces), traceCount)
 	log.Debugf("inTPS: %f, outTPS: %f, maxTPS: %f, offset: %f, slope: %f, cardinality: %d",
 		state.InTPS, state.OutTPS, state.MaxTPS, state.Offset, state.Slope, state.Cardinality)
 
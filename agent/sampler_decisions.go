@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// decisionQueueSize is the number of flushes waiting to be written to the
+// decision log, above which they are dropped from it
+const decisionQueueSize = 4
+
+// The mechanisms which kept or dropped a trace, see samplingDecision
+const (
+	decisionEngine     = "engine"      // the sampler engine, by signature score
+	decisionUniform    = "uniform"     // the uniform sample, dropped by the engine
+	decisionError      = "error"       // holding the sample of an error type, see processedTrace.ErrorSample
+	decisionUserKeep   = "user_keep"   // the sampling priority of the client
+	decisionClientDrop = "client_drop" // the sampling priority of the client
+	decisionChunk      = "chunk"       // the decision of the first chunk of a long-running trace
+	decisionDuplicate  = "duplicate"   // kept by the engine, but of the shape of a kept trace, see sampledShapes
+)
+
+// samplingDecision is a line of the decision log: the signature of a trace
+// given to the sampler and what it decided
+type samplingDecision struct {
+	TraceID        uint64 `json:"trace_id"`
+	Env            string `json:"env"`
+	Service        string `json:"service"`
+	Resource       string `json:"resource"`
+	DurationBucket byte   `json:"duration_bucket"` // of the root, as in sampledShapes, see durationBucket
+	Error          bool   `json:"error"`
+	Kept           bool   `json:"kept"`
+	Mechanism      string `json:"mechanism"`         // one of the decision* mechanisms
+	Evicted        bool   `json:"evicted,omitempty"` // kept, then evicted to stay under the sampler memory limit
+
+	index int // in Sampler.sampledTraces if kept
+}
+
+// decisionFlush is the line starting the decisions of a flush
+type decisionFlush struct {
+	Flush    int64   `json:"flush"`    // when, in nanoseconds since epoch
+	Duration float64 `json:"duration"` // since the previous flush, in seconds
+	Traces   int     `json:"traces"`   // the number of decisions following
+	Kept     int     `json:"kept"`     // the number of them kept, and not evicted
+}
+
+// decisionRecord holds the decisions of a flush
+type decisionRecord struct {
+	flush     decisionFlush
+	decisions []samplingDecision
+}
+
+// decisionLog writes the decisions of every flush of the sampler to an
+// NDJSON file, see config.AgentConfig.DecisionLogDir: a decisionFlush line
+// followed by a samplingDecision line per trace. Files are written by their
+// own goroutine from a bounded queue, so that the log never slows down the
+// sampler.
+type decisionLog struct {
+	files   *LocalEndpoint // writes and rotates the files
+	records chan decisionRecord
+	done    chan struct{}
+}
+
+// newDecisionLog returns a decisionLog writing to conf.DecisionLogDir, or
+// nil if it is disabled. A nil decisionLog records nothing.
+func newDecisionLog(conf *config.AgentConfig) (*decisionLog, error) {
+	if conf.DecisionLogDir == "" {
+		return nil, nil
+	}
+	files, err := NewLocalEndpoint(conf.DecisionLogDir, int(conf.DecisionLogMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return &decisionLog{
+		files:   files,
+		records: make(chan decisionRecord, decisionQueueSize),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Run writes the decisions recorded until Stop is called
+func (l *decisionLog) Run() {
+	if l == nil {
+		return
+	}
+	go func() {
+		defer close(l.done)
+		for r := range l.records {
+			l.write(r)
+		}
+	}()
+}
+
+// Stop writes the decisions still queued and returns. Record must not be
+// called afterwards.
+func (l *decisionLog) Stop() {
+	if l == nil {
+		return
+	}
+	close(l.records)
+	<-l.done
+}
+
+// Record queues the decisions of a flush to be written. It never blocks:
+// they are dropped when the queue is full.
+func (l *decisionLog) Record(flush decisionFlush, decisions []samplingDecision) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.records <- decisionRecord{flush: flush, decisions: decisions}:
+	default:
+		statsd.Client.Count("datadog.trace_agent.sampler.dropped_decision_logs", 1, nil, 1)
+	}
+}
+
+func (l *decisionLog) write(r decisionRecord) {
+	_, err := l.files.writeFile("decisions.ndjson", func(f io.Writer) (int64, error) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		if err := enc.Encode(r.flush); err != nil {
+			return 0, err
+		}
+		for _, d := range r.decisions {
+			if err := enc.Encode(d); err != nil {
+				return 0, err
+			}
+		}
+		n, err := f.Write(buf.Bytes())
+		return int64(n), err
+	})
+	if err != nil {
+		log.Errorf("cannot write the sampling decisions to %s: %v", l.files.dir, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// readDecisionLogs returns the flush lines and the decisions of the decision
+// log files in dir, oldest first
+func readDecisionLogs(t *testing.T, dir string) ([]decisionFlush, [][]samplingDecision) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flushes []decisionFlush
+	var decisions [][]samplingDecision
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), "-decisions.ndjson") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		var flush decisionFlush
+		var lines []samplingDecision
+		for scanner.Scan() {
+			if flush.Flush == 0 {
+				if err := json.Unmarshal(scanner.Bytes(), &flush); err != nil || flush.Flush == 0 {
+					t.Fatalf("%s does not start with a flush line: %s", fi.Name(), scanner.Text())
+				}
+				continue
+			}
+			var d samplingDecision
+			if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+				t.Fatalf("invalid decision in %s: %v", fi.Name(), err)
+			}
+			lines = append(lines, d)
+		}
+		f.Close()
+		flushes = append(flushes, flush)
+		decisions = append(decisions, lines)
+	}
+	return flushes, decisions
+}
+
+func TestSamplerDecisionLog(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-decisions")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DecisionLogDir = dir
+	conf.UniformSampleRate = 0.5
+	conf.MaxSamplerMemory = 6 << 10
+	s := NewSampler(conf)
+	s.samplerEngine = neverSampleEngine{}
+	s.Run()
+
+	// at 0.5, trace IDs 1 and 8 are in the uniform sample, 9 is not
+	s.Add(priorityTrace(1, 0, false))
+	s.Add(priorityTrace(9, 0, false))
+	s.Add(priorityTrace(2, model.PriorityAutoDrop, true))
+	s.Add(priorityTrace(4, model.PriorityUserKeep, true))
+	errorSample := priorityTrace(5, 0, false)
+	errorSample.Trace[0].Error = 1
+	errorSample.ErrorSample = true
+	s.Add(errorSample)
+	s.samplerEngine = alwaysSampleEngine{}
+	s.Add(sizedTrace(6, 0))
+	// too big for the memory limit
+	s.Add(sizedTrace(7, 7<<10))
+	kept := s.Flush()
+	s.Stop()
+
+	flushes, decisions := readDecisionLogs(t, dir)
+	if !assert.Len(flushes, 1) {
+		t.FailNow()
+	}
+	assert.Equal(7, flushes[0].Traces)
+	assert.Len(decisions[0], 7)
+
+	// reconciled with the traces kept
+	var keptIDs []uint64
+	for _, t := range kept {
+		keptIDs = append(keptIDs, t[0].TraceID)
+	}
+	var decidedIDs []uint64
+	mechanisms := make(map[uint64]string)
+	for _, d := range decisions[0] {
+		mechanisms[d.TraceID] = d.Mechanism
+		if d.Kept {
+			decidedIDs = append(decidedIDs, d.TraceID)
+		}
+	}
+	assert.Equal(keptIDs, decidedIDs)
+	assert.Equal(len(kept), flushes[0].Kept)
+	assert.Equal(map[uint64]string{
+		1: decisionUniform,
+		9: decisionEngine,
+		2: decisionClientDrop,
+		4: decisionUserKeep,
+		5: decisionError,
+		6: decisionEngine,
+		7: decisionEngine,
+	}, mechanisms)
+
+	// with the signature of the traces
+	d := decisions[0][4]
+	assert.Equal(samplingDecision{TraceID: 5, Service: "mcnulty", Resource: "GET /", DurationBucket: durationBucket(100),
+		Error: true, Kept: true, Mechanism: decisionError}, d)
+	evicted := decisions[0][6]
+	assert.False(evicted.Kept)
+	assert.True(evicted.Evicted)
+}
+
+func TestDecisionLogDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSampler(config.NewDefaultAgentConfig())
+	assert.Nil(s.decisionLog)
+	s.samplerEngine = alwaysSampleEngine{}
+	s.Add(priorityTrace(1, 0, false))
+	assert.Len(s.Flush(), 1)
+	assert.Len(s.decisions, 0)
+}
+
+func TestDecisionLogQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-decisions")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DecisionLogDir = dir
+	l, err := newDecisionLog(conf)
+	assert.Nil(err)
+
+	// not running, the flushes past the queue are dropped without blocking
+	for i := 0; i < decisionQueueSize+2; i++ {
+		l.Record(decisionFlush{Flush: int64(i + 1)}, nil)
+	}
+	l.Run()
+	l.Stop()
+	flushes, _ := readDecisionLogs(t, dir)
+	assert.Len(flushes, decisionQueueSize)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// sampledShapes remembers the shapes of the traces kept by the sampler
+// engine during the last flushes, see Sampler.Add. Shapes are held in a pair
+// of Bloom filters: the current one gets the new shapes and replaces the
+// previous one every window flushes, so that a shape is remembered between
+// window and 2*window flushes. A false positive skips a trace of a new shape.
+type sampledShapes struct {
+	window  int // in flushes
+	flushes int // since the last rotation
+
+	current, previous *bloomFilter
+}
+
+const (
+	// shapesCapacity is the number of shapes expected in between two
+	// rotations, and shapesFalsePositives the rate of false positives at
+	// this capacity: 2 filters of ~12KB
+	shapesCapacity       = 10000
+	shapesFalsePositives = 0.01
+)
+
+// newSampledShapes returns the shapes of the traces kept during the last
+// window flushes, or nil if window is not positive
+func newSampledShapes(window int) *sampledShapes {
+	if window <= 0 {
+		return nil
+	}
+	return &sampledShapes{
+		window:   window,
+		current:  newBloomFilter(shapesCapacity, shapesFalsePositives),
+		previous: newBloomFilter(shapesCapacity, shapesFalsePositives),
+	}
+}
+
+// repeated tells if a trace of the same shape as t was already kept during
+// the window, and otherwise remembers the shape of t
+func (s *sampledShapes) repeated(t processedTrace) bool {
+	h := traceShape(t)
+	if s.current.has(h) || s.previous.has(h) {
+		return true
+	}
+	s.current.add(h)
+	return false
+}
+
+// flushed counts a flush of the sampler and rotates the filters at the end of
+// the window
+func (s *sampledShapes) flushed() {
+	s.flushes++
+	if s.flushes < s.window {
+		return
+	}
+	s.flushes = 0
+	s.current, s.previous = s.previous, s.current
+	s.current.reset()
+}
+
+// traceShape is the hash of what makes 2 traces look alike: the env, the
+// service and resource of their root, and their duration within a power of 2
+func traceShape(t processedTrace) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(t.Env))
+	h.Write([]byte{0})
+	h.Write([]byte(t.Root.Service))
+	h.Write([]byte{0})
+	h.Write([]byte(t.Root.Resource))
+	h.Write([]byte{0, durationBucket(t.Root.Duration)})
+	return h.Sum64()
+}
+
+// durationBucket returns the number of bits of d, so that durations of the
+// same order of magnitude share a bucket
+func durationBucket(d int64) byte {
+	var n byte
+	for ; d > 0; d >>= 1 {
+		n++
+	}
+	return n
+}
+
+// hasError tells if any span of t is an error
+func hasError(t model.Trace) bool {
+	for i := range t {
+		if t[i].Error != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bloomFilter is a set of hashes which may tell that a hash it does not hold
+// is in it, but never the opposite
+type bloomFilter struct {
+	bits   []uint64
+	hashes int // number of bits set per hash
+}
+
+// newBloomFilter returns a filter sized to hold n hashes with a rate of false
+// positives of p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Ceil(m / float64(n) * math.Ln2))
+	return &bloomFilter{bits: make([]uint64, int(m+63)/64), hashes: k}
+}
+
+// bit returns the position of the i-th bit of h in the filter, derived from
+// the 2 halves of h by double hashing
+func (f *bloomFilter) bit(h uint64, i int) uint64 {
+	h1, h2 := h&0xffffffff, h>>32|1
+	return (h1 + uint64(i)*h2) % uint64(len(f.bits)*64)
+}
+
+func (f *bloomFilter) add(h uint64) {
+	for i := 0; i < f.hashes; i++ {
+		b := f.bit(h, i)
+		f.bits[b/64] |= 1 << (b % 64)
+	}
+}
+
+func (f *bloomFilter) has(h uint64) bool {
+	for i := 0; i < f.hashes; i++ {
+		b := f.bit(h, i)
+		if f.bits[b/64]&(1<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
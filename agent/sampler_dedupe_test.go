@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// shapedTrace returns a trace with a root of the given resource and duration
+func shapedTrace(traceID uint64, resource string, duration int64) processedTrace {
+	trace := model.Trace{{TraceID: traceID, SpanID: 1, Service: "mcnulty", Name: "query", Resource: resource, Duration: duration}}
+	return processedTrace{Trace: trace, Root: &trace[0], Env: "prod"}
+}
+
+// sampledResources returns the number of traces flushed by s, by resource
+func sampledResources(s *Sampler) map[string]int {
+	resources := make(map[string]int)
+	for _, t := range s.Flush() {
+		resources[t[0].Resource]++
+	}
+	return resources
+}
+
+func TestSamplerDedupe(t *testing.T) {
+	assert := assert.New(t)
+
+	// a flood of identical traces next to a few rare ones
+	add := func(s *Sampler) {
+		id := uint64(1)
+		for i := 0; i < 100; i++ {
+			s.Add(shapedTrace(id, "GET /health", 1000))
+			id++
+			if i%25 == 0 {
+				s.Add(shapedTrace(id, fmt.Sprintf("GET /rare/%d", i), 1000))
+				id++
+			}
+		}
+	}
+
+	conf := config.NewDefaultAgentConfig()
+	s := NewSampler(conf)
+	s.samplerEngine = alwaysSampleEngine{}
+	add(s)
+	assert.Equal(100, sampledResources(s)["GET /health"])
+
+	conf.DedupeWindowFlushes = 3
+	s = NewSampler(conf)
+	s.samplerEngine = alwaysSampleEngine{}
+	add(s)
+	resources := sampledResources(s)
+	assert.Len(resources, 5)
+	for _, n := range resources {
+		assert.Equal(1, n)
+	}
+	// the count of skipped duplicates is reset at each flush
+	assert.Equal(int64(0), s.duplicates)
+}
+
+func TestSamplerDedupeShapes(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DedupeWindowFlushes = 1
+	s := NewSampler(conf)
+	s.samplerEngine = alwaysSampleEngine{}
+
+	s.Add(shapedTrace(1, "GET /", 1000))
+	// same duration bucket
+	s.Add(shapedTrace(2, "GET /", 1023))
+	assert.Equal(int64(1), s.duplicates)
+	// slower, another env, or errors are kept
+	s.Add(shapedTrace(3, "GET /", 2048))
+	other := shapedTrace(4, "GET /", 1000)
+	other.Env = "staging"
+	s.Add(other)
+	failed := shapedTrace(5, "GET /", 1000)
+	failed.Trace[0].Error = 1
+	s.Add(failed)
+	// the client decision wins
+	kept := shapedTrace(6, "GET /", 1000)
+	kept.Root.Metrics = map[string]float64{model.SamplingPriorityKey: model.PriorityUserKeep}
+	s.Add(kept)
+	assert.Equal(int64(1), s.duplicates)
+	assert.Len(s.Flush(), 5)
+}
+
+func TestSamplerDedupeWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DedupeWindowFlushes = 2
+	s := NewSampler(conf)
+	s.samplerEngine = alwaysSampleEngine{}
+
+	// a shape is remembered for at least the window, at most twice as much
+	var flushed []int
+	for i := 0; i < 6; i++ {
+		s.Add(shapedTrace(uint64(i), "GET /", 1000))
+		flushed = append(flushed, len(s.Flush()))
+	}
+	assert.Equal([]int{1, 0, 0, 0, 1, 0}, flushed)
+}
+
+func TestBloomFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newBloomFilter(shapesCapacity, shapesFalsePositives)
+	for i := 0; i < shapesCapacity; i++ {
+		f.add(traceShape(shapedTrace(0, fmt.Sprintf("GET /%d", i), 1000)))
+	}
+	var falsePositives int
+	for i := 0; i < shapesCapacity; i++ {
+		assert.True(f.has(traceShape(shapedTrace(0, fmt.Sprintf("GET /%d", i), 1000))))
+		if f.has(traceShape(shapedTrace(0, fmt.Sprintf("POST /%d", i), 1000))) {
+			falsePositives++
+		}
+	}
+	assert.InDelta(shapesFalsePositives, float64(falsePositives)/shapesCapacity, shapesFalsePositives)
+
+	f.reset()
+	assert.False(f.has(traceShape(shapedTrace(0, "GET /0", 1000))))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// neverSampleEngine is a SamplerEngine dropping all the traces
+type neverSampleEngine struct{}
+
+func (e neverSampleEngine) Run()  {}
+func (e neverSampleEngine) Stop() {}
+func (e neverSampleEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	return false
+}
+
+func priorityTrace(traceID uint64, priority int, hasPriority bool) processedTrace {
+	root := model.Span{TraceID: traceID, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /", Duration: 100}
+	if hasPriority {
+		root.Metrics = map[string]float64{model.SamplingPriorityKey: float64(priority)}
+	}
+	trace := model.Trace{root}
+	return processedTrace{Trace: trace, Root: &trace[0]}
+}
+
+func TestSamplerPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		engine SamplerEngine
+		kept   []uint64
+	}{
+		// user-keep is kept even when the engine drops everything
+		{neverSampleEngine{}, []uint64{4}},
+		// drop priorities are never kept, even when the engine keeps everything
+		{alwaysSampleEngine{}, []uint64{3, 4, 5}},
+	} {
+		s := NewSampler(config.NewDefaultAgentConfig())
+		s.samplerEngine = tc.engine
+
+		s.Add(priorityTrace(1, model.PriorityUserDrop, true))
+		s.Add(priorityTrace(2, model.PriorityAutoDrop, true))
+		s.Add(priorityTrace(3, model.PriorityAutoKeep, true))
+		s.Add(priorityTrace(4, model.PriorityUserKeep, true))
+		s.Add(priorityTrace(5, 0, false))
+
+		var kept []uint64
+		for _, t := range s.Flush() {
+			kept = append(kept, t[0].TraceID)
+		}
+		assert.Equal(tc.kept, kept)
+
+		stats := publishSamplerInfo().(samplerInfo).Stats
+		assert.Equal(map[string]int64{
+			"priority:-1": 1,
+			"priority:0":  1,
+			"priority:1":  1,
+			"priority:2":  1,
+		}, stats.PriorityTraces)
+	}
+}
+
+func TestSamplerSynthetic(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSampler(config.NewDefaultAgentConfig())
+	s.samplerEngine = neverSampleEngine{}
+
+	marker := model.NewTraceFlushMarker()
+	s.Add(processedTrace{Trace: marker, Root: &marker[0]})
+	self := newFlushTrace(time.Now()).finish()
+	s.Add(processedTrace{Trace: self, Root: &self[0]})
+	s.Add(priorityTrace(1, model.PriorityUserKeep, true))
+	assert.Equal(1, s.traceCount)
+	assert.Equal(map[int]int64{model.PriorityUserKeep: 1}, s.priorityCounts)
+
+	// the trace of the flush is kept, not the marker
+	var kept []uint64
+	for _, t := range s.Flush() {
+		kept = append(kept, t[0].TraceID)
+	}
+	assert.Equal([]uint64{self[0].TraceID, 1}, kept)
+}
+
+func TestSamplerUniform(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.UniformSampleRate = 0.5
+	s := NewSampler(conf)
+	s.samplerEngine = neverSampleEngine{}
+
+	// at 0.5, trace IDs 1 and 8 are in the uniform sample, 9 and 42 are not
+	s.Add(priorityTrace(1, 0, false))
+	s.Add(priorityTrace(9, 0, false))
+	s.Add(priorityTrace(8, model.PriorityAutoKeep, true))
+	s.Add(priorityTrace(42, model.PriorityUserKeep, true))
+	// client decisions to drop still win
+	s.Add(priorityTrace(1, model.PriorityAutoDrop, true))
+	s.samplerEngine = alwaysSampleEngine{}
+	s.Add(priorityTrace(9, 0, false))
+
+	var kept []uint64
+	uniform := make(map[uint64]bool)
+	for _, t := range s.Flush() {
+		kept = append(kept, t[0].TraceID)
+		if t[0].Meta[model.TraceUniformKeepKey] == "true" {
+			uniform[t[0].TraceID] = true
+		}
+	}
+	assert.Equal([]uint64{1, 8, 42, 9}, kept)
+	assert.Equal(map[uint64]bool{1: true, 8: true}, uniform)
+}
+
+func TestSamplerErrorSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSampler(config.NewDefaultAgentConfig())
+	s.samplerEngine = neverSampleEngine{}
+
+	sample := priorityTrace(1, 0, false)
+	sample.ErrorSample = true
+	s.Add(sample)
+	s.Add(priorityTrace(2, 0, false))
+	// within the client decisions
+	dropped := priorityTrace(3, model.PriorityAutoDrop, true)
+	dropped.ErrorSample = true
+	s.Add(dropped)
+	assert.False(clientDropped(priorityTrace(4, model.PriorityAutoKeep, true).Root))
+	assert.True(clientDropped(dropped.Root))
+
+	var kept []uint64
+	for _, t := range s.Flush() {
+		kept = append(kept, t[0].TraceID)
+	}
+	assert.Equal([]uint64{1}, kept)
+	assert.Equal(int64(1), publishSamplerInfo().(samplerInfo).Stats.ErrorSamplesKept)
+}
+
+func TestSpanSamplingPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	p, ok := priorityTrace(1, model.PriorityUserKeep, true).Root.SamplingPriority()
+	assert.True(ok)
+	assert.Equal(model.PriorityUserKeep, p)
+
+	_, ok = priorityTrace(1, 0, false).Root.SamplingPriority()
+	assert.False(ok)
+}
+
+func TestSamplerLongRunningChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	chunk := func(traceID uint64, seq string) processedTrace {
+		pt := priorityTrace(traceID, 0, false)
+		pt.Root.Meta = map[string]string{model.TraceLongRunningKey: "true", model.TraceChunkSeqKey: seq}
+		return pt
+	}
+
+	s := NewSampler(config.NewDefaultAgentConfig())
+	s.samplerEngine = alwaysSampleEngine{}
+	s.Add(chunk(1, "0"))
+	s.samplerEngine = neverSampleEngine{}
+	s.Add(chunk(2, "0"))
+
+	// the next chunks follow the decision of the first one
+	s.Add(chunk(1, "1"))
+	s.Add(chunk(2, "1"))
+	s.samplerEngine = alwaysSampleEngine{}
+	s.Add(chunk(2, "2"))
+	s.Add(chunk(1, "2"))
+
+	var kept []uint64
+	for _, t := range s.Flush() {
+		seq, ok := t.ChunkSeq()
+		assert.True(ok)
+		kept = append(kept, t[0].TraceID*10+uint64(seq))
+	}
+	assert.Equal([]uint64{10, 11, 12}, kept)
+
+	// decisions are forgotten when no chunk comes
+	s.chunkTTL = 0
+	s.Flush()
+	assert.Len(s.chunks, 0)
+}
+
+// sizedTrace returns a trace of 2 spans, the root one holding size bytes of meta
+func sizedTrace(traceID uint64, size int) processedTrace {
+	trace := model.Trace{
+		{TraceID: traceID, SpanID: 1, Service: "mcnulty", Name: "query", Resource: "GET /", Duration: 100,
+			Meta: map[string]string{"sql.query": strings.Repeat("x", size)}},
+		{TraceID: traceID, SpanID: 2, ParentID: 1, Service: "mcnulty", Name: "render", Resource: "GET /", Duration: 20},
+	}
+	return processedTrace{Trace: trace, Root: &trace[0]}
+}
+
+func TestSamplerMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.MaxSamplerMemory = 13 << 10
+	s := NewSampler(conf)
+	s.samplerEngine = alwaysSampleEngine{}
+
+	s.Add(sizedTrace(1, 5<<10))
+	s.Add(sizedTrace(2, 0))
+	s.Add(sizedTrace(3, 6<<10))
+	// over the limit, the biggest traces go first, even the new ones
+	s.Add(sizedTrace(4, 7<<10))
+	s.Add(sizedTrace(5, 0))
+	s.Add(sizedTrace(6, 4<<10))
+	assert.True(s.bytes <= conf.MaxSamplerMemory)
+
+	traces := s.Flush()
+	var kept []uint64
+	var keptSize, encodedSize int
+	for _, t := range traces {
+		kept = append(kept, t[0].TraceID)
+		keptSize += t.WeightedSize()
+		b, err := json.Marshal(t)
+		assert.Nil(err)
+		encodedSize += len(b)
+	}
+	assert.Equal([]uint64{1, 2, 5, 6}, kept)
+
+	stats := publishSamplerInfo().(samplerInfo).Stats
+	assert.Equal(int64(2), stats.EvictedTraces)
+	assert.Equal(int64(sizedTrace(3, 6<<10).Trace.WeightedSize()+sizedTrace(4, 7<<10).Trace.WeightedSize()), stats.EvictedBytes)
+	assert.Equal(int64(keptSize), stats.MemoryBytes)
+	assert.InEpsilon(float64(encodedSize), float64(stats.MemoryBytes), 0.1)
+
+	// counters are reset by the flush
+	s.Add(sizedTrace(7, 0))
+	assert.Len(s.Flush(), 1)
+	stats = publishSamplerInfo().(samplerInfo).Stats
+	assert.Equal(int64(0), stats.EvictedTraces)
+	assert.Equal(int64(sizedTrace(7, 0).Trace.WeightedSize()), stats.MemoryBytes)
+}
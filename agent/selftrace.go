@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// selfTraceService is the service of the traces the agent makes of its own
+// flushes, see config.AgentConfig.SelfTracing
+const selfTraceService = "trace-agent"
+
+// flushTrace is the trace of one flush of the agent, from the stats and the
+// sampled traces it takes to the writing of its payloads. Its stages are
+// added by the agent and the writer goroutines working on the flush.
+type flushTrace struct {
+	mu      sync.Mutex
+	root    model.Span
+	stages  []model.Span
+	pending int // payloads of the flush still to be written
+}
+
+// newFlushTrace returns the trace of a flush started at start
+func newFlushTrace(start time.Time) *flushTrace {
+	root := model.NewSpan(model.RandomID(), 0, selfTraceService, "flush", start, 0)
+	// the agent's own traces are not sampled out
+	root.Metrics[model.SamplingPriorityKey] = model.PriorityUserKeep
+	// nor counted in the stats
+	root.SetSynthetic()
+	return &flushTrace{root: root}
+}
+
+// stage records a stage of the flush started at start and ending now. It
+// does nothing on a nil flushTrace, i.e. when self tracing is disabled.
+func (ft *flushTrace) stage(name string, start time.Time, metrics map[string]float64) {
+	ft.addStage(name, start, time.Since(start), metrics)
+}
+
+// addStage records a stage of the flush started at start and lasting d
+func (ft *flushTrace) addStage(name string, start time.Time, d time.Duration, metrics map[string]float64) {
+	if ft == nil {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	span := ft.root.NewChild(name, start, d)
+	span.SetSynthetic()
+	for k, v := range metrics {
+		span.Metrics[k] = v
+	}
+	ft.stages = append(ft.stages, span)
+}
+
+// expect sets the number of payloads of the flush, written by the writer
+func (ft *flushTrace) expect(payloads int) {
+	if ft == nil {
+		return
+	}
+	ft.mu.Lock()
+	ft.pending = payloads
+	ft.mu.Unlock()
+}
+
+// written tells that a payload of the flush was written, returning true if
+// it was the last one and the trace is complete
+func (ft *flushTrace) written() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.pending--
+	return ft.pending == 0
+}
+
+// finish returns the trace of the flush, its root span lasting until the end
+// of its last stage
+func (ft *flushTrace) finish() model.Trace {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	// spans without duration are discarded by the API
+	trace := make(model.Trace, 1, len(ft.stages)+1)
+	trace[0] = ft.root
+	root := &trace[0]
+	if root.Duration <= 0 {
+		root.Duration = 1
+	}
+	for _, s := range ft.stages {
+		if s.Duration <= 0 {
+			s.Duration = 1
+		}
+		if s.End() > root.End() {
+			root.Duration = s.End() - root.Start
+		}
+		trace = append(trace, s)
+	}
+	return trace
+}
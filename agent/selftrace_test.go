@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Now()
+	ft := newFlushTrace(start)
+	ft.addStage("concentrate", start, time.Millisecond, map[string]float64{"stats_buckets": 2})
+	ft.addStage("send", start.Add(time.Millisecond), 0, nil)
+	ft.expect(2)
+	assert.False(ft.written())
+	assert.True(ft.written())
+
+	trace := ft.finish()
+	if assert.Len(trace, 3) {
+		root := trace[0]
+		assert.Equal(selfTraceService, root.Service)
+		assert.Equal("flush", root.Name)
+		assert.Equal(int64(time.Millisecond+1), root.Duration)
+		p, ok := root.SamplingPriority()
+		assert.True(ok)
+		assert.Equal(model.PriorityUserKeep, p)
+		for _, s := range trace {
+			assert.True(s.IsSynthetic())
+		}
+
+		assert.Equal(root.SpanID, trace[1].ParentID)
+		assert.Equal(float64(2), trace[1].Metrics["stats_buckets"])
+		assert.Equal(int64(1), trace[2].Duration)
+	}
+
+	// a nil trace records nothing
+	var nilTrace *flushTrace
+	nilTrace.stage("sample", start, nil)
+	nilTrace.expect(1)
+}
+
+func TestSelfTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 10)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.SelfTracing = true
+	agent := NewAgent(conf)
+	agent.Writer.Run()
+	defer agent.Writer.Stop()
+
+	agent.Sampler.Add(priorityTrace(42, model.PriorityUserKeep, true))
+	agent.flush()
+
+	var self model.Trace
+	select {
+	case self = <-agent.Writer.selfTraces:
+	case <-time.After(time.Second):
+		t.Fatal("the flush was not traced")
+	}
+
+	stages := make(map[string]model.Span)
+	for _, s := range self[1:] {
+		assert.Equal(self[0].SpanID, s.ParentID)
+		assert.Equal(selfTraceService, s.Service)
+		assert.True(s.Start >= self[0].Start && s.End() <= self[0].End(), "%s not within its flush", s.Name)
+		stages[s.Name] = s
+	}
+	assert.Equal("flush", self[0].Name)
+	for _, name := range []string{"concentrate", "sample", "encode", "send"} {
+		assert.Contains(stages, name)
+	}
+	assert.Equal(float64(1), stages["sample"].Metrics["traces"])
+	assert.Equal(float64(1), stages["send"].Metrics["traces"])
+	assert.True(stages["send"].Metrics["payload_size"] > 0)
+	assert.Equal(stages["send"].Metrics["payload_size"], stages["encode"].Metrics["payload_size"])
+	<-data
+
+	// the trace of a flush is sent with the next one
+	agent.filter = newTraceFilter(&config.AgentConfig{
+		FilterReject: []config.TagRule{{Key: "env", Pattern: "*"}},
+	})
+	self[0].Meta["env"] = "filtered"
+	agent.process(self, self.GetRoot())
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		agent.Sampler.mu.Lock()
+		n := len(agent.Sampler.sampledTraces)
+		agent.Sampler.mu.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+	agent.flush()
+
+	select {
+	case received := <-data:
+		gz, err := gzip.NewReader(strings.NewReader(received.body))
+		assert.Nil(err)
+		var payload model.AgentPayload
+		assert.Nil(json.NewDecoder(gz).Decode(&payload))
+		if assert.Len(payload.Traces, 1) {
+			assert.Equal(self[0].TraceID, payload.Traces[0][0].TraceID)
+			assert.Len(payload.Traces[0], len(self))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the trace of the flush was not sent")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// streamBufferSize is the number of traces a stream subscriber can lag
+// behind before traces are dropped for it
+const streamBufferSize = 100
+
+// streamSubscriber receives the traces published to a traceBroadcast
+type streamSubscriber struct {
+	traces  chan model.Trace
+	service string // only the traces with a span of this service are sent, all if empty
+	dropped int64  // traces dropped because the subscriber was too slow
+}
+
+// matches tells if the subscriber wants t
+func (s *streamSubscriber) matches(t model.Trace) bool {
+	if s.service == "" {
+		return true
+	}
+	for i := range t {
+		if t[i].Service == s.service {
+			return true
+		}
+	}
+	return false
+}
+
+// traceBroadcast sends the traces selected by the sampler to the clients of
+// /debug/stream. Publishing never blocks: traces are dropped for the
+// subscribers which do not keep up, the pipeline is never slowed down.
+type traceBroadcast struct {
+	max int // maximum number of subscribers, 0 to disable streaming
+
+	mu          sync.RWMutex
+	subscribers map[*streamSubscriber]struct{}
+}
+
+func newTraceBroadcast(max int) *traceBroadcast {
+	return &traceBroadcast{max: max, subscribers: make(map[*streamSubscriber]struct{})}
+}
+
+// subscribe returns a new subscriber to the traces of service, all of them
+// if empty, or false if there are already too many subscribers
+func (b *traceBroadcast) subscribe(service string) (*streamSubscriber, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subscribers) >= b.max {
+		return nil, false
+	}
+	s := &streamSubscriber{traces: make(chan model.Trace, streamBufferSize), service: service}
+	b.subscribers[s] = struct{}{}
+	return s, true
+}
+
+func (b *traceBroadcast) unsubscribe(s *streamSubscriber) {
+	b.mu.Lock()
+	delete(b.subscribers, s)
+	b.mu.Unlock()
+}
+
+// publish sends the traces to the subscribers which want them
+func (b *traceBroadcast) publish(traces []model.Trace) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subscribers {
+		for _, t := range traces {
+			if !s.matches(t) {
+				continue
+			}
+			select {
+			case s.traces <- t:
+			default:
+				atomic.AddInt64(&s.dropped, 1)
+			}
+		}
+	}
+}
+
+// handleStream streams the sampled traces as newline-delimited JSON until
+// the client goes away or, with the limit parameter, after that many traces.
+// The service parameter only streams the traces with a span of that service.
+func (r *HTTPReceiver) handleStream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.streams.max <= 0 {
+		http.Error(w, "streaming is disabled", http.StatusNotFound)
+		return
+	}
+
+	limit := 0
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	sub, ok := r.streams.subscribe(req.URL.Query().Get("service"))
+	if !ok {
+		http.Error(w, "too many streams", http.StatusTooManyRequests)
+		return
+	}
+	defer func() {
+		r.streams.unsubscribe(sub)
+		if n := atomic.LoadInt64(&sub.dropped); n > 0 {
+			log.Debugf("trace stream dropped %d traces, the client was too slow", n)
+		}
+	}()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	enc := json.NewEncoder(w)
+	for sent := 0; limit == 0 || sent < limit; sent++ {
+		select {
+		case t := <-sub.traces:
+			if err := enc.Encode(t); err != nil {
+				log.Debugf("closing trace stream: %v", err)
+				return
+			}
+			flush()
+		case <-closed:
+			return
+		case <-r.exit:
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitSubscribers waits for the broadcast to have n subscribers
+func waitSubscribers(t *testing.T, b *traceBroadcast, n int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		b.mu.RLock()
+		l := len(b.subscribers)
+		b.mu.RUnlock()
+		if l == n {
+			return
+		}
+	}
+	t.Fatalf("expected %d stream subscribers", n)
+}
+
+func streamTrace(traceID uint64, services ...string) model.Trace {
+	var t model.Trace
+	for i, service := range services {
+		t = append(t, model.Span{TraceID: traceID, SpanID: uint64(i + 1), ParentID: uint64(i), Service: service, Name: "query"})
+	}
+	return t
+}
+
+func TestReceiverStream(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DebugMaxStreams = 1
+	receiver := NewHTTPReceiver(conf)
+	server := httptest.NewServer(http.HandlerFunc(receiver.handleStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/stream?service=web&limit=2")
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+	waitSubscribers(t, receiver.streams, 1)
+
+	// a single stream is allowed
+	resp2, err := http.Get(server.URL + "/debug/stream")
+	assert.Nil(err)
+	resp2.Body.Close()
+	assert.Equal(http.StatusTooManyRequests, resp2.StatusCode)
+
+	receiver.streams.publish([]model.Trace{
+		streamTrace(1, "db"),
+		streamTrace(2, "web", "db"),
+		streamTrace(3, "auth", "web"),
+		streamTrace(4, "web"),
+	})
+
+	var traceIDs []uint64
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var trace model.Trace
+		assert.Nil(json.Unmarshal(scanner.Bytes(), &trace))
+		traceIDs = append(traceIDs, trace[0].TraceID)
+	}
+	assert.Nil(scanner.Err())
+	// the stream ends after the limit
+	assert.Equal([]uint64{2, 3}, traceIDs)
+	waitSubscribers(t, receiver.streams, 0)
+
+	resp, err = http.Get(server.URL + "/debug/stream?limit=-1")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestReceiverStreamClientClose(t *testing.T) {
+	conf := config.NewDefaultAgentConfig()
+	receiver := NewHTTPReceiver(conf)
+	server := httptest.NewServer(http.HandlerFunc(receiver.handleStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/stream")
+	assert.Nil(t, err)
+	waitSubscribers(t, receiver.streams, 1)
+	resp.Body.Close()
+	waitSubscribers(t, receiver.streams, 0)
+}
+
+func TestTraceBroadcastSlowSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newTraceBroadcast(1)
+	sub, ok := b.subscribe("")
+	assert.True(ok)
+
+	traces := make([]model.Trace, 2*streamBufferSize)
+	for i := range traces {
+		traces[i] = streamTrace(uint64(i), "web")
+	}
+	// publishing does not wait for the subscriber
+	b.publish(traces)
+	assert.Len(sub.traces, streamBufferSize)
+	assert.Equal(int64(streamBufferSize), sub.dropped)
+
+	b.unsubscribe(sub)
+	b.publish(traces)
+	assert.Len(sub.traces, streamBufferSize)
+}
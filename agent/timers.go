@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+const (
+	// timerBufferSize is the size of the datagrams read, as the dogstatsd
+	// buffer, longer ones being truncated
+	timerBufferSize = 8192
+	// timerQueueSize is the number of datagrams waiting to be parsed, above
+	// which they are dropped
+	timerQueueSize = 256
+)
+
+// timerStats are the counters of a TimerListener, reset when reported
+type timerStats struct {
+	Datagrams   int64
+	Dropped     int64 // datagrams, the queue being full
+	Metrics     int64 // timing metrics added to the stats
+	Ignored     int64 // metrics of other types
+	ParseErrors int64
+	NoService   int64 // timing metrics without the service tag
+	OverKeys    int64 // dropped, over config.AgentConfig.TimersMaxKeys
+}
+
+// timerKey is what distinguishes the spans of the timing metrics in the stats
+type timerKey struct {
+	service, resource, name, env string
+}
+
+// TimerListener receives statsd timing metrics over UDP and adds their
+// values to the stats of the concentrator as the durations of spans, no trace
+// being sent or sampled, see config.AgentConfig.TimersPort. Datagrams are read
+// into pooled buffers, then parsed by their own goroutine.
+type TimerListener struct {
+	conf         *config.AgentConfig
+	concentrator *Concentrator
+
+	conn       *net.UDPConn
+	buffers    sync.Pool
+	datagrams  chan []byte
+	stats      timerStats
+	spanID     uint64
+	keys       map[timerKey]struct{} // of the spans added, up to conf.TimersMaxKeys
+	exit, done chan struct{}
+}
+
+// NewTimerListener returns a TimerListener adding the timing metrics to c
+func NewTimerListener(conf *config.AgentConfig, c *Concentrator) *TimerListener {
+	return &TimerListener{
+		conf:         conf,
+		concentrator: c,
+		buffers:      sync.Pool{New: func() interface{} { return make([]byte, timerBufferSize) }},
+		datagrams:    make(chan []byte, timerQueueSize),
+		keys:         make(map[timerKey]struct{}),
+		exit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Listen opens the UDP socket on addr
+func (l *TimerListener) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %v", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %v", addr, err)
+	}
+	l.conn = conn
+	log.Infof("listening for statsd timing metrics at udp://%s", conn.LocalAddr())
+	return nil
+}
+
+// Run reads and parses the datagrams until Stop is called. Listen must have
+// succeeded.
+func (l *TimerListener) Run() {
+	go l.read()
+	go l.parse()
+	go l.logStats()
+}
+
+// Stop closes the socket and waits for the datagrams read to be parsed
+func (l *TimerListener) Stop() {
+	close(l.exit)
+	l.conn.Close()
+	<-l.done
+}
+
+func (l *TimerListener) read() {
+	defer close(l.datagrams)
+	for {
+		buf := l.buffers.Get().([]byte)
+		n, err := l.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-l.exit:
+				return
+			default:
+			}
+			log.Errorf("cannot read statsd timing metrics: %v", err)
+			continue
+		}
+		atomic.AddInt64(&l.stats.Datagrams, 1)
+		select {
+		case l.datagrams <- buf[:n]:
+		default:
+			atomic.AddInt64(&l.stats.Dropped, 1)
+			l.buffers.Put(buf)
+		}
+	}
+}
+
+func (l *TimerListener) parse() {
+	defer close(l.done)
+	for buf := range l.datagrams {
+		l.handleDatagram(buf)
+		l.buffers.Put(buf[:cap(buf)])
+	}
+}
+
+// handleDatagram adds the timing metrics of a datagram, one per line, to the
+// stats. A span is added per metric, weighted by its sample rate.
+func (l *TimerListener) handleDatagram(data []byte) {
+	now := time.Now().UnixNano()
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		m, err := parseTimer(string(line))
+		switch {
+		case err == errNotTimer:
+			atomic.AddInt64(&l.stats.Ignored, 1)
+			continue
+		case err != nil:
+			atomic.AddInt64(&l.stats.ParseErrors, 1)
+			log.Debugf("cannot parse statsd metric %q: %v", line, err)
+			continue
+		}
+		l.add(m, now)
+	}
+}
+
+// add adds the span of m ending at now to the stats
+func (l *TimerListener) add(m timerMetric, now int64) {
+	service := m.tags[l.conf.TimersTags[config.TimerTagService]]
+	if service == "" {
+		atomic.AddInt64(&l.stats.NoService, 1)
+		return
+	}
+	resource := m.tags[l.conf.TimersTags[config.TimerTagResource]]
+	if resource == "" {
+		resource = m.name
+	}
+	env := model.NormalizeTag(m.tags[l.conf.TimersTags[config.TimerTagEnv]])
+	if env == "" {
+		env = l.conf.DefaultEnv
+	}
+
+	l.spanID++
+	s := model.Span{
+		TraceID:  l.spanID,
+		SpanID:   l.spanID,
+		Service:  service,
+		Name:     m.name,
+		Resource: resource,
+		Start:    now - m.duration,
+		Duration: m.duration,
+		Metrics:  map[string]float64{model.TraceTopLevelKey: 1},
+
+		IsTopLevel: true,
+	}
+	if err := s.Normalize(); err != nil {
+		atomic.AddInt64(&l.stats.ParseErrors, 1)
+		log.Debugf("dropping statsd timing metric %q: %v", m.name, err)
+		return
+	}
+
+	k := timerKey{service: s.Service, resource: s.Resource, name: s.Name, env: env}
+	if _, ok := l.keys[k]; !ok {
+		if len(l.keys) >= l.conf.TimersMaxKeys {
+			atomic.AddInt64(&l.stats.OverKeys, 1)
+			return
+		}
+		l.keys[k] = struct{}{}
+	}
+	atomic.AddInt64(&l.stats.Metrics, 1)
+	l.concentrator.Add(processedTrace{Trace: model.Trace{s}, Env: env}, 1/m.rate)
+}
+
+func (l *TimerListener) logStats() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.exit:
+			return
+		}
+		statsd.Client.Count("datadog.trace_agent.timers.datagrams", atomic.SwapInt64(&l.stats.Datagrams, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.timers.dropped_datagrams", atomic.SwapInt64(&l.stats.Dropped, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.timers.metrics", atomic.SwapInt64(&l.stats.Metrics, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.timers.ignored", atomic.SwapInt64(&l.stats.Ignored, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.timers.parse_errors", atomic.SwapInt64(&l.stats.ParseErrors, 0), nil, 1)
+		statsd.Client.Count("datadog.trace_agent.timers.no_service", atomic.SwapInt64(&l.stats.NoService, 0), nil, 1)
+		if n := atomic.SwapInt64(&l.stats.OverKeys, 0); n > 0 {
+			statsd.Client.Count("datadog.trace_agent.timers.over_max_keys", n, nil, 1)
+			log.Warnf("dropped %d statsd timing metrics over the limit of %d distinct keys", n, l.conf.TimersMaxKeys)
+		}
+	}
+}
+
+// timerMetric is a statsd timing metric
+type timerMetric struct {
+	name     string
+	duration int64 // in nanoseconds
+	rate     float64
+	tags     map[string]string
+}
+
+// errNotTimer is returned by parseTimer for the valid metrics of other types
+var errNotTimer = errors.New("not a timing metric")
+
+// parseTimer parses a statsd timing metric in the dogstatsd format,
+// `<name>:<value>|ms[|@<rate>][|#<tag>:<value>,...]`, the value being in
+// milliseconds
+func parseTimer(line string) (timerMetric, error) {
+	m := timerMetric{rate: 1}
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return m, errors.New("missing the metric type")
+	}
+	i := strings.LastIndex(parts[0], ":")
+	if i <= 0 {
+		return m, errors.New("expected <name>:<value>")
+	}
+	if parts[1] != "ms" {
+		return m, errNotTimer
+	}
+	m.name = parts[0][:i]
+	v, err := strconv.ParseFloat(parts[0][i+1:], 64)
+	if err != nil || v < 0 {
+		return m, fmt.Errorf("invalid value %q", parts[0][i+1:])
+	}
+	m.duration = int64(v * 1e6)
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, fmt.Errorf("invalid sample rate %q", p[1:])
+			}
+			m.rate = rate
+		case strings.HasPrefix(p, "#"):
+			m.tags = make(map[string]string)
+			for _, tag := range strings.Split(p[1:], ",") {
+				if j := strings.Index(tag, ":"); j > 0 {
+					m.tags[tag[:j]] = tag[j+1:]
+				}
+			}
+		default:
+			return m, fmt.Errorf("unexpected field %q", p)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimer(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := parseTimer("api.request.duration:123|ms|#service:web,resource:GET_/users")
+	assert.Nil(err)
+	assert.Equal(timerMetric{name: "api.request.duration", duration: 123e6, rate: 1,
+		tags: map[string]string{"service": "web", "resource": "GET_/users"}}, m)
+
+	m, err = parseTimer("db.query:0.5|ms|@0.25|#service:db,critical")
+	assert.Nil(err)
+	assert.Equal(timerMetric{name: "db.query", duration: 5e5, rate: 0.25, tags: map[string]string{"service": "db"}}, m)
+
+	for _, line := range []string{"page.views:1|c", "users:3|s|#service:web", "queue.size:10|g"} {
+		_, err = parseTimer(line)
+		assert.Equal(errNotTimer, err, line)
+	}
+	for _, line := range []string{"api.request.duration", "api.request.duration|ms", ":12|ms", "a:abc|ms",
+		"a:-1|ms", "a:1|ms|@2", "a:1|ms|@0", "a:1|ms|unexpected"} {
+		_, err = parseTimer(line)
+		if assert.NotNil(err, line) {
+			assert.NotEqual(errNotTimer, err, line)
+		}
+	}
+}
+
+// timerDurations returns the duration distributions of the buckets, by
+// service and resource
+func timerDurations(buckets []model.StatsBucket) map[string]model.Distribution {
+	dists := make(map[string]model.Distribution)
+	for _, b := range buckets {
+		for _, d := range b.Distributions {
+			if d.Measure == model.DURATION {
+				dists[d.Service()+" "+d.Resource()] = d
+			}
+		}
+	}
+	return dists
+}
+
+// timerHits returns the hits of the buckets, by service and resource
+func timerHits(buckets []model.StatsBucket) map[string]float64 {
+	hits := make(map[string]float64)
+	for _, b := range buckets {
+		for _, c := range b.Counts {
+			if c.Measure == model.HITS && c.TagSet.Get("resource").Value != "" {
+				hits[c.TagSet.Get("service").Value+" "+c.TagSet.Get("resource").Value] += c.Value
+			}
+		}
+	}
+	return hits
+}
+
+func TestTimerListener(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DefaultEnv = "none"
+	conf.TimersMaxKeys = 4
+	conf.TimersTags[config.TimerTagResource] = "endpoint"
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	l := NewTimerListener(conf, c)
+	if !assert.Nil(l.Listen("127.0.0.1:0")) {
+		return
+	}
+	l.Run()
+
+	conn, err := net.Dial("udp", l.conn.LocalAddr().String())
+	if !assert.Nil(err) {
+		return
+	}
+	defer conn.Close()
+	datagrams := []string{
+		// several metrics per datagram, as dogstatsd clients buffer them
+		"api.request.duration:100|ms|#service:web,endpoint:GET_/users\n" +
+			"api.request.duration:200|ms|#service:web,endpoint:GET_/users\n" +
+			"api.request.duration:300|ms|#service:web,endpoint:GET_/users\n",
+		"api.request.duration:400|ms|#service:web,endpoint:GET_/users",
+		// weighted by their sample rate
+		"api.request.duration:50|ms|@0.5|#service:web,endpoint:POST_/users",
+		// without resource, or in another env
+		"db.query:10|ms|#service:db",
+		"db.query:10|ms|#service:db,env:staging",
+		// over the keys limit
+		"db.query:10|ms|#service:db,env:prod",
+		// ignored or dropped
+		"page.views:1|c|#service:web",
+		"db.query:10|ms",
+		"db.query:abc|ms|#service:db",
+	}
+	for _, d := range datagrams {
+		_, err := conn.Write([]byte(d))
+		assert.Nil(err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if atomic.LoadInt64(&l.stats.Datagrams) == int64(len(datagrams)) {
+			break
+		}
+	}
+	l.Stop()
+
+	assert.Equal(int64(7), atomic.LoadInt64(&l.stats.Metrics))
+	assert.Equal(int64(1), atomic.LoadInt64(&l.stats.OverKeys))
+	assert.Equal(int64(1), atomic.LoadInt64(&l.stats.Ignored))
+	assert.Equal(int64(1), atomic.LoadInt64(&l.stats.NoService))
+	assert.Equal(int64(1), atomic.LoadInt64(&l.stats.ParseErrors))
+
+	buckets := c.FlushAll()
+	dists := timerDurations(buckets)
+	if d, ok := dists["web GET_/users"]; assert.True(ok) {
+		assert.Equal("api.request.duration", d.Name)
+		assert.Equal(4, d.Summary.N)
+		// within the precision of the stored values
+		assert.InEpsilon(100e6, d.Summary.Quantile(0), 0.01)
+		assert.InEpsilon(200e6, d.Summary.Quantile(0.5), 0.01)
+		assert.InEpsilon(400e6, d.Summary.Quantile(0.95), 0.01)
+	}
+	if d, ok := dists["db db.query"]; assert.True(ok) {
+		assert.InEpsilon(10e6, d.Summary.Quantile(0.5), 0.01)
+	}
+	assert.Len(dists, 3) // both envs of db.query under the same service and resource
+
+	hits := timerHits(buckets)
+	assert.Equal(float64(4), hits["web GET_/users"])
+	assert.Equal(float64(2), hits["web POST_/users"])
+	// default and staging envs
+	assert.Equal(float64(2), hits["db db.query"])
+	assert.Len(l.keys, conf.TimersMaxKeys)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// newAPITransport returns the transport of an APIEndpoint. It has the
+// settings of http.DefaultTransport and counts the connections it opens and
+// closes, so that their churn can be monitored.
+func newAPITransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			statsd.Client.Count("datadog.trace_agent.api.connections_opened", 1, nil, 1)
+			return &countedConn{Conn: conn}, nil
+		},
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// countedConn counts its closing in the connection churn
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// Close implements net.Conn
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		statsd.Client.Count("datadog.trace_agent.api.connections_closed", 1, nil, 1)
+	})
+	return c.Conn.Close()
+}
+
+// SetConnections configures the connections to the intakes. With
+// conf.APIConnMaxLifetime, the idle connections are closed periodically, so
+// that new ones resolve the intake host again instead of sending to the same
+// address for days. It must be called before any write.
+func (a *APIEndpoint) SetConnections(conf *config.AgentConfig) {
+	a.transport.MaxIdleConnsPerHost = conf.APIMaxIdleConnsPerHost
+	a.transport.IdleConnTimeout = conf.APIIdleConnTimeout
+	a.transport.DisableKeepAlives = conf.APIDisableKeepAlives
+	if conf.APIConnMaxLifetime > 0 && !conf.APIDisableKeepAlives {
+		go a.recycleConnections(conf.APIConnMaxLifetime)
+	}
+}
+
+// recycleConnections closes the idle connections every interval, busy ones
+// being closed by the first tick they are idle at
+func (a *APIEndpoint) recycleConnections(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// newConnCountingServer returns an intake accepting all the payloads, and the
+// number of connections it got
+func newConnCountingServer() (*httptest.Server, *int64) {
+	var conns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	return server, &conns
+}
+
+func TestAPIEndpointConnMaxLifetime(t *testing.T) {
+	assert := assert.New(t)
+
+	server, conns := newConnCountingServer()
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIConnMaxLifetime = 50 * time.Millisecond
+	a := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	a.SetConnections(conf)
+
+	_, err := a.Write(newTestPayload("test"))
+	assert.Nil(err)
+	_, err = a.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal(int64(1), atomic.LoadInt64(conns), "the connection should be reused before its lifetime")
+
+	time.Sleep(4 * conf.APIConnMaxLifetime)
+	_, err = a.Write(newTestPayload("test"))
+	assert.Nil(err)
+	assert.Equal(int64(2), atomic.LoadInt64(conns), "a new connection should be opened past the lifetime")
+}
+
+func TestAPIEndpointConnections(t *testing.T) {
+	assert := assert.New(t)
+
+	server, conns := newConnCountingServer()
+	defer server.Close()
+
+	// connections are kept without lifetime
+	conf := config.NewDefaultAgentConfig()
+	conf.APIConnMaxLifetime = 0
+	a := NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	a.SetConnections(conf)
+	for i := 0; i < 3; i++ {
+		_, err := a.Write(newTestPayload("test"))
+		assert.Nil(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(int64(1), atomic.LoadInt64(conns))
+	assert.Equal(conf.APIMaxIdleConnsPerHost, a.transport.MaxIdleConnsPerHost)
+	assert.Equal(conf.APIIdleConnTimeout, a.transport.IdleConnTimeout)
+
+	// and never without keep-alives
+	conf.APIDisableKeepAlives = true
+	a = NewAPIEndpoint([]string{server.URL}, []string{"key"})
+	a.SetConnections(conf)
+	for i := 0; i < 3; i++ {
+		_, err := a.Write(newTestPayload("test"))
+		assert.Nil(err)
+	}
+	assert.Equal(int64(4), atomic.LoadInt64(conns))
+}
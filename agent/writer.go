@@ -1,7 +1,12 @@
 package main
 
 import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -9,6 +14,7 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/statsd"
+	"github.com/DataDog/datadog-trace-agent/watch"
 )
 
 // the amount of time in seconds to wait before resending a payload
@@ -17,14 +23,29 @@ const payloadResendDelay = 5 * time.Second
 // the amount of time in seconds a payload can stay buffered before being dropped
 const payloadMaxAge = 10 * time.Minute
 
+// The contents of the payloads split with config.AgentConfig.APISplitPayloads
+const (
+	contentTraces = "traces"
+	contentStats  = "stats"
+)
+
+// maxFlushLimit is the number of payloads per flush above which the writer
+// stops limiting its flushes, see Writer.flushLimit
+const maxFlushLimit = 64
+
 // writerPayload wraps a model.AgentPayload and keeps track of a list of
 // endpoints the payload must be sent to.
 type writerPayload struct {
 	payload      model.AgentPayload // the payload itself
 	size         int                // the size of the serialized payload or 0 if it has not been serialized yet
 	endpoint     AgentEndpoint      // the endpoints the payload must be sent to
+	route        string             // the route of the payload, empty for the main endpoint
+	content      string             // contentTraces or contentStats once split, see Writer.splitContent
 	creationDate time.Time          // the creation date of the payload
 	nextFlush    time.Time          // The earliest moment we can flush
+	sendAt       time.Time          // the earliest moment it is first sent, see Writer.sendTime
+	trace        *flushTrace        // the trace of the flush of the payload, until it is first written
+	result       *writeResult       // the result of the last write, nil if the endpoint does not tell, see resultEndpoint
 }
 
 func newWriterPayload(p model.AgentPayload, endpoint AgentEndpoint) *writerPayload {
@@ -36,8 +57,24 @@ func newWriterPayload(p model.AgentPayload, endpoint AgentEndpoint) *writerPaylo
 }
 
 func (p *writerPayload) write() error {
-	size, err := p.endpoint.Write(p.payload)
-	p.size = size
+	var size int
+	var err error
+	if re, ok := p.endpoint.(resultEndpoint); ok {
+		var r writeResult
+		r, err = re.WriteResult(p.payload)
+		size, p.result = r.size, &r
+	} else {
+		size, err = p.endpoint.Write(p.payload)
+	}
+	if size == 0 && p.size == 0 && err != nil {
+		// not encoded, e.g. only sent to endpoints which rejected their
+		// API key, the size still has to bound the payload buffer
+		n, _ := model.StreamAgentPayload(ioutil.Discard, &p.payload)
+		size = int(n)
+	}
+	if size > 0 {
+		p.size = size
+	}
 	return err
 }
 
@@ -45,51 +82,186 @@ func (p *writerPayload) write() error {
 // pre-processed data from channels and tentatively output them
 // to a given endpoint.
 type Writer struct {
-	endpoint AgentEndpoint // where the data will end
+	endpoint AgentEndpoint            // where the data will end
+	routes   map[string]AgentEndpoint // endpoints by value of the routing tag, see config.Route
+	kafka    *KafkaEndpoint           // set when payloads are also sent to Kafka
+	local    *LocalEndpoint           // set when rejected payloads are written locally, see config.AuthFailureLocal
+	audit    *auditLog                // writes a sample of the payloads sent, nil if disabled
 
 	// input data
 	inPayloads chan model.AgentPayload     // main payloads for processed traces/stats
 	inServices chan model.ServicesMetadata // secondary services metadata
 
+	// with self tracing, the trace of each flush is sent to inFlushTraces
+	// before its payload is sent to inPayloads, and is then sent to
+	// selfTraces once the payload is written
+	inFlushTraces chan *flushTrace
+	selfTraces    chan model.Trace
+
 	payloadBuffer []*writerPayload       // buffer of payloads ready to send
 	serviceBuffer model.ServicesMetadata // services are merged into this map continuously
 
+	// depth of the input channel and of the payload buffer, see /debug/pipeline
+	payloadsQueue   *queueStats
+	bufferQueue     *queueStats
+	bufferedPayload int64 // len(payloadBuffer), readable from other goroutines
+
+	// flushLimit is the maximum number of payloads written per flush, 0 for
+	// no limit. It is lowered when the intake is about to rate limit us.
+	flushLimit int
+
+	senders map[senderKey]*senderPool // by route and content, see writePayloads
+
+	batches map[batchKey]*payloadBatch // small payloads waiting to be sent together, see batch
+
+	seq *payloadSeq // numbers the payloads as they are buffered
+
+	// the payloads are first sent flushJitter into the bucket interval
+	// following their buffering, see sendTime
+	flushJitter    time.Duration
+	bucketInterval time.Duration
+
 	exit   chan struct{}
 	exitWG *sync.WaitGroup
 
+	clock watch.Clock // times the flushes and the payload retries, overridden by tests
+
 	conf *config.AgentConfig
 }
 
 // NewWriter returns a new Writer
 func NewWriter(conf *config.AgentConfig) *Writer {
 	var endpoint AgentEndpoint
+	var kafka *KafkaEndpoint
+	var local *LocalEndpoint
+
+	if conf.APIAuthFailure == config.AuthFailureLocal {
+		l, err := NewLocalEndpoint(conf.APILocalDir, conf.APILocalMaxSize)
+		if err != nil {
+			log.Errorf("cannot write payloads to %s, dropping the payloads whose API key is rejected: %v", conf.APILocalDir, err)
+		} else {
+			local = l
+		}
+	}
 
-	if conf.APIEnabled {
-		endpoint = NewAPIEndpoint(conf.APIEndpoints, conf.APIKeys)
+	audit, err := newAuditLog(conf)
+	if err != nil {
+		log.Errorf("cannot audit payloads to %s: %v", conf.APIAuditDir, err)
+	}
+
+	if !conf.APIDryRun && (conf.OutputType == config.OutputKafka || conf.OutputType == config.OutputBoth) {
+		k, err := newKafkaEndpoint(conf)
+		if err != nil {
+			// never send the payloads elsewhere than configured
+			die("cannot create the Kafka output: %v", err)
+		}
+		kafka = k
+	}
+
+	if conf.APIDryRun {
+		log.Warn("dry run: payloads and services are encoded but never sent")
+		if conf.APIDryRunDir != "" && conf.APIDryRunMaxPayloads > 0 {
+			log.Warnf("dry run: writing the first %d payloads to %s", conf.APIDryRunMaxPayloads, conf.APIDryRunDir)
+		}
+		endpoint = NewDryRunEndpoint(conf)
+	} else if kafka != nil && conf.OutputType == config.OutputKafka {
+		endpoint = kafka
+	} else if conf.APIEnabled && len(conf.APIKeys) == 0 {
+		// local-only mode, see config.AuthFailureLocal
+		if local != nil {
+			log.Infof("no API key, writing payloads to %s", conf.APILocalDir)
+			endpoint = local
+		} else {
+			log.Error("no API key and no local directory, dropping all payloads")
+			endpoint = NullEndpoint{}
+		}
+	} else if conf.APIEnabled {
+		api := NewAPIEndpoint(conf.APIEndpoints, conf.APIKeys)
 		if conf.Proxy != nil {
 			// we have some kind of proxy configured.
 			// make sure our http client uses it
-			endpoint.(*APIEndpoint).SetProxy(conf.Proxy)
+			api.SetProxy(conf.Proxy)
 		}
+		api.SetConnections(conf)
+		api.SetCompression(conf.APICompression, conf.APICompressionLevel)
+		api.SetPaths(conf)
+		endpoint = api
 	} else {
 		log.Info("API interface is disabled, flushing to /dev/null instead")
 		endpoint = NullEndpoint{}
 	}
 
-	return &Writer{
+	routes := make(map[string]AgentEndpoint, len(conf.Routes))
+	if dryRun, ok := endpoint.(*DryRunEndpoint); ok {
+		// still split by route, as they would be sent
+		for _, r := range conf.Routes {
+			routes[r.Value] = dryRun
+		}
+	} else if _, ok := endpoint.(*APIEndpoint); ok {
+		for _, r := range conf.Routes {
+			route := NewAPIEndpoint([]string{r.Endpoint}, []string{r.APIKey})
+			if conf.Proxy != nil {
+				route.SetProxy(conf.Proxy)
+			}
+			route.SetConnections(conf)
+			route.SetCompression(conf.APICompression, conf.APICompressionLevel)
+			route.SetPaths(conf)
+			routes[r.Value] = route
+		}
+	}
+
+	if kafka != nil && conf.OutputType == config.OutputBoth {
+		endpoint = teeEndpoint{main: endpoint, secondary: kafka}
+		for v, route := range routes {
+			routes[v] = teeEndpoint{main: route, secondary: kafka}
+		}
+	}
+
+	var seqPath string
+	if conf.StateDir != "" {
+		seqPath = filepath.Join(conf.StateDir, writerSeqFile)
+	}
+	seq, err := newPayloadSeq(seqPath)
+	if err == nil && seqPath != "" {
+		log.Infof("resumed the payload sequence from %s", seqPath)
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Warnf("ignoring the payload sequence saved in %s: %v", seqPath, err)
+	}
+
+	w := &Writer{
 		endpoint: endpoint,
+		routes:   routes,
+		kafka:    kafka,
+		local:    local,
+		audit:    audit,
 
 		// small buffer to not block in case we're flushing
 		inPayloads: make(chan model.AgentPayload, 1),
 
+		inFlushTraces: make(chan *flushTrace, 1),
+		selfTraces:    make(chan model.Trace, 1),
+
 		payloadBuffer: make([]*writerPayload, 0, 5),
 		serviceBuffer: make(model.ServicesMetadata),
+		senders:       make(map[senderKey]*senderPool),
+		batches:       make(map[batchKey]*payloadBatch),
+		seq:           seq,
+
+		flushJitter:    flushJitter(conf),
+		bucketInterval: conf.BucketInterval,
 
 		exit:   make(chan struct{}),
 		exitWG: &sync.WaitGroup{},
 
+		clock: watch.Real,
+
 		conf: conf,
 	}
+	w.payloadsQueue = pipeline.register("writer.payloads",
+		func() int { return len(w.inPayloads) }, cap(w.inPayloads))
+	w.bufferQueue = pipeline.register("writer.payload_buffer",
+		func() int { return int(atomic.LoadInt64(&w.bufferedPayload)) }, 0)
+	return w
 }
 
 // isPayloadBufferingEnabled returns true if payload buffering is enabled or
@@ -101,6 +273,7 @@ func (w *Writer) isPayloadBufferingEnabled() bool {
 // Run starts the writer.
 func (w *Writer) Run() {
 	w.exitWG.Add(1)
+	w.audit.Run()
 	go w.main()
 }
 
@@ -111,20 +284,41 @@ func (w *Writer) Run() {
 func (w *Writer) main() {
 	defer w.exitWG.Done()
 
-	flushTicker := time.NewTicker(time.Second)
+	flushTicker := w.clock.NewTicker(time.Second)
 	defer flushTicker.Stop()
 
 	for {
 		select {
 		case p := <-w.inPayloads:
+			var ft *flushTrace
+			select {
+			case ft = <-w.inFlushTraces:
+			default:
+			}
+			if w.conf.PartialFlushMode == config.PartialFlushDrop {
+				p.Stats = dropPartialStats(p.Stats)
+			}
 			if p.IsEmpty() {
 				continue
 			}
-			w.payloadBuffer = append(w.payloadBuffer,
-				newWriterPayload(p, w.endpoint))
+			if err := p.Validate(); err != nil {
+				log.Errorf("dropping payload: %v", err)
+				statsd.Client.Count("datadog.trace_agent.writer.invalid_payload", 1, nil, 1)
+				continue
+			}
+			p.Traces = w.trimMeta(p.Traces)
+			payloads := w.splitContent(w.route(p))
+			ft.expect(len(payloads))
+			for _, wp := range payloads {
+				wp.trace = ft
+				wp.creationDate = w.clock.Now()
+			}
+			w.bufferPayloads(w.batch(payloads))
 			w.Flush()
-		case <-flushTicker.C:
+		case <-flushTicker.C():
+			w.bufferPayloads(w.releaseBatches(false))
 			w.Flush()
+			w.saveSeq(false)
 		case sm := <-w.inServices:
 			updated := w.serviceBuffer.Update(sm)
 			if updated {
@@ -132,29 +326,173 @@ func (w *Writer) main() {
 			}
 		case <-w.exit:
 			log.Info("exiting, trying to flush all remaining data")
+			w.bufferPayloads(w.releaseBatches(true))
+			for _, p := range w.payloadBuffer {
+				p.sendAt = time.Time{}
+			}
 			w.Flush()
+			w.saveSeq(true)
 			return
 		}
 	}
 }
 
+// bufferPayloads numbers the payloads and adds them to the payload buffer,
+// to be sent at their sendTime. Retries keep the number of the first attempt.
+func (w *Writer) bufferPayloads(payloads []*writerPayload) {
+	now := w.clock.Now()
+	for _, wp := range payloads {
+		wp.payload.Seq = w.seq.next()
+		wp.sendAt = w.sendTime(now)
+	}
+	w.payloadBuffer = append(w.payloadBuffer, payloads...)
+	w.setBufferedPayloads()
+}
+
+// flushJitter returns the offset into the bucket intervals at which the
+// payloads are sent, at most half the bucket interval. With
+// conf.APIFlushJitterAuto, it is derived from the host name so that it is
+// the same across restarts and spread across hosts.
+func flushJitter(conf *config.AgentConfig) time.Duration {
+	max := conf.BucketInterval / 2
+	if max <= 0 {
+		return 0
+	}
+	if conf.APIFlushJitterAuto {
+		h := fnv.New64a()
+		h.Write([]byte(conf.HostName))
+		return time.Duration(h.Sum64() % uint64(max))
+	}
+	if conf.APIFlushJitter > max {
+		return max
+	}
+	return conf.APIFlushJitter
+}
+
+// sendTime returns when a payload buffered at now is first sent: flushJitter
+// into its bucket interval, or into the next one if that is already past.
+// Bucket intervals are aligned on the Unix epoch, as the stats buckets. It
+// is now without jitter.
+func (w *Writer) sendTime(now time.Time) time.Time {
+	if w.flushJitter <= 0 {
+		return now
+	}
+	ns := now.UnixNano()
+	at := ns - ns%int64(w.bucketInterval) + int64(w.flushJitter)
+	if at < ns {
+		at += int64(w.bucketInterval)
+	}
+	return time.Unix(0, at)
+}
+
+// saveSeq saves the payload sequence, logging the first of consecutive
+// failures
+func (w *Writer) saveSeq(sync bool) {
+	if err := w.seq.save(sync); err != nil {
+		if !w.seq.failing {
+			log.Errorf("cannot save the payload sequence to %s: %v", w.seq.path, err)
+		}
+		w.seq.failing = true
+		return
+	}
+	w.seq.failing = false
+}
+
+// dropPartialStats returns stats without the buckets flagged as partial, see
+// Concentrator.FlagPartialBuckets. stats is left untouched, the payload
+// being shared, e.g. with the callbacks of /debug/flush.
+func dropPartialStats(stats []model.StatsBucket) []model.StatsBucket {
+	kept := make([]model.StatsBucket, 0, len(stats))
+	for _, sb := range stats {
+		if sb.Partial {
+			log.Infof("dropping the stats of partial bucket %d, the agent started during its window", sb.Start)
+			statsd.Client.Count("datadog.trace_agent.writer.partial_buckets_dropped", 1, nil, 1)
+			continue
+		}
+		kept = append(kept, sb)
+	}
+	return kept
+}
+
+// route returns the payloads to send for p. With routing, p is split so that
+// every route gets its traces and stats with its own credentials, and is
+// retried on its own. Unmatched data goes to the main endpoint.
+func (w *Writer) route(p model.AgentPayload) []*writerPayload {
+	if len(w.routes) == 0 {
+		return []*writerPayload{newWriterPayload(p, w.endpoint)}
+	}
+
+	values := make([]string, 0, len(w.routes))
+	for v := range w.routes {
+		values = append(values, v)
+	}
+
+	var payloads []*writerPayload
+	for v, rp := range p.SplitByTag(w.conf.RoutingTag, values) {
+		endpoint, ok := w.routes[v]
+		if !ok {
+			endpoint = w.endpoint
+		}
+		wp := newWriterPayload(rp, endpoint)
+		wp.route = v
+		payloads = append(payloads, wp)
+	}
+	return payloads
+}
+
+// splitContent splits the payloads into their traces and their stats with
+// conf.APISplitPayloads, so that each is sent to its own intake route and
+// retried on its own
+func (w *Writer) splitContent(payloads []*writerPayload) []*writerPayload {
+	if !w.conf.APISplitPayloads {
+		return payloads
+	}
+
+	split := make([]*writerPayload, 0, 2*len(payloads))
+	for _, wp := range payloads {
+		traces, stats := wp.payload.SplitByContent()
+		for _, part := range []struct {
+			content string
+			payload model.AgentPayload
+		}{
+			{contentTraces, traces},
+			{contentStats, stats},
+		} {
+			if part.payload.IsEmpty() {
+				continue
+			}
+			sp := newWriterPayload(part.payload, wp.endpoint)
+			sp.route = wp.route
+			sp.content = part.content
+			split = append(split, sp)
+		}
+	}
+	return split
+}
+
 // Stop stops the main Run loop
 func (w *Writer) Stop() {
 	close(w.exit)
 	w.exitWG.Wait()
+	w.audit.Stop()
+	if w.kafka != nil {
+		w.kafka.Stop()
+	}
 }
 
-// FlushServices initiate a flush of the services to the services endpoint
+// FlushServices initiate a flush of the services to the services endpoint.
+// Services can't be told apart by route, they are sent to all the routes.
 func (w *Writer) FlushServices() {
 	w.endpoint.WriteServices(w.serviceBuffer)
+	for _, route := range w.routes {
+		route.WriteServices(w.serviceBuffer)
+	}
 }
 
 // Flush actually writes the data in the API
 func (w *Writer) Flush() {
-	// TODO[leo]: batch payloads in same API key
-
 	var payloads []*writerPayload
-	now := time.Now()
+	now := w.clock.Now()
 	bufSize := 0
 
 	bufferPayload := func(p *writerPayload) {
@@ -164,16 +502,44 @@ func (w *Writer) Flush() {
 
 	nbSuccesses := 0
 	nbErrors := 0
+	rateLimited := false
 
+	var toWrite []*writerPayload
 	for _, p := range w.payloadBuffer {
+		if p.sendAt.After(now) {
+			// waiting for its first send, see sendTime
+			continue
+		}
 		if w.isPayloadBufferingEnabled() && p.nextFlush.After(now) {
 			// We already tried to flush recently, so there's no
 			// point in trying again right now.
+			continue
+		}
+
+		if w.flushLimit > 0 && len(toWrite) >= w.flushLimit {
+			// the intake is close to rate limit us, keep it
+			// for the next flushes
+			continue
+		}
+		toWrite = append(toWrite, p)
+	}
+	coalesceStats(toWrite)
+	errs := w.writePayloads(toWrite)
+
+	// the results are handled in the order of the buffer, so that the
+	// payloads kept for a retry stay in the order they were flushed
+	for _, p := range w.payloadBuffer {
+		if len(toWrite) == 0 || p != toWrite[0] {
 			bufferPayload(p)
 			continue
 		}
+		toWrite = toWrite[1:]
+		err := errs[0]
+		errs = errs[1:]
 
-		err := p.write()
+		if p.result != nil && p.result.rateLimitLow {
+			rateLimited = true
+		}
 
 		if err == nil {
 			nbSuccesses++
@@ -181,6 +547,16 @@ func (w *Writer) Flush() {
 			nbErrors++
 		}
 
+		if terr, ok := err.(*apiError); ok && w.conf.APIAuthFailure != config.AuthFailureBuffer {
+			if forbidden, others := terr.splitForbidden(); forbidden != nil {
+				w.handleAuthFailure(p)
+				err = nil
+				if others != nil {
+					err = others
+				}
+			}
+		}
+
 		if err == nil || !w.isPayloadBufferingEnabled() {
 			continue
 		}
@@ -215,6 +591,8 @@ func (w *Writer) Flush() {
 			int64(nbErrors), []string{"status:error"}, 1)
 	}
 
+	w.adjustFlushLimit(nbSuccesses+nbErrors, rateLimited)
+
 	// Drop payloads to respect the buffer size limit if necessary.
 	nbDrops := 0
 	for n := 0; n < len(payloads) && bufSize > w.conf.APIPayloadBufferMaxSize; n++ {
@@ -223,7 +601,10 @@ func (w *Writer) Flush() {
 	}
 
 	if nbDrops > 0 {
-		log.Infof("dropping %d payloads (payload buffer full)", nbDrops)
+		config.WithFields(config.Fields{
+			"dropped":     nbDrops,
+			"buffer_size": bufSize,
+		}).Infof("dropping %d payloads (payload buffer full)", nbDrops)
 		statsd.Client.Count("datadog.trace_agent.writer.dropped_payload",
 			int64(nbDrops), []string{"reason:buffer_full"}, 1)
 
@@ -234,4 +615,199 @@ func (w *Writer) Flush() {
 		float64(bufSize), nil, 1)
 
 	w.payloadBuffer = payloads
+	w.setBufferedPayloads()
+}
+
+// coalesceStats merges the stats buckets of payloads which cover the same time
+// window, so that the backend does not count the window twice. This happens
+// when a bucket is flushed early, e.g. by /debug/flush, and the rest of its
+// spans are flushed before it was written. Buckets are merged into the first
+// one of their window and route, only for payloads which were never written:
+// the others already reached some of their endpoints.
+func coalesceStats(payloads []*writerPayload) {
+	type window struct {
+		route           string
+		start, duration int64
+	}
+	first := make(map[window]*model.StatsBucket)
+	var merged int64
+	for _, p := range payloads {
+		if !p.nextFlush.IsZero() {
+			continue
+		}
+		stats := p.payload.Stats[:0]
+		for _, sb := range p.payload.Stats {
+			w := window{route: p.route, start: sb.Start, duration: sb.Duration}
+			if into, ok := first[w]; ok {
+				err := into.Merge(sb)
+				if err == nil {
+					merged++
+					continue
+				}
+				log.Errorf("cannot merge stats buckets: %v", err)
+			}
+			stats = append(stats, sb)
+			if _, ok := first[w]; !ok {
+				first[w] = &stats[len(stats)-1]
+			}
+		}
+		p.payload.Stats = stats
+	}
+	if merged > 0 {
+		statsd.Client.Count("datadog.trace_agent.writer.stats_buckets_merged", merged, nil, 1)
+	}
+}
+
+// handleAuthFailure handles a payload rejected by endpoints because of their
+// API key, writing it locally with config.AuthFailureLocal and dropping it
+// otherwise. Payloads are retried as usual with config.AuthFailureBuffer.
+func (w *Writer) handleAuthFailure(p *writerPayload) {
+	if w.local != nil {
+		if _, err := w.local.Write(p.payload); err == nil {
+			return
+		}
+	}
+	statsd.Client.Count("datadog.trace_agent.writer.dropped_payload",
+		int64(1), []string{"reason:auth_failure"}, 1)
+}
+
+// adjustFlushLimit halves the number of payloads written per flush when the
+// intake is about to rate limit us, and doubles it back otherwise, given the
+// number of payloads written by the last flush.
+func (w *Writer) adjustFlushLimit(written int, rateLimited bool) {
+	limit := w.flushLimit
+	switch {
+	case rateLimited && limit == 0:
+		limit = written / 2
+	case rateLimited:
+		limit = limit / 2
+	case limit > 0 && written > 0:
+		limit *= 2
+		if limit > maxFlushLimit {
+			limit = 0
+		}
+	}
+	if rateLimited && limit < 1 {
+		limit = 1
+	}
+	if limit == w.flushLimit {
+		return
+	}
+
+	if limit == 0 {
+		log.Info("intake no longer rate limiting, flushing all payloads")
+	} else {
+		log.Infof("intake close to rate limiting, flushing at most %d payloads at once", limit)
+	}
+	w.flushLimit = limit
+	statsd.Client.Gauge("datadog.trace_agent.writer.flush_limit", float64(limit), nil, 1)
+}
+
+// senderKey identifies the payloads sharing a senderPool
+type senderKey struct {
+	route, content string
+}
+
+// senderPool bounds the number of payloads written at the same time to the
+// endpoint of a route, the traces and stats of split payloads having a pool
+// each so that a slow intake route does not hold the other back
+type senderPool struct {
+	slots       chan struct{}
+	inFlight    int64
+	maxInFlight int64 // since the last flush
+}
+
+// writePayloads writes the payloads, at most conf.APIMaxConcurrentSends at
+// the same time per route and content, and returns their errors once they are all done.
+// Payloads are started in order.
+func (w *Writer) writePayloads(payloads []*writerPayload) []error {
+	errs := make([]error, len(payloads))
+	var wg sync.WaitGroup
+	used := make(map[senderKey]*senderPool)
+
+	for i, p := range payloads {
+		key := senderKey{route: p.route, content: p.content}
+		pool, ok := w.senders[key]
+		if !ok {
+			max := w.conf.APIMaxConcurrentSends
+			if max < 1 {
+				max = 1
+			}
+			pool = &senderPool{slots: make(chan struct{}, max)}
+			w.senders[key] = pool
+		}
+		used[key] = pool
+
+		pool.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, p *writerPayload, pool *senderPool) {
+			defer wg.Done()
+			n := atomic.AddInt64(&pool.inFlight, 1)
+			for {
+				m := atomic.LoadInt64(&pool.maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt64(&pool.maxInFlight, m, n) {
+					break
+				}
+			}
+
+			start := time.Now()
+			errs[i] = p.write()
+			w.audit.Record(p, errs[i])
+			if p.trace != nil {
+				w.traceWrite(p, start)
+			}
+
+			atomic.AddInt64(&pool.inFlight, -1)
+			<-pool.slots
+		}(i, p, pool)
+	}
+	wg.Wait()
+
+	for key, pool := range used {
+		route := key.route
+		if route == "" {
+			route = "default"
+		}
+		tags := []string{"route:" + route}
+		if key.content != "" {
+			tags = append(tags, "payload:"+key.content)
+		}
+		statsd.Client.Gauge("datadog.trace_agent.writer.in_flight",
+			float64(atomic.SwapInt64(&pool.maxInFlight, 0)), tags, 1)
+	}
+	return errs
+}
+
+// traceWrite adds the write of p, started at start, to the trace of its
+// flush, and sends the trace to selfTraces once all the payloads of the flush
+// were written. Retries are not traced.
+func (w *Writer) traceWrite(p *writerPayload, start time.Time) {
+	ft := p.trace
+	p.trace = nil
+
+	if p.result != nil {
+		ft.addStage("encode", start, p.result.encodeTime, map[string]float64{
+			"payload_size": float64(p.size),
+		})
+	}
+	ft.stage("send", start, map[string]float64{
+		"payload_size":  float64(p.size),
+		"traces":        float64(len(p.payload.Traces)),
+		"stats_buckets": float64(len(p.payload.Stats)),
+	})
+
+	if !ft.written() {
+		return
+	}
+	select {
+	case w.selfTraces <- ft.finish():
+	default:
+		log.Debug("dropping the trace of a flush, the previous one was not processed yet")
+	}
+}
+
+// setBufferedPayloads publishes the length of the payload buffer
+func (w *Writer) setBufferedPayloads() {
+	atomic.StoreInt64(&w.bufferedPayload, int64(len(w.payloadBuffer)))
+	w.bufferQueue.observe()
 }
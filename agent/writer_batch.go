@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// batchedPayloadMaxSize is the estimated size in bytes of the JSON encoding
+// of the payloads above which they are sent on their own, not batched
+const batchedPayloadMaxSize = 256 << 10
+
+// batchKey tells the payloads which can be sent in the same request apart:
+// the intake takes a single host and env per payload, every route has its
+// own endpoint and split payloads their own intake route
+type batchKey struct {
+	route, content, env, hostname string
+}
+
+// payloadBatch is the payload combining the small payloads flushed until it is
+// released, see Writer.batch. It is a single writerPayload so that it is
+// written and retried as a whole.
+type payloadBatch struct {
+	payload *writerPayload
+	count   int       // number of payloads combined
+	started time.Time // when the first payload was added
+}
+
+// isBatchingEnabled tells if small payloads are combined before being sent
+func (w *Writer) isBatchingEnabled() bool {
+	return w.conf.APIFlushBatchMaxPayloads > 1
+}
+
+// batch adds the small payloads to their batch, and returns the payloads to
+// buffer now: the ones not batched and the batches which are full. The
+// payloads whose flush is traced are not batched, so that their trace ends
+// when they are written. The batch keeps the creation date of its first
+// payload.
+func (w *Writer) batch(payloads []*writerPayload) []*writerPayload {
+	if !w.isBatchingEnabled() {
+		return payloads
+	}
+
+	var ready []*writerPayload
+	for _, wp := range payloads {
+		if wp.trace != nil || wp.payload.EstimateSize(model.PayloadEncodingJSON) > batchedPayloadMaxSize {
+			statsd.Client.Count("datadog.trace_agent.writer.batch_bypassed", 1, nil, 1)
+			ready = append(ready, wp)
+			continue
+		}
+
+		key := batchKey{route: wp.route, content: wp.content, env: wp.payload.Env, hostname: wp.payload.HostName}
+		b, ok := w.batches[key]
+		if !ok {
+			b = &payloadBatch{payload: wp, count: 1, started: w.clock.Now()}
+			w.batches[key] = b
+		} else {
+			b.payload.payload.Traces = append(b.payload.payload.Traces, wp.payload.Traces...)
+			b.payload.payload.Stats = append(b.payload.payload.Stats, wp.payload.Stats...)
+			b.count++
+		}
+		if b.count >= w.conf.APIFlushBatchMaxPayloads {
+			ready = append(ready, w.release(key, b))
+		}
+	}
+	return ready
+}
+
+// releaseBatches returns the batches which waited for more payloads for
+// longer than the configured wait, or all of them if all is true, and removes
+// them from the writer
+func (w *Writer) releaseBatches(all bool) []*writerPayload {
+	var ready []*writerPayload
+	now := w.clock.Now()
+	for key, b := range w.batches {
+		if all || now.Sub(b.started) >= w.conf.APIFlushBatchMaxWait {
+			ready = append(ready, w.release(key, b))
+		}
+	}
+	return ready
+}
+
+func (w *Writer) release(key batchKey, b *payloadBatch) *writerPayload {
+	delete(w.batches, key)
+	statsd.Client.Histogram("datadog.trace_agent.writer.batch_payloads", float64(b.count), nil, 1)
+	return b.payload
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writerSeqFile is the file, in config.AgentConfig.StateDir, the last
+// payload sequence number is saved to
+const writerSeqFile = "writer.seq"
+
+const (
+	// writerSeqGap is skipped when resuming a saved sequence: the numbers
+	// assigned after the last save of a crashed agent are never reused, as
+	// long as it assigned less than writerSeqGap in its last second
+	writerSeqGap = 1000
+	// writerSeqRandomBase is the lowest random start of a sequence which
+	// could not be resumed, high above the sequences resumed from it
+	writerSeqRandomBase = 1 << 62
+)
+
+// payloadSeq numbers the payloads of the writer, so that the intake can
+// tell the payloads retried or replayed apart from the new ones. The numbers
+// keep increasing across restarts when the sequence is saved to a file, see
+// newPayloadSeq. It is owned by the writer goroutine and is not safe for
+// concurrent use.
+type payloadSeq struct {
+	path    string // empty if the sequence only lives in memory
+	last    uint64 // the last number assigned
+	saved   uint64 // the last number saved to path
+	failing bool   // if the last save failed, to only log it once
+}
+
+// newPayloadSeq returns the sequence saved in path, resumed writerSeqGap
+// numbers later. With no path, or if the file is missing or corrupt, the
+// sequence starts at a random high offset, and the error reading it is
+// returned along with the sequence.
+func newPayloadSeq(path string) (*payloadSeq, error) {
+	s := &payloadSeq{path: path}
+	if path == "" {
+		s.last = randomSeqStart()
+		return s, nil
+	}
+
+	last, err := readPayloadSeq(path)
+	if err != nil {
+		s.last = randomSeqStart()
+		s.saved = s.last
+		return s, err
+	}
+	s.last = last + writerSeqGap
+	s.saved = last
+	return s, nil
+}
+
+func randomSeqStart() uint64 {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return writerSeqRandomBase + uint64(r.Int63n(writerSeqRandomBase))
+}
+
+func readPayloadSeq(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt sequence: %v", err)
+	}
+	return last, nil
+}
+
+// next returns the next number of the sequence
+func (s *payloadSeq) next() uint64 {
+	s.last++
+	return s.last
+}
+
+// save writes the last number assigned to the file of the sequence, if it
+// changed since the last save. The file is written atomically, and synced to
+// disk if sync is true.
+func (s *payloadSeq) save(sync bool) error {
+	if s.path == "" || (s.saved == s.last && !sync) {
+		return nil
+	}
+
+	tmp, err := os.OpenFile(s.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strconv.FormatUint(s.last, 10) + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.saved = s.last
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadSeqResume(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-seq")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, writerSeqFile)
+
+	s, err := newPayloadSeq(path)
+	assert.True(os.IsNotExist(err))
+	first := s.next()
+	assert.True(first > writerSeqRandomBase)
+	assert.Equal(first+1, s.next())
+	last := s.next()
+	assert.Nil(s.save(true))
+
+	// clean restart
+	s, err = newPayloadSeq(path)
+	assert.Nil(err)
+	assert.Equal(last+writerSeqGap+1, s.next())
+}
+
+func TestPayloadSeqCrash(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-seq")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, writerSeqFile)
+
+	s, _ := newPayloadSeq(path)
+	s.next()
+	assert.Nil(s.save(false))
+	// assigned after the last save, and lost with the agent
+	var last uint64
+	for i := 0; i < writerSeqGap-1; i++ {
+		last = s.next()
+	}
+
+	s, err = newPayloadSeq(path)
+	assert.Nil(err)
+	assert.True(s.next() > last)
+}
+
+func TestPayloadSeqCorrupt(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-seq")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, writerSeqFile)
+
+	for _, data := range []string{"", "garbage\n", "-12\n", "184467440737095516160\n"} {
+		assert.Nil(ioutil.WriteFile(path, []byte(data), 0600))
+		s, err := newPayloadSeq(path)
+		assert.NotNil(err, data)
+		assert.False(os.IsNotExist(err))
+		assert.Contains(err.Error(), "corrupt sequence")
+
+		// restarted from a random offset, which replaces the corrupt file
+		last := s.next()
+		assert.True(last > writerSeqRandomBase)
+		assert.Nil(s.save(false))
+		saved, err := readPayloadSeq(path)
+		assert.Nil(err)
+		assert.Equal(last, saved)
+	}
+}
+
+func TestPayloadSeqSaveUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-seq")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, writerSeqFile)
+
+	s, _ := newPayloadSeq(path)
+	s.next()
+	assert.Nil(s.save(false))
+	os.Remove(path)
+
+	// nothing assigned since the last save
+	assert.Nil(s.save(false))
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+	// but always written on exit
+	assert.Nil(s.save(true))
+	_, err = os.Stat(path)
+	assert.Nil(err)
+
+	// in memory only
+	s, err = newPayloadSeq("")
+	assert.Nil(err)
+	s.next()
+	assert.Nil(s.save(true))
+}
+
+func TestWriterPayloadSeq(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "trace-agent-seq")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	data := make(chan dataFromAPI, 2)
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.StateDir = dir
+
+	receive := func() uint64 {
+		select {
+		case received := <-data:
+			seq, err := strconv.ParseUint(received.header.Get(headerPayloadSeq), 10, 64)
+			assert.Nil(err)
+			return seq
+		case <-time.After(time.Second):
+			t.Fatal("did not receive the payload in time")
+		}
+		return 0
+	}
+
+	w := NewWriter(conf)
+	go w.Run()
+	w.inPayloads <- newTestPayload("test")
+	first := receive()
+	w.inPayloads <- newTestPayload("test")
+	assert.Equal(first+1, receive())
+	w.Stop()
+
+	saved, err := readPayloadSeq(filepath.Join(dir, writerSeqFile))
+	assert.Nil(err)
+	assert.Equal(first+1, saved)
+
+	// restarted
+	w = NewWriter(conf)
+	go w.Run()
+	w.inPayloads <- newTestPayload("test")
+	assert.Equal(first+1+writerSeqGap+1, receive())
+	w.Stop()
+}
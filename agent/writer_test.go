@@ -1,16 +1,25 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/watch"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -137,6 +146,44 @@ receivingLoop:
 	assert.Equal(0, len(w.payloadBuffer))
 }
 
+func TestWriterInvalidPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 2)
+
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+
+	w := NewWriter(conf)
+	go w.Run()
+
+	invalid := newTestPayload("invalid")
+	invalid.HostName = ""
+	w.inPayloads <- invalid
+	w.inPayloads <- newTestPayload("test")
+
+	select {
+	case received := <-data:
+		gz, err := gzip.NewReader(strings.NewReader(received.body))
+		assert.Nil(err)
+		var payload model.AgentPayload
+		assert.Nil(json.NewDecoder(gz).Decode(&payload))
+		assert.Equal("test", payload.Env)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the valid payload in time")
+	}
+
+	w.Stop()
+
+	// the invalid payload is dropped, not buffered
+	assert.Len(data, 0)
+	assert.Equal(0, len(w.payloadBuffer))
+}
+
 func TestWriterPayloadErrors(t *testing.T) {
 	assert := assert.New(t)
 
@@ -188,6 +235,129 @@ receivingLoop:
 	assert.Equal("key500", endpoint.apiKeys[0])
 }
 
+func TestWriterRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultData := make(chan dataFromAPI, 1)
+	defaultServer := newTestServer(t, defaultData)
+	defer defaultServer.Close()
+
+	paymentsData := make(chan dataFromAPI, 1)
+	paymentsServer := newTestServer(t, paymentsData)
+	defer paymentsServer.Close()
+
+	searchServer := newFailingTestServer(t, http.StatusInternalServerError)
+	defer searchServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{defaultServer.URL}
+	conf.APIKeys = []string{"key"}
+	conf.RoutingTag = "team"
+	conf.Routes = []config.Route{
+		{Value: "payments", Endpoint: paymentsServer.URL, APIKey: "key_payments"},
+		{Value: "search", Endpoint: searchServer.URL, APIKey: "key_search"},
+	}
+
+	w := NewWriter(conf)
+	go w.Run()
+
+	p := newTestPayload("test")
+	for _, team := range []string{"payments", "search"} {
+		span := fixtures.TestSpan()
+		span.Meta = map[string]string{"team": team}
+		p.Traces = append(p.Traces, model.Trace{span})
+	}
+	w.inPayloads <- p
+
+	// the failing route must not prevent the others from being flushed
+	for _, data := range []chan dataFromAPI{defaultData, paymentsData} {
+		select {
+		case <-data:
+		case <-time.After(time.Second):
+			t.Fatal("did not receive payload in time")
+		}
+	}
+
+	w.Stop()
+
+	// only the payload of the failing route is kept to be retried
+	if assert.Len(w.payloadBuffer, 1) {
+		p0 := w.payloadBuffer[0]
+		assert.Equal([]string{"key_search"}, p0.endpoint.(*APIEndpoint).apiKeys)
+		if assert.Len(p0.payload.Traces, 1) {
+			assert.Equal("search", p0.payload.Traces[0][0].Meta["team"])
+		}
+	}
+}
+
+func TestWriterSplitPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	// an intake with a route per content, the stats one failing
+	data := make(chan dataFromAPI, 10)
+	received := newTestServer(t, data)
+	defer received.Close()
+	mux := http.NewServeMux()
+	for _, path := range []string{"/api/v0.2/traces", "/custom/services", "/api/v0.1/collector"} {
+		mux.Handle(path, received.Config.Handler)
+	}
+	mux.HandleFunc("/api/v0.2/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APISplitPayloads = true
+	conf.APIServicesPath = "/custom/services"
+
+	w := NewWriter(conf)
+	w.inServices = make(chan model.ServicesMetadata)
+	go w.Run()
+
+	w.inPayloads <- newTestPayload("test")
+	select {
+	case d := <-data:
+		assert.Equal("/api/v0.2/traces", d.urlPath)
+		gz, err := gzip.NewReader(strings.NewReader(d.body))
+		assert.Nil(err)
+		var p model.AgentPayload
+		assert.Nil(json.NewDecoder(gz).Decode(&p))
+		assert.Equal("test.host", p.HostName)
+		assert.Len(p.Traces, 1)
+		assert.Len(p.Stats, 0)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the traces in time")
+	}
+
+	w.inServices <- model.ServicesMetadata{"mcnulty": {"app_type": "web"}}
+	select {
+	case d := <-data:
+		assert.Equal("/custom/services", d.urlPath)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the services in time")
+	}
+
+	w.Stop()
+
+	// only the stats are kept to be retried, on their own route
+	if assert.Len(w.payloadBuffer, 1) {
+		p := w.payloadBuffer[0]
+		assert.Equal(contentStats, p.content)
+		assert.Len(p.payload.Traces, 0)
+		assert.Len(p.payload.Stats, 1)
+		path, _ := p.endpoint.(*APIEndpoint).paths.payload(&p.payload)
+		assert.Equal("/api/v0.2/stats", path)
+	}
+	select {
+	case d := <-data:
+		t.Fatalf("unexpected request to %s", d.urlPath)
+	default:
+	}
+}
+
 func TestWriterBuffering(t *testing.T) {
 	assert := assert.New(t)
 
@@ -258,3 +428,638 @@ func TestWriterDisabledBuffering(t *testing.T) {
 	// dropped and the buffer should be empty.
 	assert.Equal(0, len(w.payloadBuffer))
 }
+
+// rateLimitedTestEndpoint is an AgentEndpoint whose intake is about to rate
+// limit when low is true
+type rateLimitedTestEndpoint struct {
+	NullEndpoint
+	low    bool
+	writes int
+}
+
+func (e *rateLimitedTestEndpoint) Write(p model.AgentPayload) (int, error) {
+	r, err := e.WriteResult(p)
+	return r.size, err
+}
+
+func (e *rateLimitedTestEndpoint) WriteResult(p model.AgentPayload) (writeResult, error) {
+	e.writes++
+	return writeResult{rateLimitLow: e.low}, nil
+}
+
+func TestWriterFlushLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	w := NewWriter(conf)
+	endpoint := &rateLimitedTestEndpoint{low: true}
+
+	buffer := func(n int) {
+		for i := 0; i < n; i++ {
+			w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload("test"), endpoint))
+		}
+	}
+	flush := func() int {
+		endpoint.writes = 0
+		w.Flush()
+		return endpoint.writes
+	}
+
+	// not limited until the intake says so
+	buffer(10)
+	assert.Equal(10, flush())
+	assert.Equal(5, w.flushLimit)
+
+	buffer(10)
+	assert.Equal(5, flush())
+	assert.Len(w.payloadBuffer, 5)
+	assert.Equal(2, w.flushLimit)
+
+	// the limit goes back up once the intake is fine
+	endpoint.low = false
+	assert.Equal(2, flush())
+	assert.Equal(4, w.flushLimit)
+	assert.Equal(3, flush())
+	assert.Len(w.payloadBuffer, 0)
+	assert.Equal(8, w.flushLimit)
+
+	// nothing written, nothing learnt
+	assert.Equal(0, flush())
+	assert.Equal(8, w.flushLimit)
+
+	for _, limit := range []int{16, 32, 64, 0} {
+		buffer(1)
+		assert.Equal(1, flush())
+		assert.Equal(limit, w.flushLimit)
+	}
+
+	// never below one payload per flush
+	endpoint.low = true
+	buffer(1)
+	assert.Equal(1, flush())
+	assert.Equal(1, w.flushLimit)
+	buffer(2)
+	assert.Equal(1, flush())
+	assert.Equal(1, w.flushLimit)
+}
+
+func TestWriterConcurrentSends(t *testing.T) {
+	assert := assert.New(t)
+
+	var inFlight, maxInFlight, requests int32
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		// a slow intake
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIMaxConcurrentSends = 2
+	w := NewWriter(conf)
+
+	for _, env := range []string{"p0", "p1", "p2", "p3", "p4"} {
+		w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload(env), w.endpoint))
+	}
+	start := time.Now()
+	w.Flush()
+	elapsed := time.Since(start)
+
+	assert.EqualValues(5, atomic.LoadInt32(&requests))
+	assert.EqualValues(2, atomic.LoadInt32(&maxInFlight))
+	assert.True(elapsed < 500*time.Millisecond, "payloads were not sent concurrently: %v", elapsed)
+	assert.Len(w.payloadBuffer, 0)
+	api := w.endpoint.(*APIEndpoint)
+	assert.EqualValues(5, atomic.LoadInt64(&api.stats.TracesPayload))
+	assert.EqualValues(5, atomic.LoadInt64(&api.stats.TracesCount))
+
+	// failed payloads are kept in the order they were flushed in
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	for _, env := range []string{"p5", "p6", "p7", "p8"} {
+		w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload(env), w.endpoint))
+	}
+	w.Flush()
+	var envs []string
+	for _, p := range w.payloadBuffer {
+		envs = append(envs, p.payload.Env)
+	}
+	assert.Equal([]string{"p5", "p6", "p7", "p8"}, envs)
+	assert.EqualValues(9, atomic.LoadInt32(&requests))
+	assert.EqualValues(2, atomic.LoadInt32(&maxInFlight))
+}
+
+// slowResultEndpoint is an AgentEndpoint which takes its time to write
+// payloads, the intake being about to rate limit only those of env "low"
+type slowResultEndpoint struct {
+	NullEndpoint
+}
+
+func (e slowResultEndpoint) WriteResult(p model.AgentPayload) (writeResult, error) {
+	encodeTime := 10 * time.Millisecond
+	if p.Env == "low" {
+		encodeTime = 20 * time.Millisecond
+	}
+	time.Sleep(encodeTime)
+	return writeResult{encodeTime: encodeTime, rateLimitLow: p.Env == "low"}, nil
+}
+
+func TestWriterConcurrentResults(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	conf.APIMaxConcurrentSends = 2
+	w := NewWriter(conf)
+
+	// written at the same time, each payload keeps the result of its own write
+	var payloads []*writerPayload
+	for _, env := range []string{"low", "ok"} {
+		payloads = append(payloads, newWriterPayload(newTestPayload(env), slowResultEndpoint{}))
+	}
+	errs := w.writePayloads(payloads)
+	assert.Equal([]error{nil, nil}, errs)
+	if assert.NotNil(payloads[0].result) && assert.NotNil(payloads[1].result) {
+		assert.True(payloads[0].result.rateLimitLow)
+		assert.Equal(20*time.Millisecond, payloads[0].result.encodeTime)
+		assert.False(payloads[1].result.rateLimitLow)
+		assert.Equal(10*time.Millisecond, payloads[1].result.encodeTime)
+	}
+
+	// limited, though the payload told so is not the last one written
+	w.payloadBuffer = payloads
+	w.Flush()
+	assert.Equal(1, w.flushLimit)
+}
+
+func TestWriterAuthFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	status := int32(http.StatusForbidden)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	newWriter := func(mode string) (*Writer, string) {
+		dir, err := ioutil.TempDir("", "trace-agent-payloads")
+		assert.Nil(err)
+		conf := config.NewDefaultAgentConfig()
+		conf.APIEndpoints = []string{server.URL}
+		conf.APIKeys = []string{"invalid"}
+		conf.APIMaxConcurrentSends = 1
+		conf.APIAuthFailure = mode
+		conf.APILocalDir = dir
+		w := NewWriter(conf)
+		w.endpoint.(*APIEndpoint).auth.now = clock.now
+		atomic.StoreInt32(&requests, 0)
+		return w, dir
+	}
+	flush := func(w *Writer, envs ...string) {
+		for _, env := range envs {
+			w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(newTestPayload(env), w.endpoint))
+		}
+		// retry the buffered payloads right away
+		for _, p := range w.payloadBuffer {
+			p.nextFlush = time.Time{}
+		}
+		w.Flush()
+	}
+	localFiles := func(dir string) []string {
+		infos, err := ioutil.ReadDir(dir)
+		assert.Nil(err)
+		var names []string
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+
+	// the payloads are dropped, the endpoint only being probed every minute
+	w, dir := newWriter(config.AuthFailureDrop)
+	defer os.RemoveAll(dir)
+	flush(w, "p0")
+	flush(w, "p1", "p2")
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+	assert.Len(w.payloadBuffer, 0)
+	clock.advance(authProbeInterval)
+	flush(w, "p3", "p4")
+	assert.EqualValues(2, atomic.LoadInt32(&requests))
+	assert.Len(localFiles(dir), 0)
+
+	// the payloads are retried until the API key is accepted
+	w, dir = newWriter(config.AuthFailureBuffer)
+	defer os.RemoveAll(dir)
+	flush(w, "p0", "p1")
+	flush(w)
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+	if assert.Len(w.payloadBuffer, 2) {
+		// the size of payloads never sent still bounds the buffer
+		assert.True(w.payloadBuffer[1].size > 0)
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	clock.advance(authProbeInterval)
+	flush(w)
+	assert.EqualValues(3, atomic.LoadInt32(&requests))
+	assert.Len(w.payloadBuffer, 0)
+
+	// the payloads are written to the local directory
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	w, dir = newWriter(config.AuthFailureLocal)
+	defer os.RemoveAll(dir)
+	flush(w, "p0", "p1")
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+	assert.Len(w.payloadBuffer, 0)
+	files := localFiles(dir)
+	if assert.Len(files, 2) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, files[1]))
+		assert.Nil(err)
+		var p model.AgentPayload
+		assert.Nil(json.Unmarshal(data, &p))
+		assert.Equal("p1", p.Env)
+	}
+
+	// without API key, all the payloads are written locally
+	conf := config.NewDefaultAgentConfig()
+	conf.APIAuthFailure = config.AuthFailureLocal
+	conf.APILocalDir = dir
+	w = NewWriter(conf)
+	flush(w, "p2")
+	assert.Len(localFiles(dir), 3)
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+}
+
+// recordingTestEndpoint is an AgentEndpoint keeping the payloads written
+type recordingTestEndpoint struct {
+	NullEndpoint
+	mu       sync.Mutex
+	payloads []model.AgentPayload
+}
+
+func (e *recordingTestEndpoint) Write(p model.AgentPayload) (int, error) {
+	e.mu.Lock()
+	e.payloads = append(e.payloads, p)
+	e.mu.Unlock()
+	return 0, nil
+}
+
+func TestWriterCoalesceStats(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	w := NewWriter(conf)
+	endpoint := &recordingTestEndpoint{}
+
+	// the window of the fixture bucket is flushed in 2 parts, along with a
+	// bucket of the next window
+	single := fixtures.TestStatsBucket()
+	early := newTestPayload("test")
+	late := newTestPayload("test")
+	next := model.NewStatsRawBucket(single.Start+single.Duration, single.Duration)
+	next.HandleSpan(fixtures.TestSpan(), "test", nil, 1, nil)
+	late.Stats = append(late.Stats, next.Export())
+	// a payload already written once is not merged into
+	retried := newWriterPayload(newTestPayload("test"), endpoint)
+	retried.nextFlush = w.clock.Now().Add(-time.Second)
+
+	w.payloadBuffer = []*writerPayload{retried, newWriterPayload(early, endpoint), newWriterPayload(late, endpoint)}
+	w.Flush()
+
+	// payloads are written concurrently, tell them apart by their hits
+	if !assert.Len(endpoint.payloads, 3) {
+		t.FailNow()
+	}
+	byHits := make(map[float64]model.AgentPayload)
+	for _, p := range endpoint.payloads {
+		assert.Len(p.Stats, 1)
+		assert.Len(p.Traces, 1)
+		var hits float64
+		for _, c := range p.Stats[0].Counts {
+			if c.Measure == model.HITS {
+				hits += c.Value
+			}
+		}
+		byHits[hits] = p
+	}
+	merged, ok := byHits[2]
+	if !assert.True(ok, "no merged bucket") {
+		t.FailNow()
+	}
+	assert.Equal(single.Start, merged.Stats[0].Start)
+	for k, c := range single.Counts {
+		assert.Equal(2*c.Value, merged.Stats[0].Counts[k].Value, k)
+	}
+	for k, d := range single.Distributions {
+		assert.Equal(2*d.Summary.N, merged.Stats[0].Distributions[k].Summary.N, k)
+	}
+
+	// the retried payload and the next window are left alone
+	var starts []int64
+	for _, p := range endpoint.payloads {
+		starts = append(starts, p.Stats[0].Start)
+	}
+	assert.Contains(starts, single.Start+single.Duration)
+	assert.Len(byHits, 2)
+}
+
+func newBatchTestWriter(maxPayloads int) (*Writer, *watch.FakeClock) {
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	conf.APIFlushBatchMaxPayloads = maxPayloads
+	conf.APIFlushBatchMaxWait = 30 * time.Second
+	w := NewWriter(conf)
+	clock := watch.NewFakeClock(time.Now())
+	w.clock = clock
+	return w, clock
+}
+
+func TestWriterBatchByCount(t *testing.T) {
+	assert := assert.New(t)
+
+	w, _ := newBatchTestWriter(3)
+	endpoint := &recordingTestEndpoint{}
+	add := func(env string) []*writerPayload {
+		return w.batch([]*writerPayload{newWriterPayload(newTestPayload(env), endpoint)})
+	}
+
+	assert.Len(add("test"), 0)
+	assert.Len(add("test"), 0)
+	// payloads of another env are not sent with them
+	assert.Len(add("other"), 0)
+	ready := add("test")
+	if !assert.Len(ready, 1) {
+		t.FailNow()
+	}
+	assert.Len(ready[0].payload.Traces, 3)
+	assert.Len(ready[0].payload.Stats, 3)
+	assert.Len(w.batches, 1)
+
+	// the batch is a single request, its buckets of the same window merged
+	w.payloadBuffer = ready
+	w.Flush()
+	if !assert.Len(endpoint.payloads, 1) {
+		t.FailNow()
+	}
+	assert.Equal("test", endpoint.payloads[0].Env)
+	assert.Len(endpoint.payloads[0].Traces, 3)
+	assert.Len(endpoint.payloads[0].Stats, 1)
+}
+
+func TestWriterBatchByWait(t *testing.T) {
+	assert := assert.New(t)
+
+	w, clock := newBatchTestWriter(10)
+	endpoint := &recordingTestEndpoint{}
+	first := newWriterPayload(newTestPayload("test"), endpoint)
+	assert.Len(w.batch([]*writerPayload{first}), 0)
+	clock.Advance(20 * time.Second)
+	assert.Len(w.batch([]*writerPayload{newWriterPayload(newTestPayload("test"), endpoint)}), 0)
+	assert.Len(w.batch([]*writerPayload{newWriterPayload(newTestPayload("other"), endpoint)}), 0)
+	assert.Len(w.releaseBatches(false), 0)
+
+	// the wait starts with the first payload of the batch
+	clock.Advance(10 * time.Second)
+	ready := w.releaseBatches(false)
+	if !assert.Len(ready, 1) {
+		t.FailNow()
+	}
+	assert.Equal("test", ready[0].payload.Env)
+	assert.Len(ready[0].payload.Traces, 2)
+	// and the batch is retried as its first payload, keeping its creation date
+	assert.True(ready[0] == first)
+
+	// all the batches are released on exit
+	ready = w.releaseBatches(true)
+	if !assert.Len(ready, 1) {
+		t.FailNow()
+	}
+	assert.Equal("other", ready[0].payload.Env)
+	assert.Len(w.batches, 0)
+}
+
+func TestWriterBatchBypass(t *testing.T) {
+	assert := assert.New(t)
+
+	w, _ := newBatchTestWriter(10)
+	endpoint := &recordingTestEndpoint{}
+
+	traced := newWriterPayload(newTestPayload("test"), endpoint)
+	traced.trace = newFlushTrace(w.clock.Now())
+	large := newTestPayload("test")
+	span := fixtures.TestSpan()
+	span.Resource = strings.Repeat("a", batchedPayloadMaxSize)
+	large.Traces = append(large.Traces, model.Trace{span})
+
+	ready := w.batch([]*writerPayload{traced, newWriterPayload(large, endpoint), newWriterPayload(newTestPayload("test"), endpoint)})
+	if !assert.Len(ready, 2) {
+		t.FailNow()
+	}
+	assert.True(ready[0] == traced)
+	assert.Len(ready[1].payload.Traces, 2)
+	assert.Len(w.batches, 1)
+
+	// without batching, payloads are all sent on their own
+	w, _ = newBatchTestWriter(1)
+	assert.Len(w.batch([]*writerPayload{newWriterPayload(newTestPayload("test"), endpoint)}), 1)
+	assert.Len(w.batches, 0)
+}
+
+func TestWriterPartialStats(t *testing.T) {
+	for _, mode := range []string{config.PartialFlushDrop, config.PartialFlushFlag} {
+		assert := assert.New(t)
+
+		conf := config.NewDefaultAgentConfig()
+		conf.APIKeys = []string{"key"}
+		conf.PartialFlushMode = mode
+		w := NewWriter(conf)
+		endpoint := &recordingTestEndpoint{}
+		w.endpoint = endpoint
+		w.Run()
+
+		// the bucket the agent started in, and the next one
+		complete := fixtures.TestStatsBucket()
+		srb := model.NewStatsRawBucket(complete.Start-complete.Duration, complete.Duration)
+		srb.HandleSpan(fixtures.TestSpan(), "test", nil, 1, nil)
+		partial := srb.Export()
+		partial.Partial = true
+
+		both := newTestPayload("both")
+		both.Stats = []model.StatsBucket{partial, complete}
+		w.inPayloads <- both
+		w.inPayloads <- model.AgentPayload{HostName: "test.host", Env: "partial only", Stats: []model.StatsBucket{partial}}
+		w.inPayloads <- newTestPayload("last")
+
+		expected := 2
+		if mode == config.PartialFlushFlag {
+			expected = 3
+		}
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			endpoint.mu.Lock()
+			n := len(endpoint.payloads)
+			endpoint.mu.Unlock()
+			if n >= expected {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		w.Stop()
+
+		byEnv := make(map[string]model.AgentPayload)
+		for _, p := range endpoint.payloads {
+			byEnv[p.Env] = p
+		}
+		assert.Len(byEnv, expected, mode)
+		if mode == config.PartialFlushDrop {
+			assert.Len(byEnv["both"].Stats, 1)
+			assert.False(byEnv["both"].Stats[0].Partial)
+			assert.NotContains(byEnv, "partial only")
+		} else {
+			assert.Len(byEnv["both"].Stats, 2)
+			assert.True(byEnv["partial only"].Stats[0].Partial)
+		}
+		assert.Len(byEnv["last"].Stats, 1)
+	}
+}
+
+func TestDropPartialStats(t *testing.T) {
+	assert := assert.New(t)
+
+	partial := fixtures.TestStatsBucket()
+	partial.Partial = true
+	complete := fixtures.TestStatsBucket()
+	stats := []model.StatsBucket{partial, complete}
+
+	kept := dropPartialStats(stats)
+	assert.Len(kept, 1)
+	assert.False(kept[0].Partial)
+	// the payload is shared, its stats must stay the same
+	assert.Len(stats, 2)
+	assert.True(stats[0].Partial)
+	assert.False(stats[1].Partial)
+}
+
+func TestWriterFlushJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	assert.Equal(time.Duration(0), flushJitter(conf))
+
+	// stable per host, spread over the first half of the bucket interval
+	conf.APIFlushJitterAuto = true
+	offsets := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		conf.HostName = fmt.Sprintf("host-%d", i)
+		jitter := flushJitter(conf)
+		assert.Equal(jitter, flushJitter(conf))
+		assert.True(jitter >= 0 && jitter < conf.BucketInterval/2, "%s", jitter)
+		offsets[jitter] = true
+	}
+	assert.True(len(offsets) > 90)
+
+	// fixed offsets are capped
+	conf.APIFlushJitterAuto = false
+	conf.APIFlushJitter = 3 * time.Second
+	assert.Equal(3*time.Second, flushJitter(conf))
+	conf.APIFlushJitter = time.Minute
+	assert.Equal(conf.BucketInterval/2, flushJitter(conf))
+}
+
+func TestWriterSendTime(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = []string{"key"}
+	conf.APIFlushJitter = 5 * time.Second
+	w := NewWriter(conf)
+	// aligned on a bucket interval
+	start := time.Unix(1500000000, 0)
+	clock := watch.NewFakeClock(start.Add(time.Second))
+	w.clock = clock
+
+	assert.Equal(start.Add(5*time.Second), w.sendTime(start.Add(time.Second)))
+	assert.Equal(start.Add(5*time.Second), w.sendTime(start.Add(5*time.Second)))
+	assert.Equal(start.Add(15*time.Second), w.sendTime(start.Add(7*time.Second)))
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		now := start.Add(time.Duration(r.Int63n(int64(time.Hour))))
+		at := w.sendTime(now)
+		assert.Equal(int64(5*time.Second), at.UnixNano()%int64(conf.BucketInterval))
+		assert.False(at.Before(now))
+		assert.True(at.Sub(now) < conf.BucketInterval)
+	}
+
+	// the payload waits for its offset, and is sent unchanged
+	endpoint := &recordingTestEndpoint{}
+	p := newTestPayload("test")
+	w.bufferPayloads([]*writerPayload{newWriterPayload(p, endpoint)})
+	w.Flush()
+	assert.Len(endpoint.payloads, 0)
+	assert.Len(w.payloadBuffer, 1)
+	clock.Advance(3 * time.Second)
+	w.Flush()
+	assert.Len(endpoint.payloads, 0)
+	clock.Advance(time.Second)
+	w.Flush()
+	if assert.Len(endpoint.payloads, 1) {
+		sent := endpoint.payloads[0]
+		assert.Equal(p.Stats, sent.Stats)
+		assert.Equal(p.Traces, sent.Traces)
+	}
+	assert.Len(w.payloadBuffer, 0)
+
+	// without jitter, right away
+	w.flushJitter = 0
+	w.bufferPayloads([]*writerPayload{newWriterPayload(newTestPayload("test"), endpoint)})
+	w.Flush()
+	assert.Len(endpoint.payloads, 2)
+}
+
+func TestWriterFlushJitterExit(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	conf.APIFlushJitter = 5 * time.Second
+	w := NewWriter(conf)
+	endpoint := &recordingTestEndpoint{}
+	w.endpoint = endpoint
+	clock := watch.NewFakeClock(time.Unix(1500000000, 0).Add(time.Second))
+	w.clock = clock
+
+	w.Run()
+	w.inPayloads <- newTestPayload("test")
+	for i := 0; atomic.LoadInt64(&w.bufferedPayload) == 0; i++ {
+		if i > 100 {
+			t.Fatal("payload not buffered in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	endpoint.mu.Lock()
+	assert.Len(endpoint.payloads, 0)
+	endpoint.mu.Unlock()
+
+	// sent right away on exit
+	w.Stop()
+	assert.Len(endpoint.payloads, 1)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// trimMeta returns the traces with the metadata of their spans trimmed, see
+// config.AgentConfig.TrimMeta, and reports the bytes trimmed by key
+func (w *Writer) trimMeta(traces []model.Trace) []model.Trace {
+	if len(w.conf.TrimMeta) == 0 {
+		return traces
+	}
+	traces, trimmed := trimTracesMeta(traces, w.conf.TrimMeta)
+	for key, n := range trimmed {
+		statsd.Client.Count("datadog.trace_agent.writer.trimmed_meta_bytes", n, []string{"key:" + key}, 1)
+	}
+	return traces
+}
+
+// trimTracesMeta applies the rules to the spans of the traces, apart from
+// their root, and returns the bytes trimmed by key. The error details are
+// never trimmed. The traces given are left as they are, being shared with the
+// sampler and the debug streams: the spans trimmed are copies, in copies of
+// their traces.
+func trimTracesMeta(traces []model.Trace, rules []config.MetaTrimRule) ([]model.Trace, map[string]int64) {
+	trimmed := make(map[string]int64)
+	out := make([]model.Trace, len(traces))
+	for i, t := range traces {
+		out[i] = t
+		root := t.GetRoot()
+		copied := false
+		for j := range t {
+			if root != nil && t[j].SpanID == root.SpanID {
+				continue
+			}
+			if !hasTrimmedMeta(&t[j], rules) {
+				continue
+			}
+			if !copied {
+				out[i] = append(model.Trace(nil), t...)
+				copied = true
+			}
+			s := &out[i][j]
+			meta := make(map[string]string, len(s.Meta))
+			for k, v := range s.Meta {
+				meta[k] = v
+			}
+			s.Meta = meta
+			for _, r := range rules {
+				if isErrorKey(r.Key) {
+					continue
+				}
+				if n := s.TrimMetaValue(r.Key, r.MaxLen); n > 0 {
+					trimmed[r.Key] += int64(n)
+				}
+			}
+		}
+	}
+	return out, trimmed
+}
+
+// hasTrimmedMeta tells if any of the rules trims the metadata of s
+func hasTrimmedMeta(s *model.Span, rules []config.MetaTrimRule) bool {
+	for _, r := range rules {
+		if isErrorKey(r.Key) {
+			continue
+		}
+		if v, ok := s.Meta[r.Key]; ok && (r.MaxLen == 0 || len(v) > r.MaxLen) {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrorKey(key string) bool {
+	return key == model.ErrorTypeKey || key == model.ErrorMsgKey || key == model.ErrorStackKey
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimTracesMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	query := strings.Repeat("SELECT ", 100)
+	meta := func() map[string]string {
+		return map[string]string{"sql.query": query, "http.headers": "accept: */*", "http.url": "/users"}
+	}
+	trace := model.Trace{
+		{TraceID: 1, SpanID: 1, Service: "web", Meta: meta()},
+		{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Meta: meta()},
+		{TraceID: 1, SpanID: 3, ParentID: 1, Service: "db", Error: 1,
+			Meta: map[string]string{model.ErrorMsgKey: query, model.ErrorStackKey: query, "sql.query": "SELECT 1"}},
+	}
+	untouched := model.Trace{{TraceID: 2, SpanID: 1, Service: "web", Meta: meta()}}
+	traces := []model.Trace{trace, untouched}
+
+	rules := []config.MetaTrimRule{
+		{Key: "sql.query", MaxLen: 64},
+		{Key: "http.headers", MaxLen: 0},
+		// never applied, as rejected by the config
+		{Key: model.ErrorMsgKey, MaxLen: 0},
+		{Key: model.ErrorStackKey, MaxLen: 10},
+	}
+	trimmed, bytes := trimTracesMeta(traces, rules)
+	if !assert.Len(trimmed, 2) {
+		return
+	}
+
+	// the root is exempt
+	assert.Equal(meta(), trimmed[0][0].Meta)
+	// the key is dropped with 0, the value shortened otherwise
+	assert.Equal(map[string]string{
+		"sql.query": query[:64-len(model.MetaTruncatedSuffix)] + model.MetaTruncatedSuffix,
+		"http.url":  "/users",
+	}, trimmed[0][1].Meta)
+	// the error details are kept
+	assert.Equal(trace[2].Meta, trimmed[0][2].Meta)
+	assert.Equal(query, trimmed[0][2].Meta[model.ErrorMsgKey])
+	assert.Equal(map[string]int64{
+		"sql.query":    int64(len(query) - 64),
+		"http.headers": int64(len("http.headers") + len("accept: */*")),
+	}, bytes)
+
+	// on copies, the traces of the sampler being left as they are
+	assert.Equal(meta(), trace[1].Meta)
+	assert.Equal(meta(), traces[0][1].Meta)
+	trimmed[0][2].Service = "changed"
+	assert.Equal("db", trace[2].Service)
+	// the traces without anything to trim are not copied
+	assert.True(&untouched[0] == &trimmed[1][0])
+}
+
+func TestWriterTrimMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	w := NewWriter(conf)
+	traces := []model.Trace{{
+		{TraceID: 1, SpanID: 1, Service: "web"},
+		{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Meta: map[string]string{"sql.query": "SELECT 1"}},
+	}}
+	// no rules, nothing copied
+	assert.True(&traces[0][0] == &w.trimMeta(traces)[0][0])
+
+	conf.TrimMeta = []config.MetaTrimRule{{Key: "sql.query"}}
+	trimmed := w.trimMeta(traces)
+	assert.Len(trimmed[0][1].Meta, 0)
+	assert.Equal("SELECT 1", traces[0][1].Meta["sql.query"])
+}
@@ -0,0 +1,294 @@
+// Package client submits spans to a trace agent, for Go programs which do not
+// embed a tracer. It only depends on the model package and the standard
+// library.
+//
+//	c, err := client.New("localhost:8126", client.WithEncoding(client.EncodingMsgpack))
+//	...
+//	defer c.Close()
+//	err = c.SubmitTrace(spans)
+//
+// Traces are buffered and sent in the background. Errors of the background
+// sends are reported to the handler given with WithErrorHandler.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// Encoding is the encoding of the traces sent to the agent, as its Content-Type
+type Encoding string
+
+// Encodings of the traces accepted by the agent
+const (
+	EncodingJSON    Encoding = "application/json"
+	EncodingMsgpack Encoding = "application/msgpack"
+)
+
+const (
+	// tracesPath is the endpoint of the agent receiving the traces
+	tracesPath = "/v0.4/traces"
+	// headerTraceCount tells the agent how many traces a payload holds, so
+	// that they are accounted for if it cannot be decoded
+	headerTraceCount = "X-Datadog-Trace-Count"
+
+	defaultFlushInterval = time.Second
+	defaultBufferSize    = 1000
+	defaultTimeout       = 10 * time.Second
+)
+
+var (
+	// ErrClosed is returned when submitting traces to a closed client
+	ErrClosed = errors.New("client closed")
+	// ErrBufferFull is returned when a trace is submitted while the buffer
+	// is full, the trace is then dropped
+	ErrBufferFull = errors.New("trace buffer full")
+	// ErrEmptyTrace is returned when submitting a trace without spans
+	ErrEmptyTrace = errors.New("empty trace")
+)
+
+// Client submits traces to an agent. Its methods can be called from several
+// goroutines.
+type Client struct {
+	url           string // of the traces endpoint
+	http          *http.Client
+	encoding      Encoding
+	gzip          bool
+	flushInterval time.Duration
+	bufferSize    int         // traces buffered, a flush is started when reached
+	onError       func(error) // called with the errors of the background sends
+
+	mu     sync.Mutex
+	buffer model.Traces
+	closed bool
+
+	flush chan struct{}
+	exit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Option configures a Client, see New
+type Option func(*Client)
+
+// WithEncoding sets the encoding of the traces, JSON by default
+func WithEncoding(e Encoding) Option {
+	return func(c *Client) { c.encoding = e }
+}
+
+// WithGzip gzips the traces sent
+func WithGzip() Option {
+	return func(c *Client) { c.gzip = true }
+}
+
+// WithFlushInterval sets how often the buffered traces are sent, every second
+// by default
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *Client) { c.flushInterval = d }
+}
+
+// WithBufferSize sets the number of traces buffered, a flush is started when
+// they are reached. 1000 by default.
+func WithBufferSize(n int) Option {
+	return func(c *Client) { c.bufferSize = n }
+}
+
+// WithErrorHandler sets the function called with the errors of the background
+// sends, which are otherwise ignored. It must not block.
+func WithErrorHandler(f func(error)) Option {
+	return func(c *Client) { c.onError = f }
+}
+
+// WithHTTPClient sets the HTTP client sending the traces. By default, it keeps
+// a couple of connections to the agent open.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+// New returns a client sending traces to the agent at addr, its host and port
+// or its URL, and starts sending the traces submitted in the background.
+func New(addr string, opts ...Option) (*Client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in agent address %q", addr)
+	}
+	u.Path = tracesPath
+
+	c := &Client{
+		url:           u.String(),
+		encoding:      EncodingJSON,
+		flushInterval: defaultFlushInterval,
+		bufferSize:    defaultBufferSize,
+		flush:         make(chan struct{}, 1),
+		exit:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	switch c.encoding {
+	case EncodingJSON, EncodingMsgpack:
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", c.encoding)
+	}
+	if c.flushInterval <= 0 || c.bufferSize <= 0 {
+		return nil, errors.New("flush interval and buffer size must be positive")
+	}
+	if c.http == nil {
+		c.http = &http.Client{
+			Timeout: defaultTimeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// SubmitTrace buffers the spans of a trace to send them to the agent. It
+// returns ErrBufferFull, dropping the trace, when the traces are submitted
+// faster than they are sent.
+func (c *Client) SubmitTrace(spans []model.Span) error {
+	if len(spans) == 0 {
+		return ErrEmptyTrace
+	}
+	trace := make(model.Trace, len(spans))
+	copy(trace, spans)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if len(c.buffer) >= c.bufferSize {
+		c.mu.Unlock()
+		return ErrBufferFull
+	}
+	c.buffer = append(c.buffer, trace)
+	full := len(c.buffer) >= c.bufferSize
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.flush <- struct{}{}:
+		default:
+			// a flush is already pending
+		}
+	}
+	return nil
+}
+
+// Flush sends the buffered traces now, and returns the error of the send
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	traces := c.buffer
+	c.buffer = nil
+	c.mu.Unlock()
+
+	if len(traces) == 0 {
+		return nil
+	}
+	return c.send(traces)
+}
+
+// Close stops the background sends and sends the buffered traces, returning
+// the error of the send. Traces can no longer be submitted.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.exit)
+	c.wg.Wait()
+	return c.Flush()
+}
+
+func (c *Client) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flush:
+		case <-c.exit:
+			return
+		}
+		if err := c.Flush(); err != nil && c.onError != nil {
+			c.onError(err)
+		}
+	}
+}
+
+// send writes traces to the agent in a single request
+func (c *Client) send(traces model.Traces) error {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var gz *gzip.Writer
+	if c.gzip {
+		gz = gzip.NewWriter(&body)
+		w = gz
+	}
+
+	var err error
+	if c.encoding == EncodingMsgpack {
+		err = traces.WriteMsgpack(w)
+	} else {
+		err = json.NewEncoder(w).Encode(traces)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot encode %d traces: %v", len(traces), err)
+	}
+
+	req, err := http.NewRequest("POST", c.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(c.encoding))
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set(headerTraceCount, strconv.Itoa(len(traces)))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot send %d traces: %v", len(traces), err)
+	}
+	// read the response through, so that the connection is reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot send %d traces: agent responded %s", len(traces), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAgent records the traces it receives
+type testAgent struct {
+	mu       sync.Mutex
+	requests int
+	traces   model.Traces
+	headers  []http.Header
+	status   int
+}
+
+func (a *testAgent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	var traces model.Traces
+	dec := model.NewDecoderPool(1).Borrow(req.Header.Get("Content-Type"))
+	if _, err := dec.Decode(body, &traces); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests++
+	a.traces = append(a.traces, traces...)
+	a.headers = append(a.headers, req.Header)
+	if a.status != 0 {
+		w.WriteHeader(a.status)
+	}
+}
+
+func (a *testAgent) received() (int, model.Traces) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests, a.traces
+}
+
+func testTrace(id uint64) []model.Span {
+	return []model.Span{
+		{TraceID: id, SpanID: 1, Service: "tool", Name: "run", Resource: "backup", Start: model.Now(), Duration: 1000},
+		{TraceID: id, SpanID: 2, ParentID: 1, Service: "tool", Name: "upload", Resource: "s3", Start: model.Now(), Duration: 500},
+	}
+}
+
+func TestClientEncodings(t *testing.T) {
+	for _, opts := range [][]Option{
+		nil,
+		{WithGzip()},
+		{WithEncoding(EncodingMsgpack)},
+		{WithEncoding(EncodingMsgpack), WithGzip()},
+	} {
+		assert := assert.New(t)
+
+		agent := &testAgent{}
+		server := httptest.NewServer(agent)
+		c, err := New(server.URL, opts...)
+		if !assert.Nil(err) {
+			t.FailNow()
+		}
+		assert.Nil(c.SubmitTrace(testTrace(1)))
+		assert.Nil(c.SubmitTrace(testTrace(2)))
+		assert.Nil(c.Close())
+		server.Close()
+
+		requests, traces := agent.received()
+		assert.Equal(1, requests)
+		if assert.Len(traces, 2) {
+			assert.Equal("s3", traces[0][1].Resource)
+			assert.Equal(uint64(2), traces[1][0].TraceID)
+		}
+		assert.Equal("2", agent.headers[0].Get(headerTraceCount))
+		assert.Equal(ErrClosed, c.SubmitTrace(testTrace(3)))
+	}
+}
+
+func TestClientBackgroundFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	agent := &testAgent{}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	waitTraces := func(n int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, traces := agent.received(); len(traces) >= n {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, traces := agent.received()
+		assert.Len(traces, n)
+	}
+
+	// the buffer is flushed once full
+	full, err := New(server.URL, WithBufferSize(2), WithFlushInterval(time.Hour))
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer full.Close()
+	assert.Nil(full.SubmitTrace(testTrace(1)))
+	assert.Nil(full.SubmitTrace(testTrace(2)))
+	waitTraces(2)
+
+	// and every interval
+	ticking, err := New(server.URL, WithFlushInterval(20*time.Millisecond))
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer ticking.Close()
+	assert.Nil(ticking.SubmitTrace(testTrace(3)))
+	waitTraces(3)
+}
+
+func TestClientBufferFull(t *testing.T) {
+	assert := assert.New(t)
+
+	agent := &testAgent{}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	c, err := New(server.URL, WithBufferSize(1), WithFlushInterval(time.Hour))
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	// hold the buffer, as if the flush were behind
+	c.mu.Lock()
+	c.buffer = model.Traces{testTrace(1)}
+	c.mu.Unlock()
+	assert.Equal(ErrBufferFull, c.SubmitTrace(testTrace(2)))
+	assert.Equal(ErrEmptyTrace, c.SubmitTrace(nil))
+	assert.Nil(c.Close())
+
+	_, traces := agent.received()
+	assert.Len(traces, 1)
+}
+
+func TestClientErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	agent := &testAgent{status: http.StatusRequestEntityTooLarge}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	c, err := New(server.URL, WithFlushInterval(10*time.Millisecond), WithErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer c.Close()
+	assert.Nil(c.SubmitTrace(testTrace(1)))
+
+	select {
+	case err := <-errs:
+		assert.Contains(err.Error(), "413")
+	case <-time.After(2 * time.Second):
+		t.Fatal("no error reported")
+	}
+
+	// the explicit flushes return their error
+	assert.Nil(c.SubmitTrace(testTrace(2)))
+	if err := c.Flush(); assert.NotNil(err) {
+		assert.Contains(err.Error(), "cannot send 1 traces")
+	}
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := New("localhost:8126")
+	if assert.Nil(err) {
+		assert.Equal("http://localhost:8126/v0.4/traces", c.url)
+		c.Close()
+	}
+	_, err = New("http://")
+	assert.NotNil(err)
+	_, err = New("localhost:8126", WithEncoding("application/xml"))
+	assert.NotNil(err)
+	_, err = New("localhost:8126", WithBufferSize(0))
+	assert.NotNil(err)
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
@@ -15,6 +17,79 @@ import (
 	"github.com/go-ini/ini"
 )
 
+const (
+	// OutputAPI sends payloads to the Datadog API
+	OutputAPI = "api"
+	// OutputKafka sends payloads to a Kafka topic
+	OutputKafka = "kafka"
+	// OutputBoth sends payloads to both the Datadog API and a Kafka topic
+	OutputBoth = "both"
+)
+
+const (
+	// AuthFailureDrop drops the payloads an endpoint rejected the API key of
+	AuthFailureDrop = "drop"
+	// AuthFailureBuffer retries the payloads an endpoint rejected the API key
+	// of, within the limits of the payload buffer
+	AuthFailureBuffer = "buffer"
+	// AuthFailureLocal writes the payloads an endpoint rejected the API key
+	// of as JSON files, see AgentConfig.APILocalDir
+	AuthFailureLocal = "local"
+)
+
+const (
+	// PartialFlushDrop drops the stats buckets flagged as partial
+	PartialFlushDrop = "drop"
+	// PartialFlushFlag sends the stats buckets flagged as partial, see
+	// model.StatsBucket.Partial
+	PartialFlushFlag = "flag"
+)
+
+// PrecisionTier is the precision of the stats distributions of the services
+// sending fewer than Below spans per bucket, or any number of spans if Below is
+// 0, see AgentConfig.PrecisionTiers.
+type PrecisionTier struct {
+	Below   int64
+	Epsilon float64
+}
+
+// Route sends the traces and stats whose routing tag, see
+// AgentConfig.RoutingTag, has the given value to their own endpoint and API key.
+type Route struct {
+	Value    string
+	Endpoint string
+	APIKey   string `json:"-"` // never publish this
+}
+
+const (
+	// FilterScopeRoot matches the filter rules against the root span of traces
+	FilterScopeRoot = "root"
+	// FilterScopeAny matches the filter rules against all the spans of traces
+	FilterScopeAny = "any"
+)
+
+// TagRule matches the spans having the meta Key set to a value matching the
+// glob Pattern, where `*` matches any string and `?` any single character.
+type TagRule struct {
+	Key     string
+	Pattern string
+}
+
+// String returns the rule as written in the config, `<key>:<pattern>`
+func (r TagRule) String() string {
+	return r.Key + ":" + r.Pattern
+}
+
+// MetaTrimRule shortens the metadata value of Key of the spans to MaxLen
+// bytes, 0 dropping the key
+type MetaTrimRule struct {
+	Key    string
+	MaxLen int
+}
+
+// defaultLogFileMaxSize is the size above which log files are rotated (10MB)
+const defaultLogFileMaxSize = 10000000
+
 // AgentConfig handles the interpretation of the configuration (with default
 // behaviors) in one place. It is also a simple structure to share across all
 // the Agent components, with 100% safe and reliable values.
@@ -27,33 +102,257 @@ type AgentConfig struct {
 	HostName   string
 	DefaultEnv string // the traces will default to this environment
 
+	// GlobalTags are added to the metadata of all the spans which do not
+	// have them yet, and so are available to ExtraAggregators
+	GlobalTags map[string]string
+
 	// API
 	APIEndpoints            []string
 	APIKeys                 []string `json:"-"` // never publish this
 	APIEnabled              bool
 	APIPayloadBufferMaxSize int
+	APICompression          string // one of the model.Compression* codecs
+	APICompressionLevel     int    // specific to APICompression, 0 for its default level
+	APIMaxConcurrentSends   int    // payloads written at the same time to each endpoint
+	APIAuthFailure          string // one of AuthFailureDrop, AuthFailureBuffer or AuthFailureLocal
+	APILocalDir             string // where payloads are written with AuthFailureLocal
+	APILocalMaxSize         int    // size in bytes of the payloads kept in APILocalDir
+
+	// Connections to the intakes
+	APIMaxIdleConnsPerHost int           // idle connections kept to each intake
+	APIIdleConnTimeout     time.Duration // how long idle connections are kept
+	APIConnMaxLifetime     time.Duration // idle connections are closed this often, 0 to never recycle them
+	APIDisableKeepAlives   bool          // use a new connection for every request, for debugging
+
+	// Audit, a sample of the payloads sent is also written to APIAuditDir
+	APIAuditDir        string  // where a sample of the payloads sent is written, disabled when empty
+	APIAuditSampleRate float64 // fraction of the payloads written to APIAuditDir
+	APIAuditMaxSize    int     // size in bytes of the payloads kept in APIAuditDir
+
+	// Batching, small payloads are combined and sent in a single request
+	APIFlushBatchMaxPayloads int           // payloads combined in a batch, 0 or 1 to disable batching
+	APIFlushBatchMaxWait     time.Duration // how long the first payload of a batch waits for the others
+
+	// Jitter, the payloads are sent at the same offset into every bucket
+	// interval, so that a fleet of agents does not send them all at once
+	APIFlushJitter     time.Duration // the offset, 0 to send the payloads right away
+	APIFlushJitterAuto bool          // derive the offset from the host name instead
+
+	// Intake routes, with APISplitPayloads the traces and the stats of the
+	// payloads are sent apart, to APITracesPath and APIStatsPath
+	APISplitPayloads bool
+	APITracesPath    string
+	APIStatsPath     string
+	APIServicesPath  string
+
+	// Dry run, the payloads are encoded but never sent, see APIDryRunDir
+	APIDryRun            bool
+	APIDryRunDir         string // where the first payloads are written as JSON files, disabled when empty
+	APIDryRunMaxPayloads int    // payloads written to APIDryRunDir, from the start of the agent
+
+	// TrimMeta shortens or drops metadata values of the spans of the sampled
+	// traces when they are written, apart from their root and error details
+	TrimMeta []MetaTrimRule
+
+	// Output
+	OutputType        string // one of OutputAPI, OutputKafka or OutputBoth
+	KafkaBrokers      []string
+	KafkaTopic        string
+	KafkaRequiredAcks int // -1 to wait for all the in-sync replicas, 0 for none, 1 for the leader only
+	KafkaQueueSize    int // payloads waiting to be produced, above which they are dropped
+
+	// Routing
+	RoutingTag string  // meta key of the root span choosing the route of a trace, routing is disabled when empty
+	Routes     []Route // unmatched traces and stats go to APIEndpoints
+
+	// Filtering, before stats and sampling
+	FilterReject  []TagRule // traces matching any of these rules are dropped
+	FilterRequire []TagRule // if set, traces matching none of these rules are dropped
+	FilterScope   string    // one of FilterScopeRoot or FilterScopeAny
+
+	// ContainerTagging tags the spans and stats of payloads with the ID of
+	// the container which sent them, and the metadata of its pod
+	ContainerTagging bool
 
 	// Concentrator
 	BucketInterval   time.Duration // the size of our pre-aggregation per bucket
 	ExtraAggregators []string
+	MaxDistributions int // maximum number of distributions per stats bucket, 0 for no limit
+
+	// SkipFirstPartialBucket flags the buckets which started before the
+	// agent, and were not resumed from its state, as partial
+	SkipFirstPartialBucket bool
+	PartialFlushMode       string // one of PartialFlushDrop or PartialFlushFlag
+
+	// MaxDuration caps the durations of the spans, so that a clock bug
+	// does not skew the distributions. 0 for no limit.
+	MaxDuration          time.Duration
+	MaxDurationByService map[string]time.Duration // overrides MaxDuration, by service
+
+	// PrecisionTiers choose the precision of the distributions of each
+	// service from its recent number of spans per bucket, the first tier
+	// matching applies. The services above all tiers, or all of them if
+	// there are none, have the default precision, quantile.EPSILON.
+	PrecisionTiers []PrecisionTier
+
+	// DerivedWaitMetrics adds the distributions of how long the spans
+	// waited before their first child and after their last one, by service
+	DerivedWaitMetrics bool
+
+	// TopResources is the number of resources with the most hits and the
+	// highest p95 listed in each stats bucket, 0 for none
+	TopResources int
+	// QuantileBounds adds the bounds of the exact p95 to the top resources
+	QuantileBounds bool
+
+	// LatencyAlerts logs a warning for the duration distributions whose p95
+	// shifted by more than LatencyAlertFactor since the previous flush, both
+	// ways, with at least LatencyAlertMinHits values in both flushes
+	LatencyAlerts       bool
+	LatencyAlertFactor  float64
+	LatencyAlertMinHits int
 
 	// Sampler configuration
-	ExtraSampleRate float64
-	MaxTPS          float64
+	ExtraSampleRate  float64
+	MaxTPS           float64
+	MaxSpansPerTrace int   // traces with more spans are truncated before being sampled, 0 for no limit
+	MaxSamplerMemory int64 // bytes of the sampled traces kept until a flush, the biggest are evicted past it, 0 for no limit
+
+	// UniformSampleRate is the fraction of the traces kept by trace ID on top
+	// of the ones chosen by the sampler, the same traces as client tracers
+	// would keep at this rate. 0 to disable it.
+	UniformSampleRate float64
+
+	// DedupeWindowFlushes is the number of flushes during which the sampler
+	// skips the traces of the same shape as one it already kept, see
+	// Sampler.Add. 0 to disable it.
+	DedupeWindowFlushes int
+
+	// DecisionLogDir is where the sampler writes its decisions for every
+	// trace, one NDJSON file per flush, see Sampler.Flush. Disabled when
+	// empty. The oldest files are removed past DecisionLogMaxSize bytes.
+	DecisionLogDir     string
+	DecisionLogMaxSize int64
+
+	// Index hints
+	IndexedKeys    []string // meta keys promoted to the Indexed map of sampled spans
+	IndexedMaxKeys int      // above this number of matching keys, a span is not promoted
 
 	// Receiver
 	ReceiverHost    string
 	ReceiverPort    int
 	ConnectionLimit int // for rate-limiting, how many unique connections to allow in a lease period (30s)
-	ReceiverTimeout int
+	MaxMetaSize     int // budget in bytes for all the metadata of a span, 0 for no limit
+
+	// timeouts and header size limit of the receiver HTTP server, so that
+	// slow or broken clients cannot hold its connections
+	ReceiverReadTimeout    time.Duration // to read a whole request, body included
+	ReceiverWriteTimeout   time.Duration // to write the response, from the end of the request headers
+	ReceiverIdleTimeout    time.Duration // how long a keep-alive connection waits for the next request
+	ReceiverMaxHeaderBytes int
+
+	// ReceiverAcceptOversized decodes the trace payloads one trace at a time,
+	// accepting the traces of the payloads over the size limit up to it
+	// instead of rejecting them whole. ReceiverMaxTraceBytes is then the
+	// size of the largest trace accepted, 0 for the payload limit.
+	ReceiverAcceptOversized bool
+	ReceiverMaxTraceBytes   int64
+
+	// ReceiverAuthToken is the token the clients must send in the
+	// X-Datadog-Auth header of the trace intake requests, answered with a 401
+	// otherwise. Empty to disable, never published. ReceiverDebugAuth also
+	// requires it on the debug routes.
+	ReceiverAuthToken string `json:"-"`
+	ReceiverDebugAuth bool
+
+	// ReceiverSocket is the path of a unix socket the receiver also listens
+	// on, empty to disable. With ReceiverSocketSkipAuth, its requests need no
+	// token, the permissions of the socket restricting its clients.
+	ReceiverSocket         string
+	ReceiverSocketSkipAuth bool
+
+	// ClockSkewThreshold is the median delta between the end of the spans
+	// of a tracer and their reception above which its clock is reported as
+	// skewed, 0 to never report it
+	ClockSkewThreshold time.Duration
+
+	ReassemblyTimeout  time.Duration // how long spans of v0.1 clients wait for the rest of their trace
+	ReassemblyMaxSpans int           // spans waiting for their trace, above which the oldest traces are sent, 0 for no limit
+
+	// MaxTraceAssemblyDuration is how long a v0.1 trace can keep receiving
+	// spans before being sent in chunks, 0 for no limit
+	MaxTraceAssemblyDuration time.Duration
+
+	// DedupeCacheSize is the number of spans remembered to drop the ones
+	// clients send again when retrying a request, 0 to disable
+	DedupeCacheSize int
+
+	// PayloadChecksums rejects the trace payloads whose Content-MD5 or
+	// X-Datadog-Payload-Checksum header does not match their body
+	PayloadChecksums bool
+	// PayloadDedupeSize is the number of trace payload checksums remembered
+	// for a minute to drop the payloads received again as is, e.g. by
+	// middleboxes retransmitting requests, 0 to disable
+	PayloadDedupeSize int
+
+	// DebugMaxStreams is the number of clients which can stream the sampled
+	// traces from /debug/stream at the same time, 0 to disable it
+	DebugMaxStreams int
+
+	// ReceiverLogRequests logs every request of the receiver endpoints, with
+	// its status, size and latency, at debug level
+	ReceiverLogRequests bool
+
+	// DebugEnabled serves /debug/flush, which flushes the stats and the
+	// sampled traces on demand
+	DebugEnabled bool
+
+	// DebugAllowedOrigins are the origins of the browser pages allowed to
+	// query the /debug/ endpoints, by CORS, "*" for any. None by default.
+	DebugAllowedOrigins []string
 
 	// internal telemetry
-	StatsdHost string
-	StatsdPort int
+	StatsdHost  string
+	StatsdPort  int
+	SelfTracing bool // send a trace of each flush, of service "trace-agent", along with the other traces
+
+	// MetricsStatsdAddr is the dogstatsd address the distributions of the
+	// stats are sent to as distribution metrics, disabled when empty
+	MetricsStatsdAddr string
+
+	// TimersPort is the UDP port statsd timing metrics are received on, their
+	// values being added to the stats as the durations of spans, disabled
+	// when 0
+	TimersPort int
+	// TimersTags are the tags of the timing metrics holding the service,
+	// resource and env of their spans, by TimerTag* field
+	TimersTags map[string]string
+	// TimersMaxKeys is the number of distinct service, resource, name and env
+	// of the timing metrics, above which new ones are dropped
+	TimersMaxKeys int
 
 	// logging
-	LogLevel    string
-	LogFilePath string
+	LogLevel       string
+	LogFilePath    string
+	LogFormat      string // either "text" or "json"
+	LogFileMaxSize int    // size in bytes above which the log file is rotated
+
+	// StateDir is where state is saved on exit to be resumed after a restart,
+	// state persistence is disabled when empty
+	StateDir string
+
+	// StatsOnly only sends stats: no sampler runs and payloads carry no
+	// traces, for hosts with too many spans for traces to be worth sending
+	StatsOnly bool
+
+	// ResourceCacheSize is the number of quantized resources cached, the same
+	// queries being received over and over, 0 to quantize every resource
+	ResourceCacheSize int
+
+	// StrictConfig fails NewAgentConfig on the keys of the trace agent
+	// sections which are never read, rather than only logging them, see
+	// ErrUnknownKey
+	StrictConfig bool
 
 	// watchdog
 	MaxMemory        float64       // MaxMemory is the threshold (bytes allocated) above which program panics and exits, to be restarted
@@ -95,6 +394,12 @@ func mergeEnv(c *AgentConfig) {
 		}
 	}
 
+	if v := os.Getenv("DD_STRICT_CONFIG"); v == "true" {
+		c.StrictConfig = true
+	} else if v == "false" {
+		c.StrictConfig = false
+	}
+
 	if v := os.Getenv("DD_BIND_HOST"); v != "" {
 		c.StatsdHost = v
 		c.ReceiverHost = v
@@ -112,6 +417,22 @@ func mergeEnv(c *AgentConfig) {
 	if v := os.Getenv("DD_LOG_LEVEL"); v != "" {
 		c.LogLevel = v
 	}
+
+	if v := os.Getenv("DD_LOG_FORMAT"); v != "" {
+		c.LogFormat = parseLogFormat(v)
+	}
+}
+
+// parseLogFormat returns the log format matching v, defaulting to text
+func parseLogFormat(v string) string {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case LogFormatJSON:
+		return LogFormatJSON
+	case LogFormatText:
+	default:
+		log.Infof("unknown log_format %q, falling back to %s", v, LogFormatText)
+	}
+	return LogFormatText
 }
 
 // getHostname shells out to obtain the hostname used by the infra agent
@@ -156,22 +477,81 @@ func NewDefaultAgentConfig() *AgentConfig {
 		APIKeys:                 []string{},
 		APIEnabled:              true,
 		APIPayloadBufferMaxSize: 16 * 1024 * 1024,
+		APICompression:          model.CompressionGzip,
+		APIMaxConcurrentSends:   4,
+		APIAuthFailure:          AuthFailureDrop,
+		APILocalDir:             "/var/lib/datadog/trace-agent/payloads",
+		APILocalMaxSize:         100 * 1024 * 1024,
+		APIMaxIdleConnsPerHost:  4,
+		APIIdleConnTimeout:      90 * time.Second,
+		APIConnMaxLifetime:      90 * time.Second,
+		APIAuditSampleRate:      0.01,
+		APIAuditMaxSize:         100 * 1024 * 1024,
+		APIFlushBatchMaxWait:    30 * time.Second,
+		APITracesPath:           "/api/v0.2/traces",
+		APIStatsPath:            "/api/v0.2/stats",
+		APIServicesPath:         model.ServicesPayloadAPIPath(),
+		APIDryRunMaxPayloads:    10,
+
+		OutputType:        OutputAPI,
+		KafkaBrokers:      []string{},
+		KafkaTopic:        "trace-agent-payloads",
+		KafkaRequiredAcks: 1,
+		KafkaQueueSize:    100,
+
+		FilterScope: FilterScopeRoot,
 
 		BucketInterval:   time.Duration(10) * time.Second,
 		ExtraAggregators: []string{},
+		MaxDistributions: 5000,
+
+		TimersTags:    map[string]string{TimerTagService: "service", TimerTagResource: "resource", TimerTagEnv: "env"},
+		TimersMaxKeys: 1000,
 
-		ExtraSampleRate: 1.0,
-		MaxTPS:          10,
+		LatencyAlertFactor:  2,
+		LatencyAlertMinHits: 100,
+
+		ResourceCacheSize: 5000,
+
+		SkipFirstPartialBucket: true,
+		PartialFlushMode:       PartialFlushDrop,
+		MaxDuration:            30 * time.Minute,
+
+		ExtraSampleRate:  1.0,
+		MaxTPS:           10,
+		MaxSpansPerTrace: 5000,
+		MaxSamplerMemory: 100 * 1024 * 1024,
+
+		DecisionLogMaxSize: 100 * 1024 * 1024,
+
+		IndexedKeys:    []string{},
+		IndexedMaxKeys: 10,
 
 		ReceiverHost:    "localhost",
 		ReceiverPort:    8126,
 		ConnectionLimit: 2000,
+		MaxMetaSize:     model.MaxMetaSize,
+
+		ReceiverReadTimeout:    5 * time.Second,
+		ReceiverWriteTimeout:   5 * time.Second,
+		ReceiverIdleTimeout:    60 * time.Second,
+		ReceiverMaxHeaderBytes: 8 << 10,
+		ClockSkewThreshold:     10 * time.Second,
+
+		ReassemblyTimeout:  3 * time.Second,
+		ReassemblyMaxSpans: 100000,
+
+		MaxTraceAssemblyDuration: 10 * time.Minute,
+		DedupeCacheSize:          500000,
+		DebugMaxStreams:          2,
 
 		StatsdHost: "localhost",
 		StatsdPort: 8125,
 
-		LogLevel:    "INFO",
-		LogFilePath: "/var/log/datadog/trace-agent.log",
+		LogLevel:       "INFO",
+		LogFilePath:    "/var/log/datadog/trace-agent.log",
+		LogFormat:      LogFormatText,
+		LogFileMaxSize: defaultLogFileMaxSize,
 
 		MaxMemory:        1e9,
 		MaxConnections:   5000,
@@ -181,11 +561,285 @@ func NewDefaultAgentConfig() *AgentConfig {
 	return ac
 }
 
+// The fields of the spans made from timing metrics, see AgentConfig.TimersTags
+const (
+	TimerTagService  = "service"
+	TimerTagResource = "resource"
+	TimerTagEnv      = "env"
+)
+
+// configReport collects the errors found while reading the config file
+type configReport struct {
+	invalid []string
+}
+
+// ok returns true if err is nil. Missing values are not an error, the
+// default def is used, while invalid values are reported by err.
+func (r *configReport) ok(err error, def interface{}) bool {
+	switch e := err.(type) {
+	case nil:
+		return true
+	case *ErrMissingKey:
+		log.Debugf("`%s` not set in [%s] section, using default %v", e.Name, e.Section, def)
+	default:
+		r.invalid = append(r.invalid, err.Error())
+	}
+	return false
+}
+
+// err returns an error listing all the invalid values, if any
+func (r *configReport) err() error {
+	if len(r.invalid) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(r.invalid, "; "))
+}
+
+// checkUnknownKeys returns an error listing the keys of the files which
+// were never read if strict, and only logs them otherwise
+func checkUnknownKeys(files []*File, strict bool) error {
+	var unknown []string
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		for _, e := range f.unknownKeys() {
+			if !strict {
+				log.Warnf("%s: %v", f.Path, e)
+			}
+			unknown = append(unknown, fmt.Sprintf("%s: %v", f.Path, e))
+		}
+	}
+	if !strict || len(unknown) == 0 {
+		return nil
+	}
+	return fmt.Errorf("unknown configuration keys: %s", strings.Join(unknown, "; "))
+}
+
+// parseTimersTags parses the `<field>:<tag>` pairs of tag_mapping, the
+// fields not listed keeping their tag in defaults
+func parseTimersTags(vals []string, defaults map[string]string, report *configReport) map[string]string {
+	tags := make(map[string]string, len(defaults))
+	for field, tag := range defaults {
+		tags[field] = tag
+	}
+	for _, raw := range vals {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		i := strings.Index(raw, ":")
+		if i < 0 || strings.TrimSpace(raw[i+1:]) == "" {
+			report.ok(&ErrInvalidValue{Section: "trace.statsd", Name: "tag_mapping", Raw: raw,
+				Reason: "expected <field>:<tag>"}, nil)
+			continue
+		}
+		field := strings.TrimSpace(raw[:i])
+		if _, ok := defaults[field]; !ok {
+			report.ok(&ErrInvalidValue{Section: "trace.statsd", Name: "tag_mapping", Raw: raw,
+				Reason: "the field must be one of service, resource or env"}, nil)
+			continue
+		}
+		tags[field] = strings.TrimSpace(raw[i+1:])
+	}
+	return tags
+}
+
+// parseMetaTrimRules parses the `<key>:<length>` rules of trim_meta. The
+// error details are never trimmed, see model.ErrorMsgKey.
+func parseMetaTrimRules(vals []string, report *configReport) []MetaTrimRule {
+	var rules []MetaTrimRule
+	for _, raw := range vals {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		i := strings.LastIndex(raw, ":")
+		if i <= 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.writer", Name: "trim_meta", Raw: raw,
+				Reason: "expected <key>:<length>"}, nil)
+			continue
+		}
+		key := strings.TrimSpace(raw[:i])
+		n, err := strconv.Atoi(strings.TrimSpace(raw[i+1:]))
+		if err != nil || n < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.writer", Name: "trim_meta", Raw: raw,
+				Reason: "the length must be a positive number of bytes or 0"}, nil)
+			continue
+		}
+		switch key {
+		case model.ErrorTypeKey, model.ErrorMsgKey, model.ErrorStackKey:
+			report.ok(&ErrInvalidValue{Section: "trace.writer", Name: "trim_meta", Raw: raw,
+				Reason: "the error details are never trimmed"}, nil)
+			continue
+		}
+		rules = append(rules, MetaTrimRule{Key: key, MaxLen: n})
+	}
+	return rules
+}
+
+// parseRoutes reads the [trace.routing] section: the `tag` key, and one
+// `<value> = <endpoint>,<api_key>` key for each route.
+func parseRoutes(m *ini.Section, report *configReport) (string, []Route) {
+	tag := strings.TrimSpace(m.Key("tag").MustString(""))
+	var routes []Route
+	for _, k := range m.Keys() {
+		if k.Name() == "tag" {
+			continue
+		}
+		parts := strings.Split(k.String(), ",")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			report.ok(&ErrInvalidValue{Section: "trace.routing", Name: k.Name(), Raw: k.String(),
+				Reason: "expected <endpoint>,<api_key>"}, nil)
+			continue
+		}
+		routes = append(routes, Route{
+			Value:    k.Name(),
+			Endpoint: strings.TrimSpace(parts[0]),
+			APIKey:   strings.TrimSpace(parts[1]),
+		})
+	}
+	if len(routes) == 0 {
+		return "", nil
+	}
+	if tag == "" {
+		report.invalid = append(report.invalid, "missing `tag` value in [trace.routing] section")
+		return "", nil
+	}
+	return tag, routes
+}
+
+// parsePrecisionTiers parses the `<spans>:<epsilon>` tiers of
+// precision_tiers, by increasing number of spans, the last one can be a lone
+// `<epsilon>` applying to the services above the others
+func parsePrecisionTiers(values []string, report *configReport) []PrecisionTier {
+	var tiers []PrecisionTier
+	for _, raw := range values {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		invalid := func(reason string) {
+			report.ok(&ErrInvalidValue{Section: "trace.concentrator", Name: "precision_tiers", Raw: raw, Reason: reason}, nil)
+		}
+		if n := len(tiers); n > 0 && tiers[n-1].Below == 0 {
+			invalid("after the tier without a number of spans")
+			continue
+		}
+
+		var tier PrecisionTier
+		eps := raw
+		if i := strings.Index(raw, ":"); i >= 0 {
+			below, err := strconv.ParseInt(strings.TrimSpace(raw[:i]), 10, 64)
+			if err != nil || below <= 0 {
+				invalid("expected a positive number of spans")
+				continue
+			}
+			if n := len(tiers); n > 0 && below <= tiers[n-1].Below {
+				invalid("tiers must have increasing numbers of spans")
+				continue
+			}
+			tier.Below, eps = below, raw[i+1:]
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(eps), 64)
+		if err != nil || v <= 0 || v >= 0.5 {
+			invalid("expected an epsilon between 0 and 0.5")
+			continue
+		}
+		tier.Epsilon = v
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
+
+// parseServiceDurations reads the `<service> = <duration>` keys of section m,
+// the services being normalized like the ones of the spans
+func parseServiceDurations(conf *File, m *ini.Section, report *configReport) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	for _, k := range m.Keys() {
+		v, err := conf.GetDuration(m.Name(), k.Name())
+		if err == nil && v < 0 {
+			err = &ErrInvalidValue{Section: m.Name(), Name: k.Name(), Raw: k.String(), Reason: "must not be negative"}
+		}
+		if report.ok(err, nil) {
+			durations[model.NormalizeTag(k.Name())] = v
+		}
+	}
+	return durations
+}
+
+// parseGlobalTags parses the key:value tags of global_tags, reporting the
+// ones without a key
+func parseGlobalTags(values []string, report *configReport) map[string]string {
+	tags := make(map[string]string, len(values))
+	for _, raw := range values {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		kv := strings.SplitN(raw, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			report.ok(&ErrInvalidValue{Section: "trace.config", Name: "global_tags", Raw: raw,
+				Reason: "expected key:value"}, nil)
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags
+}
+
+// parseAllowedOrigins parses the origins of allowed_origins, reporting the
+// ones which are not a scheme and a host, e.g. http://localhost:3000
+func parseAllowedOrigins(values []string, report *configReport) []string {
+	var origins []string
+	for _, raw := range values {
+		origin := strings.TrimSuffix(strings.TrimSpace(raw), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+				report.ok(&ErrInvalidValue{Section: "trace.debug", Name: "allowed_origins", Raw: raw,
+					Reason: "expected scheme://host[:port] or *"}, nil)
+				continue
+			}
+		}
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+// parseTagRules reads a comma separated list of `<key>:<pattern>` rules
+// from the [trace.filter] section.
+func parseTagRules(conf *File, name string, report *configReport) []TagRule {
+	v, e := conf.GetStrArray("trace.filter", name, ",")
+	if !report.ok(e, "no rules") {
+		return nil
+	}
+	var rules []TagRule
+	for _, raw := range v {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		i := strings.Index(raw, ":")
+		if i <= 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.filter", Name: name, Raw: raw,
+				Reason: "expected <key>:<pattern>"}, nil)
+			continue
+		}
+		rules = append(rules, TagRule{Key: strings.TrimSpace(raw[:i]), Pattern: strings.TrimSpace(raw[i+1:])})
+	}
+	return rules
+}
+
 // NewAgentConfig creates the AgentConfig from the standard config
 func NewAgentConfig(conf *File, legacyConf *File) (*AgentConfig, error) {
 	c := NewDefaultAgentConfig()
+	report := &configReport{}
 	var m *ini.Section
 	var err error
+	files := []*File{conf, legacyConf} // checked for unknown keys once read
 
 	if conf == nil {
 		goto APM_CONF
@@ -194,14 +848,19 @@ func NewAgentConfig(conf *File, legacyConf *File) (*AgentConfig, error) {
 	// Inherit all relevant config from dd-agent
 	m, err = conf.GetSection("Main")
 	if err == nil {
-		if v := m.Key("hostname").MustString(""); v != "" {
+		// read through conf, as they may refer to secrets, see File.Get
+		if v, e := conf.Get("Main", "hostname"); report.ok(e, c.HostName) && v != "" {
 			c.HostName = v
 		} else {
 			log.Info("Failed to parse hostname from dd-agent config")
 		}
 
-		if v := m.Key("api_key").Strings(","); len(v) != 0 {
-			c.APIKeys = v
+		if v, e := conf.Get("Main", "api_key"); report.ok(e, nil) && v != "" {
+			vals := strings.Split(v, ",")
+			for i := range vals {
+				vals[i] = strings.TrimSpace(vals[i])
+			}
+			c.APIKeys = vals
 		} else {
 			log.Info("Failed to parse api_key from dd-agent config")
 		}
@@ -225,10 +884,17 @@ func NewAgentConfig(conf *File, legacyConf *File) (*AgentConfig, error) {
 		if v := m.Key("log_level").MustString(""); v != "" {
 			c.LogLevel = v
 		}
+		if v := m.Key("log_format").MustString(""); v != "" {
+			c.LogFormat = parseLogFormat(v)
+		}
 
 		if p := getProxySettings(m); p.Host != "" {
 			c.Proxy = p
 		}
+
+		if v, e := conf.GetBool("Main", "strict_config"); report.ok(e, c.StrictConfig) {
+			c.StrictConfig = v
+		}
 	}
 
 APM_CONF:
@@ -250,6 +916,10 @@ APM_CONF:
 		c.DefaultEnv = model.NormalizeTag(v)
 	}
 
+	if v, e := conf.GetStrArray("trace.config", "global_tags", ","); e == nil {
+		c.GlobalTags = parseGlobalTags(v, report)
+	}
+
 	if v, _ := conf.Get("trace.config", "log_level"); v != "" {
 		c.LogLevel = v
 	}
@@ -258,7 +928,26 @@ APM_CONF:
 		c.LogFilePath = v
 	}
 
-	if v, _ := conf.Get("trace.api", "api_key"); v != "" {
+	if v, _ := conf.Get("trace.config", "log_format"); v != "" {
+		c.LogFormat = parseLogFormat(v)
+	}
+
+	if v, e := conf.GetInt("trace.config", "log_file_max_size"); report.ok(e, c.LogFileMaxSize) && v > 0 {
+		c.LogFileMaxSize = v
+	}
+
+	if v, _ := conf.Get("trace.config", "state_dir"); v != "" {
+		c.StateDir = v
+	}
+
+	if v, e := conf.GetBool("trace.config", "stats_only"); report.ok(e, c.StatsOnly) {
+		c.StatsOnly = v
+	}
+	if v, e := conf.GetInt("trace.config", "resource_cache_size"); report.ok(e, c.ResourceCacheSize) {
+		c.ResourceCacheSize = v
+	}
+
+	if v, e := conf.Get("trace.api", "api_key"); report.ok(e, nil) && v != "" {
 		vals := strings.Split(v, ",")
 		for i := range vals {
 			vals[i] = strings.TrimSpace(vals[i])
@@ -274,11 +963,202 @@ APM_CONF:
 		c.APIEndpoints = vals
 	}
 
-	if v, e := conf.GetInt("trace.api", "payload_buffer_max_size"); e == nil {
+	if v, e := conf.GetInt("trace.api", "payload_buffer_max_size"); report.ok(e, c.APIPayloadBufferMaxSize) {
 		c.APIPayloadBufferMaxSize = v
 	}
 
-	if v, e := conf.GetInt("trace.concentrator", "bucket_size_seconds"); e == nil {
+	if v, _ := conf.Get("trace.api", "compression"); v != "" {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case model.CompressionGzip, model.CompressionZstd, model.CompressionSnappy, model.CompressionNone:
+			c.APICompression = v
+		default:
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "compression", Raw: v,
+				Reason: "expected gzip, zstd, snappy or none"}, nil)
+		}
+	}
+	if v, e := conf.GetInt("trace.api", "compression_level"); report.ok(e, c.APICompressionLevel) {
+		c.APICompressionLevel = v
+	}
+	if _, err := model.NewCompressor(c.APICompression, c.APICompressionLevel); err != nil {
+		// e.g. zstd in a build without cgo, or a level out of range
+		report.ok(&ErrInvalidValue{Section: "trace.api", Name: "compression", Raw: c.APICompression,
+			Reason: err.Error()}, nil)
+	}
+	if v, e := conf.GetInt("trace.api", "max_concurrent_sends"); report.ok(e, c.APIMaxConcurrentSends) {
+		if v < 1 {
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "max_concurrent_sends", Raw: strconv.Itoa(v),
+				Reason: "expected at least 1"}, nil)
+		} else {
+			c.APIMaxConcurrentSends = v
+		}
+	}
+	if v, _ := conf.Get("trace.api", "on_auth_failure"); v != "" {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case AuthFailureDrop, AuthFailureBuffer, AuthFailureLocal:
+			c.APIAuthFailure = v
+		default:
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "on_auth_failure", Raw: v,
+				Reason: "expected drop, buffer or local"}, nil)
+		}
+	}
+	if v, _ := conf.Get("trace.api", "local_dir"); v != "" {
+		c.APILocalDir = v
+	}
+	if v, e := conf.GetInt("trace.api", "local_max_size"); report.ok(e, c.APILocalMaxSize) {
+		c.APILocalMaxSize = v
+	}
+	if v, e := conf.GetInt("trace.api", "max_idle_conns_per_host"); report.ok(e, c.APIMaxIdleConnsPerHost) {
+		c.APIMaxIdleConnsPerHost = v
+	}
+	if v, e := conf.GetDuration("trace.api", "idle_conn_timeout"); report.ok(e, c.APIIdleConnTimeout) {
+		c.APIIdleConnTimeout = v
+	}
+	if v, e := conf.GetDuration("trace.api", "conn_max_lifetime"); report.ok(e, c.APIConnMaxLifetime) {
+		c.APIConnMaxLifetime = v
+	}
+	if v, e := conf.GetBool("trace.api", "disable_keep_alives"); report.ok(e, c.APIDisableKeepAlives) {
+		c.APIDisableKeepAlives = v
+	}
+	if v, _ := conf.Get("trace.api", "audit_dir"); v != "" {
+		c.APIAuditDir = v
+	}
+	if v, e := conf.GetFloat("trace.api", "audit_sample_rate"); report.ok(e, c.APIAuditSampleRate) {
+		if v < 0 || v > 1 {
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "audit_sample_rate", Raw: strconv.FormatFloat(v, 'g', -1, 64),
+				Reason: "expected a rate between 0 and 1"}, nil)
+		} else {
+			c.APIAuditSampleRate = v
+		}
+	}
+	if v, e := conf.GetInt("trace.api", "audit_max_size"); report.ok(e, c.APIAuditMaxSize) {
+		c.APIAuditMaxSize = v
+	}
+	if v, e := conf.GetInt("trace.api", "flush_batch_max_payloads"); report.ok(e, c.APIFlushBatchMaxPayloads) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "flush_batch_max_payloads", Raw: strconv.Itoa(v),
+				Reason: "expected a positive number of payloads or 0"}, nil)
+		} else {
+			c.APIFlushBatchMaxPayloads = v
+		}
+	}
+	if v, e := conf.GetDuration("trace.api", "flush_batch_max_wait"); report.ok(e, c.APIFlushBatchMaxWait) {
+		if v <= 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "flush_batch_max_wait", Raw: v.String(),
+				Reason: "expected a positive duration"}, nil)
+		} else {
+			c.APIFlushBatchMaxWait = v
+		}
+	}
+	switch v, _ := conf.Get("trace.api", "flush_jitter"); v {
+	case "":
+	case "auto":
+		c.APIFlushJitter, c.APIFlushJitterAuto = 0, true
+	case "off":
+		c.APIFlushJitter, c.APIFlushJitterAuto = 0, false
+	default:
+		if d, e := conf.GetDuration("trace.api", "flush_jitter"); report.ok(e, c.APIFlushJitter) {
+			if d < 0 {
+				report.ok(&ErrInvalidValue{Section: "trace.api", Name: "flush_jitter", Raw: v,
+					Reason: "expected auto, off or a duration"}, nil)
+			} else {
+				c.APIFlushJitter, c.APIFlushJitterAuto = d, false
+			}
+		}
+	}
+	if v, e := conf.GetBool("trace.api", "split_payloads"); report.ok(e, c.APISplitPayloads) {
+		c.APISplitPayloads = v
+	}
+	for _, p := range []struct {
+		name string
+		path *string
+	}{
+		{"traces_path", &c.APITracesPath},
+		{"stats_path", &c.APIStatsPath},
+		{"services_path", &c.APIServicesPath},
+	} {
+		v, _ := conf.Get("trace.api", p.name)
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.HasPrefix(v, "/") {
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: p.name, Raw: v,
+				Reason: "expected a path starting with /"}, nil)
+			continue
+		}
+		*p.path = v
+	}
+	if v, e := conf.GetBool("trace.api", "dry_run"); report.ok(e, c.APIDryRun) {
+		c.APIDryRun = v
+	}
+	if v, _ := conf.Get("trace.api", "dry_run_dir"); v != "" {
+		c.APIDryRunDir = v
+	}
+	if v, e := conf.GetInt("trace.api", "dry_run_max_payloads"); report.ok(e, c.APIDryRunMaxPayloads) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.api", Name: "dry_run_max_payloads", Raw: strconv.Itoa(v),
+				Reason: "expected a positive number of payloads or 0"}, nil)
+		} else {
+			c.APIDryRunMaxPayloads = v
+		}
+	}
+
+	if v, e := conf.GetStrArray("trace.writer", "trim_meta", ","); e == nil {
+		c.TrimMeta = parseMetaTrimRules(v, report)
+	}
+
+	if v, _ := conf.Get("trace.output", "type"); v != "" {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case OutputAPI, OutputKafka, OutputBoth:
+			c.OutputType = v
+		default:
+			report.ok(&ErrInvalidValue{Section: "trace.output", Name: "type", Raw: v,
+				Reason: "expected one of api, kafka or both"}, c.OutputType)
+		}
+	}
+	if v, e := conf.GetStrArray("trace.output", "kafka_brokers", ","); e == nil {
+		brokers := make([]string, 0, len(v))
+		for i := range v {
+			if b := strings.TrimSpace(v[i]); b != "" {
+				brokers = append(brokers, b)
+			}
+		}
+		c.KafkaBrokers = brokers
+	}
+	if c.OutputType != OutputAPI && len(c.KafkaBrokers) == 0 {
+		report.ok(&ErrInvalidValue{Section: "trace.output", Name: "kafka_brokers", Raw: "",
+			Reason: "expected at least one broker with output type " + c.OutputType}, nil)
+	}
+	if v, _ := conf.Get("trace.output", "kafka_topic"); v != "" {
+		c.KafkaTopic = v
+	}
+	if v, e := conf.GetInt("trace.output", "kafka_required_acks"); report.ok(e, c.KafkaRequiredAcks) {
+		c.KafkaRequiredAcks = v
+	}
+	if v, e := conf.GetInt("trace.output", "kafka_queue_size"); report.ok(e, c.KafkaQueueSize) {
+		c.KafkaQueueSize = v
+	}
+
+	if m, e := conf.GetSection("trace.routing"); e == nil {
+		c.RoutingTag, c.Routes = parseRoutes(m, report)
+	}
+
+	if v, e := conf.GetBool("trace.container", "tagging"); report.ok(e, c.ContainerTagging) {
+		c.ContainerTagging = v
+	}
+
+	c.FilterReject = parseTagRules(conf, "reject", report)
+	c.FilterRequire = parseTagRules(conf, "require", report)
+	if v, e := conf.Get("trace.filter", "scope"); report.ok(e, c.FilterScope) {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case FilterScopeRoot, FilterScopeAny:
+			c.FilterScope = v
+		default:
+			report.ok(&ErrInvalidValue{Section: "trace.filter", Name: "scope", Raw: v,
+				Reason: "expected root or any"}, nil)
+		}
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "bucket_size_seconds"); report.ok(e, c.BucketInterval) {
 		c.BucketInterval = time.Duration(v) * time.Second
 	}
 
@@ -288,43 +1168,272 @@ APM_CONF:
 		log.Debug("No aggregator configuration, using defaults")
 	}
 
-	if v, e := conf.GetFloat("trace.sampler", "extra_sample_rate"); e == nil {
+	if v, e := conf.GetInt("trace.concentrator", "max_distributions"); report.ok(e, c.MaxDistributions) {
+		c.MaxDistributions = v
+	}
+	if v, e := conf.GetBool("trace.concentrator", "skip_first_partial_bucket"); report.ok(e, c.SkipFirstPartialBucket) {
+		c.SkipFirstPartialBucket = v
+	}
+	if v, _ := conf.Get("trace.concentrator", "partial_flush_mode"); v != "" {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case PartialFlushDrop, PartialFlushFlag:
+			c.PartialFlushMode = v
+		default:
+			report.ok(&ErrInvalidValue{Section: "trace.concentrator", Name: "partial_flush_mode", Raw: v,
+				Reason: "expected drop or flag"}, nil)
+		}
+	}
+	if v, e := conf.GetDuration("trace.concentrator", "max_duration"); report.ok(e, c.MaxDuration) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.concentrator", Name: "max_duration", Raw: v.String(),
+				Reason: "must not be negative"}, nil)
+		} else {
+			c.MaxDuration = v
+		}
+	}
+	if m, e := conf.GetSection("trace.concentrator.max_duration"); e == nil {
+		c.MaxDurationByService = parseServiceDurations(conf, m, report)
+	}
+	if v, e := conf.GetBool("trace.concentrator", "derived_wait_metrics"); report.ok(e, c.DerivedWaitMetrics) {
+		c.DerivedWaitMetrics = v
+	}
+	if v, e := conf.GetStrArray("trace.concentrator", "precision_tiers", ","); e == nil {
+		c.PrecisionTiers = parsePrecisionTiers(v, report)
+	}
+	if v, e := conf.GetInt("trace.concentrator", "top_resources"); report.ok(e, c.TopResources) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.concentrator", Name: "top_resources", Raw: strconv.Itoa(v),
+				Reason: "must not be negative"}, nil)
+		} else {
+			c.TopResources = v
+		}
+	}
+	if v, e := conf.GetBool("trace.concentrator", "quantile_bounds"); report.ok(e, c.QuantileBounds) {
+		c.QuantileBounds = v
+	}
+	if v, e := conf.GetBool("trace.concentrator", "latency_alerts"); report.ok(e, c.LatencyAlerts) {
+		c.LatencyAlerts = v
+	}
+	if v, e := conf.GetFloat("trace.concentrator", "latency_alert_factor"); report.ok(e, c.LatencyAlertFactor) {
+		if v <= 1 {
+			report.ok(&ErrInvalidValue{Section: "trace.concentrator", Name: "latency_alert_factor", Raw: strconv.FormatFloat(v, 'g', -1, 64),
+				Reason: "must be greater than 1"}, nil)
+		} else {
+			c.LatencyAlertFactor = v
+		}
+	}
+	if v, e := conf.GetInt("trace.concentrator", "latency_alert_min_hits"); report.ok(e, c.LatencyAlertMinHits) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.concentrator", Name: "latency_alert_min_hits", Raw: strconv.Itoa(v),
+				Reason: "must not be negative"}, nil)
+		} else {
+			c.LatencyAlertMinHits = v
+		}
+	}
+
+	if v, e := conf.GetFloat("trace.sampler", "extra_sample_rate"); report.ok(e, c.ExtraSampleRate) {
 		c.ExtraSampleRate = v
 	}
-	if v, e := conf.GetFloat("trace.sampler", "max_traces_per_second"); e == nil {
+	if v, e := conf.GetFloat("trace.sampler", "max_traces_per_second"); report.ok(e, c.MaxTPS) {
 		c.MaxTPS = v
 	}
+	if v, e := conf.GetInt("trace.sampler", "max_spans_per_trace"); report.ok(e, c.MaxSpansPerTrace) {
+		c.MaxSpansPerTrace = v
+	}
+	if v, e := conf.GetBytes("trace.sampler", "max_sampler_memory"); report.ok(e, c.MaxSamplerMemory) {
+		c.MaxSamplerMemory = v
+	}
+	if v, e := conf.GetFloat("trace.sampler", "uniform_rate"); report.ok(e, c.UniformSampleRate) {
+		if v < 0 || v > 1 {
+			report.ok(&ErrInvalidValue{Section: "trace.sampler", Name: "uniform_rate", Raw: strconv.FormatFloat(v, 'g', -1, 64),
+				Reason: "expected a rate between 0 and 1"}, nil)
+		} else {
+			c.UniformSampleRate = v
+		}
+	}
+	if v, e := conf.GetInt("trace.sampler", "dedupe_window_flushes"); report.ok(e, c.DedupeWindowFlushes) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.sampler", Name: "dedupe_window_flushes", Raw: strconv.Itoa(v),
+				Reason: "expected a positive number of flushes"}, nil)
+		} else {
+			c.DedupeWindowFlushes = v
+		}
+	}
+	if v, _ := conf.Get("trace.sampler", "decision_log_dir"); v != "" {
+		c.DecisionLogDir = v
+	}
+	if v, e := conf.GetBytes("trace.sampler", "decision_log_max_size"); report.ok(e, c.DecisionLogMaxSize) {
+		c.DecisionLogMaxSize = v
+	}
 
-	if v, e := conf.GetInt("trace.receiver", "receiver_port"); e == nil {
+	if v, e := conf.GetStrArray("trace.index", "keys", ","); e == nil {
+		for i := range v {
+			v[i] = strings.TrimSpace(v[i])
+		}
+		c.IndexedKeys = v
+	}
+	if v, e := conf.GetInt("trace.index", "max_keys"); report.ok(e, c.IndexedMaxKeys) {
+		c.IndexedMaxKeys = v
+	}
+
+	if v, e := conf.GetInt("trace.receiver", "receiver_port"); report.ok(e, c.ReceiverPort) {
 		c.ReceiverPort = v
 	}
 
-	if v, e := conf.GetInt("trace.receiver", "connection_limit"); e == nil {
+	if v, e := conf.GetInt("trace.receiver", "connection_limit"); report.ok(e, c.ConnectionLimit) {
 		c.ConnectionLimit = v
 	}
 
-	if v, e := conf.GetInt("trace.receiver", "timeout"); e == nil {
-		c.ReceiverTimeout = v
+	for _, t := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"read_timeout", &c.ReceiverReadTimeout},
+		{"write_timeout", &c.ReceiverWriteTimeout},
+		{"idle_timeout", &c.ReceiverIdleTimeout},
+	} {
+		if v, e := conf.GetDuration("trace.receiver", t.name); report.ok(e, *t.value) {
+			if v <= 0 {
+				report.ok(&ErrInvalidValue{Section: "trace.receiver", Name: t.name, Raw: v.String(),
+					Reason: "expected a positive duration"}, *t.value)
+			} else {
+				*t.value = v
+			}
+		}
+	}
+	if v, e := conf.GetBytes("trace.receiver", "max_header_bytes"); report.ok(e, c.ReceiverMaxHeaderBytes) {
+		if v <= 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.receiver", Name: "max_header_bytes", Raw: strconv.FormatInt(v, 10),
+				Reason: "expected a positive size"}, c.ReceiverMaxHeaderBytes)
+		} else {
+			c.ReceiverMaxHeaderBytes = int(v)
+		}
+	}
+	if v, e := conf.GetBool("trace.receiver", "accept_oversized_payloads"); report.ok(e, c.ReceiverAcceptOversized) {
+		c.ReceiverAcceptOversized = v
+	}
+	if v, e := conf.GetBytes("trace.receiver", "max_trace_size"); report.ok(e, c.ReceiverMaxTraceBytes) {
+		c.ReceiverMaxTraceBytes = v
+	}
+	if v, e := conf.GetDuration("trace.receiver", "clock_skew_threshold"); report.ok(e, c.ClockSkewThreshold) {
+		if v < 0 {
+			report.ok(&ErrInvalidValue{Section: "trace.receiver", Name: "clock_skew_threshold", Raw: v.String(),
+				Reason: "expected a positive duration, or 0 to never report it"}, c.ClockSkewThreshold)
+		} else {
+			c.ClockSkewThreshold = v
+		}
+	}
+	if v, e := conf.Get("trace.receiver", "auth_token"); report.ok(e, c.ReceiverAuthToken) {
+		c.ReceiverAuthToken = v
+	}
+	if v, e := conf.GetBool("trace.receiver", "debug_auth"); report.ok(e, c.ReceiverDebugAuth) {
+		c.ReceiverDebugAuth = v
+	}
+	if v, e := conf.Get("trace.receiver", "receiver_socket"); report.ok(e, c.ReceiverSocket) {
+		c.ReceiverSocket = v
+	}
+	if v, e := conf.GetBool("trace.receiver", "socket_skip_auth"); report.ok(e, c.ReceiverSocketSkipAuth) {
+		c.ReceiverSocketSkipAuth = v
+	}
+
+	if v, e := conf.GetInt("trace.receiver", "max_meta_size"); report.ok(e, c.MaxMetaSize) {
+		c.MaxMetaSize = v
+	}
+
+	if v, e := conf.GetDuration("trace.receiver", "reassembly_timeout"); report.ok(e, c.ReassemblyTimeout) {
+		c.ReassemblyTimeout = v
+	}
+	if v, e := conf.GetInt("trace.receiver", "reassembly_max_spans"); report.ok(e, c.ReassemblyMaxSpans) {
+		c.ReassemblyMaxSpans = v
+	}
+	if v, e := conf.GetDuration("trace.receiver", "max_trace_assembly_duration"); report.ok(e, c.MaxTraceAssemblyDuration) {
+		c.MaxTraceAssemblyDuration = v
+	}
+	if v, e := conf.GetInt("trace.receiver", "dedupe_cache_size"); report.ok(e, c.DedupeCacheSize) {
+		c.DedupeCacheSize = v
+	}
+	if v, e := conf.GetBool("trace.receiver", "payload_checksums"); report.ok(e, c.PayloadChecksums) {
+		c.PayloadChecksums = v
+	}
+	if v, e := conf.GetInt("trace.receiver", "payload_dedupe_size"); report.ok(e, c.PayloadDedupeSize) {
+		c.PayloadDedupeSize = v
+	}
+	if v, e := conf.GetInt("trace.receiver", "max_debug_streams"); report.ok(e, c.DebugMaxStreams) {
+		c.DebugMaxStreams = v
+	}
+	if v, e := conf.GetBool("trace.receiver", "log_requests"); report.ok(e, c.ReceiverLogRequests) {
+		c.ReceiverLogRequests = v
+	}
+	if v, e := conf.GetBool("trace.debug", "enabled"); report.ok(e, c.DebugEnabled) {
+		c.DebugEnabled = v
+	}
+	if v, e := conf.GetStrArray("trace.debug", "allowed_origins", ","); e == nil {
+		c.DebugAllowedOrigins = parseAllowedOrigins(v, report)
+	}
+
+	if v, _ := conf.Get("trace.metrics", "statsd_addr"); v != "" {
+		c.MetricsStatsdAddr = v
 	}
 
-	if v, e := conf.GetFloat("trace.watchdog", "max_memory"); e == nil {
+	if v, e := conf.GetInt("trace.statsd", "port"); report.ok(e, c.TimersPort) {
+		if v < 0 || v > 65535 {
+			report.ok(&ErrInvalidValue{Section: "trace.statsd", Name: "port", Raw: strconv.Itoa(v),
+				Reason: "not a port number"}, nil)
+		} else {
+			c.TimersPort = v
+		}
+	}
+	if v, e := conf.GetStrArray("trace.statsd", "tag_mapping", ","); e == nil {
+		c.TimersTags = parseTimersTags(v, c.TimersTags, report)
+	}
+	if v, e := conf.GetInt("trace.statsd", "max_keys"); report.ok(e, c.TimersMaxKeys) {
+		if v < 1 {
+			report.ok(&ErrInvalidValue{Section: "trace.statsd", Name: "max_keys", Raw: strconv.Itoa(v),
+				Reason: "must be at least 1"}, nil)
+		} else {
+			c.TimersMaxKeys = v
+		}
+	}
+
+	if v, e := conf.GetBool("trace.internal", "self_tracing"); report.ok(e, c.SelfTracing) {
+		c.SelfTracing = v
+	}
+
+	if v, e := conf.GetFloat("trace.watchdog", "max_memory"); report.ok(e, c.MaxMemory) {
 		c.MaxMemory = v
 	}
 
-	if v, e := conf.GetInt("trace.watchdog", "max_connections"); e == nil {
+	if v, e := conf.GetInt("trace.watchdog", "max_connections"); report.ok(e, c.MaxConnections) {
 		c.MaxConnections = v
 	}
 
-	if v, e := conf.GetInt("trace.watchdog", "check_delay_seconds"); e == nil {
+	if v, e := conf.GetInt("trace.watchdog", "check_delay_seconds"); report.ok(e, c.WatchdogInterval) {
 		c.WatchdogInterval = time.Duration(v) * time.Second
 	}
 
 ENV_CONF:
+	if err := report.err(); err != nil {
+		return c, err
+	}
+
 	// environment variables have precedence among defaults and the config file
 	mergeEnv(c)
 
+	if err := checkUnknownKeys(files, c.StrictConfig); err != nil {
+		return c, err
+	}
+
 	// check for api-endpoint parity after all possible overrides have been applied
 	if len(c.APIKeys) == 0 {
+		if c.APIDryRun {
+			// nothing is sent, see NewWriter
+			return c, nil
+		}
+		if c.APIAuthFailure == AuthFailureLocal {
+			// local-only mode, see NewWriter
+			log.Warnf("no API key, writing payloads to %s", c.APILocalDir)
+			return c, nil
+		}
 		return c, errors.New("you must specify an API Key, either via a configuration file or the DD_API_KEY env var")
 	}
 
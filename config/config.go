@@ -3,8 +3,10 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-ini/ini"
 )
@@ -16,6 +18,10 @@ var globalConfig *File
 type File struct {
 	instance *ini.File
 	Path     string
+
+	// known are the keys looked up, by section, an empty name standing for
+	// the whole section, see unknownKeys
+	known map[string]map[string]bool
 }
 
 // New reads the file in configPath and returns a corresponding *File
@@ -54,52 +60,184 @@ func Set(config *ini.File) {
 	globalConfig = &File{instance: config}
 }
 
-// Get returns a value from the section/name pair, or an error if it can't be found.
+// ErrMissingKey is returned by the File getters when a key is not set.
+type ErrMissingKey struct {
+	Section string
+	Name    string
+}
+
+func (e *ErrMissingKey) Error() string {
+	return fmt.Sprintf("missing `%s` value in [%s] section", e.Name, e.Section)
+}
+
+// Is reports whether target is an *ErrMissingKey for the same key, an empty
+// Section or Name in target matching any.
+func (e *ErrMissingKey) Is(target error) bool {
+	t, ok := target.(*ErrMissingKey)
+	return ok && (t.Section == "" || t.Section == e.Section) && (t.Name == "" || t.Name == e.Name)
+}
+
+// ErrInvalidValue is returned by the typed File getters when a key is set to
+// a value which cannot be converted.
+type ErrInvalidValue struct {
+	Section string
+	Name    string
+	Raw     string // the value as found in the file
+	Reason  string
+}
+
+func (e *ErrInvalidValue) Error() string {
+	return fmt.Sprintf("invalid value '%s' for `%s` in [%s] section: %s", e.Raw, e.Name, e.Section, e.Reason)
+}
+
+// Is reports whether target is an *ErrInvalidValue for the same key, an empty
+// Section or Name in target matching any.
+func (e *ErrInvalidValue) Is(target error) bool {
+	t, ok := target.(*ErrInvalidValue)
+	return ok && (t.Section == "" || t.Section == e.Section) && (t.Name == "" || t.Name == e.Name)
+}
+
+// Get returns a value from the section/name pair, or an *ErrMissingKey if it can't be found.
+// Values of the form file:///path or env://VAR are replaced with the trimmed
+// contents of the file or the value of the environment variable, an
+// *ErrInvalidValue being returned if they cannot be read. Keys which were
+// renamed are read from their legacy name when not set, see renamedKeys.
 func (c *File) Get(section, name string) (string, error) {
+	c.lookup(section, name)
 	exists := c.instance.Section(section).HasKey(name)
 	if !exists {
-		return "", fmt.Errorf("missing `%s` value in [%s] section", name, section)
+		return c.getRenamed(section, name)
+	}
+	return c.resolve(section, name, c.instance.Section(section).Key(name).String())
+}
+
+// getRaw returns the trimmed value of section/name, empty values being
+// considered as missing.
+func (c *File) getRaw(section, name string) (string, error) {
+	v, err := c.Get(section, name)
+	if v = strings.TrimSpace(v); err == nil && v == "" {
+		return "", &ErrMissingKey{Section: section, Name: name}
 	}
-	return c.instance.Section(section).Key(name).String(), nil
+	return v, err
 }
 
 // GetDefault attempts to get the value in section/name, but returns the default
-// if one is not found.
+// if one is not found, or if it cannot be read.
 func (c *File) GetDefault(section, name string, defaultVal string) string {
-	return c.instance.Section(section).Key(name).MustString(defaultVal)
+	v, err := c.Get(section, name)
+	if err != nil || v == "" {
+		return defaultVal
+	}
+	return v
 }
 
-// GetInt gets an integer value from section/name, or an error if it is missing
-// or cannot be converted to an integer.
+// GetInt gets an integer value from section/name, or an *ErrMissingKey or
+// *ErrInvalidValue if it is missing or cannot be converted to an integer.
 func (c *File) GetInt(section, name string) (int, error) {
-	value, err := c.instance.Section(section).Key(name).Int()
+	raw, err := c.getRaw(section, name)
 	if err != nil {
-		return 0, fmt.Errorf("missing `%s` value in [%s] section", name, section)
+		return 0, err
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "not an integer"}
 	}
 	return value, nil
 }
 
-// GetFloat gets an float value from section/name, or an error if it is missing
-// or cannot be converted to an float.
+// GetFloat gets an float value from section/name, or an *ErrMissingKey or
+// *ErrInvalidValue if it is missing or cannot be converted to an float.
 func (c *File) GetFloat(section, name string) (float64, error) {
-	value, err := c.instance.Section(section).Key(name).Float64()
+	raw, err := c.getRaw(section, name)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(raw, 64)
 	if err != nil {
-		return 0, fmt.Errorf("missing `%s` value in [%s] section", name, section)
+		return 0, &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "not a number"}
 	}
 	return value, nil
 }
 
+// GetBool gets a boolean value from section/name, accepting true/false,
+// yes/no, on/off and 1/0.
+func (c *File) GetBool(section, name string) (bool, error) {
+	raw, err := c.getRaw(section, name)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(raw) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "not a boolean"}
+}
+
+// GetDuration gets a duration from section/name, either in the time.Duration
+// format (e.g. "1m30s") or as a plain number of seconds.
+func (c *File) GetDuration(section, name string) (time.Duration, error) {
+	raw, err := c.getRaw(section, name)
+	if err != nil {
+		return 0, err
+	}
+	if secs, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "not a duration"}
+	}
+	return value, nil
+}
+
+// byteUnits are the suffixes accepted by GetBytes, longest first
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+// GetBytes gets a size in bytes from section/name, either as a plain number
+// or with a K, KB, M, MB, G or GB suffix (powers of 1024).
+func (c *File) GetBytes(section, name string) (int64, error) {
+	raw, err := c.getRaw(section, name)
+	if err != nil {
+		return 0, err
+	}
+	num, unit := strings.ToUpper(raw), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
+	}
+	value, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || value < 0 {
+		return 0, &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "not a size in bytes"}
+	}
+	return value * unit, nil
+}
+
 // GetStrArray returns the value split across `sep` into an array of strings.
 func (c *File) GetStrArray(section, name, sep string) ([]string, error) {
-	if exists := c.instance.Section(section).HasKey(name); !exists {
-		return []string{}, fmt.Errorf("missing `%s` value in [%s] section", name, section)
+	value, err := c.Get(section, name)
+	if err != nil {
+		return []string{}, err
 	}
-
-	value := c.instance.Section(section).Key(name).String()
 	return strings.Split(value, sep), nil
 }
 
 // GetSection is a convenience method to return an entire section of ini config
 func (c *File) GetSection(key string) (*ini.Section, error) {
+	c.lookup(key, "")
 	return c.instance.GetSection(key)
 }
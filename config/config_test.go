@@ -1,22 +1,38 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"testing"
 
+	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/go-ini/ini"
 )
 
+// errorAs sets target, a pointer to an error type, to err if err is of that
+// type, standing for errors.As which Go 1.7 does not have. The errors of the
+// getters are never wrapped, so there is nothing to unwrap.
+func errorAs(err error, target interface{}) bool {
+	v := reflect.ValueOf(target).Elem()
+	if err == nil || !reflect.TypeOf(err).AssignableTo(v.Type()) {
+		return false
+	}
+	v.Set(reflect.ValueOf(err))
+	return true
+}
+
 func TestGetStrArray(t *testing.T) {
 	assert := assert.New(t)
 	f, _ := ini.Load([]byte("[Main]\n\nports = 10,15,20,25"))
 	conf := File{
-		f,
-		"some/path",
+		instance: f,
+		Path:     "some/path",
 	}
 
 	ports, err := conf.GetStrArray("Main", "ports", ",")
@@ -24,6 +40,146 @@ func TestGetStrArray(t *testing.T) {
 	assert.Equal(ports, []string{"10", "15", "20", "25"})
 }
 
+func TestTypedGetters(t *testing.T) {
+	assert := assert.New(t)
+	f, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"num = 12",
+		"flag = yes",
+		"wait = 1m30s",
+		"secs = 30",
+		"size = 10MB",
+		"bad = abc",
+		"empty =",
+	}, "\n")))
+	conf := File{instance: f, Path: "some/path"}
+
+	v, err := conf.GetInt("Main", "num")
+	assert.Nil(err)
+	assert.Equal(12, v)
+	b, err := conf.GetBool("Main", "flag")
+	assert.Nil(err)
+	assert.True(b)
+	d, err := conf.GetDuration("Main", "wait")
+	assert.Nil(err)
+	assert.Equal(90*time.Second, d)
+	d, err = conf.GetDuration("Main", "secs")
+	assert.Nil(err)
+	assert.Equal(30*time.Second, d)
+	n, err := conf.GetBytes("Main", "size")
+	assert.Nil(err)
+	assert.Equal(int64(10*1024*1024), n)
+
+	getters := map[string]func(section, name string) error{
+		"GetInt":      func(s, n string) error { _, err := conf.GetInt(s, n); return err },
+		"GetFloat":    func(s, n string) error { _, err := conf.GetFloat(s, n); return err },
+		"GetBool":     func(s, n string) error { _, err := conf.GetBool(s, n); return err },
+		"GetDuration": func(s, n string) error { _, err := conf.GetDuration(s, n); return err },
+		"GetBytes":    func(s, n string) error { _, err := conf.GetBytes(s, n); return err },
+	}
+	for getter, get := range getters {
+		for _, name := range []string{"absent", "empty"} {
+			err := get("Main", name)
+			var missing *ErrMissingKey
+			if assert.True(errorAs(err, &missing), "%s(%s): %v", getter, name, err) {
+				assert.Equal(ErrMissingKey{Section: "Main", Name: name}, *missing)
+				assert.True(missing.Is(&ErrMissingKey{}))
+				assert.False(missing.Is(&ErrMissingKey{Name: "other"}))
+			}
+		}
+
+		err := get("Main", "bad")
+		var invalid *ErrInvalidValue
+		if assert.True(errorAs(err, &invalid), "%s: %v", getter, err) {
+			assert.Equal("Main", invalid.Section)
+			assert.Equal("bad", invalid.Name)
+			assert.Equal("abc", invalid.Raw)
+			assert.NotEmpty(invalid.Reason)
+			assert.True(invalid.Is(&ErrInvalidValue{Name: "bad"}))
+			assert.False(invalid.Is(&ErrMissingKey{}))
+		}
+	}
+}
+
+func TestInvalidConfigValues(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.receiver]",
+		"receiver_port = abc",
+		"[trace.sampler]",
+		"max_traces_per_second =",
+		"[trace.api]",
+		"compression = lz4",
+	}, "\n")))
+
+	// an empty value is considered unset
+	_, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "invalid value 'abc' for `receiver_port` in [trace.receiver] section")
+		assert.NotContains(err.Error(), "max_traces_per_second")
+		assert.Contains(err.Error(), "invalid value 'lz4' for `compression` in [trace.api] section")
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := []string{"compression=snappy", "compression=gzip\ncompression_level=9"}
+	invalid := []string{"compression=zstd\ncompression_level=42", "compression=gzip\ncompression_level=10"}
+	// zstd needs a build with cgo
+	if _, err := model.NewCompressor(model.CompressionZstd, 0); err == nil {
+		valid = append(valid, "compression=zstd\ncompression_level=19")
+	} else {
+		invalid = append(invalid, "compression=zstd")
+	}
+	for _, kv := range valid {
+		dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\n" + kv))
+		_, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		assert.Nil(err, kv)
+	}
+	for _, kv := range invalid {
+		dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\n" + kv))
+		_, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		if assert.NotNil(err, kv) {
+			assert.Contains(err.Error(), "`compression` in [trace.api] section", kv)
+		}
+	}
+}
+
+func TestRoutingConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.routing]",
+		"tag = team",
+		"payments = https://trace.agent.datadoghq.com, apikey_payments",
+		"search = http://localhost:8080,apikey_search",
+	}, "\n")))
+
+	c, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal("team", c.RoutingTag)
+	assert.Equal([]Route{
+		{Value: "payments", Endpoint: "https://trace.agent.datadoghq.com", APIKey: "apikey_payments"},
+		{Value: "search", Endpoint: "http://localhost:8080", APIKey: "apikey_search"},
+	}, c.Routes)
+
+	dd, _ = ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.routing]",
+		"payments = https://trace.agent.datadoghq.com",
+	}, "\n")))
+
+	_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "`payments` in [trace.routing] section: expected <endpoint>,<api_key>")
+	}
+}
+
 func TestDefaultConfig(t *testing.T) {
 	assert := assert.New(t)
 	agentConfig := NewDefaultAgentConfig()
@@ -59,6 +215,7 @@ func TestOnlyDDAgentConfig(t *testing.T) {
 		"bind_host = 0.0.0.0",
 		"dogstatsd_port = 28125",
 		"log_level = DEBUG",
+		"log_format = json",
 	}, "\n")))
 	configFile := &File{instance: ddAgentConf, Path: "whatever"}
 	agentConfig, _ := NewAgentConfig(configFile, nil)
@@ -68,6 +225,7 @@ func TestOnlyDDAgentConfig(t *testing.T) {
 	assert.Equal("0.0.0.0", agentConfig.ReceiverHost)
 	assert.Equal(28125, agentConfig.StatsdPort)
 	assert.Equal("DEBUG", agentConfig.LogLevel)
+	assert.Equal("json", agentConfig.LogFormat)
 }
 
 func TestDDAgentMultiAPIKeys(t *testing.T) {
@@ -131,6 +289,499 @@ func TestDDAgentConfigWithNewOpts(t *testing.T) {
 	assert.Equal(0.33, agentConfig.ExtraSampleRate)
 }
 
+func TestAuthFailureConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	// without API key, the agent only starts in local mode
+	dd, _ := ini.Load([]byte("[Main]\n\nhostname=thing\n[trace.api]\non_auth_failure=buffer"))
+	_, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+
+	dd, _ = ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"[trace.api]",
+		"on_auth_failure = Local",
+		"local_dir = /tmp/payloads",
+		"local_max_size = 1024",
+	}, "\n")))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(AuthFailureLocal, agentConfig.APIAuthFailure)
+	assert.Equal("/tmp/payloads", agentConfig.APILocalDir)
+	assert.Equal(1024, agentConfig.APILocalMaxSize)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\non_auth_failure=retry"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(AuthFailureDrop, agentConfig.APIAuthFailure)
+}
+
+func TestUniformSampleRateConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.sampler]\nuniform_rate=0.05"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(0.05, agentConfig.UniformSampleRate)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.sampler]\nuniform_rate=5"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(0.0, agentConfig.UniformSampleRate)
+}
+
+func TestDedupeWindowFlushesConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.sampler]\ndedupe_window_flushes=6"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(6, agentConfig.DedupeWindowFlushes)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.sampler]\ndedupe_window_flushes=-1"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(0, agentConfig.DedupeWindowFlushes)
+}
+
+func TestDecisionLogConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", NewDefaultAgentConfig().DecisionLogDir)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.sampler]\ndecision_log_dir=/tmp/decisions\ndecision_log_max_size=1M"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal("/tmp/decisions", agentConfig.DecisionLogDir)
+	assert.Equal(int64(1<<20), agentConfig.DecisionLogMaxSize)
+}
+
+func TestReceiverServerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	agentConfig := NewDefaultAgentConfig()
+	assert.Equal(5*time.Second, agentConfig.ReceiverReadTimeout)
+	assert.Equal(5*time.Second, agentConfig.ReceiverWriteTimeout)
+	assert.Equal(time.Minute, agentConfig.ReceiverIdleTimeout)
+	assert.Equal(8192, agentConfig.ReceiverMaxHeaderBytes)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\ntimeout=2\nwrite_timeout=500ms\nidle_timeout=10s\nmax_header_bytes=4KB"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(2*time.Second, agentConfig.ReceiverReadTimeout)
+	assert.Equal(500*time.Millisecond, agentConfig.ReceiverWriteTimeout)
+	assert.Equal(10*time.Second, agentConfig.ReceiverIdleTimeout)
+	assert.Equal(4096, agentConfig.ReceiverMaxHeaderBytes)
+
+	for _, kv := range []string{"read_timeout=0", "write_timeout=-1s", "idle_timeout=forever", "max_header_bytes=0"} {
+		dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\n" + kv))
+		agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		assert.NotNil(err, kv)
+		assert.Equal(5*time.Second, agentConfig.ReceiverReadTimeout, kv)
+		assert.Equal(5*time.Second, agentConfig.ReceiverWriteTimeout, kv)
+		assert.Equal(time.Minute, agentConfig.ReceiverIdleTimeout, kv)
+		assert.Equal(8192, agentConfig.ReceiverMaxHeaderBytes, kv)
+	}
+}
+
+func TestOutputConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(OutputAPI, NewDefaultAgentConfig().OutputType)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.output]\ntype=Kafka\nkafka_brokers=kafka-1:9092, kafka-2:9092"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(OutputKafka, agentConfig.OutputType)
+	assert.Equal([]string{"kafka-1:9092", "kafka-2:9092"}, agentConfig.KafkaBrokers)
+
+	for _, kv := range []string{"type=kafka", "type=both\nkafka_brokers= ,", "type=s3"} {
+		dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.output]\n" + kv))
+		_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		assert.NotNil(err, kv)
+	}
+}
+
+func TestReceiverAuthConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	agentConfig := NewDefaultAgentConfig()
+	assert.Equal("", agentConfig.ReceiverAuthToken)
+	assert.False(agentConfig.ReceiverDebugAuth)
+	assert.Equal("", agentConfig.ReceiverSocket)
+	assert.False(agentConfig.ReceiverSocketSkipAuth)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\nauth_token=s3cr3t\ndebug_auth=true\nreceiver_socket=/var/run/datadog/apm.socket\nsocket_skip_auth=true"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal("s3cr3t", agentConfig.ReceiverAuthToken)
+	assert.True(agentConfig.ReceiverDebugAuth)
+	assert.Equal("/var/run/datadog/apm.socket", agentConfig.ReceiverSocket)
+	assert.True(agentConfig.ReceiverSocketSkipAuth)
+
+	// never published
+	data, err := json.Marshal(agentConfig)
+	assert.Nil(err)
+	assert.NotContains(string(data), "s3cr3t")
+}
+
+func TestOversizedPayloadsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	agentConfig := NewDefaultAgentConfig()
+	assert.False(agentConfig.ReceiverAcceptOversized)
+	assert.Equal(int64(0), agentConfig.ReceiverMaxTraceBytes)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\naccept_oversized_payloads=true\nmax_trace_size=2MB"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.ReceiverAcceptOversized)
+	assert.Equal(int64(2<<20), agentConfig.ReceiverMaxTraceBytes)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\nmax_trace_size=-1"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(int64(0), agentConfig.ReceiverMaxTraceBytes)
+}
+
+func TestClockSkewThresholdConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(10*time.Second, NewDefaultAgentConfig().ClockSkewThreshold)
+
+	for _, tc := range []struct {
+		kv        string
+		threshold time.Duration
+		valid     bool
+	}{
+		{"clock_skew_threshold=1m", time.Minute, true},
+		{"clock_skew_threshold=0", 0, true},
+		{"clock_skew_threshold=-1s", 10 * time.Second, false},
+	} {
+		dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\n" + tc.kv))
+		agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		assert.Equal(tc.valid, err == nil, tc.kv)
+		assert.Equal(tc.threshold, agentConfig.ClockSkewThreshold, tc.kv)
+	}
+}
+
+func TestGlobalTagsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.config]\nglobal_tags=datacenter:us-east-1a, team:platform,url:http://host:80,"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"datacenter": "us-east-1a", "team": "platform", "url": "http://host:80"}, agentConfig.GlobalTags)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.config]\nglobal_tags=datacenter:us-east-1a,team,:platform"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid value 'team'")
+	assert.Contains(err.Error(), "invalid value ':platform'")
+	assert.Equal(map[string]string{"datacenter": "us-east-1a"}, agentConfig.GlobalTags)
+}
+
+func TestAuditConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\naudit_dir=/tmp/audit\naudit_sample_rate=0.5\naudit_max_size=1000"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal("/tmp/audit", agentConfig.APIAuditDir)
+	assert.Equal(0.5, agentConfig.APIAuditSampleRate)
+	assert.Equal(1000, agentConfig.APIAuditMaxSize)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\naudit_sample_rate=-1"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(0.01, agentConfig.APIAuditSampleRate)
+}
+
+func TestDryRunConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(NewDefaultAgentConfig().APIDryRun)
+	// no API key is needed, nothing being sent
+	dd, _ := ini.Load([]byte("[Main]\n\n[trace.api]\ndry_run=true\ndry_run_dir=/tmp/dry-run\ndry_run_max_payloads=3"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.APIDryRun)
+	assert.Equal("/tmp/dry-run", agentConfig.APIDryRunDir)
+	assert.Equal(3, agentConfig.APIDryRunMaxPayloads)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\ndry_run=true\ndry_run_max_payloads=-1"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(10, agentConfig.APIDryRunMaxPayloads)
+}
+
+func TestAPIConnectionsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nmax_idle_conns_per_host=8\nidle_conn_timeout=30s\nconn_max_lifetime=5m\ndisable_keep_alives=true"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(8, agentConfig.APIMaxIdleConnsPerHost)
+	assert.Equal(30*time.Second, agentConfig.APIIdleConnTimeout)
+	assert.Equal(5*time.Minute, agentConfig.APIConnMaxLifetime)
+	assert.True(agentConfig.APIDisableKeepAlives)
+}
+
+func TestFlushBatchConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, NewDefaultAgentConfig().APIFlushBatchMaxPayloads)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nflush_batch_max_payloads=10\nflush_batch_max_wait=1m"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(10, agentConfig.APIFlushBatchMaxPayloads)
+	assert.Equal(time.Minute, agentConfig.APIFlushBatchMaxWait)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nflush_batch_max_payloads=-1\nflush_batch_max_wait=0"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "flush_batch_max_payloads")
+	assert.Contains(err.Error(), "flush_batch_max_wait")
+	assert.Equal(0, agentConfig.APIFlushBatchMaxPayloads)
+	assert.Equal(30*time.Second, agentConfig.APIFlushBatchMaxWait)
+}
+
+func TestPartialBucketConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	defaults := NewDefaultAgentConfig()
+	assert.True(defaults.SkipFirstPartialBucket)
+	assert.Equal(PartialFlushDrop, defaults.PartialFlushMode)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nskip_first_partial_bucket=false\npartial_flush_mode=Flag"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.False(agentConfig.SkipFirstPartialBucket)
+	assert.Equal(PartialFlushFlag, agentConfig.PartialFlushMode)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\npartial_flush_mode=keep"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal(PartialFlushDrop, agentConfig.PartialFlushMode)
+}
+
+func TestMaxDurationConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	defaults := NewDefaultAgentConfig()
+	assert.Equal(30*time.Minute, defaults.MaxDuration)
+	assert.Nil(defaults.MaxDurationByService)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nmax_duration=1h\n[trace.concentrator.max_duration]\nBatch-Jobs=12h\nweb=0"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(time.Hour, agentConfig.MaxDuration)
+	assert.Equal(map[string]time.Duration{"batch-jobs": 12 * time.Hour, "web": 0}, agentConfig.MaxDurationByService)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nmax_duration=-1m\n[trace.concentrator.max_duration]\nweb=forever"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "max_duration")
+	assert.Contains(err.Error(), "web")
+	assert.Equal(30*time.Minute, agentConfig.MaxDuration)
+}
+
+func TestDerivedWaitMetricsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(NewDefaultAgentConfig().DerivedWaitMetrics)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nderived_wait_metrics=true"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.DerivedWaitMetrics)
+}
+
+func TestTopResourcesConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, NewDefaultAgentConfig().TopResources)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\ntop_resources=10"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(10, agentConfig.TopResources)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\ntop_resources=-1"))
+	_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "top_resources")
+	}
+}
+
+func TestQuantileBoundsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(NewDefaultAgentConfig().QuantileBounds)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nquantile_bounds=true"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.QuantileBounds)
+}
+
+func TestLatencyAlertsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	assert.False(c.LatencyAlerts)
+	assert.Equal(float64(2), c.LatencyAlertFactor)
+	assert.Equal(100, c.LatencyAlertMinHits)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nlatency_alerts=true\nlatency_alert_factor=1.5\nlatency_alert_min_hits=10"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.LatencyAlerts)
+	assert.Equal(1.5, agentConfig.LatencyAlertFactor)
+	assert.Equal(10, agentConfig.LatencyAlertMinHits)
+
+	for _, invalid := range []string{"latency_alert_factor=1", "latency_alert_min_hits=-1"} {
+		dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\n" + invalid))
+		agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		if assert.NotNil(err) {
+			assert.Contains(err.Error(), invalid[:strings.Index(invalid, "=")])
+		}
+	}
+}
+
+func TestTimersConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	assert.Equal(0, c.TimersPort)
+	assert.Equal(1000, c.TimersMaxKeys)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.statsd]\nport=8127\ntag_mapping=service:app, resource:endpoint\nmax_keys=10"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(8127, agentConfig.TimersPort)
+	assert.Equal(map[string]string{TimerTagService: "app", TimerTagResource: "endpoint", TimerTagEnv: "env"}, agentConfig.TimersTags)
+	assert.Equal(10, agentConfig.TimersMaxKeys)
+	// the defaults are untouched
+	assert.Equal("service", NewDefaultAgentConfig().TimersTags[TimerTagService])
+
+	for _, invalid := range []string{"port=70000", "tag_mapping=host:hostname", "tag_mapping=service", "max_keys=0"} {
+		dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.statsd]\n" + invalid))
+		_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		if assert.NotNil(err, invalid) {
+			assert.Contains(err.Error(), invalid[:strings.Index(invalid, "=")])
+		}
+	}
+}
+
+func TestTrimMetaConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Len(NewDefaultAgentConfig().TrimMeta, 0)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.writer]\ntrim_meta=sql.query:2048, http.headers:0"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal([]MetaTrimRule{{Key: "sql.query", MaxLen: 2048}, {Key: "http.headers", MaxLen: 0}}, agentConfig.TrimMeta)
+
+	for _, invalid := range []string{"sql.query", "sql.query:-1", "sql.query:2k", ":10", "error.msg:100", "error.stack:0"} {
+		dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.writer]\ntrim_meta=" + invalid))
+		_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		if assert.NotNil(err, invalid) {
+			assert.Contains(err.Error(), "trim_meta")
+		}
+	}
+}
+
+func TestPayloadChecksumsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	assert.False(c.PayloadChecksums)
+	assert.Equal(0, c.PayloadDedupeSize)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\npayload_checksums=true\npayload_dedupe_size=1000"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.PayloadChecksums)
+	assert.Equal(1000, agentConfig.PayloadDedupeSize)
+}
+
+func TestAPIPathsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	assert.False(c.APISplitPayloads)
+	assert.Equal("/api/v0.2/traces", c.APITracesPath)
+	assert.Equal("/api/v0.2/stats", c.APIStatsPath)
+	assert.Equal("/api/v0.1/services", c.APIServicesPath)
+
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nsplit_payloads=true\ntraces_path=/v1/traces\nstats_path=v1/stats"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "stats_path")
+	assert.True(agentConfig.APISplitPayloads)
+	assert.Equal("/v1/traces", agentConfig.APITracesPath)
+	assert.Equal("/api/v0.2/stats", agentConfig.APIStatsPath)
+}
+
+func TestDebugAllowedOriginsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewDefaultAgentConfig().DebugAllowedOrigins)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.debug]\nallowed_origins=http://localhost:3000/, https://ui.example:8443,*"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal([]string{"http://localhost:3000", "https://ui.example:8443", "*"}, agentConfig.DebugAllowedOrigins)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.debug]\nallowed_origins=localhost:3000,http://localhost/ui,http://ok:1"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "allowed_origins")
+	assert.Equal([]string{"http://ok:1"}, agentConfig.DebugAllowedOrigins)
+}
+
+func TestPrecisionTiersConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewDefaultAgentConfig().PrecisionTiers)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nprecision_tiers=1000:0.02, 100000:0.01, 0.005"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal([]PrecisionTier{{Below: 1000, Epsilon: 0.02}, {Below: 100000, Epsilon: 0.01}, {Epsilon: 0.005}}, agentConfig.PrecisionTiers)
+
+	for _, raw := range []string{"1000:0.02,100:0.01", "0.005,1000:0.02", "many:0.02", "1000:1", "1000:-0.01", "0"} {
+		dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.concentrator]\nprecision_tiers=" + raw))
+		_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		if assert.NotNil(err, raw) {
+			assert.Contains(err.Error(), "precision_tiers", raw)
+		}
+	}
+}
+
+func TestMaxSamplerMemoryConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(int64(100<<20), NewDefaultAgentConfig().MaxSamplerMemory)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.sampler]\nmax_sampler_memory=64M"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(int64(64<<20), agentConfig.MaxSamplerMemory)
+}
+
+func TestStatsOnlyConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(NewDefaultAgentConfig().StatsOnly)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.config]\nstats_only=true"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.StatsOnly)
+}
+
+func TestReceiverLogRequestsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(NewDefaultAgentConfig().ReceiverLogRequests)
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\nlog_requests=true"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.ReceiverLogRequests)
+}
+
 func TestConfigNewIfExists(t *testing.T) {
 	// The file does not exist: no error returned
 	conf, err := NewIfExists("/does-not-exist")
@@ -155,3 +806,35 @@ func TestGetHostname(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotEqual(t, "", h)
 }
+
+func TestFlushJitterConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefaultAgentConfig()
+	assert.Equal(time.Duration(0), c.APIFlushJitter)
+	assert.False(c.APIFlushJitterAuto)
+
+	for raw, expected := range map[string]struct {
+		jitter time.Duration
+		auto   bool
+	}{
+		"auto": {0, true},
+		"off":  {0, false},
+		"2s":   {2 * time.Second, false},
+		"3":    {3 * time.Second, false},
+	} {
+		dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nflush_jitter=" + raw))
+		agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		assert.Nil(err, raw)
+		assert.Equal(expected.jitter, agentConfig.APIFlushJitter, raw)
+		assert.Equal(expected.auto, agentConfig.APIFlushJitterAuto, raw)
+	}
+
+	for _, raw := range []string{"-2s", "sometimes"} {
+		dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nflush_jitter=" + raw))
+		_, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+		if assert.NotNil(err, raw) {
+			assert.Contains(err.Error(), "flush_jitter")
+		}
+	}
+}
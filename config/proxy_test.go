@@ -13,8 +13,8 @@ import (
 
 func getURL(f *ini.File) (*url.URL, error) {
 	conf := File{
-		f,
-		"some/path",
+		instance: f,
+		Path:     "some/path",
 	}
 	m, _ := conf.GetSection("Main")
 	p := getProxySettings(m)
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefixes of the values which refer to their actual value elsewhere, so that
+// secrets such as API keys do not have to be written in the config file.
+const (
+	// fileRefPrefix refers to the contents of a file, e.g. a docker or
+	// kubernetes secret: file:///run/secrets/dd_api_key
+	fileRefPrefix = "file://"
+	// envRefPrefix refers to an environment variable: env://DD_API_KEY
+	envRefPrefix = "env://"
+)
+
+// fileRefs caches the contents of the files referred to by config values, by
+// path
+type fileRefs struct {
+	mu       sync.Mutex
+	contents map[string]string
+}
+
+var refs fileRefs
+
+// resolve returns the value referred to by raw, the value of section/name,
+// or raw itself if it is not a reference. It returns an *ErrInvalidValue if
+// the reference cannot be followed.
+func (c *File) resolve(section, name, raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, fileRefPrefix):
+		path := strings.TrimPrefix(raw, fileRefPrefix)
+		if path == "" {
+			return "", &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "no file path"}
+		}
+		v, err := refs.read(path)
+		if err != nil {
+			return "", &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: err.Error()}
+		}
+		return v, nil
+	case strings.HasPrefix(raw, envRefPrefix):
+		key := strings.TrimPrefix(raw, envRefPrefix)
+		v, ok := os.LookupEnv(key)
+		if key == "" || !ok {
+			return "", &ErrInvalidValue{Section: section, Name: name, Raw: raw, Reason: "environment variable not set"}
+		}
+		return v, nil
+	}
+	return raw, nil
+}
+
+// read returns the trimmed contents of the file at path, which is only read
+// the first time
+func (r *fileRefs) read(path string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.contents[path]; ok {
+		return v, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if r.contents == nil {
+		r.contents = make(map[string]string)
+	}
+	v := strings.TrimSpace(string(b))
+	r.contents[path] = v
+	return v, nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSecret writes contents in a file of dir named name, and returns its
+// reference
+func writeSecret(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + path
+}
+
+func TestFileReference(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = " + writeSecret(t, dir, "dd_api_key", "  secret_key\n"),
+		"port = " + writeSecret(t, dir, "port", "8126\n"),
+		"absent = file://" + filepath.Join(dir, "absent"),
+		"nopath = file://",
+	}, "\n")))
+	conf := &File{instance: dd, Path: "whatever"}
+
+	v, err := conf.Get("Main", "api_key")
+	assert.Nil(err)
+	assert.Equal("secret_key", v)
+	port, err := conf.GetInt("Main", "port")
+	assert.Nil(err)
+	assert.Equal(8126, port)
+
+	// files are only read once
+	writeSecret(t, dir, "dd_api_key", "rotated_key")
+	v, _ = conf.Get("Main", "api_key")
+	assert.Equal("secret_key", v)
+
+	for _, name := range []string{"absent", "nopath"} {
+		_, err = conf.GetInt("Main", name)
+		var invalid *ErrInvalidValue
+		if assert.True(errorAs(err, &invalid), "%s: %v", name, err) {
+			assert.Equal(name, invalid.Name)
+			assert.True(strings.HasPrefix(invalid.Raw, "file://"))
+		}
+	}
+	_, err = conf.Get("Main", "absent")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), filepath.Join(dir, "absent"))
+	}
+	assert.Equal("default", conf.GetDefault("Main", "absent", "default"))
+}
+
+func TestEnvReference(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("DD_TEST_REF_BOOL", "yes")
+	defer os.Unsetenv("DD_TEST_REF_BOOL")
+	os.Unsetenv("DD_TEST_REF_UNSET")
+
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[trace.config]",
+		"stats_only = env://DD_TEST_REF_BOOL",
+		"unset = env://DD_TEST_REF_UNSET",
+		"novar = env://",
+		"plain = envelope",
+	}, "\n")))
+	conf := &File{instance: dd, Path: "whatever"}
+
+	b, err := conf.GetBool("trace.config", "stats_only")
+	assert.Nil(err)
+	assert.True(b)
+	v, err := conf.Get("trace.config", "plain")
+	assert.Nil(err)
+	assert.Equal("envelope", v)
+
+	for _, name := range []string{"unset", "novar"} {
+		_, err := conf.Get("trace.config", name)
+		var invalid *ErrInvalidValue
+		if assert.True(errorAs(err, &invalid), "%s: %v", name, err) {
+			assert.Equal("trace.config", invalid.Section)
+			assert.Equal(name, invalid.Name)
+		}
+	}
+}
+
+func TestAPIKeyFileReference(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = " + writeSecret(t, dir, "dd_api_key", "key1, key2\n"),
+		"[trace.api]",
+		"endpoint = https://one.example.com,https://two.example.com",
+	}, "\n")))
+	c, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal([]string{"key1", "key2"}, c.APIKeys)
+
+	// a missing secret is an invalid configuration
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key = file://" + filepath.Join(dir, "absent")))
+	_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "api_key")
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"errors"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+)
+
+// renamedKey is a key of older config files, still read when its current
+// name is not set
+type renamedKey struct {
+	section, name             string // current
+	legacySection, legacyName string
+
+	// convert turns a legacy value into a current one, nil when they share
+	// their format. An empty value leaves the current key unset.
+	convert func(raw string) (string, error)
+}
+
+// renamedKeys are the keys renamed over time, by current name
+var renamedKeys = []renamedKey{
+	// a single timeout in seconds, <= 0 for the default
+	{"trace.receiver", "read_timeout", "trace.receiver", "timeout", positiveSeconds},
+	{"trace.receiver", "write_timeout", "trace.receiver", "timeout", positiveSeconds},
+}
+
+// getRenamed returns the value of the legacy key of section/name, or an
+// *ErrMissingKey for section/name if it has none or the file does not set it
+func (c *File) getRenamed(section, name string) (string, error) {
+	for _, k := range renamedKeys {
+		if k.section != section || k.name != name || !c.instance.Section(k.legacySection).HasKey(k.legacyName) {
+			continue
+		}
+		log.Warnf("`%s` in [%s] section is deprecated, set `%s` in [%s] section instead",
+			k.legacyName, k.legacySection, k.name, k.section)
+		raw, err := c.resolve(k.legacySection, k.legacyName, c.instance.Section(k.legacySection).Key(k.legacyName).String())
+		if err != nil || k.convert == nil {
+			return raw, err
+		}
+		v, err := k.convert(raw)
+		if err != nil {
+			return "", &ErrInvalidValue{Section: k.legacySection, Name: k.legacyName, Raw: raw, Reason: err.Error()}
+		}
+		return v, nil
+	}
+	return "", &ErrMissingKey{Section: section, Name: name}
+}
+
+// positiveSeconds turns a number of seconds into a duration, non-positive
+// numbers being left unset
+func positiveSeconds(raw string) (string, error) {
+	secs, err := strconv.Atoi(raw)
+	if err != nil {
+		return "", errors.New("not an integer")
+	}
+	if secs <= 0 {
+		return "", nil
+	}
+	return raw + "s", nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenamedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	// only legacy keys
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\ntimeout=2"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(2*time.Second, agentConfig.ReceiverReadTimeout)
+	assert.Equal(2*time.Second, agentConfig.ReceiverWriteTimeout)
+
+	// the current keys win
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\ntimeout=2\nread_timeout=1s\nwrite_timeout=3s"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(time.Second, agentConfig.ReceiverReadTimeout)
+	assert.Equal(3*time.Second, agentConfig.ReceiverWriteTimeout)
+
+	// the legacy meaning of the values is kept
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\ntimeout=0"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.Equal(5*time.Second, agentConfig.ReceiverReadTimeout)
+	assert.Equal(5*time.Second, agentConfig.ReceiverWriteTimeout)
+
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.receiver]\ntimeout=2m"))
+	agentConfig, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid value '2m' for `timeout`")
+	assert.Equal(5*time.Second, agentConfig.ReceiverReadTimeout)
+}
+
+func TestRenamedKeysGet(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte("[trace.receiver]\ntimeout=10"))
+	conf := &File{instance: dd, Path: "whatever"}
+
+	v, err := conf.Get("trace.receiver", "read_timeout")
+	assert.Nil(err)
+	assert.Equal("10s", v)
+	d, err := conf.GetDuration("trace.receiver", "write_timeout")
+	assert.Nil(err)
+	assert.Equal(10*time.Second, d)
+
+	// keys without a legacy name are still missing
+	_, err = conf.Get("trace.receiver", "idle_timeout")
+	assert.Equal(&ErrMissingKey{Section: "trace.receiver", Name: "idle_timeout"}, err)
+}
@@ -1,13 +1,51 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	log "github.com/cihub/seelog"
 )
 
+const (
+	// LogFormatText is the default, human-readable log format.
+	LogFormatText = "text"
+	// LogFormatJSON outputs every log record as a single-line JSON object.
+	LogFormatJSON = "json"
+
+	textLogFormat = "%Date %Time %LEVEL (%Caller) - %FieldsMsg%n"
+	jsonLogFormat = `{"ts":"%Date(2006-01-02T15:04:05.000Z07:00)","level":"%LEVEL","component":%Component,"msg":%JSONMsg}%n`
+
+	// recordSep delimits the header that WithFields prepends to messages.
+	recordSep = "\x1f"
+)
+
+// reservedFields are the keys of the JSON records, prefixed with
+// reservedFieldPrefix when used as field names so that they are never
+// duplicated.
+var reservedFields = map[string]struct{}{"ts": {}, "level": {}, "component": {}, "msg": {}}
+
+const reservedFieldPrefix = "field_"
+
+// minLogLevel is the level of the logger set by NewLogger, below which
+// FieldsLogger skips building its records. It is a log.LogLevel.
+var minLogLevel int32 = int32(log.TraceLvl)
+
+func init() {
+	log.RegisterCustomFormatter("Caller", func(string) log.FormatterFunc { return formatCaller })
+	log.RegisterCustomFormatter("Component", func(string) log.FormatterFunc { return formatComponent })
+	log.RegisterCustomFormatter("FieldsMsg", func(string) log.FormatterFunc { return formatFieldsMsg })
+	log.RegisterCustomFormatter("JSONMsg", func(string) log.FormatterFunc { return formatJSONMsg })
+}
+
 type outputs struct {
 	FormatID string `xml:"formatid,attr"`
 	Console  string `xml:",innerxml"`
@@ -28,28 +66,39 @@ type seelog struct {
 	LogLevel string  `xml:"minlevel,attr"`
 }
 
-func newSeelogConfig(logFilePath string) seelog {
-	// Rotate log files when size reaches 10MB
+func newSeelogConfig(logFilePath, logFormat string, maxSize int) seelog {
+	// Rotate log files when size reaches maxSize
 	outputXML := fmt.Sprintf(
-		"<console /> <rollingfile type=\"size\" filename=\"%s\" maxsize=\"10000000\" maxrolls=\"5\" />",
-		logFilePath,
+		"<console /> <rollingfile type=\"size\" filename=\"%s\" maxsize=\"%d\" maxrolls=\"5\" />",
+		logFilePath, maxSize,
 	)
 
+	f := textLogFormat
+	if logFormat == LogFormatJSON {
+		f = jsonLogFormat
+	}
+
 	return seelog{
 		Outputs: outputs{"common", outputXML},
 		Formats: formats{
 			format{
 				ID:     "common",
-				Format: "%Date %Time %LEVEL (%File:%Line) - %Msg%n",
+				Format: f,
 			},
 		},
 		LogLevel: "info",
 	}
 }
 
-// NewLoggerLevelCustom creates a logger with the given level.
+// NewLoggerLevelCustom creates a text logger with the given level.
 func NewLoggerLevelCustom(level, logFilePath string) error {
-	cfg := newSeelogConfig(logFilePath)
+	return NewLogger(level, logFilePath, LogFormatText, defaultLogFileMaxSize)
+}
+
+// NewLogger creates a logger with the given level, output file, format and
+// rotation size.
+func NewLogger(level, logFilePath, logFormat string, maxSize int) error {
+	cfg := newSeelogConfig(logFilePath, logFormat, maxSize)
 	ll, ok := log.LogLevelFromString(strings.ToLower(level))
 	if !ok {
 		ll = log.InfoLvl
@@ -60,6 +109,7 @@ func NewLoggerLevelCustom(level, logFilePath string) error {
 		return err
 	}
 	log.ReplaceLogger(l)
+	atomic.StoreInt32(&minLogLevel, int32(ll))
 	return nil
 }
 
@@ -70,3 +120,171 @@ func (s seelog) String() string {
 	}
 	return string(b)
 }
+
+// Fields are key/value pairs attached to a log record.
+type Fields map[string]interface{}
+
+// FieldsLogger logs records carrying a set of Fields. In the json log format
+// fields are emitted as top-level keys, in the text format they are appended
+// to the message as key=value pairs.
+type FieldsLogger struct {
+	fields Fields
+}
+
+// WithFields returns a logger attaching the given fields to its records.
+func WithFields(f Fields) FieldsLogger {
+	return FieldsLogger{fields: f}
+}
+
+// Debugf logs a formatted message at debug level.
+func (l FieldsLogger) Debugf(format string, params ...interface{}) {
+	if !logEnabled(log.DebugLvl) {
+		return
+	}
+	log.Debug(l.message(format, params))
+}
+
+// Infof logs a formatted message at info level.
+func (l FieldsLogger) Infof(format string, params ...interface{}) {
+	if !logEnabled(log.InfoLvl) {
+		return
+	}
+	log.Info(l.message(format, params))
+}
+
+// Warnf logs a formatted message at warn level.
+func (l FieldsLogger) Warnf(format string, params ...interface{}) {
+	if !logEnabled(log.WarnLvl) {
+		return
+	}
+	log.Warn(l.message(format, params))
+}
+
+// Errorf logs a formatted message at error level.
+func (l FieldsLogger) Errorf(format string, params ...interface{}) {
+	if !logEnabled(log.ErrorLvl) {
+		return
+	}
+	log.Error(l.message(format, params))
+}
+
+// logEnabled tells if the records of level are logged, see minLogLevel
+func logEnabled(level log.LogLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLogLevel)
+}
+
+// message encodes the caller and the fields in a header, seelog only giving
+// the formatters the location of this file otherwise.
+func (l FieldsLogger) message(format string, params []interface{}) string {
+	caller := ""
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	fields, err := json.Marshal(escapeReservedFields(l.fields))
+	if err != nil {
+		fields = []byte("{}")
+	}
+	return recordSep + caller + recordSep + string(fields) + recordSep + fmt.Sprintf(format, params...)
+}
+
+// escapeReservedFields returns f, with the reservedFields keys prefixed with
+// reservedFieldPrefix, copied if there are any
+func escapeReservedFields(f Fields) Fields {
+	var escaped Fields
+	for k := range f {
+		if _, ok := reservedFields[k]; ok {
+			escaped = make(Fields, len(f))
+			break
+		}
+	}
+	if escaped == nil {
+		return f
+	}
+	for k, v := range f {
+		if _, ok := reservedFields[k]; ok {
+			k = reservedFieldPrefix + k
+		}
+		escaped[k] = v
+	}
+	return escaped
+}
+
+// record is a log message split from the header added by WithFields.
+type record struct {
+	caller string
+	fields []byte
+	msg    string
+}
+
+func parseRecord(message string) record {
+	if !strings.HasPrefix(message, recordSep) {
+		return record{msg: message}
+	}
+	parts := strings.SplitN(message[len(recordSep):], recordSep, 3)
+	if len(parts) != 3 {
+		return record{msg: message}
+	}
+	return record{caller: parts[0], fields: []byte(parts[1]), msg: parts[2]}
+}
+
+func (r record) callerOrContext(context log.LogContextInterface) string {
+	if r.caller != "" || context == nil {
+		return r.caller
+	}
+	return context.FileName() + ":" + strconv.Itoa(context.Line())
+}
+
+func formatCaller(message string, level log.LogLevel, context log.LogContextInterface) interface{} {
+	return parseRecord(message).callerOrContext(context)
+}
+
+// formatComponent outputs the quoted name of the file the record comes
+// from, e.g. "receiver" or "writer".
+func formatComponent(message string, level log.LogLevel, context log.LogContextInterface) interface{} {
+	caller := parseRecord(message).callerOrContext(context)
+	if i := strings.LastIndex(caller, ".go:"); i >= 0 {
+		caller = caller[:i]
+	}
+	b, _ := json.Marshal(caller)
+	return string(b)
+}
+
+// formatFieldsMsg outputs the message followed by its sorted key=value fields.
+func formatFieldsMsg(message string, level log.LogLevel, context log.LogContextInterface) interface{} {
+	r := parseRecord(message)
+	if len(r.fields) == 0 {
+		return r.msg
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(r.fields, &fields); err != nil || len(fields) == 0 {
+		return r.msg
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(r.msg)
+	for _, k := range keys {
+		v := string(fields[k])
+		if s, err := strconv.Unquote(v); err == nil {
+			v = s
+		}
+		fmt.Fprintf(&buf, " %s=%s", k, v)
+	}
+	return buf.String()
+}
+
+// formatJSONMsg outputs the quoted message followed by its fields as extra
+// JSON keys, so that it can be embedded in a JSON object.
+func formatJSONMsg(message string, level log.LogLevel, context log.LogContextInterface) interface{} {
+	r := parseRecord(message)
+	b, _ := json.Marshal(r.msg)
+	if len(r.fields) < 2 || string(r.fields) == "{}" || string(r.fields) == "null" {
+		return string(b)
+	}
+	// r.fields is a JSON object: splice its members after the message
+	return string(b) + "," + string(r.fields[1:len(r.fields)-1])
+}
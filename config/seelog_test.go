@@ -0,0 +1,129 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/cihub/seelog"
+	"github.com/stretchr/testify/assert"
+)
+
+func captureLogs(t *testing.T, format string, f func()) []string {
+	var buf bytes.Buffer
+	l, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.DebugLvl, format)
+	assert.Nil(t, err)
+	log.ReplaceLogger(l)
+	defer log.ReplaceLogger(log.Disabled)
+
+	f()
+	log.Flush()
+
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := captureLogs(t, jsonLogFormat, func() {
+		log.Info("a \"quoted\" message")
+		WithFields(Fields{"dropped": 3, "endpoint": "/v0.3/traces"}).Errorf("dropped %d traces", 3)
+	})
+	assert.Len(lines, 2)
+
+	records := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		assert.Nil(json.Unmarshal([]byte(line), &records[i]), line)
+		for _, k := range []string{"ts", "level", "component", "msg"} {
+			assert.Contains(records[i], k)
+		}
+		assert.Equal("seelog_test", records[i]["component"])
+	}
+
+	assert.Equal("INFO", records[0]["level"])
+	assert.Equal("a \"quoted\" message", records[0]["msg"])
+
+	assert.Equal("ERROR", records[1]["level"])
+	assert.Equal("dropped 3 traces", records[1]["msg"])
+	assert.Equal(float64(3), records[1]["dropped"])
+	assert.Equal("/v0.3/traces", records[1]["endpoint"])
+}
+
+func TestJSONLogFormatReservedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := captureLogs(t, jsonLogFormat, func() {
+		WithFields(Fields{"msg": "field", "level": 1, "ts": 2, "component": 3, "service": "web"}).Warnf("message")
+	})
+	assert.Len(lines, 1)
+
+	// no key is duplicated, the decoder below keeping the last one
+	assert.Equal(1, strings.Count(lines[0], `"msg":`), lines[0])
+	assert.Equal(1, strings.Count(lines[0], `"level":`), lines[0])
+
+	var record map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(lines[0]), &record), lines[0])
+	assert.Equal("message", record["msg"])
+	assert.Equal("WARN", record["level"])
+	assert.Equal("seelog_test", record["component"])
+	assert.Equal("field", record["field_msg"])
+	assert.Equal(float64(1), record["field_level"])
+	assert.Equal(float64(2), record["field_ts"])
+	assert.Equal(float64(3), record["field_component"])
+	assert.Equal("web", record["service"])
+}
+
+// countingMarshaler counts how many times it is marshalled
+type countingMarshaler struct {
+	n *int
+}
+
+func (m countingMarshaler) MarshalJSON() ([]byte, error) {
+	*m.n++
+	return []byte("0"), nil
+}
+
+func TestFieldsLoggerDisabledLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	defer atomic.StoreInt32(&minLogLevel, atomic.LoadInt32(&minLogLevel))
+	atomic.StoreInt32(&minLogLevel, int32(log.WarnLvl))
+
+	var n int
+	lines := captureLogs(t, jsonLogFormat, func() {
+		WithFields(Fields{"count": countingMarshaler{&n}}).Debugf("debug")
+		WithFields(Fields{"count": countingMarshaler{&n}}).Infof("info")
+		WithFields(Fields{"count": countingMarshaler{&n}}).Warnf("warn")
+	})
+	assert.Len(lines, 1)
+	assert.Equal(1, n)
+}
+
+func TestTextLogFormatFields(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := captureLogs(t, textLogFormat, func() {
+		log.Info("plain message")
+		WithFields(Fields{"endpoint": "/v0.3/traces", "dropped": 3}).Infof("dropped %d traces", 3)
+	})
+	assert.Len(lines, 2)
+
+	assert.True(strings.HasSuffix(lines[0], " - plain message"), lines[0])
+	assert.Contains(lines[0], "(seelog_test.go:")
+	assert.True(strings.HasSuffix(lines[1], " - dropped 3 traces dropped=3 endpoint=/v0.3/traces"), lines[1])
+	assert.Contains(lines[1], "(seelog_test.go:")
+}
+
+func TestLogFormatConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(LogFormatJSON, parseLogFormat("JSON"))
+	assert.Equal(LogFormatText, parseLogFormat("text"))
+	assert.Equal(LogFormatText, parseLogFormat("xml"))
+
+	cfg := newSeelogConfig("/tmp/trace-agent.log", LogFormatJSON, 1024)
+	assert.Equal(jsonLogFormat, cfg.Formats.Format.Format)
+	assert.Contains(cfg.Outputs.Console, "maxsize=\"1024\"")
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownKey is a key of the file which the agent never reads, likely a
+// typo, see AgentConfig.StrictConfig.
+type ErrUnknownKey struct {
+	Section string
+	Name    string
+
+	// UnknownSection is set when no key of the section is read
+	UnknownSection bool
+	// Suggestion is the closest known key, or section if UnknownSection,
+	// empty when none is close enough
+	Suggestion string
+}
+
+func (e *ErrUnknownKey) Error() string {
+	if e.UnknownSection {
+		msg := fmt.Sprintf("`%s` in unknown [%s] section", e.Name, e.Section)
+		if e.Suggestion != "" {
+			msg += fmt.Sprintf(", did you mean [%s]?", e.Suggestion)
+		}
+		return msg
+	}
+	msg := fmt.Sprintf("unknown `%s` in [%s] section", e.Name, e.Section)
+	if e.Suggestion != "" {
+		msg += fmt.Sprintf(", did you mean `%s`?", e.Suggestion)
+	}
+	return msg
+}
+
+// Is reports whether target is an *ErrUnknownKey for the same key, an empty
+// Section or Name in target matching any.
+func (e *ErrUnknownKey) Is(target error) bool {
+	t, ok := target.(*ErrUnknownKey)
+	return ok && (t.Section == "" || t.Section == e.Section) && (t.Name == "" || t.Name == e.Name)
+}
+
+// strictSectionPrefix is the prefix of the sections of the trace agent, the
+// others belonging to the shared dd-agent config, e.g. [Main], are not checked
+const strictSectionPrefix = "trace."
+
+// lookup records that section/name is read, an empty name reading the whole
+// section. The legacy names of a renamed key are read along with it, see
+// renamedKeys.
+func (c *File) lookup(section, name string) {
+	if c.known == nil {
+		c.known = make(map[string]map[string]bool)
+	}
+	if c.known[section] == nil {
+		c.known[section] = make(map[string]bool)
+	}
+	c.known[section][name] = true
+	for _, k := range renamedKeys {
+		if k.section == section && k.name == name {
+			c.lookup(k.legacySection, k.legacyName)
+		}
+	}
+}
+
+// unknownKeys returns the keys of the trace agent sections of the file which
+// were never looked up, in the order of the file. The known keys are the ones
+// read by the getters, hence it must only be called once the whole file was
+// read, see NewAgentConfig.
+func (c *File) unknownKeys() []*ErrUnknownKey {
+	var unknown []*ErrUnknownKey
+	for _, s := range c.instance.Sections() {
+		section := s.Name()
+		if !strings.HasPrefix(section, strictSectionPrefix) {
+			continue
+		}
+		known, ok := c.known[section]
+		if known[""] {
+			// read as a whole, e.g. [trace.routing]
+			continue
+		}
+		suggestion := ""
+		if !ok {
+			suggestion = closest(section, c.knownSections())
+		}
+		for _, k := range s.Keys() {
+			if known[k.Name()] {
+				continue
+			}
+			e := &ErrUnknownKey{Section: section, Name: k.Name(), UnknownSection: !ok, Suggestion: suggestion}
+			if ok {
+				e.Suggestion = closest(k.Name(), keys(known))
+			}
+			unknown = append(unknown, e)
+		}
+	}
+	return unknown
+}
+
+// knownSections returns the trace agent sections looked up
+func (c *File) knownSections() []string {
+	var sections []string
+	for s := range c.known {
+		if strings.HasPrefix(s, strictSectionPrefix) {
+			sections = append(sections, s)
+		}
+	}
+	return sections
+}
+
+func keys(m map[string]bool) []string {
+	var names []string
+	for name := range m {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// closest returns the candidate closest to s by edit distance, or an empty
+// string if none is within a third of its length, so that only typos are
+// suggested. Ties go to the smallest candidate, to be deterministic.
+func closest(s string, candidates []string) string {
+	best, bestDist := "", len(s)/3+1
+	for _, c := range candidates {
+		d := editDistance(s, c)
+		if d < bestDist || (d == bestDist && best != "" && c < best) {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b: the number
+// of runes to insert, delete or replace to turn a into b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
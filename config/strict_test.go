@@ -0,0 +1,97 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-ini/ini"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	dd, _ := ini.Load([]byte(`[Main]
+api_key=foo
+not_a_trace_agent_key=1
+[trace.concentrator]
+bukcet_size_seconds=5
+extra_aggregators=version
+[trace.samplr]
+extra_sample_rate=0.5
+[trace.receiver]
+timeout=2
+nothing_like_a_receiver_key=1
+[trace.routing]
+tag=team
+payments=https://payments.example.com,key
+[trace.concentrator.max_duration]
+web=1m
+[other]
+anything=1`))
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, err := NewAgentConfig(conf, nil)
+	// only logged by default
+	assert.Nil(err)
+	assert.Equal([]string{"version"}, agentConfig.ExtraAggregators)
+
+	assert.Equal([]*ErrUnknownKey{
+		{Section: "trace.concentrator", Name: "bukcet_size_seconds", Suggestion: "bucket_size_seconds"},
+		{Section: "trace.samplr", Name: "extra_sample_rate", UnknownSection: true, Suggestion: "trace.sampler"},
+		{Section: "trace.receiver", Name: "nothing_like_a_receiver_key"},
+	}, conf.unknownKeys())
+
+	// all of them are listed in strict mode
+	dd.Section("Main").NewKey("strict_config", "true")
+	_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Equal("unknown configuration keys: "+
+		"whatever: unknown `bukcet_size_seconds` in [trace.concentrator] section, did you mean `bucket_size_seconds`?; "+
+		"whatever: `extra_sample_rate` in unknown [trace.samplr] section, did you mean [trace.sampler]?; "+
+		"whatever: unknown `nothing_like_a_receiver_key` in [trace.receiver] section", err.Error())
+}
+
+func TestUnknownKeysStrict(t *testing.T) {
+	assert := assert.New(t)
+
+	// the keys of both files are checked
+	dd, _ := ini.Load([]byte("[Main]\n\napi_key=foo\nstrict_config=true"))
+	legacy, _ := ini.Load([]byte("[trace.sampler]\nmax_traces_per_secnod=10"))
+	_, err := NewAgentConfig(&File{instance: dd, Path: "datadog.conf"}, &File{instance: legacy, Path: "trace-agent.ini"})
+	assert.NotNil(err)
+	assert.Equal("unknown configuration keys: trace-agent.ini: unknown `max_traces_per_secnod` in [trace.sampler] section, "+
+		"did you mean `max_traces_per_second`?", err.Error())
+
+	// known keys pass, including legacy ones
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\nstrict_config=true\n[trace.receiver]\ntimeout=2\nread_timeout=1s\n" +
+		"[trace.sampler]\nmax_traces_per_second=10"))
+	agentConfig, err := NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.Nil(err)
+	assert.True(agentConfig.StrictConfig)
+	assert.Equal(float64(10), agentConfig.MaxTPS)
+
+	// forced by the environment, as by the -strict flag
+	os.Setenv("DD_STRICT_CONFIG", "true")
+	defer os.Unsetenv("DD_STRICT_CONFIG")
+	dd, _ = ini.Load([]byte("[Main]\n\napi_key=foo\n[trace.api]\nendpont=https://example.com"))
+	_, err = NewAgentConfig(&File{instance: dd, Path: "whatever"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "unknown `endpont` in [trace.api] section, did you mean `endpoint`?")
+}
+
+func TestClosest(t *testing.T) {
+	assert := assert.New(t)
+
+	candidates := []string{"bucket_size_seconds", "max_duration", "top_resources"}
+	assert.Equal("bucket_size_seconds", closest("bukcet_size_seconds", candidates))
+	assert.Equal("bucket_size_seconds", closest("bucket_size_second", candidates))
+	assert.Equal("max_duration", closest("max_durations", candidates))
+	assert.Equal("", closest("extra_sample_rate", candidates))
+	assert.Equal("", closest("x", candidates))
+	assert.Equal("", closest("a", nil))
+
+	assert.Equal(0, editDistance("", ""))
+	assert.Equal(3, editDistance("kitten", "sitting"))
+	assert.Equal(2, editDistance("ab", "ba"))
+	assert.Equal(1, editDistance("é", "e"))
+}
@@ -9,9 +9,13 @@ var defaultAggregators = []string{"service", "resource"}
 
 const defaultEnv = "none"
 
+// statsBucketStart is the start of the fixture stats buckets, as a payload
+// requires buckets to have one
+const statsBucketStart int64 = 1500000000e9
+
 // TestStatsBucket returns a fixed stats bucket to be used in unit tests
 func TestStatsBucket() model.StatsBucket {
-	srb := model.NewStatsRawBucket(0, 1e9)
+	srb := model.NewStatsRawBucket(statsBucketStart, 1e9)
 	srb.HandleSpan(TestSpan(), defaultEnv, defaultAggregators, 1.0, nil)
 	sb := srb.Export()
 
@@ -22,19 +26,19 @@ func TestStatsBucket() model.StatsBucket {
 	//    code as indeed, stats buckets are (un)marshalled
 	js, err := json.Marshal(sb)
 	if err != nil {
-		return model.NewStatsBucket(0, 1e9)
+		return model.NewStatsBucket(statsBucketStart, 1e9)
 	}
 	var sb2 model.StatsBucket
 	err = json.Unmarshal(js, &sb2)
 	if err != nil {
-		return model.NewStatsBucket(0, 1e9)
+		return model.NewStatsBucket(statsBucketStart, 1e9)
 	}
 	return sb2
 }
 
 // StatsBucketWithSpans returns a stats bucket populated with spans stats
 func StatsBucketWithSpans(s []model.Span) model.StatsBucket {
-	srb := model.NewStatsRawBucket(0, 1e9)
+	srb := model.NewStatsRawBucket(statsBucketStart, 1e9)
 	for _, s := range s {
 		srb.HandleSpan(s, defaultEnv, defaultAggregators, 1.0, nil)
 	}
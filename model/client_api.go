@@ -40,6 +40,12 @@ func readAll(source io.Reader, dest *bytes.Buffer) (err error) {
 	return err
 }
 
+// WriteMsgpack writes the msgpack encoding of the traces to w, as clients
+// send them to the receiver
+func (t Traces) WriteMsgpack(w io.Writer) error {
+	return msgp.Encode(w, t)
+}
+
 // ClientDecoder is the common interface that all decoders should honor
 type ClientDecoder interface {
 	Decode(body io.Reader, v interface{}) (int, error)
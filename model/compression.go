@@ -0,0 +1,133 @@
+package model
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// CompressionGzip compresses payloads with gzip, understood by all intakes
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses payloads with zstd
+	CompressionZstd = "zstd"
+	// CompressionSnappy compresses payloads with snappy
+	CompressionSnappy = "snappy"
+	// CompressionNone sends payloads uncompressed
+	CompressionNone = "none"
+)
+
+// Compressor compresses payloads with a given codec
+type Compressor interface {
+	// Name is one of the Compression* constants, also used as the
+	// Content-Encoding of the payloads, except for CompressionNone
+	Name() string
+	// NewWriter returns a writer compressing to w, which must be closed
+	// to flush the compressed data
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// NewCompressor returns the Compressor for the given codec, level being
+// specific to it and 0 meaning its default level.
+func NewCompressor(name string, level int) (Compressor, error) {
+	switch name {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.BestSpeed
+		}
+		// check the level once instead of for every payload
+		if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+			return nil, err
+		}
+		return &gzipCompressor{level: level}, nil
+	case CompressionZstd:
+		return newZstdCompressor(level)
+	case CompressionSnappy:
+		// snappy has no levels
+		return &snappyCompressor{}, nil
+	case CompressionNone:
+		return noneCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+// snappyCompressor implements Compressor with the snappy framing format,
+// reusing its writers
+type snappyCompressor struct {
+	pool sync.Pool
+}
+
+func (c *snappyCompressor) Name() string { return CompressionSnappy }
+
+func (c *snappyCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	sw, ok := c.pool.Get().(*snappy.Writer)
+	if ok {
+		sw.Reset(w)
+	} else {
+		sw = snappy.NewBufferedWriter(w)
+	}
+	return &snappyWriter{Writer: sw, pool: &c.pool}, nil
+}
+
+// snappyWriter gives its snappy.Writer back to the pool once closed
+type snappyWriter struct {
+	*snappy.Writer
+	pool *sync.Pool
+}
+
+func (w *snappyWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// gzipCompressor implements Compressor with gzip, reusing its writers
+type gzipCompressor struct {
+	level int
+	pool  sync.Pool
+}
+
+func (c *gzipCompressor) Name() string { return CompressionGzip }
+
+func (c *gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if gz, ok := c.pool.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return &gzipWriter{Writer: gz, pool: &c.pool}, nil
+	}
+	gz, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{Writer: gz, pool: &c.pool}, nil
+}
+
+// gzipWriter gives its gzip.Writer back to the pool once closed
+type gzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *gzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// noneCompressor implements Compressor without compressing anything
+type noneCompressor struct{}
+
+func (noneCompressor) Name() string { return CompressionNone }
+
+func (noneCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
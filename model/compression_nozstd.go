@@ -0,0 +1,11 @@
+//go:build !cgo
+// +build !cgo
+
+package model
+
+import "fmt"
+
+// newZstdCompressor returns an error: the zstd library needs cgo
+func newZstdCompressor(level int) (Compressor, error) {
+	return nil, fmt.Errorf("this build has no %s compression, it needs cgo", CompressionZstd)
+}
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCompressor(t *testing.T) {
+	assert := assert.New(t)
+
+	gz, err := NewCompressor(CompressionGzip, 0)
+	assert.Nil(err)
+	assert.Equal("gzip", gz.Name())
+
+	// writers are reused across payloads
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		w, err := gz.NewWriter(&buf)
+		assert.Nil(err)
+		w.Write([]byte("payload"))
+		assert.Nil(w.Close())
+
+		r, err := gzip.NewReader(&buf)
+		assert.Nil(err)
+		data, err := ioutil.ReadAll(r)
+		assert.Nil(err)
+		assert.Equal("payload", string(data))
+	}
+
+	none, err := NewCompressor(CompressionNone, 0)
+	assert.Nil(err)
+	var buf bytes.Buffer
+	w, err := none.NewWriter(&buf)
+	assert.Nil(err)
+	w.Write([]byte("payload"))
+	assert.Nil(w.Close())
+	assert.Equal("payload", buf.String())
+
+	snappyCompressor, err := NewCompressor(CompressionSnappy, 0)
+	assert.Nil(err)
+	assert.Equal("snappy", snappyCompressor.Name())
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		w, err := snappyCompressor.NewWriter(&buf)
+		assert.Nil(err)
+		w.Write([]byte("payload"))
+		assert.Nil(w.Close())
+
+		data, err := ioutil.ReadAll(snappy.NewReader(&buf))
+		assert.Nil(err)
+		assert.Equal("payload", string(data))
+	}
+
+	_, err = NewCompressor(CompressionGzip, 42)
+	assert.NotNil(err)
+	_, err = NewCompressor("lz4", 0)
+	assert.NotNil(err)
+}
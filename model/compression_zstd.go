@@ -0,0 +1,78 @@
+//go:build cgo
+// +build cgo
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/DataDog/zstd"
+)
+
+// newZstdCompressor returns a zstd Compressor, 0 being its default level
+func newZstdCompressor(level int) (Compressor, error) {
+	if level == 0 {
+		level = zstd.DefaultCompression
+	}
+	if level < zstd.BestSpeed || level > zstd.BestCompression {
+		return nil, fmt.Errorf("invalid %s compression level %d, expected %d to %d",
+			CompressionZstd, level, zstd.BestSpeed, zstd.BestCompression)
+	}
+	return &zstdCompressor{level: level}, nil
+}
+
+// zstdCompressor implements Compressor with zstd, reusing its writers. The
+// zstd stream writer compressing every write in its own block, payloads are
+// buffered and compressed at once when the writer is closed.
+type zstdCompressor struct {
+	level int
+	pool  sync.Pool
+}
+
+func (c *zstdCompressor) Name() string { return CompressionZstd }
+
+func (c *zstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw, ok := c.pool.Get().(*zstdWriter)
+	if !ok {
+		zw = &zstdWriter{compressor: c}
+	}
+	zw.w = w
+	return zw, nil
+}
+
+// zstdWriter buffers a payload, and gives itself back to the pool of its
+// compressor once closed, its buffers being kept
+type zstdWriter struct {
+	compressor *zstdCompressor
+	w          io.Writer
+	src        bytes.Buffer
+	dst        []byte
+}
+
+func (w *zstdWriter) Write(p []byte) (int, error) {
+	return w.src.Write(p)
+}
+
+func (w *zstdWriter) Close() error {
+	defer func() {
+		w.w = nil
+		w.src.Reset()
+		w.compressor.pool.Put(w)
+	}()
+
+	if w.src.Len() == 0 {
+		// zstd.CompressLevel rejects empty inputs, the stream writer
+		// writes an empty frame
+		return zstd.NewWriterLevel(w.w, w.compressor.level).Close()
+	}
+	dst, err := zstd.CompressLevel(w.dst[:cap(w.dst)], w.src.Bytes(), w.compressor.level)
+	if err != nil {
+		return err
+	}
+	w.dst = dst
+	_, err = w.w.Write(dst)
+	return err
+}
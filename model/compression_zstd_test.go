@@ -0,0 +1,52 @@
+//go:build cgo
+// +build cgo
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZstdCompressor(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCompressor(CompressionZstd, 0)
+	assert.Nil(err)
+	assert.Equal("zstd", c.Name())
+
+	// writers are reused across payloads, the largest first
+	for _, payload := range []string{strings.Repeat("payload ", 10000), "payload", ""} {
+		var buf bytes.Buffer
+		w, err := c.NewWriter(&buf)
+		assert.Nil(err)
+		// in small writes, as the payloads are encoded
+		for i := 0; i < len(payload); i += 7 {
+			end := i + 7
+			if end > len(payload) {
+				end = len(payload)
+			}
+			w.Write([]byte(payload[i:end]))
+		}
+		assert.Nil(w.Close())
+		if len(payload) > 1000 {
+			assert.True(buf.Len() < len(payload)/10, buf.Len())
+		}
+
+		data, err := ioutil.ReadAll(zstd.NewReader(&buf))
+		assert.Nil(err)
+		assert.Equal(payload, string(data))
+	}
+
+	_, err = NewCompressor(CompressionZstd, 19)
+	assert.Nil(err)
+	_, err = NewCompressor(CompressionZstd, 21)
+	assert.NotNil(err)
+	_, err = NewCompressor(CompressionZstd, -1)
+	assert.NotNil(err)
+}
@@ -0,0 +1,189 @@
+package model
+
+import "sort"
+
+const (
+	// MaxErrorSummaryTypes is the number of error types summarized by
+	// service in a bucket, the most frequent ones
+	MaxErrorSummaryTypes = 50
+	// MaxErrorSummaryServices is the number of services whose errors are
+	// summarized in a bucket, the first ones to have errors
+	MaxErrorSummaryServices = 200
+	// maxErrorSampleMessageLen truncates the messages of the samples
+	maxErrorSampleMessageLen = 500
+)
+
+// ErrorSummary is an error type of a service, with a sample of its errors
+type ErrorSummary struct {
+	Type    string  `json:"type"`
+	Count   float64 `json:"count"`
+	Message string  `json:"message"`  // the error.msg of the sample, truncated
+	TraceID uint64  `json:"trace_id"` // the trace of the sample, 0 if none
+}
+
+// ErrorSummaries are the error types of the errors of a bucket by service,
+// most frequent first, see StatsRawBucket.SampleError
+type ErrorSummaries map[string][]ErrorSummary
+
+// errorSummaries are the error types of the spans of a StatsRawBucket, by
+// service and error type. They are bounded with the Space-Saving algorithm:
+// the new type of a service with MaxErrorSummaryTypes replaces its least
+// frequent type and starts from its count, so that the most frequent types
+// are kept, the counts of the least frequent ones being overestimated.
+type errorSummaries map[string]map[string]*ErrorSummary
+
+// get returns the summary of errorType for service, added if there is
+// none, or nil if the errors of too many services are summarized already
+func (es errorSummaries) get(service, errorType string) *ErrorSummary {
+	types, ok := es[service]
+	if !ok {
+		if len(es) >= MaxErrorSummaryServices {
+			return nil
+		}
+		types = make(map[string]*ErrorSummary)
+		es[service] = types
+	}
+	if e, ok := types[errorType]; ok {
+		return e
+	}
+
+	e := &ErrorSummary{Type: errorType}
+	if len(types) >= MaxErrorSummaryTypes {
+		var min *ErrorSummary
+		for _, t := range types {
+			if min == nil || t.Count < min.Count || (t.Count == min.Count && t.Type < min.Type) {
+				min = t
+			}
+		}
+		delete(types, min.Type)
+		e.Count = min.Count
+	}
+	types[errorType] = e
+	return e
+}
+
+// export returns the summaries by service, most frequent first
+func (es errorSummaries) export() ErrorSummaries {
+	ret := make(ErrorSummaries, len(es))
+	for service, types := range es {
+		list := make([]ErrorSummary, 0, len(types))
+		for _, e := range types {
+			list = append(list, *e)
+		}
+		sort.Sort(errorSummariesByCount(list))
+		ret[service] = list
+	}
+	return ret
+}
+
+// sample makes the error of s the sample of e
+func (e *ErrorSummary) sample(s *Span) {
+	e.Message = truncateUTF8(s.Meta[ErrorMsgKey], maxErrorSampleMessageLen)
+	e.TraceID = s.TraceID
+}
+
+// spanErrorType returns the error type of s, empty unless it is an error
+func spanErrorType(s *Span) string {
+	if s.Error == 0 {
+		return ""
+	}
+	return s.Meta[ErrorTypeKey]
+}
+
+// SampleError makes the error of s the sample of its service and error type
+// in the bucket, if they have none yet, and tells if it did, so that the
+// trace of s can be kept. The error itself is counted by HandleSpan.
+func (sb *StatsRawBucket) SampleError(s *Span) bool {
+	t := spanErrorType(s)
+	if t == "" {
+		return false
+	}
+	e := sb.errorSummaries.get(s.Service, t)
+	if e == nil || e.TraceID != 0 {
+		return false
+	}
+	e.sample(s)
+	return true
+}
+
+// summarizeError counts the error of s with its type, taking it as sample
+// if there is none
+func (sb *StatsRawBucket) summarizeError(s *Span, errorType string, weight float64) {
+	e := sb.errorSummaries.get(s.Service, errorType)
+	if e == nil {
+		return
+	}
+	e.Count += weight
+	if e.TraceID == 0 {
+		e.sample(s)
+	}
+}
+
+// merge adds the summaries of other to es, within the same bounds, and
+// returns them. The samples of es are kept over the ones of other.
+func (es ErrorSummaries) merge(other ErrorSummaries) ErrorSummaries {
+	if es == nil {
+		es = make(ErrorSummaries, len(other))
+	}
+	for service, list := range other {
+		mine, ok := es[service]
+		if !ok && len(es) >= MaxErrorSummaryServices {
+			continue
+		}
+		merged := append([]ErrorSummary(nil), mine...)
+		index := make(map[string]int, len(merged))
+		for i, e := range merged {
+			index[e.Type] = i
+		}
+		for _, e := range list {
+			i, ok := index[e.Type]
+			if !ok {
+				index[e.Type] = len(merged)
+				merged = append(merged, e)
+				continue
+			}
+			merged[i].Count += e.Count
+			if merged[i].TraceID == 0 {
+				merged[i].Message, merged[i].TraceID = e.Message, e.TraceID
+			}
+		}
+		sort.Sort(errorSummariesByCount(merged))
+		if len(merged) > MaxErrorSummaryTypes {
+			merged = merged[:MaxErrorSummaryTypes]
+		}
+		es[service] = merged
+	}
+	return es
+}
+
+// errorSummaryValues returns, by service and error type, the value of tag of
+// their error counts through valueOf, the one with the most errors if they
+// have several, for the summaries to go along the counts of their type when
+// a bucket is split by tag
+func errorSummaryValues(counts map[string]Count, tag string, valueOf func(string) string) map[[2]string]string {
+	sums := make(map[[3]string]float64)
+	for _, c := range counts {
+		sums[[3]string{c.TagSet.Get("service").Value, c.TagSet.Get(ErrorTypeKey).Value, valueOf(c.TagSet.Get(tag).Value)}] += c.Value
+	}
+	values := make(map[[2]string]string)
+	max := make(map[[2]string]float64)
+	for k, n := range sums {
+		key := [2]string{k[0], k[1]}
+		if m, ok := max[key]; !ok || n > m || (n == m && k[2] < values[key]) {
+			values[key], max[key] = k[2], n
+		}
+	}
+	return values
+}
+
+// errorSummariesByCount sorts error summaries by decreasing count, then type
+type errorSummariesByCount []ErrorSummary
+
+func (s errorSummariesByCount) Len() int      { return len(s) }
+func (s errorSummariesByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s errorSummariesByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Type < s[j].Type
+}
@@ -0,0 +1,160 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func errorSpan(traceID uint64, service, errorType string) Span {
+	return Span{TraceID: traceID, Service: service, Name: "request", Resource: "GET /", Error: 1,
+		Meta: map[string]string{ErrorTypeKey: errorType, ErrorMsgKey: errorType + " in " + service}}
+}
+
+func TestErrorSummaries(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for i, s := range []Span{
+		errorSpan(1, "web", "Timeout"),
+		errorSpan(2, "web", "Timeout"),
+		errorSpan(3, "web", "IOError"),
+		errorSpan(4, "db", "Timeout"),
+		// not summarized, as they are not counted
+		{TraceID: 5, Service: "web", Name: "request", Error: 1},
+		{TraceID: 6, Service: "web", Name: "request", Meta: map[string]string{ErrorTypeKey: "Timeout"}},
+	} {
+		srb.HandleSpan(s, "default", nil, float64(1+i%2), nil)
+	}
+
+	sb := srb.Export()
+	assert.Equal(ErrorSummaries{
+		"web": {
+			{Type: "Timeout", Count: 3, Message: "Timeout in web", TraceID: 1},
+			{Type: "IOError", Count: 1, Message: "IOError in web", TraceID: 3},
+		},
+		"db": {{Type: "Timeout", Count: 2, Message: "Timeout in db", TraceID: 4}},
+	}, sb.ErrorSummaries)
+
+	data, err := json.Marshal(sb)
+	assert.Nil(err)
+	assert.Contains(string(data), `"error_summaries":{"db":[{"type":"Timeout","count":2,"message":"Timeout in db","trace_id":4}]`)
+
+	// persisted and merged along with the other stats
+	state, err := srb.GobEncode()
+	assert.Nil(err)
+	var decoded StatsRawBucket
+	assert.Nil(decoded.GobDecode(state))
+	assert.Equal(sb, decoded.Export())
+	assert.Nil(decoded.Merge(srb))
+	assert.Equal(float64(6), decoded.Export().ErrorSummaries["web"][0].Count)
+	assert.Equal(uint64(1), decoded.Export().ErrorSummaries["web"][0].TraceID)
+}
+
+func TestErrorSummariesSampleError(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	// only the first error of a type is taken as sample
+	assert.True(srb.SampleError(&Span{TraceID: 1, Service: "web", Error: 1, Meta: map[string]string{ErrorTypeKey: "Timeout"}}))
+	assert.False(srb.SampleError(&Span{TraceID: 2, Service: "web", Error: 1, Meta: map[string]string{ErrorTypeKey: "Timeout"}}))
+	assert.True(srb.SampleError(&Span{TraceID: 3, Service: "db", Error: 1, Meta: map[string]string{ErrorTypeKey: "Timeout"}}))
+	assert.False(srb.SampleError(&Span{TraceID: 4, Service: "web", Error: 1}))
+	assert.False(srb.SampleError(&Span{TraceID: 5, Service: "web", Meta: map[string]string{ErrorTypeKey: "IOError"}}))
+
+	// then counted without replacing the sample
+	srb.HandleSpan(errorSpan(2, "web", "Timeout"), "default", nil, 1, nil)
+	srb.HandleSpan(errorSpan(1, "web", "Timeout"), "default", nil, 1, nil)
+	assert.Equal([]ErrorSummary{{Type: "Timeout", Count: 2, TraceID: 1}}, srb.Export().ErrorSummaries["web"])
+
+	// the messages are truncated
+	long := errorSpan(6, "web", "IOError")
+	long.Meta[ErrorMsgKey] = strings.Repeat("é", maxErrorSampleMessageLen)
+	srb.HandleSpan(long, "default", nil, 1, nil)
+	e := srb.Export().ErrorSummaries["web"][1]
+	assert.Equal("IOError", e.Type)
+	assert.Len(e.Message, maxErrorSampleMessageLen)
+}
+
+func TestErrorSummariesBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for i := 0; i < 10; i++ {
+		srb.HandleSpan(errorSpan(1, "web", "Timeout"), "default", nil, 1, nil)
+	}
+	for i := 0; i < 2*MaxErrorSummaryTypes; i++ {
+		srb.HandleSpan(errorSpan(uint64(i+2), "web", fmt.Sprintf("Error%d", i)), "default", nil, 1, nil)
+	}
+	for i := 0; i < MaxErrorSummaryServices+10; i++ {
+		srb.HandleSpan(errorSpan(1, fmt.Sprintf("service%d", i), "Timeout"), "default", nil, 1, nil)
+	}
+
+	summaries := srb.Export().ErrorSummaries
+	assert.Len(summaries, MaxErrorSummaryServices)
+	web := summaries["web"]
+	assert.Len(web, MaxErrorSummaryTypes)
+	// the frequent types are kept, the new ones replacing the rare ones
+	assert.Equal(ErrorSummary{Type: "Timeout", Count: 10, Message: "Timeout in web", TraceID: 1}, web[0])
+	// and start from the count of the type they replaced, overestimated
+	var newest *ErrorSummary
+	for i := range web {
+		if web[i].Type == fmt.Sprintf("Error%d", 2*MaxErrorSummaryTypes-1) {
+			newest = &web[i]
+		}
+	}
+	if assert.NotNil(newest) {
+		assert.Equal(float64(3), newest.Count)
+		assert.Equal(uint64(2*MaxErrorSummaryTypes+1), newest.TraceID)
+	}
+	// the counts of the types are still exact
+	assert.Len(srb.Export().ErrorTypes, 1+2*MaxErrorSummaryTypes+MaxErrorSummaryServices+10)
+}
+
+func TestErrorSummariesMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	es := ErrorSummaries{"web": {{Type: "Timeout", Count: 1, Message: "a", TraceID: 1}, {Type: "IOError", Count: 1}}}
+	other := ErrorSummaries{
+		"web": {{Type: "IOError", Count: 3, Message: "b", TraceID: 2}, {Type: "Timeout", Count: 1, Message: "c", TraceID: 3}},
+		"db":  {{Type: "Timeout", Count: 1, Message: "d", TraceID: 4}},
+	}
+	assert.Equal(ErrorSummaries{
+		"web": {{Type: "IOError", Count: 4, Message: "b", TraceID: 2}, {Type: "Timeout", Count: 2, Message: "a", TraceID: 1}},
+		"db":  {{Type: "Timeout", Count: 1, Message: "d", TraceID: 4}},
+	}, es.merge(other))
+
+	// within the bounds
+	var many []ErrorSummary
+	for i := 0; i < MaxErrorSummaryTypes+5; i++ {
+		many = append(many, ErrorSummary{Type: fmt.Sprintf("Error%02d", i), Count: float64(i)})
+	}
+	merged := ErrorSummaries(nil).merge(ErrorSummaries{"web": many})
+	assert.Len(merged["web"], MaxErrorSummaryTypes)
+	assert.Equal(float64(MaxErrorSummaryTypes+4), merged["web"][0].Count)
+}
+
+func TestErrorSummariesSplitByTag(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for _, team := range []string{"payments", "payments", "search"} {
+		s := errorSpan(1, "web", "Timeout")
+		s.Meta["team"] = team
+		srb.HandleSpan(s, "default", []string{"team"}, 1, nil)
+	}
+	s := errorSpan(2, "web", "IOError")
+	s.Meta["team"] = "search"
+	srb.HandleSpan(s, "default", []string{"team"}, 1, nil)
+
+	p := AgentPayload{HostName: "host", Stats: []StatsBucket{srb.Export()}}
+	payloads := p.SplitByTag("team", []string{"payments", "search"})
+	// along with the value with the most errors of their type
+	assert.Equal(ErrorSummaries{"web": {{Type: "Timeout", Count: 3, Message: "Timeout in web", TraceID: 1}}},
+		payloads["payments"].Stats[0].ErrorSummaries)
+	assert.Equal(ErrorSummaries{"web": {{Type: "IOError", Count: 1, Message: "IOError in web", TraceID: 2}}},
+		payloads["search"].Stats[0].ErrorSummaries)
+}
@@ -0,0 +1,53 @@
+package model
+
+// Meta keys describing the error of a span, see Span.Normalize
+const (
+	ErrorTypeKey  = "error.type"
+	ErrorMsgKey   = "error.msg"
+	ErrorStackKey = "error.stack"
+	// MaxErrorStackLen the maximum length of an error stack
+	MaxErrorStackLen = 5000
+)
+
+// errorKeyAliases lists, for each error key, the meta keys clients set it
+// with, by precedence: the first one set wins
+var errorKeyAliases = [...]struct {
+	key     string
+	aliases []string
+}{
+	{ErrorTypeKey, []string{ErrorTypeKey, "error.kind", "sfx.error.kind", "exception.type"}},
+	{ErrorMsgKey, []string{ErrorMsgKey, "error.message", "sfx.error.message", "exception.message"}},
+	{ErrorStackKey, []string{ErrorStackKey, "error.stacktrace", "sfx.error.stack", "exception.stacktrace"}},
+}
+
+// normalizeErrors moves the error metadata set with the known aliases to
+// the canonical error keys, truncating stacks, and flags the span as an
+// error when any of them is set. Empty values are ignored.
+func (s *Span) normalizeErrors() {
+	if len(s.Meta) == 0 {
+		return
+	}
+	for _, e := range errorKeyAliases {
+		var value string
+		for _, alias := range e.aliases {
+			v, ok := s.Meta[alias]
+			if !ok {
+				continue
+			}
+			if value == "" {
+				value = v
+			}
+			delete(s.Meta, alias)
+		}
+		if value == "" {
+			continue
+		}
+		if e.key == ErrorStackKey && len(value) > MaxErrorStackLen {
+			value = value[:MaxErrorStackLen]
+		}
+		s.Meta[e.key] = value
+		if s.Error == 0 {
+			s.Error = 1
+		}
+	}
+}
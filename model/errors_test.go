@@ -0,0 +1,70 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		error int32
+		meta  map[string]string
+		want  map[string]string // the error keys after normalization
+		err   int32
+	}{
+		{"no error", 0, map[string]string{"user": "leo"}, map[string]string{}, 0},
+		{"flag only", 1, map[string]string{}, map[string]string{}, 1},
+		{"canonical", 0,
+			map[string]string{"error.type": "IOError", "error.msg": "no space left", "error.stack": "at main()"},
+			map[string]string{"error.type": "IOError", "error.msg": "no space left", "error.stack": "at main()"}, 1},
+		{"error kind", 0, map[string]string{"error.kind": "IOError"}, map[string]string{"error.type": "IOError"}, 1},
+		{"sfx kind", 0, map[string]string{"sfx.error.kind": "IOError"}, map[string]string{"error.type": "IOError"}, 1},
+		{"exception type", 0, map[string]string{"exception.type": "IOError"}, map[string]string{"error.type": "IOError"}, 1},
+		{"error message", 0, map[string]string{"error.message": "boom"}, map[string]string{"error.msg": "boom"}, 1},
+		{"sfx message", 0, map[string]string{"sfx.error.message": "boom"}, map[string]string{"error.msg": "boom"}, 1},
+		{"exception message", 0, map[string]string{"exception.message": "boom"}, map[string]string{"error.msg": "boom"}, 1},
+		{"error stacktrace", 0, map[string]string{"error.stacktrace": "at f()"}, map[string]string{"error.stack": "at f()"}, 1},
+		{"sfx stack", 0, map[string]string{"sfx.error.stack": "at f()"}, map[string]string{"error.stack": "at f()"}, 1},
+		{"exception stacktrace", 0, map[string]string{"exception.stacktrace": "at f()"}, map[string]string{"error.stack": "at f()"}, 1},
+		{"canonical first", 0,
+			map[string]string{"error.type": "IOError", "sfx.error.kind": "OSError", "error.kind": "Exception"},
+			map[string]string{"error.type": "IOError"}, 1},
+		{"aliases by precedence", 0,
+			map[string]string{"exception.message": "third", "sfx.error.message": "second", "error.message": "first"},
+			map[string]string{"error.msg": "first"}, 1},
+		{"empty values ignored", 0,
+			map[string]string{"error.msg": "", "sfx.error.message": "boom"},
+			map[string]string{"error.msg": "boom"}, 1},
+		{"only empty values", 0, map[string]string{"error.type": ""}, map[string]string{}, 0},
+		{"error code kept", 2, map[string]string{"error.kind": "IOError"}, map[string]string{"error.type": "IOError"}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Span{Error: tc.error, Meta: tc.meta}
+			s.normalizeErrors()
+			assert.Equal(t, tc.err, s.Error)
+
+			got := make(map[string]string)
+			for k, v := range s.Meta {
+				if strings.Contains(k, "error") || strings.HasPrefix(k, "exception.") {
+					got[k] = v
+				}
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestNormalizeErrorStack(t *testing.T) {
+	assert := assert.New(t)
+
+	s := testSpan()
+	s.Meta["sfx.error.stack"] = strings.Repeat("at f()\n", 1000)
+	assert.Nil(s.Normalize())
+	assert.Equal(int32(1), s.Error)
+	assert.Len(s.Meta[ErrorStackKey], MaxErrorStackLen)
+	assert.True(strings.HasPrefix(s.Meta[ErrorStackKey], "at f()\nat f()\n"))
+	assert.Equal("leo", s.Meta["user"])
+}
@@ -0,0 +1,54 @@
+package model
+
+import "strings"
+
+const (
+	// MaxIndexedKeyLen the maximum length of an indexed key
+	MaxIndexedKeyLen = MaxMetaKeyLen
+	// MaxIndexedValLen the maximum length of an indexed value
+	MaxIndexedValLen = 200
+)
+
+// IndexSanitizeKey lowercases the key and replaces any character out of
+// [a-z0-9_.] with an underscore, truncating it to MaxIndexedKeyLen.
+func IndexSanitizeKey(key string) string {
+	key = strings.ToLower(key)
+	if len(key) > MaxIndexedKeyLen {
+		key = key[:MaxIndexedKeyLen]
+	}
+	b := []byte(key)
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '.' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// PromoteIndexed copies the meta keys matching keys into the Indexed map of
+// the span, so that the backend can index them. To keep the index cardinality
+// under control, nothing is promoted when more than maxKeys keys match. It
+// returns the number of promoted keys.
+func (s *Span) PromoteIndexed(keys []string, maxKeys int) int {
+	if len(keys) == 0 || len(s.Meta) == 0 {
+		return 0
+	}
+
+	var matched []string
+	for _, k := range keys {
+		if _, ok := s.Meta[k]; ok {
+			matched = append(matched, k)
+		}
+	}
+	if len(matched) == 0 || len(matched) > maxKeys {
+		return 0
+	}
+
+	if s.Indexed == nil {
+		s.Indexed = make(map[string]string, len(matched))
+	}
+	for _, k := range matched {
+		s.Indexed[IndexSanitizeKey(k)] = truncateUTF8(s.Meta[k], MaxIndexedValLen)
+	}
+	return len(matched)
+}
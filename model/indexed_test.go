@@ -0,0 +1,71 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexSanitizeKey(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("customer.id", IndexSanitizeKey("customer.id"))
+	assert.Equal("http.url", IndexSanitizeKey("HTTP.URL"))
+	assert.Equal("user_name_", IndexSanitizeKey("user-name!"))
+	assert.Equal("caf__", IndexSanitizeKey("café"))
+	assert.Len(IndexSanitizeKey(strings.Repeat("k", 500)), MaxIndexedKeyLen)
+}
+
+func TestPromoteIndexed(t *testing.T) {
+	assert := assert.New(t)
+
+	s := testSpan()
+	s.Meta["customer.id"] = "1234"
+	s.Meta["HTTP.URL"] = strings.Repeat("u", 500)
+
+	n := s.PromoteIndexed([]string{"customer.id", "HTTP.URL", "missing"}, 10)
+	assert.Equal(2, n)
+	assert.Equal("1234", s.Indexed["customer.id"])
+	assert.Len(s.Indexed["http.url"], MaxIndexedValLen)
+	assert.Len(s.Indexed, 2)
+
+	// meta is left untouched
+	assert.Len(s.Meta["HTTP.URL"], 500)
+}
+
+func TestPromoteIndexedUTF8(t *testing.T) {
+	assert := assert.New(t)
+
+	// the limit falls in the middle of a 2-byte character
+	s := testSpan()
+	s.Meta["query"] = "q" + strings.Repeat("é", MaxIndexedValLen)
+
+	assert.Equal(1, s.PromoteIndexed([]string{"query"}, 10))
+	v := s.Indexed["query"]
+	assert.True(utf8.ValidString(v))
+	assert.Equal(MaxIndexedValLen-1, len(v))
+	assert.True(strings.HasPrefix(s.Meta["query"], v))
+}
+
+func TestPromoteIndexedCap(t *testing.T) {
+	assert := assert.New(t)
+
+	s := testSpan()
+	s.Meta["a"] = "1"
+	s.Meta["b"] = "2"
+	s.Meta["c"] = "3"
+
+	assert.Equal(0, s.PromoteIndexed([]string{"a", "b", "c"}, 2))
+	assert.Nil(s.Indexed)
+
+	assert.Equal(2, s.PromoteIndexed([]string{"a", "b"}, 2))
+	assert.Len(s.Indexed, 2)
+}
+
+func TestPromoteIndexedNoMatch(t *testing.T) {
+	s := testSpan()
+	assert.Equal(t, 0, s.PromoteIndexed([]string{"nope"}, 10))
+	assert.Nil(t, s.Indexed)
+}
@@ -3,7 +3,9 @@ package model
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/cihub/seelog"
 )
@@ -21,8 +23,19 @@ const (
 	MaxMetaKeyLen = 100
 	// MaxMetaValLen the maximum length of metadata value
 	MaxMetaValLen = 5000
+	// MaxMetaSize the default maximum size of all the metadata keys and values of a span
+	MaxMetaSize = 25 * 1024
+	// MetaTruncatedSuffix is appended to the metadata values truncated to fit in the span budget
+	MetaTruncatedSuffix = "_truncated"
+	// SpanUnclampedDurationKey is the metric keeping the duration, in nanoseconds, of
+	// the spans shortened by ClampDuration
+	SpanUnclampedDurationKey = "_dd.unclamped_duration"
 	// MaxMetricsKeyLen the maximum length of a metric name key
 	MaxMetricsKeyLen = MaxMetaKeyLen
+	// MaxEventsPerSpan the maximum number of events a span can have
+	MaxEventsPerSpan = 128
+	// MaxEventAttrValLen the maximum length of an event attribute value
+	MaxEventAttrValLen = 1000
 	// MaxEndDateOffset the maximum amount of time in the future we
 	// tolerate for span end dates
 	MaxEndDateOffset = 10 * time.Minute
@@ -33,38 +46,66 @@ var (
 	Year2000NanosecTS = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC).UnixNano()
 )
 
+// FieldError is returned by Span.Normalize for the spans it rejects
+type FieldError struct {
+	Field  string // name of the invalid field of Span, e.g. "Service"
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return "span.normalize: " + e.Reason
+}
+
+func fieldError(field, format string, args ...interface{}) error {
+	return &FieldError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// SpanError is returned by NormalizeTrace for the first span of a trace it
+// rejects
+type SpanError struct {
+	Index int         // of the span in the trace
+	Err   *FieldError // why the span is rejected
+
+	msg string
+}
+
+func (e *SpanError) Error() string {
+	return e.msg
+}
+
 // Normalize makes sure a Span is properly initialized and encloses the minimum required info
+// or returns a *FieldError
 func (s *Span) Normalize() error {
 	// Service
 	if s.Service == "" {
-		return errors.New("span.normalize: empty `Service`")
+		return fieldError("Service", "empty `Service`")
 	}
 	if len(s.Service) > MaxServiceLen {
-		return fmt.Errorf("span.normalize: `Service` too long (max %d chars): %s", MaxServiceLen, s.Service)
+		return fieldError("Service", "`Service` too long (max %d chars): %s", MaxServiceLen, s.Service)
 	}
 	// service shall comply with Datadog tag normalization as it's eventually a tag
 	s.Service = NormalizeTag(s.Service)
 	if s.Service == "" {
-		return errors.New("span.normalize: `Service` could not be normalized")
+		return fieldError("Service", "`Service` could not be normalized")
 	}
 
 	// Name
 	if s.Name == "" {
-		return errors.New("span.normalize: empty `Name`")
+		return fieldError("Name", "empty `Name`")
 	}
 	if len(s.Name) > MaxNameLen {
-		return fmt.Errorf("span.normalize: `Name` too long (max %d chars): %s", MaxNameLen, s.Name)
+		return fieldError("Name", "`Name` too long (max %d chars): %s", MaxNameLen, s.Name)
 	}
 	// name shall comply with Datadog metric name normalization
 	var ok bool
 	s.Name, ok = normMetricNameParse(s.Name)
 	if !ok {
-		return fmt.Errorf("span.normalize: invalid `Name`: %s", s.Name)
+		return fieldError("Name", "invalid `Name`: %s", s.Name)
 	}
 
 	// Resource
 	if s.Resource == "" {
-		return errors.New("span.normalize: empty `Resource`")
+		return fieldError("Resource", "empty `Resource`")
 	}
 	if len(s.Resource) > MaxResourceLen {
 		s.Resource = s.Resource[:MaxResourceLen]
@@ -74,10 +115,10 @@ func (s *Span) Normalize() error {
 	// TraceID & SpanID should be set in the client
 	// because they uniquely define the traces and associate them into traces
 	if s.TraceID == 0 {
-		return errors.New("span.normalize: empty `TraceID`")
+		return fieldError("TraceID", "empty `TraceID`")
 	}
 	if s.SpanID == 0 {
-		return errors.New("span.normalize: empty `SpanID`")
+		return fieldError("SpanID", "empty `SpanID`")
 	}
 
 	// ParentID, TraceID and SpanID set in the client could be the same
@@ -94,19 +135,21 @@ func (s *Span) Normalize() error {
 	// if s.Start is very little, less than year 2000 probably a unit issue so discard
 	// (or it is "le bug de l'an 2000")
 	if s.Start < Year2000NanosecTS {
-		return fmt.Errorf("span.normalize: invalid `Start` (must be nanosecond epoch): %d", s.Start)
+		return fieldError("Start", "invalid `Start` (must be nanosecond epoch): %d", s.Start)
 	}
 
 	// If the end date is too far away in the future, it's probably a mistake.
 	if s.Start+s.Duration > time.Now().Add(MaxEndDateOffset).UnixNano() {
-		return fmt.Errorf("span.normalize: more than %v in the future", MaxEndDateOffset)
+		return fieldError("Duration", "more than %v in the future", MaxEndDateOffset)
 	}
 
 	if s.Duration == 0 {
-		return errors.New("span.normalize: spans with zeroed `Duration` are discarded, use annotations")
+		return fieldError("Duration", "spans with zeroed `Duration` are discarded, use annotations")
 	}
 
-	// Error - Nothing to do
+	// Error, clients set it with various meta keys
+	s.normalizeErrors()
+
 	// Optional data, Meta & Metrics can be nil
 	// Soft fail on those
 	for k, v := range s.Meta {
@@ -140,21 +183,200 @@ func (s *Span) Normalize() error {
 
 	}
 
+	// Events & Links are optional too, they are trimmed rather than rejected
+	s.normalizeEvents()
+	s.normalizeLinks()
+
 	// ParentID set on the client side, no way of checking
 
 	// Type
 	if len(s.Type) > MaxTypeLen {
-		return fmt.Errorf("span.normalize: `Type` too long (max %d chars): %s", MaxTypeLen, s.Type)
+		return fieldError("Type", "`Type` too long (max %d chars): %s", MaxTypeLen, s.Type)
 	}
 
 	// Environment
-	if env, ok := s.Meta["env"]; ok {
-		s.Meta["env"] = NormalizeTag(env)
+	if env, ok := s.Meta[EnvKey]; ok {
+		s.Meta[EnvKey] = NormalizeTag(env)
 	}
+	s.setTypedMeta()
 
 	return nil
 }
 
+// normalizeEvents keeps the first MaxEventsPerSpan events of the span and
+// truncates their names and attributes
+func (s *Span) normalizeEvents() {
+	if len(s.Events) > MaxEventsPerSpan {
+		log.Debugf("span.normalize: dropping %d `Events` (max %d)", len(s.Events)-MaxEventsPerSpan, MaxEventsPerSpan)
+		s.Events = s.Events[:MaxEventsPerSpan]
+	}
+
+	for i := range s.Events {
+		e := &s.Events[i]
+		if len(e.Name) > MaxNameLen {
+			e.Name = truncateUTF8(e.Name, MaxNameLen) + "..."
+		}
+		for k, v := range e.Attrs {
+			modified := false
+
+			if len(k) > MaxMetaKeyLen {
+				delete(e.Attrs, k)
+				k = truncateUTF8(k, MaxMetaKeyLen) + "..."
+				modified = true
+			}
+
+			if len(v) > MaxEventAttrValLen {
+				v = truncateUTF8(v, MaxEventAttrValLen) + "..."
+				modified = true
+			}
+
+			if modified {
+				e.Attrs[k] = v
+			}
+		}
+	}
+}
+
+// normalizeLinks drops the links which do not point to a span
+func (s *Span) normalizeLinks() {
+	if len(s.Links) == 0 {
+		return
+	}
+	links := s.Links[:0]
+	for _, l := range s.Links {
+		if l.TraceID == 0 || l.SpanID == 0 {
+			log.Debugf("span.normalize: dropping invalid `Links` entry: %v", l)
+			continue
+		}
+		links = append(links, l)
+	}
+	s.Links = links
+}
+
+// metaBySize sorts metadata keys by descending size of their value
+type metaBySize struct {
+	keys []string
+	meta map[string]string
+}
+
+func (m metaBySize) Len() int      { return len(m.keys) }
+func (m metaBySize) Swap(i, j int) { m.keys[i], m.keys[j] = m.keys[j], m.keys[i] }
+func (m metaBySize) Less(i, j int) bool {
+	li, lj := len(m.meta[m.keys[i]]), len(m.meta[m.keys[j]])
+	if li != lj {
+		return li > lj
+	}
+	return m.keys[i] < m.keys[j]
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a rune
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// AddMissingMeta sets the metadata of tags the span does not have yet, its
+// own values always win
+func (s *Span) AddMissingMeta(tags map[string]string) {
+	for k, v := range tags {
+		if _, ok := s.Meta[k]; ok {
+			continue
+		}
+		if s.Meta == nil {
+			s.Meta = make(map[string]string, len(tags))
+		}
+		s.Meta[k] = v
+	}
+}
+
+// TruncateMeta shrinks the metadata of the span so that the total size of its
+// keys and values fits in budget bytes. The biggest values are truncated first
+// and get MetaTruncatedSuffix appended. It returns the number of bytes shaved.
+func (s *Span) TruncateMeta(budget int) int {
+	if budget <= 0 || len(s.Meta) == 0 {
+		return 0
+	}
+
+	var size int
+	for k, v := range s.Meta {
+		size += len(k) + len(v)
+	}
+	if size <= budget {
+		return 0
+	}
+
+	bySize := metaBySize{keys: make([]string, 0, len(s.Meta)), meta: s.Meta}
+	for k := range s.Meta {
+		bySize.keys = append(bySize.keys, k)
+	}
+	sort.Sort(bySize)
+
+	var shaved int
+	for _, k := range bySize.keys {
+		v := s.Meta[k]
+		if size <= budget || len(v) <= len(MetaTruncatedSuffix) {
+			// values are sorted, the next ones cannot be truncated either
+			break
+		}
+		keep := len(v) - (size - budget) - len(MetaTruncatedSuffix)
+		if keep < 0 {
+			keep = 0
+		}
+		truncated := truncateUTF8(v, keep) + MetaTruncatedSuffix
+		s.Meta[k] = truncated
+
+		size -= len(v) - len(truncated)
+		shaved += len(v) - len(truncated)
+	}
+
+	return shaved
+}
+
+// TrimMetaValue shortens the metadata value of key to max bytes, suffix
+// MetaTruncatedSuffix included unless max is shorter, or deletes the key if
+// max is 0. It returns the number of bytes shaved, the ones of the key
+// included when it is deleted.
+func (s *Span) TrimMetaValue(key string, max int) int {
+	v, ok := s.Meta[key]
+	if !ok {
+		return 0
+	}
+	if max <= 0 {
+		delete(s.Meta, key)
+		return len(key) + len(v)
+	}
+	if len(v) <= max {
+		return 0
+	}
+	trimmed := truncateUTF8(v, max)
+	if max > len(MetaTruncatedSuffix) {
+		trimmed = truncateUTF8(v, max-len(MetaTruncatedSuffix)) + MetaTruncatedSuffix
+	}
+	s.Meta[key] = trimmed
+	return len(v) - len(trimmed)
+}
+
+// ClampDuration shortens the span to max nanoseconds if it is longer, keeping
+// its end, and keeps its duration in the SpanUnclampedDurationKey metric. It
+// returns whether the span was shortened.
+func (s *Span) ClampDuration(max int64) bool {
+	if max <= 0 || s.Duration <= max {
+		return false
+	}
+	if s.Metrics == nil {
+		s.Metrics = make(map[string]float64)
+	}
+	s.Metrics[SpanUnclampedDurationKey] = float64(s.Duration)
+	s.Start += s.Duration - max
+	s.Duration = max
+	return true
+}
+
 // NormalizeTrace takes a trace and
 // * rejects the trace if there is a trace ID discrepancy between 2 spans
 // * rejects spans that cannot be normalized
@@ -171,11 +393,19 @@ func NormalizeTrace(t Trace) (Trace, error) {
 	traceID := t[0].TraceID
 	for i, s := range t {
 		if s.TraceID != traceID {
-			return t, fmt.Errorf("trace id mismatch %s:%x != %s:%x", t[0].Name, t[0].TraceID, s.Name, s.TraceID)
+			return t, &SpanError{
+				Index: i,
+				Err:   &FieldError{Field: "TraceID", Reason: fmt.Sprintf("`TraceID` %x differs from the one of the first span %x", s.TraceID, traceID)},
+				msg:   fmt.Sprintf("trace id mismatch %s:%x != %s:%x", t[0].Name, t[0].TraceID, s.Name, s.TraceID),
+			}
 		}
 
 		if err := t[i].Normalize(); err != nil {
-			return t, fmt.Errorf("invalid span %v: %v", s, err)
+			return t, &SpanError{
+				Index: i,
+				Err:   err.(*FieldError),
+				msg:   fmt.Sprintf("invalid span %v: %v", s, err),
+			}
 		}
 	}
 
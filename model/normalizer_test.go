@@ -4,6 +4,7 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -196,6 +197,91 @@ func TestNormalizeMetaValueTooLong(t *testing.T) {
 	}
 }
 
+func metaSize(m map[string]string) int {
+	var size int
+	for k, v := range m {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+func TestTruncateMetaUnderBudget(t *testing.T) {
+	s := testSpan()
+	before := make(map[string]string)
+	for k, v := range s.Meta {
+		before[k] = v
+	}
+	assert.Equal(t, 0, s.TruncateMeta(MaxMetaSize))
+	assert.Equal(t, before, s.Meta)
+}
+
+func TestTruncateMetaOrder(t *testing.T) {
+	assert := assert.New(t)
+	s := testSpan()
+	s.Meta = map[string]string{
+		"small":  strings.Repeat("s", 100),
+		"medium": strings.Repeat("m", 4000),
+		"big":    strings.Repeat("b", 8000),
+	}
+	before := metaSize(s.Meta)
+
+	// cutting the biggest value is enough
+	shaved := s.TruncateMeta(10000)
+	assert.Equal(before-metaSize(s.Meta), shaved)
+	assert.True(metaSize(s.Meta) <= 10000)
+	assert.True(strings.HasSuffix(s.Meta["big"], MetaTruncatedSuffix))
+	assert.Equal(strings.Repeat("m", 4000), s.Meta["medium"])
+	assert.Equal(strings.Repeat("s", 100), s.Meta["small"])
+
+	// both big values need to go
+	s.TruncateMeta(200)
+	assert.True(metaSize(s.Meta) <= 200)
+	assert.Equal(MetaTruncatedSuffix, s.Meta["big"])
+	assert.True(strings.HasSuffix(s.Meta["medium"], MetaTruncatedSuffix))
+	assert.Equal(strings.Repeat("s", 100), s.Meta["small"])
+}
+
+func TestTrimMetaValue(t *testing.T) {
+	assert := assert.New(t)
+	s := testSpan()
+	s.Meta = map[string]string{
+		"sql.query":    strings.Repeat("q", 100),
+		"http.headers": "accept: */*",
+		"short":        "s",
+		"multibyte":    strings.Repeat("é", 20),
+	}
+
+	assert.Equal(100-20, s.TrimMetaValue("sql.query", 20))
+	assert.Equal(strings.Repeat("q", 20-len(MetaTruncatedSuffix))+MetaTruncatedSuffix, s.Meta["sql.query"])
+	assert.Equal(0, s.TrimMetaValue("short", 20))
+	assert.Equal(0, s.TrimMetaValue("missing", 0))
+
+	// deleted
+	assert.Equal(len("http.headers")+len("accept: */*"), s.TrimMetaValue("http.headers", 0))
+	_, ok := s.Meta["http.headers"]
+	assert.False(ok)
+
+	// too short for the suffix, without splitting a rune
+	assert.Equal(40-4, s.TrimMetaValue("multibyte", 5))
+	assert.Equal("éé", s.Meta["multibyte"])
+}
+
+func TestTruncateMetaMultiByte(t *testing.T) {
+	assert := assert.New(t)
+
+	for budget := 20; budget < 40; budget++ {
+		s := testSpan()
+		s.Meta = map[string]string{"k": strings.Repeat("日本語", 10)}
+		assert.True(s.TruncateMeta(budget) > 0)
+
+		v := s.Meta["k"]
+		assert.True(utf8.ValidString(v), v)
+		assert.True(strings.HasSuffix(v, MetaTruncatedSuffix))
+		assert.True(metaSize(s.Meta) <= budget)
+		assert.Equal(0, len(strings.TrimSuffix(v, MetaTruncatedSuffix))%3)
+	}
+}
+
 func TestNormalizeParentIDPassThru(t *testing.T) {
 	s := testSpan()
 	before := s.ParentID
@@ -287,3 +373,112 @@ func TestNormalizeTrace(t *testing.T) {
 	_, err := NormalizeTrace(trace)
 	assert.NoError(t, err)
 }
+
+func TestNormalizeEvents(t *testing.T) {
+	assert := assert.New(t)
+	s := testSpan()
+	for i := 0; i < MaxEventsPerSpan+10; i++ {
+		s.Events = append(s.Events, SpanEvent{Ts: s.Start + int64(i), Name: "retry"})
+	}
+	s.Events[0].Name = strings.Repeat("n", MaxNameLen+10)
+	s.Events[0].Attrs = map[string]string{
+		"short":                   "value",
+		strings.Repeat("k", 1000): "key",
+		"long":                    strings.Repeat("v", MaxEventAttrValLen*2),
+		"multibyte":               strings.Repeat("é", MaxEventAttrValLen),
+	}
+
+	assert.NoError(s.Normalize())
+	assert.Len(s.Events, MaxEventsPerSpan)
+	assert.Equal(s.Start+int64(MaxEventsPerSpan-1), s.Events[MaxEventsPerSpan-1].Ts)
+
+	e := s.Events[0]
+	assert.Equal(strings.Repeat("n", MaxNameLen)+"...", e.Name)
+	assert.Len(e.Attrs, 4)
+	assert.Equal("value", e.Attrs["short"])
+	assert.Equal("key", e.Attrs[strings.Repeat("k", MaxMetaKeyLen)+"..."])
+	assert.Equal(strings.Repeat("v", MaxEventAttrValLen)+"...", e.Attrs["long"])
+	assert.True(utf8.ValidString(e.Attrs["multibyte"]))
+	assert.True(len(e.Attrs["multibyte"]) <= MaxEventAttrValLen+3)
+}
+
+func TestNormalizeLinks(t *testing.T) {
+	assert := assert.New(t)
+	s := testSpan()
+	s.Links = []SpanLink{{TraceID: 1, SpanID: 2}, {TraceID: 0, SpanID: 3}, {TraceID: 4, SpanID: 0}, {TraceID: 5, SpanID: 6}}
+	assert.NoError(s.Normalize())
+	assert.Equal([]SpanLink{{TraceID: 1, SpanID: 2}, {TraceID: 5, SpanID: 6}}, s.Links)
+}
+
+func TestAddMissingMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := map[string]string{"datacenter": "us-east-1a", "team": "platform"}
+
+	s := testSpan()
+	s.Meta = nil
+	s.AddMissingMeta(tags)
+	assert.Equal(tags, s.Meta)
+
+	// the tags of the span win
+	s.Meta = map[string]string{"team": "search", "http.url": "/"}
+	s.AddMissingMeta(tags)
+	assert.Equal(map[string]string{"datacenter": "us-east-1a", "team": "search", "http.url": "/"}, s.Meta)
+
+	s.Meta = nil
+	s.AddMissingMeta(nil)
+	assert.Nil(s.Meta)
+}
+
+func TestNormalizeTraceSpanError(t *testing.T) {
+	assert := assert.New(t)
+
+	span1 := testSpan()
+	span2 := testSpan()
+	span2.Service = ""
+	_, err := NormalizeTrace(Trace{span1, span2})
+	se, ok := err.(*SpanError)
+	assert.True(ok)
+	assert.Equal(1, se.Index)
+	assert.Equal("Service", se.Err.Field)
+	assert.Equal("empty `Service`", se.Err.Reason)
+	assert.Contains(err.Error(), "invalid span")
+
+	span2 = testSpan()
+	span2.TraceID++
+	_, err = NormalizeTrace(Trace{span1, span2})
+	se, ok = err.(*SpanError)
+	assert.True(ok)
+	assert.Equal(1, se.Index)
+	assert.Equal("TraceID", se.Err.Field)
+	assert.Contains(err.Error(), "trace id mismatch")
+}
+
+func TestClampDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	s := testSpan()
+	s.Metrics = nil
+	end := s.End()
+	assert.False(s.ClampDuration(0))
+	assert.False(s.ClampDuration(s.Duration))
+	assert.Nil(s.Metrics)
+
+	duration := s.Duration
+	assert.True(s.ClampDuration(duration / 2))
+	assert.Equal(duration/2, s.Duration)
+	assert.Equal(end, s.End())
+	assert.Equal(float64(duration), s.Metrics[SpanUnclampedDurationKey])
+}
+
+func TestNormalizeTypedMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	s := testSpan()
+	s.Meta = map[string]string{EnvKey: "Prod", HTTPStatusCodeKey: "404"}
+	assert.Nil(s.Normalize())
+	assert.Equal("prod", s.Env)
+	assert.Equal(uint16(404), s.StatusCode)
+	assert.Equal("prod", s.Meta[EnvKey])
+	assert.Equal("404", s.Meta[HTTPStatusCodeKey])
+}
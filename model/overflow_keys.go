@@ -0,0 +1,172 @@
+package model
+
+import "math"
+
+const (
+	// maxOverflowHashes is the number of folded keys an overflowKeys counts
+	// exactly
+	maxOverflowHashes = 1 << 13
+	// overflowSketchBits is the size of the sketch of an overflowKeys past
+	// maxOverflowHashes, 16KB
+	overflowSketchBits = 1 << 17
+)
+
+// overflowKeys counts the distinct aggregation keys folded in the overflow
+// distributions of a StatsRawBucket in bounded memory: folding a UUID in
+// every resource must not grow it by one key per span. It holds the hashes of
+// the keys, exact up to maxOverflowHashes, then only their bits in a fixed
+// size sketch. There, keys on the same bit cannot be told apart, so every new
+// bit stands for the number of keys it is expected to account for given the
+// bits left, as in linear counting: the count holds until the sketch fills
+// up, for millions of keys. The zero value is an empty set.
+type overflowKeys struct {
+	hashes map[uint64]string // the service of the folded keys, by hash, until full
+	sketch []uint64          // the bits of the hashes, once hashes was full
+	zeros  int               // the bits of sketch not set
+	credit float64           // the fraction of key not counted yet
+}
+
+// restoreOverflowKeys returns the overflowKeys of the given hashes and sketch
+func restoreOverflowKeys(hashes map[uint64]string, sketch []uint64) overflowKeys {
+	o := overflowKeys{hashes: hashes, sketch: sketch}
+	if sketch != nil {
+		o.zeros = overflowSketchBits
+		for _, w := range sketch {
+			o.zeros -= popcount(w)
+		}
+	}
+	return o
+}
+
+// add adds the hash h of a key of service, returning the number of keys it
+// stands for: 1 if it is new and counted exactly, 0 if it was seen already,
+// or its estimate past maxOverflowHashes
+func (o *overflowKeys) add(h uint64, service string) int {
+	if o.sketch == nil {
+		if _, ok := o.hashes[h]; ok {
+			return 0
+		}
+		if len(o.hashes) < maxOverflowHashes {
+			if o.hashes == nil {
+				o.hashes = make(map[uint64]string)
+			}
+			o.hashes[h] = service
+			return 1
+		}
+		o.toSketch()
+	}
+	w, bit := sketchBit(h)
+	if o.sketch[w]&bit != 0 {
+		return 0
+	}
+	o.sketch[w] |= bit
+	// a new key falls on a bit not set with a probability of zeros/bits
+	o.credit += float64(overflowSketchBits) / float64(o.zeros)
+	o.zeros--
+	n := int(o.credit)
+	o.credit -= float64(n)
+	return n
+}
+
+// toSketch moves the hashes of o to its sketch
+func (o *overflowKeys) toSketch() {
+	o.sketch = make([]uint64, overflowSketchBits/64)
+	o.zeros = overflowSketchBits
+	for h := range o.hashes {
+		w, bit := sketchBit(h)
+		if o.sketch[w]&bit == 0 {
+			o.sketch[w] |= bit
+			o.zeros--
+		}
+	}
+	o.hashes = nil
+}
+
+// merge adds the keys of other, whose counts by service are counts, to o,
+// returning the number of keys new to o by service. Past the exact hashes of
+// other, the services of its keys are unknown: its counts are shared out in
+// proportion of the keys the new bits of its sketch stand for.
+func (o *overflowKeys) merge(other *overflowKeys, counts map[string]int) map[string]int {
+	added := make(map[string]int)
+	if other.sketch == nil {
+		for h, service := range other.hashes {
+			if n := o.add(h, service); n > 0 {
+				added[service] += n
+			}
+		}
+		return added
+	}
+
+	if o.sketch == nil {
+		o.toSketch()
+	}
+	before := o.zeros
+	for i, w := range other.sketch {
+		o.zeros -= popcount(w &^ o.sketch[i])
+		o.sketch[i] |= w
+	}
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 || o.zeros == before {
+		return added
+	}
+	fresh := linearCount(o.zeros) - linearCount(before)
+	for service, n := range counts {
+		if n = int(float64(n)*fresh/float64(total) + 0.5); n > 0 {
+			added[service] = n
+		}
+	}
+	return added
+}
+
+// linearCount returns the number of keys expected to leave zeros bits of a
+// sketch not set
+func linearCount(zeros int) float64 {
+	if zeros == 0 {
+		zeros = 1
+	}
+	return overflowSketchBits * math.Log(float64(overflowSketchBits)/float64(zeros))
+}
+
+// sketchBit returns the word and bit of hash h in a sketch. FNV-1a does not
+// spread similar keys evenly enough over its low bits, so they are mixed
+// first, with the finalizer of MurmurHash3.
+func sketchBit(h uint64) (int, uint64) {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	i := h % overflowSketchBits
+	return int(i / 64), 1 << (i % 64)
+}
+
+// popcount returns the number of bits set in w
+func popcount(w uint64) int {
+	n := 0
+	for ; w != 0; w &= w - 1 {
+		n++
+	}
+	return n
+}
+
+// hash returns the 64-bit FNV-1a hash of k, each field ending with a 0xff
+// byte, which UTF-8 strings never hold
+func (k aggregationKey) hash() uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for _, f := range [...]string{k.Name, k.Env, k.Resource, k.Service, k.Extra} {
+		for i := 0; i < len(f); i++ {
+			h ^= uint64(f[i])
+			h *= prime64
+		}
+		h ^= 0xff
+		h *= prime64
+	}
+	return h
+}
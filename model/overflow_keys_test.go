@@ -0,0 +1,73 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func overflowKeyHash(i int) uint64 {
+	return aggregationKey{Name: "request", Env: "default", Resource: fmt.Sprintf("GET /users/%d", i), Service: "web"}.hash()
+}
+
+func TestOverflowKeysExact(t *testing.T) {
+	assert := assert.New(t)
+
+	var o overflowKeys
+	n := 0
+	for i := 0; i < maxOverflowHashes; i++ {
+		n += o.add(overflowKeyHash(i), "web")
+		n += o.add(overflowKeyHash(i), "web")
+	}
+	assert.Equal(maxOverflowHashes, n)
+	assert.Len(o.hashes, maxOverflowHashes)
+	assert.Nil(o.sketch)
+}
+
+func TestOverflowKeysSketch(t *testing.T) {
+	assert := assert.New(t)
+
+	var o overflowKeys
+	n := 0
+	for i := 0; i < 500000; i++ {
+		n += o.add(overflowKeyHash(i), "web")
+	}
+	// seen keys are still not counted again
+	for i := 0; i < 1000; i++ {
+		n += o.add(overflowKeyHash(i), "web")
+	}
+
+	// bounded, and still close
+	assert.Nil(o.hashes)
+	assert.Len(o.sketch, overflowSketchBits/64)
+	assert.InEpsilon(500000, n, 0.02)
+
+	restored := restoreOverflowKeys(o.hashes, o.sketch)
+	assert.Equal(o.zeros, restored.zeros)
+}
+
+func TestOverflowKeysMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	// exact: only the keys new to a are added
+	var a, b overflowKeys
+	for i := 0; i < 100; i++ {
+		a.add(overflowKeyHash(i), "web")
+		b.add(overflowKeyHash(i+50), "web")
+	}
+	assert.Equal(map[string]int{"web": 50}, a.merge(&b, map[string]int{"web": 100}))
+
+	// sketches: the new keys are shared out by service
+	a, b = overflowKeys{}, overflowKeys{}
+	for i := 0; i < 100000; i++ {
+		a.add(overflowKeyHash(i), "web")
+		b.add(overflowKeyHash(i+50000), "web")
+	}
+	added := a.merge(&b, map[string]int{"web": 75000, "db": 25000})
+	assert.InEpsilon(37500, added["web"], 0.02)
+	assert.InEpsilon(12500, added["db"], 0.02)
+
+	// nothing new
+	assert.Len(a.merge(&b, map[string]int{"web": 75000, "db": 25000}), 0)
+}
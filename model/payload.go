@@ -2,20 +2,37 @@ package model
 
 import (
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
 )
 
+// AgentInfo describes the agent which produced a payload
+type AgentInfo struct {
+	Version   string `json:"version"`    // the agent version, set at build time
+	GitCommit string `json:"git_commit"` // the commit the agent was built from
+	StartTime int64  `json:"start_time"` // when the agent started, in nanoseconds since epoch
+	Hostname  string `json:"hostname"`   // the host the agent runs on
+}
+
+// PayloadSchemaVersion is the version of the fields of AgentPayload, to be
+// increased when they change
+const PayloadSchemaVersion = 4
+
 // AgentPayload is the main payload to carry data that has been
-// pre-processed to the Datadog mothership
+// pre-processed to the Datadog mothership. Only the host name is always
+// encoded, the other fields are omitted when empty.
 type AgentPayload struct {
-	HostName string        `json:"hostname"` // the host name that will be resolved by the API
-	Env      string        `json:"env"`      // the default environment this agent uses
-	Traces   []Trace       `json:"traces"`   // the traces we sampled
-	Stats    []StatsBucket `json:"stats"`    // the statistics we pre-computed
+	HostName      string        `json:"hostname"`                 // the host name that will be resolved by the API
+	Env           string        `json:"env,omitempty"`            // the default environment this agent uses
+	Traces        []Trace       `json:"traces,omitempty"`         // the traces we sampled, none in stats-only mode
+	Stats         []StatsBucket `json:"stats,omitempty"`          // the statistics we pre-computed
+	AgentInfo     *AgentInfo    `json:"agent_info,omitempty"`     // the agent which produced this payload
+	SchemaVersion int           `json:"schema_version,omitempty"` // see PayloadSchemaVersion, 0 for older agents
+	Seq           uint64        `json:"-"`                        // the sequence number of the payload, sent as a header
 }
 
 // IsEmpty tells if a payload contains data. If not, it's useless
@@ -24,6 +41,120 @@ func (p *AgentPayload) IsEmpty() bool {
 	return len(p.Stats) == 0 && len(p.Traces) == 0
 }
 
+// Validate returns an error if the payload misses what the API requires: a
+// host name, and stats or traces, the stats buckets having a start and a
+// duration.
+func (p *AgentPayload) Validate() error {
+	if p.HostName == "" {
+		return errors.New("invalid payload: no hostname")
+	}
+	if p.IsEmpty() {
+		return errors.New("invalid payload: no stats nor traces")
+	}
+	for _, sb := range p.Stats {
+		if sb.Start <= 0 || sb.Duration <= 0 {
+			return fmt.Errorf("invalid payload: stats bucket with start %d and duration %d", sb.Start, sb.Duration)
+		}
+	}
+	return nil
+}
+
+// SplitByContent returns the traces and the stats of the payload apart,
+// each in a payload keeping the host, env, agent info and schema version of
+// p. Either is empty when p holds none.
+func (p *AgentPayload) SplitByContent() (traces, stats AgentPayload) {
+	traces = AgentPayload{HostName: p.HostName, Env: p.Env, AgentInfo: p.AgentInfo, SchemaVersion: p.SchemaVersion}
+	stats = traces
+	traces.Traces = p.Traces
+	stats.Stats = p.Stats
+	return traces, stats
+}
+
+// SplitByTag partitions the traces and stats of the payload by the value of
+// tag: traces by the meta of their root span, stats by their tag set. Data
+// without the tag, or with a value not in values, goes to the payload of the
+// empty value. All the payloads keep the host, env, agent info and schema
+// version of p, except when splitting by env: the payloads of the values are
+// then of their env.
+func (p *AgentPayload) SplitByTag(tag string, values []string) map[string]AgentPayload {
+	known := make(map[string]bool, len(values))
+	for _, v := range values {
+		known[v] = true
+	}
+	valueOf := func(v string) string {
+		if known[v] {
+			return v
+		}
+		return ""
+	}
+
+	payloads := make(map[string]AgentPayload)
+	get := func(v string) AgentPayload {
+		sp, ok := payloads[v]
+		if !ok {
+			sp = AgentPayload{HostName: p.HostName, Env: p.Env, AgentInfo: p.AgentInfo, SchemaVersion: p.SchemaVersion}
+			if tag == "env" && v != "" {
+				sp.Env = v
+			}
+		}
+		return sp
+	}
+
+	for _, t := range p.Traces {
+		var v string
+		if root := t.GetRoot(); root != nil {
+			v = valueOf(root.Meta[tag])
+		}
+		sp := get(v)
+		sp.Traces = append(sp.Traces, t)
+		payloads[v] = sp
+	}
+
+	for _, sb := range p.Stats {
+		buckets := make(map[string]StatsBucket)
+		bucket := func(v string) StatsBucket {
+			b, ok := buckets[v]
+			if !ok {
+				b = NewStatsBucket(sb.Start, sb.Duration)
+				b.Partial = sb.Partial
+				buckets[v] = b
+			}
+			return b
+		}
+		for k, c := range sb.Counts {
+			bucket(valueOf(c.TagSet.Get(tag).Value)).Counts[k] = c
+		}
+		for k, d := range sb.Distributions {
+			bucket(valueOf(d.TagSet.Get(tag).Value)).Distributions[k] = d
+		}
+		for k, c := range sb.ErrorTypes {
+			bucket(valueOf(c.TagSet.Get(tag).Value)).ErrorTypes[k] = c
+		}
+		values := errorSummaryValues(sb.ErrorTypes, tag, valueOf)
+		for service, list := range sb.ErrorSummaries {
+			for _, e := range list {
+				v := values[[2]string{service, e.Type}]
+				b := bucket(v)
+				if b.ErrorSummaries == nil {
+					b.ErrorSummaries = make(ErrorSummaries)
+					buckets[v] = b
+				}
+				b.ErrorSummaries[service] = append(b.ErrorSummaries[service], e)
+			}
+		}
+		for v, b := range buckets {
+			if sb.TopResources != nil {
+				b.SetTopResourcesWithBounds(sb.TopResources.max, sb.TopResources.bounds)
+			}
+			sp := get(v)
+			sp.Stats = append(sp.Stats, b)
+			payloads[v] = sp
+		}
+	}
+
+	return payloads
+}
+
 // AgentPayloadVersion is the version the agent agrees to with
 // the API so that they can encode/decode the data accordingly
 type AgentPayloadVersion string
@@ -43,21 +174,204 @@ var (
 // payload (according to GlobalAgentPayloadVersion)
 func EncodeAgentPayload(p AgentPayload) ([]byte, error) {
 	var b bytes.Buffer
-	var err error
+	_, err := StreamAgentPayload(&b, &p)
+	return b.Bytes(), err
+}
+
+// defaultCompressor is the gzip Compressor of StreamAgentPayload
+var defaultCompressor, _ = NewCompressor(CompressionGzip, 0)
+
+// StreamAgentPayload writes the encoded payload to w (according to
+// GlobalAgentPayloadVersion) and returns the number of bytes written. Unlike
+// EncodeAgentPayload the encoded payload is never held in memory.
+func StreamAgentPayload(w io.Writer, p *AgentPayload) (int64, error) {
+	return StreamAgentPayloadWith(w, p, defaultCompressor)
+}
 
+// StreamAgentPayloadWith is StreamAgentPayload, compressing the payload
+// with c instead of gzip.
+func StreamAgentPayloadWith(w io.Writer, p *AgentPayload, c Compressor) (int64, error) {
 	switch GlobalAgentPayloadVersion {
 	case AgentPayloadV01:
-		gz, err := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+		cw := &countingWriter{w: w}
+		cl, err := c.NewWriter(cw)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		err = json.NewEncoder(gz).Encode(p)
-		gz.Close()
+		if _, err := p.WriteTo(cl); err != nil {
+			cl.Close()
+			return cw.n, err
+		}
+		err = cl.Close()
+		return cw.n, err
 	default:
-		err = errors.New("unknown payload version")
+		return 0, errors.New("unknown payload version")
 	}
+}
 
-	return b.Bytes(), err
+// countingWriter counts the bytes written through it and remembers the first
+// error, so that long sequences of writes can be checked once.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func (cw *countingWriter) WriteString(s string) {
+	cw.Write([]byte(s))
+}
+
+// WriteTo writes the payload as JSON to w, the same way json.Marshal would
+// but encoding traces and distributions one at a time, so that the whole
+// payload is never marshalled in memory.
+func (p *AgentPayload) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	enc := json.NewEncoder(cw)
+	encode := func(v interface{}) {
+		if cw.err == nil {
+			cw.err = enc.Encode(v)
+		}
+	}
+
+	cw.WriteString(`{"hostname":`)
+	encode(p.HostName)
+	if p.Env != "" {
+		cw.WriteString(`,"env":`)
+		encode(p.Env)
+	}
+
+	if len(p.Traces) > 0 {
+		cw.WriteString(`,"traces":[`)
+		for i, t := range p.Traces {
+			if i > 0 {
+				cw.WriteString(",")
+			}
+			encode(t)
+		}
+		cw.WriteString("]")
+	}
+
+	if len(p.Stats) > 0 {
+		cw.WriteString(`,"stats":[`)
+		for i := range p.Stats {
+			if i > 0 {
+				cw.WriteString(",")
+			}
+			writeStatsBucket(cw, enc, &p.Stats[i])
+		}
+		cw.WriteString("]")
+	}
+
+	if p.AgentInfo != nil {
+		cw.WriteString(`,"agent_info":`)
+		encode(p.AgentInfo)
+	}
+	if p.SchemaVersion != 0 {
+		cw.WriteString(`,"schema_version":`)
+		encode(p.SchemaVersion)
+	}
+	cw.WriteString("}")
+
+	return cw.n, cw.err
+}
+
+// writeStatsBucket writes a StatsBucket as json.Marshal would, one count or
+// distribution at a time.
+func writeStatsBucket(cw *countingWriter, enc *json.Encoder, sb *StatsBucket) {
+	encode := func(v interface{}) {
+		if cw.err == nil {
+			cw.err = enc.Encode(v)
+		}
+	}
+
+	cw.WriteString(`{"Start":`)
+	encode(sb.Start)
+	cw.WriteString(`,"Duration":`)
+	encode(sb.Duration)
+
+	cw.WriteString(`,"Counts":`)
+	if sb.Counts == nil {
+		cw.WriteString("null")
+	} else {
+		keys := make([]string, 0, len(sb.Counts))
+		for k := range sb.Counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cw.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				cw.WriteString(",")
+			}
+			encode(k)
+			cw.WriteString(":")
+			encode(sb.Counts[k])
+		}
+		cw.WriteString("}")
+	}
+
+	cw.WriteString(`,"Distributions":`)
+	if sb.Distributions == nil {
+		cw.WriteString("null")
+	} else {
+		keys := make([]string, 0, len(sb.Distributions))
+		for k := range sb.Distributions {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cw.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				cw.WriteString(",")
+			}
+			encode(k)
+			cw.WriteString(":")
+			encode(sb.Distributions[k])
+		}
+		cw.WriteString("}")
+	}
+
+	if len(sb.ErrorTypes) > 0 {
+		keys := make([]string, 0, len(sb.ErrorTypes))
+		for k := range sb.ErrorTypes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cw.WriteString(`,"ErrorTypes":{`)
+		for i, k := range keys {
+			if i > 0 {
+				cw.WriteString(",")
+			}
+			encode(k)
+			cw.WriteString(":")
+			encode(sb.ErrorTypes[k])
+		}
+		cw.WriteString("}")
+	}
+
+	if len(sb.ErrorSummaries) > 0 {
+		cw.WriteString(`,"error_summaries":`)
+		encode(sb.ErrorSummaries)
+	}
+	if sb.Partial {
+		cw.WriteString(`,"Partial":true`)
+	}
+	if sb.TopResources != nil {
+		cw.WriteString(`,"TopResources":`)
+		encode(sb.TopResources)
+	}
+
+	cw.WriteString("}")
 }
 
 // AgentPayloadAPIPath returns the path (after the first slash) to which
@@ -0,0 +1,309 @@
+package model
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/DataDog/datadog-trace-agent/quantile"
+)
+
+// PayloadEncodingJSON is the encoding of AgentPayloadV01 payloads before
+// their compression, as written by AgentPayload.WriteTo
+const PayloadEncodingJSON = "json"
+
+// EstimateSize returns an estimate of the size of the payload once encoded
+// with encoding, without encoding it: only the lengths of its strings and
+// the number of its fields, spans and summary entries are used. Strings are
+// assumed not to need escaping. It returns -1 for unknown encodings.
+func (p *AgentPayload) EstimateSize(encoding string) int {
+	if encoding != PayloadEncodingJSON {
+		return -1
+	}
+
+	// each value written by WriteTo is followed by the newline of
+	// json.Encoder, hence the +1s
+	n := len(`{"hostname":`) + jsonStringSize(p.HostName) + 1
+	if p.Env != "" {
+		n += len(`,"env":`) + jsonStringSize(p.Env) + 1
+	}
+	if len(p.Traces) > 0 {
+		n += len(`,"traces":[]`) + len(p.Traces) - 1
+		for _, t := range p.Traces {
+			n += t.jsonSize() + 1
+		}
+	}
+	if len(p.Stats) > 0 {
+		n += len(`,"stats":[]`) + len(p.Stats) - 1
+		for i := range p.Stats {
+			n += p.Stats[i].jsonSize()
+		}
+	}
+	if p.AgentInfo != nil {
+		n += len(`,"agent_info":`) + p.AgentInfo.jsonSize() + 1
+	}
+	if p.SchemaVersion != 0 {
+		n += len(`,"schema_version":`) + jsonIntSize(int64(p.SchemaVersion)) + 1
+	}
+	return n + len(`}`)
+}
+
+func (a *AgentInfo) jsonSize() int {
+	return len(`{"version":,"git_commit":,"start_time":,"hostname":}`) +
+		jsonStringSize(a.Version) + jsonStringSize(a.GitCommit) +
+		jsonIntSize(a.StartTime) + jsonStringSize(a.Hostname)
+}
+
+func (t Trace) jsonSize() int {
+	if t == nil {
+		return len(`null`)
+	}
+	n := len(`[]`)
+	if len(t) > 1 {
+		n += len(t) - 1
+	}
+	for i := range t {
+		n += t[i].jsonSize()
+	}
+	return n
+}
+
+func (s *Span) jsonSize() int {
+	n := len(`{"service":,"name":,"resource":,"trace_id":,"span_id":,"start":,"duration":,"error":,"meta":,"metrics":,"parent_id":,"type":}`)
+	n += jsonStringSize(s.Service) + jsonStringSize(s.Name) + jsonStringSize(s.Resource) +
+		jsonUintSize(s.TraceID) + jsonUintSize(s.SpanID) +
+		jsonIntSize(s.Start) + jsonIntSize(s.Duration) + jsonIntSize(int64(s.Error)) +
+		jsonStringMapSize(s.Meta) + jsonFloatMapSize(s.Metrics) +
+		jsonUintSize(s.ParentID) + jsonStringSize(s.Type)
+
+	if len(s.Events) > 0 {
+		n += len(`,"events":[]`) + len(s.Events) - 1
+		for _, e := range s.Events {
+			n += len(`{"ts":,"name":}`) + jsonIntSize(e.Ts) + jsonStringSize(e.Name)
+			if len(e.Attrs) > 0 {
+				n += len(`,"attrs":`) + jsonStringMapSize(e.Attrs)
+			}
+		}
+	}
+	if len(s.Links) > 0 {
+		n += len(`,"links":[]`) + len(s.Links) - 1
+		for _, l := range s.Links {
+			n += len(`{"trace_id":,"span_id":}`) + jsonUintSize(l.TraceID) + jsonUintSize(l.SpanID)
+		}
+	}
+	if len(s.Indexed) > 0 {
+		n += len(`,"indexed":`) + jsonStringMapSize(s.Indexed)
+	}
+	return n
+}
+
+func (sb *StatsBucket) jsonSize() int {
+	n := len(`{"Start":,"Duration":,"Counts":,"Distributions":}`) +
+		jsonIntSize(sb.Start) + 1 + jsonIntSize(sb.Duration) + 1
+	n += jsonCountsSize(sb.Counts)
+
+	if sb.Distributions == nil {
+		n += len(`null`)
+	} else {
+		n += jsonObjectSize(len(sb.Distributions))
+		for k, d := range sb.Distributions {
+			// the key and the distribution are each written with a newline
+			n += jsonStringSize(k) + 1 + len(`:`) + d.jsonSize() + 1
+		}
+	}
+
+	if len(sb.ErrorTypes) > 0 {
+		n += len(`,"ErrorTypes":`) + jsonCountsSize(sb.ErrorTypes)
+	}
+	if len(sb.ErrorSummaries) > 0 {
+		// written with the newline of json.Encoder
+		n += len(`,"error_summaries":`) + sb.ErrorSummaries.jsonSize() + 1
+	}
+	if sb.Partial {
+		n += len(`,"Partial":true`)
+	}
+	if sb.TopResources != nil {
+		// written with the newline of json.Encoder
+		n += len(`,"TopResources":`) + sb.TopResources.jsonSize() + 1
+	}
+	return n
+}
+
+func (es ErrorSummaries) jsonSize() int {
+	n := jsonObjectSize(len(es))
+	for service, list := range es {
+		n += jsonStringSize(service) + len(`:`)
+		if list == nil {
+			n += len(`null`)
+			continue
+		}
+		n += len(`[]`)
+		if len(list) > 1 {
+			n += len(list) - 1
+		}
+		for _, e := range list {
+			n += len(`{"type":,"count":,"message":,"trace_id":}`) +
+				jsonStringSize(e.Type) + jsonFloatSize(e.Count) + jsonStringSize(e.Message) + jsonUintSize(e.TraceID)
+		}
+	}
+	return n
+}
+
+func (t *TopResources) jsonSize() int {
+	n := len(`{"hits":,"p95":}`)
+	for _, list := range [][]ResourceStats{t.Hits, t.P95} {
+		if list == nil {
+			n += len(`null`)
+			continue
+		}
+		n += len(`[]`)
+		if len(list) > 1 {
+			n += len(list) - 1
+		}
+		for _, rs := range list {
+			n += len(`{"name":,"service":,"resource":,"hits":,"p95":}`) +
+				jsonStringSize(rs.Name) + jsonStringSize(rs.Service) + jsonStringSize(rs.Resource) +
+				jsonFloatSize(rs.Hits) + jsonFloatSize(rs.P95)
+			if rs.P95Lower != 0 {
+				n += len(`,"p95_lower":`) + jsonFloatSize(rs.P95Lower)
+			}
+			if rs.P95Upper != 0 {
+				n += len(`,"p95_upper":`) + jsonFloatSize(rs.P95Upper)
+			}
+		}
+	}
+	return n
+}
+
+func jsonCountsSize(counts map[string]Count) int {
+	if counts == nil {
+		return len(`null`)
+	}
+	n := jsonObjectSize(len(counts))
+	for k, c := range counts {
+		n += jsonStringSize(k) + 1 + len(`:`) + c.jsonSize() + 1
+	}
+	return n
+}
+
+func (c *Count) jsonSize() int {
+	return len(`{"key":,"name":,"measure":,"tagset":,"value":}`) +
+		jsonStringSize(c.Key) + jsonStringSize(c.Name) + jsonStringSize(c.Measure) +
+		c.TagSet.jsonSize() + jsonFloatSize(c.Value)
+}
+
+func (d *Distribution) jsonSize() int {
+	return len(`{"key":,"name":,"measure":,"tagset":,"summary":,"service":,"resource":}`) +
+		jsonStringSize(d.Key) + jsonStringSize(d.Name) + jsonStringSize(d.Measure) +
+		d.TagSet.jsonSize() + jsonSummarySize(d.Summary) +
+		jsonStringSize(d.Service()) + jsonStringSize(d.Resource())
+}
+
+func (t TagSet) jsonSize() int {
+	if t == nil {
+		return len(`null`)
+	}
+	n := len(`[]`)
+	if len(t) > 1 {
+		n += len(t) - 1
+	}
+	for _, tag := range t {
+		n += len(`{"name":,"value":}`) + jsonStringSize(tag.Name) + jsonStringSize(tag.Value)
+	}
+	return n
+}
+
+func jsonSummarySize(s *quantile.SliceSummary) int {
+	if s == nil {
+		return len(`null`)
+	}
+	n := len(`{"Entries":,"N":}`) + jsonIntSize(int64(s.N))
+	if s.Entries == nil {
+		n += len(`null`)
+	} else {
+		n += len(`[]`)
+		if len(s.Entries) > 1 {
+			n += len(s.Entries) - 1
+		}
+		for _, e := range s.Entries {
+			n += len(`{"v":,"g":,"delta":}`) + jsonFloatSize(e.V) +
+				jsonIntSize(int64(e.G)) + jsonIntSize(int64(e.Delta))
+		}
+	}
+	if s.FirstTs != 0 {
+		n += len(`,"FirstTs":`) + jsonIntSize(s.FirstTs)
+	}
+	if s.LastTs != 0 {
+		n += len(`,"LastTs":`) + jsonIntSize(s.LastTs)
+	}
+	if s.Epsilon != 0 {
+		n += len(`,"Epsilon":`) + jsonFloatSize(s.Epsilon)
+	}
+	return n
+}
+
+// jsonObjectSize is the size of the braces and commas of an object with n
+// fields
+func jsonObjectSize(n int) int {
+	if n > 1 {
+		return len(`{}`) + n - 1
+	}
+	return len(`{}`)
+}
+
+func jsonStringMapSize(m map[string]string) int {
+	if m == nil {
+		return len(`null`)
+	}
+	n := jsonObjectSize(len(m))
+	for k, v := range m {
+		n += jsonStringSize(k) + len(`:`) + jsonStringSize(v)
+	}
+	return n
+}
+
+func jsonFloatMapSize(m map[string]float64) int {
+	if m == nil {
+		return len(`null`)
+	}
+	n := jsonObjectSize(len(m))
+	for k, v := range m {
+		n += jsonStringSize(k) + len(`:`) + jsonFloatSize(v)
+	}
+	return n
+}
+
+func jsonStringSize(s string) int {
+	return len(s) + len(`""`)
+}
+
+func jsonUintSize(v uint64) int {
+	n := 1
+	for v >= 10 {
+		v /= 10
+		n++
+	}
+	return n
+}
+
+func jsonIntSize(v int64) int {
+	if v < 0 {
+		if v == math.MinInt64 {
+			return len("-9223372036854775808")
+		}
+		return 1 + jsonUintSize(uint64(-v))
+	}
+	return jsonUintSize(uint64(v))
+}
+
+// jsonFloatSize is the size of v as encoding/json formats it
+func jsonFloatSize(v float64) int {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return jsonIntSize(int64(v))
+	}
+	var buf [32]byte
+	format := byte('f')
+	if abs := math.Abs(v); abs < 1e-6 || abs >= 1e21 {
+		format = 'e'
+	}
+	return len(strconv.AppendFloat(buf[:0], v, format, -1, 64))
+}
@@ -0,0 +1,155 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRandomPayload returns a payload of n traces with spans of random
+// sizes, and their stats
+func newRandomPayload(seed int64, n int) AgentPayload {
+	r := rand.New(rand.NewSource(seed))
+	str := func(max int) string {
+		b := make([]byte, 1+r.Intn(max))
+		for i := range b {
+			b[i] = byte('a' + r.Intn(26))
+		}
+		return string(b)
+	}
+
+	start := int64(1500000000e9)
+	srb := NewStatsRawBucket(start, 1e10)
+	p := AgentPayload{
+		HostName:      "host-" + str(10),
+		Env:           "prod",
+		AgentInfo:     &AgentInfo{Version: "5.20.0", GitCommit: "abcdef", StartTime: start - 1e12, Hostname: "host"},
+		SchemaVersion: PayloadSchemaVersion,
+	}
+	for i := 0; i < n; i++ {
+		traceID := uint64(r.Int63())
+		trace := make(Trace, 1+r.Intn(20))
+		for j := range trace {
+			s := Span{
+				TraceID:  traceID,
+				SpanID:   uint64(r.Int63()),
+				Service:  str(3),
+				Name:     str(15),
+				Resource: str(200),
+				Type:     str(5),
+				Start:    start + r.Int63n(5e9),
+				Duration: r.Int63n(1e9),
+				Meta:     map[string]string{"env": "prod"},
+			}
+			if j > 0 {
+				s.ParentID = trace[0].SpanID
+			}
+			if r.Intn(10) == 0 {
+				s.Error = 1
+				s.Meta[ErrorTypeKey] = str(10)
+			}
+			for k := r.Intn(8); k > 0; k-- {
+				s.Meta[str(20)] = str(100)
+			}
+			if r.Intn(2) == 0 {
+				s.Metrics = map[string]float64{
+					"_top_level":            1,
+					"rows":                  float64(r.Intn(1000)),
+					"ratio":                 r.Float64(),
+					SpanSampleRateMetricKey: 0.5,
+				}
+			}
+			for k := r.Intn(3); k > 0; k-- {
+				s.Events = append(s.Events, SpanEvent{Ts: s.Start + 1, Name: str(10), Attrs: map[string]string{"attempt": str(3)}})
+			}
+			if r.Intn(5) == 0 {
+				s.Links = []SpanLink{{TraceID: uint64(r.Int63()), SpanID: uint64(r.Int63())}}
+			}
+			trace[j] = s
+			srb.HandleSpan(s, "prod", nil, 1, nil)
+		}
+		p.Traces = append(p.Traces, trace)
+	}
+	p.Stats = []StatsBucket{srb.Export()}
+	return p
+}
+
+func TestAgentPayloadEstimateSize(t *testing.T) {
+	assert := assert.New(t)
+
+	escaped := newMaximalPayload()
+	escaped.Traces[0][1].Resource = `SELECT * FROM "users" WHERE age > 21 AND name <> 'bob'`
+
+	corpus := map[string]AgentPayload{
+		"empty":   {HostName: "host"},
+		"minimal": newMinimalPayload(),
+		"maximal": newMaximalPayload(),
+		"escaped": escaped,
+	}
+	for _, n := range []int{1, 10, 100, 1000} {
+		corpus[fmt.Sprintf("random %d traces", n)] = newRandomPayload(int64(n), n)
+	}
+	statsOnly := newRandomPayload(42, 100)
+	statsOnly.Traces = nil
+	corpus["stats only"] = statsOnly
+
+	for name, p := range corpus {
+		size, err := p.WriteTo(ioutil.Discard)
+		assert.Nil(err)
+		estimate := p.EstimateSize(PayloadEncodingJSON)
+		assert.InEpsilon(size, estimate, 0.1, "%s: estimated %d bytes, encoded in %d", name, estimate, size)
+	}
+
+	p := newMinimalPayload()
+	assert.Equal(-1, p.EstimateSize("protobuf"))
+}
+
+func TestAgentPayloadEstimateSizeExact(t *testing.T) {
+	assert := assert.New(t)
+
+	// without strings to escape, the estimate is the size
+	for _, p := range []AgentPayload{newMinimalPayload(), newMaximalPayload(), newRandomPayload(1, 50)} {
+		size, _ := p.WriteTo(ioutil.Discard)
+		assert.Equal(int(size), p.EstimateSize(PayloadEncodingJSON))
+	}
+}
+
+func TestAgentPayloadEstimateSizeCost(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	p := newRandomPayload(1, 100)
+	estimate := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p.EstimateSize(PayloadEncodingJSON)
+		}
+	})
+	encode := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p.WriteTo(ioutil.Discard)
+		}
+	})
+	ratio := float64(encode.NsPerOp()) / float64(estimate.NsPerOp())
+	assert.True(t, ratio >= 10, "estimating the size is only %.1f times cheaper than encoding", ratio)
+}
+
+func BenchmarkAgentPayloadEstimateSize(b *testing.B) {
+	p := newRandomPayload(1, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.EstimateSize(PayloadEncodingJSON)
+	}
+}
+
+func BenchmarkAgentPayloadWriteTo(b *testing.B) {
+	p := newRandomPayload(1, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.WriteTo(ioutil.Discard)
+	}
+}
@@ -0,0 +1,244 @@
+package model
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentPayloadSplitByContent(t *testing.T) {
+	assert := assert.New(t)
+
+	info := &AgentInfo{Version: "5.20.0"}
+	p := AgentPayload{
+		HostName:      "host",
+		Env:           "prod",
+		Traces:        []Trace{{Span{TraceID: 1, SpanID: 1}}},
+		Stats:         []StatsBucket{NewStatsBucket(0, 1e10)},
+		AgentInfo:     info,
+		SchemaVersion: PayloadSchemaVersion,
+	}
+	traces, stats := p.SplitByContent()
+	assert.Equal(AgentPayload{HostName: "host", Env: "prod", Traces: p.Traces, AgentInfo: info, SchemaVersion: PayloadSchemaVersion}, traces)
+	assert.Equal(AgentPayload{HostName: "host", Env: "prod", Stats: p.Stats, AgentInfo: info, SchemaVersion: PayloadSchemaVersion}, stats)
+
+	p.Stats = nil
+	_, stats = p.SplitByContent()
+	assert.True(stats.IsEmpty())
+}
+
+func TestAgentPayloadSplitByTag(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := func(id uint64, team string) Trace {
+		root := Span{TraceID: id, SpanID: 1, Service: "mcnulty", Name: "query"}
+		if team != "" {
+			root.Meta = map[string]string{"team": team}
+		}
+		return Trace{root, Span{TraceID: id, SpanID: 2, ParentID: 1, Service: "mcnulty", Name: "sql",
+			Meta: map[string]string{"team": "search"}}}
+	}
+
+	sb := NewStatsBucket(0, 1e10)
+	for _, team := range []string{"payments", "search", "marketing", ""} {
+		tags := TagSet{{"service", "mcnulty"}}
+		if team != "" {
+			tags = append(tags, Tag{"team", team})
+		}
+		key := GrainKey("query", HITS, tags.Key())
+		sb.Counts[key] = NewCount(HITS, key, "query", tags)
+		key = GrainKey("query", DURATION, tags.Key())
+		sb.Distributions[key] = NewDistribution(DURATION, key, "query", tags)
+		key = GrainKey("query", ERRORS, tags.Key()+",error.type:Timeout")
+		sb.ErrorTypes[key] = NewCount(ERRORS, key, "query", append(tags, Tag{ErrorTypeKey, "Timeout"}))
+	}
+
+	sb.Partial = true
+	p := AgentPayload{
+		HostName: "test.host",
+		Env:      "prod",
+		Traces:   []Trace{trace(1, "payments"), trace(2, "search"), trace(3, "marketing"), trace(4, "")},
+		Stats:    []StatsBucket{sb},
+	}
+
+	payloads := p.SplitByTag("team", []string{"payments", "search"})
+	assert.Len(payloads, 3)
+
+	for v, ids := range map[string][]uint64{"payments": {1}, "search": {2}, "": {3, 4}} {
+		sp := payloads[v]
+		assert.Equal("test.host", sp.HostName)
+		assert.Equal("prod", sp.Env)
+
+		var traceIDs []uint64
+		for _, t := range sp.Traces {
+			traceIDs = append(traceIDs, t[0].TraceID)
+		}
+		assert.Equal(ids, traceIDs, v)
+
+		if assert.Len(sp.Stats, 1) {
+			assert.Equal(int64(1e10), sp.Stats[0].Duration)
+			assert.True(sp.Stats[0].Partial)
+			for _, c := range sp.Stats[0].Counts {
+				team := c.TagSet.Get("team").Value
+				if v == "" {
+					assert.NotContains([]string{"payments", "search"}, team)
+				} else {
+					assert.Equal(v, team)
+				}
+			}
+		}
+	}
+	assert.Len(payloads[""].Stats[0].Counts, 2)
+	assert.Len(payloads[""].Stats[0].Distributions, 2)
+	assert.Len(payloads["payments"].Stats[0].Distributions, 1)
+	assert.Len(payloads["payments"].Stats[0].ErrorTypes, 1)
+	assert.Len(payloads[""].Stats[0].ErrorTypes, 2)
+}
+
+// Run `go test ./model -update` to regenerate the golden payloads after an
+// intended change of the schema, along with PayloadSchemaVersion.
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// newMinimalPayload returns a payload with only the required fields
+func newMinimalPayload() AgentPayload {
+	srb := NewStatsRawBucket(1500000000e9, 1e10)
+	srb.HandleSpan(Span{SpanID: 1, Service: "web", Name: "request", Resource: "GET /", Start: 1500000000e9, Duration: 1e6},
+		defaultEnv, nil, 1, nil)
+	return AgentPayload{HostName: "host", Stats: []StatsBucket{srb.Export()}}
+}
+
+// newMaximalPayload returns a payload with all the fields of the current
+// schema version
+func newMaximalPayload() AgentPayload {
+	root := Span{TraceID: 1, SpanID: 1, Service: "web", Name: "request", Resource: "GET /", Type: "web",
+		Start: 1500000000e9, Duration: 2e6, Error: 1,
+		Meta:       map[string]string{"env": "prod", ErrorTypeKey: "Timeout", "team": "payments"},
+		Metrics:    map[string]float64{SamplingPriorityKey: 2, "_top_level": 1},
+		IsTopLevel: true}
+	child := Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "query", Resource: "SELECT ?", Type: "sql",
+		Start: 1500000000e9 + 1e5, Duration: 1e6}
+
+	srb := NewStatsRawBucket(1500000000e9, 1e10)
+	srb.SetEpsilons(map[string]float64{"db": 0.005})
+	sublayers := ComputeSublayers(&Trace{root, child})
+	srb.HandleSpan(root, "prod", []string{"team"}, 1, &sublayers)
+	srb.HandleSpan(child, "prod", []string{"team"}, 1, nil)
+	sb := srb.Export()
+	sb.Partial = true
+	sb.SetTopResources(2)
+	return AgentPayload{
+		HostName:      "host",
+		Env:           "prod",
+		Traces:        []Trace{{root, child}},
+		Stats:         []StatsBucket{sb},
+		AgentInfo:     &AgentInfo{Version: "5.20.0", GitCommit: "abcdef", StartTime: 1499999000e9, Hostname: "host"},
+		SchemaVersion: PayloadSchemaVersion,
+	}
+}
+
+func TestAgentPayloadGolden(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, p := range map[string]AgentPayload{
+		"payload_minimal.golden.json": newMinimalPayload(),
+		"payload_maximal.golden.json": newMaximalPayload(),
+	} {
+		assert.Nil(p.Validate(), name)
+		var buf bytes.Buffer
+		_, err := p.WriteTo(&buf)
+		assert.Nil(err)
+
+		path := filepath.Join("testdata", name)
+		if *updateGolden {
+			if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+				t.Fatalf("cannot update %s: %v", path, err)
+			}
+		}
+		expected, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("cannot read %s: %v", path, err)
+		}
+		assert.True(bytes.Equal(expected, buf.Bytes()), "%s differs from the encoded payload, run with -update if this is intended", path)
+	}
+
+	// absent sections produce no bytes
+	var buf bytes.Buffer
+	p := newMinimalPayload()
+	p.WriteTo(&buf)
+	for _, field := range []string{"env", "traces", "agent_info", "schema_version"} {
+		assert.NotContains(buf.String(), `"`+field+`":`)
+	}
+}
+
+func TestAgentPayloadValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newMaximalPayload()
+	assert.Nil(p.Validate())
+	tracesOnly := newMaximalPayload()
+	tracesOnly.Stats = nil
+	assert.Nil(tracesOnly.Validate())
+
+	for name, invalidate := range map[string]func(p *AgentPayload){
+		"no hostname":    func(p *AgentPayload) { p.HostName = "" },
+		"empty":          func(p *AgentPayload) { p.Stats, p.Traces = nil, nil },
+		"no start":       func(p *AgentPayload) { p.Stats[0].Start = 0 },
+		"no duration":    func(p *AgentPayload) { p.Stats[0].Duration = 0 },
+		"negative start": func(p *AgentPayload) { p.Stats[0].Start = -1 },
+	} {
+		p := newMaximalPayload()
+		invalidate(&p)
+		assert.NotNil(p.Validate(), name)
+	}
+}
+
+func TestAgentPayloadSplitByEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(1500000000e9, 1e10)
+	for _, env := range []string{"prod", "staging", "staging", "none"} {
+		srb.HandleSpan(Span{SpanID: 1, Service: "web", Name: "request", Resource: "GET /", Start: 1500000000e9, Duration: 1e6},
+			env, nil, 1, nil)
+	}
+	p := AgentPayload{
+		HostName: "host",
+		Env:      "none",
+		Traces: []Trace{
+			{Span{TraceID: 1, SpanID: 1, Meta: map[string]string{"env": "prod"}}},
+			{Span{TraceID: 2, SpanID: 1, Meta: map[string]string{"env": "staging"}}},
+			{Span{TraceID: 3, SpanID: 1}},
+		},
+		Stats: []StatsBucket{srb.Export()},
+	}
+
+	payloads := p.SplitByTag("env", []string{"prod", "staging"})
+	assert.Len(payloads, 3)
+	for env, traceID := range map[string]uint64{"prod": 1, "staging": 2, "": 3} {
+		sp := payloads[env]
+		if env == "" {
+			assert.Equal("none", sp.Env)
+		} else {
+			assert.Equal(env, sp.Env)
+		}
+		if assert.Len(sp.Traces, 1, env) {
+			assert.Equal(traceID, sp.Traces[0][0].TraceID)
+		}
+		if assert.Len(sp.Stats, 1, env) {
+			for _, c := range sp.Stats[0].Counts {
+				if env == "" {
+					assert.Equal("none", c.TagSet.Get("env").Value)
+				} else {
+					assert.Equal(env, c.TagSet.Get("env").Value)
+				}
+			}
+		}
+	}
+	// staging spans share their distribution
+	for _, d := range payloads["staging"].Stats[0].Distributions {
+		assert.Equal(2, d.Summary.N)
+	}
+}
@@ -3,11 +3,34 @@ package model
 import (
 	"fmt"
 	"math/rand"
+	"strconv"
+	"time"
 )
 
 const (
 	// SpanSampleRateMetricKey is the metric key holding the sample rate
 	SpanSampleRateMetricKey = "_sample_rate"
+	// SamplingPriorityKey is the metric key holding the sampling priority
+	// given by the client to the trace, on its root span
+	SamplingPriorityKey = "_sampling_priority_v1"
+	// EnvKey is the meta key holding the env of the span, see Span.Env
+	EnvKey = "env"
+	// HTTPStatusCodeKey is the meta key holding the status code of HTTP
+	// requests, see Span.StatusCode
+	HTTPStatusCodeKey = "http.status_code"
+)
+
+// Sampling priorities set by clients, see Span.SamplingPriority
+const (
+	// PriorityUserDrop means the user asked to drop the trace
+	PriorityUserDrop = -1
+	// PriorityAutoDrop means the client sampler decided to drop the trace
+	PriorityAutoDrop = 0
+	// PriorityAutoKeep means the client sampler decided to keep the trace,
+	// the agent still samples it
+	PriorityAutoKeep = 1
+	// PriorityUserKeep means the user asked to keep the trace
+	PriorityUserKeep = 2
 )
 
 // Span is the common struct we use to represent a dapper-like span
@@ -24,10 +47,39 @@ type Span struct {
 	Error    int32  `json:"error" msg:"error"`       // error status of the span, 0 == OK
 
 	// Optional
-	Meta     map[string]string  `json:"meta" msg:"meta"`           // arbitrary tags/metadata
-	Metrics  map[string]float64 `json:"metrics" msg:"metrics"`     // arbitrary metrics
-	ParentID uint64             `json:"parent_id" msg:"parent_id"` // span ID of the span in which this one was created
-	Type     string             `json:"type" msg:"type"`           // protocol associated with the span
+	Meta     map[string]string  `json:"meta" msg:"meta"`               // arbitrary tags/metadata
+	Metrics  map[string]float64 `json:"metrics" msg:"metrics"`         // arbitrary metrics
+	ParentID uint64             `json:"parent_id" msg:"parent_id"`     // span ID of the span in which this one was created
+	Type     string             `json:"type" msg:"type"`               // protocol associated with the span
+	Events   []SpanEvent        `json:"events,omitempty" msg:"events"` // timestamped annotations, e.g. a retry
+	Links    []SpanLink         `json:"links,omitempty" msg:"links"`   // spans of other traces this one relates to
+
+	// Set by the agent
+	Indexed map[string]string `json:"indexed,omitempty" msg:"-"` // meta promoted for indexing, see PromoteIndexed
+
+	// Copies of the hottest meta, set by Normalize so that the agent does
+	// not look them up for every span. Meta is still what is encoded.
+	Env        string `json:"-" msg:"-"` // meta EnvKey, read with GetEnv
+	StatusCode uint16 `json:"-" msg:"-"` // meta HTTPStatusCodeKey if valid, read with GetStatusCode
+
+	// IsTopLevel copies the TraceTopLevelKey metric, set by
+	// Trace.ComputeTopLevel, so that the stats never read Metrics, which
+	// the sampler writes concurrently. Read with TopLevel.
+	IsTopLevel bool `json:"-" msg:"-"`
+}
+
+// SpanEvent is something which happened during a span, at a given time
+type SpanEvent struct {
+	Ts    int64             `json:"ts" msg:"ts"` // nanosecond epoch of the event
+	Name  string            `json:"name" msg:"name"`
+	Attrs map[string]string `json:"attrs,omitempty" msg:"attrs"`
+}
+
+// SpanLink references a span, typically of another trace, causally related
+// to the span holding the link
+type SpanLink struct {
+	TraceID uint64 `json:"trace_id" msg:"trace_id"`
+	SpanID  uint64 `json:"span_id" msg:"span_id"`
 }
 
 // String formats a Span struct to be displayed as a string
@@ -48,6 +100,28 @@ func RandomID() uint64 {
 	return uint64(rand.Int63())
 }
 
+// NewSpan returns a span of the given trace and parent, with a random ID,
+// started at start and lasting d. Its resource is its name.
+func NewSpan(traceID, parentID uint64, service, name string, start time.Time, d time.Duration) Span {
+	return Span{
+		TraceID:  traceID,
+		SpanID:   RandomID(),
+		ParentID: parentID,
+		Service:  service,
+		Name:     name,
+		Resource: name,
+		Start:    start.UnixNano(),
+		Duration: d.Nanoseconds(),
+		Meta:     make(map[string]string),
+		Metrics:  make(map[string]float64),
+	}
+}
+
+// NewChild returns a child span of s, of the same service
+func (s *Span) NewChild(name string, start time.Time, d time.Duration) Span {
+	return NewSpan(s.TraceID, s.SpanID, s.Service, name, start, d)
+}
+
 const flushMarkerType = "_FLUSH_MARKER"
 
 // IsFlushMarker tells if this is a marker span, which signals the system to flush
@@ -60,11 +134,116 @@ func NewFlushMarker() Span {
 	return Span{Type: flushMarkerType}
 }
 
+// SpanSyntheticKey is set to "true" in the meta of the spans the agent makes
+// itself, e.g. the traces of its flushes
+const SpanSyntheticKey = "_dd.synthetic"
+
+// SetSynthetic marks s as made by the agent
+func (s *Span) SetSynthetic() {
+	if s.Meta == nil {
+		s.Meta = make(map[string]string, 1)
+	}
+	s.Meta[SpanSyntheticKey] = "true"
+}
+
+// IsSynthetic tells if s was made by the agent rather than received from a
+// client: flush markers and the spans marked with SetSynthetic
+func (s *Span) IsSynthetic() bool {
+	return s.IsFlushMarker() || s.Meta[SpanSyntheticKey] == "true"
+}
+
+// ShouldAggregate tells if s counts in the stats computed from the received
+// spans, synthetic spans never do
+func ShouldAggregate(s *Span) bool {
+	return !s.IsSynthetic()
+}
+
 // End returns the end time of the span.
 func (s *Span) End() int64 {
 	return s.Start + s.Duration
 }
 
+// SamplingPriority returns the sampling priority of the span, and false if
+// it has none.
+func (s *Span) SamplingPriority() (int, bool) {
+	p, ok := s.Metrics[SamplingPriorityKey]
+	return int(p), ok
+}
+
+// setTypedMeta copies the meta held by typed fields, such as Env, to them
+func (s *Span) setTypedMeta() {
+	s.Env = s.Meta[EnvKey]
+	s.StatusCode = 0
+	if v, ok := s.Meta[HTTPStatusCodeKey]; ok {
+		if code, err := strconv.ParseUint(v, 10, 16); err == nil {
+			s.StatusCode = uint16(code)
+		}
+	}
+}
+
+// GetEnv returns the env of the span, from its meta if it were not copied to
+// Env, or an empty string
+func (s *Span) GetEnv() string {
+	if s.Env != "" {
+		return s.Env
+	}
+	return s.Meta[EnvKey]
+}
+
+// GetStatusCode returns the HTTP status code of the span, from its meta if it
+// were not copied to StatusCode, or 0 if it has none
+func (s *Span) GetStatusCode() uint16 {
+	if s.StatusCode != 0 {
+		return s.StatusCode
+	}
+	code, _ := strconv.ParseUint(s.Meta[HTTPStatusCodeKey], 10, 16)
+	return uint16(code)
+}
+
+// GetMeta returns the meta value of key, read from the typed field of key if
+// it was set
+func (s *Span) GetMeta(key string) (string, bool) {
+	if key == EnvKey && s.Env != "" {
+		return s.Env, true
+	}
+	v, ok := s.Meta[key]
+	return v, ok
+}
+
+// TopLevel returns true if the span is the entry point into its service, as
+// marked by Trace.ComputeTopLevel
+func (s *Span) TopLevel() bool {
+	return s.IsTopLevel
+}
+
+// spanOverhead approximates the memory used by a Span apart from the content
+// of its strings, maps and slices
+const spanOverhead = 200
+
+// WeightedSize returns an approximation of the memory used by the span, in
+// bytes: the lengths of its strings and a fixed overhead for the struct and
+// every map entry or slice element. It is meant to be cheap, not exact.
+func (s *Span) WeightedSize() int {
+	size := spanOverhead + len(s.Service) + len(s.Name) + len(s.Resource) + len(s.Type)
+	for k, v := range s.Meta {
+		size += len(k) + len(v) + 32
+	}
+	for k := range s.Metrics {
+		size += len(k) + 24
+	}
+	for k, v := range s.Indexed {
+		size += len(k) + len(v) + 32
+	}
+	for _, e := range s.Events {
+		size += len(e.Name) + 48
+		for k, v := range e.Attrs {
+			size += len(k) + len(v) + 32
+		}
+	}
+	size += 16 * len(s.Links)
+	return size
+}
+
 // Weight returns the weight of the span as defined for sampling, i.e. the
 // inverse of the sampling rate.
 func (s *Span) Weight() float64 {
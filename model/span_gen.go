@@ -185,6 +185,50 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+		case "events":
+			if dc.IsNil() {
+				z.Events, err = nil, dc.ReadNil()
+				break
+			}
+
+			var zevt uint32
+			zevt, err = dc.ReadArrayHeader()
+			if err != nil {
+				return
+			}
+			if cap(z.Events) >= int(zevt) {
+				z.Events = (z.Events)[:zevt]
+			} else {
+				z.Events = make([]SpanEvent, zevt)
+			}
+			for zevi := range z.Events {
+				err = z.Events[zevi].DecodeMsg(dc)
+				if err != nil {
+					return
+				}
+			}
+		case "links":
+			if dc.IsNil() {
+				z.Links, err = nil, dc.ReadNil()
+				break
+			}
+
+			var zlnk uint32
+			zlnk, err = dc.ReadArrayHeader()
+			if err != nil {
+				return
+			}
+			if cap(z.Links) >= int(zlnk) {
+				z.Links = (z.Links)[:zlnk]
+			} else {
+				z.Links = make([]SpanLink, zlnk)
+			}
+			for zlni := range z.Links {
+				err = z.Links[zlni].DecodeMsg(dc)
+				if err != nil {
+					return
+				}
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -197,9 +241,9 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Span) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 12
+	// map header, size 14
 	// write "service"
-	err = en.Append(0x8c, 0xa7, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65)
+	err = en.Append(0x8e, 0xa7, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65)
 	if err != nil {
 		return err
 	}
@@ -326,6 +370,36 @@ func (z *Span) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	// write "events"
+	err = en.Append(0xa6, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73)
+	if err != nil {
+		return err
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Events)))
+	if err != nil {
+		return
+	}
+	for zevi := range z.Events {
+		err = z.Events[zevi].EncodeMsg(en)
+		if err != nil {
+			return
+		}
+	}
+	// write "links"
+	err = en.Append(0xa5, 0x6c, 0x69, 0x6e, 0x6b, 0x73)
+	if err != nil {
+		return err
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Links)))
+	if err != nil {
+		return
+	}
+	for zlni := range z.Links {
+		err = z.Links[zlni].EncodeMsg(en)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -345,6 +419,221 @@ func (z *Span) Msgsize() (s int) {
 			s += msgp.StringPrefixSize + len(zbai) + msgp.Float64Size
 		}
 	}
-	s += 10 + msgp.Uint64Size + 5 + msgp.StringPrefixSize + len(z.Type)
+	s += 10 + msgp.Uint64Size + 5 + msgp.StringPrefixSize + len(z.Type) + 7 + msgp.ArrayHeaderSize
+	for zevi := range z.Events {
+		s += z.Events[zevi].Msgsize()
+	}
+	s += 6 + msgp.ArrayHeaderSize + (len(z.Links) * (9 + msgp.Uint64Size + 8 + msgp.Uint64Size))
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *SpanEvent) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zsev uint32
+	zsev, err = dc.ReadMapHeader()
+	if err != nil {
+		return
+	}
+	for zsev > 0 {
+		zsev--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			return
+		}
+
+		switch msgp.UnsafeString(field) {
+		case "ts":
+			if dc.IsNil() {
+				z.Ts, err = 0, dc.ReadNil()
+				break
+			}
+
+			z.Ts, err = parseInt64(dc)
+			if err != nil {
+				return
+			}
+		case "name":
+			if dc.IsNil() {
+				z.Name, err = "", dc.ReadNil()
+				break
+			}
+
+			z.Name, err = parseString(dc)
+			if err != nil {
+				return
+			}
+		case "attrs":
+			if dc.IsNil() {
+				z.Attrs, err = nil, dc.ReadNil()
+				break
+			}
+
+			var zatr uint32
+			zatr, err = dc.ReadMapHeader()
+			if err != nil {
+				return
+			}
+			if z.Attrs == nil && zatr > 0 {
+				z.Attrs = make(map[string]string, zatr)
+			} else if len(z.Attrs) > 0 {
+				for key, _ := range z.Attrs {
+					delete(z.Attrs, key)
+				}
+			}
+			for zatr > 0 {
+				zatr--
+				var zatk string
+				var zatv string
+				zatk, err = parseString(dc)
+				if err != nil {
+					return
+				}
+				zatv, err = parseString(dc)
+				if err != nil {
+					return
+				}
+				z.Attrs[zatk] = zatv
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *SpanEvent) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 3
+	// write "ts"
+	err = en.Append(0x83, 0xa2, 0x74, 0x73)
+	if err != nil {
+		return err
+	}
+	err = en.WriteInt64(z.Ts)
+	if err != nil {
+		return
+	}
+	// write "name"
+	err = en.Append(0xa4, 0x6e, 0x61, 0x6d, 0x65)
+	if err != nil {
+		return err
+	}
+	err = en.WriteString(z.Name)
+	if err != nil {
+		return
+	}
+	// write "attrs"
+	err = en.Append(0xa5, 0x61, 0x74, 0x74, 0x72, 0x73)
+	if err != nil {
+		return err
+	}
+	err = en.WriteMapHeader(uint32(len(z.Attrs)))
+	if err != nil {
+		return
+	}
+	for zatk, zatv := range z.Attrs {
+		err = en.WriteString(zatk)
+		if err != nil {
+			return
+		}
+		err = en.WriteString(zatv)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *SpanEvent) Msgsize() (s int) {
+	s = 1 + 3 + msgp.Int64Size + 5 + msgp.StringPrefixSize + len(z.Name) + 6 + msgp.MapHeaderSize
+	if z.Attrs != nil {
+		for zatk, zatv := range z.Attrs {
+			_ = zatv
+			s += msgp.StringPrefixSize + len(zatk) + msgp.StringPrefixSize + len(zatv)
+		}
+	}
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *SpanLink) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zsln uint32
+	zsln, err = dc.ReadMapHeader()
+	if err != nil {
+		return
+	}
+	for zsln > 0 {
+		zsln--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			return
+		}
+
+		switch msgp.UnsafeString(field) {
+		case "trace_id":
+			if dc.IsNil() {
+				z.TraceID, err = 0, dc.ReadNil()
+				break
+			}
+
+			z.TraceID, err = dc.ReadUint64()
+			if err != nil {
+				return
+			}
+		case "span_id":
+			if dc.IsNil() {
+				z.SpanID, err = 0, dc.ReadNil()
+				break
+			}
+
+			z.SpanID, err = dc.ReadUint64()
+			if err != nil {
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z SpanLink) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 2
+	// write "trace_id"
+	err = en.Append(0x82, 0xa8, 0x74, 0x72, 0x61, 0x63, 0x65, 0x5f, 0x69, 0x64)
+	if err != nil {
+		return err
+	}
+	err = en.WriteUint64(z.TraceID)
+	if err != nil {
+		return
+	}
+	// write "span_id"
+	err = en.Append(0xa7, 0x73, 0x70, 0x61, 0x6e, 0x5f, 0x69, 0x64)
+	if err != nil {
+		return err
+	}
+	err = en.WriteUint64(z.SpanID)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z SpanLink) Msgsize() (s int) {
+	s = 1 + 9 + msgp.Uint64Size + 8 + msgp.Uint64Size
 	return
 }
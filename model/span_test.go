@@ -1,9 +1,14 @@
 package model
 
 import (
+	"bytes"
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 )
 
 func testSpan() Span {
@@ -39,6 +44,26 @@ func TestSpanFlushMarker(t *testing.T) {
 	assert.True(s.IsFlushMarker())
 }
 
+func TestSpanSynthetic(t *testing.T) {
+	assert := assert.New(t)
+
+	marker := NewFlushMarker()
+	assert.True(marker.IsSynthetic())
+	assert.False(ShouldAggregate(&marker))
+
+	s := NewSpan(42, 0, "trace-agent", "flush", time.Now(), time.Second)
+	assert.True(ShouldAggregate(&s))
+	s.SetSynthetic()
+	assert.Equal("true", s.Meta[SpanSyntheticKey])
+	assert.False(ShouldAggregate(&s))
+
+	// without meta
+	var empty Span
+	assert.True(ShouldAggregate(&empty))
+	empty.SetSynthetic()
+	assert.True(empty.IsSynthetic())
+}
+
 func TestSpanWeight(t *testing.T) {
 	assert := assert.New(t)
 
@@ -60,3 +85,125 @@ func TestSpanWeight(t *testing.T) {
 	span.Metrics[SpanSampleRateMetricKey] = 1.5
 	assert.Equal(1.0, span.Weight())
 }
+
+func TestSpanWeightedSize(t *testing.T) {
+	assert := assert.New(t)
+
+	thin := Span{Service: "web", Name: "request", Resource: "GET /", Type: "http"}
+	assert.Equal(spanOverhead+3+7+5+4, thin.WeightedSize())
+
+	// the size follows the content of the span
+	fat := thin
+	fat.Meta = map[string]string{"sql.query": strings.Repeat("SELECT 1;", 100)}
+	fat.Metrics = map[string]float64{"rows": 10}
+	assert.Equal(thin.WeightedSize()+9+900+32+4+24, fat.WeightedSize())
+
+	// and so is the one of the trace
+	assert.Equal(thin.WeightedSize()+fat.WeightedSize(), Trace{thin, fat}.WeightedSize())
+}
+
+func testSpanWithEvents() Span {
+	s := testSpan()
+	s.Events = []SpanEvent{
+		{Ts: s.Start + 10, Name: "cache miss", Attrs: map[string]string{"key": "raclette"}},
+		{Ts: s.Start + 20, Name: "retry"},
+	}
+	s.Links = []SpanLink{{TraceID: 1234, SpanID: 5678}}
+	return s
+}
+
+func TestSpanEventsMsgpack(t *testing.T) {
+	assert := assert.New(t)
+	s := testSpanWithEvents()
+
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, &s))
+	assert.True(buf.Len() <= s.Msgsize())
+
+	var decoded Span
+	assert.Nil(msgp.Decode(&buf, &decoded))
+	assert.Equal(s, decoded)
+}
+
+func TestSpanEventsJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	js, err := json.Marshal(testSpan())
+	assert.Nil(err)
+	assert.NotContains(string(js), "events")
+	assert.NotContains(string(js), "links")
+
+	var span Span
+	assert.Nil(json.Unmarshal([]byte(`{
+		"trace_id": 1, "span_id": 2, "name": "query",
+		"events": [{"ts": 3, "name": "retry", "attrs": {"attempt": "2"}}],
+		"links": [{"trace_id": 4, "span_id": 5}]
+	}`), &span))
+	assert.Equal([]SpanEvent{{Ts: 3, Name: "retry", Attrs: map[string]string{"attempt": "2"}}}, span.Events)
+	assert.Equal([]SpanLink{{TraceID: 4, SpanID: 5}}, span.Links)
+}
+
+func TestNewSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Unix(1448466874, 0)
+	root := NewSpan(42, 0, "trace-agent", "flush", start, time.Second)
+	assert.Equal(uint64(42), root.TraceID)
+	assert.NotEqual(uint64(0), root.SpanID)
+	assert.Equal("flush", root.Resource)
+	assert.Equal(start.UnixNano(), root.Start)
+	assert.Equal(int64(1e9), root.Duration)
+	assert.NotNil(root.Meta)
+	assert.NotNil(root.Metrics)
+
+	child := root.NewChild("send", start.Add(time.Millisecond), time.Millisecond)
+	assert.Equal(root.TraceID, child.TraceID)
+	assert.Equal(root.SpanID, child.ParentID)
+	assert.NotEqual(root.SpanID, child.SpanID)
+	assert.Equal("trace-agent", child.Service)
+	assert.Equal("send", child.Name)
+	assert.Equal(int64(1e6), child.Duration)
+	assert.Equal(root.SpanID, Trace{root, child}.GetRoot().SpanID)
+}
+
+func TestSpanTypedMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	s := testSpan()
+	s.Meta[EnvKey] = "prod"
+	s.Meta[HTTPStatusCodeKey] = "503"
+	assert.Equal("prod", s.GetEnv())
+	assert.Equal(uint16(503), s.GetStatusCode())
+
+	s.setTypedMeta()
+	assert.Equal("prod", s.Env)
+	assert.Equal(uint16(503), s.StatusCode)
+	assert.Equal("prod", s.GetEnv())
+	assert.Equal(uint16(503), s.GetStatusCode())
+	v, ok := s.GetMeta(EnvKey)
+	assert.True(ok)
+	assert.Equal("prod", v)
+	v, ok = s.GetMeta("pool")
+	assert.True(ok)
+	assert.Equal("fondue", v)
+
+	// the meta are still what is encoded
+	js, err := json.Marshal(s)
+	assert.Nil(err)
+	var decoded Span
+	assert.Nil(json.Unmarshal(js, &decoded))
+	assert.Equal("", decoded.Env)
+	assert.Equal(s.Meta, decoded.Meta)
+
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, &s))
+	decoded = Span{}
+	assert.Nil(msgp.Decode(&buf, &decoded))
+	assert.Equal(uint16(0), decoded.StatusCode)
+	assert.Equal(s.Meta, decoded.Meta)
+
+	s.Meta[HTTPStatusCodeKey] = "unknown"
+	s.setTypedMeta()
+	assert.Equal(uint16(0), s.StatusCode)
+	assert.Equal(uint16(0), s.GetStatusCode())
+}
@@ -1,7 +1,10 @@
 package model
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/DataDog/datadog-trace-agent/quantile"
 )
@@ -11,6 +14,15 @@ const (
 	HITS     string = "hits"
 	ERRORS          = "errors"
 	DURATION        = "duration"
+	// SERVICEDURATION is the measure of the duration distributions of the
+	// top-level spans of each service, see Span.TopLevel, while DURATION
+	// distributions account for all the spans of each resource
+	SERVICEDURATION = "service.duration"
+	// WAITBEFORE and WAITAFTER are the measures of the distributions of the
+	// waits of the spans with children, by service, see SpanWaits. They are
+	// derived from the traces, hence their namespace.
+	WAITBEFORE = "derived.wait_before"
+	WAITAFTER  = "derived.wait_after"
 )
 
 var (
@@ -44,10 +56,46 @@ type Distribution struct {
 // GrainKey generates the key used to aggregate counts and distributions
 // which is of the form: name|measure|aggr
 // for example: serve|duration|service:webserver
+// The values are kept raw, as the intake reads them: the TagSet of the
+// stats is what tells apart values holding the separators.
 func GrainKey(name, measure, aggr string) string {
 	return name + "|" + measure + "|" + aggr
 }
 
+// ParseGrainKey recovers the name, measure and tags from a key generated by
+// GrainKey with the aggregate of a StatsRawBucket grain. Resources can hold
+// commas, so they are delimited by the env and service tags which surround
+// them. It is only needed for the distributions encoded with their key only:
+// the stats are aggregated by struct keys, see aggregationKey.
+func ParseGrainKey(key string) (name, measure string, tags TagSet, err error) {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) != 3 {
+		return "", "", nil, fmt.Errorf("invalid grain key: %s", key)
+	}
+	name, measure, aggr := parts[0], parts[1], parts[2]
+
+	resourceIdx := strings.Index(aggr, ",resource:")
+	serviceIdx := strings.LastIndex(aggr, ",service:")
+	if !strings.HasPrefix(aggr, "env:") || resourceIdx < 0 || serviceIdx < resourceIdx {
+		return "", "", nil, fmt.Errorf("invalid grain key: %s", key)
+	}
+
+	service := aggr[serviceIdx+len(",service:"):]
+	var extra string
+	if i := strings.Index(service, ","); i >= 0 {
+		service, extra = service[:i], service[i+1:]
+	}
+	tags = TagSet{
+		{"env", aggr[len("env:"):resourceIdx]},
+		{"resource", aggr[resourceIdx+len(",resource:") : serviceIdx]},
+		{"service", service},
+	}
+	if extra != "" {
+		tags = append(tags, NewTagSetFromString(extra)...)
+	}
+	return name, measure, tags, nil
+}
+
 // NewCount returns a new Count for a metric and a given tag set
 func NewCount(m, ckey, name string, tgs TagSet) Count {
 	return Count{
@@ -92,10 +140,65 @@ func (d Distribution) Add(v float64, sampleID uint64) {
 	d.Summary.Insert(v, sampleID)
 }
 
-// Merge is used when 2 Distributions represent the same thing and it merges the 2 underlying summaries
-func (d Distribution) Merge(d2 Distribution) {
-	// We don't check tagsets for distributions as we reaggregate without reallocating new structs
+// Service returns the service this distribution accounts for
+func (d Distribution) Service() string {
+	return d.TagSet.Get("service").Value
+}
+
+// Resource returns the resource this distribution accounts for
+func (d Distribution) Resource() string {
+	return d.TagSet.Get("resource").Value
+}
+
+// Merge is used when 2 Distributions represent the same thing and it merges
+// the 2 underlying summaries. It fails if they don't have the same name,
+// measure and tags.
+func (d Distribution) Merge(d2 Distribution) error {
+	if !d.homogeneous(d2) {
+		return fmt.Errorf("trying to merge non-homogeneous distributions [%s] and [%s]", d.Key, d2.Key)
+	}
 	d.Summary.Merge(d2.Summary)
+	return nil
+}
+
+// homogeneous tells if d and d2 have the same name, measure and tags
+func (d Distribution) homogeneous(d2 Distribution) bool {
+	return d.Name == d2.Name && d.Measure == d2.Measure && d.TagSet.Key() == d2.TagSet.Key()
+}
+
+// distribution is used to avoid infinite recursion when (un)marshalling
+type distribution Distribution
+
+// MarshalJSON adds the service and resource to the encoded distribution
+func (d Distribution) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		distribution
+		Service  string `json:"service"`
+		Resource string `json:"resource"`
+	}{distribution(d), d.Service(), d.Resource()})
+}
+
+// UnmarshalJSON decodes a distribution, recovering its name, measure and
+// tags from its key if it was encoded in the legacy key-only format.
+func (d *Distribution) UnmarshalJSON(b []byte) error {
+	var dd distribution
+	if err := json.Unmarshal(b, &dd); err != nil {
+		return err
+	}
+	*d = Distribution(dd)
+
+	if len(d.TagSet) > 0 {
+		return nil
+	}
+	if d.Key == "" {
+		return errors.New("distribution has neither key nor tags")
+	}
+	name, measure, tags, err := ParseGrainKey(d.Key)
+	if err != nil {
+		return err
+	}
+	d.Name, d.Measure, d.TagSet = name, measure, tags
+	return nil
 }
 
 // Copy returns a distro with the same data but a different underlying summary
@@ -113,6 +216,19 @@ type StatsBucket struct {
 	// stats indexed by keys
 	Counts        map[string]Count        // All the true counts we keep
 	Distributions map[string]Distribution // All the true distribution we keep to answer quantile queries
+
+	// ErrorTypes counts the errors by service and error type, see ErrorTypeKey
+	ErrorTypes map[string]Count `json:",omitempty"`
+	// ErrorSummaries are the most frequent error types by service, each
+	// with a sample of its errors, see StatsRawBucket.SampleError
+	ErrorSummaries ErrorSummaries `json:"error_summaries,omitempty"`
+
+	// Partial is set on the buckets whose window was only partly seen, e.g.
+	// the one the agent started in
+	Partial bool `json:",omitempty"`
+
+	// TopResources are set with SetTopResources, nil otherwise
+	TopResources *TopResources `json:",omitempty"`
 }
 
 // NewStatsBucket opens a new bucket for time ts and initializes it properly
@@ -123,6 +239,80 @@ func NewStatsBucket(ts, d int64) StatsBucket {
 		Duration:      d,
 		Counts:        make(map[string]Count),
 		Distributions: make(map[string]Distribution),
+		ErrorTypes:    make(map[string]Count),
+	}
+}
+
+// Merge adds the counts and distributions of other, which must cover the same
+// time window, to sb. Distributions of the same key are merged, the others
+// are taken over from other, which must not be used afterwards.
+func (sb *StatsBucket) Merge(other StatsBucket) error {
+	if sb.Start != other.Start || sb.Duration != other.Duration {
+		return fmt.Errorf("trying to merge stats buckets of different windows [%d, +%d) and [%d, +%d)",
+			sb.Start, sb.Duration, other.Start, other.Duration)
+	}
+	// nothing is merged unless everything can be
+	for k, d := range other.Distributions {
+		if mine, ok := sb.Distributions[k]; ok && !mine.homogeneous(d) {
+			return fmt.Errorf("trying to merge non-homogeneous distributions [%s] and [%s]", mine.Key, d.Key)
+		}
+	}
+	for k, c := range other.Counts {
+		if mine, ok := sb.Counts[k]; ok && mine.Key != c.Key {
+			return fmt.Errorf("trying to merge non-homogeneous counts [%s] and [%s]", mine.Key, c.Key)
+		}
+	}
+
+	if sb.Counts == nil {
+		sb.Counts = make(map[string]Count, len(other.Counts))
+	}
+	mergeCounts(sb.Counts, other.Counts)
+	if sb.Distributions == nil {
+		sb.Distributions = make(map[string]Distribution, len(other.Distributions))
+	}
+	for k, d := range other.Distributions {
+		if mine, ok := sb.Distributions[k]; ok {
+			if err := mine.Merge(d); err != nil {
+				return err
+			}
+		} else {
+			sb.Distributions[k] = d
+		}
+	}
+	if len(other.ErrorTypes) > 0 {
+		if sb.ErrorTypes == nil {
+			sb.ErrorTypes = make(map[string]Count, len(other.ErrorTypes))
+		}
+		mergeCounts(sb.ErrorTypes, other.ErrorTypes)
+	}
+	if len(other.ErrorSummaries) > 0 {
+		sb.ErrorSummaries = sb.ErrorSummaries.merge(other.ErrorSummaries)
+	}
+	sb.Partial = sb.Partial || other.Partial
+	if sb.TopResources != nil || other.TopResources != nil {
+		var n int
+		var bounds bool
+		for _, top := range []*TopResources{sb.TopResources, other.TopResources} {
+			if top != nil && top.max > n {
+				n = top.max
+			}
+			if top != nil && top.bounds {
+				bounds = true
+			}
+		}
+		sb.SetTopResourcesWithBounds(n, bounds)
+	}
+	return nil
+}
+
+// mergeCounts adds the counts of src to the ones of dst with the same key
+func mergeCounts(dst, src map[string]Count) {
+	for k, c := range src {
+		if mine, ok := dst[k]; ok {
+			dst[k] = mine.Merge(c)
+		} else {
+			dst[k] = c
+		}
 	}
 }
 
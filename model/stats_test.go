@@ -2,6 +2,7 @@ package model
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -336,6 +337,24 @@ func BenchmarkHandleSpan(b *testing.B) {
 	}
 }
 
+func BenchmarkHandleSpanAggregators(b *testing.B) {
+
+	srb := NewStatsRawBucket(0, 1e9)
+	aggr := []string{"version", "region"}
+	spans := testSpans()
+	for i := range spans {
+		spans[i].Meta = map[string]string{"version": "1.2", "region": "eu"}
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, s := range spans {
+			srb.HandleSpan(s, defaultEnv, aggr, 1.0, nil)
+		}
+	}
+}
+
 func BenchmarkHandleSpanSublayers(b *testing.B) {
 
 	srb := NewStatsRawBucket(0, 1e9)
@@ -439,3 +458,107 @@ func BenchmarkStringsJoin(b *testing.B) {
 		_ = strings.Join(a, "|")
 	}
 }
+
+func TestDistributionMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for _, s := range testSpans() {
+		srb.HandleSpan(s, defaultEnv, nil, 1, nil)
+	}
+	sb := srb.Export()
+	alpha := sb.Distributions["A.foo|duration|env:default,resource:α,service:A"]
+	beta := sb.Distributions["A.foo|duration|env:default,resource:β,service:A"]
+	assert.Equal("A", alpha.Service())
+	assert.Equal("α", alpha.Resource())
+
+	n := alpha.Summary.N
+	assert.Nil(alpha.Merge(alpha.Copy()))
+	assert.Equal(2*n, alpha.Summary.N)
+
+	err := alpha.Merge(beta)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "non-homogeneous")
+	assert.Equal(2*n, alpha.Summary.N)
+}
+
+func TestStatsBucketMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	// the spans of the window are split between 2 partial buckets, only
+	// the first one sees the "rare" resource
+	all := NewStatsRawBucket(0, 1e9)
+	partial := []*StatsRawBucket{NewStatsRawBucket(0, 1e9), NewStatsRawBucket(0, 1e9)}
+	for i := 0; i < 2000; i++ {
+		s := Span{Service: "A", Name: "A.foo", Resource: "α", Duration: int64(1 + (i*7919)%1000)}
+		if i%3 == 0 {
+			s.Error = 1
+		}
+		if i%100 == 0 {
+			s.Resource = "rare"
+		}
+		all.HandleSpan(s, defaultEnv, nil, 1, nil)
+		partial[i%2].HandleSpan(s, defaultEnv, nil, 1, nil)
+	}
+	expected := all.Export()
+	sb := partial[0].Export()
+	flagged := partial[1].Export()
+	flagged.Partial = true
+	assert.Nil(sb.Merge(flagged))
+	assert.True(sb.Partial)
+
+	assert.Len(sb.Counts, len(expected.Counts))
+	for k, c := range expected.Counts {
+		assert.Equal(c.Value, sb.Counts[k].Value, k)
+	}
+	assert.Len(sb.Distributions, len(expected.Distributions))
+	for k, d := range expected.Distributions {
+		merged := sb.Distributions[k].Summary
+		assert.Equal(d.Summary.N, merged.N, k)
+		for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+			// within the rank errors of the single and the merged
+			// summaries, durations being uniform up to 1000
+			assert.InDelta(d.Summary.Quantile(q), merged.Quantile(q), 3*quantile.EPSILON*1000, "%s p%v", k, q)
+		}
+	}
+
+	// other windows are not merged
+	before := sb.Counts["A.foo|hits|env:default,resource:α,service:A"].Value
+	other := NewStatsRawBucket(1e9, 1e9)
+	other.HandleSpan(Span{Service: "A", Name: "A.foo", Resource: "α", Duration: 1}, defaultEnv, nil, 1, nil)
+	err := sb.Merge(other.Export())
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "different windows")
+	assert.Equal(before, sb.Counts["A.foo|hits|env:default,resource:α,service:A"].Value)
+}
+
+func TestDistributionJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(Span{Service: "A", Name: "A.foo", Resource: "SELECT a, b", Duration: 1, Meta: map[string]string{"version": "1.2"}},
+		defaultEnv, []string{"version"}, 1, nil)
+	d := srb.Export().Distributions["A.foo|duration|env:default,resource:SELECT a, b,service:A,version:1.2"]
+
+	b, err := json.Marshal(d)
+	assert.Nil(err)
+	var fields map[string]interface{}
+	assert.Nil(json.Unmarshal(b, &fields))
+	assert.Equal("A", fields["service"])
+	assert.Equal("SELECT a, b", fields["resource"])
+
+	var decoded Distribution
+	assert.Nil(json.Unmarshal(b, &decoded))
+	assert.Equal(d.TagSet, decoded.TagSet)
+
+	// legacy payloads only carry the key
+	legacy := []byte(`{"key":"A.foo|duration|env:default,resource:SELECT a, b,service:A,version:1.2","summary":{"Entries":[],"N":0}}`)
+	decoded = Distribution{}
+	assert.Nil(json.Unmarshal(legacy, &decoded))
+	assert.Equal("A.foo", decoded.Name)
+	assert.Equal(DURATION, decoded.Measure)
+	assert.Equal(d.TagSet, decoded.TagSet)
+	assert.Equal("SELECT a, b", decoded.Resource())
+
+	assert.NotNil(json.Unmarshal([]byte(`{"key":"not a grain"}`), &decoded))
+}
@@ -2,7 +2,9 @@ package model
 
 import (
 	"bytes"
-	"sort"
+	"encoding/gob"
+	"fmt"
+	"strconv"
 
 	"github.com/DataDog/datadog-trace-agent/quantile"
 )
@@ -23,10 +25,10 @@ type sublayerStats struct {
 	value int64
 }
 
-func newGroupedStats(tags TagSet) groupedStats {
+func newGroupedStats(tags TagSet, eps float64) groupedStats {
 	return groupedStats{
 		tags:                 tags,
-		durationDistribution: quantile.NewSliceSummary(),
+		durationDistribution: quantile.NewSliceSummaryWithEpsilon(eps),
 	}
 }
 
@@ -36,15 +38,52 @@ func newSublayerStats(tags TagSet) sublayerStats {
 	}
 }
 
-type statsKey struct {
-	name string
-	aggr string
+// OverflowResource is the resource of the distribution spans are folded in
+// once a bucket holds too many of them, see StatsRawBucket.SetMaxDistributions.
+const OverflowResource = "__other__"
+
+// aggregationKey identifies the stats of the spans with the same name and
+// grain: env, resource, service and extra aggregators. Its fields are
+// compared as is, and the grain strings, e.g.
+// env:prod,resource:GET /,service:web, are only built by Export, so that no
+// value has to be parsed back and separators in values are harmless.
+type aggregationKey struct {
+	Name     string
+	Env      string
+	Resource string // empty for the stats by service
+	Service  string
+	Extra    string // the values of the extra aggregators, see extraKey
 }
 
+// statsSubKey is the key of the stats split further than their grain: the
+// waits by measure, the error types by error type tag, and the sublayers by
+// measure and sublayer tag
 type statsSubKey struct {
-	name    string
-	measure string
-	aggr    string
+	aggregationKey
+	Measure string
+	Tag     Tag
+}
+
+// byService returns the key of the stats by service of the spans of k
+func (k aggregationKey) byService() aggregationKey {
+	k.Resource = ""
+	return k
+}
+
+// grainTags returns the tags of the stats of k: env, resource, service and
+// the extra aggregators, with room for one more
+func (k aggregationKey) grainTags(extra TagSet) TagSet {
+	tags := make(TagSet, 0, 4+len(extra))
+	tags = append(tags, Tag{"env", k.Env}, Tag{"resource", k.Resource}, Tag{"service", k.Service})
+	return append(tags, extra...)
+}
+
+// serviceTags returns the tags of the stats by service of k: env, service
+// and the extra aggregators, with room for one more
+func (k aggregationKey) serviceTags(extra TagSet) TagSet {
+	tags := make(TagSet, 0, 3+len(extra))
+	tags = append(tags, Tag{"env", k.Env}, Tag{"service", k.Service})
+	return append(tags, extra...)
 }
 
 // StatsRawBucket is used to compute span data and aggregate it
@@ -57,11 +96,23 @@ type StatsRawBucket struct {
 	duration int64 // duration of a bucket in nanoseconds
 
 	// this should really remain private as it's subject to refactoring
-	data         map[statsKey]groupedStats
+	data         map[aggregationKey]groupedStats
 	sublayerData map[statsSubKey]sublayerStats
+	serviceData  map[aggregationKey]groupedStats // only the distributions of top-level spans, by service
+	errorData    map[statsSubKey]groupedStats    // only the errors, by service and error type
+	waitData     map[statsSubKey]groupedStats    // only the distributions of the waits, by service
 
-	// internal buffer for aggregate strings - not threadsafe
-	keyBuf bytes.Buffer
+	errorSummaries errorSummaries // the samples of the error types, by service, see SampleError
+
+	// internal buffers for the extra aggregators of the keys - not threadsafe
+	keyBuf   bytes.Buffer
+	extraBuf TagSet
+
+	maxDistributions int            // 0 for no limit
+	overflowKeys     overflowKeys   // keys folded in the overflow distributions
+	overflowServices map[string]int // number of keys folded, per service
+
+	epsilons map[string]float64 // precision of the new distributions, by service, see SetEpsilons
 }
 
 // NewStatsRawBucket opens a new calculation bucket for time ts and initializes it properly
@@ -70,9 +121,66 @@ func NewStatsRawBucket(ts, d int64) *StatsRawBucket {
 	return &StatsRawBucket{
 		start:        ts,
 		duration:     d,
-		data:         make(map[statsKey]groupedStats),
+		data:         make(map[aggregationKey]groupedStats),
 		sublayerData: make(map[statsSubKey]sublayerStats),
+		serviceData:  make(map[aggregationKey]groupedStats),
+		errorData:    make(map[statsSubKey]groupedStats),
+		waitData:     make(map[statsSubKey]groupedStats),
+
+		errorSummaries: make(errorSummaries),
+	}
+}
+
+// SetMaxDistributions limits the number of distinct aggregation keys, hence
+// duration distributions, of the bucket. Once reached, spans with new keys are
+// aggregated with the OverflowResource of their service, which protects us
+// from clients setting unique ids in resources. 0 means no limit.
+func (sb *StatsRawBucket) SetMaxDistributions(n int) {
+	sb.maxDistributions = n
+}
+
+// SetEpsilons sets the precision of the distributions created from now on,
+// by service, see quantile.NewSliceSummaryWithEpsilon. The distributions of
+// the other services have the default precision. eps must not be modified
+// afterwards.
+func (sb *StatsRawBucket) SetEpsilons(eps map[string]float64) {
+	sb.epsilons = eps
+}
+
+// Start returns the timestamp the bucket starts at
+func (sb *StatsRawBucket) Start() int64 {
+	return sb.start
+}
+
+// Overflow returns the number of distinct aggregation keys which were folded
+// in the overflow distributions, per service, estimated past the first ones,
+// see overflowKeys.
+func (sb *StatsRawBucket) Overflow() map[string]int {
+	return sb.overflowServices
+}
+
+// overflow returns true if key must be folded in the overflow distribution,
+// keeping track of it if so.
+func (sb *StatsRawBucket) overflow(key aggregationKey) bool {
+	if sb.maxDistributions <= 0 || len(sb.data) < sb.maxDistributions {
+		return false
 	}
+	if _, ok := sb.data[key]; ok {
+		return false
+	}
+	if n := sb.overflowKeys.add(key.hash(), key.Service); n > 0 {
+		sb.countOverflow(key.Service, n)
+	}
+	return true
+}
+
+// countOverflow adds n to the number of keys of service folded in the
+// overflow distributions
+func (sb *StatsRawBucket) countOverflow(service string, n int) {
+	if sb.overflowServices == nil {
+		sb.overflowServices = make(map[string]int)
+	}
+	sb.overflowServices[service] += n
 }
 
 // Export transforms a StatsRawBucket into a StatsBucket, typically used
@@ -81,85 +189,151 @@ func NewStatsRawBucket(ts, d int64) *StatsRawBucket {
 func (sb *StatsRawBucket) Export() StatsBucket {
 	ret := NewStatsBucket(sb.start, sb.duration)
 	for k, v := range sb.data {
-		hitsKey := GrainKey(k.name, HITS, k.aggr)
-		ret.Counts[hitsKey] = Count{
+		aggr := grain(v.tags)
+		hitsKey := GrainKey(k.Name, HITS, aggr)
+		addCount(ret.Counts, Count{
 			Key:     hitsKey,
-			Name:    k.name,
+			Name:    k.Name,
 			Measure: HITS,
 			TagSet:  v.tags,
 			Value:   float64(v.hits),
-		}
-		errorsKey := GrainKey(k.name, ERRORS, k.aggr)
-		ret.Counts[errorsKey] = Count{
+		})
+		errorsKey := GrainKey(k.Name, ERRORS, aggr)
+		addCount(ret.Counts, Count{
 			Key:     errorsKey,
-			Name:    k.name,
+			Name:    k.Name,
 			Measure: ERRORS,
 			TagSet:  v.tags,
 			Value:   float64(v.errors),
-		}
-		durationKey := GrainKey(k.name, DURATION, k.aggr)
-		ret.Counts[durationKey] = Count{
+		})
+		durationKey := GrainKey(k.Name, DURATION, aggr)
+		// summaries are only compressed when they grow large, make sure we
+		// send them as tight as possible
+		v.durationDistribution.Compress()
+		addCount(ret.Counts, Count{
 			Key:     durationKey,
-			Name:    k.name,
+			Name:    k.Name,
 			Measure: DURATION,
 			TagSet:  v.tags,
 			Value:   float64(v.duration),
-		}
-		ret.Distributions[durationKey] = Distribution{
+		})
+		addDistribution(ret.Distributions, Distribution{
 			Key:     durationKey,
-			Name:    k.name,
+			Name:    k.Name,
 			Measure: DURATION,
 			TagSet:  v.tags,
 			Summary: v.durationDistribution,
-		}
+		})
+	}
+	for k, v := range sb.serviceData {
+		key := GrainKey(k.Name, SERVICEDURATION, grain(v.tags))
+		v.durationDistribution.Compress()
+		addDistribution(ret.Distributions, Distribution{
+			Key:     key,
+			Name:    k.Name,
+			Measure: SERVICEDURATION,
+			TagSet:  v.tags,
+			Summary: v.durationDistribution,
+		})
+	}
+	for k, v := range sb.waitData {
+		key := GrainKey(k.Name, k.Measure, grain(v.tags))
+		v.durationDistribution.Compress()
+		addDistribution(ret.Distributions, Distribution{
+			Key:     key,
+			Name:    k.Name,
+			Measure: k.Measure,
+			TagSet:  v.tags,
+			Summary: v.durationDistribution,
+		})
+	}
+	for k, v := range sb.errorData {
+		key := GrainKey(k.Name, ERRORS, grain(v.tags))
+		addCount(ret.ErrorTypes, Count{
+			Key:     key,
+			Name:    k.Name,
+			Measure: ERRORS,
+			TagSet:  v.tags,
+			Value:   v.errors,
+		})
+	}
+	if len(sb.errorSummaries) > 0 {
+		ret.ErrorSummaries = sb.errorSummaries.export()
 	}
 	for k, v := range sb.sublayerData {
-		key := GrainKey(k.name, k.measure, k.aggr)
-		ret.Counts[key] = Count{
+		key := GrainKey(k.Name, k.Measure, grain(v.tags))
+		addCount(ret.Counts, Count{
 			Key:     key,
-			Name:    k.name,
-			Measure: k.measure,
+			Name:    k.Name,
+			Measure: k.Measure,
 			TagSet:  v.tags,
 			Value:   float64(v.value),
-		}
+		})
 	}
 	return ret
 }
 
-func assembleGrain(b *bytes.Buffer, env, resource, service string, m map[string]string) (string, TagSet) {
-	b.Reset()
-
-	b.WriteString("env:")
-	b.WriteString(env)
-	b.WriteString(",resource:")
-	b.WriteString(resource)
-	b.WriteString(",service:")
-	b.WriteString(service)
-
-	tagset := TagSet{{"env", env}, {"resource", resource}, {"service", service}}
-
-	if m == nil || len(m) == 0 {
-		return b.String(), tagset
+// addCount adds c to counts, summed with the count of the same key if any:
+// the grain strings of distinct aggregation keys are the same when their
+// values hold the separators, e.g. resource "a,service:b" of service "c" and
+// resource "a" of service "b,service:c"
+func addCount(counts map[string]Count, c Count) {
+	if prev, ok := counts[c.Key]; ok {
+		c = prev.Add(c.Value)
 	}
+	counts[c.Key] = c
+}
 
-	keys := make([]string, len(m))
-	j := 0
-	for k := range m {
-		keys[j] = k
-		j++
+// addDistribution adds d to distributions, merged with the distribution of
+// the same key if any, see addCount
+func addDistribution(distributions map[string]Distribution, d Distribution) {
+	if prev, ok := distributions[d.Key]; ok {
+		// the summaries are the ones of the raw bucket, left untouched
+		merged := prev.Summary.Copy()
+		merged.Merge(d.Summary)
+		prev.Summary = merged
+		d = prev
 	}
+	distributions[d.Key] = d
+}
 
-	sort.Strings(keys) // required else aggregations would not work
-
-	for _, key := range keys {
-		b.WriteRune(',')
-		b.WriteString(key)
-		b.WriteRune(':')
-		b.WriteString(m[key])
-		tagset = append(tagset, Tag{key, m[key]})
+// grain returns the aggregate of the grain keys of the stats with tags, e.g.
+// env:prod,resource:GET /,service:web
+func grain(tags TagSet) string {
+	n := len(tags)
+	for _, t := range tags {
+		n += len(t.Name) + len(t.Value)
+	}
+	b := make([]byte, 0, n)
+	for i, t := range tags {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, t.Name...)
+		b = append(b, ':')
+		b = append(b, t.Value...)
 	}
+	return string(b)
+}
 
-	return b.String(), tagset
+// extraKey returns the Extra of the aggregation key of the spans with the
+// extra aggregators extra, each name and value prefixed by its length so
+// that they can hold anything
+func (sb *StatsRawBucket) extraKey(extra TagSet) string {
+	if len(extra) == 0 {
+		return ""
+	}
+	b := &sb.keyBuf
+	b.Reset()
+	for _, t := range extra {
+		b.WriteString(strconv.Itoa(len(t.Name)))
+		b.WriteByte(':')
+		b.WriteString(t.Name)
+		b.WriteString(strconv.Itoa(len(t.Value)))
+		b.WriteByte(':')
+		b.WriteString(t.Value)
+	}
+	return b.String()
 }
 
 // HandleSpan adds the span to this bucket stats, aggregated with the finest grain matching given aggregators
@@ -168,34 +342,69 @@ func (sb *StatsRawBucket) HandleSpan(s Span, env string, aggregators []string, w
 		panic("env should never be empty")
 	}
 
-	m := make(map[string]string)
-
-	for _, agg := range aggregators {
-		if agg != "env" && agg != "resource" && agg != "service" {
-			if v, ok := s.Meta[agg]; ok {
-				m[agg] = v
-			}
-		}
+	extra := sb.extraAggregators(s, aggregators)
+	key := aggregationKey{Name: s.Name, Env: env, Resource: s.Resource, Service: s.Service, Extra: sb.extraKey(extra)}
+	if sb.overflow(key) {
+		key.Resource = OverflowResource
 	}
+	tags := sb.add(s, weight, key, extra)
 
-	grain, tags := assembleGrain(&sb.keyBuf, env, s.Resource, s.Service, m)
-	sb.add(s, weight, grain, tags)
+	// service-level latencies only account for the entry points of services
+	if s.TopLevel() {
+		sb.addService(s, key.byService(), extra)
+	}
+	if errorType := s.Meta[ErrorTypeKey]; s.Error != 0 && errorType != "" {
+		sb.addErrorType(s, weight, errorType, key.byService(), extra)
+		sb.summarizeError(&s, errorType, weight)
+	}
 
 	// sublayers - special case
 	if sublayers != nil {
 		for _, sub := range *sublayers {
-			sb.addSublayer(s, grain, tags, sub)
+			sb.addSublayer(s, key, tags, sub)
 		}
 	}
 }
 
-func (sb *StatsRawBucket) add(s Span, weight float64, aggr string, tags TagSet) {
-	var gs groupedStats
-	var ok bool
+// HandleWaits adds the waits of the span, see ComputeWaits, to the wait
+// distributions of its service
+func (sb *StatsRawBucket) HandleWaits(s Span, env string, aggregators []string, w SpanWaits) {
+	extra := sb.extraAggregators(s, aggregators)
+	key := aggregationKey{Name: s.Name, Env: env, Service: s.Service, Extra: sb.extraKey(extra)}
+	sb.addWait(s, WAITBEFORE, key, extra, w.Before)
+	sb.addWait(s, WAITAFTER, key, extra, w.After)
+}
+
+// extraAggregators returns the values of the extra aggregators set on s,
+// sorted by name. They are only valid until the next call, the tags of the
+// stats are copies.
+func (sb *StatsRawBucket) extraAggregators(s Span, aggregators []string) TagSet {
+	extra := sb.extraBuf[:0]
+	for _, agg := range aggregators {
+		if agg == "env" || agg == "resource" || agg == "service" {
+			continue
+		}
+		v, ok := s.Meta[agg]
+		if !ok || extra.Get(agg).Name != "" {
+			continue
+		}
+		// insertion sort, there are only a few of them
+		extra = append(extra, Tag{})
+		i := len(extra) - 1
+		for ; i > 0 && extra[i-1].Name > agg; i-- {
+			extra[i] = extra[i-1]
+		}
+		extra[i] = Tag{agg, v}
+	}
+	sb.extraBuf = extra
+	return extra
+}
 
-	key := statsKey{name: s.Name, aggr: aggr}
-	if gs, ok = sb.data[key]; !ok {
-		gs = newGroupedStats(tags)
+// add adds s to the stats of key, and returns their tags
+func (sb *StatsRawBucket) add(s Span, weight float64, key aggregationKey, extra TagSet) TagSet {
+	gs, ok := sb.data[key]
+	if !ok {
+		gs = newGroupedStats(key.grainTags(extra), sb.epsilons[s.Service])
 	}
 
 	gs.hits += weight
@@ -207,33 +416,165 @@ func (sb *StatsRawBucket) add(s Span, weight float64, aggr string, tags TagSet)
 	// TODO add for s.Metrics ability to define arbitrary counts and distros, check some config?
 	// alter resolution of duration distro
 	trundur := nsTimestampToFloat(s.Duration)
-	gs.durationDistribution.Insert(trundur, s.SpanID)
+	gs.durationDistribution.InsertWithTime(trundur, s.SpanID, s.End())
 
 	sb.data[key] = gs
+	return gs.tags
+}
+
+func (sb *StatsRawBucket) addService(s Span, key aggregationKey, extra TagSet) {
+	gs, ok := sb.serviceData[key]
+	if !ok {
+		gs = newGroupedStats(key.serviceTags(extra), sb.epsilons[s.Service])
+	}
+	gs.durationDistribution.InsertWithTime(nsTimestampToFloat(s.Duration), s.SpanID, s.End())
+	sb.serviceData[key] = gs
+}
+
+func (sb *StatsRawBucket) addWait(s Span, measure string, key aggregationKey, extra TagSet, wait int64) {
+	subKey := statsSubKey{aggregationKey: key, Measure: measure}
+	gs, ok := sb.waitData[subKey]
+	if !ok {
+		gs = newGroupedStats(key.serviceTags(extra), sb.epsilons[s.Service])
+	}
+	gs.durationDistribution.InsertWithTime(nsTimestampToFloat(wait), s.SpanID, s.End())
+	sb.waitData[subKey] = gs
+}
+
+// addErrorType counts the error of s by service and error type
+func (sb *StatsRawBucket) addErrorType(s Span, weight float64, errorType string, key aggregationKey, extra TagSet) {
+	subKey := statsSubKey{aggregationKey: key, Tag: Tag{ErrorTypeKey, errorType}}
+	gs, ok := sb.errorData[subKey]
+	if !ok {
+		gs = groupedStats{tags: append(key.serviceTags(extra), subKey.Tag)}
+	}
+	gs.errors += weight
+	sb.errorData[subKey] = gs
 }
 
-func (sb *StatsRawBucket) addSublayer(s Span, aggr string, tags TagSet, sub SublayerValue) {
+func (sb *StatsRawBucket) addSublayer(s Span, key aggregationKey, tags TagSet, sub SublayerValue) {
 	// This is not as efficient as a "regular" add as we don't update
 	// all sublayers at once (one call for HITS, and another one for ERRORS, DURATION...)
 	// when logically, if we have a sublayer for HITS, we also have one for DURATION,
 	// they should indeed come together. Still room for improvement here.
 
-	var ss sublayerStats
-	var ok bool
-
-	subAggr := aggr + "," + sub.Tag.Name + ":" + sub.Tag.Value
-	subTags := make(TagSet, len(tags)+1)
-	copy(subTags, tags)
-	subTags[len(tags)] = sub.Tag
-
-	key := statsSubKey{name: s.Name, measure: sub.Metric, aggr: subAggr}
-	if ss, ok = sb.sublayerData[key]; !ok {
+	subKey := statsSubKey{aggregationKey: key, Measure: sub.Metric, Tag: sub.Tag}
+	ss, ok := sb.sublayerData[subKey]
+	if !ok {
+		subTags := make(TagSet, len(tags)+1)
+		copy(subTags, tags)
+		subTags[len(tags)] = sub.Tag
 		ss = newSublayerStats(subTags)
 	}
 
 	ss.value += int64(sub.Value)
 
-	sb.sublayerData[key] = ss
+	sb.sublayerData[subKey] = ss
+}
+
+// Merge adds the stats of o, a bucket with the same start and duration, to
+// sb, e.g. when partial buckets are built for the same interval. Hits, errors
+// and durations are summed and distributions merged, keys new to sb are
+// folded in the overflow distributions past its limit. o must not be used
+// afterwards.
+func (sb *StatsRawBucket) Merge(o *StatsRawBucket) error {
+	if o.start != sb.start || o.duration != sb.duration {
+		return fmt.Errorf("cannot merge stats bucket [%d, +%d] into [%d, +%d]", o.start, o.duration, sb.start, sb.duration)
+	}
+	// nothing is merged unless everything can be, as in StatsBucket.Merge:
+	// restored from a saved state, the stats of a key hold the tags saved
+	for k, v := range o.data {
+		if err := checkHomogeneous(sb.data[k], v); err != nil {
+			return err
+		}
+	}
+	for k, v := range o.serviceData {
+		if err := checkHomogeneous(sb.serviceData[k], v); err != nil {
+			return err
+		}
+	}
+	for k, v := range o.waitData {
+		if err := checkHomogeneous(sb.waitData[k], v); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range o.data {
+		if sb.overflow(k) {
+			// the tags hold env, resource and service, then the aggregators
+			k.Resource = OverflowResource
+			v.tags = k.grainTags(v.tags[3:])
+		}
+		gs, ok := sb.data[k]
+		if !ok {
+			sb.data[k] = v
+			continue
+		}
+		gs.hits += v.hits
+		gs.errors += v.errors
+		gs.duration += v.duration
+		gs.durationDistribution.Merge(v.durationDistribution)
+		sb.data[k] = gs
+	}
+	for k, v := range o.serviceData {
+		if gs, ok := sb.serviceData[k]; ok {
+			gs.durationDistribution.Merge(v.durationDistribution)
+		} else {
+			sb.serviceData[k] = v
+		}
+	}
+	for k, v := range o.waitData {
+		if gs, ok := sb.waitData[k]; ok {
+			gs.durationDistribution.Merge(v.durationDistribution)
+		} else {
+			sb.waitData[k] = v
+		}
+	}
+	for k, v := range o.errorData {
+		if gs, ok := sb.errorData[k]; ok {
+			v.errors += gs.errors
+		}
+		sb.errorData[k] = v
+	}
+	for service, types := range o.errorSummaries {
+		for t, v := range types {
+			e := sb.errorSummaries.get(service, t)
+			if e == nil {
+				break
+			}
+			e.Count += v.Count
+			if e.TraceID == 0 {
+				e.Message, e.TraceID = v.Message, v.TraceID
+			}
+		}
+	}
+	for k, v := range o.sublayerData {
+		if ss, ok := sb.sublayerData[k]; ok {
+			v.value += ss.value
+		}
+		sb.sublayerData[k] = v
+	}
+	for service, n := range sb.overflowKeys.merge(&o.overflowKeys, o.overflowServices) {
+		sb.countOverflow(service, n)
+	}
+	return nil
+}
+
+// checkHomogeneous returns an error if gs, when set, and other do not have
+// the same tags, their distributions then not being ones of the same
+// aggregation
+func checkHomogeneous(gs, other groupedStats) error {
+	if gs.tags == nil {
+		return nil
+	}
+	same := len(gs.tags) == len(other.tags)
+	for i := 0; same && i < len(gs.tags); i++ {
+		same = gs.tags[i] == other.tags[i]
+	}
+	if !same {
+		return fmt.Errorf("trying to merge non-homogeneous stats [%s] and [%s]", grain(gs.tags), grain(other.tags))
+	}
+	return nil
 }
 
 // 10 bits precision (any value will be +/- 1/1024)
@@ -248,3 +589,211 @@ func nsTimestampToFloat(ns int64) float64 {
 	}
 	return float64(ns << shift)
 }
+
+// statsRawBucketState is the gob encoded form of a StatsRawBucket
+type statsRawBucketState struct {
+	Start            int64
+	Duration         int64
+	Data             []groupedStatsState
+	Sublayers        []sublayerStatsState
+	Services         []groupedStatsState // only the distributions are set
+	ErrorTypes       []groupedStatsState // only the errors are set
+	Waits            []groupedStatsState // only the measures and distributions are set
+	MaxDistributions int
+	OverflowHashes   map[uint64]string // the keys folded in the overflow distributions, see overflowKeys
+	OverflowSketch   []uint64
+	OverflowServices map[string]int
+	ErrorSummaries   []errorSummaryState
+}
+
+type errorSummaryState struct {
+	Service string
+	Summary ErrorSummary
+}
+
+type groupedStatsState struct {
+	Key          aggregationKey
+	Measure      string // only for the waits
+	Tag          Tag    // only for the error types
+	Tags         TagSet
+	Hits         float64
+	Errors       float64
+	Duration     float64
+	Distribution *quantile.SliceSummary
+}
+
+type sublayerStatsState struct {
+	Key     aggregationKey
+	Measure string
+	Tag     Tag
+	Tags    TagSet
+	Value   int64
+}
+
+// subKey returns the in-memory key of the stats of a state
+func subKey(k aggregationKey, measure string, tag Tag) statsSubKey {
+	return statsSubKey{aggregationKey: k, Measure: measure, Tag: tag}
+}
+
+// GobEncode is used to persist open buckets across restarts, it flattens
+// the aggregation maps
+func (sb *StatsRawBucket) GobEncode() ([]byte, error) {
+	state := statsRawBucketState{
+		Start:            sb.start,
+		Duration:         sb.duration,
+		Data:             make([]groupedStatsState, 0, len(sb.data)),
+		Sublayers:        make([]sublayerStatsState, 0, len(sb.sublayerData)),
+		MaxDistributions: sb.maxDistributions,
+		OverflowHashes:   sb.overflowKeys.hashes,
+		OverflowSketch:   sb.overflowKeys.sketch,
+		OverflowServices: sb.overflowServices,
+	}
+	for k, v := range sb.data {
+		state.Data = append(state.Data, groupedStatsState{
+			Key:          k,
+			Tags:         v.tags,
+			Hits:         v.hits,
+			Errors:       v.errors,
+			Duration:     v.duration,
+			Distribution: v.durationDistribution,
+		})
+	}
+	for k, v := range sb.serviceData {
+		state.Services = append(state.Services, groupedStatsState{
+			Key:          k,
+			Tags:         v.tags,
+			Distribution: v.durationDistribution,
+		})
+	}
+	for k, v := range sb.waitData {
+		state.Waits = append(state.Waits, groupedStatsState{
+			Key:          k.aggregationKey,
+			Measure:      k.Measure,
+			Tags:         v.tags,
+			Distribution: v.durationDistribution,
+		})
+	}
+	for k, v := range sb.errorData {
+		state.ErrorTypes = append(state.ErrorTypes, groupedStatsState{
+			Key:    k.aggregationKey,
+			Tag:    k.Tag,
+			Tags:   v.tags,
+			Errors: v.errors,
+		})
+	}
+	for k, v := range sb.sublayerData {
+		state.Sublayers = append(state.Sublayers, sublayerStatsState{
+			Key:     k.aggregationKey,
+			Measure: k.Measure,
+			Tag:     k.Tag,
+			Tags:    v.tags,
+			Value:   v.value,
+		})
+	}
+	for service, types := range sb.errorSummaries {
+		for _, e := range types {
+			state.ErrorSummaries = append(state.ErrorSummaries, errorSummaryState{Service: service, Summary: *e})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(state)
+	return buf.Bytes(), err
+}
+
+// GobDecode rebuilds a bucket encoded by GobEncode
+func (sb *StatsRawBucket) GobDecode(data []byte) error {
+	var state statsRawBucketState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	if state.Duration <= 0 {
+		return fmt.Errorf("invalid stats bucket: duration %d", state.Duration)
+	}
+
+	if err := state.validateKeys(); err != nil {
+		return err
+	}
+	if state.OverflowSketch != nil && len(state.OverflowSketch) != overflowSketchBits/64 {
+		return fmt.Errorf("invalid stats bucket: overflow sketch of %d words", len(state.OverflowSketch))
+	}
+
+	*sb = *NewStatsRawBucket(state.Start, state.Duration)
+	sb.maxDistributions = state.MaxDistributions
+	for _, v := range state.Data {
+		d := v.Distribution
+		if d == nil {
+			d = quantile.NewSliceSummary()
+		}
+		sb.data[v.Key] = groupedStats{
+			tags:                 v.Tags,
+			hits:                 v.Hits,
+			errors:               v.Errors,
+			duration:             v.Duration,
+			durationDistribution: d,
+		}
+	}
+	for _, v := range state.Services {
+		d := v.Distribution
+		if d == nil {
+			d = quantile.NewSliceSummary()
+		}
+		sb.serviceData[v.Key] = groupedStats{
+			tags:                 v.Tags,
+			durationDistribution: d,
+		}
+	}
+	for _, v := range state.Waits {
+		d := v.Distribution
+		if d == nil {
+			d = quantile.NewSliceSummary()
+		}
+		sb.waitData[subKey(v.Key, v.Measure, Tag{})] = groupedStats{
+			tags:                 v.Tags,
+			durationDistribution: d,
+		}
+	}
+	for _, v := range state.ErrorTypes {
+		sb.errorData[subKey(v.Key, "", v.Tag)] = groupedStats{
+			tags:   v.Tags,
+			errors: v.Errors,
+		}
+	}
+	for _, v := range state.Sublayers {
+		sb.sublayerData[subKey(v.Key, v.Measure, v.Tag)] = sublayerStats{
+			tags:  v.Tags,
+			value: v.Value,
+		}
+	}
+	sb.overflowKeys = restoreOverflowKeys(state.OverflowHashes, state.OverflowSketch)
+	sb.overflowServices = state.OverflowServices
+	for _, v := range state.ErrorSummaries {
+		types, ok := sb.errorSummaries[v.Service]
+		if !ok {
+			types = make(map[string]*ErrorSummary)
+			sb.errorSummaries[v.Service] = types
+		}
+		e := v.Summary
+		types[e.Type] = &e
+	}
+	return nil
+}
+
+// validateKeys returns an error if an aggregation key of the state has no
+// env, as HandleSpan never builds, e.g. when saved by an agent which keyed
+// the stats by their grain strings
+func (state *statsRawBucketState) validateKeys() error {
+	for _, list := range [][]groupedStatsState{state.Data, state.Services, state.Waits, state.ErrorTypes} {
+		for _, v := range list {
+			if v.Key.Env == "" {
+				return fmt.Errorf("invalid stats bucket: no env for %s", v.Key.Name)
+			}
+		}
+	}
+	for _, v := range state.Sublayers {
+		if v.Key.Env == "" {
+			return fmt.Errorf("invalid stats bucket: no env for %s", v.Key.Name)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,16 @@
 package model
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
 	"testing"
 
+	"github.com/DataDog/datadog-trace-agent/quantile"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,9 +19,11 @@ func TestGrain(t *testing.T) {
 	assert := assert.New(t)
 
 	s := Span{Service: "thing", Name: "other", Resource: "yo"}
-	aggr, tgs := assembleGrain(&srb.keyBuf, "default", s.Resource, s.Service, nil)
+	srb.HandleSpan(s, "default", nil, 1, nil)
+	key := aggregationKey{Name: "other", Env: "default", Resource: "yo", Service: "thing"}
+	tgs := srb.data[key].tags
 
-	assert.Equal("env:default,resource:yo,service:thing", aggr)
+	assert.Equal("env:default,resource:yo,service:thing", grain(tgs))
 	assert.Equal(TagSet{Tag{"env", "default"}, Tag{"resource", "yo"}, Tag{"service", "thing"}}, tgs)
 }
 
@@ -22,8 +32,454 @@ func TestGrainWithExtraTags(t *testing.T) {
 	assert := assert.New(t)
 
 	s := Span{Service: "thing", Name: "other", Resource: "yo", Meta: map[string]string{"meta2": "two", "meta1": "ONE"}}
-	aggr, tgs := assembleGrain(&srb.keyBuf, "default", s.Resource, s.Service, s.Meta)
+	srb.HandleSpan(s, "default", []string{"meta2", "meta1"}, 1, nil)
+	key := aggregationKey{Name: "other", Env: "default", Resource: "yo", Service: "thing", Extra: "5:meta13:ONE5:meta23:two"}
+	tgs := srb.data[key].tags
 
-	assert.Equal("env:default,resource:yo,service:thing,meta1:ONE,meta2:two", aggr)
+	assert.Equal("env:default,resource:yo,service:thing,meta1:ONE,meta2:two", grain(tgs))
 	assert.Equal(TagSet{Tag{"env", "default"}, Tag{"resource", "yo"}, Tag{"service", "thing"}, Tag{"meta1", "ONE"}, Tag{"meta2", "two"}}, tgs)
 }
+
+func TestStatsRawBucketMaxDistributions(t *testing.T) {
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetMaxDistributions(5000)
+	assert := assert.New(t)
+
+	for i := 0; i < 10000; i++ {
+		s := Span{Service: "uuid-service", Name: "request", Resource: fmt.Sprintf("GET /users/%d", i), Duration: 100}
+		srb.HandleSpan(s, "default", nil, 1, nil)
+	}
+	// known keys are still aggregated in their own distribution
+	srb.HandleSpan(Span{Service: "uuid-service", Name: "request", Resource: "GET /users/0", Duration: 100}, "default", nil, 1, nil)
+
+	// the limit, and the overflow distribution of the service
+	assert.Len(srb.data, 5001)
+	assert.Equal(map[string]int{"uuid-service": 5000}, srb.Overflow())
+
+	sb := srb.Export()
+	assert.Len(sb.Distributions, 5001)
+	assert.Equal(float64(2), sb.Counts["request|hits|env:default,resource:GET /users/0,service:uuid-service"].Value)
+	overflow := sb.Distributions["request|duration|env:default,resource:__other__,service:uuid-service"]
+	assert.Equal(5000, overflow.Summary.N)
+}
+
+func TestStatsRawBucketGob(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(1e10, 1e9)
+	srb.SetMaxDistributions(2)
+	sublayers := []SublayerValue{{Metric: "_sublayers.span_count", Tag: Tag{"sublayer_service", "db"}, Value: 3}}
+	for i := 0; i < 4; i++ {
+		s := Span{Service: "web", Name: "request", Resource: fmt.Sprintf("GET /%d", i), Duration: int64(100 * (i + 1)), Error: int32(i % 2)}
+		srb.HandleSpan(s, "default", nil, 1, &sublayers)
+	}
+
+	data, err := srb.GobEncode()
+	assert.Nil(err)
+	var decoded StatsRawBucket
+	assert.Nil(decoded.GobDecode(data))
+
+	assert.Equal(srb.Start(), decoded.Start())
+	assert.Equal(srb.Overflow(), decoded.Overflow())
+	assert.Equal(srb.Export(), decoded.Export())
+
+	// the distribution limit and the overflow keys survive
+	s := Span{Service: "web", Name: "request", Resource: "GET /new", Duration: 100}
+	srb.HandleSpan(s, "default", nil, 1, nil)
+	decoded.HandleSpan(s, "default", nil, 1, nil)
+	assert.Equal(srb.Export(), decoded.Export())
+
+	assert.NotNil(decoded.GobDecode([]byte("not a gob")))
+}
+
+func TestStatsRawBucketTopLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 400},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 300},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "db", Name: "postgres.query", Resource: "SELECT", Duration: 200},
+		Span{TraceID: 1, SpanID: 4, ParentID: 3, Service: "db", Name: "postgres.query", Resource: "SELECT", Duration: 100},
+	}
+	trace.ComputeTopLevel()
+
+	srb := NewStatsRawBucket(0, 1e9)
+	sublayers := []SublayerValue{{Metric: "_sublayers.span_count", Tag: Tag{"sublayer_service", "db"}, Value: 2}}
+	for i, s := range trace {
+		if i == 0 {
+			srb.HandleSpan(s, "default", nil, 1, &sublayers)
+		} else {
+			srb.HandleSpan(s, "default", nil, 1, nil)
+		}
+	}
+	sb := srb.Export()
+
+	// the sublayers of the root are aggregated by its resource
+	assert.Equal(float64(2), sb.Counts["http.request|_sublayers.span_count|env:default,resource:GET /,service:web,sublayer_service:db"].Value)
+
+	// operation stats account for all the spans
+	assert.Equal(float64(2), sb.Counts["http.request|hits|env:default,resource:GET /,service:web"].Value)
+	assert.Equal(2, sb.Distributions["http.request|duration|env:default,resource:GET /,service:web"].Summary.N)
+	assert.Equal(2, sb.Distributions["postgres.query|duration|env:default,resource:SELECT,service:db"].Summary.N)
+
+	// service latencies only account for the entry points of services
+	assert.Len(sb.Distributions, 4)
+	web := sb.Distributions["http.request|service.duration|env:default,service:web"]
+	assert.Equal(SERVICEDURATION, web.Measure)
+	assert.Equal(TagSet{{"env", "default"}, {"service", "web"}}, web.TagSet)
+	if assert.Equal(1, web.Summary.N) {
+		assert.Equal(float64(400), web.Summary.Quantile(1))
+	}
+	db := sb.Distributions["postgres.query|service.duration|env:default,service:db"]
+	if assert.Equal(1, db.Summary.N) {
+		assert.Equal(float64(200), db.Summary.Quantile(1))
+	}
+
+	// they are persisted along with the other stats
+	data, err := srb.GobEncode()
+	assert.Nil(err)
+	var decoded StatsRawBucket
+	assert.Nil(decoded.GobDecode(data))
+	assert.Equal(sb, decoded.Export())
+}
+
+func TestStatsRawBucketExportCompressed(t *testing.T) {
+	assert := assert.New(t)
+
+	// summaries compress every 50 insertions, leave them mid-cycle
+	srb := NewStatsRawBucket(0, 1e9)
+	var durations []float64
+	for i := 0; i < 5049; i++ {
+		d := int64((i * 7919) % 10007)
+		srb.HandleSpan(Span{SpanID: uint64(i), Service: "web", Name: "request", Resource: "GET /", Duration: d}, "default", nil, 1, nil)
+		durations = append(durations, float64(d))
+	}
+	key := aggregationKey{Name: "request", Env: "default", Resource: "GET /", Service: "web"}
+	raw := srb.data[key].durationDistribution.Copy()
+
+	exported := srb.Export().Distributions["request|duration|env:default,resource:GET /,service:web"].Summary
+	rawJSON, _ := json.Marshal(raw)
+	exportedJSON, _ := json.Marshal(exported)
+	assert.True(len(exportedJSON) < len(rawJSON), "%d bytes exported, %d raw", len(exportedJSON), len(rawJSON))
+
+	// the quantiles keep their precision
+	sort.Float64s(durations)
+	for _, q := range []float64{0, 0.25, 0.5, 0.75, 0.9, 0.99, 1} {
+		v := exported.Quantile(q)
+		lo := sort.SearchFloat64s(durations, v)
+		hi := sort.Search(len(durations), func(i int) bool { return durations[i] > v })
+		rank := q * float64(len(durations)-1)
+		bound := math.Ceil(quantile.EPSILON*float64(len(durations))) + 1
+		assert.True(rank >= float64(lo)-bound && rank <= float64(hi)+bound, "q%v: %v", q, v)
+	}
+}
+
+func TestStatsRawBucketEpsilons(t *testing.T) {
+	assert := assert.New(t)
+
+	web := Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 100}
+	db := Span{SpanID: 2, ParentID: 1, Service: "db", Name: "query", Resource: "SELECT", Duration: 50}
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(web, "default", nil, 1, nil)
+	srb.SetEpsilons(map[string]float64{"db": 0.005, "web": 0.02})
+	srb.HandleSpan(web, "default", nil, 1, nil)
+	srb.HandleSpan(db, "default", nil, 1, nil)
+	sb := srb.Export()
+
+	// only the new distributions get the precision
+	assert.Equal(quantile.EPSILON, sb.Distributions["http.request|duration|env:default,resource:GET /,service:web"].Summary.Precision())
+	assert.Equal(0.005, sb.Distributions["query|duration|env:default,resource:SELECT,service:db"].Summary.Precision())
+
+	data, err := srb.GobEncode()
+	assert.Nil(err)
+	var decoded StatsRawBucket
+	assert.Nil(decoded.GobDecode(data))
+	assert.Equal(sb, decoded.Export())
+
+	// the precision of merged distributions is the coarser one
+	o := NewStatsRawBucket(0, 1e9)
+	o.SetEpsilons(map[string]float64{"db": 0.02})
+	o.HandleSpan(db, "default", nil, 1, nil)
+	assert.Nil(srb.Merge(o))
+	assert.Equal(0.02, srb.Export().Distributions["query|duration|env:default,resource:SELECT,service:db"].Summary.Precision())
+}
+
+func TestStatsRawBucketWaits(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	s := Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 1000}
+	srb.HandleWaits(s, "default", nil, SpanWaits{Before: 100, After: 300})
+	srb.HandleWaits(s, "default", nil, SpanWaits{Before: 200, After: 0})
+	sb := srb.Export()
+
+	assert.Len(sb.Distributions, 2)
+	before := sb.Distributions["http.request|derived.wait_before|env:default,service:web"]
+	assert.Equal(WAITBEFORE, before.Measure)
+	assert.Equal(TagSet{{"env", "default"}, {"service", "web"}}, before.TagSet)
+	if assert.Equal(2, before.Summary.N) {
+		assert.Equal(float64(100), before.Summary.Quantile(0))
+		assert.Equal(float64(200), before.Summary.Quantile(1))
+	}
+	after := sb.Distributions["http.request|derived.wait_after|env:default,service:web"]
+	assert.Equal(WAITAFTER, after.Measure)
+	if assert.Equal(2, after.Summary.N) {
+		assert.Equal(float64(0), after.Summary.Quantile(0))
+		assert.Equal(float64(300), after.Summary.Quantile(1))
+	}
+
+	// they are merged and persisted along with the other stats
+	o := NewStatsRawBucket(0, 1e9)
+	o.HandleWaits(s, "default", nil, SpanWaits{Before: 300, After: 400})
+	assert.Nil(srb.Merge(o))
+	assert.Equal(3, srb.Export().Distributions["http.request|derived.wait_after|env:default,service:web"].Summary.N)
+
+	data, err := srb.GobEncode()
+	assert.Nil(err)
+	var decoded StatsRawBucket
+	assert.Nil(decoded.GobDecode(data))
+	assert.Equal(srb.Export(), decoded.Export())
+}
+
+func TestStatsRawBucketMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	whole := NewStatsRawBucket(1e10, 1e9)
+	parts := [2]*StatsRawBucket{NewStatsRawBucket(1e10, 1e9), NewStatsRawBucket(1e10, 1e9)}
+	sublayers := []SublayerValue{{Metric: "_sublayers.span_count", Tag: Tag{"sublayer_service", "db"}, Value: 2}}
+
+	// 300 spans over 3 resources, the late ones, odd, go to the second part
+	var hits, errors, duration [3]float64
+	for i := 0; i < 300; i++ {
+		r, weight := i%3, float64(1+i%2)
+		s := Span{SpanID: uint64(i), Service: "web", Name: "request", Resource: fmt.Sprintf("GET /%d", r),
+			Meta: map[string]string{"version": "v1"}, Duration: int64(1000 * (i + 1)), Error: int32(i % 5 / 4)}
+		s.Metrics = map[string]float64{"_top_level": 1}
+		s.IsTopLevel = true
+		whole.HandleSpan(s, "default", []string{"version"}, weight, &sublayers)
+		parts[i%2].HandleSpan(s, "default", []string{"version"}, weight, &sublayers)
+		hits[r] += weight
+		errors[r] += weight * float64(s.Error)
+		duration[r] += weight * float64(s.Duration)
+	}
+	assert.Nil(parts[0].Merge(parts[1]))
+
+	merged, expected := parts[0].Export(), whole.Export()
+	for r := 0; r < 3; r++ {
+		aggr := fmt.Sprintf("env:default,resource:GET /%d,service:web,version:v1", r)
+		assert.Equal(hits[r], merged.Counts["request|hits|"+aggr].Value)
+		assert.Equal(errors[r], merged.Counts["request|errors|"+aggr].Value)
+		assert.Equal(duration[r], merged.Counts["request|duration|"+aggr].Value)
+		assert.Equal(float64(200), merged.Counts["request|_sublayers.span_count|"+aggr+",sublayer_service:db"].Value)
+	}
+	assert.Equal(expected.Counts, merged.Counts)
+	assert.Equal(expected.Start, merged.Start)
+	assert.Equal(expected.Duration, merged.Duration)
+	assert.Len(merged.Distributions, len(expected.Distributions))
+	for k, d := range expected.Distributions {
+		assert.Equal(d.TagSet, merged.Distributions[k].TagSet, k)
+		assert.Equal(d.Summary.N, merged.Distributions[k].Summary.N, k)
+		assert.Equal(d.Summary.Quantile(0), merged.Distributions[k].Summary.Quantile(0), k)
+		assert.Equal(d.Summary.Quantile(1), merged.Distributions[k].Summary.Quantile(1), k)
+		assert.Equal(d.Summary.FirstTs, merged.Distributions[k].Summary.FirstTs, k)
+		assert.Equal(d.Summary.LastTs, merged.Distributions[k].Summary.LastTs, k)
+	}
+	// the spans end at their duration
+	d := merged.Distributions["request|duration|env:default,resource:GET /0,service:web,version:v1"]
+	assert.Equal(int64(1000), d.Summary.FirstTs)
+	assert.Equal(int64(298000), d.Summary.LastTs)
+
+	assert.NotNil(parts[0].Merge(NewStatsRawBucket(2e10, 1e9)))
+
+	// stats of the same key with other tags, e.g. from a saved state, are
+	// not merged, nor is anything else
+	o := NewStatsRawBucket(1e10, 1e9)
+	for _, r := range []string{"GET /0", "GET /new"} {
+		s := Span{Service: "web", Name: "request", Resource: r, Duration: 1, Meta: map[string]string{"version": "v1"}}
+		o.HandleSpan(s, "default", []string{"version"}, 1, nil)
+	}
+	for k, v := range o.data {
+		v.tags = append(TagSet{}, v.tags...)
+		v.tags[len(v.tags)-1].Value = "v2"
+		o.data[k] = v
+	}
+	if assert.NotNil(parts[0].Merge(o)) {
+		assert.Equal(merged, parts[0].Export())
+	}
+}
+
+func TestStatsRawBucketMergeMaxDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	sb := NewStatsRawBucket(0, 1e9)
+	sb.SetMaxDistributions(2)
+	o := NewStatsRawBucket(0, 1e9)
+	for i := 0; i < 4; i++ {
+		s := Span{Service: "web", Name: "request", Resource: fmt.Sprintf("GET /%d", i), Duration: 100}
+		if i < 2 {
+			sb.HandleSpan(s, "default", nil, 1, nil)
+		}
+		o.HandleSpan(s, "default", nil, 1, nil)
+	}
+	assert.Nil(sb.Merge(o))
+
+	// the keys new to sb are folded in the overflow distribution
+	exported := sb.Export()
+	assert.Len(exported.Distributions, 3)
+	assert.Equal(float64(2), exported.Counts["request|hits|env:default,resource:GET /0,service:web"].Value)
+	assert.Equal(float64(2), exported.Counts["request|hits|env:default,resource:__other__,service:web"].Value)
+	assert.Equal(float64(200), exported.Counts["request|duration|env:default,resource:__other__,service:web"].Value)
+	assert.Equal(map[string]int{"web": 2}, sb.Overflow())
+}
+
+func TestStatsRawBucketErrorTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for i, s := range []Span{
+		{Service: "web", Name: "request", Resource: "GET /", Error: 1, Meta: map[string]string{ErrorTypeKey: "Timeout"}},
+		{Service: "web", Name: "request", Resource: "POST /", Error: 1, Meta: map[string]string{ErrorTypeKey: "Timeout"}},
+		{Service: "web", Name: "request", Resource: "GET /", Error: 1, Meta: map[string]string{ErrorTypeKey: "IOError"}},
+		{Service: "db", Name: "query", Resource: "SELECT", Error: 1, Meta: map[string]string{ErrorTypeKey: "Timeout"}},
+		// errors without a type and spans without error are not counted
+		{Service: "web", Name: "request", Resource: "GET /", Error: 1},
+		{Service: "web", Name: "request", Resource: "GET /", Meta: map[string]string{ErrorTypeKey: "Timeout"}},
+	} {
+		srb.HandleSpan(s, "default", nil, float64(1+i%2), nil)
+	}
+
+	sb := srb.Export()
+	assert.Len(sb.ErrorTypes, 3)
+	timeouts := sb.ErrorTypes["request|errors|env:default,service:web,error.type:Timeout"]
+	assert.Equal(float64(3), timeouts.Value)
+	assert.Equal(ERRORS, timeouts.Measure)
+	assert.Equal(TagSet{{"env", "default"}, {"service", "web"}, {ErrorTypeKey, "Timeout"}}, timeouts.TagSet)
+	assert.Equal(float64(1), sb.ErrorTypes["request|errors|env:default,service:web,error.type:IOError"].Value)
+	assert.Equal(float64(2), sb.ErrorTypes["query|errors|env:default,service:db,error.type:Timeout"].Value)
+	// the other stats are unchanged
+	assert.Equal(float64(3), sb.Counts["request|errors|env:default,resource:GET /,service:web"].Value)
+
+	// they are persisted and merged along with the other stats
+	data, err := srb.GobEncode()
+	assert.Nil(err)
+	var decoded StatsRawBucket
+	assert.Nil(decoded.GobDecode(data))
+	assert.Equal(sb, decoded.Export())
+	assert.Nil(decoded.Merge(srb))
+	assert.Equal(float64(6), decoded.Export().ErrorTypes["request|errors|env:default,service:web,error.type:Timeout"].Value)
+}
+
+func TestStatsRawBucketSeparators(t *testing.T) {
+	assert := assert.New(t)
+
+	resources := []string{"a|b", "a,b", "a:b", "env:x", "a,resource:b", "a,service:b", "", "|||,,,:::"}
+	srb := NewStatsRawBucket(0, 1e9)
+	for i, r := range resources {
+		for j := 0; j <= i; j++ {
+			s := Span{Service: "web", Name: "request", Resource: r, Duration: 100, Meta: map[string]string{"team": "a,team:b"}}
+			srb.HandleSpan(s, "default", []string{"team"}, 1, nil)
+		}
+	}
+	assert.Len(srb.data, len(resources))
+
+	// every resource keeps its own stats, through JSON too
+	sb := srb.Export()
+	data, err := json.Marshal(sb)
+	assert.Nil(err)
+	var decoded StatsBucket
+	assert.Nil(json.Unmarshal(data, &decoded))
+	for _, b := range []StatsBucket{sb, decoded} {
+		hits := make(map[string]int)
+		for _, d := range b.Distributions {
+			if d.Measure == DURATION {
+				hits[d.Resource()] = d.Summary.N
+				assert.Equal("a,team:b", d.TagSet.Get("team").Value)
+			}
+		}
+		for i, r := range resources {
+			assert.Equal(i+1, hits[r], r)
+		}
+	}
+
+	// and through the saved state
+	state, err := srb.GobEncode()
+	assert.Nil(err)
+	var resumed StatsRawBucket
+	assert.Nil(resumed.GobDecode(state))
+	assert.Equal(srb.data, resumed.data)
+}
+
+func TestStatsRawBucketSeparatorsCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	// the same grain string, but distinct aggregations
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(Span{Service: "c", Name: "request", Resource: "a,service:b", Duration: 100}, "default", nil, 1, nil)
+	srb.HandleSpan(Span{Service: "b,service:c", Name: "request", Resource: "a", Duration: 200}, "default", nil, 1, nil)
+	assert.Len(srb.data, 2)
+
+	// summed once exported, the raw stats untouched
+	for i := 0; i < 2; i++ {
+		sb := srb.Export()
+		assert.Equal(float64(2), sb.Counts["request|hits|env:default,resource:a,service:b,service:c"].Value)
+		assert.Equal(2, sb.Distributions["request|duration|env:default,resource:a,service:b,service:c"].Summary.N)
+	}
+}
+
+func TestStatsRawBucketRawKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	// the keys are the legacy ones, percent signs read as is
+	resource := "SELECT a, b WHERE c LIKE 'd%2C|%7C%25'"
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(Span{Service: "web", Name: "request", Resource: resource, Duration: 100}, "default", nil, 1, nil)
+
+	key := "request|duration|env:default,resource:" + resource + ",service:web"
+	d, ok := srb.Export().Distributions[key]
+	if !assert.True(ok) {
+		return
+	}
+	assert.Equal(key, d.Key)
+	name, measure, tags, err := ParseGrainKey(key)
+	assert.Nil(err)
+	assert.Equal("request", name)
+	assert.Equal(DURATION, measure)
+	assert.Equal(d.TagSet, tags)
+	assert.Equal(resource, tags.Get("resource").Value)
+}
+
+func TestStatsRawBucketMergeOverflowServices(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetMaxDistributions(1)
+	srb.HandleSpan(Span{Service: "web,eu", Name: "request", Resource: "GET /", Duration: 100}, "default", nil, 1, nil)
+	srb.HandleSpan(Span{Service: "web,eu", Name: "request", Resource: "GET /,service:db", Duration: 100}, "default", nil, 1, nil)
+
+	o := NewStatsRawBucket(0, 1e9)
+	o.SetMaxDistributions(1)
+	o.HandleSpan(Span{Service: "web,eu", Name: "request", Resource: "GET /", Duration: 100}, "default", nil, 1, nil)
+	o.HandleSpan(Span{Service: "web,eu", Name: "request", Resource: "POST /", Duration: 100}, "default", nil, 1, nil)
+
+	assert.Nil(srb.Merge(o))
+	assert.Equal(map[string]int{"web,eu": 2}, srb.Overflow())
+	overflow := aggregationKey{Name: "request", Env: "default", Resource: OverflowResource, Service: "web,eu"}
+	assert.Equal(float64(2), srb.data[overflow].hits)
+	assert.Equal("web,eu", srb.data[overflow].tags.Get("service").Value)
+}
+
+func TestStatsRawBucketGobOlderState(t *testing.T) {
+	assert := assert.New(t)
+
+	// saved with the grain strings as keys, which no longer decode
+	var buf bytes.Buffer
+	assert.Nil(gob.NewEncoder(&buf).Encode(struct {
+		Start, Duration int64
+		Data            []struct{ Name, Aggr string }
+	}{0, 1e9, []struct{ Name, Aggr string }{{"request", "env:default,resource:GET /,service:web"}}}))
+	var sb StatsRawBucket
+	err := sb.GobDecode(buf.Bytes())
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "no env")
+	}
+}
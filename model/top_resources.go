@@ -0,0 +1,128 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// TopResources are the resources of a stats bucket with the most hits and
+// the slowest ones, by their p95 duration, so that the busiest and slowest
+// resources of an interval can be told without querying the backend. They
+// are computed from the duration distributions of the bucket, see
+// StatsBucket.SetTopResources.
+type TopResources struct {
+	Hits []ResourceStats `json:"hits"` // by decreasing hits
+	P95  []ResourceStats `json:"p95"`  // by decreasing p95 duration
+
+	max    int  // number of resources kept by list, to compute them again on Merge
+	bounds bool // if the p95 bounds are set, see SetTopResourcesWithBounds
+}
+
+// ResourceStats sums up one duration distribution of a stats bucket
+type ResourceStats struct {
+	Name     string  `json:"name"`
+	Service  string  `json:"service"`
+	Resource string  `json:"resource"`
+	Hits     float64 `json:"hits"`
+	P95      float64 `json:"p95"` // in nanoseconds
+
+	// the bounds of the exact p95, with SetTopResourcesWithBounds
+	P95Lower float64 `json:"p95_lower,omitempty"`
+	P95Upper float64 `json:"p95_upper,omitempty"`
+}
+
+// SetTopResources computes the n distributions of the bucket with the most
+// hits and the ones with the highest p95, from its counts and distributions.
+// Ties are broken by the other measure, then by service, resource and name.
+// Buckets with fewer distributions list them all. n <= 0 removes them.
+func (sb *StatsBucket) SetTopResources(n int) {
+	sb.SetTopResourcesWithBounds(n, false)
+}
+
+// SetTopResourcesWithBounds is SetTopResources, also setting the bounds of
+// the p95 of each resource if bounds is true, see
+// quantile.SliceSummary.QuantileWithBounds.
+func (sb *StatsBucket) SetTopResourcesWithBounds(n int, bounds bool) {
+	if n <= 0 {
+		sb.TopResources = nil
+		return
+	}
+
+	var all []ResourceStats
+	for _, d := range sb.Distributions {
+		if d.Measure != DURATION || d.Summary == nil || d.Summary.N == 0 {
+			continue
+		}
+		rs := ResourceStats{
+			Name:     d.Name,
+			Service:  d.Service(),
+			Resource: d.Resource(),
+			Hits:     float64(d.Summary.N),
+		}
+		if bounds {
+			rs.P95, rs.P95Lower, rs.P95Upper = d.Summary.QuantileWithBounds(0.95)
+		} else {
+			rs.P95 = d.Summary.Quantile(0.95)
+		}
+		// the hits count is weighted by the sampling of the traces, unlike
+		// the distribution
+		aggr := strings.TrimPrefix(d.Key, GrainKey(d.Name, DURATION, ""))
+		if c, ok := sb.Counts[GrainKey(d.Name, HITS, aggr)]; ok {
+			rs.Hits = c.Value
+		}
+		all = append(all, rs)
+	}
+
+	top := &TopResources{max: n, bounds: bounds}
+	sort.Sort(byHits(all))
+	top.Hits = append([]ResourceStats{}, all[:minInt(n, len(all))]...)
+	sort.Sort(byP95(all))
+	top.P95 = append([]ResourceStats{}, all[:minInt(n, len(all))]...)
+	sb.TopResources = top
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// lessResource orders the resources with the same measures
+func lessResource(a, b ResourceStats) bool {
+	if a.Service != b.Service {
+		return a.Service < b.Service
+	}
+	if a.Resource != b.Resource {
+		return a.Resource < b.Resource
+	}
+	return a.Name < b.Name
+}
+
+type byHits []ResourceStats
+
+func (s byHits) Len() int      { return len(s) }
+func (s byHits) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byHits) Less(i, j int) bool {
+	if s[i].Hits != s[j].Hits {
+		return s[i].Hits > s[j].Hits
+	}
+	if s[i].P95 != s[j].P95 {
+		return s[i].P95 > s[j].P95
+	}
+	return lessResource(s[i], s[j])
+}
+
+type byP95 []ResourceStats
+
+func (s byP95) Len() int      { return len(s) }
+func (s byP95) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byP95) Less(i, j int) bool {
+	if s[i].P95 != s[j].P95 {
+		return s[i].P95 > s[j].P95
+	}
+	if s[i].Hits != s[j].Hits {
+		return s[i].Hits > s[j].Hits
+	}
+	return lessResource(s[i], s[j])
+}
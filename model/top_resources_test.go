@@ -0,0 +1,133 @@
+package model
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTopResourcesBucket returns a bucket of resources with the given hits
+// and durations, a part of their spans going to other
+func newTopResourcesBucket(other *StatsRawBucket) StatsBucket {
+	srb := NewStatsRawBucket(0, 1e10)
+	for _, r := range []struct {
+		service, resource string
+		spans             int
+		weight            float64
+		duration          int64
+	}{
+		{"web", "GET /home", 50, 1, 100},
+		{"web", "GET /slow", 2, 1, 5000},
+		{"web", "GET /users", 50, 1, 300},
+		{"web", "GET /api", 20, 1, 300},
+		{"auth", "POST /login", 5, 2, 100},
+	} {
+		for i := 0; i < r.spans; i++ {
+			s := Span{Service: r.service, Name: "request", Resource: r.resource, Duration: r.duration}
+			if other != nil && i%2 == 1 {
+				other.HandleSpan(s, defaultEnv, nil, r.weight, nil)
+				continue
+			}
+			srb.HandleSpan(s, defaultEnv, nil, r.weight, nil)
+		}
+	}
+	return srb.Export()
+}
+
+func TestStatsBucketTopResources(t *testing.T) {
+	assert := assert.New(t)
+
+	sb := newTopResourcesBucket(nil)
+	sb.SetTopResources(3)
+	if !assert.NotNil(sb.TopResources) {
+		t.FailNow()
+	}
+	// ties are broken by the other measure
+	assert.Equal([]ResourceStats{
+		{Name: "request", Service: "web", Resource: "GET /users", Hits: 50, P95: 300},
+		{Name: "request", Service: "web", Resource: "GET /home", Hits: 50, P95: 100},
+		{Name: "request", Service: "web", Resource: "GET /api", Hits: 20, P95: 300},
+	}, sb.TopResources.Hits)
+	assert.Equal([]ResourceStats{
+		{Name: "request", Service: "web", Resource: "GET /slow", Hits: 2, P95: 5000},
+		{Name: "request", Service: "web", Resource: "GET /users", Hits: 50, P95: 300},
+		{Name: "request", Service: "web", Resource: "GET /api", Hits: 20, P95: 300},
+	}, sb.TopResources.P95)
+
+	// fewer resources than asked for, then by service on full ties; the
+	// hits are weighted
+	sb.SetTopResources(10)
+	assert.Len(sb.TopResources.Hits, 5)
+	assert.Len(sb.TopResources.P95, 5)
+	assert.Equal(ResourceStats{Name: "request", Service: "auth", Resource: "POST /login", Hits: 10, P95: 100},
+		sb.TopResources.P95[4])
+	assert.Equal("GET /home", sb.TopResources.Hits[1].Resource)
+	assert.Equal("POST /login", sb.TopResources.Hits[3].Resource)
+
+	sb.SetTopResources(0)
+	assert.Nil(sb.TopResources)
+
+	empty := NewStatsBucket(0, 1e10)
+	empty.SetTopResources(3)
+	assert.Len(empty.TopResources.Hits, 0)
+	assert.Len(empty.TopResources.P95, 0)
+}
+
+func TestStatsBucketTopResourcesMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := newTopResourcesBucket(nil)
+	expected.SetTopResources(3)
+
+	other := NewStatsRawBucket(0, 1e10)
+	sb := newTopResourcesBucket(other)
+	sb.SetTopResources(3)
+	assert.Nil(sb.Merge(other.Export()))
+	assert.Equal(expected.TopResources, sb.TopResources)
+
+	// split buckets list their own resources
+	p := AgentPayload{HostName: "host", Stats: []StatsBucket{expected}}
+	payloads := p.SplitByTag("service", []string{"auth"})
+	auth := payloads["auth"].Stats[0].TopResources
+	if assert.NotNil(auth) {
+		assert.Len(auth.Hits, 1)
+		assert.Equal("POST /login", auth.P95[0].Resource)
+	}
+	assert.Len(payloads[""].Stats[0].TopResources.Hits, 3)
+}
+
+func TestStatsBucketTopResourcesBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	sb := newTopResourcesBucket(nil)
+	sb.SetTopResourcesWithBounds(3, true)
+	for _, rs := range append(sb.TopResources.Hits, sb.TopResources.P95...) {
+		assert.True(rs.P95Lower > 0, rs.Resource)
+		assert.True(rs.P95Lower <= rs.P95, rs.Resource)
+		assert.True(rs.P95 <= rs.P95Upper, rs.Resource)
+	}
+	assert.Equal(ResourceStats{Name: "request", Service: "web", Resource: "GET /slow", Hits: 2,
+		P95: 5000, P95Lower: 5000, P95Upper: 5000}, sb.TopResources.P95[0])
+
+	// the bounds are encoded, and kept on merge
+	p := AgentPayload{HostName: "host", Stats: []StatsBucket{sb}}
+	var buf bytes.Buffer
+	size, err := p.WriteTo(&buf)
+	assert.Nil(err)
+	assert.Contains(buf.String(), `"p95_lower":5000,"p95_upper":5000`)
+	assert.Equal(int(size), p.EstimateSize(PayloadEncodingJSON))
+
+	other := NewStatsRawBucket(0, 1e10)
+	merged := newTopResourcesBucket(other)
+	merged.SetTopResourcesWithBounds(3, true)
+	assert.Nil(merged.Merge(other.Export()))
+	assert.Equal(sb.TopResources, merged.TopResources)
+
+	// not set by default
+	p.Stats[0].SetTopResources(3)
+	assert.Equal(float64(0), p.Stats[0].TopResources.P95[0].P95Lower)
+	buf.Reset()
+	p.WriteTo(&buf)
+	assert.NotContains(buf.String(), "p95_lower")
+}
@@ -1,9 +1,36 @@
 package model
 
 import (
+	"sort"
+	"strconv"
+
 	log "github.com/cihub/seelog"
 )
 
+const (
+	// TraceTruncatedKey is set in the root span meta of truncated traces
+	TraceTruncatedKey = "_dd.truncated"
+	// TraceDroppedSpansKey is the root span metric holding the number of spans
+	// dropped from a truncated trace
+	TraceDroppedSpansKey = "_dd.dropped_spans"
+	// TraceOrphanKey is set in the meta of spans received without the rest
+	// of their trace, and sent as single-span traces
+	TraceOrphanKey = "_dd.orphan"
+	// TraceLongRunningKey is set in the meta of the spans of traces which
+	// kept receiving spans for longer than they can be assembled, and are
+	// sent in several chunks
+	TraceLongRunningKey = "_dd.long_running"
+	// TraceChunkSeqKey is the meta holding the sequence number, from 0, of
+	// the chunk of a long-running trace a span was sent in
+	TraceChunkSeqKey = "_dd.chunk_seq"
+	// TraceTopLevelKey is the metric set to 1 on the spans which are the entry
+	// point into their service, see Trace.ComputeTopLevel
+	TraceTopLevelKey = "_top_level"
+	// TraceUniformKeepKey is set in the root span meta of the sampled traces
+	// which are part of the uniform sample, see sampler.SampleByRate
+	TraceUniformKeepKey = "_dd.uniform_keep"
+)
+
 //go:generate msgp -marshal=false
 
 // Trace is a collection of spans with the same trace ID
@@ -16,16 +43,142 @@ type Traces []Trace
 // the first trace it finds or an empty string
 func (t Trace) GetEnv() string {
 	// exit this on first success
-	for _, s := range t {
-		for k, v := range s.Meta {
-			if k == "env" {
-				return v
-			}
+	for i := range t {
+		if env := t[i].GetEnv(); env != "" {
+			return env
 		}
 	}
 	return ""
 }
 
+// ChunkSeq returns the sequence number of the chunk of a long-running trace
+// t is, and false if t is a whole trace, see TraceChunkSeqKey
+func (t Trace) ChunkSeq() (int, bool) {
+	if len(t) == 0 {
+		return 0, false
+	}
+	v, ok := t[0].Meta[TraceChunkSeqKey]
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(v)
+	return seq, err == nil
+}
+
+// ComputeTopLevel marks with TraceTopLevelKey, and Span.IsTopLevel, the spans
+// which are the entry point into their service: the spans without parent, or
+// whose parent is not in the trace or belongs to another service.
+func (t Trace) ComputeTopLevel() {
+	services := make(map[uint64]string, len(t))
+	for i := range t {
+		services[t[i].SpanID] = t[i].Service
+	}
+	for i := range t {
+		s := &t[i]
+		if service, ok := services[s.ParentID]; ok && s.ParentID != 0 && service == s.Service {
+			// clients cannot tell us which spans are top-level
+			delete(s.Metrics, TraceTopLevelKey)
+			s.IsTopLevel = false
+			continue
+		}
+		if s.Metrics == nil {
+			s.Metrics = make(map[string]float64)
+		}
+		s.Metrics[TraceTopLevelKey] = 1
+		s.IsTopLevel = true
+	}
+}
+
+// ChildrenMap returns the spans of the trace by the ID of their parent
+func (t Trace) ChildrenMap() map[uint64][]*Span {
+	children := make(map[uint64][]*Span, len(t))
+	for i := range t {
+		children[t[i].ParentID] = append(children[t[i].ParentID], &t[i])
+	}
+	return children
+}
+
+// UnknownResource is the resource given to the spans without a resource, an
+// ancestor with one, nor a name, see InheritResources
+const UnknownResource = "unknown"
+
+// InheritResources gives the spans without a resource the one of their
+// nearest ancestor, or else their name, or else UnknownResource, so that they
+// do not all aggregate in the same empty resource. Orphans have no ancestor,
+// and an ancestor given its name passes it down. It returns the number of spans given a
+// resource, by service, or nil if all of them had one.
+func (t Trace) InheritResources() map[string]int {
+	missing := false
+	for i := range t {
+		if t[i].Resource == "" {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	inherited := make(map[string]int)
+	give := func(s *Span, resource string) {
+		if resource == "" {
+			resource = s.Name
+		}
+		if resource == "" {
+			resource = UnknownResource
+		}
+		s.Resource = resource
+		inherited[s.Service]++
+	}
+
+	ids := make(map[uint64]bool, len(t))
+	for i := range t {
+		ids[t[i].SpanID] = true
+	}
+	// walk the trees of the trace from their roots, the spans whose parent
+	// is not in the trace, with the resource of their parent
+	type walked struct {
+		span     *Span
+		resource string
+	}
+	var stack []walked
+	for i := range t {
+		if t[i].ParentID == 0 || !ids[t[i].ParentID] {
+			stack = append(stack, walked{&t[i], ""})
+		}
+	}
+	children := t.ChildrenMap()
+	// a span is walked once unless span IDs are reused, stop there
+	for n := 0; len(stack) > 0 && n < len(t); n++ {
+		w := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if w.span.Resource == "" {
+			give(w.span, w.resource)
+		}
+		for _, child := range children[w.span.SpanID] {
+			stack = append(stack, walked{child, w.span.Resource})
+		}
+	}
+
+	// spans out of any tree, in parent cycles
+	for i := range t {
+		if t[i].Resource == "" {
+			give(&t[i], "")
+		}
+	}
+	return inherited
+}
+
+// WeightedSize returns an approximation of the memory used by the spans of
+// the trace, see Span.WeightedSize
+func (t Trace) WeightedSize() int {
+	size := 0
+	for i := range t {
+		size += t[i].WeightedSize()
+	}
+	return size
+}
+
 // GetRoot extracts the root span from a trace
 func (t Trace) GetRoot() *Span {
 	// That should be caught beforehand
@@ -66,6 +219,83 @@ func (t Trace) GetRoot() *Span {
 	return &t[len(t)-1]
 }
 
+// spansByPriority sorts span indexes so that the ones we want to keep when
+// truncating a trace come first: the root, errors, then the longest spans.
+type spansByPriority struct {
+	trace Trace
+	idx   []int
+	root  int
+}
+
+func (p spansByPriority) Len() int      { return len(p.idx) }
+func (p spansByPriority) Swap(i, j int) { p.idx[i], p.idx[j] = p.idx[j], p.idx[i] }
+func (p spansByPriority) Less(i, j int) bool {
+	a, b := p.idx[i], p.idx[j]
+	if (a == p.root) != (b == p.root) {
+		return a == p.root
+	}
+	sa, sb := &p.trace[a], &p.trace[b]
+	if (sa.Error != 0) != (sb.Error != 0) {
+		return sa.Error != 0
+	}
+	if sa.Duration != sb.Duration {
+		return sa.Duration > sb.Duration
+	}
+	return a < b
+}
+
+// Truncate returns a copy of the trace holding at most maxSpans spans, along
+// with its root. The root, the error spans and then the longest spans are kept,
+// and the root of the copy is marked with TraceTruncatedKey and
+// TraceDroppedSpansKey. The trace is returned unchanged if it is small enough.
+func (t Trace) Truncate(root *Span, maxSpans int) (Trace, *Span) {
+	if maxSpans <= 0 || len(t) <= maxSpans {
+		return t, root
+	}
+
+	p := spansByPriority{trace: t, idx: make([]int, len(t)), root: -1}
+	for i := range t {
+		p.idx[i] = i
+		if &t[i] == root {
+			p.root = i
+		}
+	}
+	sort.Sort(p)
+
+	// keep the spans in their original order
+	kept := p.idx[:maxSpans]
+	sort.Ints(kept)
+
+	truncated := make(Trace, len(kept))
+	var newRoot *Span
+	for i, idx := range kept {
+		truncated[i] = t[idx]
+		if idx == p.root {
+			newRoot = &truncated[i]
+		}
+	}
+	if newRoot == nil {
+		return truncated, nil
+	}
+
+	// the original root is still used by the stats, don't share its maps
+	meta := make(map[string]string, len(newRoot.Meta)+1)
+	for k, v := range newRoot.Meta {
+		meta[k] = v
+	}
+	meta[TraceTruncatedKey] = "true"
+	newRoot.Meta = meta
+
+	metrics := make(map[string]float64, len(newRoot.Metrics)+1)
+	for k, v := range newRoot.Metrics {
+		metrics[k] = v
+	}
+	metrics[TraceDroppedSpansKey] = float64(len(t) - len(kept))
+	newRoot.Metrics = metrics
+
+	return truncated, newRoot
+}
+
 // NewTraceFlushMarker returns a trace with a single span as flush marker
 func NewTraceFlushMarker() Trace {
 	return []Span{NewFlushMarker()}
@@ -0,0 +1,555 @@
+package model
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	// minDecodeBuffer is the size the payload buffer grows by, at least
+	minDecodeBuffer = 4 << 10
+	// maxPooledDecodeBuffer is the size of the largest payload buffer kept
+	// for the next payloads
+	maxPooledDecodeBuffer = 4 << 20
+	// maxInternedStrings is the number of strings shared by the spans of a
+	// payload, and maxInternedLength the length of the longest of them
+	maxInternedStrings = 4096
+	maxInternedLength  = 64
+)
+
+// commonKeys are the meta and metrics keys set by most tracers, decoded
+// without allocation
+var commonKeys = newStringTable(
+	EnvKey, HTTPStatusCodeKey, "http.method", "http.url", "http.host",
+	ErrorTypeKey, ErrorMsgKey, ErrorStackKey,
+	"sql.query", "db.name", "db.user", "out.host", "out.port",
+	"span.kind", "component", "language", "system.pid", "version",
+	SpanSampleRateMetricKey, SamplingPriorityKey, TraceTopLevelKey,
+	SpanSyntheticKey, TraceChunkSeqKey, TraceLongRunningKey,
+)
+
+func newStringTable(strings ...string) map[string]string {
+	t := make(map[string]string, len(strings))
+	for _, s := range strings {
+		t[s] = s
+	}
+	return t
+}
+
+var traceDecoders = sync.Pool{
+	New: func() interface{} {
+		return &traceDecoder{strings: make(map[string]string)}
+	},
+}
+
+// DecodeTracesMsgpack decodes a msgpack payload of traces. The spans of the
+// usual shape are decoded by a hand-rolled decoder, which reuses its buffers
+// and shares the strings repeated by the spans of the payload. The payloads
+// with anything else, such as unknown fields or unusual encodings, are
+// decoded by Traces.DecodeMsg, so that the traces and errors are always
+// those of Traces.DecodeMsg. The whole payload is read before being decoded,
+// so r must be bounded, as the request bodies are by the LimitedReader of
+// the receiver.
+func DecodeTracesMsgpack(r io.Reader) (Traces, error) {
+	d := traceDecoders.Get().(*traceDecoder)
+	defer d.release()
+
+	if err := d.read(r); err != nil {
+		return nil, err
+	}
+	if traces, ok := d.decode(); ok {
+		return traces, nil
+	}
+
+	var traces Traces
+	err := traces.DecodeMsg(msgp.NewReader(bytes.NewReader(d.buf)))
+	return traces, err
+}
+
+// traceDecoder decodes the traces of a msgpack payload, see
+// DecodeTracesMsgpack. Its methods return false for what they do not
+// decode exactly as Traces.DecodeMsg does, including invalid payloads.
+type traceDecoder struct {
+	buf     []byte            // the payload
+	off     int               // the position of the decoder in buf
+	strings map[string]string // the strings of the payload, shared by its spans
+}
+
+// read reads the payload from r, until EOF
+func (d *traceDecoder) read(r io.Reader) error {
+	d.buf, d.off = d.buf[:0], 0
+	for {
+		if len(d.buf) == cap(d.buf) {
+			buf := make([]byte, len(d.buf), 2*cap(d.buf)+minDecodeBuffer)
+			copy(buf, d.buf)
+			d.buf = buf
+		}
+		n, err := r.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+n]
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// release puts d back in the pool, for the next payload
+func (d *traceDecoder) release() {
+	if cap(d.buf) > maxPooledDecodeBuffer {
+		d.buf = nil
+	}
+	for s := range d.strings {
+		delete(d.strings, s)
+	}
+	traceDecoders.Put(d)
+}
+
+func (d *traceDecoder) decode() (Traces, bool) {
+	n, ok := d.arrayHeader()
+	if !ok {
+		return nil, false
+	}
+	// empty arrays are decoded as nil slices, as by Traces.DecodeMsg
+	var traces Traces
+	if n > 0 {
+		traces = make(Traces, n)
+	}
+	for i := range traces {
+		n, ok := d.arrayHeader()
+		if !ok {
+			return nil, false
+		}
+		var trace Trace
+		if n > 0 {
+			trace = make(Trace, n)
+		}
+		for j := range trace {
+			if !d.span(&trace[j]) {
+				return nil, false
+			}
+		}
+		traces[i] = trace
+	}
+	return traces, true
+}
+
+func (d *traceDecoder) span(s *Span) bool {
+	n, ok := d.mapHeader()
+	if !ok {
+		return false
+	}
+	for ; n > 0; n-- {
+		field, ok := d.readString(false)
+		if !ok {
+			return false
+		}
+		switch msgp.UnsafeString(field) {
+		case "service":
+			s.Service, ok = d.stringField()
+		case "name":
+			s.Name, ok = d.stringField()
+		case "resource":
+			s.Resource, ok = d.stringField()
+		case "type":
+			s.Type, ok = d.stringField()
+		case "trace_id":
+			s.TraceID, ok = d.uint64Field()
+		case "span_id":
+			s.SpanID, ok = d.uint64Field()
+		case "parent_id":
+			s.ParentID, ok = d.uint64Field()
+		case "start":
+			s.Start, ok = d.int64Field()
+		case "duration":
+			s.Duration, ok = d.int64Field()
+		case "error":
+			var v int64
+			v, ok = d.int64Field()
+			ok = ok && v >= math.MinInt32 && v <= math.MaxInt32
+			s.Error = int32(v)
+		case "meta":
+			s.Meta, ok = d.stringMap(s.Meta)
+		case "metrics":
+			ok = d.metrics(s)
+		case "events":
+			ok = d.events(s)
+		case "links":
+			ok = d.links(s)
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// stringMap decodes a map of strings, such as the meta of a span, into m:
+// as Span.DecodeMsg does, the values of a previous field are replaced
+func (d *traceDecoder) stringMap(m map[string]string) (map[string]string, bool) {
+	if d.skipNil() {
+		return nil, true
+	}
+	n, ok := d.mapHeader()
+	if !ok {
+		return m, false
+	}
+	if m == nil && n > 0 {
+		m = make(map[string]string, n)
+	} else {
+		for k := range m {
+			delete(m, k)
+		}
+	}
+	for ; n > 0; n-- {
+		k, ok := d.readString(true)
+		if !ok {
+			return m, false
+		}
+		v, ok := d.readString(true)
+		if !ok {
+			return m, false
+		}
+		m[d.key(k)] = d.intern(v)
+	}
+	return m, true
+}
+
+// metrics decodes the metrics of s, see stringMap
+func (d *traceDecoder) metrics(s *Span) bool {
+	if d.skipNil() {
+		s.Metrics = nil
+		return true
+	}
+	n, ok := d.mapHeader()
+	if !ok {
+		return false
+	}
+	if s.Metrics == nil && n > 0 {
+		s.Metrics = make(map[string]float64, n)
+	} else {
+		for k := range s.Metrics {
+			delete(s.Metrics, k)
+		}
+	}
+	for ; n > 0; n-- {
+		k, ok := d.readString(true)
+		if !ok {
+			return false
+		}
+		v, ok := d.readFloat64()
+		if !ok {
+			return false
+		}
+		s.Metrics[d.key(k)] = v
+	}
+	return true
+}
+
+// events decodes the events of s into the ones of a previous field, as
+// Span.DecodeMsg does
+func (d *traceDecoder) events(s *Span) bool {
+	if d.skipNil() {
+		s.Events = nil
+		return true
+	}
+	n, ok := d.arrayHeader()
+	if !ok {
+		return false
+	}
+	if cap(s.Events) >= n {
+		s.Events = s.Events[:n]
+	} else {
+		s.Events = make([]SpanEvent, n)
+	}
+	for i := range s.Events {
+		if !d.event(&s.Events[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *traceDecoder) event(e *SpanEvent) bool {
+	n, ok := d.mapHeader()
+	if !ok {
+		return false
+	}
+	for ; n > 0; n-- {
+		field, ok := d.readString(false)
+		if !ok {
+			return false
+		}
+		switch msgp.UnsafeString(field) {
+		case "ts":
+			e.Ts, ok = d.int64Field()
+		case "name":
+			e.Name, ok = d.stringField()
+		case "attrs":
+			e.Attrs, ok = d.stringMap(e.Attrs)
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// links decodes the links of s, see events
+func (d *traceDecoder) links(s *Span) bool {
+	if d.skipNil() {
+		s.Links = nil
+		return true
+	}
+	n, ok := d.arrayHeader()
+	if !ok {
+		return false
+	}
+	if cap(s.Links) >= n {
+		s.Links = s.Links[:n]
+	} else {
+		s.Links = make([]SpanLink, n)
+	}
+	for i := range s.Links {
+		if !d.link(&s.Links[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *traceDecoder) link(l *SpanLink) bool {
+	n, ok := d.mapHeader()
+	if !ok {
+		return false
+	}
+	for ; n > 0; n-- {
+		field, ok := d.readString(false)
+		if !ok {
+			return false
+		}
+		switch msgp.UnsafeString(field) {
+		case "trace_id":
+			l.TraceID, ok = d.uint64Field()
+		case "span_id":
+			l.SpanID, ok = d.uint64Field()
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns k as a string, without allocation for the common keys
+func (d *traceDecoder) key(k []byte) string {
+	if s, ok := commonKeys[string(k)]; ok {
+		return s
+	}
+	return d.intern(k)
+}
+
+// intern returns b as a string, shared with the other spans of the payload
+// when short enough to be repeated
+func (d *traceDecoder) intern(b []byte) string {
+	if len(b) > maxInternedLength {
+		return string(b)
+	}
+	if s, ok := d.strings[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	if len(d.strings) < maxInternedStrings {
+		d.strings[s] = s
+	}
+	return s
+}
+
+// skipNil skips the next value if it is nil
+func (d *traceDecoder) skipNil() bool {
+	if d.off < len(d.buf) && d.buf[d.off] == 0xc0 {
+		d.off++
+		return true
+	}
+	return false
+}
+
+func (d *traceDecoder) next() (byte, bool) {
+	if d.off >= len(d.buf) {
+		return 0, false
+	}
+	b := d.buf[d.off]
+	d.off++
+	return b, true
+}
+
+// readUint reads a big-endian unsigned integer of size bytes
+func (d *traceDecoder) readUint(size int) (uint64, bool) {
+	if len(d.buf)-d.off < size {
+		return 0, false
+	}
+	var v uint64
+	for _, b := range d.buf[d.off : d.off+size] {
+		v = v<<8 | uint64(b)
+	}
+	d.off += size
+	return v, true
+}
+
+// readLength decodes the length of an array or a map of n elements taking at
+// least min bytes each: larger ones cannot fit in what is left of buf
+func (d *traceDecoder) readLength(size, min int) (int, bool) {
+	n, ok := d.readUint(size)
+	if !ok || n > uint64(len(d.buf)-d.off)/uint64(min) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func (d *traceDecoder) arrayHeader() (int, bool) {
+	b, ok := d.next()
+	switch {
+	case !ok:
+		return 0, false
+	case b >= 0x90 && b <= 0x9f:
+		return int(b & 0x0f), true
+	case b == 0xdc:
+		return d.readLength(2, 1)
+	case b == 0xdd:
+		return d.readLength(4, 1)
+	}
+	return 0, false
+}
+
+func (d *traceDecoder) mapHeader() (int, bool) {
+	b, ok := d.next()
+	switch {
+	case !ok:
+		return 0, false
+	case b >= 0x80 && b <= 0x8f:
+		return int(b & 0x0f), true
+	case b == 0xde:
+		return d.readLength(2, 2)
+	case b == 0xdf:
+		return d.readLength(4, 2)
+	}
+	return 0, false
+}
+
+// readString returns the bytes of the next string, or binary if bin, as
+// parseString decodes them
+func (d *traceDecoder) readString(bin bool) ([]byte, bool) {
+	b, ok := d.next()
+	if !ok {
+		return nil, false
+	}
+	var n uint64
+	switch {
+	case b >= 0xa0 && b <= 0xbf:
+		n = uint64(b & 0x1f)
+	case b == 0xd9 || bin && b == 0xc4:
+		n, ok = d.readUint(1)
+	case b == 0xda || bin && b == 0xc5:
+		n, ok = d.readUint(2)
+	case b == 0xdb || bin && b == 0xc6:
+		n, ok = d.readUint(4)
+	default:
+		return nil, false
+	}
+	if !ok || n > uint64(len(d.buf)-d.off) {
+		return nil, false
+	}
+	s := d.buf[d.off : d.off+int(n)]
+	d.off += int(n)
+	return s, true
+}
+
+func (d *traceDecoder) stringField() (string, bool) {
+	if d.skipNil() {
+		return "", true
+	}
+	b, ok := d.readString(true)
+	if !ok {
+		return "", false
+	}
+	return d.intern(b), true
+}
+
+// uint64Field decodes the positive fixints and the uints, as
+// msgp.Reader.ReadUint64 does
+func (d *traceDecoder) uint64Field() (uint64, bool) {
+	if d.skipNil() {
+		return 0, true
+	}
+	b, ok := d.next()
+	switch {
+	case !ok:
+		return 0, false
+	case b <= 0x7f:
+		return uint64(b), true
+	case b >= 0xcc && b <= 0xcf:
+		return d.readUint(1 << (b - 0xcc))
+	}
+	return 0, false
+}
+
+// int64Field decodes the ints, and the uints which fit, as parseInt64 does
+func (d *traceDecoder) int64Field() (int64, bool) {
+	if d.skipNil() {
+		return 0, true
+	}
+	b, ok := d.next()
+	if !ok {
+		return 0, false
+	}
+	return d.readInt64(b)
+}
+
+// readInt64 decodes the integer of lead byte b
+func (d *traceDecoder) readInt64(b byte) (int64, bool) {
+	switch {
+	case b <= 0x7f:
+		return int64(b), true
+	case b >= 0xe0:
+		return int64(int8(b)), true
+	case b >= 0xcc && b <= 0xcf:
+		v, ok := d.readUint(1 << (b - 0xcc))
+		return int64(v), ok && v <= math.MaxInt64
+	case b >= 0xd0 && b <= 0xd3:
+		size := 1 << (b - 0xd0)
+		v, ok := d.readUint(size)
+		// sign extension
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, ok
+	}
+	return 0, false
+}
+
+// readFloat64 decodes the float64s and the integers, as parseFloat64 does: the
+// uints are the bits of float64s
+func (d *traceDecoder) readFloat64() (float64, bool) {
+	b, ok := d.next()
+	switch {
+	case !ok:
+		return 0, false
+	case b == 0xcb:
+		v, ok := d.readUint(8)
+		return math.Float64frombits(v), ok
+	case b >= 0xcc && b <= 0xcf:
+		v, ok := d.readUint(1 << (b - 0xcc))
+		return math.Float64frombits(v), ok
+	}
+	v, ok := d.readInt64(b)
+	return float64(v), ok
+}
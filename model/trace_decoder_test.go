@@ -0,0 +1,479 @@
+package model
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// decodeTracesGeneric decodes b as the receiver did before DecodeTracesMsgpack
+func decodeTracesGeneric(b []byte) (Traces, error) {
+	var traces Traces
+	err := traces.DecodeMsg(msgp.NewReader(bytes.NewReader(b)))
+	return traces, err
+}
+
+// assertSameDecoding checks that DecodeTracesMsgpack decodes b exactly as
+// Traces.DecodeMsg does
+func assertSameDecoding(t *testing.T, b []byte) {
+	expected, expectedErr := decodeTracesGeneric(b)
+	traces, err := DecodeTracesMsgpack(bytes.NewReader(b))
+	assert.Equal(t, fmt.Sprint(expectedErr), fmt.Sprint(err), "payload %x", b)
+	assert.Equal(t, expected, traces, "payload %x", b)
+}
+
+// decodesFast tells if b is decoded without the fallback to Traces.DecodeMsg
+func decodesFast(b []byte) bool {
+	d := &traceDecoder{buf: b, strings: make(map[string]string)}
+	_, ok := d.decode()
+	return ok
+}
+
+// corpusWriter writes msgpack payloads of traces, choosing randomly among the
+// encodings of each value, some of which are left to Traces.DecodeMsg
+type corpusWriter struct {
+	r        *rand.Rand
+	buf      []byte
+	compact  bool // only strings and headers of 8 bit lengths are written
+	fallback bool // something left to Traces.DecodeMsg was written
+}
+
+var corpusStrings = []string{
+	"", "web", "db", "GET /users", "http.request", "postgres.query", "http",
+	"env", "http.status_code", "200", "custom.tag", "_sample_rate",
+	strings.Repeat("SELECT * FROM users WHERE id = ? ", 4),
+}
+
+// rare tells when to write something left to Traces.DecodeMsg
+func (w *corpusWriter) rare() bool {
+	return w.r.Intn(50) == 0
+}
+
+func (w *corpusWriter) write(b ...byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *corpusWriter) writeUint(v uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		w.buf = append(w.buf, byte(v>>(8*uint(i))))
+	}
+}
+
+// header writes the header of a map or an array of n elements, fix is the
+// lead byte of its fixed format, and the next ones of its 16 and 32 bit ones
+func (w *corpusWriter) header(n int, fix, b16 byte) {
+	switch c := w.r.Intn(3); {
+	case (c == 0 || w.compact) && n < 16:
+		w.write(fix | byte(n))
+	case c <= 1:
+		w.write(b16)
+		w.writeUint(uint64(n), 2)
+	default:
+		w.write(b16 + 1)
+		w.writeUint(uint64(n), 4)
+	}
+}
+
+func (w *corpusWriter) str(s string, field bool) {
+	n := uint64(len(s))
+	c := w.r.Intn(7)
+	if field && c >= 4 && !w.rare() {
+		// the fields are binaries only rarely
+		c -= 4
+	}
+	if w.compact {
+		c = []int{0, 1, 4}[c%3]
+	}
+	switch {
+	case c == 0 && n < 32:
+		w.write(0xa0 | byte(n))
+	case c <= 1 && n < 256:
+		w.write(0xd9, byte(n))
+	case c == 2:
+		w.write(0xda)
+		w.writeUint(n, 2)
+	case c == 3:
+		w.write(0xdb)
+		w.writeUint(n, 4)
+	case c == 4 && n < 256:
+		w.write(0xc4, byte(n))
+		w.fallback = w.fallback || field
+	case c == 5:
+		w.write(0xc5)
+		w.writeUint(n, 2)
+		w.fallback = w.fallback || field
+	default:
+		w.write(0xc6)
+		w.writeUint(n, 4)
+		w.fallback = w.fallback || field
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *corpusWriter) uint(v uint64) {
+	switch c := w.r.Intn(6); {
+	case c == 0 && v < 128:
+		w.write(byte(v))
+	case c <= 1 && v < 1<<8:
+		w.write(0xcc, byte(v))
+	case c <= 2 && v < 1<<16:
+		w.write(0xcd)
+		w.writeUint(v, 2)
+	case c <= 3 && v < 1<<32:
+		w.write(0xce)
+		w.writeUint(v, 4)
+	case c == 5 && v <= math.MaxInt64 && w.rare():
+		// msgp.Reader.ReadUint64 rejects ints
+		w.write(0xd3)
+		w.writeUint(v, 8)
+		w.fallback = true
+	default:
+		w.write(0xcf)
+		w.writeUint(v, 8)
+	}
+}
+
+func (w *corpusWriter) int(v int64) {
+	switch c := w.r.Intn(6); {
+	case c == 0 && v >= -32 && v < 128:
+		w.write(byte(v))
+	case c <= 1 && v >= math.MinInt8 && v <= math.MaxInt8:
+		w.write(0xd0, byte(v))
+	case c <= 2 && v >= math.MinInt16 && v <= math.MaxInt16:
+		w.write(0xd1)
+		w.writeUint(uint64(v), 2)
+	case c <= 3 && v >= math.MinInt32 && v <= math.MaxInt32:
+		w.write(0xd2)
+		w.writeUint(uint64(v), 4)
+	case c == 4 && v >= 0:
+		w.write(0xcf)
+		w.writeUint(uint64(v), 8)
+	default:
+		w.write(0xd3)
+		w.writeUint(uint64(v), 8)
+	}
+}
+
+func (w *corpusWriter) float(v float64) {
+	switch c := w.r.Intn(4); {
+	case c == 0 && v == math.Trunc(v) && math.Abs(v) < 1<<31:
+		w.int(int64(v))
+	case c == 1:
+		// the bits of the float64, see parseFloat64
+		w.write(0xcf)
+		w.writeUint(math.Float64bits(v), 8)
+	case c == 2 && float64(float32(v)) == v && w.rare():
+		// rejected by parseFloat64
+		w.write(0xca)
+		w.writeUint(uint64(math.Float32bits(float32(v))), 4)
+		w.fallback = true
+	default:
+		w.write(0xcb)
+		w.writeUint(math.Float64bits(v), 8)
+	}
+}
+
+func (w *corpusWriter) randomString() string {
+	if w.r.Intn(10) == 0 {
+		return fmt.Sprintf("value-%d", w.r.Int63())
+	}
+	return corpusStrings[w.r.Intn(len(corpusStrings))]
+}
+
+// nil writes nil instead of a value, sometimes
+func (w *corpusWriter) nil() bool {
+	if w.r.Intn(10) > 0 {
+		return false
+	}
+	w.write(0xc0)
+	return true
+}
+
+func (w *corpusWriter) span() {
+	fields := []string{"service", "name", "resource", "type", "trace_id", "span_id", "parent_id",
+		"start", "duration", "error", "meta", "metrics", "events", "links"}
+	if w.rare() {
+		fields = append(fields, "unknown")
+	}
+	if w.r.Intn(10) == 0 {
+		// set again, overriding the first value
+		fields = append(fields, fields[w.r.Intn(len(fields))])
+	}
+	order := w.r.Perm(len(fields))
+	order = order[:len(order)-w.r.Intn(3)]
+
+	w.header(len(order), 0x80, 0xde)
+	for _, i := range order {
+		f := fields[i]
+		w.str(f, true)
+		switch f {
+		case "service", "name", "resource", "type":
+			if !w.nil() {
+				w.str(w.randomString(), false)
+			}
+		case "trace_id", "span_id", "parent_id":
+			if !w.nil() {
+				w.uint(uint64(w.r.Int63()) >> uint(w.r.Intn(64)))
+			}
+		case "start", "duration":
+			if !w.nil() {
+				w.int(w.r.Int63()>>uint(w.r.Intn(64)) - int64(w.r.Intn(100)))
+			}
+		case "error":
+			if w.nil() {
+				break
+			}
+			v := int64(w.r.Intn(3))
+			if w.rare() {
+				v = math.MaxInt32 + 1
+				w.fallback = true
+			}
+			w.int(v)
+		case "meta":
+			w.stringMap()
+		case "metrics":
+			if w.nil() {
+				break
+			}
+			n := w.r.Intn(4)
+			w.header(n, 0x80, 0xde)
+			for i := 0; i < n; i++ {
+				w.str(w.randomString(), false)
+				w.float([]float64{0, 1, 0.5, -3, 1e300}[w.r.Intn(5)])
+			}
+		case "unknown":
+			w.int(42)
+			w.fallback = true
+		case "events":
+			if w.nil() {
+				break
+			}
+			n := w.r.Intn(3)
+			w.header(n, 0x90, 0xdc)
+			for i := 0; i < n; i++ {
+				w.header(3, 0x80, 0xde)
+				w.str("ts", true)
+				w.int(w.r.Int63())
+				w.str("name", true)
+				w.str(w.randomString(), false)
+				w.str("attrs", true)
+				w.stringMap()
+			}
+		case "links":
+			if w.nil() {
+				break
+			}
+			n := w.r.Intn(3)
+			w.header(n, 0x90, 0xdc)
+			for i := 0; i < n; i++ {
+				w.header(2, 0x80, 0xde)
+				w.str("trace_id", true)
+				w.uint(uint64(w.r.Int63()))
+				w.str("span_id", true)
+				w.uint(uint64(w.r.Int63()))
+			}
+		}
+	}
+}
+
+func (w *corpusWriter) stringMap() {
+	if w.nil() {
+		return
+	}
+	n := w.r.Intn(4)
+	w.header(n, 0x80, 0xde)
+	for i := 0; i < n; i++ {
+		w.str(w.randomString(), false)
+		w.str(w.randomString(), false)
+	}
+}
+
+func (w *corpusWriter) traces() []byte {
+	w.buf, w.fallback = nil, false
+	n := w.r.Intn(4)
+	w.header(n, 0x90, 0xdc)
+	for i := 0; i < n; i++ {
+		spans := w.r.Intn(4)
+		w.header(spans, 0x90, 0xdc)
+		for j := 0; j < spans; j++ {
+			w.span()
+		}
+	}
+	return w.buf
+}
+
+func TestDecodeTracesMsgpackCorpus(t *testing.T) {
+	w := &corpusWriter{r: rand.New(rand.NewSource(42))}
+	var fast int
+	for i := 0; i < 2000; i++ {
+		b := w.traces()
+		assertSameDecoding(t, b)
+		if !assert.Equal(t, !w.fallback, decodesFast(b), "payload %x", b) {
+			break
+		}
+		if !w.fallback {
+			fast++
+		}
+	}
+	// most of the corpus exercises the fast path
+	assert.True(t, fast > 1000, "%d payloads decoded without fallback", fast)
+}
+
+// lengthLeads are the lead bytes of 16 and 32 bit lengths, from which
+// Traces.DecodeMsg allocates whatever the length, see corruptByte
+var lengthLeads = map[byte]bool{0xc5: true, 0xc6: true, 0xda: true, 0xdb: true, 0xdc: true, 0xdd: true, 0xde: true, 0xdf: true}
+
+// corruptByte returns a random byte, but the ones which could make
+// Traces.DecodeMsg allocate gigabytes
+func corruptByte(r *rand.Rand) byte {
+	for {
+		if b := byte(r.Intn(256)); !lengthLeads[b] {
+			return b
+		}
+	}
+}
+
+func TestDecodeTracesMsgpackInvalid(t *testing.T) {
+	w := &corpusWriter{r: rand.New(rand.NewSource(43)), compact: true}
+	for i := 0; i < 1000; i++ {
+		b := w.traces()
+		// truncated
+		assertSameDecoding(t, b[:w.r.Intn(len(b))])
+		// corrupted
+		c := append([]byte{}, b...)
+		c[w.r.Intn(len(c))] = corruptByte(w.r)
+		assertSameDecoding(t, c)
+	}
+
+	for _, b := range [][]byte{
+		nil,
+		{0xc0},
+		{0x91, 0xc0},
+		{0x91, 0x91, 0xc0},
+		{0x91, 0x91, 0x81, 0xa4, 'm', 'e', 't', 'a', 0x81, 0xa3, 'e', 'n', 'v', 0xc0},
+	} {
+		assert.False(t, decodesFast(b), "payload %x", b)
+		assertSameDecoding(t, b)
+	}
+
+	// unlike Traces.DecodeMsg, the fast path allocates nothing for lengths
+	// which cannot fit in the payload
+	for _, b := range [][]byte{
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x91, 0x91, 0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0x91, 0x91, 0x81, 0xa7, 's', 'e', 'r', 'v', 'i', 'c', 'e', 0xdb, 0xff, 0xff, 0xff, 0xff},
+	} {
+		assert.False(t, decodesFast(b), "payload %x", b)
+	}
+}
+
+func testTraces() Traces {
+	var traces Traces
+	for i := 0; i < 10; i++ {
+		var trace Trace
+		for j := 0; j < 10; j++ {
+			trace = append(trace, Span{
+				Service:  "web",
+				Name:     "http.request",
+				Resource: fmt.Sprintf("GET /users/%d", j),
+				TraceID:  uint64(i + 1),
+				SpanID:   uint64(j + 1),
+				ParentID: uint64(j),
+				Start:    1500000000000000000 + int64(j),
+				Duration: 12345678,
+				Error:    int32(j % 2),
+				Meta: map[string]string{
+					EnvKey:            "prod",
+					HTTPStatusCodeKey: "200",
+					"http.method":     "GET",
+					"http.url":        fmt.Sprintf("https://example.com/users/%d", j),
+				},
+				Metrics: map[string]float64{SpanSampleRateMetricKey: 1, "custom.metric": 0.5},
+				Type:    "http",
+			})
+		}
+		trace[0].Events = []SpanEvent{{Ts: 1500000000000000001, Name: "retry", Attrs: map[string]string{"attempt": "1"}}}
+		trace[1].Links = []SpanLink{{TraceID: 42, SpanID: 43}}
+		traces = append(traces, trace)
+	}
+	return traces
+}
+
+func TestDecodeTracesMsgpackEncoded(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testTraces()
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+	b := buf.Bytes()
+
+	assert.True(decodesFast(b))
+	decoded, err := DecodeTracesMsgpack(bytes.NewReader(b))
+	assert.Nil(err)
+	assert.Equal(traces, decoded)
+	assertSameDecoding(t, b)
+}
+
+func TestDecodeTracesMsgpackReuse(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testTraces()
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+	first, err := DecodeTracesMsgpack(bytes.NewReader(buf.Bytes()))
+	assert.Nil(err)
+
+	// the next payloads reuse the buffers, not the decoded strings
+	for i := range traces {
+		for j := range traces[i] {
+			traces[i][j].Service = "other"
+			traces[i][j].Meta["http.url"] = "https://example.com/other"
+		}
+	}
+	buf.Reset()
+	assert.Nil(msgp.Encode(&buf, traces))
+	for i := 0; i < 10; i++ {
+		_, err := DecodeTracesMsgpack(bytes.NewReader(buf.Bytes()))
+		assert.Nil(err)
+	}
+	assert.Equal(testTraces(), first)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("read failed") }
+
+func TestDecodeTracesMsgpackReadError(t *testing.T) {
+	traces, err := DecodeTracesMsgpack(errReader{})
+	assert.Nil(t, traces)
+	assert.EqualError(t, err, "read failed")
+}
+
+// BenchmarkDecodeTracesMsgpack decodes a payload of 100 spans
+func BenchmarkDecodeTracesMsgpack(b *testing.B) {
+	var buf bytes.Buffer
+	msgp.Encode(&buf, testTraces())
+	payload := buf.Bytes()
+
+	b.Run("generic", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decodeTracesGeneric(payload)
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			DecodeTracesMsgpack(bytes.NewReader(payload))
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// ErrTraceTooLarge is returned by TraceStream.Next for the traces larger than
+// the size it was given
+var ErrTraceTooLarge = errors.New("trace too large")
+
+// TraceStream decodes the traces of a JSON or msgpack payload one at a time,
+// so that the receiver can stop reading a payload once it read enough of it.
+// It decodes the same traces as Traces.DecodeMsg and json.Decoder do.
+type TraceStream struct {
+	json *json.Decoder
+	msgp *msgp.Reader
+	r    *countingReader
+
+	n    int // number of traces in the payload, -1 if unknown
+	read int // number of traces read
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// NewTraceStream reads the start of a payload of traces from r, msgpack
+// if msgpack is true and JSON otherwise, and returns the stream of its traces.
+func NewTraceStream(r io.Reader, msgpack bool) (*TraceStream, error) {
+	if !msgpack {
+		s := &TraceStream{json: json.NewDecoder(r), n: -1}
+		tok, err := s.json.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok != json.Delim('[') {
+			return nil, fmt.Errorf("expected an array of traces, got %v", tok)
+		}
+		return s, nil
+	}
+
+	s := &TraceStream{r: &countingReader{r: r}}
+	s.msgp = msgp.NewReader(s.r)
+	n, err := s.msgp.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	s.n = int(n)
+	return s, nil
+}
+
+// Len returns the number of traces of the payload, -1 if unknown until its
+// end, as for JSON payloads
+func (s *TraceStream) Len() int {
+	return s.n
+}
+
+// Read returns the number of traces read by Next, including those too large
+func (s *TraceStream) Read() int {
+	return s.read
+}
+
+// Next decodes the next trace of the payload and returns it along with its
+// size in the payload. Traces larger than max bytes, unless max is 0, are
+// not returned and ErrTraceTooLarge is returned with their size instead.
+// io.EOF is returned at the end of the payload.
+func (s *TraceStream) Next(max int64) (Trace, int64, error) {
+	if s.json != nil {
+		return s.nextJSON(max)
+	}
+
+	if s.read >= s.n {
+		return nil, 0, io.EOF
+	}
+	start := s.offset()
+	var t Trace
+	if err := t.DecodeMsg(s.msgp); err != nil {
+		return nil, s.offset() - start, err
+	}
+	s.read++
+	size := s.offset() - start
+	if max > 0 && size > max {
+		return nil, size, ErrTraceTooLarge
+	}
+	return t, size, nil
+}
+
+func (s *TraceStream) nextJSON(max int64) (Trace, int64, error) {
+	if !s.json.More() {
+		if _, err := s.json.Token(); err != nil {
+			return nil, 0, err
+		}
+		s.n = s.read
+		return nil, 0, io.EOF
+	}
+	var raw json.RawMessage
+	if err := s.json.Decode(&raw); err != nil {
+		return nil, 0, err
+	}
+	s.read++
+	size := int64(len(raw))
+	if max > 0 && size > max {
+		return nil, size, ErrTraceTooLarge
+	}
+	var t Trace
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, size, err
+	}
+	return t, size, nil
+}
+
+// offset returns the position of the msgpack decoder in the payload
+func (s *TraceStream) offset() int64 {
+	return s.r.count - int64(s.msgp.Buffered())
+}
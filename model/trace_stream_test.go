@@ -0,0 +1,137 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func testStreamTraces() Traces {
+	traces := Traces{
+		{{TraceID: 1, SpanID: 1, Service: "a", Name: "a.op", Resource: "GET /a", Meta: map[string]string{"k": "v"}}},
+		{},
+		{
+			{TraceID: 3, SpanID: 1, Service: "b", Name: "b.op", Resource: "SELECT 1"},
+			{TraceID: 3, SpanID: 2, ParentID: 1, Service: "b", Name: "b.op", Resource: strings.Repeat("x", 500)},
+		},
+		{{TraceID: 4, SpanID: 1, Service: "c", Name: "c.op", Resource: "c", Metrics: map[string]float64{"m": 1.5}}},
+	}
+	return traces
+}
+
+func TestTraceStream(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testStreamTraces()
+	var mp bytes.Buffer
+	assert.Nil(msgp.Encode(&mp, traces))
+	js, err := json.Marshal(traces)
+	assert.Nil(err)
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		msgpack bool
+		header  int64 // the size of what is not a trace in the payload
+		n       int
+	}{
+		{"msgpack", mp.Bytes(), true, 1, len(traces)},
+		{"json", js, false, int64(2 + len(traces) - 1), -1},
+	} {
+		s, err := NewTraceStream(bytes.NewReader(tc.payload), tc.msgpack)
+		assert.Nil(err, tc.name)
+		assert.Equal(tc.n, s.Len(), tc.name)
+
+		var decoded Traces
+		var sizes int64
+		for {
+			trace, size, err := s.Next(0)
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(err, tc.name)
+			decoded = append(decoded, trace)
+			sizes += size
+		}
+		assert.Equal(len(traces), s.Len(), tc.name)
+		assert.Equal(len(traces), s.Read(), tc.name)
+		assert.Equal(int64(len(tc.payload))-tc.header, sizes, tc.name)
+
+		var whole Traces
+		if tc.msgpack {
+			assert.Nil(msgp.Decode(bytes.NewReader(tc.payload), &whole))
+		} else {
+			assert.Nil(json.Unmarshal(tc.payload, &whole))
+		}
+		assert.Equal(whole, decoded, tc.name)
+	}
+}
+
+func TestTraceStreamTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testStreamTraces()
+	var mp bytes.Buffer
+	assert.Nil(msgp.Encode(&mp, traces))
+	js, err := json.Marshal(traces)
+	assert.Nil(err)
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		msgpack bool
+	}{
+		{"msgpack", mp.Bytes(), true},
+		{"json", js, false},
+	} {
+		s, err := NewTraceStream(bytes.NewReader(tc.payload), tc.msgpack)
+		assert.Nil(err, tc.name)
+
+		var ids []uint64
+		for {
+			trace, size, err := s.Next(300)
+			if err == io.EOF {
+				break
+			}
+			if len(ids) == 2 {
+				// the trace with the long resource
+				assert.Equal(ErrTraceTooLarge, err, tc.name)
+				assert.Nil(trace, tc.name)
+				assert.True(size > 500, tc.name)
+				ids = append(ids, 0)
+				continue
+			}
+			assert.Nil(err, tc.name)
+			assert.True(size <= 300, tc.name)
+			if len(trace) > 0 {
+				ids = append(ids, trace[0].TraceID)
+			} else {
+				ids = append(ids, 0)
+			}
+		}
+		assert.Equal([]uint64{1, 0, 0, 4}, ids, tc.name)
+	}
+}
+
+func TestTraceStreamErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewTraceStream(strings.NewReader(`{"traces": []}`), false)
+	assert.NotNil(err)
+	_, err = NewTraceStream(strings.NewReader(""), true)
+	assert.NotNil(err)
+
+	// the traces before the invalid one are decoded
+	s, err := NewTraceStream(strings.NewReader(`[[{"trace_id": 1}], [{"duration": "long"}]]`), false)
+	assert.Nil(err)
+	trace, _, err := s.Next(0)
+	assert.Nil(err)
+	assert.Equal(uint64(1), trace[0].TraceID)
+	_, _, err = s.Next(0)
+	assert.NotNil(err)
+}
@@ -31,3 +31,160 @@ func TestGetRootFromPartialTrace(t *testing.T) {
 
 	assert.Equal(trace.GetRoot().SpanID, uint64(12341))
 }
+
+func TestComputeTopLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1234, SpanID: 1, Service: "web", Name: "http.request"},
+		Span{TraceID: 1234, SpanID: 2, ParentID: 1, Service: "web", Name: "template.render", Metrics: map[string]float64{TraceTopLevelKey: 1}},
+		Span{TraceID: 1234, SpanID: 3, ParentID: 1, Service: "db", Name: "postgres.query"},
+		Span{TraceID: 1234, SpanID: 4, ParentID: 3, Service: "db", Name: "postgres.fetch"},
+		// the parent of orphans is not known to be in the same service
+		Span{TraceID: 1234, SpanID: 5, ParentID: 42, Service: "db", Name: "postgres.query"},
+	}
+	trace.ComputeTopLevel()
+
+	var topLevel []uint64
+	for i := range trace {
+		if trace[i].TopLevel() {
+			topLevel = append(topLevel, trace[i].SpanID)
+		}
+	}
+	assert.Equal([]uint64{1, 3, 5}, topLevel)
+	_, ok := trace[1].Metrics[TraceTopLevelKey]
+	assert.False(ok)
+}
+
+func newGiantTrace(n int) Trace {
+	trace := make(Trace, n)
+	for i := range trace {
+		trace[i] = Span{TraceID: 42, SpanID: uint64(i + 1), ParentID: 1, Service: "loop", Name: "iteration", Resource: "it", Duration: int64(i + 1)}
+		if i%100 == 50 {
+			// short errors
+			trace[i].Error = 1
+			trace[i].Duration = 1
+		}
+	}
+	trace[0].ParentID = 0
+	trace[0].Duration = 1
+	trace[0].Meta = map[string]string{"env": "prod"}
+	return trace
+}
+
+func TestTraceTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := newGiantTrace(10000)
+	root := trace.GetRoot()
+	truncated, newRoot := trace.Truncate(root, 5000)
+
+	assert.Len(truncated, 5000)
+	assert.Equal(uint64(1), newRoot.SpanID)
+	assert.Equal("true", newRoot.Meta[TraceTruncatedKey])
+	assert.Equal("prod", newRoot.Meta["env"])
+	assert.Equal(float64(5000), newRoot.Metrics[TraceDroppedSpansKey])
+
+	// the original trace is left untouched
+	assert.Len(trace, 10000)
+	assert.NotContains(root.Meta, TraceTruncatedKey)
+	assert.Nil(root.Metrics)
+
+	var errors int
+	seen := make(map[uint64]bool)
+	for i, s := range truncated {
+		seen[s.SpanID] = true
+		if s.Error != 0 {
+			errors++
+		}
+		if i > 0 {
+			assert.True(truncated[i-1].SpanID < s.SpanID, "spans keep their order")
+		}
+	}
+	assert.Equal(100, errors)
+	// the other kept spans are longer than all the dropped ones
+	minKept := int64(-1)
+	for _, s := range truncated {
+		if s.SpanID != 1 && s.Error == 0 && (minKept < 0 || s.Duration < minKept) {
+			minKept = s.Duration
+		}
+	}
+	for _, s := range trace {
+		if !seen[s.SpanID] {
+			assert.True(s.Duration < minKept, "span %d should be kept", s.SpanID)
+		}
+	}
+	assert.Equal(int64(5053), minKept)
+}
+
+func TestTraceTruncateSmall(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := newGiantTrace(10)
+	root := trace.GetRoot()
+	truncated, newRoot := trace.Truncate(root, 10)
+	assert.Equal(trace, truncated)
+	assert.True(root == newRoot)
+	assert.NotContains(root.Meta, TraceTruncatedKey)
+}
+
+func TestTraceInheritResources(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /users"},
+		Span{SpanID: 2, ParentID: 1, Service: "web", Name: "render"},
+		Span{SpanID: 3, ParentID: 2, Service: "db", Name: "query"},
+		Span{SpanID: 4, ParentID: 2, Service: "db", Name: "query", Resource: "SELECT users"},
+		Span{SpanID: 5, ParentID: 4, Service: "db", Name: "fetch"},
+		// an orphan, its parent is not in the trace
+		Span{SpanID: 6, ParentID: 42, Service: "cache", Name: "get"},
+		Span{SpanID: 7, ParentID: 6, Service: "cache"},
+		Span{SpanID: 8, ParentID: 42, Service: "cache"},
+	}
+	inherited := trace.InheritResources()
+
+	assert.Equal(map[string]int{"web": 1, "db": 2, "cache": 3}, inherited)
+	resources := make(map[uint64]string)
+	for _, s := range trace {
+		resources[s.SpanID] = s.Resource
+	}
+	assert.Equal(map[uint64]string{
+		1: "GET /users",
+		2: "GET /users",
+		3: "GET /users",
+		4: "SELECT users",
+		5: "SELECT users",
+		6: "get",
+		7: "get",
+		8: UnknownResource,
+	}, resources)
+
+	// all spans have a resource now
+	assert.Nil(trace.InheritResources())
+}
+
+func TestTraceInheritResourcesRootName(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{SpanID: 1, Service: "worker", Name: "job.run"},
+		Span{SpanID: 2, ParentID: 1, Service: "worker", Name: "job.step"},
+	}
+	assert.Equal(map[string]int{"worker": 2}, trace.InheritResources())
+	assert.Equal("job.run", trace[0].Resource)
+	assert.Equal("job.run", trace[1].Resource)
+}
+
+func TestTraceInheritResourcesCycle(t *testing.T) {
+	assert := assert.New(t)
+
+	// no root, spans are each other's parent
+	trace := Trace{
+		Span{SpanID: 1, ParentID: 2, Service: "s", Name: "a"},
+		Span{SpanID: 2, ParentID: 1, Service: "s"},
+	}
+	assert.Equal(map[string]int{"s": 2}, trace.InheritResources())
+	assert.Equal("a", trace[0].Resource)
+	assert.Equal(UnknownResource, trace[1].Resource)
+}
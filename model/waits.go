@@ -0,0 +1,55 @@
+package model
+
+// SpanWaits are how long a span waited before its first child started and
+// after its last child ended, e.g. queued in a pool or serializing a response,
+// in nanoseconds
+type SpanWaits struct {
+	Before int64
+	After  int64
+}
+
+// ComputeWaits returns the waits of the spans of the trace with children, by
+// span ID. The children are clipped to the interval of their parent, the ones
+// outside of it, e.g. async work outliving the parent, are ignored, and
+// overlapping children cover their union: only the earliest start and latest
+// end matter.
+func ComputeWaits(t Trace) map[uint64]SpanWaits {
+	children := t.ChildrenMap()
+	var waits map[uint64]SpanWaits
+	for i := range t {
+		s := &t[i]
+		start, end := s.Start, s.End()
+		first, last := end, start
+		covered := false
+		for _, c := range children[s.SpanID] {
+			if c == s {
+				continue
+			}
+			cstart, cend := c.Start, c.End()
+			if cend <= start || cstart >= end {
+				continue
+			}
+			if cstart < start {
+				cstart = start
+			}
+			if cend > end {
+				cend = end
+			}
+			if cstart < first {
+				first = cstart
+			}
+			if cend > last {
+				last = cend
+			}
+			covered = true
+		}
+		if !covered {
+			continue
+		}
+		if waits == nil {
+			waits = make(map[uint64]SpanWaits)
+		}
+		waits[s.SpanID] = SpanWaits{Before: first - start, After: end - last}
+	}
+	return waits
+}
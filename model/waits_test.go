@@ -0,0 +1,31 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeWaits(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		// the overlapping children cover [100, 700]
+		Span{TraceID: 1, SpanID: 1, Start: 0, Duration: 1000},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 100, Duration: 300},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Start: 300, Duration: 400},
+		// the skewed child starting before its parent is clipped to it
+		Span{TraceID: 1, SpanID: 4, ParentID: 2, Start: 90, Duration: 30},
+		Span{TraceID: 1, SpanID: 5, ParentID: 2, Start: 150, Duration: 200},
+		// the async child of 3 runs after it ended: 3 has no waits
+		Span{TraceID: 1, SpanID: 6, ParentID: 3, Start: 800, Duration: 100},
+	}
+
+	assert.Equal(map[uint64]SpanWaits{
+		1: {Before: 100, After: 300},
+		2: {Before: 0, After: 50},
+	}, ComputeWaits(tr))
+
+	// no children, no waits
+	assert.Nil(ComputeWaits(Trace{Span{TraceID: 1, SpanID: 1, Duration: 1000}}))
+}
@@ -0,0 +1,180 @@
+package quantile
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+/************************************************************************************
+	ACCURACY, check the rank error of the quantiles against the exact ranks of the
+	inserted values, for single and merged summaries
+************************************************************************************/
+
+// accuracyMergeParts is the number of summaries merged by the merge tests
+const accuracyMergeParts = 8
+
+var accuracyQuantiles = []float64{0, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999, 0.9999, 1}
+
+var accuracyDistributions = []struct {
+	name string
+	gen  func(r *rand.Rand) float64
+}{
+	{"uniform", func(r *rand.Rand) float64 { return r.Float64() * 1e6 }},
+	{"exponential", func(r *rand.Rand) float64 { return r.ExpFloat64() * 1e3 }},
+	{"lognormal", func(r *rand.Rand) float64 { return math.Exp(10 + 2*r.NormFloat64()) }},
+	{"bimodal", func(r *rand.Rand) float64 {
+		// e.g. cache hits and misses
+		if r.Intn(4) == 0 {
+			return 5e4 + 5e3*r.NormFloat64()
+		}
+		return 1e3 + 1e2*r.NormFloat64()
+	}},
+}
+
+func accuracySizes() []int {
+	if testing.Short() {
+		return []int{1000, 100000}
+	}
+	return []int{1000, 100000, 1000000}
+}
+
+// rankError returns how far the rank of v in sorted, the exact inserted
+// values, is from the rank of quantile q. Equal values share all their ranks.
+func rankError(sorted []float64, q, v float64) float64 {
+	r := q * float64(len(sorted))
+	lo := sort.SearchFloat64s(sorted, v)
+	hi := sort.Search(len(sorted), func(i int) bool { return sorted[i] > v })
+	switch {
+	case r < float64(lo):
+		return float64(lo) - r
+	case r > float64(hi):
+		return r - float64(hi)
+	}
+	return 0
+}
+
+// checkRankError fails if the rank error of a quantile is above eps*N,
+// reporting the worst one
+func checkRankError(t *testing.T, name string, sorted []float64, eps float64, quantile func(q float64) float64) {
+	var worstQ, worstV, worst float64
+	for _, q := range accuracyQuantiles {
+		v := quantile(q)
+		if err := rankError(sorted, q, v); err > worst {
+			worstQ, worstV, worst = q, v, err
+		}
+	}
+	// ranks are integers, allow for the rounding of q*N
+	if bound := eps*float64(len(sorted)) + 1; worst > bound {
+		t.Errorf("%s: quantile %v returned %v with a rank error of %v (%.4f*N), above %v (%v*N)",
+			name, worstQ, worstV, worst, worst/float64(len(sorted)), bound, eps)
+	}
+}
+
+// testAccuracy generates values for each distribution and size, inserts
+// them in a single summary and in summaries which are then merged, and
+// checks the rank error of both
+func testAccuracy(t *testing.T, single, merged func(vals []float64) func(q float64) float64) {
+	for _, d := range accuracyDistributions {
+		for _, n := range accuracySizes() {
+			r := rand.New(rand.NewSource(42))
+			vals := make([]float64, n)
+			for i := range vals {
+				vals[i] = d.gen(r)
+			}
+			singleQuantile := single(vals)
+			mergedQuantile := merged(vals)
+
+			sort.Float64s(vals)
+			name := fmt.Sprintf("%s/%d", d.name, n)
+			checkRankError(t, name, vals, EPSILON, singleQuantile)
+			// each merged summary brings its own EPSILON
+			checkRankError(t, name+"/merged", vals, 2*EPSILON, mergedQuantile)
+		}
+	}
+}
+
+func testSummaryAccuracy(t *testing.T) {
+	testAccuracy(t,
+		func(vals []float64) func(q float64) float64 {
+			s := NewSummary()
+			for i, v := range vals {
+				s.Insert(v, uint64(i))
+			}
+			return s.Quantile
+		},
+		func(vals []float64) func(q float64) float64 {
+			parts := make([]*Summary, accuracyMergeParts)
+			for i := range parts {
+				parts[i] = NewSummary()
+			}
+			for i, v := range vals {
+				parts[i%len(parts)].Insert(v, uint64(i))
+			}
+			s := NewSummary()
+			for _, p := range parts {
+				s.Merge(p)
+			}
+			return s.Quantile
+		},
+	)
+}
+
+func TestSliceSummaryAccuracy(t *testing.T) {
+	testAccuracy(t,
+		func(vals []float64) func(q float64) float64 {
+			s := NewSliceSummary()
+			for i, v := range vals {
+				s.Insert(v, uint64(i))
+			}
+			return s.Quantile
+		},
+		func(vals []float64) func(q float64) float64 {
+			parts := make([]*SliceSummary, accuracyMergeParts)
+			for i := range parts {
+				parts[i] = NewSliceSummary()
+			}
+			for i, v := range vals {
+				parts[i%len(parts)].Insert(v, uint64(i))
+			}
+			s := NewSliceSummary()
+			for _, p := range parts {
+				s.Merge(p)
+			}
+			return s.Quantile
+		},
+	)
+}
+
+func TestSliceSummaryEpsilonAccuracy(t *testing.T) {
+	for _, eps := range []float64{0.005, 0.02} {
+		for _, d := range accuracyDistributions {
+			r := rand.New(rand.NewSource(42))
+			vals := make([]float64, 100000)
+			for i := range vals {
+				vals[i] = d.gen(r)
+			}
+
+			s := NewSliceSummaryWithEpsilon(eps)
+			parts := make([]*SliceSummary, accuracyMergeParts)
+			for i := range parts {
+				parts[i] = NewSliceSummaryWithEpsilon(eps)
+			}
+			for i, v := range vals {
+				s.Insert(v, uint64(i))
+				parts[i%len(parts)].Insert(v, uint64(i))
+			}
+			merged := NewSliceSummaryWithEpsilon(eps)
+			for _, p := range parts {
+				merged.Merge(p)
+			}
+
+			sort.Float64s(vals)
+			name := fmt.Sprintf("%s/%v", d.name, eps)
+			checkRankError(t, name, vals, eps, s.Quantile)
+			checkRankError(t, name+"/merged", vals, 2*eps, merged.Quantile)
+		}
+	}
+}
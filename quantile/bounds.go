@@ -0,0 +1,92 @@
+package quantile
+
+// boundedQuery finds the values at the rank r of a quantile and at its
+// bounds r-epsN and r+epsN, visiting the entries of a summary once in order.
+// The true rank of the value found for r is within these bounds, so the
+// exact quantile is between the lower and the upper values. Ranks out of
+// the summary are clamped to its min and max.
+type boundedQuery struct {
+	ranks  [3]int     // lower, value and upper ranks, increasing
+	values [3]float64 // the values found for ranks
+	found  int        // number of values found
+	epsN   int
+	rmin   int
+}
+
+func newBoundedQuery(q float64, n int, eps float64) *boundedQuery {
+	r := int(q*float64(n) + 0.5)
+	epsN := int(eps * float64(n))
+	return &boundedQuery{
+		ranks: [3]int{r - epsN, r, r + epsN},
+		epsN:  epsN,
+	}
+}
+
+// visit visits the entry t, followed by next, and tells if all the values
+// were found
+func (b *boundedQuery) visit(t, next Entry) bool {
+	b.rmin += t.G
+	for b.found < len(b.ranks) && b.ranks[b.found]+b.epsN < b.rmin+next.G+next.Delta {
+		b.values[b.found] = t.V
+		b.found++
+	}
+	return b.found == len(b.ranks)
+}
+
+// last visits the last entry t, and returns the lower, the value and the
+// upper values
+func (b *boundedQuery) last(t Entry) (value, lower, upper float64) {
+	for ; b.found < len(b.ranks); b.found++ {
+		b.values[b.found] = t.V
+	}
+	return b.values[1], b.values[0], b.values[2]
+}
+
+// QuantileWithBounds returns an EPSILON estimate of the element at quantile
+// 'q' (0 <= q <= 1), as Quantile, along with the elements at EPSILON*N ranks
+// below and above it, between which the exact quantile is.
+func (s *Summary) QuantileWithBounds(q float64) (value, lower, upper float64) {
+	b := newBoundedQuery(q, s.N, EPSILON)
+
+	if s.data == nil {
+		if len(s.small) == 0 {
+			return 0, 0, 0
+		}
+		for i := 0; i < len(s.small)-1; i++ {
+			if b.visit(s.small[i], s.small[i+1]) {
+				break
+			}
+		}
+		return b.last(s.small[len(s.small)-1])
+	}
+
+	elt := s.data.head.next[0]
+	if elt == nil {
+		// empty summary
+		return 0, 0, 0
+	}
+	for ; elt.next[0] != nil; elt = elt.next[0] {
+		if b.visit(elt.value, elt.next[0].value) {
+			break
+		}
+	}
+	return b.last(elt.value)
+}
+
+// QuantileWithBounds returns an estimate of the element at quantile 'q'
+// (0 <= q <= 1), as Quantile, along with the elements at eps*N ranks below
+// and above it, eps being the precision of the summary. The exact quantile
+// is between them.
+func (s *SliceSummary) QuantileWithBounds(q float64) (value, lower, upper float64) {
+	if len(s.Entries) == 0 {
+		return 0, 0, 0
+	}
+
+	b := newBoundedQuery(q, s.N, s.Precision())
+	for i := 0; i < len(s.Entries)-1; i++ {
+		if b.visit(s.Entries[i], s.Entries[i+1]) {
+			break
+		}
+	}
+	return b.last(s.Entries[len(s.Entries)-1])
+}
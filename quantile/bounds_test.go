@@ -0,0 +1,108 @@
+package quantile
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var boundsDeciles = []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+
+// exactQuantile returns the value at the rank of quantile q in sorted, the
+// rank being rounded as the summaries round it
+func exactQuantile(sorted []float64, q float64) float64 {
+	r := int(q*float64(len(sorted)) + 0.5)
+	if r > 0 {
+		r--
+	}
+	if r >= len(sorted) {
+		r = len(sorted) - 1
+	}
+	return sorted[r]
+}
+
+// checkBounds fails if the exact quantile is not within the bounds for every
+// decile, or if the value is not the one of Quantile
+func checkBounds(t *testing.T, name string, sorted []float64,
+	quantile func(q float64) float64, bounded func(q float64) (float64, float64, float64)) {
+	for _, q := range boundsDeciles {
+		v, lower, upper := bounded(q)
+		exact := exactQuantile(sorted, q)
+		if v != quantile(q) {
+			t.Errorf("%s: quantile %v is %v, Quantile returned %v", name, q, v, quantile(q))
+		}
+		if exact < lower || exact > upper {
+			t.Errorf("%s: quantile %v is %v, out of [%v, %v]", name, q, exact, lower, upper)
+		}
+		if lower > v || v > upper {
+			t.Errorf("%s: quantile %v of %v is out of its bounds [%v, %v]", name, q, v, lower, upper)
+		}
+	}
+}
+
+func testQuantileWithBoundsUniform(t *testing.T) {
+	seeds := 50
+	if testing.Short() {
+		seeds = 10
+	}
+	for seed := 0; seed < seeds; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		for _, n := range []int{10, 1000, 20000} {
+			s := NewSummary()
+			ss := NewSliceSummary()
+			merged := NewSliceSummary()
+			part := NewSliceSummary()
+			vals := make([]float64, n)
+			for i := range vals {
+				vals[i] = r.Float64() * 1e6
+				s.Insert(vals[i], uint64(i))
+				ss.Insert(vals[i], uint64(i))
+				part.Insert(vals[i], uint64(i))
+				if (i+1)%(n/5+1) == 0 {
+					merged.Merge(part)
+					part = NewSliceSummary()
+				}
+			}
+			merged.Merge(part)
+			sort.Float64s(vals)
+
+			checkBounds(t, "summary", vals, s.Quantile, s.QuantileWithBounds)
+			checkBounds(t, "slice summary", vals, ss.Quantile, ss.QuantileWithBounds)
+			checkBounds(t, "merged slice summary", vals, merged.Quantile, merged.QuantileWithBounds)
+		}
+	}
+}
+
+func testQuantileWithBoundsClamped(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummary()
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	v, lower, upper := s.QuantileWithBounds(0)
+	assert.Equal(float64(0), v)
+	assert.Equal(float64(0), lower)
+	assert.True(upper > 0)
+	// the ranks of the bounds are within 2*EPSILON*N of the exact one
+	_, lower, upper = s.QuantileWithBounds(0.5)
+	assert.True(lower <= 499 && 499 <= upper)
+	assert.True(upper-lower <= 4*EPSILON*1000)
+	v, lower, upper = s.QuantileWithBounds(1)
+	assert.Equal(float64(999), v)
+	assert.Equal(float64(999), upper)
+
+	// a single value
+	ss := NewSliceSummary()
+	ss.Insert(42, 0)
+	v, lower, upper = ss.QuantileWithBounds(0.5)
+	assert.Equal([]float64{42, 42, 42}, []float64{v, lower, upper})
+
+	// empty summaries
+	v, lower, upper = NewSummary().QuantileWithBounds(0.5)
+	assert.Equal([]float64{0, 0, 0}, []float64{v, lower, upper})
+	v, lower, upper = NewSliceSummary().QuantileWithBounds(0.5)
+	assert.Equal([]float64{0, 0, 0}, []float64{v, lower, upper})
+}
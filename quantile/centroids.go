@@ -0,0 +1,63 @@
+package quantile
+
+// Centroid is a weighted point of a distribution, which is how the metrics
+// intake represents distributions
+type Centroid struct {
+	Value float64
+	Count int64
+}
+
+// ToCentroids collapses the summary into at most maxCentroids centroids of
+// about the same weight, each at the weighted mean of the values it stands
+// for. Their counts sum up to N. If maxCentroids is 0 there is one centroid
+// per entry of the summary.
+func (s *Summary) ToCentroids(maxCentroids int) []Centroid {
+	var entries []Entry
+	if s.data != nil || s.small != nil {
+		entries = s.entries()
+	}
+	return toCentroids(entries, maxCentroids)
+}
+
+// ToCentroids collapses the summary into at most maxCentroids centroids, see
+// Summary.ToCentroids
+func (s *SliceSummary) ToCentroids(maxCentroids int) []Centroid {
+	return toCentroids(s.Entries, maxCentroids)
+}
+
+// toCentroids groups sorted GK entries into at most maxCentroids centroids:
+// the k-th one ends at the first entry reaching a cumulated weight of
+// (k+1)*total/maxCentroids.
+func toCentroids(entries []Entry, maxCentroids int) []Centroid {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += int64(e.G)
+	}
+	if maxCentroids <= 0 || maxCentroids > len(entries) {
+		maxCentroids = len(entries)
+	}
+	max := int64(maxCentroids)
+
+	centroids := make([]Centroid, 0, maxCentroids)
+	var sum float64
+	var count, cumulated int64
+	for _, e := range entries {
+		if e.G == 0 {
+			continue
+		}
+		sum += e.V * float64(e.G)
+		count += int64(e.G)
+		cumulated += int64(e.G)
+		// the last boundary is total, so the last entry always ends a
+		// centroid and there are never more than maxCentroids of them
+		if boundary := (int64(len(centroids)+1)*total + max - 1) / max; cumulated >= boundary {
+			centroids = append(centroids, Centroid{Value: sum / float64(count), Count: count})
+			sum, count = 0, 0
+		}
+	}
+	return centroids
+}
@@ -0,0 +1,65 @@
+package quantile
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func centroidsCount(centroids []Centroid) int {
+	var n int64
+	for _, c := range centroids {
+		n += c.Count
+	}
+	return int(n)
+}
+
+func testToCentroids(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummary()
+	ss := NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		v := rand.NormFloat64()*100 + 1000
+		s.Insert(v, uint64(i))
+		ss.Insert(v, uint64(i))
+	}
+
+	for _, max := range []int{1, 2, 7, 32, 100, 0} {
+		for name, centroids := range map[string][]Centroid{
+			"skiplist": s.ToCentroids(max),
+			"slice":    ss.ToCentroids(max),
+		} {
+			assert.Equal(10000, centroidsCount(centroids), "%s max:%d", name, max)
+			if max > 0 {
+				assert.True(len(centroids) <= max, "%s max:%d got %d centroids", name, max, len(centroids))
+			}
+			for i := 1; i < len(centroids); i++ {
+				assert.True(centroids[i-1].Value <= centroids[i].Value, "%s max:%d centroids not sorted", name, max)
+			}
+		}
+	}
+
+	// a single centroid is the mean, and the median is close to it
+	mean := s.ToCentroids(1)[0].Value
+	assert.InEpsilon(1000, mean, 0.01)
+	centroids := s.ToCentroids(32)
+	assert.Len(centroids, 32)
+	assert.InEpsilon(s.Quantile(0.5), centroids[15].Value, 0.05)
+}
+
+func testToCentroidsEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	ss := NewSliceSummary()
+	for _, v := range []float64{1, 1, 2, 3, 10} {
+		ss.Insert(v, 0)
+	}
+	assert.Equal([]Centroid{{1, 1}, {1, 1}, {2, 1}, {3, 1}, {10, 1}}, ss.ToCentroids(0))
+	assert.Equal([]Centroid{{1, 2}, {2.5, 2}, {10, 1}}, ss.ToCentroids(3))
+	assert.Equal([]Centroid{{3.4, 5}}, ss.ToCentroids(1))
+
+	assert.Nil(NewSummary().ToCentroids(10))
+	assert.Nil(NewSliceSummary().ToCentroids(10))
+}
@@ -0,0 +1,34 @@
+//go:build gofuzz
+// +build gofuzz
+
+package quantile
+
+// FuzzSummaryUnmarshal is a go-fuzz target checking that decoding arbitrary
+// bytes never panics, and that decoded summaries can be queried. Run with:
+//
+//	go-fuzz-build -func FuzzSummaryUnmarshal github.com/DataDog/datadog-trace-agent/quantile
+//	go-fuzz -bin quantile-fuzz.zip -workdir quantile/testdata/fuzz
+func FuzzSummaryUnmarshal(data []byte) int {
+	interesting := 0
+
+	var js Summary
+	if err := js.UnmarshalJSON(data); err == nil {
+		queryAll(&js)
+		interesting = 1
+	}
+
+	var gs Summary
+	if err := gs.GobDecode(data); err == nil {
+		queryAll(&gs)
+		interesting = 1
+	}
+
+	return interesting
+}
+
+func queryAll(s *Summary) {
+	for _, q := range []float64{0, 0.25, 0.5, 0.75, 0.99, 1} {
+		s.Quantile(q)
+	}
+	s.BySlices()
+}
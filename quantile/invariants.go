@@ -0,0 +1,52 @@
+package quantile
+
+import "fmt"
+
+// CompressionStats describes the work done by the compressions of a Summary
+type CompressionStats struct {
+	Passes  int // number of compressions
+	Removed int // number of entries removed by compressions
+	// MaxErrorRatio is the greatest (g+delta)/errorBound(N) seen across
+	// the entries left by compressions, above 1 the GK invariant is broken
+	MaxErrorRatio float64
+}
+
+// errorBound is the maximum g+delta of an entry in a summary of n values.
+// The GK bound is 2*EPSILON*n, new entries being inserted with
+// delta=int(2*EPSILON*n) like in the paper, it allows for their g of 1.
+func errorBound(n int) int {
+	return int(2*EPSILON*float64(n)) + 1
+}
+
+// CompressionStats returns the statistics of the compressions of the summary
+// since it was created or decoded.
+func (s *Summary) CompressionStats() CompressionStats {
+	return s.compression
+}
+
+// CheckInvariants walks the summary and returns an error describing the
+// first entry breaking the GK invariants: values are non-decreasing, every
+// g+delta is within errorBound(N) and the g of all entries add up to N.
+// It is linear in the size of the summary, so it's meant for tests and
+// debugging only.
+func (s *Summary) CheckInvariants() error {
+	bound := errorBound(s.N)
+	var sumG int
+	entries := s.entries()
+	for i, e := range entries {
+		if i > 0 && e.V < entries[i-1].V {
+			return fmt.Errorf("entry %d: value %v lower than previous value %v", i, e.V, entries[i-1].V)
+		}
+		if e.G < 1 || e.Delta < 0 {
+			return fmt.Errorf("entry %d: invalid g %d or delta %d", i, e.G, e.Delta)
+		}
+		if e.G+e.Delta > bound {
+			return fmt.Errorf("entry %d: g+delta %d above bound %d (N=%d)", i, e.G+e.Delta, bound, s.N)
+		}
+		sumG += e.G
+	}
+	if sumG != s.N {
+		return fmt.Errorf("sum of g %d does not match N=%d", sumG, s.N)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package quantile
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSummaryCheckInvariants(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSummary()
+	assert.Nil(s.CheckInvariants())
+	for i := 0; i < 10000; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	assert.Nil(s.CheckInvariants())
+
+	// corrupt an entry in the middle of the summary
+	elt := s.data.head.next[0]
+	for i := 0; i < s.data.length/2; i++ {
+		elt = elt.next[0]
+	}
+	delta := elt.value.Delta
+	elt.value.Delta = s.N
+	assert.Contains(s.CheckInvariants().Error(), "above bound")
+	elt.value.Delta = delta
+
+	v := elt.value.V
+	elt.value.V = -1
+	assert.Contains(s.CheckInvariants().Error(), "lower than previous value")
+	elt.value.V = v
+
+	elt.value.G++
+	assert.Contains(s.CheckInvariants().Error(), "does not match N")
+	elt.value.G--
+
+	assert.Nil(s.CheckInvariants())
+}
+
+func testSummaryInvariantsRandomInserts(t *testing.T) {
+	assert := assert.New(t)
+
+	r := rand.New(rand.NewSource(42))
+	s := NewSummary()
+	for i := 1; i <= 100000; i++ {
+		s.Insert(r.Float64()*1000, uint64(i))
+		if i%1000 == 0 {
+			if err := s.CheckInvariants(); err != nil {
+				t.Fatalf("after %d inserts: %v", i, err)
+			}
+		}
+	}
+
+	stats := s.CompressionStats()
+	assert.True(stats.Passes > 0)
+	assert.True(stats.Removed > 0)
+	assert.True(stats.MaxErrorRatio > 0)
+	assert.True(stats.MaxErrorRatio <= 1, "max error ratio %f", stats.MaxErrorRatio)
+}
@@ -10,6 +10,14 @@ import (
 type SliceSummary struct {
 	Entries []Entry
 	N       int
+
+	// FirstTs and LastTs are the timestamp range of the values, see Summary
+	FirstTs int64 `json:",omitempty"`
+	LastTs  int64 `json:",omitempty"`
+
+	// Epsilon is the precision of the summary, EPSILON if 0, see
+	// NewSliceSummaryWithEpsilon
+	Epsilon float64 `json:",omitempty"`
 }
 
 // NewSliceSummary allocates a new GK summary backed by a DLL
@@ -17,6 +25,24 @@ func NewSliceSummary() *SliceSummary {
 	return &SliceSummary{}
 }
 
+// NewSliceSummaryWithEpsilon allocates a new GK summary with the precision
+// eps instead of EPSILON: its quantiles are within eps*N ranks of the exact
+// ones, and it keeps about 1/eps entries. 0 is EPSILON.
+func NewSliceSummaryWithEpsilon(eps float64) *SliceSummary {
+	if eps == EPSILON {
+		eps = 0
+	}
+	return &SliceSummary{Epsilon: eps}
+}
+
+// Precision returns the epsilon of the summary
+func (s *SliceSummary) Precision() float64 {
+	if s.Epsilon <= 0 {
+		return EPSILON
+	}
+	return s.Epsilon
+}
+
 func (s SliceSummary) String() string {
 	var b bytes.Buffer
 	b.WriteString("summary size: ")
@@ -38,10 +64,11 @@ func (s SliceSummary) String() string {
 
 // Insert inserts a new value v in the summary paired with t (the ID of the span it was reported from)
 func (s *SliceSummary) Insert(v float64, t uint64) {
+	eps := s.Precision()
 	newEntry := Entry{
 		V:     v,
 		G:     1,
-		Delta: int(2 * EPSILON * float64(s.N)),
+		Delta: int(2 * eps * float64(s.N)),
 	}
 
 	i := sort.Search(len(s.Entries), func(i int) bool { return v < s.Entries[i].V })
@@ -56,13 +83,24 @@ func (s *SliceSummary) Insert(v float64, t uint64) {
 	s.Entries[i] = newEntry
 	s.N++
 
-	if s.N%int(1.0/float64(2.0*EPSILON)) == 0 {
-		s.compress()
+	// inserting in a slice is linear in its size so, unlike Summary, keep
+	// it tight by compressing at a fixed rate
+	if s.N%int(1.0/float64(2.0*eps)) == 0 {
+		s.Compress()
 	}
 }
 
-func (s *SliceSummary) compress() {
-	epsN := int(2 * EPSILON * float64(s.N))
+// InsertWithTime is Insert, also recording ts in the timestamp range of the
+// summary, see Summary.InsertWithTime
+func (s *SliceSummary) InsertWithTime(v float64, t uint64, ts int64) {
+	s.Insert(v, t)
+	s.FirstTs, s.LastTs = widenTimeRange(s.FirstTs, s.LastTs, ts, ts)
+}
+
+// Compress merges the entries of the summary which are not needed to keep
+// its precision, see Summary.Compress.
+func (s *SliceSummary) Compress() {
+	epsN := int(2 * s.Precision() * float64(s.N))
 
 	var j, sum int
 	for i := len(s.Entries) - 1; i >= 2; i = j - 1 {
@@ -88,7 +126,8 @@ func (s *SliceSummary) compress() {
 	}
 }
 
-// Quantile returns an EPSILON estimate of the element at quantile 'q' (0 <= q <= 1)
+// Quantile returns an estimate of the element at quantile 'q' (0 <= q <= 1),
+// within the precision of the summary
 func (s *SliceSummary) Quantile(q float64) float64 {
 	if len(s.Entries) == 0 {
 		return 0
@@ -98,7 +137,7 @@ func (s *SliceSummary) Quantile(q float64) float64 {
 	r := int(q*float64(s.N) + 0.5)
 
 	var rmin int
-	epsN := int(EPSILON * float64(s.N))
+	epsN := int(s.Precision() * float64(s.N))
 
 	for i := 0; i < len(s.Entries)-1; i++ {
 		t := s.Entries[i]
@@ -107,21 +146,23 @@ func (s *SliceSummary) Quantile(q float64) float64 {
 		rmin += t.G
 
 		if r+epsN < rmin+n.G+n.Delta {
-			if r+epsN < rmin+n.G {
-				return t.V
-			}
-			return n.V
+			return t.V
 		}
 	}
 
 	return s.Entries[len(s.Entries)-1].V
 }
 
-// Merge two summaries entries together
+// Merge two summaries entries together. The merged summary has the coarser
+// precision of the two.
 func (s *SliceSummary) Merge(s2 *SliceSummary) {
 	if s2.N == 0 {
 		return
 	}
+	if s2.Precision() > s.Precision() {
+		s.Epsilon = s2.Epsilon
+	}
+	s.FirstTs, s.LastTs = widenTimeRange(s.FirstTs, s.LastTs, s2.FirstTs, s2.LastTs)
 	if s.N == 0 {
 		s.N = s2.N
 		s.Entries = make([]Entry, 0, len(s2.Entries))
@@ -129,32 +170,30 @@ func (s *SliceSummary) Merge(s2 *SliceSummary) {
 		return
 	}
 
-	pos := 0
-	end := len(s.Entries) - 1
-
-	empties := make([]Entry, len(s2.Entries))
-	s.Entries = append(s.Entries, empties...)
-
-	for _, e := range s2.Entries {
-		for pos <= end {
-			if e.V > s.Entries[pos].V {
-				pos++
-				continue
+	// on equal values, the entries of s come first, see Summary.Merge
+	entries := make([]Entry, 0, len(s.Entries)+len(s2.Entries))
+	var i, j int
+	for i < len(s.Entries) || j < len(s2.Entries) {
+		if j == len(s2.Entries) || (i < len(s.Entries) && s.Entries[i].V <= s2.Entries[j].V) {
+			e := s.Entries[i]
+			if j < len(s2.Entries) {
+				e.Delta = mergedDelta(e, s2.Entries[j])
 			}
-			copy(s.Entries[pos+1:end+2], s.Entries[pos:end+1])
-			s.Entries[pos] = e
-			pos++
-			end++
-			break
+			entries = append(entries, e)
+			i++
+			continue
 		}
-		if pos > end {
-			s.Entries[pos] = e
-			pos++
+		e := s2.Entries[j]
+		if i < len(s.Entries) {
+			e.Delta = mergedDelta(e, s.Entries[i])
 		}
+		entries = append(entries, e)
+		j++
 	}
+	s.Entries = entries
 	s.N += s2.N
 
-	s.compress()
+	s.Compress()
 }
 
 // Copy allocates a new summary with the same data
@@ -163,6 +202,8 @@ func (s *SliceSummary) Copy() *SliceSummary {
 	s2.Entries = make([]Entry, len(s.Entries))
 	copy(s2.Entries, s.Entries)
 	s2.N = s.N
+	s2.FirstTs, s2.LastTs = s.FirstTs, s.LastTs
+	s2.Epsilon = s.Epsilon
 	return s2
 }
 
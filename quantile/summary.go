@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"sync"
 )
 
 /*
@@ -18,18 +21,72 @@ Should reimplement everything from scratch from the paper
 http://infolab.stanford.edu/~datar/courses/cs361a/papers/quantiles.pdf
 
 This implementation is backed by a skiplist to make inserting elements into the
-summary faster.  Querying is still O(n).
+summary faster.  Querying is still O(n). Small summaries are kept in a sorted
+slice instead, see SmallSummaryMaxEntries.
 
 */
 
 // EPSILON is the precision of the rank returned by our quantile queries
 const EPSILON float64 = 0.01
 
+// CompressSlack is the factor by which a summary can grow above the GK space
+// bound before being compressed. Greater values trade memory for CPU.
+var CompressSlack = 2.0
+
+// CompressMaxNodesPerPass is the number of entries a compression triggered by
+// Insert visits at most, so that inserting into a large summary, e.g. when its
+// compression fell behind, has a bounded cost: the compression resumes with the
+// next insertions. 0 to compress whole summaries at once.
+var CompressMaxNodesPerPass = 0
+
+// SmallSummaryMaxEntries is the number of entries up to which a summary keeps
+// them in a sorted slice rather than in a skiplist, whose nodes cost much more
+// memory for the many summaries of a few values. Past it, the entries are
+// moved to a skiplist for good.
+const SmallSummaryMaxEntries = 128
+
+// smallSummaryMaxEntries is the SmallSummaryMaxEntries new summaries use, 0
+// to always use a skiplist. Only tests change it, to run over both backends.
+var smallSummaryMaxEntries = SmallSummaryMaxEntries
+
+// compressThreshold returns the number of entries above which a summary of n
+// values, which was last compressed down to lastSize entries, is compressed.
+// This follows the (1/EPSILON)*log(EPSILON*n) GK bound, so that we don't
+// compress summaries which are already tight, and never goes below lastSize so
+// that compressing is amortized when the bound is underestimated.
+func compressThreshold(n, lastSize int) int {
+	bound := 1.0 / (2.0 * EPSILON)
+	if en := EPSILON * float64(n); en > 1 {
+		bound = math.Max(bound, math.Log(en)/EPSILON)
+	}
+	bound = math.Max(bound, float64(lastSize))
+	return int(CompressSlack * bound)
+}
+
 // Summary is a way to represent an approximation of the distribution of values
 type Summary struct {
-	data        *Skiplist // where the real data is stored
+	data        *Skiplist // where the real data is stored, nil while small is used
+	small       []Entry   // the sorted entries of small summaries, see SmallSummaryMaxEntries
 	EncodedData []Entry   `json:"data"` // flattened data user for ser/deser purposes
 	N           int       `json:"n"`    // number of unique points that have been added to this summary
+
+	// FirstTs and LastTs are the earliest and latest timestamps of the
+	// values inserted with InsertWithTime, in nanoseconds since epoch, and
+	// are 0 when there are none
+	FirstTs int64 `json:"first_ts,omitempty"`
+	LastTs  int64 `json:"last_ts,omitempty"`
+
+	compressedSize int              // number of entries after the last compression
+	compression    CompressionStats // see CompressionStats
+
+	// pass is the compression in progress with CompressMaxNodesPerPass,
+	// shared by the copies of the summary so that any of them can finish it
+	pass *compressPass
+}
+
+// compressPass is where a partial compression resumes
+type compressPass struct {
+	next *SkiplistNode // nil when no compression is in progress
 }
 
 // Entry is an element of the skiplist, see GK paper for description
@@ -41,47 +98,78 @@ type Entry struct {
 
 // NewSummary returns a new approx-summary with accuracy EPSILON
 func NewSummary() *Summary {
+	if smallSummaryMaxEntries > 0 {
+		return &Summary{small: []Entry{}}
+	}
 	return &Summary{
 		data: NewSkiplist(),
 	}
 }
 
+// entries returns a copy of the entries of the summary, in order
+func (s *Summary) entries() []Entry {
+	if s.data == nil {
+		return append(make([]Entry, 0, len(s.small)), s.small...)
+	}
+	entries := make([]Entry, 0, s.data.length)
+	for curr := s.data.head.next[0]; curr != nil; curr = curr.next[0] {
+		entries = append(entries, curr.value)
+	}
+	return entries
+}
+
+// length returns the number of entries of the summary
+func (s *Summary) length() int {
+	if s.data == nil {
+		return len(s.small)
+	}
+	return s.data.length
+}
+
+// migrate moves the entries of a small summary to a skiplist
+func (s *Summary) migrate() {
+	s.data = NewSkiplist()
+	for _, e := range s.small {
+		s.data.Insert(e)
+	}
+	s.small = nil
+}
+
 func (s Summary) String() string {
 	var b bytes.Buffer
 	b.WriteString(fmt.Sprintf("samples: %d\n", s.N))
-	curr := s.data.head.next[0]
-	i := 0
-
-	for curr != nil {
-		e := curr.value
+	for i, e := range s.entries() {
 		b.WriteString(fmt.Sprintf("v:%6.02f g:%05d d:%05d   ", e.V, e.G, e.Delta))
 		if i%10 == 9 {
 			b.WriteRune('\n')
 		}
-		i++
-		curr = curr.next[0]
 	}
 	return b.String()
 }
 
 // MarshalJSON is used to send the data over to the API
 func (s Summary) MarshalJSON() ([]byte, error) {
-	if s.data == nil {
+	if s.data == nil && s.small == nil {
 		panic(errors.New("Cannot marshal non-initialized Summary"))
 	}
 
-	// TODO[leo] preallocate, not sure: 1/ 2*EPSILON?
-	s.EncodedData = make([]Entry, 0)
-	curr := s.data.head.next[0]
-	for curr != nil {
-		s.EncodedData = append(s.EncodedData, curr.value)
-		curr = curr.next[0]
+	if s.compressing() {
+		s.Compress()
 	}
 
-	return json.Marshal(map[string]interface{}{
+	s.EncodedData = s.entries()
+
+	m := map[string]interface{}{
 		"data": s.EncodedData,
 		"n":    s.N,
-	})
+	}
+	if s.FirstTs != 0 {
+		m["first_ts"] = s.FirstTs
+	}
+	if s.LastTs != 0 {
+		m["last_ts"] = s.LastTs
+	}
+	return json.Marshal(m)
 }
 
 // Avoid infinite recursion when unmarshalling
@@ -99,23 +187,16 @@ func (s *Summary) UnmarshalJSON(b []byte) error {
 	}
 	*s = Summary(ss)
 
-	s.data = NewSkiplist()
-	for _, e := range s.EncodedData {
-		s.data.Insert(e)
-	}
-
-	return nil
+	return s.loadEncodedData()
 }
 
 // GobEncode is used by the Kafka payload now, it flattens our skiplist
 func (s *Summary) GobEncode() ([]byte, error) {
-	// TODO[leo] preallocate, not sure: 1/ 2*EPSILON?
-	s.EncodedData = make([]Entry, 0)
-	curr := s.data.head.next[0]
-	for curr != nil {
-		s.EncodedData = append(s.EncodedData, curr.value)
-		curr = curr.next[0]
+	if s.compressing() {
+		s.Compress()
 	}
+
+	s.EncodedData = s.entries()
 	ss := summary(*s)
 
 	var buf bytes.Buffer
@@ -134,14 +215,53 @@ func (s *Summary) GobDecode(data []byte) error {
 	}
 
 	*s = Summary(ss)
-	s.data = NewSkiplist()
+
+	return s.loadEncodedData()
+}
+
+// loadEncodedData rebuilds the entries from EncodedData, in a skiplist past
+// SmallSummaryMaxEntries. Encoded summaries can come from older or
+// misbehaving agents, so entries which would break the GK invariants are
+// rejected, leaving an empty summary.
+func (s *Summary) loadEncodedData() error {
+	s.data, s.small = nil, nil
+	if len(s.EncodedData) > smallSummaryMaxEntries {
+		s.data = NewSkiplist()
+	} else {
+		s.small = make([]Entry, 0, len(s.EncodedData))
+	}
+	if s.N < 0 {
+		err := fmt.Errorf("invalid summary: negative count %d", s.N)
+		s.N = 0
+		return err
+	}
 	for _, e := range s.EncodedData {
-		s.data.Insert(e)
+		if e.G < 0 || e.Delta < 0 || math.IsNaN(e.V) {
+			s.N = 0
+			return fmt.Errorf("invalid summary entry: %+v", e)
+		}
+	}
+	for _, e := range s.EncodedData {
+		if s.data == nil {
+			s.insertSmall(e)
+		} else {
+			s.data.Insert(e)
+		}
 	}
 
 	return nil
 }
 
+// insertSmall inserts e in the sorted entries of a small summary, after the
+// ones of the same value like Skiplist.Insert, and returns its index
+func (s *Summary) insertSmall(e Entry) int {
+	i := sort.Search(len(s.small), func(i int) bool { return s.small[i].V > e.V })
+	s.small = append(s.small, Entry{})
+	copy(s.small[i+1:], s.small[i:])
+	s.small[i] = e
+	return i
+}
+
 // Insert inserts a new value v in the summary paired with t (the ID of the span it was reported from)
 func (s *Summary) Insert(v float64, t uint64) {
 	e := Entry{
@@ -150,6 +270,20 @@ func (s *Summary) Insert(v float64, t uint64) {
 		Delta: 0,
 	}
 
+	if s.data == nil {
+		s.N++
+		if i := s.insertSmall(e); i > 0 && i < len(s.small)-1 {
+			s.small[i].Delta = int(2 * EPSILON * float64(s.N))
+		}
+		if len(s.small) > compressThreshold(s.N, s.compressedSize) {
+			s.Compress()
+		}
+		if len(s.small) > smallSummaryMaxEntries {
+			s.migrate()
+		}
+		return
+	}
+
 	eptr := s.data.Insert(e)
 
 	s.N++
@@ -158,17 +292,128 @@ func (s *Summary) Insert(v float64, t uint64) {
 		eptr.value.Delta = int(2 * EPSILON * float64(s.N))
 	}
 
-	if s.N%int(1.0/float64(2.0*EPSILON)) == 0 {
-		s.compress()
+	if s.compressing() {
+		s.compressPartially()
+	} else if s.data.length > compressThreshold(s.N, s.compressedSize) {
+		if CompressMaxNodesPerPass > 0 {
+			s.compressPartially()
+		} else {
+			s.Compress()
+		}
+	}
+}
+
+// InsertWithTime is Insert, also recording ts (the time of the value, in
+// nanoseconds since epoch) in the timestamp range of the summary
+func (s *Summary) InsertWithTime(v float64, t uint64, ts int64) {
+	s.Insert(v, t)
+	s.FirstTs, s.LastTs = widenTimeRange(s.FirstTs, s.LastTs, ts, ts)
+}
+
+// widenTimeRange returns the timestamp range [first, last] widened to
+// include [from, to]. Zero bounds are unset.
+func widenTimeRange(first, last, from, to int64) (int64, int64) {
+	if from != 0 && (first == 0 || from < first) {
+		first = from
+	}
+	if to != 0 && (last == 0 || to > last) {
+		last = to
+	}
+	return first, last
+}
+
+// Compress merges the entries of the summary which are not needed to keep
+// its EPSILON precision. It is called as values are inserted, but can be
+// forced, typically before serializing the summary. A compression in
+// progress is restarted from the first entry and completed.
+func (s *Summary) Compress() {
+	if s.data == nil {
+		s.compressSmall()
+		return
 	}
+	s.compress(s.data.head.next[0], 0)
 }
 
-func (s *Summary) compress() {
+// compressSmall is compress for the entries of a small summary, which are
+// always compressed at once
+func (s *Summary) compressSmall() {
 	var missing int
 	epsN := int(2 * EPSILON * float64(s.N))
 
 	// keep first and last element
-	for elt := s.data.head.next[0]; elt != nil && elt.next[0] != nil; {
+	kept := s.small[:0]
+	for i := 0; i < len(s.small)-1; i++ {
+		t := s.small[i]
+		nt := &s.small[i+1]
+
+		removed := false
+		if t.V == nt.V {
+			missing += nt.G
+			nt.Delta += missing
+			nt.G = t.G
+			removed = true
+		} else if len(kept) > 0 {
+			if t.G+nt.G+missing+nt.Delta < epsN {
+				nt.G += t.G + missing
+				missing = 0
+				removed = true
+			} else {
+				nt.G += missing
+				missing = 0
+			}
+		}
+
+		if r := float64(nt.G+nt.Delta) / float64(errorBound(s.N)); r > s.compression.MaxErrorRatio {
+			s.compression.MaxErrorRatio = r
+		}
+		if removed {
+			s.compression.Removed++
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	if len(s.small) > 0 {
+		kept = append(kept, s.small[len(s.small)-1])
+	}
+
+	s.small = kept
+	s.compressedSize = len(s.small)
+	s.compression.Passes++
+}
+
+// compressing tells if a compression is in progress, see compressPartially
+func (s *Summary) compressing() bool {
+	return s.pass != nil && s.pass.next != nil
+}
+
+// compressPartially runs the compression in progress, or a new one, for at
+// most CompressMaxNodesPerPass entries. The summary keeps its invariants
+// between the passes.
+func (s *Summary) compressPartially() {
+	start := s.data.head.next[0]
+	if s.compressing() {
+		start = s.pass.next
+	}
+	s.compress(start, CompressMaxNodesPerPass)
+}
+
+// compress compresses the entries from start, stopping after max of them if
+// max is positive and remembering where to resume in s.pass
+func (s *Summary) compress(start *SkiplistNode, max int) {
+	var missing, visited int
+	epsN := int(2 * EPSILON * float64(s.N))
+
+	// keep first and last element
+	for elt := start; elt != nil && elt.next[0] != nil; visited++ {
+		if max > 0 && visited >= max && missing == 0 {
+			// the g of the removed entries were all added back, so
+			// that they still add up to N
+			if s.pass == nil {
+				s.pass = &compressPass{}
+			}
+			s.pass.next = elt
+			return
+		}
 		next := elt.next[0]
 		t := elt.value
 		nt := &next.value
@@ -179,19 +424,30 @@ func (s *Summary) compress() {
 			nt.Delta += missing
 			nt.G = t.G
 			s.data.Remove(elt)
+			s.compression.Removed++
 		} else if elt != s.data.head.next[0] && next != nil {
 			if t.G+nt.G+missing+nt.Delta < epsN {
 				nt.G += t.G + missing
 				missing = 0
 				s.data.Remove(elt)
+				s.compression.Removed++
 			} else {
 				nt.G += missing
 				missing = 0
 			}
 		}
 
+		if r := float64(nt.G+nt.Delta) / float64(errorBound(s.N)); r > s.compression.MaxErrorRatio {
+			s.compression.MaxErrorRatio = r
+		}
 		elt = next
 	}
+
+	if s.pass != nil {
+		s.pass.next = nil
+	}
+	s.compressedSize = s.data.length
+	s.compression.Passes++
 }
 
 // Quantile returns an EPSILON estimate of the element at quantile 'q' (0 <= q <= 1)
@@ -201,6 +457,24 @@ func (s *Summary) Quantile(q float64) float64 {
 	epsN := int(EPSILON * float64(s.N))
 	var rmin int
 
+	if s.data == nil {
+		for i, t := range s.small {
+			rmin += t.G
+			if i == len(s.small)-1 {
+				return t.V
+			}
+			if n := s.small[i+1]; r+epsN < rmin+n.G+n.Delta {
+				return t.V
+			}
+		}
+		return 0
+	}
+
+	if s.data.head.next[0] == nil {
+		// empty summary
+		return 0
+	}
+
 	for elt := s.data.head.next[0]; elt != nil; elt = elt.next[0] {
 		t := elt.value
 		rmin += t.G
@@ -211,10 +485,7 @@ func (s *Summary) Quantile(q float64) float64 {
 		}
 
 		if r+epsN < rmin+n.value.G+n.value.Delta {
-			if r+epsN < rmin+n.value.G {
-				return t.V
-			}
-			return n.value.V
+			return t.V
 		}
 	}
 
@@ -238,6 +509,15 @@ type SummarySlice struct {
 func (s *Summary) BySlices() []SummarySlice {
 	var slices []SummarySlice
 
+	if s.data == nil {
+		var last Entry
+		for _, cur := range s.small {
+			slices = append(slices, SummarySlice{Start: last.V, End: cur.V, Weight: cur.G})
+			last = cur
+		}
+		return slices
+	}
+
 	last := s.data.head
 	cur := last.next[0]
 
@@ -258,17 +538,67 @@ func (s *Summary) BySlices() []SummarySlice {
 
 // Merge takes a summary and merge the values inside the current pointed object
 func (s *Summary) Merge(s2 *Summary) {
-	if s2.N == 0 || s2.data == nil {
+	if s2.N == 0 || (s2.data == nil && s2.small == nil) {
 		return
 	}
 
+	s.FirstTs, s.LastTs = widenTimeRange(s.FirstTs, s.LastTs, s2.FirstTs, s2.LastTs)
 	s.N += s2.N
-	// Iterate on s2 elements and insert/merge them
-	for elt := s2.data.head.next[0]; elt != nil; elt = elt.next[0] {
-		s.data.Insert(elt.value)
+	others := s2.small
+	if s2.data != nil {
+		others = s2.entries()
+	}
+	if s.data == nil && len(s.small)+len(others) > smallSummaryMaxEntries {
+		s.migrate()
+	}
+
+	if s.data == nil {
+		s.small = mergeEntries(s.small, others)
+		s.Compress()
+		return
+	}
+	// Iterate on s2 elements and insert/merge them, the entries of s coming
+	// first on equal values
+	next := s.data.head.next[0]
+	for _, other := range others {
+		for next != nil && next.value.V <= other.V {
+			next.value.Delta = mergedDelta(next.value, other)
+			next = next.next[0]
+		}
+		e := other
+		if next != nil {
+			e.Delta = mergedDelta(e, next.value)
+		}
+		s.data.Insert(e)
 	}
 	// Force compression
-	s.compress()
+	s.Compress()
+}
+
+// mergeEntries is Merge for the sorted entries of small summaries
+func mergeEntries(entries, others []Entry) []Entry {
+	merged := make([]Entry, 0, len(entries)+len(others))
+	var i int
+	for _, e := range others {
+		for i < len(entries) && entries[i].V <= e.V {
+			mine := entries[i]
+			mine.Delta = mergedDelta(mine, e)
+			merged = append(merged, mine)
+			i++
+		}
+		if i < len(entries) {
+			e.Delta = mergedDelta(e, entries[i])
+		}
+		merged = append(merged, e)
+	}
+	return append(merged, entries[i:]...)
+}
+
+// mergedDelta returns the delta of e once merged in a summary where next is
+// the first entry after it: the rank of e can grow as far as the one of next,
+// so that the merged summary keeps the sum of the precisions of the two.
+func mergedDelta(e, next Entry) int {
+	return e.Delta + next.G + next.Delta - 1
 }
 
 // Copy just returns a new summary with the same data
@@ -283,7 +613,14 @@ const maxHeight = 31
 // Skiplist is a pseudo-random data structure used to store nodes and find quickly what we want
 type Skiplist struct {
 	height int
+	length int // number of nodes, head excluded
 	head   *SkiplistNode
+
+	// finger is the search path of the last insertion: at each level, the
+	// last node before the inserted value. Searches jump to it when they can,
+	// so that inserting close to the previous value, as with ascending
+	// durations, does not walk from the head.
+	finger [maxHeight]*SkiplistNode
 }
 
 // SkiplistNode is holding the actual value and pointers to the neighbor nodes
@@ -293,12 +630,33 @@ type SkiplistNode struct {
 	prev  []*SkiplistNode
 }
 
+// nodePools recycles removed nodes, by level
+var nodePools [maxHeight]sync.Pool
+
+// newSkiplistNode returns a node linked on levels 0 to level
+func newSkiplistNode(e Entry, level int) *SkiplistNode {
+	if node, ok := nodePools[level].Get().(*SkiplistNode); ok {
+		node.value = e
+		return node
+	}
+	links := make([]*SkiplistNode, 2*(level+1))
+	return &SkiplistNode{
+		value: e,
+		next:  links[: level+1 : level+1],
+		prev:  links[level+1:],
+	}
+}
+
 // NewSkiplist returns a new empty Skiplist
 func NewSkiplist() *Skiplist {
-	return &Skiplist{
+	s := &Skiplist{
 		height: 0,
 		head:   &SkiplistNode{next: make([]*SkiplistNode, maxHeight)},
 	}
+	for i := range s.finger {
+		s.finger[i] = s.head
+	}
+	return s
 }
 
 // Insert adds a new Entry to the Skiplist and yields a pointer to the node where the data was inserted
@@ -316,19 +674,22 @@ func (s *Skiplist) Insert(e Entry) *SkiplistNode {
 		level = s.height
 	}
 
-	node := &SkiplistNode{
-		value: e,
-		next:  make([]*SkiplistNode, level+1),
-		prev:  make([]*SkiplistNode, level+1),
-	}
+	node := newSkiplistNode(e, level)
+
 	curr := s.head
 	for i := s.height; i >= 0; i-- {
+		// start from the finger when it is between curr and e, which is
+		// typically the case when inserting mostly ascending values
+		if f := s.finger[i]; f != s.head && f.value.V <= e.V && (curr == s.head || f.value.V > curr.value.V) {
+			curr = f
+		}
 
 		for curr.next[i] != nil && e.V >= curr.next[i].value.V {
 			curr = curr.next[i]
 		}
 
 		if i > level {
+			s.finger[i] = curr
 			continue
 		}
 
@@ -338,12 +699,15 @@ func (s *Skiplist) Insert(e Entry) *SkiplistNode {
 		}
 		curr.next[i] = node
 		node.prev[i] = curr
+		s.finger[i] = node
 	}
+	s.length++
 
 	return node
 }
 
-// Remove removes a node from the Skiplist
+// Remove removes a node from the Skiplist. The node is recycled, it must not
+// be used afterwards.
 func (s *Skiplist) Remove(node *SkiplistNode) {
 
 	// remove n from each level of the Skiplist
@@ -358,7 +722,12 @@ func (s *Skiplist) Remove(node *SkiplistNode) {
 		if next != nil {
 			next.prev[i] = prev
 		}
+		if s.finger[i] == node {
+			s.finger[i] = prev
+		}
 		node.next[i] = nil
 		node.prev[i] = nil
 	}
+	s.length--
+	nodePools[len(node.next)-1].Put(node)
 }
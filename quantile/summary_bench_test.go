@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 const randlen = 1000
@@ -174,3 +175,89 @@ func BenchmarkGKSliceEncoding100(b *testing.B) {
 func BenchmarkGKSliceEncoding1000(b *testing.B) {
 	BGKSliceEncoding(b, 1000)
 }
+
+func BenchmarkGKSkiplistInsertionDistinct(b *testing.B) {
+	s := NewSummary()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		s.Insert(rand.Float64(), uint64(n))
+	}
+}
+
+// skiplistBenchSize is the number of values inserted in a skiplist before
+// starting over, so that all the benchmarks run on lists of the same size
+const skiplistBenchSize = 10000
+
+// benchSkiplistInsert inserts into a skiplist the values given by gen for
+// the insertions 0 to skiplistBenchSize-1
+func benchSkiplistInsert(b *testing.B, gen func(i int) float64) {
+	vals := make([]float64, skiplistBenchSize)
+	for i := range vals {
+		vals[i] = gen(i)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	var s *Skiplist
+	for n := 0; n < b.N; n++ {
+		i := n % skiplistBenchSize
+		if i == 0 {
+			s = NewSkiplist()
+		}
+		s.Insert(Entry{V: vals[i], G: 1})
+	}
+}
+
+func BenchmarkSkiplistInsert(b *testing.B) {
+	b.Run("random", func(b *testing.B) {
+		benchSkiplistInsert(b, func(i int) float64 { return rand.Float64() })
+	})
+	b.Run("ascending", func(b *testing.B) {
+		benchSkiplistInsert(b, func(i int) float64 { return float64(i) })
+	})
+	b.Run("mostly-ascending", func(b *testing.B) {
+		benchSkiplistInsert(b, func(i int) float64 { return float64(i) + 10*rand.Float64() })
+	})
+	b.Run("descending", func(b *testing.B) {
+		benchSkiplistInsert(b, func(i int) float64 { return float64(-i) })
+	})
+}
+
+// benchSummaryWorstInsert reports the longest insertion into a summary of
+// 100000 values whose compression fell behind, with maxNodes entries
+// compressed at most by the insertions
+func benchSummaryWorstInsert(b *testing.B, maxNodes int) {
+	defer func(slack float64, max int) {
+		CompressSlack, CompressMaxNodesPerPass = slack, max
+	}(CompressSlack, CompressMaxNodesPerPass)
+
+	var worst time.Duration
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		CompressSlack, CompressMaxNodesPerPass = 1000, maxNodes
+		s := NewSummary()
+		for i := 0; i < 100000; i++ {
+			s.Insert(rand.Float64(), uint64(i))
+		}
+		CompressSlack = 2
+		b.StartTimer()
+
+		for i := 0; i < 100; i++ {
+			start := time.Now()
+			s.Insert(rand.Float64(), uint64(i))
+			if d := time.Since(start); d > worst {
+				worst = d
+			}
+		}
+	}
+	b.Logf("worst insertion: %s", worst)
+}
+
+func BenchmarkGKSkiplistWorstInsert(b *testing.B) {
+	b.Run("full", func(b *testing.B) { benchSummaryWorstInsert(b, 0) })
+	b.Run("partial", func(b *testing.B) { benchSummaryWorstInsert(b, 1000) })
+}
@@ -0,0 +1,99 @@
+package quantile
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run `go test ./quantile -update` to regenerate the golden files after an
+// intended change of the wire format.
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// newGoldenSummary returns a summary which is always built the same way
+func newGoldenSummary() *Summary {
+	r := rand.New(rand.NewSource(42))
+	s := NewSummary()
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(r.Intn(500)), uint64(i))
+	}
+	return s
+}
+
+func checkGolden(t *testing.T, name string, actual []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("cannot update %s: %v", path, err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", path, err)
+	}
+	assert.True(t, bytes.Equal(expected, actual), "%s differs from the encoded summary, run with -update if this is intended", path)
+}
+
+func testSummaryGoldenJSON(t *testing.T) {
+	assert := assert.New(t)
+	s := newGoldenSummary()
+
+	b, err := json.Marshal(s)
+	assert.Nil(err)
+	checkGolden(t, "summary.golden.json", b)
+
+	var decoded Summary
+	golden, _ := ioutil.ReadFile(filepath.Join("testdata", "summary.golden.json"))
+	assert.Nil(json.Unmarshal(golden, &decoded))
+	for _, q := range testQuantiles {
+		assert.Equal(s.Quantile(q), decoded.Quantile(q))
+	}
+}
+
+func testSummaryGoldenGob(t *testing.T) {
+	assert := assert.New(t)
+	s := newGoldenSummary()
+
+	b, err := s.GobEncode()
+	assert.Nil(err)
+	checkGolden(t, "summary.golden.gob", b)
+
+	var decoded Summary
+	golden, _ := ioutil.ReadFile(filepath.Join("testdata", "summary.golden.gob"))
+	assert.Nil(decoded.GobDecode(golden))
+	for _, q := range testQuantiles {
+		assert.Equal(s.Quantile(q), decoded.Quantile(q))
+	}
+}
+
+func TestSummaryUnmarshalInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, data := range []string{
+		`{"data":[{"v":1,"g":-3,"delta":0}],"n":1}`,
+		`{"data":[{"v":1,"g":1,"delta":-1}],"n":1}`,
+		`{"data":[{"v":1,"g":1,"delta":0}],"n":-1}`,
+	} {
+		var s Summary
+		assert.NotNil(s.UnmarshalJSON([]byte(data)), data)
+		assert.Equal(0, s.N)
+		assert.Equal(0.0, s.Quantile(0.5))
+	}
+
+	// valid but empty summaries can be queried
+	for _, data := range []string{`{}`, `null`, `{"data":[],"n":12}`} {
+		var s Summary
+		assert.Nil(s.UnmarshalJSON([]byte(data)), data)
+		assert.Equal(0.0, s.Quantile(0.99))
+		assert.Len(s.BySlices(), 0)
+	}
+
+	var s Summary
+	assert.NotNil(s.GobDecode([]byte("not a gob")))
+}
@@ -0,0 +1,179 @@
+package quantile
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// backendTests are the tests of the summaries which must behave the same
+// whether small summaries are kept in sorted slices or in skiplists
+var backendTests = []struct {
+	name string
+	test func(*testing.T)
+}{
+	{"Accuracy", testSummaryAccuracy},
+	{"QuantileWithBoundsUniform", testQuantileWithBoundsUniform},
+	{"QuantileWithBoundsClamped", testQuantileWithBoundsClamped},
+	{"ToCentroids", testToCentroids},
+	{"ToCentroidsEntries", testToCentroidsEntries},
+	{"CheckInvariants", testSummaryCheckInvariants},
+	{"InvariantsRandomInserts", testSummaryInvariantsRandomInserts},
+	{"GoldenJSON", testSummaryGoldenJSON},
+	{"GoldenGob", testSummaryGoldenGob},
+	{"SkiplistConstant10", testSummarySkiplistConstant10},
+	{"SkiplistConstant100", testSummarySkiplistConstant100},
+	{"SkiplistConstant1000", testSummarySkiplistConstant1000},
+	{"SkiplistConstant10000", testSummarySkiplistConstant10000},
+	{"SkiplistConstant100000", testSummarySkiplistConstant100000},
+	{"SkiplistUniform10", testSummarySkiplistUniform10},
+	{"SkiplistUniform100", testSummarySkiplistUniform100},
+	{"SkiplistUniform1000", testSummarySkiplistUniform1000},
+	{"SkiplistUniform10000", testSummarySkiplistUniform10000},
+	{"SkiplistUniform100000", testSummarySkiplistUniform100000},
+	{"Gob", testSummaryGob},
+	{"Merge", testSummaryMerge},
+	{"TimeRange", testSummaryTimeRange},
+	{"RemergeReal10000", testSummaryRemergeReal10000},
+	{"Remerge10000", testSummaryRemerge10000},
+	{"AdaptiveCompress", testSummaryAdaptiveCompress},
+	{"FingerCompress", testSkiplistFingerCompress},
+	{"PartialCompress", testSummaryPartialCompress},
+}
+
+func TestSummaryBackends(t *testing.T) {
+	defer func() { smallSummaryMaxEntries = SmallSummaryMaxEntries }()
+	for _, max := range []int{SmallSummaryMaxEntries, 0} {
+		smallSummaryMaxEntries = max
+		for _, bt := range backendTests {
+			t.Run(fmt.Sprintf("%s/small=%d", bt.name, max), bt.test)
+		}
+	}
+}
+
+// newSkiplistSummary returns an empty summary backed by a skiplist
+func newSkiplistSummary() *Summary {
+	return &Summary{data: NewSkiplist()}
+}
+
+func TestSummarySmallMigration(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+	small, skiplist := NewSummary(), newSkiplistSummary()
+	assert.Nil(small.data)
+	migrated := 0
+	for i := 0; i < 5000; i++ {
+		v := float64(r.Intn(2000))
+		small.Insert(v, uint64(i))
+		skiplist.Insert(v, uint64(i))
+		if small.data != nil && migrated == 0 {
+			migrated = i
+		}
+		if !assert.Equal(skiplist.entries(), small.entries(), "after %d inserts", i+1) {
+			t.FailNow()
+		}
+		assert.True(small.data != nil || small.length() <= SmallSummaryMaxEntries)
+	}
+	// migrated mid-stream, once for good
+	assert.True(migrated > 0)
+	assert.Nil(small.small)
+	assert.Equal(skiplist.N, small.N)
+	assert.Equal(skiplist.CompressionStats(), small.CompressionStats())
+	for _, q := range testQuantiles {
+		assert.Equal(skiplist.Quantile(q), small.Quantile(q))
+	}
+}
+
+func TestSummarySmallBackend(t *testing.T) {
+	assert := assert.New(t)
+	build := func(s *Summary, n int, seed int64) *Summary {
+		r := rand.New(rand.NewSource(seed))
+		for i := 0; i < n; i++ {
+			s.Insert(float64(r.Intn(100)), uint64(i))
+		}
+		return s
+	}
+
+	for _, n := range []int{0, 1, 2, 30, 100} {
+		small, skiplist := build(NewSummary(), n, int64(n)), build(newSkiplistSummary(), n, int64(n))
+		if !assert.Nil(small.data, "%d values", n) {
+			continue
+		}
+		for _, q := range testQuantiles {
+			assert.Equal(skiplist.Quantile(q), small.Quantile(q))
+		}
+		assert.Equal(skiplist.BySlices(), small.BySlices())
+		assert.Equal(skiplist.ToCentroids(10), small.ToCentroids(10))
+		assert.Equal(skiplist.String(), small.String())
+
+		js, err := json.Marshal(small)
+		assert.Nil(err)
+		expected, _ := json.Marshal(skiplist)
+		assert.Equal(string(expected), string(js))
+		var decoded Summary
+		assert.Nil(json.Unmarshal(js, &decoded))
+		assert.Nil(decoded.data)
+		assert.Equal(small.entries(), decoded.entries())
+
+		gb, err := small.GobEncode()
+		assert.Nil(err)
+		expected, _ = skiplist.GobEncode()
+		assert.Equal(expected, gb)
+
+		// merging into either backend, staying small while possible
+		for _, other := range []*Summary{build(NewSummary(), 30, 1), build(newSkiplistSummary(), 30, 1)} {
+			mergedSmall, mergedSkiplist := small.Copy(), skiplist.Copy()
+			mergedSmall.Merge(other)
+			mergedSkiplist.Merge(other)
+			assert.Nil(mergedSmall.data)
+			assert.Equal(mergedSkiplist.entries(), mergedSmall.entries())
+			assert.Equal(mergedSkiplist.N, mergedSmall.N)
+		}
+	}
+
+	// merging past the threshold migrates
+	s := NewSummary()
+	for i := 0; i < 100; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	other := NewSummary()
+	for i := 0; i < 100; i++ {
+		other.Insert(float64(i)+0.5, uint64(i))
+	}
+	s.Merge(other)
+	assert.NotNil(s.data)
+	assert.Equal(200, s.N)
+	assert.Nil(s.CheckInvariants())
+}
+
+// benchSmallSummaries builds 1k summaries of 30 values, as for resources
+// hit a few times per bucket
+func benchSmallSummaries(b *testing.B, max int) {
+	defer func() { smallSummaryMaxEntries = SmallSummaryMaxEntries }()
+	smallSummaryMaxEntries = max
+
+	values := randSlice(30)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		summaries := make([]*Summary, 1000)
+		for j := range summaries {
+			s := NewSummary()
+			for k, v := range values {
+				s.Insert(v, uint64(k))
+			}
+			summaries[j] = s
+		}
+	}
+}
+
+func BenchmarkSmallSummariesSlice(b *testing.B) {
+	benchSmallSummaries(b, 128)
+}
+
+func BenchmarkSmallSummariesSkiplist(b *testing.B) {
+	benchSmallSummaries(b, 0)
+}
@@ -1,8 +1,13 @@
 package quantile
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,19 +72,19 @@ func SummarySliceConstantN(t *testing.T, n int) {
 		assert.Equal(42.0, v)
 	}
 }
-func TestSummarySkiplistConstant10(t *testing.T) {
+func testSummarySkiplistConstant10(t *testing.T) {
 	SummarySkiplistConstantN(t, 10)
 }
-func TestSummarySkiplistConstant100(t *testing.T) {
+func testSummarySkiplistConstant100(t *testing.T) {
 	SummarySkiplistConstantN(t, 100)
 }
-func TestSummarySkiplistConstant1000(t *testing.T) {
+func testSummarySkiplistConstant1000(t *testing.T) {
 	SummarySkiplistConstantN(t, 1000)
 }
-func TestSummarySkiplistConstant10000(t *testing.T) {
+func testSummarySkiplistConstant10000(t *testing.T) {
 	SummarySkiplistConstantN(t, 10000)
 }
-func TestSummarySkiplistConstant100000(t *testing.T) {
+func testSummarySkiplistConstant100000(t *testing.T) {
 	SummarySkiplistConstantN(t, 100000)
 }
 func TestSummarySliceConstant10(t *testing.T) {
@@ -139,19 +144,19 @@ func SummarySliceUniformN(t *testing.T, n int) {
 		assert.InDelta(exp, v, EPSILON*float64(n), "quantile %f failed, exp: %f, val: %f", testQuantiles[i], exp, v)
 	}
 }
-func TestSummarySkiplistUniform10(t *testing.T) {
+func testSummarySkiplistUniform10(t *testing.T) {
 	SummarySkiplistUniformN(t, 10)
 }
-func TestSummarySkiplistUniform100(t *testing.T) {
+func testSummarySkiplistUniform100(t *testing.T) {
 	SummarySkiplistUniformN(t, 100)
 }
-func TestSummarySkiplistUniform1000(t *testing.T) {
+func testSummarySkiplistUniform1000(t *testing.T) {
 	SummarySkiplistUniformN(t, 1000)
 }
-func TestSummarySkiplistUniform10000(t *testing.T) {
+func testSummarySkiplistUniform10000(t *testing.T) {
 	SummarySkiplistUniformN(t, 10000)
 }
-func TestSummarySkiplistUniform100000(t *testing.T) {
+func testSummarySkiplistUniform100000(t *testing.T) {
 	SummarySkiplistUniformN(t, 100000)
 }
 func TestSummarySliceUniform10(t *testing.T) {
@@ -180,7 +185,7 @@ func NewSummaryWithTestData() *Summary {
 	return s
 }
 
-func TestSummaryGob(t *testing.T) {
+func testSummaryGob(t *testing.T) {
 	assert := assert.New(t)
 
 	s := NewSummaryWithTestData()
@@ -192,7 +197,7 @@ func TestSummaryGob(t *testing.T) {
 	assert.Equal(s.N, ss.N)
 }
 
-func TestSummaryMerge(t *testing.T) {
+func testSummaryMerge(t *testing.T) {
 	assert := assert.New(t)
 	s1 := NewSummary()
 	for i := 0; i < 101; i++ {
@@ -208,8 +213,8 @@ func TestSummaryMerge(t *testing.T) {
 
 	expected := map[float64]float64{
 		0.0: 0,
-		0.2: 15,
-		0.4: 30,
+		0.2: 14,
+		0.4: 29,
 		0.6: 45,
 		0.8: 70,
 		1.0: 100,
@@ -250,7 +255,134 @@ func TestSummarySliceMerge(t *testing.T) {
 	}
 }
 
-func TestSummaryRemergeReal10000(t *testing.T) {
+func TestSliceSummaryEpsilon(t *testing.T) {
+	assert := assert.New(t)
+
+	fine, coarse := NewSliceSummaryWithEpsilon(0.005), NewSliceSummaryWithEpsilon(0.02)
+	assert.Equal(0.005, fine.Precision())
+	assert.Equal(EPSILON, NewSliceSummary().Precision())
+	assert.Equal(NewSliceSummary(), NewSliceSummaryWithEpsilon(EPSILON))
+	for i := 0; i < 10000; i++ {
+		fine.Insert(float64(i), uint64(i))
+		coarse.Insert(float64(i), uint64(i))
+	}
+	fine.Compress()
+	coarse.Compress()
+	assert.True(len(fine.Entries) > 2*len(coarse.Entries), "%d entries at 0.005, %d at 0.02", len(fine.Entries), len(coarse.Entries))
+	assert.Equal(0.005, fine.Copy().Epsilon)
+
+	// the precision is encoded along, unless it is the default one
+	b, _ := json.Marshal(fine)
+	assert.Contains(string(b), `"Epsilon":0.005`)
+	b, _ = json.Marshal(NewSliceSummary())
+	assert.NotContains(string(b), "Epsilon")
+
+	// merged summaries have the coarser precision
+	merged := fine.Copy()
+	merged.Merge(coarse)
+	assert.Equal(0.02, merged.Precision())
+	merged = NewSliceSummary()
+	merged.Merge(fine)
+	assert.Equal(EPSILON, merged.Precision())
+	merged = NewSliceSummaryWithEpsilon(0.005)
+	merged.Merge(NewSliceSummaryWithEpsilon(0.02))
+	assert.Equal(0.005, merged.Precision(), "empty summaries bring no error")
+}
+
+func testSummaryTimeRange(t *testing.T) {
+	assert := assert.New(t)
+
+	s1 := NewSummary()
+	plain := NewSummary()
+	s1.Insert(10, 10)
+	plain.Insert(10, 10)
+	assert.Equal(int64(0), s1.FirstTs)
+	assert.Equal(int64(0), s1.LastTs)
+	for i, ts := range []int64{300, 100, 200} {
+		s1.InsertWithTime(float64(i), uint64(i), ts)
+		plain.Insert(float64(i), uint64(i))
+	}
+	assert.Equal(int64(100), s1.FirstTs)
+	assert.Equal(int64(300), s1.LastTs)
+	assert.Equal(plain.BySlices(), s1.BySlices())
+
+	b, err := json.Marshal(s1)
+	assert.Nil(err)
+	var fromJSON Summary
+	assert.Nil(json.Unmarshal(b, &fromJSON))
+	assert.Equal(int64(100), fromJSON.FirstTs)
+	assert.Equal(int64(300), fromJSON.LastTs)
+
+	b, err = s1.GobEncode()
+	assert.Nil(err)
+	var fromGob Summary
+	assert.Nil(fromGob.GobDecode(b))
+	assert.Equal(int64(100), fromGob.FirstTs)
+	assert.Equal(int64(300), fromGob.LastTs)
+
+	// summaries without timestamps do not change the range
+	s2 := NewSummary()
+	s2.Insert(1, 1)
+	s1.Merge(s2)
+	assert.Equal(int64(100), s1.FirstTs)
+	assert.Equal(int64(300), s1.LastTs)
+	s2.InsertWithTime(2, 2, 50)
+	s2.InsertWithTime(3, 3, 400)
+	s1.Merge(s2)
+	assert.Equal(int64(50), s1.FirstTs)
+	assert.Equal(int64(400), s1.LastTs)
+	s3 := NewSummary()
+	s3.Merge(s1)
+	assert.Equal(int64(50), s3.FirstTs)
+	assert.Equal(int64(400), s3.LastTs)
+}
+
+func TestSliceSummaryTimeRange(t *testing.T) {
+	assert := assert.New(t)
+
+	s1 := NewSliceSummary()
+	s1.Insert(1, 1)
+	assert.Equal(int64(0), s1.FirstTs)
+	assert.Equal(int64(0), s1.LastTs)
+	for i, ts := range []int64{300, 100, 200} {
+		s1.InsertWithTime(float64(i), uint64(i), ts)
+	}
+	assert.Equal(int64(100), s1.FirstTs)
+	assert.Equal(int64(300), s1.LastTs)
+	assert.Equal(s1.FirstTs, s1.Copy().FirstTs)
+	assert.Equal(s1.LastTs, s1.Copy().LastTs)
+
+	b, err := json.Marshal(s1)
+	assert.Nil(err)
+	var fromJSON SliceSummary
+	assert.Nil(json.Unmarshal(b, &fromJSON))
+	assert.Equal(*s1, fromJSON)
+
+	var buf bytes.Buffer
+	assert.Nil(gob.NewEncoder(&buf).Encode(s1))
+	var fromGob SliceSummary
+	assert.Nil(gob.NewDecoder(&buf).Decode(&fromGob))
+	assert.Equal(*s1, fromGob)
+
+	// the range of empty summaries is the one merged in
+	s2 := NewSliceSummary()
+	s2.InsertWithTime(2, 2, 50)
+	s2.InsertWithTime(3, 3, 400)
+	s3 := NewSliceSummary()
+	s3.Merge(s2)
+	assert.Equal(int64(50), s3.FirstTs)
+	assert.Equal(int64(400), s3.LastTs)
+	s1.Merge(s2)
+	assert.Equal(int64(50), s1.FirstTs)
+	assert.Equal(int64(400), s1.LastTs)
+
+	// plain summaries encode as before
+	b, err = json.Marshal(NewSliceSummary())
+	assert.Nil(err)
+	assert.Equal(`{"Entries":null,"N":0}`, string(b))
+}
+
+func testSummaryRemergeReal10000(t *testing.T) {
 	s := NewSummary()
 	for n := 0; n < 1000; n++ {
 		s1 := NewSummary()
@@ -312,7 +444,7 @@ func TestSliceSummaryRemerge10000(t *testing.T) {
 	fmt.Println(total)
 }
 
-func TestSummaryRemerge10000(t *testing.T) {
+func testSummaryRemerge10000(t *testing.T) {
 	s1 := NewSummary()
 	for n := 0; n < 1000; n++ {
 		for i := 0; i < 100; i++ {
@@ -354,3 +486,183 @@ func TestSummaryBySlices(t *testing.T) {
 		}
 	}
 }
+
+func TestSummaryCompressThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	// small summaries all share the same floor
+	assert.Equal(int(CompressSlack/(2*EPSILON)), compressThreshold(0, 0))
+	assert.Equal(compressThreshold(0, 0), compressThreshold(100, 0))
+
+	// then it grows with the GK bound
+	assert.True(compressThreshold(1e6, 0) > compressThreshold(1e4, 0))
+
+	// and never goes below what the last compression achieved
+	assert.Equal(int(CompressSlack*5000), compressThreshold(1e4, 5000))
+}
+
+func testSummaryAdaptiveCompress(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSummary()
+
+	for i := 0; i < 100000; i++ {
+		s.Insert(rand.Float64(), uint64(i))
+		assert.True(s.length() <= compressThreshold(s.N, s.compressedSize))
+	}
+
+	before := s.length()
+	s.Compress()
+	assert.True(s.length() <= before)
+	assert.Equal(s.length(), s.compressedSize)
+
+	// the skiplist length is properly maintained
+	n := 0
+	for elt := s.data.head.next[0]; elt != nil; elt = elt.next[0] {
+		n++
+	}
+	assert.Equal(n, s.data.length)
+}
+
+// checkSkiplist fails if the levels of s are not sorted and consistently
+// linked, or if its finger is not on them, and returns the values of s
+func checkSkiplist(t *testing.T, s *Skiplist) []float64 {
+	var values []float64
+	for i := 0; i <= s.height; i++ {
+		fingerFound := s.finger[i] == s.head
+		for elt := s.head; elt.next[i] != nil; elt = elt.next[i] {
+			next := elt.next[i]
+			if next.prev[i] != elt {
+				t.Fatalf("level %d: node %v not linked back to its previous node", i, next.value.V)
+			}
+			if elt != s.head && next.value.V < elt.value.V {
+				t.Fatalf("level %d: %v after %v", i, next.value.V, elt.value.V)
+			}
+			if next == s.finger[i] {
+				fingerFound = true
+			}
+			if i == 0 {
+				values = append(values, next.value.V)
+			}
+		}
+		if !fingerFound {
+			t.Fatalf("level %d: finger %v not in the list", i, s.finger[i].value.V)
+		}
+	}
+	if len(values) != s.length {
+		t.Fatalf("length %d, found %d nodes", s.length, len(values))
+	}
+	return values
+}
+
+func TestSkiplistFinger(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSkiplist()
+	var expected []float64
+	var last *SkiplistNode
+	insert := func(v float64) {
+		last = s.Insert(Entry{V: v, G: 1})
+		expected = append(expected, v)
+	}
+	remove := func(node *SkiplistNode) {
+		for i, v := range expected {
+			if v == node.value.V {
+				expected = append(expected[:i], expected[i+1:]...)
+				break
+			}
+		}
+		s.Remove(node)
+	}
+
+	for round := 0; round < 50; round++ {
+		// ascending, then values before the finger, then equal values
+		for i := 0; i < 20; i++ {
+			insert(float64(round*100 + i))
+		}
+		for i := 0; i < 10; i++ {
+			insert(rand.Float64() * float64(round*100+20))
+		}
+		insert(last.value.V)
+		insert(last.value.V)
+
+		// removing the finger itself, then inserting right after it
+		remove(last)
+		insert(float64(round*100 + 19))
+
+		// removing random nodes
+		for i := 0; i < 5; i++ {
+			elt := s.head.next[0]
+			for j := rand.Intn(s.length); j > 0; j-- {
+				elt = elt.next[0]
+			}
+			remove(elt)
+		}
+		insert(float64(round*100 + 50))
+
+		values := checkSkiplist(t, s)
+		sorted := append([]float64{}, expected...)
+		sort.Float64s(sorted)
+		if !assert.Equal(sorted, values, "round %d", round) {
+			t.FailNow()
+		}
+	}
+}
+
+func testSkiplistFingerCompress(t *testing.T) {
+	s := NewSummary()
+	for i := 0; i < 100000; i++ {
+		// mostly ascending, compressions remove nodes under the finger
+		s.Insert(float64(i)+100*rand.Float64(), uint64(i))
+	}
+	checkSkiplist(t, s.data)
+	assert.Nil(t, s.CheckInvariants())
+}
+
+func testSummaryPartialCompress(t *testing.T) {
+	assert := assert.New(t)
+	defer func(max int) { CompressMaxNodesPerPass = max }(CompressMaxNodesPerPass)
+	CompressMaxNodesPerPass = 100
+
+	r := rand.New(rand.NewSource(42))
+	s := NewSummary()
+	vals := make([]float64, 0, 50000)
+	partial := 0
+	for i := 0; i < 50000; i++ {
+		v := r.Float64() * 1000
+		vals = append(vals, v)
+		s.Insert(v, uint64(i))
+		if s.compressing() {
+			partial++
+		}
+		if err := s.CheckInvariants(); err != nil {
+			t.Fatalf("after %d inserts: %v", i+1, err)
+		}
+	}
+	assert.True(partial > 0)
+	assert.True(s.CompressionStats().Passes > 0)
+
+	// serializing completes the pass in progress
+	for !s.compressing() {
+		v := r.Float64() * 1000
+		vals = append(vals, v)
+		s.Insert(v, 0)
+	}
+	_, err := s.GobEncode()
+	assert.Nil(err)
+	assert.False(s.compressing())
+	assert.Equal(s.data.length, s.compressedSize)
+	assert.Nil(s.CheckInvariants())
+
+	for !s.compressing() {
+		v := r.Float64() * 1000
+		vals = append(vals, v)
+		s.Insert(v, 0)
+	}
+	_, err = json.Marshal(s)
+	assert.Nil(err)
+	assert.False(s.compressing())
+	assert.Nil(s.CheckInvariants())
+
+	sort.Float64s(vals)
+	checkRankError(t, "partial", vals, EPSILON, s.Quantile)
+}
@@ -0,0 +1,150 @@
+package quantizer
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultResourceCacheSize is the number of quantized resources cached
+	// by default, see SetResourceCacheSize
+	DefaultResourceCacheSize = 5000
+
+	// resourceCacheShardBits is the log2 of the number of shards of the
+	// resource cache
+	resourceCacheShardBits = 4
+
+	// maxResourceKeyLength is the length above which resources are cached by
+	// their SHA-1, not to hold huge queries in memory twice
+	maxResourceKeyLength = 512
+)
+
+// resourceKey is the key of a quantized resource: the type of its span and
+// the raw resource, or its SHA-1 if it is too long
+type resourceKey struct {
+	spanType string
+	resource string
+	hashed   bool
+}
+
+func newResourceKey(spanType, resource string) resourceKey {
+	if len(resource) <= maxResourceKeyLength {
+		return resourceKey{spanType: spanType, resource: resource}
+	}
+	sum := sha1.Sum([]byte(resource))
+	return resourceKey{spanType: spanType, resource: string(sum[:]), hashed: true}
+}
+
+type resourceEntry struct {
+	key       resourceKey
+	quantized string
+	err       error
+}
+
+// resourceShard is an LRU of the quantized resources whose key hashes to it
+type resourceShard struct {
+	mu      sync.Mutex
+	entries map[resourceKey]*list.Element
+	lru     *list.List // *resourceEntry, most recently used first
+}
+
+// resourceCache caches the quantized resources by the type of their span
+// and raw resource, since the same queries are received over and over. Keys
+// are spread over shards not to contend on a single lock, each holding at
+// most its share of the cache size, the least recently used resources being
+// dropped first. A nil cache quantizes every resource.
+type resourceCache struct {
+	// first, to be 64-bit aligned for the atomic operations on 32-bit
+	// platforms
+	hits, misses int64
+
+	shardCap int
+	shards   [1 << resourceCacheShardBits]resourceShard
+}
+
+// newResourceCache returns a cache of up to size resources, nil if size is
+// not positive
+func newResourceCache(size int) *resourceCache {
+	if size <= 0 {
+		return nil
+	}
+	c := &resourceCache{shardCap: size >> resourceCacheShardBits}
+	if c.shardCap < 1 {
+		c.shardCap = 1
+	}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[resourceKey]*list.Element)
+		c.shards[i].lru = list.New()
+	}
+	return c
+}
+
+func (c *resourceCache) shard(k resourceKey) *resourceShard {
+	h := fnv.New32a()
+	h.Write([]byte(k.spanType))
+	h.Write([]byte(k.resource))
+	return &c.shards[h.Sum32()&(1<<resourceCacheShardBits-1)]
+}
+
+// quantize returns quantize(resource), from the cache if it was computed for
+// a span of the same type already. Errors are cached too. quantize is called
+// without holding any lock.
+func (c *resourceCache) quantize(spanType, resource string, quantize func(string) (string, error)) (string, error) {
+	if c == nil {
+		return quantize(resource)
+	}
+
+	k := newResourceKey(spanType, resource)
+	s := c.shard(k)
+	s.mu.Lock()
+	if elem, ok := s.entries[k]; ok {
+		s.lru.MoveToFront(elem)
+		e := elem.Value.(*resourceEntry)
+		s.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return e.quantized, e.err
+	}
+	s.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	quantized, err := quantize(resource)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[k]; ok {
+		// added by a concurrent miss
+		return quantized, err
+	}
+	for s.lru.Len() >= c.shardCap {
+		back := s.lru.Back()
+		s.lru.Remove(back)
+		delete(s.entries, back.Value.(*resourceEntry).key)
+	}
+	s.entries[k] = s.lru.PushFront(&resourceEntry{key: k, quantized: quantized, err: err})
+	return quantized, err
+}
+
+// swapStats returns the hits and misses of the cache and resets them
+func (c *resourceCache) swapStats() (hits, misses int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.SwapInt64(&c.hits, 0), atomic.SwapInt64(&c.misses, 0)
+}
+
+var resources = newResourceCache(DefaultResourceCacheSize)
+
+// SetResourceCacheSize sets the number of quantized resources cached, 0 to
+// quantize every resource. It must be called before quantizing any span.
+func SetResourceCacheSize(size int) {
+	resources = newResourceCache(size)
+}
+
+// SwapResourceCacheStats returns the number of resources found in the cache
+// and of the ones which had to be quantized since the last call
+func SwapResourceCacheStats() (hits, misses int64) {
+	return resources.swapStats()
+}
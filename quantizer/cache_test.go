@@ -0,0 +1,149 @@
+package quantizer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceCacheQuantize(t *testing.T) {
+	assert := assert.New(t)
+
+	spans := []model.Span{
+		SQLSpan("SELECT host, status FROM ec2_status WHERE org_id=42"),
+		SQLSpan("SELECT * FROM users WHERE users.id = '1 AND users.name = 'dog'"),
+		SQLSpan("SELECT articles.* FROM articles WHERE articles.id IN (1, 3, 5)" + strings.Repeat(" ", maxResourceKeyLength)),
+		CassSpan("select * from users where id = 42"),
+		RedisSpan("CONFIG SET parameter value\nGET k1\nSET k2 v2\nDEL k3"),
+	}
+
+	defer SetResourceCacheSize(DefaultResourceCacheSize)
+	SetResourceCacheSize(0)
+	var direct []model.Span
+	for _, s := range spans {
+		direct = append(direct, Quantize(copySpan(s)))
+	}
+
+	SetResourceCacheSize(100)
+	for i := 0; i < 2; i++ {
+		for j, s := range spans {
+			assert.Equal(direct[j], Quantize(copySpan(s)))
+		}
+	}
+	hits, misses := SwapResourceCacheStats()
+	assert.Equal(int64(len(spans)), hits)
+	assert.Equal(int64(len(spans)), misses)
+
+	// sql and cassandra spans are cached apart
+	n := 0
+	for i := range resources.shards {
+		n += len(resources.shards[i].entries)
+	}
+	assert.Equal(len(spans), n)
+}
+
+func copySpan(s model.Span) model.Span {
+	meta := make(map[string]string, len(s.Meta))
+	for k, v := range s.Meta {
+		meta[k] = v
+	}
+	s.Meta = meta
+	return s
+}
+
+func TestResourceCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	k := newResourceKey(sqlType, "SELECT 1")
+	assert.Equal(resourceKey{spanType: sqlType, resource: "SELECT 1"}, k)
+
+	long := "SELECT " + strings.Repeat("a", maxResourceKeyLength)
+	k = newResourceKey(sqlType, long)
+	assert.True(k.hashed)
+	assert.Len(k.resource, 20)
+	assert.Equal(k, newResourceKey(sqlType, long))
+	assert.NotEqual(k, newResourceKey(sqlType, long+"b"))
+}
+
+func TestResourceCacheSize(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newResourceCache(0))
+	c := newResourceCache(64)
+	for i := 0; i < 1000; i++ {
+		c.quantize(sqlType, fmt.Sprintf("SELECT %d", i), func(s string) (string, error) { return s, nil })
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		assert.True(len(s.entries) <= c.shardCap)
+		assert.Equal(len(s.entries), s.lru.Len())
+	}
+
+	// the most recently used are kept
+	k := newResourceKey(sqlType, "SELECT 999")
+	_, ok := c.shard(k).entries[k]
+	assert.True(ok)
+}
+
+func TestResourceCacheConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newResourceCache(16)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r := fmt.Sprintf("get k%d", i%50)
+				q, err := c.quantize(redisType, r, func(s string) (string, error) { return strings.ToUpper(s), nil })
+				assert.Nil(err)
+				assert.Equal(strings.ToUpper(r), q)
+			}
+		}()
+	}
+	wg.Wait()
+	hits, misses := c.swapStats()
+	assert.Equal(int64(8000), hits+misses)
+}
+
+// BenchmarkQuantizeResourceCache quantizes SQL spans, 90% of them with one of
+// a few repeated resources, with and without the cache
+func BenchmarkQuantizeResourceCache(b *testing.B) {
+	repeated := []string{
+		"SELECT host, status FROM ec2_status WHERE org_id = 42",
+		"SELECT articles.* FROM articles WHERE articles.id IN (1, 3, 5)",
+		"SELECT clients.* FROM clients INNER JOIN posts ON posts.author_id = author.id AND posts.published = 't'",
+		`INSERT INTO delayed_jobs (created_at, failed_at, handler) VALUES (0, '2016-12-04 17:09:59', NULL), (0, '2016-12-04 17:09:59', NULL)`,
+	}
+	spans := make([]model.Span, 1000)
+	for i := range spans {
+		if i%10 == 0 {
+			spans[i] = SQLSpan(fmt.Sprintf("SELECT * FROM users WHERE id = %d AND name = 'user%d'", i, i))
+		} else {
+			spans[i] = SQLSpan(repeated[i%len(repeated)])
+		}
+	}
+
+	defer SetResourceCacheSize(DefaultResourceCacheSize)
+	for _, bm := range []struct {
+		name string
+		size int
+	}{
+		{"uncached", 0},
+		{"cached", DefaultResourceCacheSize},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			SetResourceCacheSize(bm.size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				Quantize(spans[i%len(spans)])
+			}
+		})
+	}
+}
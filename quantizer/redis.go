@@ -19,7 +19,14 @@ var redisCompoundCommandSet = map[string]bool{
 
 // QuantizeRedis generates resource for Redis spans
 func QuantizeRedis(span model.Span) model.Span {
-	query := compactWhitespaces(span.Resource)
+	span.Resource, _ = resources.quantize(span.Type, span.Resource, quantizeRedisQuery)
+	return span
+}
+
+// quantizeRedisQuery returns the resource of the Redis query, its first
+// commands
+func quantizeRedisQuery(query string) (string, error) {
+	query = compactWhitespaces(query)
 
 	var resource bytes.Buffer
 	truncated := false
@@ -74,7 +81,5 @@ func QuantizeRedis(span model.Span) model.Span {
 		resource.WriteString(" ...")
 	}
 
-	span.Resource = strings.Trim(resource.String(), " ")
-
-	return span
+	return strings.Trim(resource.String(), " "), nil
 }
@@ -207,7 +207,7 @@ func QuantizeSQL(span model.Span) model.Span {
 		return span
 	}
 
-	quantizedString, err := tokenQuantizer.Process(span.Resource)
+	quantizedString, err := resources.quantize(span.Type, span.Resource, tokenQuantizer.Process)
 
 	if err != nil {
 		// if we have an error, the partially parsed SQL is discarded so that we don't pollute
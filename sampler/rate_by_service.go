@@ -0,0 +1,42 @@
+package sampler
+
+import (
+	"sync"
+)
+
+// RateByService stores the last sample rate applied to the traces of each
+// service and env, so that it can be fed back to the clients.
+type RateByService struct {
+	mu    sync.RWMutex
+	rates map[string]float64
+}
+
+// NewRateByService returns an empty RateByService
+func NewRateByService() *RateByService {
+	return &RateByService{rates: make(map[string]float64)}
+}
+
+// RateByServiceKey returns the key identifying a service and env, for
+// instance "service:django,env:prod".
+func RateByServiceKey(service, env string) string {
+	return "service:" + service + ",env:" + env
+}
+
+// Set stores the rate applied to the traces of the given service and env
+func (rbs *RateByService) Set(service, env string, rate float64) {
+	rbs.mu.Lock()
+	rbs.rates[RateByServiceKey(service, env)] = rate
+	rbs.mu.Unlock()
+}
+
+// GetAll returns a copy of all the rates, by service and env key
+func (rbs *RateByService) GetAll() map[string]float64 {
+	rbs.mu.RLock()
+	defer rbs.mu.RUnlock()
+
+	ret := make(map[string]float64, len(rbs.rates))
+	for k, v := range rbs.rates {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,27 @@
+package sampler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateByService(t *testing.T) {
+	assert := assert.New(t)
+	rbs := NewRateByService()
+	assert.Len(rbs.GetAll(), 0)
+
+	rbs.Set("django", "prod", 0.5)
+	rbs.Set("django", "staging", 1)
+	rbs.Set("django", "prod", 0.25)
+
+	rates := rbs.GetAll()
+	assert.Equal(map[string]float64{
+		"service:django,env:prod":    0.25,
+		"service:django,env:staging": 1,
+	}, rates)
+
+	// the returned map is a copy
+	rates["service:django,env:prod"] = 1
+	assert.Equal(0.25, rbs.GetAll()["service:django,env:prod"])
+}
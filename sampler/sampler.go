@@ -33,6 +33,8 @@ const (
 type Sampler struct {
 	// Storage of the state of the sampler
 	Backend *Backend
+	// Last rates applied by service, fed back to the clients
+	RateByService *RateByService
 
 	// Extra sampling rate to combine to the existing sampling
 	extraRate float64
@@ -55,9 +57,10 @@ func NewSampler(extraRate float64, maxTPS float64) *Sampler {
 	decayPeriod := defaultDecayPeriod
 
 	s := &Sampler{
-		Backend:   NewBackend(decayPeriod),
-		extraRate: extraRate,
-		maxTPS:    maxTPS,
+		Backend:       NewBackend(decayPeriod),
+		RateByService: NewRateByService(),
+		extraRate:     extraRate,
+		maxTPS:        maxTPS,
 
 		exit: make(chan struct{}),
 	}
@@ -127,6 +130,7 @@ func (s *Sampler) Sample(trace model.Trace, root *model.Span, env string) bool {
 
 	sampled := ApplySampleRate(root, sampleRate)
 
+	maxTPSrate := 1.0
 	if sampled {
 		// Count the trace to allow us to check for the maxTPS limit.
 		// It has to happen before the maxTPS sampling.
@@ -134,12 +138,14 @@ func (s *Sampler) Sample(trace model.Trace, root *model.Span, env string) bool {
 
 		// Check for the maxTPS limit, and if we require an extra sampling.
 		// No need to check if we already decided not to keep the trace.
-		maxTPSrate := s.GetMaxTPSSampleRate()
+		maxTPSrate = s.GetMaxTPSSampleRate()
 		if maxTPSrate < 1 {
 			sampled = ApplySampleRate(root, maxTPSrate)
 		}
 	}
 
+	s.RateByService.Set(root.Service, env, sampleRate*maxTPSrate)
+
 	return sampled
 }
 
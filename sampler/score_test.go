@@ -18,6 +18,30 @@ func TestTrivialSampleByRate(t *testing.T) {
 	assert.True(SampleByRate(randomTraceID(), 1))
 }
 
+func TestSampleByRateVectors(t *testing.T) {
+	assert := assert.New(t)
+
+	// the decisions client tracers take for the same trace IDs and rates:
+	// keep if traceID*1111111111111111111 mod 2^64 < rate*(2^64-1)
+	for _, tc := range []struct {
+		traceID uint64
+		rate    float64
+		keep    bool
+	}{
+		{1, 0.1, true},                     // hash 1111111111111111111
+		{2, 0.1, false},                    // hash 2222222222222222222
+		{8, 0.5, true},                     // hash 8888888888888888888
+		{9, 0.5, false},                    // hash 9999999999999999999
+		{42, 0.5, false},                   // hash 9773178519247563430
+		{42, 0.53, true},                   // same hash, higher rate
+		{1 << 63, 0.5, false},              // hash 2^63, right at the threshold
+		{12345678901234567890, 0.1, false}, // hash 1908804064858086206
+		{12345678901234567890, 0.11, true},
+	} {
+		assert.Equal(tc.keep, SampleByRate(tc.traceID, tc.rate), "trace %d at %v", tc.traceID, tc.rate)
+	}
+}
+
 func TestSampleRateManyTraces(t *testing.T) {
 	// Test that the effective sample rate isn't far from the theoretical
 	// Test with multiple sample rates
@@ -0,0 +1,127 @@
+// Package watch abstracts the clock of the agent, so that tests can control
+// the time its components see.
+package watch
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and times events
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers ticks at intervals, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock of the time package
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// FakeClock is a Clock whose time only moves with Advance, for tests
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a ticker, or a timer of After when period is 0
+type fakeTimer struct {
+	clock   *FakeClock
+	c       chan time.Time
+	next    time.Time
+	period  time.Duration
+	stopped bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+// NewFakeClock returns a FakeClock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return c.add(d, d)
+}
+
+// After implements Clock
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), next: c.now.Add(d), period: period}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+// Stop stops the ticker, no more ticks are sent once it returns
+func (t *fakeTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+// Advance moves the time forward by d, firing the tickers and timers due
+// on the way. As with time.Ticker, ticks are dropped for the slow readers.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// fire sends the ticks due at c.now. c.mu must be held.
+func (c *FakeClock) fire() {
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			if t.period == 0 {
+				t.stopped = true
+				break
+			}
+			t.next = t.next.Add(t.period)
+		}
+		if !t.stopped {
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+}
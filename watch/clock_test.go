@@ -0,0 +1,77 @@
+package watch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Unix(1500000000, 0)
+	c := NewFakeClock(start)
+	assert.Equal(start, c.Now())
+
+	ticker := c.NewTicker(10 * time.Second)
+	after := c.After(15 * time.Second)
+	pending := func(ch <-chan time.Time) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	c.Advance(9 * time.Second)
+	assert.Equal(start.Add(9*time.Second), c.Now())
+	assert.False(pending(ticker.C()))
+	assert.False(pending(after))
+
+	c.Advance(time.Second)
+	select {
+	case tick := <-ticker.C():
+		assert.Equal(start.Add(10*time.Second), tick)
+	default:
+		t.Fatal("the ticker should have ticked")
+	}
+	assert.False(pending(after))
+
+	// late readers miss ticks, timers fire once
+	c.Advance(time.Minute)
+	assert.True(pending(ticker.C()))
+	assert.False(pending(ticker.C()))
+	assert.True(pending(after))
+
+	// stopped tickers do not tick
+	ticker.Stop()
+	c.Advance(time.Minute)
+	assert.False(pending(ticker.C()))
+	assert.False(pending(after))
+
+	// timers already due fire right away
+	assert.True(pending(c.After(0)))
+}
+
+func TestRealClock(t *testing.T) {
+	assert := assert.New(t)
+
+	before := time.Now()
+	now := Real.Now()
+	assert.False(now.Before(before))
+
+	ticker := Real.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+	case <-time.After(time.Second):
+		t.Fatal("the ticker did not tick")
+	}
+	select {
+	case <-Real.After(time.Millisecond):
+	case <-time.After(time.Second):
+		t.Fatal("the timer did not fire")
+	}
+}